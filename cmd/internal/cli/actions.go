@@ -79,10 +79,11 @@ func handleOCI(ctx context.Context, imgCache *cache.Handle, cmd *cobra.Command,
 	}
 
 	pullOpts := oci.PullOptions{
-		TmpDir:     tmpDir,
-		OciAuth:    ociAuth,
-		DockerHost: dockerHost,
-		NoHTTPS:    noHTTPS,
+		TmpDir:          tmpDir,
+		OciAuth:         ociAuth,
+		DockerHost:      dockerHost,
+		NoHTTPS:         noHTTPS,
+		DefaultRegistry: getDefaultPullRegistry(),
 	}
 
 	return oci.Pull(ctx, imgCache, pullFrom, pullOpts)
@@ -102,20 +103,27 @@ func handleLibrary(ctx context.Context, imgCache *cache.Handle, pullFrom string)
 		return "", err
 	}
 
-	// Default "" = use current remote endpoint
-	var libraryURI string
-	if r.Host != "" {
-		if noHTTPS {
-			libraryURI = "http://" + r.Host
-		} else {
-			libraryURI = "https://" + r.Host
-		}
-	}
-
-	c, err := getLibraryClientConfig(libraryURI)
+	// the host of r can be the name, or an alias, of a remote
+	c, err := getRemoteLibraryClientConfig(r)
 	if err != nil {
 		return "", err
 	}
+	if c == nil {
+		// Default "" = use current remote endpoint
+		var libraryURI string
+		if r.Host != "" {
+			if noHTTPS {
+				libraryURI = "http://" + r.Host
+			} else {
+				libraryURI = "https://" + r.Host
+			}
+		}
+
+		c, err = getLibraryClientConfig(libraryURI)
+		if err != nil {
+			return "", err
+		}
+	}
 	return library.Pull(ctx, imgCache, r, runtime.GOARCH, tmpDir, c)
 }
 
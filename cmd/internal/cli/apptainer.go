@@ -16,6 +16,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -59,6 +60,8 @@ var (
 	dockerAuthConfig ocitypes.DockerAuthConfig
 	dockerLogin      bool
 	dockerHost       string
+	dockerClientCert string
+	dockerClientKey  string
 
 	encryptionPEMPath   string
 	promptForPassphrase bool
@@ -178,6 +181,26 @@ var dockerHostFlag = cmdline.Flag{
 	WithoutPrefix: true,
 }
 
+// --docker-client-cert
+var dockerClientCertFlag = cmdline.Flag{
+	ID:           "dockerClientCertFlag",
+	Value:        &dockerClientCert,
+	DefaultValue: "",
+	Name:         "docker-client-cert",
+	Usage:        "path to a PEM encoded client certificate for registries requiring mutual TLS, used with --docker-client-key",
+	EnvKeys:      []string{"DOCKER_CLIENT_CERT"},
+}
+
+// --docker-client-key
+var dockerClientKeyFlag = cmdline.Flag{
+	ID:           "dockerClientKeyFlag",
+	Value:        &dockerClientKey,
+	DefaultValue: "",
+	Name:         "docker-client-key",
+	Usage:        "path to the PEM encoded private key of the --docker-client-cert certificate",
+	EnvKeys:      []string{"DOCKER_CLIENT_KEY"},
+}
+
 // --passphrase
 var commonPromptForPassphraseFlag = cmdline.Flag{
 	ID:           "commonPromptForPassphraseFlag",
@@ -738,26 +761,36 @@ func loadRemoteConf(filepath string) (*remote.Config, error) {
 	return c, nil
 }
 
-// getRemote returns the remote in use or an error
-func getRemote() (*endpoint.Config, error) {
-	var c *remote.Config
-
-	// try to load both remotes, check for errors, sync if both exist,
-	// if neither exist return errNoDefault to return to old auth behavior
+// loadRemoteConfig returns the remote configuration of the user synced with
+// the system one, or nil if neither exist.
+func loadRemoteConfig() (*remote.Config, error) {
+	// try to load both remotes, check for errors, sync if both exist
 	cSys, sysErr := loadRemoteConf(remote.SystemConfigPath)
 	cUsr, usrErr := loadRemoteConf(syfs.RemoteConf())
 	if sysErr != nil && usrErr != nil {
-		return endpoint.DefaultEndpointConfig, nil
+		return nil, nil
 	} else if sysErr != nil {
-		c = cUsr
+		return cUsr, nil
 	} else if usrErr != nil {
-		c = cSys
-	} else {
-		// sync cUsr with system config cSys
-		if err := cUsr.SyncFrom(cSys); err != nil {
-			return nil, err
-		}
-		c = cUsr
+		return cSys, nil
+	}
+
+	// sync cUsr with system config cSys
+	if err := cUsr.SyncFrom(cSys); err != nil {
+		return nil, err
+	}
+	return cUsr, nil
+}
+
+// getRemote returns the remote in use or an error
+func getRemote() (*endpoint.Config, error) {
+	// if neither remote configuration exist return the default endpoint
+	// to return to old auth behavior
+	c, err := loadRemoteConfig()
+	if err != nil {
+		return nil, err
+	} else if c == nil {
+		return endpoint.DefaultEndpointConfig, nil
 	}
 
 	ep, err := c.GetDefault()
@@ -782,6 +815,18 @@ func getRemote() (*endpoint.Config, error) {
 	return ep, err
 }
 
+// getDefaultPullRegistry returns the default pull registry of the remote in
+// use, resolving the docker references not naming their registry, or an
+// empty string if none is set or the remote can't be loaded.
+func getDefaultPullRegistry() string {
+	ep, err := getRemote()
+	if err != nil {
+		sylog.Debugf("Not using the default pull registry of the active remote: %s", err)
+		return ""
+	}
+	return ep.DefaultPullRegistry
+}
+
 func apptainerExec(image string, args []string) (string, error) {
 	// Record from stdout and store as a string to return as the contents of the file.
 	var stdout bytes.Buffer
@@ -880,3 +925,42 @@ func getLibraryClientConfig(uri string) (*libClient.Config, error) {
 	}
 	return libClientConfig, nil
 }
+
+// getRemoteLibraryClientConfig returns the client config of the library of
+// the remote aliased by the host of the library ref, e.g.
+// library://alias/entity/collection/container, and replaces that host with
+// the one of the library. It returns nil when the host isn't an alias: the
+// names of the remotes aren't resolved, as they could be the host of a
+// library.
+func getRemoteLibraryClientConfig(ref *libClient.Ref) (*libClient.Config, error) {
+	if ref.Host == "" {
+		return nil, nil
+	}
+	c, err := loadRemoteConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load remote configuration: %v", err)
+	} else if c == nil {
+		return nil, nil
+	}
+	name, ok := c.ResolveAlias(ref.Host)
+	if !ok {
+		return nil, nil
+	}
+	if ep, err := c.GetDefault(); err == nil && ep.Exclusive && name != c.DefaultRemote {
+		return nil, fmt.Errorf("endpoint is set as exclusive by the system administrator: only remote %s can be used", c.DefaultRemote)
+	}
+
+	libClientConfig, err := c.Remotes[name].LibraryClientConfig("")
+	if err != nil {
+		return nil, err
+	}
+	if libClientConfig.BaseURL == "" {
+		return nil, fmt.Errorf("remote %s has no library client", name)
+	}
+	u, err := url.Parse(libClientConfig.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing library URI of remote %s: %v", name, err)
+	}
+	ref.Host = u.Host
+	return libClientConfig, nil
+}
@@ -17,6 +17,7 @@ import (
 	"syscall"
 
 	"github.com/apptainer/apptainer/docs"
+	"github.com/apptainer/apptainer/internal/pkg/build"
 	"github.com/apptainer/apptainer/internal/pkg/util/fs"
 	"github.com/apptainer/apptainer/internal/pkg/util/interactive"
 	"github.com/apptainer/apptainer/pkg/cmdline"
@@ -37,10 +38,73 @@ var buildArgs struct {
 	encrypt             bool
 	fakeroot            bool
 	fixPerms            bool
+	normalizeOwnership  bool
+	includePaths        []string
+	provenance          bool
+	buildProvenance     bool
+	layerHistory        bool
+	sbom                bool
+	preserveManifest    bool
+	healthcheck         bool
+	testScript          string
+	idPreflight         bool
+	warningsAsErrors    bool
+	verifyLayers        bool
+	verifyRootfs        bool
+	verifyGzip          bool
+	parallelGzip        bool
+	ignorePlatform      bool
+	archVariant         string
+	platform            string
+	contentTrust        bool
+	contentTrustServer  string
+	chunkSize           string
+	limitRate           string
+	pullThroughCache    string
+	sharedBlobCache     string
+	allowedRegistries   []string
+	allowRootUser       bool
+	manifestTimeout     string
+	prunePatterns       []string
+	pruneProfile        string
+	pruneDryRun         bool
+	normalizeNetFiles   string
+	normalizeEnv        bool
+	extractRetries      int
+	maxFiles            int
+	maxFileSize         string
+	oversizedFiles      string
+	acls                string
+	maxExtractMemory    string
+	maxExtractCPUTime   string
+	extractBufferSize   string
+	sparseFiles         bool
+	keepDirlinks        bool
+	extractUIDMap       []string
+	extractGIDMap       []string
+	lockFile            string
+	updateLock          bool
+	permsState          string
+	selinuxLabels       string
+	containerdAddress   string
+	containerdNamespace string
+	mergeSources        []string
+	keepGoing           bool
+	unknownMediaTypes   string
+	danglingHardlinks   string
+	symlinkLoops        string
+	latestTag           string
+	runnableCheck       string
+	logFile             string
+	compression         string
+	compressionLevel    int
+	jsonErrors          bool
 	isJSON              bool
 	noCleanUp           bool
 	noTest              bool
 	sandbox             bool
+	outputFormat        string
+	contentAddressed    bool
 	update              bool
 	nvidia              bool
 	nvccli              bool
@@ -54,6 +118,9 @@ var buildArgs struct {
 	buildVarArgs        []string // Variables passed to build procedure.
 	buildVarArgFile     string   // Variables file passed to build procedure.
 	buildArgsUnusedWarn bool     // Variables passed to build procedure to turn fatal error to warn.
+	gitSubmodules       bool
+	gitUsername         string
+	gitPassword         string
 }
 
 // -s|--sandbox
@@ -67,6 +134,26 @@ var buildSandboxFlag = cmdline.Flag{
 	EnvKeys:      []string{"SANDBOX"},
 }
 
+// --output-format
+var buildOutputFormatFlag = cmdline.Flag{
+	ID:           "buildOutputFormatFlag",
+	Value:        &buildArgs.outputFormat,
+	DefaultValue: "",
+	Name:         "output-format",
+	Usage:        "format of the built image (sandbox, sif, oci-layout, oci-archive), sif by default",
+	EnvKeys:      []string{"OUTPUT_FORMAT"},
+}
+
+// --content-addressed
+var buildContentAddressedFlag = cmdline.Flag{
+	ID:           "buildContentAddressedFlag",
+	Value:        &buildArgs.contentAddressed,
+	DefaultValue: false,
+	Name:         "content-addressed",
+	Usage:        "build the image in the destination directory under a name derived from the source digests and the build options, skipping the build if it exists",
+	EnvKeys:      []string{"CONTENT_ADDRESSED"},
+}
+
 // --section
 var buildSectionFlag = cmdline.Flag{
 	ID:           "buildSectionFlag",
@@ -171,6 +258,648 @@ var buildFixPermsFlag = cmdline.Flag{
 	EnvKeys:      []string{"FIXPERMS"},
 }
 
+// --normalize-ownership
+var buildNormalizeOwnershipFlag = cmdline.Flag{
+	ID:           "buildNormalizeOwnershipFlag",
+	Value:        &buildArgs.normalizeOwnership,
+	DefaultValue: false,
+	Name:         "normalize-ownership",
+	Usage:        "set the ownership of all container content to root:root, for SIF images built from oci/docker or cpio sources",
+	EnvKeys:      []string{"NORMALIZE_OWNERSHIP"},
+}
+
+// --include-path
+var buildIncludePathFlag = cmdline.Flag{
+	ID:           "buildIncludePathFlag",
+	Value:        &buildArgs.includePaths,
+	DefaultValue: []string{},
+	Name:         "include-path",
+	Usage:        "only extract the given paths from oci/docker sources, producing a non-complete root filesystem",
+	EnvKeys:      []string{"INCLUDE_PATH"},
+}
+
+// --provenance
+var buildProvenanceFlag = cmdline.Flag{
+	ID:           "buildProvenanceFlag",
+	Value:        &buildArgs.provenance,
+	DefaultValue: false,
+	Name:         "provenance",
+	Usage:        "record the oci/docker source layer providing each file in the SIF image metadata",
+	EnvKeys:      []string{"PROVENANCE"},
+}
+
+// --build-provenance
+var buildBuildProvenanceFlag = cmdline.Flag{
+	ID:           "buildBuildProvenanceFlag",
+	Value:        &buildArgs.buildProvenance,
+	DefaultValue: false,
+	Name:         "build-provenance",
+	Usage:        "record the apptainer version, host platform, build mode and source of the build in the SIF image metadata",
+	EnvKeys:      []string{"BUILD_PROVENANCE"},
+}
+
+// --layer-history
+var buildLayerHistoryFlag = cmdline.Flag{
+	ID:           "buildLayerHistoryFlag",
+	Value:        &buildArgs.layerHistory,
+	DefaultValue: false,
+	Name:         "layer-history",
+	Usage:        "record the history of the layers of oci/docker sources in the SIF image metadata, shown by inspect --history",
+	EnvKeys:      []string{"LAYER_HISTORY"},
+}
+
+// --sbom
+var buildSBOMFlag = cmdline.Flag{
+	ID:           "buildSBOMFlag",
+	Value:        &buildArgs.sbom,
+	DefaultValue: false,
+	Name:         "sbom",
+	Usage:        "record the packages installed by oci/docker sources in the SIF image metadata",
+	EnvKeys:      []string{"SBOM"},
+}
+
+// --preserve-manifest
+var buildPreserveManifestFlag = cmdline.Flag{
+	ID:           "buildPreserveManifestFlag",
+	Value:        &buildArgs.preserveManifest,
+	DefaultValue: false,
+	Name:         "preserve-manifest",
+	Usage:        "store the manifest and config of the oci/docker source verbatim in the SIF image metadata",
+	EnvKeys:      []string{"PRESERVE_MANIFEST"},
+}
+
+// --healthcheck
+var buildHealthcheckFlag = cmdline.Flag{
+	ID:           "buildHealthcheckFlag",
+	Value:        &buildArgs.healthcheck,
+	DefaultValue: false,
+	Name:         "healthcheck",
+	Usage:        "use the healthcheck of the oci/docker source image as the test script run by apptainer test, unless the definition has a %test section",
+	EnvKeys:      []string{"HEALTHCHECK"},
+}
+
+// --test-script
+var buildTestScriptFlag = cmdline.Flag{
+	ID:           "buildTestScriptFlag",
+	Value:        &buildArgs.testScript,
+	DefaultValue: "",
+	Name:         "test-script",
+	Usage:        "path of a script embedded as the test script run by apptainer test, replacing the %test section of the definition",
+	EnvKeys:      []string{"TEST_SCRIPT"},
+}
+
+// --id-preflight
+var buildIDPreflightFlag = cmdline.Flag{
+	ID:           "buildIDPreflightFlag",
+	Value:        &buildArgs.idPreflight,
+	DefaultValue: false,
+	Name:         "id-preflight",
+	Usage:        "report the uids/gids owning the oci/docker source content before extracting it, and warn about those which can't be mapped",
+	EnvKeys:      []string{"ID_PREFLIGHT"},
+}
+
+// --warnings-as-errors
+var buildWarningsAsErrorsFlag = cmdline.Flag{
+	ID:           "buildWarningsAsErrorsFlag",
+	Value:        &buildArgs.warningsAsErrors,
+	DefaultValue: false,
+	Name:         "warnings-as-errors",
+	Usage:        "fail the build when warnings about the oci/docker source content are emitted during its extraction",
+	EnvKeys:      []string{"WARNINGS_AS_ERRORS"},
+}
+
+// --verify-layers
+var buildVerifyLayersFlag = cmdline.Flag{
+	ID:           "buildVerifyLayersFlag",
+	Value:        &buildArgs.verifyLayers,
+	DefaultValue: false,
+	Name:         "verify-layers",
+	Usage:        "check that all of the layers of oci/docker sources were applied in order after their extraction",
+	EnvKeys:      []string{"VERIFY_LAYERS"},
+}
+
+// --verify-rootfs
+var buildVerifyRootfsFlag = cmdline.Flag{
+	ID:           "buildVerifyRootfsFlag",
+	Value:        &buildArgs.verifyRootfs,
+	DefaultValue: false,
+	Name:         "verify-rootfs",
+	Usage:        "check the rootfs extracted from oci/docker sources against the content of their layers, reading them again",
+	EnvKeys:      []string{"VERIFY_ROOTFS"},
+}
+
+// --verify-gzip
+var buildVerifyGzipFlag = cmdline.Flag{
+	ID:           "buildVerifyGzipFlag",
+	Value:        &buildArgs.verifyGzip,
+	DefaultValue: false,
+	Name:         "verify-gzip",
+	Usage:        "check the CRC-32 and size trailer of the gzip layers of oci/docker sources, failing on a truncated or corrupted layer",
+	EnvKeys:      []string{"VERIFY_GZIP"},
+}
+
+// --parallel-gzip
+var buildParallelGzipFlag = cmdline.Flag{
+	ID:           "buildParallelGzipFlag",
+	Value:        &buildArgs.parallelGzip,
+	DefaultValue: false,
+	Name:         "parallel-gzip",
+	Usage:        "use multiple threads to decompress gzip layers of oci/docker sources",
+	EnvKeys:      []string{"PARALLEL_GZIP"},
+}
+
+// --ignore-platform
+var buildIgnorePlatformFlag = cmdline.Flag{
+	ID:           "buildIgnorePlatformFlag",
+	Value:        &buildArgs.ignorePlatform,
+	DefaultValue: false,
+	Name:         "ignore-platform",
+	Usage:        "build from oci/docker sources whose OS or architecture doesn't match the host",
+	EnvKeys:      []string{"IGNORE_PLATFORM"},
+}
+
+// --arch-variant
+var buildArchVariantFlag = cmdline.Flag{
+	ID:           "buildArchVariantFlag",
+	Value:        &buildArgs.archVariant,
+	DefaultValue: "",
+	Name:         "arch-variant",
+	Usage:        "architecture variant (e.g. v7) of the image to select from the image index of oci/docker sources",
+	EnvKeys:      []string{"ARCH_VARIANT"},
+}
+
+// --platform
+var buildPlatformFlag = cmdline.Flag{
+	ID:           "buildPlatformFlag",
+	Value:        &buildArgs.platform,
+	DefaultValue: "",
+	Name:         "platform",
+	Usage:        "platform (os/arch[/variant]) of the image to select from the image index of oci/docker sources, or all to build an image for each platform",
+	EnvKeys:      []string{"PLATFORM"},
+}
+
+// --content-trust
+var buildContentTrustFlag = cmdline.Flag{
+	ID:           "buildContentTrustFlag",
+	Value:        &buildArgs.contentTrust,
+	DefaultValue: false,
+	Name:         "content-trust",
+	Usage:        "require docker sources to be signed with Docker Content Trust",
+	EnvKeys:      []string{"CONTENT_TRUST"},
+}
+
+// --content-trust-server
+var buildContentTrustServerFlag = cmdline.Flag{
+	ID:           "buildContentTrustServerFlag",
+	Value:        &buildArgs.contentTrustServer,
+	DefaultValue: "",
+	Name:         "content-trust-server",
+	Usage:        "notary server holding the trust data of docker sources (default derived from the registry)",
+	EnvKeys:      []string{"CONTENT_TRUST_SERVER"},
+}
+
+// --chunk-size
+var buildChunkSizeFlag = cmdline.Flag{
+	ID:           "buildChunkSizeFlag",
+	Value:        &buildArgs.chunkSize,
+	DefaultValue: "",
+	Name:         "chunk-size",
+	Usage:        "fetch docker source layers larger than this size (e.g. 64M) with resumable range requests",
+	EnvKeys:      []string{"CHUNK_SIZE"},
+}
+
+// --limit-rate
+var buildLimitRateFlag = cmdline.Flag{
+	ID:           "buildLimitRateFlag",
+	Value:        &buildArgs.limitRate,
+	DefaultValue: "",
+	Name:         "limit-rate",
+	Usage:        "limit the download rate of docker and oci-http sources to this many bytes per second (e.g. 10M)",
+	EnvKeys:      []string{"LIMIT_RATE"},
+}
+
+// --pull-through-cache
+var buildPullThroughCacheFlag = cmdline.Flag{
+	ID:           "buildPullThroughCacheFlag",
+	Value:        &buildArgs.pullThroughCache,
+	DefaultValue: "",
+	Name:         "pull-through-cache",
+	Usage:        "resolve docker sources not naming their registry through this pull-through cache of Docker Hub (e.g. cache.example.com:5000/dockerhub)",
+	EnvKeys:      []string{"PULL_THROUGH_CACHE"},
+}
+
+// --shared-blob-cache
+var buildSharedBlobCacheFlag = cmdline.Flag{
+	ID:           "buildSharedBlobCacheFlag",
+	Value:        &buildArgs.sharedBlobCache,
+	DefaultValue: "",
+	Name:         "shared-blob-cache",
+	Usage:        "fetch the blobs of docker sources from, and store them in, this blob cache directory shared across users",
+	EnvKeys:      []string{"SHARED_BLOB_CACHE"},
+}
+
+// --allowed-registries
+var buildAllowedRegistriesFlag = cmdline.Flag{
+	ID:           "buildAllowedRegistriesFlag",
+	Value:        &buildArgs.allowedRegistries,
+	DefaultValue: []string{},
+	Name:         "allowed-registries",
+	Usage:        "only allow docker, oras and library sources from these registry hosts, with an optional port and wildcards (e.g. docker.io,*.example.com)",
+	EnvKeys:      []string{"ALLOWED_REGISTRIES"},
+}
+
+// --allow-root-user
+var buildAllowRootUserFlag = cmdline.Flag{
+	ID:           "buildAllowRootUserFlag",
+	Value:        &buildArgs.allowRootUser,
+	DefaultValue: false,
+	Name:         "allow-root-user",
+	Usage:        "build from oci/docker sources running as root even if the configuration rejects them",
+	EnvKeys:      []string{"ALLOW_ROOT_USER"},
+}
+
+// --manifest-timeout
+var buildManifestTimeoutFlag = cmdline.Flag{
+	ID:           "buildManifestTimeoutFlag",
+	Value:        &buildArgs.manifestTimeout,
+	DefaultValue: "",
+	Name:         "manifest-timeout",
+	Usage:        "abandon and retry the manifest fetch of oci/docker sources after this duration (e.g. 30s)",
+	EnvKeys:      []string{"MANIFEST_TIMEOUT"},
+}
+
+// --prune
+var buildPruneFlag = cmdline.Flag{
+	ID:           "buildPruneFlag",
+	Value:        &buildArgs.prunePatterns,
+	DefaultValue: []string{},
+	Name:         "prune",
+	Usage:        "remove the container files matching the patterns once built, e.g. '*.a' or '/usr/share/man'",
+	EnvKeys:      []string{"PRUNE"},
+}
+
+// --prune-profile
+var buildPruneProfileFlag = cmdline.Flag{
+	ID:           "buildPruneProfileFlag",
+	Value:        &buildArgs.pruneProfile,
+	DefaultValue: "",
+	Name:         "prune-profile",
+	Usage:        "remove the container files of a prune profile once built, minimal removing the documentation, manual pages and non-English locales",
+	EnvKeys:      []string{"PRUNE_PROFILE"},
+}
+
+// --prune-dry-run
+var buildPruneDryRunFlag = cmdline.Flag{
+	ID:           "buildPruneDryRunFlag",
+	Value:        &buildArgs.pruneDryRun,
+	DefaultValue: false,
+	Name:         "prune-dry-run",
+	Usage:        "only report the container files which --prune and --prune-profile would remove",
+	EnvKeys:      []string{"PRUNE_DRY_RUN"},
+}
+
+// --compression
+var buildCompressionFlag = cmdline.Flag{
+	ID:           "buildCompressionFlag",
+	Value:        &buildArgs.compression,
+	DefaultValue: "",
+	Name:         "compression",
+	Usage:        "compression algorithm of the SIF image squashfs: gzip (default), lz4, lzo, xz or zstd",
+	EnvKeys:      []string{"COMPRESSION"},
+}
+
+// --compression-level
+var buildCompressionLevelFlag = cmdline.Flag{
+	ID:           "buildCompressionLevelFlag",
+	Value:        &buildArgs.compressionLevel,
+	DefaultValue: 0,
+	Name:         "compression-level",
+	Usage:        "compression level of the SIF image squashfs, 1-9 for gzip and lzo, 1-22 for zstd (0 for the default level)",
+	EnvKeys:      []string{"COMPRESSION_LEVEL"},
+}
+
+// --extract-retries
+var buildExtractRetriesFlag = cmdline.Flag{
+	ID:           "buildExtractRetriesFlag",
+	Value:        &buildArgs.extractRetries,
+	DefaultValue: 0,
+	Name:         "extract-retries",
+	Usage:        "retry the extraction of a layer of oci/docker sources this many times after a transient filesystem error",
+	EnvKeys:      []string{"EXTRACT_RETRIES"},
+}
+
+// --max-files
+var buildMaxFilesFlag = cmdline.Flag{
+	ID:           "buildMaxFilesFlag",
+	Value:        &buildArgs.maxFiles,
+	DefaultValue: 0,
+	Name:         "max-files",
+	Usage:        "abort the extraction of oci/docker sources holding more than this many files (0 for unlimited)",
+	EnvKeys:      []string{"MAX_FILES"},
+}
+
+// --max-file-size
+var buildMaxFileSizeFlag = cmdline.Flag{
+	ID:           "buildMaxFileSizeFlag",
+	Value:        &buildArgs.maxFileSize,
+	DefaultValue: "",
+	Name:         "max-file-size",
+	Usage:        "maximum size of a single file of the layers of oci/docker sources, e.g. 4GiB (unlimited by default)",
+	EnvKeys:      []string{"MAX_FILE_SIZE"},
+}
+
+// --oversized-files
+var buildOversizedFilesFlag = cmdline.Flag{
+	ID:           "buildOversizedFilesFlag",
+	Value:        &buildArgs.oversizedFiles,
+	DefaultValue: "",
+	Name:         "oversized-files",
+	Usage:        "handling of the files of oci/docker sources larger than --max-file-size (error, skip)",
+	EnvKeys:      []string{"OVERSIZED_FILES"},
+}
+
+// --acls
+var buildACLsFlag = cmdline.Flag{
+	ID:           "buildACLsFlag",
+	Value:        &buildArgs.acls,
+	DefaultValue: "",
+	Name:         "acls",
+	Usage:        "handling of the POSIX ACLs of the files of oci/docker sources (drop, preserve)",
+	EnvKeys:      []string{"ACLS"},
+}
+
+// --max-extract-memory
+var buildMaxExtractMemoryFlag = cmdline.Flag{
+	ID:           "buildMaxExtractMemoryFlag",
+	Value:        &buildArgs.maxExtractMemory,
+	DefaultValue: "",
+	Name:         "max-extract-memory",
+	Usage:        "abort the extraction of oci/docker sources once the build process uses more than this resident memory, e.g. 2GiB (best-effort, checked periodically)",
+	EnvKeys:      []string{"MAX_EXTRACT_MEMORY"},
+}
+
+// --max-extract-cpu-time
+var buildMaxExtractCPUTimeFlag = cmdline.Flag{
+	ID:           "buildMaxExtractCPUTimeFlag",
+	Value:        &buildArgs.maxExtractCPUTime,
+	DefaultValue: "",
+	Name:         "max-extract-cpu-time",
+	Usage:        "abort the extraction of oci/docker sources once it used more than this CPU time, e.g. 10m (best-effort, checked periodically)",
+	EnvKeys:      []string{"MAX_EXTRACT_CPU_TIME"},
+}
+
+// --extract-buffer-size
+var buildExtractBufferSizeFlag = cmdline.Flag{
+	ID:           "buildExtractBufferSizeFlag",
+	Value:        &buildArgs.extractBufferSize,
+	DefaultValue: "",
+	Name:         "extract-buffer-size",
+	Usage:        "size of the buffer copying the files of oci/docker sources to the rootfs (e.g. 1M, default 32K)",
+	EnvKeys:      []string{"EXTRACT_BUFFER_SIZE"},
+}
+
+// --git-submodules
+var buildGitSubmodulesFlag = cmdline.Flag{
+	ID:           "buildGitSubmodulesFlag",
+	Value:        &buildArgs.gitSubmodules,
+	DefaultValue: false,
+	Name:         "git-submodules",
+	Usage:        "check out the submodules of the git repositories built from (git+https://...)",
+	EnvKeys:      []string{"GIT_SUBMODULES"},
+}
+
+// --git-username
+var buildGitUsernameFlag = cmdline.Flag{
+	ID:           "buildGitUsernameFlag",
+	Value:        &buildArgs.gitUsername,
+	DefaultValue: "",
+	Name:         "git-username",
+	Usage:        "specify a username for the authentication to the http(s) git repositories built from",
+	Hidden:       true,
+	EnvKeys:      []string{"GIT_USERNAME"},
+}
+
+// --git-password
+var buildGitPasswordFlag = cmdline.Flag{
+	ID:           "buildGitPasswordFlag",
+	Value:        &buildArgs.gitPassword,
+	DefaultValue: "",
+	Name:         "git-password",
+	Usage:        "specify a password or a token for the authentication to the http(s) git repositories built from",
+	Hidden:       true,
+	EnvKeys:      []string{"GIT_PASSWORD"},
+}
+
+// --sparse
+var buildSparseFilesFlag = cmdline.Flag{
+	ID:           "buildSparseFilesFlag",
+	Value:        &buildArgs.sparseFiles,
+	DefaultValue: false,
+	Name:         "sparse",
+	Usage:        "extract the runs of zeros of the files of oci/docker sources as holes, if supported by the filesystem",
+	EnvKeys:      []string{"SPARSE"},
+}
+
+// --keep-dirlinks
+var buildKeepDirlinksFlag = cmdline.Flag{
+	ID:           "buildKeepDirlinksFlag",
+	Value:        &buildArgs.keepDirlinks,
+	DefaultValue: false,
+	Name:         "keep-dirlinks",
+	Usage:        "extract the directories of oci/docker sources through the symlinks to directories of the lower layers, instead of replacing the symlinks",
+	EnvKeys:      []string{"KEEP_DIRLINKS"},
+}
+
+// --extract-uid-map
+var buildExtractUIDMapFlag = cmdline.Flag{
+	ID:           "buildExtractUIDMapFlag",
+	Value:        &buildArgs.extractUIDMap,
+	DefaultValue: []string{},
+	Name:         "extract-uid-map",
+	Usage:        "map the uids of the content of oci/docker sources onto those of the rootfs (containerID:hostID[:size]), privileged extractions only",
+	EnvKeys:      []string{"EXTRACT_UID_MAP"},
+}
+
+// --extract-gid-map
+var buildExtractGIDMapFlag = cmdline.Flag{
+	ID:           "buildExtractGIDMapFlag",
+	Value:        &buildArgs.extractGIDMap,
+	DefaultValue: []string{},
+	Name:         "extract-gid-map",
+	Usage:        "map the gids of the content of oci/docker sources onto those of the rootfs (containerID:hostID[:size]), privileged extractions only",
+	EnvKeys:      []string{"EXTRACT_GID_MAP"},
+}
+
+// --lock-file
+var buildLockFileFlag = cmdline.Flag{
+	ID:           "buildLockFileFlag",
+	Value:        &buildArgs.lockFile,
+	DefaultValue: "",
+	Name:         "lock-file",
+	Usage:        "pin the tags of docker sources to the digests recorded in this lock file, recording the missing ones",
+	EnvKeys:      []string{"LOCK_FILE"},
+}
+
+// --update-lock
+var buildUpdateLockFlag = cmdline.Flag{
+	ID:           "buildUpdateLockFlag",
+	Value:        &buildArgs.updateLock,
+	DefaultValue: false,
+	Name:         "update-lock",
+	Usage:        "record the current digests of the tags of docker sources in the lock file (default apptainer-build.lock)",
+	EnvKeys:      []string{"UPDATE_LOCK"},
+}
+
+// --perms-state
+var buildPermsStateFlag = cmdline.Flag{
+	ID:           "buildPermsStateFlag",
+	Value:        &buildArgs.permsState,
+	DefaultValue: "",
+	Name:         "perms-state",
+	Usage:        "record the scan of a sandbox for restrictive permissions in this file, to only scan the layers changed since on a rebuild",
+	EnvKeys:      []string{"PERMS_STATE"},
+}
+
+// --selinux-labels
+var buildSELinuxLabelsFlag = cmdline.Flag{
+	ID:           "buildSELinuxLabelsFlag",
+	Value:        &buildArgs.selinuxLabels,
+	DefaultValue: "",
+	Name:         "selinux-labels",
+	Usage:        "apply the SELinux labels of the given file_contexts policy to the rootfs extracted from oci/docker sources",
+	EnvKeys:      []string{"SELINUX_LABELS"},
+}
+
+// --containerd-address
+var buildContainerdAddressFlag = cmdline.Flag{
+	ID:           "buildContainerdAddressFlag",
+	Value:        &buildArgs.containerdAddress,
+	DefaultValue: "",
+	Name:         "containerd-address",
+	Usage:        "socket of the containerd image store of containerd sources (default $CONTAINERD_ADDRESS or /run/containerd/containerd.sock)",
+	EnvKeys:      []string{"CONTAINERD_ADDRESS"},
+}
+
+// --containerd-namespace
+var buildContainerdNamespaceFlag = cmdline.Flag{
+	ID:           "buildContainerdNamespaceFlag",
+	Value:        &buildArgs.containerdNamespace,
+	DefaultValue: "",
+	Name:         "containerd-namespace",
+	Usage:        "namespace of the containerd image store of containerd sources, e.g. k8s.io (default $CONTAINERD_NAMESPACE or default)",
+	EnvKeys:      []string{"CONTAINERD_NAMESPACE"},
+}
+
+// --keep-going
+var buildKeepGoingFlag = cmdline.Flag{
+	ID:           "buildKeepGoingFlag",
+	Value:        &buildArgs.keepGoing,
+	DefaultValue: false,
+	Name:         "keep-going",
+	Usage:        "continue the extraction of oci/docker sources past a layer failing to extract, building a degraded image",
+	EnvKeys:      []string{"KEEP_GOING"},
+}
+
+// --unknown-media-types
+var buildUnknownMediaTypesFlag = cmdline.Flag{
+	ID:           "buildUnknownMediaTypesFlag",
+	Value:        &buildArgs.unknownMediaTypes,
+	DefaultValue: "",
+	Name:         "unknown-media-types",
+	Usage:        "handling of the layers of oci/docker sources with an unknown media type (error, passthrough, skip)",
+	EnvKeys:      []string{"UNKNOWN_MEDIA_TYPES"},
+}
+
+// --dangling-hardlinks
+var buildDanglingHardlinksFlag = cmdline.Flag{
+	ID:           "buildDanglingHardlinksFlag",
+	Value:        &buildArgs.danglingHardlinks,
+	DefaultValue: "",
+	Name:         "dangling-hardlinks",
+	Usage:        "handling of the hard links of oci/docker sources whose target isn't extracted (copy, skip, error)",
+	EnvKeys:      []string{"DANGLING_HARDLINKS"},
+}
+
+// --symlink-loops
+var buildSymlinkLoopsFlag = cmdline.Flag{
+	ID:           "buildSymlinkLoopsFlag",
+	Value:        &buildArgs.symlinkLoops,
+	DefaultValue: "",
+	Name:         "symlink-loops",
+	Usage:        "handling of the symlinks of the rootfs which loop or are nested too deeply (warn, remove, error, ignore)",
+	EnvKeys:      []string{"SYMLINK_LOOPS"},
+}
+
+// --latest-tag
+var buildLatestTagFlag = cmdline.Flag{
+	ID:           "buildLatestTagFlag",
+	Value:        &buildArgs.latestTag,
+	DefaultValue: "",
+	Name:         "latest-tag",
+	Usage:        "handling of the docker sources using the floating latest tag (warn, error, ignore)",
+	EnvKeys:      []string{"LATEST_TAG"},
+}
+
+// --check-runnable
+var buildRunnableCheckFlag = cmdline.Flag{
+	ID:           "buildRunnableCheckFlag",
+	Value:        &buildArgs.runnableCheck,
+	DefaultValue: "",
+	Name:         "check-runnable",
+	Usage:        "handling of the built containers holding neither the entrypoint of their oci/docker source nor a shell (ignore, warn, error)",
+	EnvKeys:      []string{"CHECK_RUNNABLE"},
+}
+
+// --log-file
+var buildLogFileFlag = cmdline.Flag{
+	ID:           "buildLogFileFlag",
+	Value:        &buildArgs.logFile,
+	DefaultValue: "",
+	Name:         "log-file",
+	Usage:        "copy the log lines of the source phase of the build, including the extraction of oci/docker sources, to this file",
+	EnvKeys:      []string{"LOG_FILE"},
+}
+
+// --json-errors
+var buildJSONErrorsFlag = cmdline.Flag{
+	ID:           "buildJSONErrorsFlag",
+	Value:        &buildArgs.jsonErrors,
+	DefaultValue: false,
+	Name:         "json-errors",
+	Usage:        "write a build failure to stderr as a JSON document, with the type of the failure and the source, layer and path involved",
+	EnvKeys:      []string{"JSON_ERRORS"},
+}
+
+// --normalize-net-files
+var buildNormalizeNetFilesFlag = cmdline.Flag{
+	ID:           "buildNormalizeNetFilesFlag",
+	Value:        &buildArgs.normalizeNetFiles,
+	DefaultValue: "",
+	Name:         "normalize-net-files",
+	Usage:        "replace /etc/resolv.conf and /etc/hosts of the extracted image by regular files bound over at runtime (empty, template)",
+	EnvKeys:      []string{"NORMALIZE_NET_FILES"},
+}
+
+// --merge-source
+var buildMergeSourceFlag = cmdline.Flag{
+	ID:           "buildMergeSourceFlag",
+	Value:        &buildArgs.mergeSources,
+	DefaultValue: []string{},
+	Name:         "merge-source",
+	Usage:        "extract the layers of the given oci/docker source URIs, in order, atop the oci/docker source of the build",
+	EnvKeys:      []string{"MERGE_SOURCE"},
+}
+
+// --normalize-env
+var buildNormalizeEnvFlag = cmdline.Flag{
+	ID:           "buildNormalizeEnvFlag",
+	Value:        &buildArgs.normalizeEnv,
+	DefaultValue: false,
+	Name:         "normalize-env",
+	Usage:        "drop the malformed and duplicate entries of the env of the image config of oci/docker sources, and set a default PATH if missing",
+	EnvKeys:      []string{"NORMALIZE_ENV"},
+}
+
 // --nv
 var buildNvFlag = cmdline.Flag{
 	ID:           "nvFlag",
@@ -323,11 +1052,77 @@ func init() {
 		cmdManager.RegisterFlagForCmd(&buildEncryptFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&buildFakerootFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&buildFixPermsFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildNormalizeOwnershipFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildIncludePathFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildProvenanceFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildBuildProvenanceFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildLayerHistoryFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildSBOMFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildPreserveManifestFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildHealthcheckFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildTestScriptFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildIDPreflightFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildWarningsAsErrorsFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildVerifyLayersFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildVerifyRootfsFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildVerifyGzipFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildParallelGzipFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildIgnorePlatformFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildArchVariantFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildPlatformFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildContentTrustFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildContentTrustServerFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildChunkSizeFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildLimitRateFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildPullThroughCacheFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildSharedBlobCacheFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildAllowedRegistriesFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildAllowRootUserFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildManifestTimeoutFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildPruneFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildPruneProfileFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildPruneDryRunFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildNormalizeNetFilesFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildNormalizeEnvFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildMergeSourceFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildCompressionFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildCompressionLevelFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildExtractRetriesFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildMaxFilesFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildMaxFileSizeFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildOversizedFilesFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildACLsFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildMaxExtractMemoryFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildMaxExtractCPUTimeFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildExtractBufferSizeFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildSparseFilesFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildGitSubmodulesFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildGitUsernameFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildGitPasswordFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildKeepDirlinksFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildExtractUIDMapFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildExtractGIDMapFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildLockFileFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildUpdateLockFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildPermsStateFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildSELinuxLabelsFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildContainerdAddressFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildContainerdNamespaceFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildKeepGoingFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildUnknownMediaTypesFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildDanglingHardlinksFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildSymlinkLoopsFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildLatestTagFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildRunnableCheckFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildLogFileFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildJSONErrorsFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&buildJSONFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&buildLibraryFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&buildNoCleanupFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&buildNoTestFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&buildSandboxFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildOutputFormatFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&buildContentAddressedFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&buildSectionFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&buildUpdateFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&commonForceFlag, buildCmd)
@@ -335,6 +1130,8 @@ func init() {
 		cmdManager.RegisterFlagForCmd(&commonTmpDirFlag, buildCmd)
 
 		cmdManager.RegisterFlagForCmd(&dockerHostFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&dockerClientCertFlag, buildCmd)
+		cmdManager.RegisterFlagForCmd(&dockerClientKeyFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&dockerUsernameFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&dockerPasswordFlag, buildCmd)
 		cmdManager.RegisterFlagForCmd(&dockerLoginFlag, buildCmd)
@@ -377,7 +1174,9 @@ var buildCmd = &cobra.Command{
 
 func preRun(cmd *cobra.Command, args []string) {
 	spec := args[len(args)-1]
-	isDeffile := fs.IsFile(spec) && !isImage(spec)
+	// a git repository is assumed to hold a definition file, its content
+	// being unknown until the build clones it
+	isDeffile := build.IsGitSpec(spec) || fs.IsFile(spec) && !isImage(spec)
 	if buildArgs.fakeroot {
 		fakerootExec(isDeffile, false)
 	} else {
@@ -398,6 +1197,23 @@ func preRun(cmd *cobra.Command, args []string) {
 	}
 }
 
+// resolveOutputFormat sets the output format of the build from the
+// --output-format and --sandbox flags, --sandbox being the sandbox output
+// format.
+func resolveOutputFormat() error {
+	switch {
+	case buildArgs.outputFormat == "":
+		buildArgs.outputFormat = "sif"
+		if buildArgs.sandbox {
+			buildArgs.outputFormat = "sandbox"
+		}
+	case buildArgs.sandbox && buildArgs.outputFormat != "sandbox":
+		return fmt.Errorf("--sandbox conflicts with --output-format %s", buildArgs.outputFormat)
+	}
+	buildArgs.sandbox = buildArgs.outputFormat == "sandbox"
+	return nil
+}
+
 // checkBuildTarget makes sure output target doesn't exist, or is ok to overwrite.
 // And checks that update flag will update an existing directory.
 func checkBuildTarget(path string) error {
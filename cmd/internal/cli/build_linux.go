@@ -16,9 +16,11 @@ import (
 	"fmt"
 	"os"
 	osExec "os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/apptainer/apptainer/internal/pkg/build"
 	"github.com/apptainer/apptainer/internal/pkg/build/args"
@@ -36,9 +38,11 @@ import (
 	"github.com/apptainer/apptainer/pkg/image"
 	"github.com/apptainer/apptainer/pkg/runtime/engine/config"
 	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/apptainer/apptainer/pkg/util/apptainerconf"
 	"github.com/apptainer/apptainer/pkg/util/cryptkey"
 	"github.com/apptainer/apptainer/pkg/util/namespaces"
 	keyClient "github.com/apptainer/container-key-client/client"
+	"github.com/docker/go-units"
 	"github.com/spf13/cobra"
 )
 
@@ -84,6 +88,7 @@ func fakerootExec(isDeffile, unprivEncrypt bool) {
 	// https://github.com/containers/image/issues/1066
 	// https://github.com/containers/image/blob/master/internal/rootless/rootless.go
 	os.Setenv("_CONTAINERS_ROOTLESS_UID", strconv.FormatUint(uint64(uid), 10))
+	os.Setenv(fakeroot.BuildEnv, "1")
 
 	if uid != 0 && (!fakeroot.IsUIDMapped(uid) || buildArgs.ignoreSubuid) {
 		sylog.Infof("User not listed in %v, trying root-mapped namespace", fakeroot.SubUIDFile)
@@ -145,6 +150,10 @@ func runBuild(cmd *cobra.Command, args []string) {
 	dest := args[0]
 	spec := args[1]
 
+	if err := resolveOutputFormat(); err != nil {
+		sylog.Fatalf("%s", err)
+	}
+
 	fakerootPath := ""
 	if os.Getenv("_APPTAINER_FAKEFAKEROOT") == "1" {
 		var err error
@@ -213,13 +222,38 @@ func runBuild(cmd *cobra.Command, args []string) {
 		os.Setenv("APPTAINER_WRITABLE_TMPFS", "1")
 	}
 
+	// the destination of a content-addressed image is a directory, the
+	// image path is checked once its name is known
+	if buildArgs.contentAddressed {
+		if fi, err := os.Stat(dest); err != nil || !fi.IsDir() {
+			sylog.Fatalf("While checking build target: %s must be an existing directory with --content-addressed", dest)
+		}
+	} else {
+		checkBuildOutput(cmd, dest)
+	}
+
+	runBuildLocal(cmd.Context(), cmd, dest, spec, fakerootPath)
+}
+
+// checkBuildOutput checks that the image can be built at dest.
+func checkBuildOutput(cmd *cobra.Command, dest string) {
+	opts := types.Options{
+		Update: buildArgs.update,
+		Force:  forceOverwrite,
+	}
+	// the encryption material is only read by runBuildLocal, once the
+	// target is checked
+	if buildArgs.encrypt || promptForPassphrase || cmd.Flags().Lookup("pem-path").Changed {
+		opts.EncryptionKeyInfo = &cryptkey.KeyInfo{}
+	}
+
 	// check if target collides with existing file
+	if err := build.ValidateOutput(buildArgs.outputFormat, dest, opts); err != nil {
+		sylog.Fatalf("While checking build target: %s", err)
+	}
 	if err := checkBuildTarget(dest); err != nil {
 		sylog.Fatalf("While checking build target: %s", err)
 	}
-
-	runBuildLocal(cmd.Context(), cmd, dest, spec, fakerootPath)
-	sylog.Infof("Build complete: %s", dest)
 }
 
 func runBuildLocal(ctx context.Context, cmd *cobra.Command, dst, spec string, fakerootPath string) {
@@ -268,10 +302,27 @@ func runBuildLocal(ctx context.Context, cmd *cobra.Command, dst, spec string, fa
 	if err != nil {
 		sylog.Fatalf("While processing the definition file: %v", err)
 	}
+	var checkout *build.GitCheckout
+	if build.IsGitSpec(spec) {
+		checkout, err = build.CloneGitSpec(ctx, spec, build.GitOptions{
+			TmpDir:     tmpDir,
+			Submodules: buildArgs.gitSubmodules,
+			Username:   buildArgs.gitUsername,
+			Password:   buildArgs.gitPassword,
+		})
+		if err != nil {
+			sylog.Fatalf("Unable to build from %s: %v", spec, err)
+		}
+		defer checkout.Remove()
+		spec = checkout.Spec
+	}
 	defs, unusedArgs, err := build.MakeAllDefs(spec, buildArgsMap)
 	if err != nil {
 		sylog.Fatalf("Unable to build from %s: %v", spec, err)
 	}
+	if checkout != nil {
+		checkout.ResolveFiles(defs)
+	}
 
 	if len(unusedArgs) > 0 {
 		if buildArgs.buildArgsUnusedWarn {
@@ -327,48 +378,302 @@ func runBuildLocal(ctx context.Context, cmd *cobra.Command, dst, spec string, fa
 		}
 	}
 
-	buildFormat := "sif"
-	sandboxTarget := false
-	if buildArgs.sandbox {
-		buildFormat = "sandbox"
-		sandboxTarget = true
-
-	}
-
-	b, err := build.New(
-		defs,
-		build.Config{
-			Dest:      dst,
-			Format:    buildFormat,
-			NoCleanUp: buildArgs.noCleanUp,
-			Opts: types.Options{
-				ImgCache:          imgCache,
-				TmpDir:            tmpDir,
-				NoCache:           disableCache,
-				Update:            buildArgs.update,
-				Force:             forceOverwrite,
-				Sections:          buildArgs.sections,
-				NoTest:            buildArgs.noTest,
-				NoHTTPS:           noHTTPS,
-				LibraryURL:        buildArgs.libraryURL,
-				LibraryAuthToken:  authToken,
-				FakerootPath:      fakerootPath,
-				KeyServerOpts:     ko,
-				DockerAuthConfig:  authConf,
-				DockerDaemonHost:  dockerHost,
-				EncryptionKeyInfo: keyInfo,
-				FixPerms:          buildArgs.fixPerms,
-				SandboxTarget:     sandboxTarget,
-				Unprivilege:       unprivilege,
-			},
-		})
+	var chunkSize int64
+	if buildArgs.chunkSize != "" {
+		chunkSize, err = units.RAMInBytes(buildArgs.chunkSize)
+		if err != nil || chunkSize <= 0 {
+			sylog.Fatalf("Invalid chunk size %q", buildArgs.chunkSize)
+		}
+	}
+
+	var limitRate int64
+	if buildArgs.limitRate != "" {
+		limitRate, err = units.RAMInBytes(buildArgs.limitRate)
+		if err != nil || limitRate <= 0 {
+			sylog.Fatalf("Invalid download rate limit %q", buildArgs.limitRate)
+		}
+	}
+
+	var manifestTimeout time.Duration
+	if buildArgs.manifestTimeout != "" {
+		manifestTimeout, err = time.ParseDuration(buildArgs.manifestTimeout)
+		if err != nil || manifestTimeout <= 0 {
+			sylog.Fatalf("Invalid manifest fetch timeout %q", buildArgs.manifestTimeout)
+		}
+	}
+
+	if (dockerClientCert == "") != (dockerClientKey == "") {
+		sylog.Fatalf("The --docker-client-cert and --docker-client-key options must be used together")
+	}
+
+	if buildArgs.extractRetries < 0 {
+		sylog.Fatalf("Invalid number of extraction retries %d", buildArgs.extractRetries)
+	}
+	if buildArgs.maxFiles < 0 {
+		sylog.Fatalf("Invalid maximum number of files %d", buildArgs.maxFiles)
+	}
+
+	var extractBufferSize int64
+	if buildArgs.extractBufferSize != "" {
+		extractBufferSize, err = units.RAMInBytes(buildArgs.extractBufferSize)
+		if err != nil || extractBufferSize < types.MinExtractBufferSize || extractBufferSize > types.MaxExtractBufferSize {
+			sylog.Fatalf("Invalid extraction buffer size %q, should be between %s and %s", buildArgs.extractBufferSize,
+				units.BytesSize(types.MinExtractBufferSize), units.BytesSize(types.MaxExtractBufferSize))
+		}
+	}
+
+	var maxFileSize int64
+	if buildArgs.maxFileSize != "" {
+		maxFileSize, err = units.RAMInBytes(buildArgs.maxFileSize)
+		if err != nil || maxFileSize <= 0 {
+			sylog.Fatalf("Invalid maximum file size %q", buildArgs.maxFileSize)
+		}
+	}
+
+	var maxExtractMemory int64
+	if buildArgs.maxExtractMemory != "" {
+		maxExtractMemory, err = units.RAMInBytes(buildArgs.maxExtractMemory)
+		if err != nil || maxExtractMemory <= 0 {
+			sylog.Fatalf("Invalid extraction memory limit %q", buildArgs.maxExtractMemory)
+		}
+	}
+
+	var maxExtractCPUTime time.Duration
+	if buildArgs.maxExtractCPUTime != "" {
+		maxExtractCPUTime, err = time.ParseDuration(buildArgs.maxExtractCPUTime)
+		if err != nil || maxExtractCPUTime <= 0 {
+			sylog.Fatalf("Invalid extraction CPU time limit %q", buildArgs.maxExtractCPUTime)
+		}
+	}
+
+	// the pull-through cache of the configuration is overridden by the flag
+	pullThroughCache := buildArgs.pullThroughCache
+	if conf := apptainerconf.GetCurrentConfig(); pullThroughCache == "" && conf != nil {
+		pullThroughCache = conf.PullThroughCache
+	}
+	sharedBlobCache := buildArgs.sharedBlobCache
+	if conf := apptainerconf.GetCurrentConfig(); sharedBlobCache == "" && conf != nil {
+		sharedBlobCache = conf.SharedBlobCache
+	}
+
+	if buildArgs.pruneProfile != "" {
+		if _, err := types.GetPruneProfile(buildArgs.pruneProfile); err != nil {
+			sylog.Fatalf("%s", err)
+		}
+	}
+
+	// the allowed registries of the flag may only restrict the ones of the
+	// configuration, which apply to the sources without the flag
+	allowedRegistries := buildArgs.allowedRegistries
+	if err := types.CheckRegistryPatterns(allowedRegistries); err != nil {
+		sylog.Fatalf("%s", err)
+	}
+	if conf := apptainerconf.GetCurrentConfig(); conf != nil && len(conf.AllowedRegistries) > 0 {
+		for _, r := range allowedRegistries {
+			if !types.RegistryAllowed(conf.AllowedRegistries, r) {
+				sylog.Fatalf("Registry %s is not in the allowed registries of the configuration: %s", r, strings.Join(conf.AllowedRegistries, ", "))
+			}
+		}
+	}
+
+	// the policy of the configuration for the images running as root,
+	// applied by the sources when unset, is overridden by the flag
+	rootUser := ""
+	if buildArgs.allowRootUser {
+		rootUser = types.RootUserAllow
+	}
+
+	lockFile := buildArgs.lockFile
+	if lockFile == "" && buildArgs.updateLock {
+		lockFile = types.DefaultLockFile
+	}
+	if lockFile != "" {
+		lockFile, err = filepath.Abs(lockFile)
+		if err != nil {
+			sylog.Fatalf("While resolving the lock file path: %v", err)
+		}
+	}
+
+	permsState := buildArgs.permsState
+	if permsState != "" {
+		permsState, err = filepath.Abs(permsState)
+		if err != nil {
+			sylog.Fatalf("While resolving the perms state file path: %v", err)
+		}
+	}
+
+	testScript := buildArgs.testScript
+	if testScript != "" {
+		testScript, err = filepath.Abs(testScript)
+		if err != nil {
+			sylog.Fatalf("While resolving the test script path: %v", err)
+		}
+	}
+
+	selinuxLabels := buildArgs.selinuxLabels
+	if selinuxLabels != "" {
+		selinuxLabels, err = filepath.Abs(selinuxLabels)
+		if err != nil {
+			sylog.Fatalf("While resolving the SELinux label policy path: %v", err)
+		}
+	}
+
+	switch buildArgs.normalizeNetFiles {
+	case "", types.NetFilesEmpty, types.NetFilesTemplate:
+	default:
+		sylog.Fatalf("Invalid network files normalization %q, should be %s or %s", buildArgs.normalizeNetFiles, types.NetFilesEmpty, types.NetFilesTemplate)
+	}
+
+	switch buildArgs.unknownMediaTypes {
+	case "", types.UnknownMediaTypeError, types.UnknownMediaTypePassthrough, types.UnknownMediaTypeSkip:
+	default:
+		sylog.Fatalf("Invalid unknown media types handling %q, should be %s, %s or %s", buildArgs.unknownMediaTypes,
+			types.UnknownMediaTypeError, types.UnknownMediaTypePassthrough, types.UnknownMediaTypeSkip)
+	}
+
+	buildFormat := buildArgs.outputFormat
+	sandboxTarget := buildArgs.sandbox
+
+	conf := build.Config{
+		Dest:      dst,
+		Format:    buildFormat,
+		NoCleanUp: buildArgs.noCleanUp,
+		Opts: types.Options{
+			ImgCache:           imgCache,
+			TmpDir:             tmpDir,
+			NoCache:            disableCache,
+			Update:             buildArgs.update,
+			Force:              forceOverwrite,
+			Sections:           buildArgs.sections,
+			NoTest:             buildArgs.noTest,
+			NoHTTPS:            noHTTPS,
+			LibraryURL:         buildArgs.libraryURL,
+			LibraryAuthToken:   authToken,
+			FakerootPath:       fakerootPath,
+			Fakeroot:           os.Getenv(fakeroot.BuildEnv) == "1",
+			KeyServerOpts:      ko,
+			DockerAuthConfig:   authConf,
+			DockerDaemonHost:   dockerHost,
+			Containerd:         types.ContainerdOptions{Address: buildArgs.containerdAddress, Namespace: buildArgs.containerdNamespace},
+			MergeSources:       buildArgs.mergeSources,
+			DockerClientCert:   dockerClientCert,
+			DockerClientKey:    dockerClientKey,
+			EncryptionKeyInfo:  keyInfo,
+			FixPerms:           buildArgs.fixPerms,
+			NormalizeOwnership: buildArgs.normalizeOwnership,
+			IncludePaths:       buildArgs.includePaths,
+			Provenance:         buildArgs.provenance,
+			BuildProvenance:    buildArgs.buildProvenance,
+			LayerHistory:       buildArgs.layerHistory,
+			SBOM:               buildArgs.sbom,
+			PreserveManifest:   buildArgs.preserveManifest,
+			Healthcheck:        buildArgs.healthcheck,
+			TestScript:         testScript,
+			IDPreflight:        buildArgs.idPreflight,
+			WarningsAsErrors:   buildArgs.warningsAsErrors,
+			VerifyLayers:       buildArgs.verifyLayers,
+			VerifyRootfs:       buildArgs.verifyRootfs,
+			VerifyGzip:         buildArgs.verifyGzip,
+			ParallelGzip:       buildArgs.parallelGzip,
+			IgnorePlatform:     buildArgs.ignorePlatform,
+			ArchVariant:        buildArgs.archVariant,
+			Platform:           buildArgs.platform,
+			ContentTrust:       buildArgs.contentTrust,
+			ContentTrustServer: buildArgs.contentTrustServer,
+			ChunkSize:          chunkSize,
+			DownloadRateLimit:  limitRate,
+			PullThroughCache:   pullThroughCache,
+			SharedBlobCache:    sharedBlobCache,
+			DefaultRegistry:    getDefaultPullRegistry(),
+			AllowedRegistries:  allowedRegistries,
+			RootUser:           rootUser,
+			ManifestTimeout:    manifestTimeout,
+			PrunePatterns:      buildArgs.prunePatterns,
+			PruneProfile:       buildArgs.pruneProfile,
+			PruneDryRun:        buildArgs.pruneDryRun,
+			NormalizeNetFiles:  buildArgs.normalizeNetFiles,
+			NormalizeEnv:       buildArgs.normalizeEnv,
+			ExtractRetries:     buildArgs.extractRetries,
+			MaxFiles:           buildArgs.maxFiles,
+			MaxFileSize:        maxFileSize,
+			OversizedFiles:     buildArgs.oversizedFiles,
+			ACLs:               buildArgs.acls,
+			MaxExtractMemory:   maxExtractMemory,
+			MaxExtractCPUTime:  maxExtractCPUTime,
+			ExtractBufferSize:  int(extractBufferSize),
+			SparseFiles:        buildArgs.sparseFiles,
+			KeepDirlinks:       buildArgs.keepDirlinks,
+			ExtractUIDMap:      buildArgs.extractUIDMap,
+			ExtractGIDMap:      buildArgs.extractGIDMap,
+			LockFile:           lockFile,
+			UpdateLock:         buildArgs.updateLock,
+			PermsStateFile:     permsState,
+			SELinuxLabels:      selinuxLabels,
+			KeepGoing:          buildArgs.keepGoing,
+			UnknownMediaTypes:  buildArgs.unknownMediaTypes,
+			DanglingHardlinks:  buildArgs.danglingHardlinks,
+			SymlinkLoops:       buildArgs.symlinkLoops,
+			LatestTag:          buildArgs.latestTag,
+			RunnableCheck:      buildArgs.runnableCheck,
+			LogFile:            buildArgs.logFile,
+			ManifestCache:      types.NewMemoryManifestCache(),
+			Compression:        buildArgs.compression,
+			CompressionLevel:   buildArgs.compressionLevel,
+			SandboxTarget:      sandboxTarget,
+			Unprivilege:        unprivilege,
+		},
+	}
+
+	// finalDest is the content-addressed name the image built to
+	// conf.Dest is renamed to once complete
+	var finalDest string
+	if buildArgs.contentAddressed {
+		name, err := build.ContentAddressedName(ctx, defs, conf)
+		if err != nil {
+			sylog.Fatalf("While deriving the content-addressed name: %v", err)
+		}
+		dest := filepath.Join(dst, name)
+		// the images are only renamed to their content-addressed name
+		// once complete, an existing one is a previous successful build
+		if _, err := os.Lstat(dest); err == nil {
+			sylog.Infof("Image %s is already built, skipping the build", dest)
+			return
+		}
+		// build to a temporary name in the same directory
+		conf.Dest = filepath.Join(dst, fmt.Sprintf(".%s.%d.tmp", name, os.Getpid()))
+		checkBuildOutput(cmd, conf.Dest)
+		finalDest = dest
+	}
+
+	b, err := build.New(defs, conf)
 	if err != nil {
 		sylog.Fatalf("Unable to create build: %v", err)
 	}
 
 	if err = b.Full(ctx); err != nil {
+		if finalDest != "" {
+			os.RemoveAll(conf.Dest)
+		}
+		if buildArgs.jsonErrors {
+			if werr := types.WriteErrorDocument(os.Stderr, fmt.Errorf("while performing build: %w", err)); werr == nil {
+				os.Exit(255)
+			}
+		}
 		sylog.Fatalf("While performing build: %v", err)
 	}
+	if finalDest != "" {
+		if err := os.Rename(conf.Dest, finalDest); err != nil {
+			if _, serr := os.Lstat(finalDest); serr != nil {
+				os.RemoveAll(conf.Dest)
+				sylog.Fatalf("While renaming the image to %s: %v", finalDest, err)
+			}
+			// a concurrent build of the same content completed first
+			os.RemoveAll(conf.Dest)
+			sylog.Infof("Image %s was built concurrently, discarding this build", finalDest)
+		}
+		conf.Dest = finalDest
+	}
+	sylog.Infof("Build complete: %s", conf.Dest)
 }
 
 func checkSections() error {
@@ -14,9 +14,11 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/apptainer/apptainer/docs"
 	"github.com/apptainer/apptainer/internal/app/apptainer"
+	"github.com/apptainer/apptainer/internal/pkg/build"
 	"github.com/apptainer/apptainer/internal/pkg/cache"
 	"github.com/apptainer/apptainer/pkg/cmdline"
 	"github.com/apptainer/apptainer/pkg/sylog"
@@ -29,6 +31,8 @@ func init() {
 		cmdManager.RegisterFlagForCmd(&cacheCleanDaysFlag, cacheCleanCmd)
 		cmdManager.RegisterFlagForCmd(&cacheCleanDryFlag, cacheCleanCmd)
 		cmdManager.RegisterFlagForCmd(&cacheCleanForceFlag, cacheCleanCmd)
+		cmdManager.RegisterFlagForCmd(&cacheCleanBuildScratchFlag, cacheCleanCmd)
+		cmdManager.RegisterFlagForCmd(&commonTmpDirFlag, cacheCleanCmd)
 	})
 }
 
@@ -38,6 +42,8 @@ var (
 	cacheCleanDry   bool
 	cacheCleanForce bool
 
+	cacheCleanBuildScratch bool
+
 	// -T|--type
 	cacheCleanTypesFlag = cmdline.Flag{
 		ID:           "cacheCleanTypes",
@@ -78,6 +84,15 @@ var (
 		Usage:        "suppress any prompts and clean the cache",
 	}
 
+	// --build-scratch
+	cacheCleanBuildScratchFlag = cmdline.Flag{
+		ID:           "cacheCleanBuildScratchFlag",
+		Value:        &cacheCleanBuildScratch,
+		DefaultValue: false,
+		Name:         "build-scratch",
+		Usage:        "remove scratch directories left in the temporary directory by failed builds, instead of cleaning the cache",
+	}
+
 	// cacheCleanCmd is 'apptainer cache clean' and will clear your local apptainer cache
 	cacheCleanCmd = &cobra.Command{
 		DisableFlagsInUseLine: true,
@@ -98,6 +113,9 @@ func cleanCache() error {
 	if cacheCleanDry {
 		fmt.Println("User requested a dry run. Not actually deleting any data!")
 	}
+	if cacheCleanBuildScratch {
+		return cleanBuildScratch()
+	}
 	if !cacheCleanForce && !cacheCleanDry {
 		ok, err := cleanCachePrompt()
 		if err != nil {
@@ -118,6 +136,24 @@ func cleanCache() error {
 	return nil
 }
 
+// cleanBuildScratch removes the orphaned build scratch directories, no prompt
+// is needed as directories in use by a running build are left untouched.
+func cleanBuildScratch() error {
+	maxAge := time.Duration(cacheCleanDays) * 24 * time.Hour
+	removed, err := build.CleanupBuildScratch(tmpDir, maxAge, cacheCleanDry)
+	if err != nil {
+		return fmt.Errorf("could not clean build scratch directories: %v", err)
+	}
+	for _, dir := range removed {
+		if cacheCleanDry {
+			fmt.Printf("Would remove %s\n", dir)
+		} else {
+			fmt.Printf("Removing %s\n", dir)
+		}
+	}
+	return nil
+}
+
 func cleanCachePrompt() (bool, error) {
 	fmt.Print(`This will delete everything in your cache (containers from all sources and OCI blobs).
 Hint: You can see exactly what would be deleted by canceling and using the --dry-run option.
@@ -21,9 +21,12 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/apptainer/apptainer/docs"
 	"github.com/apptainer/apptainer/internal/pkg/util/env"
+	"github.com/apptainer/apptainer/pkg/build/types"
 	"github.com/apptainer/apptainer/pkg/cmdline"
 	"github.com/apptainer/apptainer/pkg/image"
 	"github.com/apptainer/apptainer/pkg/inspect"
@@ -48,6 +51,7 @@ var (
 	labels      bool
 	deffile     bool
 	jsonfmt     bool
+	layerHist   bool
 )
 
 // -l|--labels
@@ -149,6 +153,15 @@ var inspectHelpfileFlag = cmdline.Flag{
 	Usage:        "inspect the runscript helpfile, if it exists",
 }
 
+// --history
+var inspectHistoryFlag = cmdline.Flag{
+	ID:           "inspectHistoryFlag",
+	Value:        &layerHist,
+	DefaultValue: false,
+	Name:         "history",
+	Usage:        "show the history of the layers of the oci/docker image the SIF image was built from, if recorded",
+}
+
 // --all
 var inspectAllFlag = cmdline.Flag{
 	ID:           "inspectAllFlag",
@@ -173,6 +186,7 @@ func init() {
 		cmdManager.RegisterFlagForCmd(&inspectTestFlag, InspectCmd)
 		cmdManager.RegisterFlagForCmd(&inspectAppsListFlag, InspectCmd)
 		cmdManager.RegisterFlagForCmd(&inspectAllFlag, InspectCmd)
+		cmdManager.RegisterFlagForCmd(&inspectHistoryFlag, InspectCmd)
 	})
 }
 
@@ -601,6 +615,57 @@ func inspectDeffilePartition(img *image.Image) (string, error) {
 	return string(data), nil
 }
 
+// printLayerHistory writes the history of the layers of the oci/docker image
+// the SIF image img was built from to w, from the newest layer, as JSON with
+// jsonfmt.
+func printLayerHistory(w io.Writer, img *image.Image, jsonfmt bool) error {
+	if img.Type != image.SIF {
+		return fmt.Errorf("the layer history is only recorded in SIF images")
+	}
+	r, err := image.NewSectionReader(img, image.SIFDescLayerHistoryJSON, -1)
+	if err == image.ErrNoSection {
+		return fmt.Errorf("no layer history found in %s, build it with --layer-history to record it", img.Path)
+	} else if err != nil {
+		return fmt.Errorf("while reading layer history: %s", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("while reading layer history: %s", err)
+	}
+	history, err := types.ParseLayerHistory(data)
+	if err != nil {
+		return err
+	}
+
+	if jsonfmt {
+		jsonObj, err := json.MarshalIndent(history, "", "\t")
+		if err != nil {
+			return fmt.Errorf("could not format layer history as JSON: %s", err)
+		}
+		fmt.Fprintf(w, "%s\n", jsonObj)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tCREATED\tCREATED BY\tCOMMENT")
+	for i := len(history) - 1; i >= 0; i-- {
+		e := history[i]
+		layer := "<empty>"
+		if e.Layer != "" {
+			layer = e.Layer.Encoded()
+			if len(layer) > 12 {
+				layer = layer[:12]
+			}
+		}
+		created := "-"
+		if e.Created != nil {
+			created = e.Created.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", layer, created, e.CreatedBy, e.Comment)
+	}
+	return tw.Flush()
+}
+
 func printSortedApp(m map[string]*inspect.AppAttributes) {
 	sorted := make([]string, 0, len(m))
 	for k := range m {
@@ -645,6 +710,13 @@ var InspectCmd = &cobra.Command{
 			sylog.Fatalf("Failed to open image %s: %s", args[0], err)
 		}
 
+		if layerHist {
+			if err := printLayerHistory(os.Stdout, img, jsonfmt); err != nil {
+				sylog.Fatalf("%s", err)
+			}
+			return
+		}
+
 		if allData {
 			// display all data in JSON format only
 			jsonfmt = true
@@ -228,22 +228,29 @@ func pullRun(cmd *cobra.Command, args []string) {
 			sylog.Fatalf("Conflicting arguments; do not use --library with a library URI containing host name")
 		}
 
-		var libraryURI string
-		if pullLibraryURI != "" {
-			libraryURI = pullLibraryURI
-		} else if ref.Host != "" {
-			// override libraryURI if ref contains host name
-			if noHTTPS {
-				libraryURI = "http://" + ref.Host
-			} else {
-				libraryURI = "https://" + ref.Host
-			}
-		}
-
-		lc, err := getLibraryClientConfig(libraryURI)
+		// the host of ref can be the name, or an alias, of a remote
+		lc, err := getRemoteLibraryClientConfig(ref)
 		if err != nil {
 			sylog.Fatalf("Unable to get library client configuration: %v", err)
 		}
+		if lc == nil {
+			var libraryURI string
+			if pullLibraryURI != "" {
+				libraryURI = pullLibraryURI
+			} else if ref.Host != "" {
+				// override libraryURI if ref contains host name
+				if noHTTPS {
+					libraryURI = "http://" + ref.Host
+				} else {
+					libraryURI = "https://" + ref.Host
+				}
+			}
+
+			lc, err = getLibraryClientConfig(libraryURI)
+			if err != nil {
+				sylog.Fatalf("Unable to get library client configuration: %v", err)
+			}
+		}
 		co, err := getKeyserverClientOpts("", endpoint.KeyserverVerifyOp)
 		if err != nil {
 			sylog.Fatalf("Unable to get keyserver client configuration: %v", err)
@@ -288,12 +295,13 @@ func pullRun(cmd *cobra.Command, args []string) {
 			return
 		}
 		pullOpts := oci.PullOptions{
-			TmpDir:     tmpDir,
-			OciAuth:    ociAuth,
-			DockerHost: dockerHost,
-			NoHTTPS:    noHTTPS,
-			NoCleanUp:  buildArgs.noCleanUp,
-			Pullarch:   arch,
+			TmpDir:          tmpDir,
+			OciAuth:         ociAuth,
+			DockerHost:      dockerHost,
+			NoHTTPS:         noHTTPS,
+			NoCleanUp:       buildArgs.noCleanUp,
+			Pullarch:        arch,
+			DefaultRegistry: getDefaultPullRegistry(),
 		}
 
 		_, err = oci.PullToFile(ctx, imgCache, pullTo, pullFrom, pullOpts)
@@ -105,10 +105,17 @@ var PushCmd = &cobra.Command{
 				sylog.Fatalf("Conflicting arguments; do not use --library with a library URI containing host name")
 			}
 
-			lc, err := getLibraryClientConfig(PushLibraryURI)
+			// the host of destRef can be the name, or an alias, of a remote
+			lc, err := getRemoteLibraryClientConfig(destRef)
 			if err != nil {
 				sylog.Fatalf("Unable to get library client configuration: %v", err)
 			}
+			if lc == nil {
+				lc, err = getLibraryClientConfig(PushLibraryURI)
+				if err != nil {
+					sylog.Fatalf("Unable to get library client configuration: %v", err)
+				}
+			}
 
 			// Push to library requires a valid authToken
 			if lc.AuthToken == "" {
@@ -42,6 +42,12 @@ var (
 	global                  bool
 	remoteUseExclusive      bool
 	remoteAddInsecure       bool
+	remoteListVerify        bool
+	remoteListGrouped       bool
+	remoteListFilter        string
+	remoteListFilterURI     bool
+	remoteListSource        bool
+	remoteListCheckActive   bool
 )
 
 // assemble values of remoteConfig for user/sys locations
@@ -168,6 +174,60 @@ var remoteAddInsecureFlag = cmdline.Flag{
 	EnvKeys:      []string{"ADD_INSECURE"},
 }
 
+// --verify
+var remoteListVerifyFlag = cmdline.Flag{
+	ID:           "remoteListVerifyFlag",
+	Value:        &remoteListVerify,
+	DefaultValue: false,
+	Name:         "verify",
+	Usage:        "decode stored tokens and show their expiry",
+}
+
+// --grouped
+var remoteListGroupedFlag = cmdline.Flag{
+	ID:           "remoteListGroupedFlag",
+	Value:        &remoteListGrouped,
+	DefaultValue: false,
+	Name:         "grouped",
+	Usage:        "list global and user remotes in separate tables",
+}
+
+// --filter
+var remoteListFilterFlag = cmdline.Flag{
+	ID:           "remoteListFilterFlag",
+	Value:        &remoteListFilter,
+	DefaultValue: "",
+	Name:         "filter",
+	Usage:        "only list remotes whose name matches the glob pattern or contains the string",
+}
+
+// --filter-uri
+var remoteListFilterURIFlag = cmdline.Flag{
+	ID:           "remoteListFilterURIFlag",
+	Value:        &remoteListFilterURI,
+	DefaultValue: false,
+	Name:         "filter-uri",
+	Usage:        "also list remotes whose URI matches the --filter value",
+}
+
+// --source
+var remoteListSourceFlag = cmdline.Flag{
+	ID:           "remoteListSourceFlag",
+	Value:        &remoteListSource,
+	DefaultValue: false,
+	Name:         "source",
+	Usage:        "show whether each remote is defined in the user or system config file, or both",
+}
+
+// --check-active
+var remoteListCheckActiveFlag = cmdline.Flag{
+	ID:           "remoteListCheckActiveFlag",
+	Value:        &remoteListCheckActive,
+	DefaultValue: false,
+	Name:         "check-active",
+	Usage:        "warn if the active remote is unreachable or its token has expired",
+}
+
 func init() {
 	addCmdInit(func(cmdManager *cmdline.CommandManager) {
 		cmdManager.RegisterCmd(RemoteCmd)
@@ -200,6 +260,13 @@ func init() {
 
 		cmdManager.RegisterFlagForCmd(&remoteUseExclusiveFlag, RemoteUseCmd)
 
+		cmdManager.RegisterFlagForCmd(&remoteListVerifyFlag, RemoteListCmd)
+		cmdManager.RegisterFlagForCmd(&remoteListGroupedFlag, RemoteListCmd)
+		cmdManager.RegisterFlagForCmd(&remoteListFilterFlag, RemoteListCmd)
+		cmdManager.RegisterFlagForCmd(&remoteListFilterURIFlag, RemoteListCmd)
+		cmdManager.RegisterFlagForCmd(&remoteListSourceFlag, RemoteListCmd)
+		cmdManager.RegisterFlagForCmd(&remoteListCheckActiveFlag, RemoteListCmd)
+
 		cmdManager.RegisterFlagForCmd(&remoteKeyserverOrderFlag, RemoteAddKeyserverCmd)
 		cmdManager.RegisterFlagForCmd(&remoteKeyserverInsecureFlag, RemoteAddKeyserverCmd)
 	})
@@ -350,7 +417,15 @@ var RemoteUseCmd = &cobra.Command{
 var RemoteListCmd = &cobra.Command{
 	Args: cobra.ExactArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := apptainer.RemoteList(remoteConfig); err != nil {
+		listArgs := &apptainer.RemoteListArgs{
+			Verify:      remoteListVerify,
+			Grouped:     remoteListGrouped,
+			Filter:      remoteListFilter,
+			FilterURI:   remoteListFilterURI,
+			Source:      remoteListSource,
+			CheckActive: remoteListCheckActive,
+		}
+		if err := apptainer.RemoteList(remoteConfig, listArgs); err != nil {
 			sylog.Fatalf("%s", err)
 		}
 	},
@@ -44,6 +44,12 @@ Enterprise Performance Computing (EPC)`
 
       default:    The compressed Apptainer read only image format (default)
       sandbox:    This is a read-write container within a directory structure
+      oci-layout: An OCI image layout directory, holding the container as
+                  a single layer image
+      oci-archive: A tar archive of an OCI image layout
+
+  The --output-format option selects the format (sif, sandbox, oci-layout or
+  oci-archive), --sandbox being the same as --output-format sandbox.
 
   note: It is a common workflow to use the "sandbox" mode for development of the
   container, and then build it as a default Apptainer image for production
@@ -59,6 +65,8 @@ Enterprise Performance Computing (EPC)`
       directory:  A directory structure containing a (ch)root file system
       image:      A local image on your machine (will convert to sif if
                   it is legacy format)
+      cpio:path:  A cpio archive, optionally gzip compressed, such as an
+                  initramfs image
 
   Targets can also be remote and defined by a URI of the following formats:
 
@@ -66,6 +74,8 @@ Enterprise Performance Computing (EPC)`
       docker://   a Docker/OCI registry (default Docker Hub)
       shub://     an Apptainer registry (default Singularity Hub)
       oras://     an OCI registry that holds SIF files using ORAS
+      git+https:// a git repository holding a def file or a directory,
+                  with an optional ref and path: git+https://...#ref:path
 
   Temporary files:
   
@@ -122,6 +132,10 @@ Enterprise Performance Computing (EPC)`
       Scratch:
           Bootstrap: scratch # Populate the container with a minimal rootfs in %setup
 
+      Cpio/initramfs:
+          Bootstrap: cpio
+          From: /boot/initramfs.img
+
   DEFFILE SECTIONS:
 
   The following sections are presented in the order of processing, with the exception
@@ -179,10 +193,16 @@ Enterprise Performance Computing (EPC)`
       Build a sif image from the Library:
           $ apptainer build /tmp/debian1.sif library://debian:latest
 
+      Build a sif file from a def file of a tag of a git repository:
+          $ apptainer build /tmp/app.sif git+https://example.com/app.git#v1.0:app.def
+
       Build a base sandbox from DockerHub, make changes to it, then build sif
           $ apptainer build --sandbox /tmp/debian docker://debian:latest
           $ apptainer exec --writable /tmp/debian apt-get install python
-          $ apptainer build /tmp/debian2.sif /tmp/debian`
+          $ apptainer build /tmp/debian2.sif /tmp/debian
+
+      Build an oci-archive from a def file:
+          $ apptainer build --output-format oci-archive /tmp/debian.tar /path/to/debian.def`
 
 	// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
 	// Cache
@@ -208,12 +228,19 @@ Enterprise Performance Computing (EPC)`
   APPTAINER_CACHEDIR is not set). By default the entire cache is cleaned, use
   --days and --type flags to override this behavior. Note: if you use Apptainer
   as root, cache will be stored in '/root/.apptainer/.cache', to clean that
-  cache, you will need to run 'cache clean' as root, or with 'sudo'.`
+  cache, you will need to run 'cache clean' as root, or with 'sudo'.
+
+  With --build-scratch, the scratch directories left in the temporary
+  directory (TMPDIR if set, /tmp otherwise) by failed or killed builds are
+  removed instead. Directories in use by a running build are never removed,
+  and --days restricts the cleanup to directories older than the specified
+  number of days.`
 	CacheCleanExample string = `
   All group commands have their own help output:
 
   $ apptainer help cache clean --days 30
   $ apptainer help cache clean --type=library,oci
+  $ apptainer cache clean --build-scratch --days 1
   $ apptainer cache clean --help`
 
 	// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
@@ -86,9 +86,44 @@ const (
   The 'remote list' command lists all remote endpoints configured for use.
 
   The current remote is indicated by 'YES' in the 'ACTIVE' column and can be changed
-  with the 'remote use' command.`
+  with the 'remote use' command. The remote serving the keyserver of the current
+  remote, where the 'key' and 'verify' operations go, is indicated by 'YES' in the
+  'KEYSERVER' column. No remote is indicated when it is an external keyserver not
+  provided by any of the remotes.
+
+  With the '--verify' option, an 'EXPIRES' column shows when the stored token of
+  each remote expires. Tokens whose expiry can't be decoded are shown as 'UNKNOWN'
+  and tokens which have already expired as 'EXPIRED'.
+
+  With the '--grouped' option, the global and user remotes are listed in two
+  separate tables instead of a single table with a 'GLOBAL' column.
+
+  With the '--filter' option, only the remotes whose name matches the given glob
+  pattern (when it holds any of the '*?[' characters) or contains the given string
+  are listed. With '--filter-uri', remotes whose URI matches are listed too.
+
+  With the '--source' option, a 'SOURCE' column shows where each remote is
+  defined: 'USER' for the user config file, 'SYSTEM' for the system one, and
+  'BOTH' for a global remote whose credentials are stored in the user config
+  file, or a user remote overriding a global one of the same name.
+
+  With the '--check-active' option, the services of the current remote are
+  probed and its stored token is decoded after the listing, with a warning if
+  the remote is unreachable or its token has expired.`
 	RemoteListExample string = `
-  $ apptainer remote list`
+  $ apptainer remote list
+
+  $ apptainer remote list --verify
+
+  $ apptainer remote list --grouped
+
+  $ apptainer remote list --filter 'prod-*'
+
+  $ apptainer remote list --filter example.com --filter-uri
+
+  $ apptainer remote list --source
+
+  $ apptainer remote list --check-active`
 	// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
 	// remote login command
 	// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
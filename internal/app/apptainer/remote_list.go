@@ -11,43 +11,219 @@
 package apptainer
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"sort"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/apptainer/apptainer/internal/pkg/remote"
+	"github.com/apptainer/apptainer/internal/pkg/remote/endpoint"
+	remoteutil "github.com/apptainer/apptainer/internal/pkg/remote/util"
+	"github.com/apptainer/apptainer/pkg/sylog"
 )
 
-const listLine = "%s\t%s\t%s\t%s\t%s\t%s\n"
+// RemoteListArgs holds the options controlling the output of RemoteList.
+type RemoteListArgs struct {
+	// Verify decodes the stored tokens and displays their expiry.
+	Verify bool
+	// Grouped displays the global and user remotes in separate tables,
+	// instead of a single table with a GLOBAL column.
+	Grouped bool
+	// Filter only lists the remotes whose name matches, as a glob pattern
+	// if it holds any of the *?[ characters, or as a substring otherwise.
+	Filter string
+	// FilterURI also lists the remotes whose URI matches Filter.
+	FilterURI bool
+	// Source displays a SOURCE column telling whether each remote is
+	// defined in the user config file, the system one, or both.
+	Source bool
+	// CheckActive probes the services of the active remote and decodes its
+	// token, warning when it is unreachable or its token has expired.
+	CheckActive bool
+	// ConfigCache, if set, reads the user and system config files through
+	// the cache, for the long-lived processes listing the remotes
+	// repeatedly.
+	ConfigCache *remote.ConfigCache
+
+	// sources maps the remote names to their SOURCE column, set by
+	// RemoteList.
+	sources map[string]string
+}
+
+// the values of the SOURCE column
+const (
+	remoteSourceUser   = "USER"
+	remoteSourceSystem = "SYSTEM"
+	remoteSourceBoth   = "BOTH"
+)
 
 // RemoteList prints information about remote configurations
-func RemoteList(usrConfigFile string) (err error) {
-	c := &remote.Config{}
+func RemoteList(usrConfigFile string, args *RemoteListArgs) (err error) {
+	if args == nil {
+		args = &RemoteListArgs{}
+	}
 
+	var c, cSys *remote.Config
+	if args.ConfigCache != nil {
+		c, cSys, err = readCachedConfigs(args.ConfigCache, usrConfigFile)
+	} else {
+		c, err = readUserConfig(usrConfigFile)
+		if err == nil {
+			cSys, err = readSysConfig()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if args.Source {
+		args.sources = remoteSources(c, cSys)
+	}
+
+	if cSys != nil {
+		if err := c.SyncFrom(cSys); err != nil {
+			return err
+		}
+	}
+
+	if err := printRemoteList(os.Stdout, c, args); err != nil {
+		return err
+	}
+	if args.CheckActive {
+		for _, w := range activeRemoteWarnings(c, time.Now(), probeRemote) {
+			sylog.Warningf("%s", w)
+		}
+	}
+	return nil
+}
+
+// readUserConfig reads the user config file, created empty if missing.
+func readUserConfig(usrConfigFile string) (*remote.Config, error) {
 	// opening config file
 	file, err := os.OpenFile(usrConfigFile, os.O_RDONLY|os.O_CREATE, 0o600)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return fmt.Errorf("no remote configurations")
+			return nil, fmt.Errorf("no remote configurations")
 		}
-		return fmt.Errorf("while opening remote config file: %s", err)
+		return nil, fmt.Errorf("while opening remote config file: %s", err)
 	}
 	defer file.Close()
 
 	// read file contents to config struct
-	c, err = remote.ReadFrom(file)
+	c, err := remote.ReadFrom(file)
 	if err != nil {
-		return fmt.Errorf("while parsing remote config data: %s", err)
+		return nil, fmt.Errorf("while parsing remote config data: %s", err)
 	}
+	return c, nil
+}
 
-	if err := syncSysConfig(c); err != nil {
-		return err
+// readCachedConfigs reads the user config file and the system one through
+// cache, as readUserConfig and readSysConfig do.
+func readCachedConfigs(cache *remote.ConfigCache, usrConfigFile string) (c, cSys *remote.Config, err error) {
+	c, err = cache.Read(usrConfigFile)
+	if errors.Is(err, os.ErrNotExist) {
+		// created empty by readUserConfig, then cached
+		if _, err = readUserConfig(usrConfigFile); err == nil {
+			c, err = cache.Read(usrConfigFile)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	cSys, err = cache.Read(remote.SystemConfigPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return c, cSys, nil
+}
+
+// probeRemote returns an error if the services of the remote e can't be
+// retrieved, or if one of them doesn't report its status.
+func probeRemote(e *endpoint.Config) error {
+	sps, err := e.GetAllServices()
+	if err != nil {
+		return fmt.Errorf("while retrieving services: %s", err)
+	}
+	names := make([]string, 0, len(sps))
+	for n := range sps {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		for _, sp := range sps[n] {
+			if s := doStatusCheck(n, sp); s != nil && s.status != "OK" {
+				return fmt.Errorf("%s service at %s is not available", n, s.uri)
+			}
+		}
+	}
+	return nil
+}
+
+// activeRemoteWarnings returns the warnings about the active remote of c,
+// the one operations use, if its token has expired at now or if probe
+// returns an error for it.
+func activeRemoteWarnings(c *remote.Config, now time.Time, probe func(*endpoint.Config) error) []string {
+	if _, ok := c.Remotes[c.DefaultRemote]; !ok {
+		return nil
+	}
+	e, err := c.GetRemote(c.DefaultRemote)
+	if err != nil {
+		return nil
+	}
+
+	var warnings []string
+	if tokenExpiryStatus(e.Token, now) == "EXPIRED" {
+		warnings = append(warnings, fmt.Sprintf("The token of the active remote %s has expired, please login again", c.DefaultRemote))
+	}
+	if err := probe(e); err != nil {
+		warnings = append(warnings, fmt.Sprintf("The active remote %s is unreachable: %s", c.DefaultRemote, err))
+	}
+	return warnings
+}
+
+// remoteSources returns the SOURCE column of the remotes of the user config
+// usr and of the system config sys, before they are synced. The global
+// remotes the user logged in to are stored in both, as are the user remotes
+// with the name of a global one.
+func remoteSources(usr, sys *remote.Config) map[string]string {
+	sources := make(map[string]string)
+	for n := range usr.Remotes {
+		sources[n] = remoteSourceUser
+	}
+	if sys == nil {
+		return sources
+	}
+	for n := range sys.Remotes {
+		if _, ok := sources[n]; ok {
+			sources[n] = remoteSourceBoth
+		} else {
+			sources[n] = remoteSourceSystem
+		}
+	}
+	return sources
+}
+
+func printRemoteList(w io.Writer, c *remote.Config, args *RemoteListArgs) error {
+	if args.Filter != "" {
+		// a malformed pattern would silently match nothing
+		if _, err := path.Match(args.Filter, ""); err != nil {
+			return fmt.Errorf("invalid filter %q: %s", args.Filter, err)
+		}
 	}
 
 	// list in alphanumeric order
 	names := make([]string, 0, len(c.Remotes))
-	for n := range c.Remotes {
+	for n, r := range c.Remotes {
+		if args.Filter != "" && !remoteFilterMatch(args, n, r.URI, r.Aliases) {
+			continue
+		}
 		names = append(names, n)
 	}
 	sort.Slice(names, func(i, j int) bool {
@@ -63,33 +239,233 @@ func RemoteList(usrConfigFile string) (err error) {
 	})
 	sort.Strings(names)
 
-	fmt.Println("Cloud Services Endpoints")
-	fmt.Println("========================")
-	fmt.Println()
+	fmt.Fprintln(w, "Cloud Services Endpoints")
+	fmt.Fprintln(w, "========================")
+	fmt.Fprintln(w)
+
+	if len(names) == 0 && args.Filter != "" {
+		fmt.Fprintln(w, "No matching remotes")
+		return nil
+	}
+
+	if !args.Grouped {
+		return printRemoteTable(w, c, names, args)
+	}
 
-	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintf(tw, listLine, "NAME", "URI", "ACTIVE", "GLOBAL", "EXCLUSIVE", "INSECURE")
+	var system, user []string
 	for _, n := range names {
-		sys := "NO"
 		if c.Remotes[n].System {
-			sys = "YES"
+			system = append(system, n)
+		} else {
+			user = append(user, n)
+		}
+	}
+
+	groups := []struct {
+		title string
+		names []string
+	}{
+		{"Global Remotes", system},
+		{"User Remotes", user},
+	}
+	for i, g := range groups {
+		if i > 0 {
+			fmt.Fprintln(w)
 		}
-		excl := "NO"
-		if c.Remotes[n].Exclusive {
-			excl = "YES"
+		fmt.Fprintln(w, g.title)
+		fmt.Fprintln(w, strings.Repeat("-", len(g.title)))
+		if len(g.names) == 0 {
+			fmt.Fprintln(w, "(none)")
+			continue
 		}
-		insec := "NO"
-		if c.Remotes[n].Insecure {
-			insec = "YES"
+		if err := printRemoteTable(w, c, g.names, args); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		active := "NO"
-		if c.DefaultRemote != "" && c.DefaultRemote == n {
-			active = "YES"
+// remoteFilterMatch reports whether the remote name, with uri and aliases,
+// matches the filter of args.
+func remoteFilterMatch(args *RemoteListArgs, name, uri string, aliases []string) bool {
+	match := func(s string) bool {
+		if strings.ContainsAny(args.Filter, "*?[") {
+			ok, _ := path.Match(args.Filter, s)
+			return ok
 		}
-		fmt.Fprintf(tw, listLine, n, c.Remotes[n].URI, active, sys, excl, insec)
+		return strings.Contains(s, args.Filter)
 	}
-	tw.Flush()
+	for _, a := range aliases {
+		if match(a) {
+			return true
+		}
+	}
+	return match(name) || (args.FilterURI && match(uri))
+}
 
-	return nil
+// printRemoteTable prints a table of the remotes names.
+func printRemoteTable(w io.Writer, c *remote.Config, names []string, args *RemoteListArgs) error {
+	header := []string{"NAME", "URI"}
+	// the aliases are only displayed when a remote has one
+	aliases := false
+	for _, n := range names {
+		aliases = aliases || len(c.Remotes[n].Aliases) > 0
+	}
+	header = append(header, "ACTIVE")
+	if !args.Grouped {
+		header = append(header, "GLOBAL")
+	}
+	if args.Source {
+		header = append(header, "SOURCE")
+	}
+	header = append(header, "EXCLUSIVE", "INSECURE", "KEYSERVER")
+	// the default pull registries are only displayed when one is set
+	registries := false
+	for _, n := range names {
+		registries = registries || c.Remotes[n].DefaultPullRegistry != ""
+	}
+	if registries {
+		header = append(header, "REGISTRY")
+	}
+	if args.Verify {
+		header = append(header, "EXPIRES")
+	}
+	// the aliases, of varying length, are the last column
+	if aliases {
+		header = append(header, "ALIASES")
+	}
+
+	keyserverRemote := activeKeyserverRemote(c)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, n := range names {
+		fmt.Fprintln(tw, strings.Join(remoteListRow(c, n, keyserverRemote, aliases, registries, args), "\t"))
+	}
+	return tw.Flush()
+}
+
+// remoteListRow returns the columns displayed for the remote name,
+// keyserverRemote being the remote serving the active keyserver, with the
+// ALIASES column if aliases is true and the REGISTRY column if registries
+// is true.
+func remoteListRow(c *remote.Config, n, keyserverRemote string, aliases, registries bool, args *RemoteListArgs) []string {
+	r := c.Remotes[n]
+
+	sys := "NO"
+	if r.System {
+		sys = "YES"
+	}
+	excl := "NO"
+	if r.Exclusive {
+		excl = "YES"
+	}
+	insec := "NO"
+	if r.Insecure {
+		insec = "YES"
+	}
+
+	active := "NO"
+	if c.DefaultRemote != "" && c.DefaultRemote == n {
+		active = "YES"
+	}
+
+	keyserver := "NO"
+	if keyserverRemote == n {
+		keyserver = "YES"
+	}
+
+	row := []string{n, r.URI, active}
+	if !args.Grouped {
+		row = append(row, sys)
+	}
+	if args.Source {
+		source := args.sources[n]
+		if source == "" {
+			source = "-"
+		}
+		row = append(row, source)
+	}
+	row = append(row, excl, insec, keyserver)
+	if registries {
+		registry := r.DefaultPullRegistry
+		if registry == "" {
+			registry = "-"
+		}
+		row = append(row, registry)
+	}
+	if args.Verify {
+		row = append(row, tokenExpiryStatus(r.Token, time.Now()))
+	}
+	if aliases {
+		names := "-"
+		if len(r.Aliases) > 0 {
+			names = strings.Join(r.Aliases, ",")
+		}
+		row = append(row, names)
+	}
+	return row
+}
+
+// activeKeyserverRemote returns the name of the remote serving the primary
+// keyserver of the active remote, the one the key operations go to, or an
+// empty string if it isn't served by any of the remotes.
+func activeKeyserverRemote(c *remote.Config) string {
+	active, ok := c.Remotes[c.DefaultRemote]
+	if !ok {
+		return ""
+	}
+	// without keyserver configuration, the keystore service of the
+	// remote is used
+	if len(active.Keyservers) == 0 {
+		return c.DefaultRemote
+	}
+
+	var primary *endpoint.ServiceConfig
+	for _, kc := range active.Keyservers {
+		if kc.Skip {
+			continue
+		}
+		primary = kc
+		break
+	}
+	if primary == nil {
+		return ""
+	} else if !primary.External {
+		return c.DefaultRemote
+	}
+
+	// an external keyserver may be the keystore service of another remote
+	names := make([]string, 0, len(c.Remotes))
+	for n := range c.Remotes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if n == c.DefaultRemote {
+			continue
+		}
+		for _, kc := range c.Remotes[n].Keyservers {
+			if !kc.External && remoteutil.SameKeyserver(kc.URI, primary.URI) {
+				return n
+			}
+		}
+	}
+	return ""
+}
+
+// tokenExpiryStatus returns the value displayed in the EXPIRES column
+// for the token, compared against now.
+func tokenExpiryStatus(token string, now time.Time) string {
+	if token == "" {
+		return "-"
+	}
+	exp, err := endpoint.TokenExpiry(token)
+	if err != nil {
+		return "UNKNOWN"
+	}
+	if !exp.After(now) {
+		return "EXPIRED"
+	}
+	return exp.Format(time.RFC3339)
 }
@@ -0,0 +1,561 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package apptainer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/remote"
+	"github.com/apptainer/apptainer/internal/pkg/remote/endpoint"
+)
+
+func makeJWT(exp time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+	return header + "." + payload + ".c2lnbmF0dXJl"
+}
+
+// listColumns returns the columns of the output line for the remote name.
+func listColumns(t *testing.T, out, name string) []string {
+	t.Helper()
+
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == name {
+			return fields
+		}
+	}
+	t.Fatalf("remote %s not found in output:\n%s", name, out)
+	return nil
+}
+
+func TestRemoteListVerify(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+
+	c := &remote.Config{
+		DefaultRemote: "valid",
+		Remotes: map[string]*endpoint.Config{
+			"valid":   {URI: "valid.example.com", Token: makeJWT(future)},
+			"expired": {URI: "expired.example.com", Token: makeJWT(time.Now().Add(-time.Hour))},
+			"opaque":  {URI: "opaque.example.com", Token: "0123456789abcdef"},
+			"none":    {URI: "none.example.com"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		verify  bool
+		expires map[string]string
+	}{
+		{
+			name:   "without verify",
+			verify: false,
+		},
+		{
+			name:   "with verify",
+			verify: true,
+			expires: map[string]string{
+				"valid":   future.Format(time.RFC3339),
+				"expired": "EXPIRED",
+				"opaque":  "UNKNOWN",
+				"none":    "-",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			if err := printRemoteList(&buf, c, &RemoteListArgs{Verify: tt.verify}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			out := buf.String()
+
+			header := listColumns(t, out, "NAME")
+			hasColumn := header[len(header)-1] == "EXPIRES"
+			if hasColumn != tt.verify {
+				t.Fatalf("unexpected EXPIRES column presence: %v", hasColumn)
+			}
+
+			for name, want := range tt.expires {
+				cols := listColumns(t, out, name)
+				if got := cols[len(cols)-1]; got != want {
+					t.Errorf("unexpected expiry for %s: got %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoteListGrouped(t *testing.T) {
+	c := &remote.Config{
+		DefaultRemote: "mine",
+		Remotes: map[string]*endpoint.Config{
+			"site":  {URI: "site.example.com", System: true},
+			"other": {URI: "other.example.com", System: true, Exclusive: true},
+			"mine":  {URI: "mine.example.com"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := printRemoteList(&buf, c, &RemoteListArgs{Grouped: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	out := buf.String()
+
+	global, user, ok := strings.Cut(out, "User Remotes")
+	if !ok || !strings.Contains(global, "Global Remotes") {
+		t.Fatalf("missing sections in output:\n%s", out)
+	}
+
+	sections := []struct {
+		name    string
+		out     string
+		members []string
+		others  []string
+	}{
+		{"global", global, []string{"site", "other"}, []string{"mine"}},
+		{"user", user, []string{"mine"}, []string{"site", "other"}},
+	}
+	for _, s := range sections {
+		if header := listColumns(t, s.out, "NAME"); strings.Contains(strings.Join(header, " "), "GLOBAL") {
+			t.Errorf("unexpected GLOBAL column in %s section: %v", s.name, header)
+		}
+		for _, n := range s.members {
+			listColumns(t, s.out, n)
+		}
+		for _, n := range s.others {
+			if strings.Contains(s.out, n+".example.com") {
+				t.Errorf("remote %s unexpectedly listed in %s section", n, s.name)
+			}
+		}
+	}
+
+	if cols := listColumns(t, user, "mine"); cols[2] != "YES" {
+		t.Errorf("unexpected ACTIVE column for mine: %v", cols)
+	}
+	if cols := listColumns(t, global, "other"); cols[3] != "YES" {
+		t.Errorf("unexpected EXCLUSIVE column for other: %v", cols)
+	}
+}
+
+func TestRemoteListFilter(t *testing.T) {
+	c := &remote.Config{
+		Remotes: map[string]*endpoint.Config{
+			"prod-east": {URI: "east.example.com", System: true},
+			"prod-west": {URI: "west.example.com"},
+			"staging":   {URI: "staging.internal"},
+			"dev":       {URI: "dev.example.com"},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		args      RemoteListArgs
+		listed    []string
+		wantError bool
+	}{
+		{
+			name:   "glob on name",
+			args:   RemoteListArgs{Filter: "prod-*"},
+			listed: []string{"prod-east", "prod-west"},
+		},
+		{
+			name:   "substring on name",
+			args:   RemoteListArgs{Filter: "tag"},
+			listed: []string{"staging"},
+		},
+		{
+			name:   "name only",
+			args:   RemoteListArgs{Filter: "example"},
+			listed: nil,
+		},
+		{
+			name:   "substring on uri",
+			args:   RemoteListArgs{Filter: "example", FilterURI: true},
+			listed: []string{"prod-east", "prod-west", "dev"},
+		},
+		{
+			name:   "glob on uri",
+			args:   RemoteListArgs{Filter: "*.internal", FilterURI: true},
+			listed: []string{"staging"},
+		},
+		{
+			name:   "grouped",
+			args:   RemoteListArgs{Filter: "prod-*", Grouped: true},
+			listed: []string{"prod-east", "prod-west"},
+		},
+		{
+			name:      "invalid pattern",
+			args:      RemoteListArgs{Filter: "prod-["},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			err := printRemoteList(&buf, c, &tt.args)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("unexpected success")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			out := buf.String()
+
+			if len(tt.listed) == 0 {
+				if !strings.Contains(out, "No matching remotes") {
+					t.Errorf("missing no match message in output:\n%s", out)
+				}
+			}
+			listed := make(map[string]bool)
+			for _, n := range tt.listed {
+				listColumns(t, out, n)
+				listed[n] = true
+			}
+			for n := range c.Remotes {
+				if !listed[n] && strings.Contains(out, n) {
+					t.Errorf("remote %s unexpectedly listed in output:\n%s", n, out)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoteListKeyserver(t *testing.T) {
+	remotes := map[string]*endpoint.Config{
+		"site": {
+			URI:    "site.example.com",
+			System: true,
+			Keyservers: []*endpoint.ServiceConfig{
+				{URI: "https://keys.site.example.com"},
+			},
+		},
+		"mine": {
+			URI: "mine.example.com",
+			Keyservers: []*endpoint.ServiceConfig{
+				{URI: "https://keys.mine.example.com", Skip: true},
+				{URI: "https://keys.site.example.com", External: true},
+			},
+		},
+		"other": {
+			URI: "other.example.com",
+			Keyservers: []*endpoint.ServiceConfig{
+				{URI: "https://keys.external.org", External: true},
+			},
+		},
+		"plain": {URI: "plain.example.com"},
+	}
+
+	tests := []struct {
+		name   string
+		active string
+		served string
+	}{
+		{
+			name:   "own keyserver",
+			active: "site",
+			served: "site",
+		},
+		{
+			name:   "keyserver of another remote",
+			active: "mine",
+			served: "site",
+		},
+		{
+			name:   "external keyserver",
+			active: "other",
+			served: "",
+		},
+		{
+			name:   "discovered keyserver",
+			active: "plain",
+			served: "plain",
+		},
+		{
+			name:   "no active remote",
+			active: "",
+			served: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &remote.Config{DefaultRemote: tt.active, Remotes: remotes}
+
+			var buf bytes.Buffer
+			if err := printRemoteList(&buf, c, &RemoteListArgs{Verify: true}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			out := buf.String()
+
+			header := listColumns(t, out, "NAME")
+			if header[len(header)-2] != "KEYSERVER" {
+				t.Fatalf("unexpected header: %v", header)
+			}
+			for n := range remotes {
+				want := "NO"
+				if n == tt.served {
+					want = "YES"
+				}
+				cols := listColumns(t, out, n)
+				if got := cols[len(cols)-2]; got != want {
+					t.Errorf("unexpected KEYSERVER column for %s: got %q, want %q", n, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoteListSource(t *testing.T) {
+	sys := &remote.Config{
+		DefaultRemote: "site",
+		Remotes: map[string]*endpoint.Config{
+			"site":   {URI: "site.example.com", System: true},
+			"mirror": {URI: "mirror.example.com", System: true},
+			"shared": {URI: "shared.example.com", System: true},
+		},
+	}
+	usr := &remote.Config{
+		Remotes: map[string]*endpoint.Config{
+			// the global remote the user logged in to
+			"site": {URI: "site.example.com", System: true, Token: "token"},
+			// a user remote overriding the global one
+			"shared": {URI: "shared.user.example.com"},
+			"mine":   {URI: "mine.example.com"},
+		},
+	}
+
+	args := &RemoteListArgs{Source: true, sources: remoteSources(usr, sys)}
+	if err := usr.SyncFrom(sys); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printRemoteList(&buf, usr, args); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	out := buf.String()
+
+	header := listColumns(t, out, "NAME")
+	if header[4] != "SOURCE" {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	want := map[string]string{
+		"site":   remoteSourceBoth,
+		"shared": remoteSourceBoth,
+		"mirror": remoteSourceSystem,
+		"mine":   remoteSourceUser,
+	}
+	for n, source := range want {
+		if got := listColumns(t, out, n)[4]; got != source {
+			t.Errorf("unexpected SOURCE column for %s: got %q, want %q", n, got, source)
+		}
+	}
+
+	// without a system config, all of the remotes come from the user one
+	sources := remoteSources(&remote.Config{Remotes: map[string]*endpoint.Config{"mine": {}}}, nil)
+	if sources["mine"] != remoteSourceUser || len(sources) != 1 {
+		t.Errorf("unexpected sources without system config: %v", sources)
+	}
+
+	// the column is only displayed with the option
+	buf.Reset()
+	if err := printRemoteList(&buf, usr, &RemoteListArgs{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Contains(buf.String(), "SOURCE") {
+		t.Errorf("unexpected SOURCE column without the option")
+	}
+}
+
+func TestRemoteListDefaultPullRegistry(t *testing.T) {
+	c := &remote.Config{
+		DefaultRemote: "site",
+		Remotes: map[string]*endpoint.Config{
+			"site":  {URI: "site.example.com", DefaultPullRegistry: "registry.site.example.com:5000/hub"},
+			"other": {URI: "other.example.com"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := printRemoteList(&buf, c, &RemoteListArgs{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	out := buf.String()
+	if header := listColumns(t, out, "NAME"); header[7] != "REGISTRY" {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	want := map[string]string{
+		"site":  "registry.site.example.com:5000/hub",
+		"other": "-",
+	}
+	for n, registry := range want {
+		if got := listColumns(t, out, n)[7]; got != registry {
+			t.Errorf("unexpected REGISTRY column for %s: got %q, want %q", n, got, registry)
+		}
+	}
+
+	// the column is only displayed when a remote sets a registry
+	delete(c.Remotes, "site")
+	buf.Reset()
+	if err := printRemoteList(&buf, c, &RemoteListArgs{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Contains(buf.String(), "REGISTRY") {
+		t.Errorf("unexpected REGISTRY column without default pull registry")
+	}
+}
+
+func TestRemoteListAliases(t *testing.T) {
+	c := &remote.Config{
+		DefaultRemote: "site",
+		Remotes: map[string]*endpoint.Config{
+			"site":  {URI: "site.example.com", Aliases: []string{"s", "lab"}},
+			"other": {URI: "other.example.com"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := printRemoteList(&buf, c, &RemoteListArgs{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	out := buf.String()
+	header := listColumns(t, out, "NAME")
+	if header[2] != "ACTIVE" || header[len(header)-1] != "ALIASES" {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	want := map[string]string{
+		"site":  "s,lab",
+		"other": "-",
+	}
+	for n, aliases := range want {
+		if got := listColumns(t, out, n)[len(header)-1]; got != aliases {
+			t.Errorf("unexpected ALIASES column for %s: got %q, want %q", n, got, aliases)
+		}
+	}
+
+	// the remotes are matched by their aliases
+	buf.Reset()
+	if err := printRemoteList(&buf, c, &RemoteListArgs{Filter: "lab"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out := buf.String(); !strings.Contains(out, "site.example.com") || strings.Contains(out, "other.example.com") {
+		t.Errorf("unexpected output filtered by alias:\n%s", out)
+	}
+
+	// the column is only displayed when a remote has an alias
+	c.Remotes["site"].Aliases = nil
+	buf.Reset()
+	if err := printRemoteList(&buf, c, &RemoteListArgs{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Contains(buf.String(), "ALIASES") {
+		t.Errorf("unexpected ALIASES column without aliases")
+	}
+}
+
+func TestRemoteListCheckActive(t *testing.T) {
+	now := time.Now()
+	expired := makeJWT(now.Add(-time.Hour))
+	remotes := map[string]*endpoint.Config{
+		"good":        {URI: "good.example.com", Token: makeJWT(now.Add(time.Hour))},
+		"expired":     {URI: "expired.example.com", Token: expired},
+		"unreachable": {URI: "unreachable.example.com"},
+		"both":        {URI: "both.example.com", Token: expired},
+	}
+	probe := func(e *endpoint.Config) error {
+		if e.URI == "unreachable.example.com" || e.URI == "both.example.com" {
+			return errors.New("while retrieving services: connection refused")
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name   string
+		active string
+		want   []string
+	}{
+		{name: "good", active: "good"},
+		{name: "none", active: ""},
+		{
+			name:   "expired",
+			active: "expired",
+			want:   []string{"The token of the active remote expired has expired, please login again"},
+		},
+		{
+			name:   "unreachable",
+			active: "unreachable",
+			want:   []string{"The active remote unreachable is unreachable: while retrieving services: connection refused"},
+		},
+		{
+			name:   "both",
+			active: "both",
+			want: []string{
+				"The token of the active remote both has expired, please login again",
+				"The active remote both is unreachable: while retrieving services: connection refused",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &remote.Config{DefaultRemote: tt.active, Remotes: remotes}
+			got := activeRemoteWarnings(c, now, probe)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected warnings %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadCachedConfigs(t *testing.T) {
+	dir := t.TempDir()
+	oldSysConfig := remote.SystemConfigPath
+	remote.SystemConfigPath = filepath.Join(dir, "system.yaml")
+	t.Cleanup(func() { remote.SystemConfigPath = oldSysConfig })
+
+	// the missing user config is created, as without cache
+	usrConfigFile := filepath.Join(dir, "remote.yaml")
+	cache := remote.NewConfigCache(time.Minute)
+	c, cSys, err := readCachedConfigs(cache, usrConfigFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(c.Remotes) != 0 || cSys != nil {
+		t.Errorf("unexpected configs: %+v, %+v", c, cSys)
+	}
+	if _, err := os.Stat(usrConfigFile); err != nil {
+		t.Errorf("user config not created: %s", err)
+	}
+
+	data := "Active: sys\nRemotes:\n  sys:\n    URI: sys.example.com\n    System: true\n"
+	if err := os.WriteFile(remote.SystemConfigPath, []byte(data), 0o644); err != nil {
+		t.Fatalf("while writing system config: %s", err)
+	}
+	if _, cSys, err = readCachedConfigs(cache, usrConfigFile); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cSys == nil || cSys.Remotes["sys"] == nil {
+		t.Errorf("unexpected system config: %+v", cSys)
+	}
+}
@@ -19,23 +19,32 @@ import (
 )
 
 func syncSysConfig(cUsr *remote.Config) error {
+	cSys, err := readSysConfig()
+	if err != nil || cSys == nil {
+		return err
+	}
+
+	// sync cUsr with system config cSys
+	return cUsr.SyncFrom(cSys)
+}
+
+// readSysConfig returns the system remote config, nil if there is none.
+func readSysConfig() (*remote.Config, error) {
 	// opening system config file
 	f, err := os.OpenFile(remote.SystemConfigPath, os.O_RDONLY, 0o600)
 	if err != nil && os.IsNotExist(err) {
-		return nil
+		return nil, nil
 	} else if err != nil {
-		return fmt.Errorf("while opening remote config file: %s", err)
+		return nil, fmt.Errorf("while opening remote config file: %s", err)
 	}
 	defer f.Close()
 
 	// read file contents to config struct
 	cSys, err := remote.ReadFrom(f)
 	if err != nil {
-		return fmt.Errorf("while parsing remote config data: %s", err)
+		return nil, fmt.Errorf("while parsing remote config data: %s", err)
 	}
-
-	// sync cUsr with system config cSys
-	return cUsr.SyncFrom(cSys)
+	return cSys, nil
 }
 
 // RemoteUse sets remote to use
@@ -0,0 +1,70 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package assemblers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/apptainer/apptainer/internal/pkg/build/sources"
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+)
+
+// OCIAssembler assembles an OCI image layout, or an oci-archive holding
+// it when Archive is set.
+type OCIAssembler struct {
+	Archive bool
+}
+
+// Assemble creates an OCI image layout, or an oci-archive, from a Bundle.
+func (a *OCIAssembler) Assemble(b *types.Bundle, path string) error {
+	if _, err := os.Lstat(path); err == nil {
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("while removing %s: %v", path, err)
+		}
+	}
+
+	if !a.Archive {
+		sylog.Infof("Creating OCI image layout...")
+		desc, err := sources.BundleToOCILayout(context.Background(), b, path)
+		if err != nil {
+			return fmt.Errorf("OCI image layout assemble failed: %v", err)
+		}
+		sylog.Debugf("Created image %s in %s", desc.Digest, path)
+		return nil
+	}
+
+	sylog.Infof("Creating oci-archive...")
+	layout := filepath.Join(b.TmpDir, "oci-layout")
+	desc, err := sources.BundleToOCILayout(context.Background(), b, layout)
+	if err != nil {
+		return fmt.Errorf("oci-archive assemble failed: %v", err)
+	}
+	defer os.RemoveAll(layout)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("oci-archive assemble failed: %v", err)
+	}
+	// an oci-archive is a tar stream of the layout
+	if err := types.ExportRootfsTar(layout, f, types.ExportTarOptions{}); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("while writing oci-archive: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("while writing oci-archive: %v", err)
+	}
+	sylog.Debugf("Created image %s in %s", desc.Digest, path)
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package assemblers_test
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/build/assemblers"
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/sif/v2/pkg/sif"
+	ociarchive "github.com/containers/image/v5/oci/archive"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/pkg/compression"
+	imagetypes "github.com/containers/image/v5/types"
+)
+
+// checkOCIImage checks the image of ref has a single layer holding the
+// files of the rootfs of newCompressionBundle, and the labels of the
+// container.
+func checkOCIImage(t *testing.T, ref imagetypes.ImageReference) {
+	t.Helper()
+
+	ctx := context.Background()
+	img, err := ref.NewImage(ctx, &imagetypes.SystemContext{})
+	if err != nil {
+		t.Fatalf("while opening image: %s", err)
+	}
+	defer img.Close()
+	config, err := img.OCIConfig(ctx)
+	if err != nil {
+		t.Fatalf("while reading image config: %s", err)
+	}
+	if config.Config.Labels["org.example.label"] != "value" {
+		t.Errorf("unexpected labels %v", config.Config.Labels)
+	}
+	layers := img.LayerInfos()
+	if len(layers) != 1 {
+		t.Fatalf("unexpected %d layers, want 1", len(layers))
+	}
+
+	src, err := ref.NewImageSource(ctx, &imagetypes.SystemContext{})
+	if err != nil {
+		t.Fatalf("while opening image source: %s", err)
+	}
+	defer src.Close()
+	rc, _, err := src.GetBlob(ctx, layers[0], nil)
+	if err != nil {
+		t.Fatalf("while reading layer: %s", err)
+	}
+	defer rc.Close()
+	r, _, err := compression.AutoDecompress(rc)
+	if err != nil {
+		t.Fatalf("while decompressing layer: %s", err)
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatalf("while reading layer: %s", err)
+		}
+		if filepath.Clean(hdr.Name) == "file" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("file missing from the layer")
+	}
+}
+
+// newOutputBundle returns the bundle of newCompressionBundle, with labels.
+func newOutputBundle(t *testing.T) *types.Bundle {
+	t.Helper()
+
+	b := newCompressionBundle(t)
+	dir := filepath.Join(b.RootfsPath, ".singularity.d")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	labels, err := json.Marshal(map[string]string{"org.example.label": "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "labels.json"), labels, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestOutputFormats builds each output format from the same rootfs.
+func TestOutputFormats(t *testing.T) {
+	b := newOutputBundle(t)
+	out := t.TempDir()
+
+	t.Run("oci-layout", func(t *testing.T) {
+		dest := filepath.Join(out, "layout")
+		if err := (&assemblers.OCIAssembler{}).Assemble(b, dest); err != nil {
+			t.Fatalf("failed to assemble: %v", err)
+		}
+		for _, name := range []string{"oci-layout", "index.json", "blobs/sha256"} {
+			if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+				t.Errorf("unexpected layout: %s", err)
+			}
+		}
+		ref, err := ocilayout.NewReference(dest, "latest")
+		if err != nil {
+			t.Fatalf("while parsing layout reference: %s", err)
+		}
+		checkOCIImage(t, ref)
+	})
+
+	t.Run("oci-archive", func(t *testing.T) {
+		dest := filepath.Join(out, "image.tar")
+		if err := (&assemblers.OCIAssembler{Archive: true}).Assemble(b, dest); err != nil {
+			t.Fatalf("failed to assemble: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(b.TmpDir, "oci-layout")); !os.IsNotExist(err) {
+			t.Errorf("temporary layout left: %v", err)
+		}
+		ref, err := ociarchive.NewReference(dest, "latest")
+		if err != nil {
+			t.Fatalf("while parsing archive reference: %s", err)
+		}
+		checkOCIImage(t, ref)
+	})
+
+	// the destinations of the other type are replaced, as with --force
+	t.Run("oci-archive over directory", func(t *testing.T) {
+		dest := filepath.Join(out, "forced")
+		if err := os.MkdirAll(filepath.Join(dest, "sandbox"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&assemblers.OCIAssembler{Archive: true}).Assemble(b, dest); err != nil {
+			t.Fatalf("failed to assemble: %v", err)
+		}
+		ref, err := ociarchive.NewReference(dest, "latest")
+		if err != nil {
+			t.Fatalf("while parsing archive reference: %s", err)
+		}
+		checkOCIImage(t, ref)
+	})
+
+	t.Run("sif", func(t *testing.T) {
+		mksquashfsPath, err := exec.LookPath("mksquashfs")
+		if err != nil {
+			mksquashfsPath = filepath.Join(t.TempDir(), "mksquashfs")
+			if err := os.WriteFile(mksquashfsPath, []byte(fakeMksquashfs), 0o755); err != nil {
+				t.Fatalf("while writing mksquashfs: %s", err)
+			}
+		}
+		dest := filepath.Join(out, "image.sif")
+		a := &assemblers.SIFAssembler{MksquashfsPath: mksquashfsPath}
+		if err := a.Assemble(b, dest); err != nil {
+			t.Fatalf("failed to assemble: %v", err)
+		}
+		f, err := sif.LoadContainerFromPath(dest, sif.OptLoadWithFlag(os.O_RDONLY))
+		if err != nil {
+			t.Fatalf("while loading SIF: %s", err)
+		}
+		defer f.UnloadContainer()
+		if _, err := f.GetDescriptor(sif.WithPartitionType(sif.PartPrimSys)); err != nil {
+			t.Errorf("while getting rootfs partition: %s", err)
+		}
+	})
+
+	t.Run("sandbox", func(t *testing.T) {
+		dest := filepath.Join(out, "sandbox")
+		if err := (&assemblers.SandboxAssembler{Copy: true}).Assemble(b, dest); err != nil {
+			t.Fatalf("failed to assemble: %v", err)
+		}
+		for _, name := range []string{"file", ".singularity.d/labels.json"} {
+			if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+				t.Errorf("unexpected sandbox: %s", err)
+			}
+		}
+	})
+}
@@ -35,6 +35,40 @@ type SIFAssembler struct {
 	MksquashfsProcs uint
 	MksquashfsMem   string
 	MksquashfsPath  string
+	// Compression is the compression algorithm of the squashfs, overriding
+	// GzipFlag, and CompressionLevel its level, the mksquashfs default
+	// when zero.
+	Compression      string
+	CompressionLevel int
+}
+
+// squashfsLevels are the compression levels of the squashfs compression
+// algorithms, nil for the algorithms without a level.
+var squashfsLevels = map[string][]int{
+	"gzip": {1, 9},
+	"lz4":  nil,
+	"lzo":  {1, 9},
+	"xz":   nil,
+	"zstd": {1, 22},
+}
+
+// SquashfsCompFlags returns the mksquashfs flags compressing the squashfs
+// with the algorithm comp at level, the default level of comp when zero.
+func SquashfsCompFlags(comp string, level int) ([]string, error) {
+	levels, ok := squashfsLevels[comp]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression algorithm %q, should be gzip, lz4, lzo, xz or zstd", comp)
+	}
+	flags := []string{"-comp", comp}
+	if level == 0 {
+		return flags, nil
+	}
+	if levels == nil {
+		return nil, fmt.Errorf("the %s compression algorithm has no compression level", comp)
+	} else if level < levels[0] || level > levels[1] {
+		return nil, fmt.Errorf("invalid %s compression level %d, should be between %d and %d", comp, level, levels[0], levels[1])
+	}
+	return append(flags, "-Xcompression-level", strconv.Itoa(level)), nil
 }
 
 type encryptionOptions struct {
@@ -174,7 +208,13 @@ func (a *SIFAssembler) Assemble(b *types.Bundle, path string) error {
 		flags = append(flags, "-all-root")
 	}
 	// specify compression if needed
-	if a.GzipFlag {
+	if a.Compression != "" {
+		compFlags, err := SquashfsCompFlags(a.Compression, a.CompressionLevel)
+		if err != nil {
+			return err
+		}
+		flags = append(flags, compFlags...)
+	} else if a.GzipFlag {
 		flags = append(flags, "-comp", "gzip")
 	}
 	if a.MksquashfsMem != "" {
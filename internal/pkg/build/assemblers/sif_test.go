@@ -14,6 +14,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/apptainer/apptainer/internal/pkg/build/assemblers"
@@ -21,7 +23,9 @@ import (
 	"github.com/apptainer/apptainer/internal/pkg/cache"
 	testCache "github.com/apptainer/apptainer/internal/pkg/test/tool/cache"
 	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/image"
 	useragent "github.com/apptainer/apptainer/pkg/util/user-agent"
+	"github.com/apptainer/sif/v2/pkg/sif"
 )
 
 const (
@@ -138,3 +142,185 @@ func TestSIFAssemblerShub(t *testing.T) {
 
 	defer os.Remove(assemblerShubDest)
 }
+
+func TestSquashfsCompFlags(t *testing.T) {
+	tests := []struct {
+		comp      string
+		level     int
+		want      []string
+		wantError string
+	}{
+		{comp: "gzip", want: []string{"-comp", "gzip"}},
+		{comp: "gzip", level: 9, want: []string{"-comp", "gzip", "-Xcompression-level", "9"}},
+		{comp: "lzo", level: 1, want: []string{"-comp", "lzo", "-Xcompression-level", "1"}},
+		{comp: "zstd", level: 22, want: []string{"-comp", "zstd", "-Xcompression-level", "22"}},
+		{comp: "xz", want: []string{"-comp", "xz"}},
+		{comp: "lz4", want: []string{"-comp", "lz4"}},
+		{comp: "xz", level: 6, wantError: "the xz compression algorithm has no compression level"},
+		{comp: "gzip", level: 10, wantError: "invalid gzip compression level 10, should be between 1 and 9"},
+		{comp: "brotli", wantError: `unsupported compression algorithm "brotli"`},
+	}
+	for _, tt := range tests {
+		flags, err := assemblers.SquashfsCompFlags(tt.comp, tt.level)
+		if tt.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("%s/%d: unexpected error: %v, want %q", tt.comp, tt.level, err, tt.wantError)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s/%d: unexpected error: %s", tt.comp, tt.level, err)
+			continue
+		}
+		if !reflect.DeepEqual(flags, tt.want) {
+			t.Errorf("%s/%d: unexpected flags %v, want %v", tt.comp, tt.level, flags, tt.want)
+		}
+	}
+}
+
+// fakeMksquashfs is a mksquashfs writing the options it is called with next
+// to the destination, and a squashfs super block for the -comp algorithm.
+const fakeMksquashfs = `#!/bin/sh
+dest=$2
+shift 2
+echo "$@" > "$dest.args"
+comp=1
+while [ $# -gt 0 ]; do
+	if [ "$1" = "-comp" ]; then
+		case $2 in
+		lzo) comp=3 ;;
+		xz) comp=4 ;;
+		lz4) comp=5 ;;
+		zstd) comp=6 ;;
+		esac
+	fi
+	shift
+done
+printf 'hsqs\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\000\00'$comp'\000\000\000\000\000\000\000\004\000\000\000' > "$dest"
+printf '%064d' 0 >> "$dest"
+`
+
+// readSIFComp returns the compression of the squashfs of the SIF image.
+func readSIFComp(t *testing.T, path string) string {
+	t.Helper()
+
+	f, err := sif.LoadContainerFromPath(path, sif.OptLoadWithFlag(os.O_RDONLY))
+	if err != nil {
+		t.Fatalf("while loading SIF: %s", err)
+	}
+	defer f.UnloadContainer()
+	d, err := f.GetDescriptor(sif.WithPartitionType(sif.PartPrimSys))
+	if err != nil {
+		t.Fatalf("while getting rootfs partition: %s", err)
+	}
+	data, err := d.GetData()
+	if err != nil {
+		t.Fatalf("while reading rootfs partition: %s", err)
+	}
+	comp, err := image.GetSquashfsComp(data)
+	if err != nil {
+		t.Fatalf("while looking for compression type: %s", err)
+	}
+	return comp
+}
+
+// newCompressionBundle returns a bundle whose rootfs holds a file.
+func newCompressionBundle(t *testing.T) *types.Bundle {
+	t.Helper()
+
+	b, err := types.NewBundle(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("unable to make bundle: %v", err)
+	}
+	t.Cleanup(func() { b.Remove() })
+	b.Recipe.FullRaw = []byte("bootstrap: scratch\n")
+	if err := os.WriteFile(filepath.Join(b.RootfsPath, "file"), []byte(strings.Repeat("content", 1000)), 0o644); err != nil {
+		t.Fatalf("while writing file: %s", err)
+	}
+	return b
+}
+
+// TestSIFAssemblerCompressionFlags checks the compression chosen is passed
+// to mksquashfs.
+func TestSIFAssemblerCompressionFlags(t *testing.T) {
+	mksquashfsPath := filepath.Join(t.TempDir(), "mksquashfs")
+	if err := os.WriteFile(mksquashfsPath, []byte(fakeMksquashfs), 0o755); err != nil {
+		t.Fatalf("while writing mksquashfs: %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		a         assemblers.SIFAssembler
+		wantFlags string
+		wantComp  string
+		wantError string
+	}{
+		{name: "default", wantComp: "gzip"},
+		{name: "gzip flag", a: assemblers.SIFAssembler{GzipFlag: true}, wantFlags: "-comp gzip", wantComp: "gzip"},
+		{name: "zstd", a: assemblers.SIFAssembler{GzipFlag: true, Compression: "zstd", CompressionLevel: 19}, wantFlags: "-comp zstd -Xcompression-level 19", wantComp: "zstd"},
+		{name: "xz", a: assemblers.SIFAssembler{Compression: "xz"}, wantFlags: "-comp xz", wantComp: "xz"},
+		{name: "invalid level", a: assemblers.SIFAssembler{Compression: "lzo", CompressionLevel: 12}, wantError: "invalid lzo compression level 12"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCompressionBundle(t)
+			a := tt.a
+			a.MksquashfsPath = mksquashfsPath
+			dest := filepath.Join(t.TempDir(), "image.sif")
+			err := a.Assemble(b, dest)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("failed to assemble: %v", err)
+			}
+
+			matches, err := filepath.Glob(filepath.Join(b.TmpDir, "squashfs-*.args"))
+			if err != nil || len(matches) != 1 {
+				t.Fatalf("unexpected mksquashfs calls %v: %v", matches, err)
+			}
+			args, err := os.ReadFile(matches[0])
+			if err != nil {
+				t.Fatalf("while reading mksquashfs options: %s", err)
+			}
+			if tt.wantFlags != "" && !strings.Contains(string(args), tt.wantFlags) {
+				t.Errorf("unexpected mksquashfs options %q, want %q", args, tt.wantFlags)
+			} else if tt.wantFlags == "" && strings.Contains(string(args), "-comp") {
+				t.Errorf("unexpected mksquashfs options %q", args)
+			}
+			if comp := readSIFComp(t, dest); comp != tt.wantComp {
+				t.Errorf("unexpected compression %s, want %s", comp, tt.wantComp)
+			}
+		})
+	}
+}
+
+// TestSIFAssemblerCompression checks the squashfs of the SIF image is
+// compressed with the algorithm chosen.
+func TestSIFAssemblerCompression(t *testing.T) {
+	mksquashfsPath, err := exec.LookPath("mksquashfs")
+	if err != nil {
+		t.Skipf("could not find mksquashfs: %v", err)
+	}
+
+	for _, comp := range []string{"gzip", "xz", "zstd"} {
+		t.Run(comp, func(t *testing.T) {
+			b := newCompressionBundle(t)
+			a := &assemblers.SIFAssembler{
+				MksquashfsPath: mksquashfsPath,
+				Compression:    comp,
+			}
+			dest := filepath.Join(t.TempDir(), "image.sif")
+			if err := a.Assemble(b, dest); err != nil {
+				if strings.Contains(err.Error(), "Compressor \""+comp+"\" is not supported") {
+					t.Skipf("%s compression not supported by %s", comp, mksquashfsPath)
+				}
+				t.Fatalf("failed to assemble: %v", err)
+			}
+			if got := readSIFComp(t, dest); got != comp {
+				t.Errorf("unexpected compression %s, want %s", got, comp)
+			}
+		})
+	}
+}
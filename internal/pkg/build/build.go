@@ -18,6 +18,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/apptainer/apptainer/internal/pkg/util/fs"
 	"github.com/apptainer/apptainer/pkg/util/fs/proc"
@@ -33,6 +34,7 @@ import (
 	"github.com/apptainer/apptainer/pkg/build/types/parser"
 	"github.com/apptainer/apptainer/pkg/image"
 	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/docker/go-units"
 	"github.com/samber/lo"
 )
 
@@ -45,6 +47,9 @@ import (
 type Build struct {
 	// stages of the build
 	stages []stage
+	// defs are the definitions of the stages, built for each platform
+	// with the PlatformAll platform
+	defs []types.Definition
 	// Conf contains cross stage build configuration.
 	Conf Config
 }
@@ -62,6 +67,43 @@ type Config struct {
 	Opts types.Options
 }
 
+// outputFormats are the formats of the built containers.
+var outputFormats = []string{"sandbox", "sif", "oci-layout", "oci-archive"}
+
+// ValidateOutput checks the output format, a sandbox directory, a SIF image,
+// an OCI image layout or an oci-archive, against the destination dest and
+// the options: only SIF images are encrypted and only sandboxes updated, and
+// the file formats can't overwrite an existing directory, nor an OCI image
+// layout an existing file, unless opts.Force replaces the destination.
+func ValidateOutput(format, dest string, opts types.Options) error {
+	file := false
+	switch format {
+	case "sandbox", "oci-layout":
+	case "sif", "oci-archive":
+		file = true
+	default:
+		return fmt.Errorf("unrecognized output format %q, should be %s", format, strings.Join(outputFormats, ", "))
+	}
+	if opts.EncryptionKeyInfo != nil && format != "sif" {
+		return fmt.Errorf("only SIF images can be encrypted, not the %s output format", format)
+	}
+	if opts.Update && format != "sandbox" {
+		return fmt.Errorf("only sandbox update is supported, not the %s output format", format)
+	}
+
+	fi, err := os.Stat(dest)
+	if err != nil || opts.Force {
+		return nil
+	}
+	if file && fi.IsDir() {
+		return fmt.Errorf("the %s output format needs a file, %s is an existing directory", format, dest)
+	} else if format == "oci-layout" && !fi.IsDir() {
+		// a sandbox still replaces an existing file, as it always did
+		return fmt.Errorf("the %s output format needs a directory, %s is an existing file", format, dest)
+	}
+	return nil
+}
+
 // NewBuild creates a new Build struct from a spec (URI, definition file, etc...).
 func NewBuild(spec string, conf Config) (*Build, error) {
 	def, err := makeDef(spec)
@@ -88,15 +130,30 @@ func newBuild(defs []types.Definition, conf Config) (*Build, error) {
 	}
 	conf.Dest = dest
 
+	if err := validateRunnableCheck(conf.Opts.RunnableCheck); err != nil {
+		return nil, err
+	}
+
 	// always build a sandbox if updating an existing sandbox
 	if conf.Opts.Update {
 		conf.Format = "sandbox"
 	}
 
+	// the manifests of the sources are fetched once for all of the stages
+	if conf.Opts.ManifestCache == nil {
+		conf.Opts.ManifestCache = types.NewMemoryManifestCache()
+	}
+
 	b := &Build{
 		Conf: conf,
 	}
 
+	if conf.Opts.Platform == types.PlatformAll {
+		// the stages are created by the build of each platform
+		b.defs = defs
+		return b, nil
+	}
+
 	// look if there is mount options set which could conflict
 	// with the build process like nodev and noexec
 	entries, err := proc.GetMountInfoEntry("/proc/self/mountinfo")
@@ -117,12 +174,12 @@ func newBuild(defs []types.Definition, conf Config) (*Build, error) {
 		if conf.Format == "sandbox" {
 			rootfsParent = filepath.Dir(conf.Dest)
 		}
-		parentPath, err := os.MkdirTemp(rootfsParent, "build-temp-")
+		parentPath, lock, err := types.MkdirScratch(rootfsParent, "build-temp-")
 		if err != nil {
 			return nil, fmt.Errorf("failed to create build parent dir: %w", err)
 		}
 
-		var s stage
+		s := stage{lock: lock}
 		if conf.Opts.EncryptionKeyInfo != nil {
 			s.b, err = types.NewEncryptedBundle(parentPath, conf.Opts.TmpDir, conf.Opts.EncryptionKeyInfo)
 			s.b.Opts.Unprivilege = conf.Opts.Unprivilege
@@ -130,6 +187,7 @@ func newBuild(defs []types.Definition, conf Config) (*Build, error) {
 			s.b, err = types.NewBundle(parentPath, conf.Opts.TmpDir)
 		}
 		if err != nil {
+			types.ReleaseScratchLock(lock)
 			return nil, err
 		}
 		s.name = d.Header["stage"]
@@ -191,15 +249,30 @@ func newBuild(defs []types.Definition, conf Config) (*Build, error) {
 	switch conf.Format {
 	case "sandbox":
 		b.stages[lastStageIndex].a = &assemblers.SandboxAssembler{Copy: sandboxCopy}
+		if conf.Opts.Compression != "" || conf.Opts.CompressionLevel != 0 {
+			sylog.Warningf("The compression options only apply to SIF images")
+		}
 	case "sif":
 		mksquashfsPath, err := squashfs.GetPath()
 		if err != nil {
 			return nil, fmt.Errorf("while searching for mksquashfs: %v", err)
 		}
 
-		flag, err := ensureGzipComp(b.stages[lastStageIndex].b.TmpDir, mksquashfsPath)
-		if err != nil {
-			return nil, fmt.Errorf("while ensuring correct compression algorithm: %v", err)
+		// a compression level alone applies to the gzip compression
+		comp := conf.Opts.Compression
+		if comp == "" && conf.Opts.CompressionLevel != 0 {
+			comp = "gzip"
+		}
+		var flag bool
+		if comp != "" {
+			if err := ensureComp(b.stages[lastStageIndex].b.TmpDir, mksquashfsPath, comp, conf.Opts.CompressionLevel); err != nil {
+				return nil, fmt.Errorf("while ensuring the compression algorithm: %v", err)
+			}
+		} else {
+			flag, err = ensureGzipComp(b.stages[lastStageIndex].b.TmpDir, mksquashfsPath)
+			if err != nil {
+				return nil, fmt.Errorf("while ensuring correct compression algorithm: %v", err)
+			}
 		}
 		mksquashfsProcs, err := squashfs.GetProcs()
 		if err != nil {
@@ -210,10 +283,17 @@ func newBuild(defs []types.Definition, conf Config) (*Build, error) {
 			return nil, fmt.Errorf("while searching for mksquashfs mem limits: %v", err)
 		}
 		b.stages[lastStageIndex].a = &assemblers.SIFAssembler{
-			GzipFlag:        flag,
-			MksquashfsProcs: mksquashfsProcs,
-			MksquashfsMem:   mksquashfsMem,
-			MksquashfsPath:  mksquashfsPath,
+			GzipFlag:         flag,
+			MksquashfsProcs:  mksquashfsProcs,
+			MksquashfsMem:    mksquashfsMem,
+			MksquashfsPath:   mksquashfsPath,
+			Compression:      comp,
+			CompressionLevel: conf.Opts.CompressionLevel,
+		}
+	case "oci-layout", "oci-archive":
+		b.stages[lastStageIndex].a = &assemblers.OCIAssembler{Archive: conf.Format == "oci-archive"}
+		if conf.Opts.Compression != "" || conf.Opts.CompressionLevel != 0 {
+			sylog.Warningf("The compression options only apply to SIF images")
 		}
 	default:
 		return nil, fmt.Errorf("unrecognized output format %s", conf.Format)
@@ -229,33 +309,79 @@ func newBuild(defs []types.Definition, conf Config) (*Build, error) {
 func ensureGzipComp(tmpdir, mksquashfsPath string) (bool, error) {
 	sylog.Debugf("Ensuring gzip compression for mksquashfs")
 
-	var err error
+	comp, err := testSquashfsComp(tmpdir, mksquashfsPath, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if comp == "gzip" {
+		sylog.Debugf("Gzip compression by default ensured")
+		return false, nil
+	}
+
+	// Now force add `-comp gzip` in addition to -noappend -mem -processors
+	comp, err = testSquashfsComp(tmpdir, mksquashfsPath, []string{"-comp", "gzip"})
+	if err != nil {
+		return false, fmt.Errorf("could not build squashfs with required gzip compression")
+	}
+
+	if comp == "gzip" {
+		sylog.Debugf("Gzip compression with -comp flag ensured")
+		return true, nil
+	}
+
+	return false, fmt.Errorf("could not build squashfs with required gzip compression")
+}
+
+// ensureComp builds a dummy squashfs image compressed with the algorithm
+// comp at level, returning an error if mksquashfs doesn't support them.
+func ensureComp(tmpdir, mksquashfsPath, comp string, level int) error {
+	sylog.Debugf("Ensuring %s compression for mksquashfs", comp)
+
+	compFlags, err := assemblers.SquashfsCompFlags(comp, level)
+	if err != nil {
+		return err
+	}
+	got, err := testSquashfsComp(tmpdir, mksquashfsPath, compFlags)
+	if err != nil {
+		return fmt.Errorf("the %s compression algorithm is not supported by %s: %v", comp, mksquashfsPath, err)
+	} else if got != comp {
+		return fmt.Errorf("the %s compression algorithm is not supported by %s: %s compression used instead", comp, mksquashfsPath, got)
+	}
+	return nil
+}
+
+// testSquashfsComp builds a dummy squashfs image with the compression flags
+// compFlags, and returns the type of compression used.
+func testSquashfsComp(tmpdir, mksquashfsPath string, compFlags []string) (string, error) {
 	s := packer.NewSquashfs()
 	s.MksquashfsPath = mksquashfsPath
 
-	srcf, err := os.CreateTemp(tmpdir, "squashfs-gzip-comp-test-src")
+	srcf, err := os.CreateTemp(tmpdir, "squashfs-comp-test-src")
 	if err != nil {
-		return false, fmt.Errorf("while creating temporary file for squashfs source: %v", err)
+		return "", fmt.Errorf("while creating temporary file for squashfs source: %v", err)
 	}
+	defer os.Remove(srcf.Name())
 
 	srcf.Write([]byte("Test File Content"))
 	srcf.Close()
 
-	f, err := os.CreateTemp(tmpdir, "squashfs-gzip-comp-test-")
+	f, err := os.CreateTemp(tmpdir, "squashfs-comp-test-")
 	if err != nil {
-		return false, fmt.Errorf("while creating temporary file for squashfs: %v", err)
+		return "", fmt.Errorf("while creating temporary file for squashfs: %v", err)
 	}
+	defer os.Remove(f.Name())
 	f.Close()
 
 	flags := []string{"-noappend"}
 
 	mksquashfsProcs, err := squashfs.GetProcs()
 	if err != nil {
-		return false, fmt.Errorf("while searching for mksquashfs processor limits: %v", err)
+		return "", fmt.Errorf("while searching for mksquashfs processor limits: %v", err)
 	}
 	mksquashfsMem, err := squashfs.GetMem()
 	if err != nil {
-		return false, fmt.Errorf("while searching for mksquashfs mem limits: %v", err)
+		return "", fmt.Errorf("while searching for mksquashfs mem limits: %v", err)
 	}
 	if mksquashfsMem != "" {
 		flags = append(flags, "-mem", mksquashfsMem)
@@ -263,49 +389,22 @@ func ensureGzipComp(tmpdir, mksquashfsPath string) (bool, error) {
 	if mksquashfsProcs != 0 {
 		flags = append(flags, "-processors", fmt.Sprint(mksquashfsProcs))
 	}
+	flags = append(flags, compFlags...)
 
 	if err := s.Create([]string{srcf.Name()}, f.Name(), flags); err != nil {
-		return false, fmt.Errorf("while creating squashfs: %v", err)
+		return "", fmt.Errorf("while creating squashfs: %v", err)
 	}
 
 	content, err := os.ReadFile(f.Name())
 	if err != nil {
-		return false, fmt.Errorf("while reading test squashfs: %v", err)
+		return "", fmt.Errorf("while reading test squashfs: %v", err)
 	}
 
 	comp, err := image.GetSquashfsComp(content)
 	if err != nil {
-		return false, fmt.Errorf("could not verify squashfs compression type: %v", err)
+		return "", fmt.Errorf("could not verify squashfs compression type: %v", err)
 	}
-
-	if comp == "gzip" {
-		sylog.Debugf("Gzip compression by default ensured")
-		return false, nil
-	}
-
-	// Now force add `-comp gzip` in addition to -noappend -mem -processors
-	flags = append(flags, "-comp", "gzip")
-
-	if err := s.Create([]string{srcf.Name()}, f.Name(), flags); err != nil {
-		return false, fmt.Errorf("could not build squashfs with required gzip compression")
-	}
-
-	content, err = os.ReadFile(f.Name())
-	if err != nil {
-		return false, fmt.Errorf("while reading test squashfs: %v", err)
-	}
-
-	comp, err = image.GetSquashfsComp(content)
-	if err != nil {
-		return false, fmt.Errorf("could not verify squashfs compression type: %v", err)
-	}
-
-	if comp == "gzip" {
-		sylog.Debugf("Gzip compression with -comp flag ensured")
-		return true, nil
-	}
-
-	return false, fmt.Errorf("could not build squashfs with required gzip compression")
+	return comp, nil
 }
 
 // cleanUp removes remnants of build from file system unless NoCleanUp is specified.
@@ -325,11 +424,17 @@ func (b Build) cleanUp() {
 		if err != nil {
 			sylog.Errorf("Could not remove bundle: %v", err)
 		}
+		if s.lock != nil {
+			types.ReleaseScratchLock(s.lock)
+		}
 	}
 }
 
 // Full runs a standard build from start to finish.
 func (b *Build) Full(ctx context.Context) error {
+	if b.Conf.Opts.Platform == types.PlatformAll {
+		return b.fullPlatforms(ctx)
+	}
 	sylog.Infof("Starting build...")
 
 	// monitor build for termination signal and clean up
@@ -343,6 +448,23 @@ func (b *Build) Full(ctx context.Context) error {
 	// clean up build normally
 	defer b.cleanUp()
 
+	var logFile *os.File
+	if b.Conf.Opts.LogFile != "" {
+		f, err := os.OpenFile(b.Conf.Opts.LogFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+		if err != nil {
+			return fmt.Errorf("unable to create log file: %v", err)
+		}
+		defer f.Close()
+		logFile = f
+	}
+	// teeLogs copies the logs of the source phase of a stage to logFile
+	teeLogs := func() (restore func()) {
+		if logFile == nil {
+			return func() {}
+		}
+		return sources.TeeLogs(logFile)
+	}
+
 	oldumask := syscall.Umask(0o002)
 
 	// build each stage one after the other
@@ -356,12 +478,15 @@ func (b *Build) Full(ctx context.Context) error {
 		if update {
 			// updating, extract dest container to bundle
 			sylog.Infof("Building into existing container: %s", b.Conf.Dest)
+			restoreLogs := teeLogs()
 			p, err := sources.GetLocalPacker(ctx, b.Conf.Dest, stage.b)
 			if err != nil {
+				restoreLogs()
 				return err
 			}
 
 			_, err = p.Pack(ctx)
+			restoreLogs()
 			if err != nil {
 				return err
 			}
@@ -370,13 +495,22 @@ func (b *Build) Full(ctx context.Context) error {
 			if b.Conf.Opts.ImgCache == nil {
 				return fmt.Errorf("undefined image cache")
 			}
+			restoreLogs := teeLogs()
 			if err := stage.c.Get(ctx, stage.b); err != nil {
-				return fmt.Errorf("conveyor failed to get: %v", err)
+				restoreLogs()
+				return fmt.Errorf("conveyor failed to get: %w", err)
 			}
 
 			_, err := stage.c.Pack(ctx)
+			restoreLogs()
 			if err != nil {
-				return fmt.Errorf("packer failed to pack: %v", err)
+				return fmt.Errorf("packer failed to pack: %w", err)
+			}
+
+			if stage.b.Opts.BuildProvenance {
+				if err := stage.insertBuildProvenance(time.Now()); err != nil {
+					return fmt.Errorf("while recording build provenance: %w", err)
+				}
 			}
 		}
 
@@ -443,6 +577,16 @@ func (b *Build) Full(ctx context.Context) error {
 
 	syscall.Umask(oldumask)
 
+	if last := b.stages[len(b.stages)-1]; len(last.b.Opts.PrunePatterns) > 0 || last.b.Opts.PruneProfile != "" {
+		if err := pruneRootfs(last.b); err != nil {
+			return err
+		}
+	}
+
+	if err := checkRunnable(b.stages[len(b.stages)-1].b); err != nil {
+		return err
+	}
+
 	sylog.Debugf("Calling assembler")
 	if err := b.stages[len(b.stages)-1].Assemble(b.Conf.Dest); err != nil {
 		return err
@@ -452,6 +596,34 @@ func (b *Build) Full(ctx context.Context) error {
 	return nil
 }
 
+// pruneRootfs removes the content of the bundle rootfs matching the prune
+// patterns and profile, and reports the space reclaimed.
+func pruneRootfs(b *types.Bundle) error {
+	var profile types.PruneProfile
+	if b.Opts.PruneProfile != "" {
+		var err error
+		if profile, err = types.GetPruneProfile(b.Opts.PruneProfile); err != nil {
+			return err
+		}
+	}
+	r, err := types.PruneRootfsProfile(b.RootfsPath, profile, b.Opts.PrunePatterns, b.Opts.PruneDryRun)
+	if err != nil {
+		return fmt.Errorf("while pruning container: %v", err)
+	}
+	if b.Opts.PruneDryRun {
+		for _, p := range r.Paths {
+			sylog.Infof("Would prune %s", p)
+		}
+		sylog.Infof("Pruning would reclaim %s from %d paths", units.BytesSize(float64(r.Bytes)), len(r.Paths))
+		return nil
+	}
+	for _, p := range r.Paths {
+		sylog.Verbosef("Pruned %s", p)
+	}
+	sylog.Infof("Pruning reclaimed %s from %d paths", units.BytesSize(float64(r.Bytes)), len(r.Paths))
+	return nil
+}
+
 // makeDef gets a definition object from a spec.
 func makeDef(spec string) (types.Definition, error) {
 	if ok, err := uri.IsValid(spec); ok && err == nil {
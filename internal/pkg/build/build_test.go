@@ -1,10 +1,13 @@
 package build
 
 import (
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/util/cryptkey"
 	"gotest.tools/v3/assert"
 )
 
@@ -58,3 +61,45 @@ func TestProcessWithAdditionalArgs(t *testing.T) {
 	assert.Equal(t, len(unusedArgs), 1)
 	assert.Equal(t, "ADDITION", unusedArgs[0])
 }
+
+func TestValidateOutput(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "image.sif")
+	assert.NilError(t, os.WriteFile(file, []byte("image"), 0o644))
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name      string
+		format    string
+		dest      string
+		opts      types.Options
+		wantError string
+	}{
+		{name: "sif", format: "sif", dest: missing},
+		{name: "sif over file", format: "sif", dest: file},
+		{name: "sif over directory", format: "sif", dest: dir, wantError: "needs a file"},
+		{name: "oci-archive over directory", format: "oci-archive", dest: dir, wantError: "needs a file"},
+		{name: "oci-layout", format: "oci-layout", dest: missing},
+		{name: "oci-layout over directory", format: "oci-layout", dest: dir},
+		{name: "oci-layout over file", format: "oci-layout", dest: file, wantError: "needs a directory"},
+		{name: "forced sif over directory", format: "sif", dest: dir, opts: types.Options{Force: true}},
+		{name: "forced oci-archive over directory", format: "oci-archive", dest: dir, opts: types.Options{Force: true}},
+		{name: "forced oci-layout over file", format: "oci-layout", dest: file, opts: types.Options{Force: true}},
+		{name: "forced encrypted oci-archive", format: "oci-archive", dest: dir, opts: types.Options{Force: true, EncryptionKeyInfo: &cryptkey.KeyInfo{}}, wantError: "only SIF images can be encrypted"},
+		{name: "sandbox over file", format: "sandbox", dest: file},
+		{name: "sandbox update", format: "sandbox", dest: dir, opts: types.Options{Update: true}},
+		{name: "oci-layout update", format: "oci-layout", dest: dir, opts: types.Options{Update: true}, wantError: "only sandbox update"},
+		{name: "encrypted oci-archive", format: "oci-archive", dest: missing, opts: types.Options{EncryptionKeyInfo: &cryptkey.KeyInfo{}}, wantError: "only SIF images can be encrypted"},
+		{name: "unknown format", format: "docker-archive", dest: missing, wantError: "unrecognized output format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateOutput(tt.format, tt.dest, tt.opts)
+			if tt.wantError == "" {
+				assert.NilError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package build
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apptainer/apptainer/internal/pkg/build/sources"
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+)
+
+// ContentAddressedName returns the content-addressed file name of the
+// image built from defs with conf, see types.ContentAddressedName, once
+// the digests of the sources of the stages are resolved.
+func ContentAddressedName(ctx context.Context, defs []types.Definition, conf Config) (string, error) {
+	if conf.Opts.Update {
+		return "", fmt.Errorf("content-addressed names are not supported when updating a sandbox")
+	}
+
+	stages := make([]types.ContentSource, 0, len(defs))
+	for _, d := range defs {
+		digest, err := sources.ResolveSourceDigest(ctx, d, conf.Opts)
+		if err != nil {
+			return "", fmt.Errorf("while resolving source digest: %w", err)
+		}
+		sylog.Debugf("Source %s:%s resolved to %s", d.Header["bootstrap"], d.Header["from"], digest)
+		stages = append(stages, types.ContentSource{Definition: d, Digest: digest})
+	}
+	return types.ContentAddressedName(stages, conf.Format, conf.Opts)
+}
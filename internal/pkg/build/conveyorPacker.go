@@ -43,7 +43,7 @@ func conveyorPacker(def types.Definition) (ConveyorPacker, error) {
 		return &sources.OrasConveyorPacker{}, nil
 	case "shub":
 		return &sources.ShubConveyorPacker{}, nil
-	case "docker", "docker-archive", "docker-daemon", "oci", "oci-archive":
+	case "docker", "docker-archive", "docker-daemon", "containerd", "oci", "oci-archive", "oci-http":
 		return &sources.OCIConveyorPacker{}, nil
 	case "busybox":
 		return &sources.BusyBoxConveyorPacker{}, nil
@@ -59,6 +59,8 @@ func conveyorPacker(def types.Definition) (ConveyorPacker, error) {
 		return &sources.ZypperConveyorPacker{}, nil
 	case "scratch":
 		return &sources.ScratchConveyorPacker{}, nil
+	case "cpio":
+		return &sources.CpioConveyorPacker{}, nil
 	case "":
 		return nil, fmt.Errorf("no bootstrap specification found")
 	default:
@@ -0,0 +1,253 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/apptainer/apptainer/internal/pkg/util/bin"
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	securejoin "github.com/cyphar/filepath-securejoin"
+)
+
+// GitSpecPrefix prefixes the URL of the git repositories built from, e.g.
+// git+https://github.com/user/repo.git#v1.0:path/to/app.def.
+const GitSpecPrefix = "git+"
+
+// GitDefinitionFile is the definition file built from the root directory
+// of a git repository when the spec doesn't name a path.
+const GitDefinitionFile = "Apptainer"
+
+// GitOptions are the options of the checkout of a git spec.
+type GitOptions struct {
+	// TmpDir is the directory the checkout is created in, the default
+	// temporary directory when empty.
+	TmpDir string
+	// Submodules checks out the submodules of the repository, recursively.
+	Submodules bool
+	// Username and Password, when set, authenticate to the http(s)
+	// repositories, in addition to the credential helpers of git.
+	Username string
+	Password string
+}
+
+// GitCheckout is the checkout of the git repository of a git spec.
+type GitCheckout struct {
+	// Dir is the directory of the checkout.
+	Dir string
+	// Spec is the path of the definition file or of the rootfs directory
+	// of the checkout to build from.
+	Spec string
+}
+
+// IsGitSpec reports whether the build spec is a git repository.
+func IsGitSpec(spec string) bool {
+	if !strings.HasPrefix(spec, GitSpecPrefix) {
+		return false
+	}
+	for _, scheme := range []string{"https://", "http://", "ssh://", "file://"} {
+		if strings.HasPrefix(spec[len(GitSpecPrefix):], scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGitSpec returns the URL of the repository of the git spec, and the
+// ref and the path within the repository of its fragment, set as #ref:path
+// like the docker build contexts. Both are optional, the default branch and
+// the root directory being used when empty.
+func parseGitSpec(spec string) (url, ref, path string, err error) {
+	if !IsGitSpec(spec) {
+		return "", "", "", fmt.Errorf("%s is not a git spec, should be %shttps://, http://, ssh:// or file://", spec, GitSpecPrefix)
+	}
+	url = strings.TrimPrefix(spec, GitSpecPrefix)
+	if i := strings.LastIndex(url, "#"); i >= 0 {
+		ref, path, _ = strings.Cut(url[i+1:], ":")
+		url = url[:i]
+	}
+	if strings.HasPrefix(ref, "-") {
+		return "", "", "", fmt.Errorf("invalid ref %q of %s", ref, spec)
+	}
+	for _, elem := range strings.Split(path, "/") {
+		if elem == ".." {
+			return "", "", "", fmt.Errorf("invalid path %q of %s: it can't hold a .. element", path, spec)
+		}
+	}
+	return url, ref, path, nil
+}
+
+// appendGitConfigEnv returns the environment env setting the git
+// configuration key to value, after the configuration already set in env
+// with GIT_CONFIG_COUNT and the GIT_CONFIG_KEY_<n> and GIT_CONFIG_VALUE_<n>
+// variables.
+func appendGitConfigEnv(env []string, key, value string) ([]string, error) {
+	count := 0
+	res := make([]string, 0, len(env)+3)
+	for _, e := range env {
+		if strings.HasPrefix(e, "GIT_CONFIG_COUNT=") {
+			v := strings.TrimPrefix(e, "GIT_CONFIG_COUNT=")
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid GIT_CONFIG_COUNT %q", v)
+			}
+			count = n
+			continue
+		}
+		res = append(res, e)
+	}
+	return append(res,
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", count+1),
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", count, key),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, value),
+	), nil
+}
+
+// CloneGitSpec checks out the ref of the repository of the git spec, with
+// its submodules when requested, and returns the checkout, to be removed by
+// the caller. Only the history of the ref is fetched, unless it is a commit
+// the repository doesn't advertise. The path of the spec, resolved within
+// the checkout, is a definition file or a rootfs directory, the root
+// directory holding a GitDefinitionFile being built from it.
+func CloneGitSpec(ctx context.Context, spec string, opts GitOptions) (co *GitCheckout, err error) {
+	url, ref, path, err := parseGitSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	gitPath, err := bin.FindBin("git")
+	if err != nil {
+		return nil, fmt.Errorf("git is required to build from %s: %w", spec, err)
+	}
+
+	dir, err := os.MkdirTemp(opts.TmpDir, "build-git-")
+	if err != nil {
+		return nil, fmt.Errorf("while creating git checkout directory: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	co = &GitCheckout{Dir: dir}
+
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if opts.Username != "" || opts.Password != "" {
+		// the credentials are passed in the environment, hidden from the
+		// process list, and only sent to the repository, not to the hosts of
+		// its submodules
+		auth := base64.StdEncoding.EncodeToString([]byte(opts.Username + ":" + opts.Password))
+		env, err = appendGitConfigEnv(env, "http."+url+".extraHeader", "Authorization: Basic "+auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	git := func(args ...string) error {
+		cmd := exec.CommandContext(ctx, gitPath, append([]string{"-C", dir}, args...)...)
+		cmd.Env = env
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		sylog.Debugf("Running git %s", strings.Join(args, " "))
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+
+	sylog.Infof("Cloning %s", url)
+	if err = git("init", "--quiet"); err != nil {
+		return nil, err
+	}
+	if err = git("remote", "add", "origin", url); err != nil {
+		return nil, err
+	}
+	fetchRef := ref
+	if fetchRef == "" {
+		fetchRef = "HEAD"
+	}
+	if err = git("fetch", "--quiet", "--depth", "1", "origin", fetchRef); err != nil {
+		if ref == "" {
+			return nil, err
+		}
+		// a commit not advertised by the repository is fetched with the
+		// whole history
+		sylog.Debugf("Fetching %s of %s with the whole history: %s", ref, url, err)
+		if err = git("fetch", "--quiet", "origin"); err != nil {
+			return nil, err
+		}
+		fetchRef = ref
+	} else {
+		fetchRef = "FETCH_HEAD"
+	}
+	if err = git("checkout", "--quiet", "--detach", fetchRef); err != nil {
+		return nil, fmt.Errorf("while checking out %s of %s: %w", ref, url, err)
+	}
+	if opts.Submodules {
+		if err = git("submodule", "update", "--quiet", "--init", "--recursive", "--depth", "1"); err != nil {
+			return nil, err
+		}
+	}
+
+	// the path is resolved within the checkout, its symlinks included
+	co.Spec, err = securejoin.SecureJoin(dir, path)
+	if err != nil {
+		return nil, fmt.Errorf("while resolving %s in %s: %w", path, url, err)
+	}
+	fi, err := os.Stat(co.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("while resolving %s in %s: %w", path, url, err)
+	}
+	if def := filepath.Join(co.Spec, GitDefinitionFile); fi.IsDir() && path == "" {
+		if fi, serr := os.Lstat(def); serr == nil && fi.Mode().IsRegular() {
+			co.Spec = def
+		}
+	}
+	sylog.Debugf("Building %s from %s", strings.TrimPrefix(co.Spec, dir), url)
+	return co, nil
+}
+
+// ResolveFiles resolves the relative host sources of the %files sections
+// of the definitions read from the checkout relative to the directory of
+// their definition file, instead of the current directory, so that they
+// are copied from the repository. The destination of a source without one
+// stays its relative path.
+func (co *GitCheckout) ResolveFiles(defs []types.Definition) {
+	dir := filepath.Dir(co.Spec)
+	for _, d := range defs {
+		for i, f := range d.BuildData.Files {
+			// the sources of the stages are not on the host
+			if strings.Split(f.Args, "#")[0] != "" {
+				continue
+			}
+			for j, transfer := range f.Files {
+				if transfer.Src == "" || filepath.IsAbs(transfer.Src) {
+					continue
+				}
+				if transfer.Dst == "" {
+					transfer.Dst = transfer.Src
+				}
+				transfer.Src = filepath.Join(dir, transfer.Src)
+				d.BuildData.Files[i].Files[j] = transfer
+			}
+		}
+	}
+}
+
+// Remove removes the checkout.
+func (co *GitCheckout) Remove() error {
+	return os.RemoveAll(co.Dir)
+}
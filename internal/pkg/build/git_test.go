@@ -0,0 +1,265 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package build
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/buildcfg"
+	"github.com/apptainer/apptainer/internal/pkg/cache"
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/util/apptainerconf"
+	"gotest.tools/v3/assert"
+)
+
+// requireGit skips the test when git isn't installed, and loads the
+// default configuration, when not loaded, for the lookup of git.
+func requireGit(t *testing.T) {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	if apptainerconf.GetCurrentConfig() == nil {
+		cfg, err := apptainerconf.Parse("")
+		assert.NilError(t, err)
+		apptainerconf.SetCurrentConfig(cfg)
+		apptainerconf.SetBinaryPath(buildcfg.LIBEXECDIR, true)
+	}
+}
+
+// runGit runs git in dir and returns its output.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "protocol.file.allow=always"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	assert.NilError(t, err, "git %s: %s", strings.Join(args, " "), out)
+	return strings.TrimSpace(string(out))
+}
+
+// writeRepoFiles writes the files to the work tree dir.
+func writeRepoFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NilError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+}
+
+// makeGitRepo creates a bare repository, whose main branch holds a
+// definition file and a rootfs directory, and a submodule, and returns its
+// URL and the first commit, holding a previous definition file.
+func makeGitRepo(t *testing.T) (url, first string) {
+	t.Helper()
+
+	tmp := t.TempDir()
+	sub := filepath.Join(tmp, "sub")
+	runGit(t, tmp, "init", "--quiet", "--initial-branch=main", sub)
+	writeRepoFiles(t, sub, map[string]string{"module.txt": "submodule\n"})
+	runGit(t, sub, "add", "-A")
+	runGit(t, sub, "commit", "--quiet", "-m", "submodule")
+
+	work := filepath.Join(tmp, "work")
+	runGit(t, tmp, "init", "--quiet", "--initial-branch=main", work)
+	writeRepoFiles(t, work, map[string]string{
+		GitDefinitionFile: "Bootstrap: scratch\n\n%files\n    first.txt /first.txt\n",
+		"first.txt":       "first\n",
+	})
+	runGit(t, work, "add", "-A")
+	runGit(t, work, "commit", "--quiet", "-m", "first")
+	first = runGit(t, work, "rev-parse", "HEAD")
+
+	writeRepoFiles(t, work, map[string]string{
+		"app/app.def":            "Bootstrap: scratch\n\n%files\n    hello.txt /hello.txt\n    data\n    /etc/passwd /passwd\n",
+		"app/hello.txt":          "hello\n",
+		"app/data/file":          "data\n",
+		"rootfs/etc/os-release":  "NAME=test\n",
+		"rootfs/usr/bin/.keep":   "",
+		"rootfs/bin/placeholder": "bin\n",
+	})
+	assert.NilError(t, os.Symlink("/etc", filepath.Join(work, "escape")))
+	runGit(t, work, "submodule", "add", "--quiet", sub, "sub")
+	runGit(t, work, "add", "-A")
+	runGit(t, work, "commit", "--quiet", "-m", "second")
+	runGit(t, work, "tag", "v1")
+
+	bare := filepath.Join(tmp, "repo.git")
+	runGit(t, tmp, "clone", "--quiet", "--bare", work, bare)
+	return "git+file://" + bare, first
+}
+
+func TestCloneGitSpec(t *testing.T) {
+	requireGit(t)
+	url, first := makeGitRepo(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		spec       string
+		submodules bool
+		// auth sets credentials, whose configuration doesn't replace the
+		// one of the environment
+		auth    bool
+		want    string
+		wantErr string
+	}{
+		{name: "default definition file", spec: url, want: GitDefinitionFile},
+		{name: "definition file", spec: url + "#main:app/app.def", want: "app/app.def"},
+		{name: "tag rootfs", spec: url + "#v1:rootfs", want: "rootfs"},
+		{name: "commit", spec: url + "#" + first, want: GitDefinitionFile},
+		{name: "submodules", spec: url + "#:sub/module.txt", submodules: true, want: "sub/module.txt"},
+		{name: "submodules with credentials", spec: url + "#:sub/module.txt", submodules: true, auth: true, want: "sub/module.txt"},
+		{name: "submodules not checked out", spec: url + "#:sub/module.txt", wantErr: "while resolving sub/module.txt"},
+		{name: "traversal", spec: url + "#main:../repo.git", wantErr: "can't hold a .. element"},
+		{name: "symlink out of the checkout", spec: url + "#main:escape/hostname", wantErr: "while resolving escape/hostname"},
+		{name: "unknown ref", spec: url + "#unknown", wantErr: "while checking out unknown"},
+		{name: "option ref", spec: url + "#--upload-pack=true", wantErr: "invalid ref"},
+		{name: "not a git spec", spec: "git+ftp://example.com/repo.git", wantErr: "is not a git spec"},
+	}
+
+	// the submodule is cloned from a local repository
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "protocol.file.allow")
+	t.Setenv("GIT_CONFIG_VALUE_0", "always")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := GitOptions{TmpDir: t.TempDir(), Submodules: tt.submodules}
+			if tt.auth {
+				opts.Username = "user"
+				opts.Password = "secret"
+			}
+			co, err := CloneGitSpec(ctx, tt.spec, opts)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			defer co.Remove()
+			assert.Equal(t, co.Spec, filepath.Join(co.Dir, tt.want))
+		})
+	}
+}
+
+func TestAppendGitConfigEnv(t *testing.T) {
+	key := "http.https://example.com/repo.git.extraHeader"
+
+	// the configuration already set is kept
+	env, err := appendGitConfigEnv([]string{
+		"HOME=/home/user",
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=protocol.file.allow",
+		"GIT_CONFIG_VALUE_0=always",
+	}, key, "Authorization: Basic dXNlcg==")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, env, []string{
+		"HOME=/home/user",
+		"GIT_CONFIG_KEY_0=protocol.file.allow",
+		"GIT_CONFIG_VALUE_0=always",
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_1=" + key,
+		"GIT_CONFIG_VALUE_1=Authorization: Basic dXNlcg==",
+	})
+
+	env, err = appendGitConfigEnv([]string{"HOME=/home/user"}, key, "value")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, env, []string{"HOME=/home/user", "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=" + key, "GIT_CONFIG_VALUE_0=value"})
+
+	_, err = appendGitConfigEnv([]string{"GIT_CONFIG_COUNT=x"}, key, "value")
+	assert.ErrorContains(t, err, "invalid GIT_CONFIG_COUNT")
+}
+
+func TestGitCheckoutResolveFiles(t *testing.T) {
+	requireGit(t)
+	url, _ := makeGitRepo(t)
+
+	co, err := CloneGitSpec(context.Background(), url+"#main:app/app.def", GitOptions{TmpDir: t.TempDir()})
+	assert.NilError(t, err)
+	defer co.Remove()
+
+	defs, _, err := MakeAllDefs(co.Spec, nil)
+	assert.NilError(t, err)
+	co.ResolveFiles(defs)
+
+	dir := filepath.Join(co.Dir, "app")
+	assert.DeepEqual(t, defs[0].BuildData.Files[0].Files, []types.FileTransport{
+		{Src: filepath.Join(dir, "hello.txt"), Dst: "/hello.txt"},
+		{Src: filepath.Join(dir, "data"), Dst: "data"},
+		{Src: "/etc/passwd", Dst: "/passwd"},
+	})
+}
+
+func TestBuildFromGit(t *testing.T) {
+	test.EnsurePrivilege(t)
+	requireGit(t)
+	// the build inspects the image with the installed apptainer
+	if _, err := os.Stat(filepath.Join(buildcfg.BINDIR, "apptainer")); err != nil {
+		t.Skip("apptainer is not installed")
+	}
+	url, _ := makeGitRepo(t)
+	passwd, err := os.ReadFile("/etc/passwd")
+	assert.NilError(t, err)
+
+	tests := []struct {
+		name  string
+		spec  string
+		files map[string]string
+	}{
+		{
+			name:  "rootfs",
+			spec:  url + "#v1:rootfs",
+			files: map[string]string{"etc/os-release": "NAME=test\n", "bin/placeholder": "bin\n"},
+		},
+		{
+			name:  "definition file",
+			spec:  url + "#main:app/app.def",
+			files: map[string]string{"hello.txt": "hello\n", "data/file": "data\n", "passwd": string(passwd)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			co, err := CloneGitSpec(context.Background(), tt.spec, GitOptions{TmpDir: tmpDir})
+			assert.NilError(t, err)
+			defer co.Remove()
+
+			defs, _, err := MakeAllDefs(co.Spec, nil)
+			assert.NilError(t, err)
+			co.ResolveFiles(defs)
+
+			imgCache, err := cache.New(cache.Config{ParentDir: t.TempDir()})
+			assert.NilError(t, err)
+
+			dest := filepath.Join(tmpDir, "sandbox")
+			b, err := New(defs, Config{
+				Dest:   dest,
+				Format: "sandbox",
+				Opts:   types.Options{ImgCache: imgCache, TmpDir: tmpDir, Sections: []string{"all"}, NoTest: true},
+			})
+			assert.NilError(t, err)
+			assert.NilError(t, b.Full(context.Background()))
+
+			for name, content := range tt.files {
+				data, err := os.ReadFile(filepath.Join(dest, name))
+				assert.NilError(t, err)
+				assert.Equal(t, string(data), content)
+			}
+		})
+	}
+}
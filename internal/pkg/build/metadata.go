@@ -147,6 +147,18 @@ func insertStartScript(b *types.Bundle) error {
 }
 
 func insertTestScript(b *types.Bundle) error {
+	if b.RunSection("test") && b.Opts.TestScript != "" {
+		data, err := os.ReadFile(b.Opts.TestScript)
+		if err != nil {
+			return fmt.Errorf("while reading test script: %v", err)
+		}
+		if b.Recipe.ImageData.Test.Script != "" {
+			sylog.Warningf("The %%test section of the definition is replaced by the test script %s", b.Opts.TestScript)
+		}
+		sylog.Infof("Adding testscript %s", b.Opts.TestScript)
+		shebang, script := handleShebangScript(types.Script{Script: string(data)})
+		return os.WriteFile(filepath.Join(b.RootfsPath, "/.singularity.d/test"), []byte(shebang+"\n\n"+script+"\n"), 0o755)
+	}
 	if b.RunSection("test") && b.Recipe.ImageData.Test.Script != "" {
 		sylog.Infof("Adding testscript")
 		shebang, script := handleShebangScript(b.Recipe.ImageData.Test)
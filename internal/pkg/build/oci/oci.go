@@ -240,6 +240,14 @@ func getDockerRefDigest(ctx context.Context, ref types.ImageReference, sys *type
 		sys.ArchitectureChoice = defaultCtx.ArchitectureChoice
 		sys.VariantChoice = defaultCtx.VariantChoice
 	}
+	// docker.GetDigest requires the docker reference itself, not a wrapper
+	for {
+		u, ok := ref.(interface{ Unwrap() types.ImageReference })
+		if !ok {
+			break
+		}
+		ref = u.Unwrap()
+	}
 	d, err := docker.GetDigest(ctx, sys, ref)
 	if err != nil {
 		return "", err
@@ -264,8 +272,10 @@ func getArchFromURI(uri string) (arch *GoArch) {
 		archURI = uriComponents[0]
 	}
 
-	// handle this type: docker://docker.io/amd64/alpine
-	if strings.IndexByte(archURI, '.') != -1 && len(uriComponents) > 1 {
+	// handle this type: docker://docker.io/amd64/alpine, the first component
+	// is a registry host, with an optional port, as the reference parser of
+	// containers/image detects it, e.g. localhost:5000/amd64/alpine
+	if (strings.ContainsAny(archURI, ".:") || archURI == "localhost") && len(uriComponents) > 1 {
 		archURI = uriComponents[1]
 	}
 
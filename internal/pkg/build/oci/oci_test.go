@@ -195,6 +195,39 @@ func TestParseURI(t *testing.T) {
 	}
 }
 
+func TestGetArchFromURI(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+		want string
+	}{
+		{name: "no arch", uri: "docker://alpine", want: ""},
+		{name: "arch namespace", uri: "docker://arm64v8/alpine", want: "arm64v8"},
+		{name: "registry", uri: "docker://docker.io/amd64/alpine", want: "amd64"},
+		{name: "registry port", uri: "docker://registry.example.com:5000/arm32v7/alpine:3.18", want: "arm32v7"},
+		{name: "localhost", uri: "docker://localhost/arm64v8/alpine", want: "arm64v8"},
+		{name: "localhost port", uri: "docker://localhost:5000/arm64v8/alpine", want: "arm64v8"},
+		{name: "host port", uri: "docker://registry:5000/ppc64le/alpine", want: "ppc64le"},
+		{name: "nested repository", uri: "docker://registry.example.com:5000/team/project/subpath/image:tag", want: ""},
+		{name: "registry only", uri: "docker://registry.example.com:5000", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arch := getArchFromURI(tt.uri)
+			if tt.want == "" {
+				if arch != nil {
+					t.Errorf("unexpected arch for %s: %+v", tt.uri, arch)
+				}
+				return
+			}
+			if arch == nil || *arch != ArchMap[tt.want] {
+				t.Errorf("unexpected arch for %s: got %+v, want %+v", tt.uri, arch, ArchMap[tt.want])
+			}
+		})
+	}
+}
+
 func createValidSysCtx() *types.SystemContext {
 	opts := buildTypes.Options{
 		NoHTTPS: true,
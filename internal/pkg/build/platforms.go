@@ -0,0 +1,116 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apptainer/apptainer/internal/pkg/build/sources"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// PlatformImage is an image of a build for all platforms.
+type PlatformImage struct {
+	// Platform is the os/architecture[/variant] platform of the image.
+	Platform string `json:"platform"`
+	// Path is the path of the image, relative to the manifest.
+	Path string `json:"path"`
+	// Digest is the digest of the SIF image, empty for a sandbox.
+	Digest digest.Digest `json:"digest,omitempty"`
+}
+
+// PlatformManifest ties together the images of a build for all platforms,
+// one for each platform of the image index of the source, so that the image
+// of the platform of a host can be selected from it.
+type PlatformManifest struct {
+	Images []PlatformImage `json:"images"`
+}
+
+// PlatformDest returns the destination of the image built for platform, for
+// a build for all platforms to dest, e.g. image-linux-arm64-v8.sif for the
+// linux/arm64/v8 platform and image.sif.
+func PlatformDest(dest, platform string) string {
+	ext := filepath.Ext(dest)
+	return strings.TrimSuffix(dest, ext) + "-" + strings.ReplaceAll(platform, "/", "-") + ext
+}
+
+// PlatformManifestPath returns the path of the manifest of a build for all
+// platforms to dest, e.g. image.platforms.json for image.sif.
+func PlatformManifestPath(dest string) string {
+	return strings.TrimSuffix(dest, filepath.Ext(dest)) + ".platforms.json"
+}
+
+// fullPlatforms builds an image for each platform of the image index of the
+// source of the last stage, see PlatformDest, and writes their manifest.
+func (b *Build) fullPlatforms(ctx context.Context) error {
+	if b.Conf.Opts.Update {
+		return fmt.Errorf("an existing image can't be updated for all platforms")
+	}
+	platforms, err := sources.IndexPlatforms(ctx, b.defs[len(b.defs)-1], b.Conf.Opts)
+	if err != nil {
+		return fmt.Errorf("while listing the platforms of the source: %w", err)
+	}
+	return buildPlatforms(b.Conf, platforms, func(conf Config) error {
+		pb, err := newBuild(b.defs, conf)
+		if err != nil {
+			return err
+		}
+		return pb.Full(ctx)
+	})
+}
+
+// buildPlatforms runs build with the configuration conf for each of the
+// platforms, then writes the manifest listing the images built.
+func buildPlatforms(conf Config, platforms []string, build func(Config) error) error {
+	m := PlatformManifest{}
+	manifestPath := PlatformManifestPath(conf.Dest)
+	for _, platform := range platforms {
+		c := conf
+		c.Dest = PlatformDest(conf.Dest, platform)
+		c.Opts.Platform = platform
+		sylog.Infof("Building image for the %s platform: %s", platform, c.Dest)
+		if err := build(c); err != nil {
+			return fmt.Errorf("while building image for the %s platform: %w", platform, err)
+		}
+
+		rel, err := filepath.Rel(filepath.Dir(manifestPath), c.Dest)
+		if err != nil {
+			return err
+		}
+		img := PlatformImage{Platform: platform, Path: rel}
+		if conf.Format != "sandbox" {
+			f, err := os.Open(c.Dest)
+			if err != nil {
+				return err
+			}
+			img.Digest, err = digest.FromReader(f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("while computing digest of %s: %w", c.Dest, err)
+			}
+		}
+		m.Images = append(m.Images, img)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(manifestPath, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("while writing platform manifest: %w", err)
+	}
+	sylog.Infof("Wrote the manifest of the images of %d platforms: %s", len(platforms), manifestPath)
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apptainer/apptainer/pkg/build/types"
+	digest "github.com/opencontainers/go-digest"
+	"gotest.tools/v3/assert"
+)
+
+func TestPlatformDest(t *testing.T) {
+	assert.Equal(t, PlatformDest("/tmp/image.sif", "linux/arm64/v8"), "/tmp/image-linux-arm64-v8.sif")
+	assert.Equal(t, PlatformDest("/tmp/sandbox", "linux/amd64"), "/tmp/sandbox-linux-amd64")
+	assert.Equal(t, PlatformManifestPath("/tmp/image.sif"), "/tmp/image.platforms.json")
+	assert.Equal(t, PlatformManifestPath("/tmp/sandbox"), "/tmp/sandbox.platforms.json")
+}
+
+func TestBuildPlatforms(t *testing.T) {
+	dir := t.TempDir()
+	conf := Config{
+		Dest:   filepath.Join(dir, "image.sif"),
+		Format: "sif",
+		Opts:   types.Options{Platform: types.PlatformAll},
+	}
+	platforms := []string{"linux/amd64", "linux/arm64/v8"}
+
+	// the stub build writes the platform it's configured for
+	var built []string
+	err := buildPlatforms(conf, platforms, func(c Config) error {
+		built = append(built, c.Opts.Platform)
+		return os.WriteFile(c.Dest, []byte(c.Opts.Platform), 0o644)
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, built, platforms)
+
+	data, err := os.ReadFile(filepath.Join(dir, "image.platforms.json"))
+	assert.NilError(t, err)
+	var m PlatformManifest
+	assert.NilError(t, json.Unmarshal(data, &m))
+	assert.DeepEqual(t, m, PlatformManifest{Images: []PlatformImage{
+		{Platform: "linux/amd64", Path: "image-linux-amd64.sif", Digest: digest.FromString("linux/amd64")},
+		{Platform: "linux/arm64/v8", Path: "image-linux-arm64-v8.sif", Digest: digest.FromString("linux/arm64/v8")},
+	}})
+	for _, img := range m.Images {
+		content, err := os.ReadFile(filepath.Join(dir, img.Path))
+		assert.NilError(t, err)
+		assert.Equal(t, string(content), img.Platform)
+	}
+
+	// a failed platform build fails without manifest
+	conf.Dest = filepath.Join(dir, "failed.sif")
+	errBuild := errors.New("build failed")
+	err = buildPlatforms(conf, platforms, func(c Config) error { return errBuild })
+	assert.ErrorIs(t, err, errBuild)
+	_, err = os.Stat(filepath.Join(dir, "failed.platforms.json"))
+	assert.Assert(t, os.IsNotExist(err))
+}
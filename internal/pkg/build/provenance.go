@@ -0,0 +1,86 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/buildcfg"
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/image"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/apptainer/apptainer/pkg/util/namespaces"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// sourceDigester is implemented by the conveyors knowing the manifest
+// digest of their source image.
+type sourceDigester interface {
+	SourceDigest() digest.Digest
+}
+
+// insertBuildProvenance records the provenance of the build of the stage,
+// once its source was fetched at the time now, in the image metadata.
+func (s *stage) insertBuildProvenance(now time.Time) error {
+	p, err := s.buildProvenance(buildMode(), now)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("while encoding build provenance: %s", err)
+	}
+
+	if s.b.Opts.SandboxTarget {
+		sylog.Warningf("The build provenance is only recorded in SIF images")
+	}
+	s.b.JSONObjects[image.SIFDescBuildProvenanceJSON] = data
+	return nil
+}
+
+// buildProvenance returns the provenance of the build of the stage in the
+// build mode, at the time now unless SOURCE_DATE_EPOCH is set.
+func (s *stage) buildProvenance(mode string, now time.Time) (*types.BuildProvenance, error) {
+	epoch, ok, err := types.SourceDateEpoch()
+	if err != nil {
+		return nil, err
+	} else if ok {
+		now = epoch
+	}
+
+	p := &types.BuildProvenance{
+		Version:   buildcfg.PACKAGE_VERSION,
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Mode:      mode,
+		Source:    s.b.Recipe.Header["bootstrap"],
+		Timestamp: now.UTC().Truncate(time.Second),
+	}
+	if from := s.b.Recipe.Header["from"]; from != "" {
+		p.Source += "://" + from
+	}
+	if d, ok := s.c.(sourceDigester); ok {
+		p.SourceDigest = d.SourceDigest()
+	}
+	return p, nil
+}
+
+// buildMode returns the mode of the running build.
+func buildMode() string {
+	if os.Geteuid() != 0 {
+		return types.BuildModeRootless
+	} else if namespaces.IsUnprivileged() {
+		return types.BuildModeFakeroot
+	}
+	return types.BuildModeRoot
+}
@@ -0,0 +1,98 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package build
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/build/sources"
+	"github.com/apptainer/apptainer/internal/pkg/buildcfg"
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/image"
+	digest "github.com/opencontainers/go-digest"
+	"gotest.tools/v3/assert"
+)
+
+// digestConveyor is a conveyor whose source image has a known digest.
+type digestConveyor struct {
+	d digest.Digest
+}
+
+func (c digestConveyor) Get(context.Context, *types.Bundle) error { return nil }
+
+func (c digestConveyor) Pack(context.Context) (*types.Bundle, error) { return nil, nil }
+
+func (c digestConveyor) SourceDigest() digest.Digest { return c.d }
+
+func TestInsertBuildProvenance(t *testing.T) {
+	d := digest.FromString("manifest")
+	now := time.Date(2023, 5, 4, 12, 30, 15, 500, time.FixedZone("CEST", 2*3600))
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		c      ConveyorPacker
+		epoch  string
+		want   types.BuildProvenance
+	}{
+		{
+			name:   "docker",
+			header: map[string]string{"bootstrap": "docker", "from": "alpine:3.18"},
+			c:      digestConveyor{d: d},
+			want: types.BuildProvenance{
+				Source:       "docker://alpine:3.18",
+				SourceDigest: d,
+				Timestamp:    time.Date(2023, 5, 4, 10, 30, 15, 0, time.UTC),
+			},
+		},
+		{
+			name:   "scratch",
+			header: map[string]string{"bootstrap": "scratch"},
+			c:      &sources.ScratchConveyorPacker{},
+			epoch:  "1600000000",
+			want: types.BuildProvenance{
+				Source:    "scratch",
+				Timestamp: time.Unix(1600000000, 0).UTC(),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.epoch != "" {
+				t.Setenv("SOURCE_DATE_EPOCH", tt.epoch)
+			}
+			b, err := types.NewBundle(t.TempDir(), t.TempDir())
+			assert.NilError(t, err)
+			t.Cleanup(func() { b.Remove() })
+			b.Recipe.Header = tt.header
+			s := &stage{c: tt.c, b: b}
+
+			p, err := s.buildProvenance(types.BuildModeFakeroot, now)
+			assert.NilError(t, err)
+			want := tt.want
+			want.Version = buildcfg.PACKAGE_VERSION
+			want.OS = runtime.GOOS
+			want.Arch = runtime.GOARCH
+			want.Mode = types.BuildModeFakeroot
+			assert.DeepEqual(t, *p, want)
+
+			// the recorded provenance is retrieved from the image metadata
+			assert.NilError(t, s.insertBuildProvenance(now))
+			data, ok := b.JSONObjects[image.SIFDescBuildProvenanceJSON]
+			assert.Assert(t, ok)
+			got, err := types.ParseBuildProvenance(data)
+			assert.NilError(t, err)
+			want.Mode = buildMode()
+			assert.DeepEqual(t, *got, want)
+		})
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/image"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// errNotRunnable is returned for a container which isn't runnable with the
+// types.RunnableCheckError policy.
+var errNotRunnable = errors.New("container is not runnable")
+
+// runnableShells are the shells looked for in the containers.
+var runnableShells = []string{"/bin/sh", "/bin/bash", "/bin/ash", "/bin/busybox", "/usr/bin/sh", "/usr/bin/bash"}
+
+// defaultPath is the PATH the executables of the entrypoint are looked up
+// in, when the config of the image doesn't set one.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// validateRunnableCheck returns an error if policy isn't a policy of
+// types.Options.RunnableCheck, so that it fails before the build runs.
+func validateRunnableCheck(policy string) error {
+	switch policy {
+	case "", types.RunnableCheckIgnore, types.RunnableCheckWarn, types.RunnableCheckError:
+		return nil
+	}
+	return fmt.Errorf("invalid policy %q for the containers which aren't runnable, should be %s, %s or %s", policy,
+		types.RunnableCheckIgnore, types.RunnableCheckWarn, types.RunnableCheckError)
+}
+
+// checkRunnable applies the runnable check policy of b, validated by
+// validateRunnableCheck, to its rootfs, failing with errNotRunnable or
+// warning with the types.RunnableCheckError and types.RunnableCheckWarn
+// policies when it isn't runnable.
+func checkRunnable(b *types.Bundle) error {
+	policy := b.Opts.RunnableCheck
+	if policy == "" || policy == types.RunnableCheckIgnore {
+		return nil
+	}
+
+	reason, err := notRunnableReason(b)
+	if err != nil {
+		return fmt.Errorf("while checking the container is runnable: %w", err)
+	}
+	if reason == "" {
+		return nil
+	}
+	if policy == types.RunnableCheckWarn {
+		sylog.Warningf("The container may not be runnable: %s", reason)
+		return nil
+	}
+	return fmt.Errorf("%w: %s (use --check-runnable=warn or ignore for an intentionally minimal container)", errNotRunnable, reason)
+}
+
+// notRunnableReason returns why the rootfs of b isn't runnable, or an empty
+// string when it holds the interpreter of the %runscript of the definition,
+// run in place of the entrypoint, or else the executable of the entrypoint,
+// or cmd, of its image config, or a shell when it has none.
+func notRunnableReason(b *types.Bundle) (string, error) {
+	var config imgspecv1.ImageConfig
+	if data, ok := b.JSONObjects[image.SIFDescOCIConfigJSON]; ok {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return "", fmt.Errorf("while decoding image config: %w", err)
+		}
+	}
+
+	if b.Recipe.ImageData.Runscript.Script != "" {
+		shebang, _ := handleShebangScript(b.Recipe.ImageData.Runscript)
+		for _, name := range shebangCommands(shebang) {
+			found, err := findExecutable(b.RootfsPath, name, imagePath(config.Env))
+			if err != nil {
+				return "", err
+			} else if !found {
+				return fmt.Sprintf("the interpreter %s of the %%runscript isn't an executable of the container", name), nil
+			}
+		}
+		return "", nil
+	}
+
+	kind, args := "entrypoint", config.Entrypoint
+	if len(args) == 0 {
+		kind, args = "cmd", config.Cmd
+	}
+	if len(args) > 0 {
+		name := args[0]
+		if strings.Contains(name, "/") && !filepath.IsAbs(name) {
+			name = filepath.Join("/", config.WorkingDir, name)
+		}
+		found, err := findExecutable(b.RootfsPath, name, imagePath(config.Env))
+		if err != nil || found {
+			return "", err
+		}
+		return fmt.Sprintf("the %s %s of the image config isn't an executable of the container", kind, args[0]), nil
+	}
+
+	for _, sh := range runnableShells {
+		found, err := findExecutable(b.RootfsPath, sh, "")
+		if err != nil || found {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("no shell found among %s", strings.Join(runnableShells, ", ")), nil
+}
+
+// shebangCommands returns the interpreter of the shebang line shebang, and
+// the command it runs when it is env, e.g. /usr/bin/env and python3 for
+// #!/usr/bin/env python3.
+func shebangCommands(shebang string) []string {
+	fields := strings.Fields(strings.TrimPrefix(shebang, "#!"))
+	if len(fields) == 0 {
+		return nil
+	}
+	commands := fields[:1]
+	if filepath.Base(fields[0]) == "env" {
+		for _, f := range fields[1:] {
+			// the options and variables set by env
+			if strings.HasPrefix(f, "-") || strings.Contains(f, "=") {
+				continue
+			}
+			commands = append(commands, f)
+			break
+		}
+	}
+	return commands
+}
+
+// imagePath returns the PATH set by the environment env of an image
+// config, or defaultPath.
+func imagePath(env []string) string {
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			return strings.TrimPrefix(e, "PATH=")
+		}
+	}
+	return defaultPath
+}
+
+// findExecutable reports whether name, an absolute path or a command looked
+// up in the directories of path, is an executable file of rootfs. The
+// symlinks are resolved inside rootfs.
+func findExecutable(rootfs, name, path string) (bool, error) {
+	candidates := []string{name}
+	if !strings.Contains(name, "/") {
+		candidates = nil
+		for _, dir := range filepath.SplitList(path) {
+			if filepath.IsAbs(dir) {
+				candidates = append(candidates, filepath.Join(dir, name))
+			}
+		}
+	}
+
+	for _, c := range candidates {
+		p, err := securejoin.SecureJoin(rootfs, c)
+		if err != nil {
+			return false, err
+		}
+		fi, err := os.Stat(p)
+		if os.IsNotExist(err) || errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.ENOTDIR) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if fi.Mode().IsRegular() && fi.Mode().Perm()&0o111 != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
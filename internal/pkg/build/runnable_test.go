@@ -0,0 +1,196 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/image"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestCheckRunnable(t *testing.T) {
+	// files of the rootfs, executable when their mode is set
+	type file struct {
+		path   string
+		mode   os.FileMode
+		target string
+	}
+
+	tests := []struct {
+		name      string
+		files     []file
+		config    *imgspecv1.ImageConfig
+		runscript string
+		policy    string
+		wantWarn  string
+		wantErr   bool
+	}{
+		{
+			name:     "scratch warn",
+			files:    []file{{path: "data/file", mode: 0o644}},
+			policy:   types.RunnableCheckWarn,
+			wantWarn: "no shell found",
+		},
+		{
+			name:    "scratch error",
+			files:   []file{{path: "data/file", mode: 0o644}},
+			policy:  types.RunnableCheckError,
+			wantErr: true,
+		},
+		{
+			name:  "scratch ignored",
+			files: []file{{path: "data/file", mode: 0o644}},
+		},
+		{
+			name:   "shell",
+			files:  []file{{path: "bin/busybox", mode: 0o755}, {path: "bin/sh", target: "busybox"}},
+			policy: types.RunnableCheckError,
+		},
+		{
+			name:   "entrypoint in path",
+			files:  []file{{path: "app/server", mode: 0o755}},
+			config: &imgspecv1.ImageConfig{Entrypoint: []string{"server"}, Env: []string{"PATH=/app"}},
+			policy: types.RunnableCheckError,
+		},
+		{
+			name:   "absolute cmd through symlink",
+			files:  []file{{path: "usr/bin/app", mode: 0o755}, {path: "bin", target: "usr/bin"}},
+			config: &imgspecv1.ImageConfig{Cmd: []string{"/bin/app", "--serve"}},
+			policy: types.RunnableCheckError,
+		},
+		{
+			name:   "relative entrypoint",
+			files:  []file{{path: "srv/bin/app", mode: 0o755}},
+			config: &imgspecv1.ImageConfig{Entrypoint: []string{"bin/app"}, WorkingDir: "/srv"},
+			policy: types.RunnableCheckError,
+		},
+		{
+			name:     "missing entrypoint",
+			files:    []file{{path: "bin/sh", mode: 0o755}},
+			config:   &imgspecv1.ImageConfig{Entrypoint: []string{"/usr/bin/app"}},
+			policy:   types.RunnableCheckWarn,
+			wantWarn: "entrypoint /usr/bin/app",
+		},
+		{
+			name:     "entrypoint not executable",
+			files:    []file{{path: "usr/bin/app", mode: 0o644}},
+			config:   &imgspecv1.ImageConfig{Entrypoint: []string{"app"}},
+			policy:   types.RunnableCheckWarn,
+			wantWarn: "entrypoint app",
+		},
+		{
+			name:     "entrypoint escaping rootfs",
+			files:    []file{{path: "usr/bin/app", target: "/../../../../bin/sh"}},
+			config:   &imgspecv1.ImageConfig{Entrypoint: []string{"/usr/bin/app"}},
+			policy:   types.RunnableCheckWarn,
+			wantWarn: "entrypoint /usr/bin/app",
+		},
+		{
+			name:      "runscript without shell",
+			files:     []file{{path: "usr/bin/app", mode: 0o755}},
+			config:    &imgspecv1.ImageConfig{Entrypoint: []string{"/usr/bin/app"}},
+			runscript: "exec /usr/bin/app",
+			policy:    types.RunnableCheckError,
+			wantErr:   true,
+		},
+		{
+			// the shell isn't the interpreter of the runscript
+			name:      "runscript interpreter missing",
+			files:     []file{{path: "bin/sh", mode: 0o755}},
+			runscript: "#!/bin/bash\nexec app",
+			policy:    types.RunnableCheckWarn,
+			wantWarn:  "interpreter /bin/bash of the %runscript",
+		},
+		{
+			name:      "runscript interpreter with env",
+			files:     []file{{path: "usr/bin/env", mode: 0o755}, {path: "opt/python/bin/python3", mode: 0o755}},
+			config:    &imgspecv1.ImageConfig{Env: []string{"PATH=/opt/python/bin"}},
+			runscript: "#!/usr/bin/env -S python3 -u\nprint('run')",
+			policy:    types.RunnableCheckError,
+		},
+		{
+			name:      "runscript command of env missing",
+			files:     []file{{path: "usr/bin/env", mode: 0o755}, {path: "bin/sh", mode: 0o755}},
+			runscript: "#!/usr/bin/env python3\nprint('run')",
+			policy:    types.RunnableCheckWarn,
+			wantWarn:  "interpreter python3 of the %runscript",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &types.Bundle{RootfsPath: t.TempDir(), JSONObjects: make(map[string][]byte)}
+			b.Opts.RunnableCheck = tt.policy
+			b.Recipe.ImageData.Runscript.Script = tt.runscript
+			for _, f := range tt.files {
+				p := filepath.Join(b.RootfsPath, f.path)
+				assert.NilError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+				if f.target != "" {
+					assert.NilError(t, os.Symlink(f.target, p))
+				} else {
+					assert.NilError(t, os.WriteFile(p, []byte("#!/bin/sh\n"), f.mode))
+				}
+			}
+			if tt.config != nil {
+				data, err := json.Marshal(tt.config)
+				assert.NilError(t, err)
+				b.JSONObjects[image.SIFDescOCIConfigJSON] = data
+			}
+
+			var output bytes.Buffer
+			oldWriter := sylog.SetWriter(&output)
+			err := checkRunnable(b)
+			sylog.SetWriter(oldWriter)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("unexpected success")
+				}
+				if tt.policy == types.RunnableCheckError && !errors.Is(err, errNotRunnable) {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			assert.NilError(t, err)
+			if tt.wantWarn == "" {
+				if output.Len() > 0 {
+					t.Errorf("unexpected output: %q", output.String())
+				}
+			} else if !strings.Contains(output.String(), "may not be runnable") || !strings.Contains(output.String(), tt.wantWarn) {
+				t.Errorf("unexpected output %q, want %q", output.String(), tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestValidateRunnableCheck(t *testing.T) {
+	for _, policy := range []string{"", types.RunnableCheckIgnore, types.RunnableCheckWarn, types.RunnableCheckError} {
+		if err := validateRunnableCheck(policy); err != nil {
+			t.Errorf("unexpected error for policy %q: %s", policy, err)
+		}
+	}
+	if err := validateRunnableCheck("fail"); err == nil || !strings.Contains(err.Error(), `invalid policy "fail"`) {
+		t.Errorf("unexpected error for an invalid policy: %v", err)
+	}
+
+	// an invalid policy fails before the build
+	_, err := newBuild([]types.Definition{{}}, Config{Dest: t.TempDir(), Opts: types.Options{RunnableCheck: "fail"}})
+	if err == nil || !strings.Contains(err.Error(), `invalid policy "fail"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
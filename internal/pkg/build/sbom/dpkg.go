@@ -0,0 +1,101 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sbom
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// dpkgStatus is the dpkg database, relative to the root filesystem.
+	dpkgStatus = "var/lib/dpkg/status"
+	// dpkgStatusDir holds a dpkg database file per package in distroless
+	// images, relative to the root filesystem.
+	dpkgStatusDir = "var/lib/dpkg/status.d"
+)
+
+// readDpkg returns the packages installed in the dpkg database of the root
+// filesystem rootfs.
+func readDpkg(rootfs string) ([]Package, error) {
+	files := []string{filepath.Join(rootfs, dpkgStatus)}
+	entries, err := os.ReadDir(filepath.Join(rootfs, dpkgStatusDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasSuffix(e.Name(), ".md5sums") {
+			files = append(files, filepath.Join(rootfs, dpkgStatusDir, e.Name()))
+		}
+	}
+
+	var pkgs []Package
+	for _, path := range files {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		p, err := parseDpkgStatus(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		pkgs = append(pkgs, p...)
+	}
+	return pkgs, nil
+}
+
+// parseDpkgStatus returns the installed packages of the dpkg status file
+// read from r.
+func parseDpkgStatus(r io.Reader) ([]Package, error) {
+	var pkgs []Package
+
+	fields := make(map[string]string)
+	flush := func() {
+		// the files of the distroless databases don't have a status
+		status, ok := fields["Status"]
+		installed := !ok || strings.HasSuffix(status, " installed")
+		if fields["Package"] != "" && installed {
+			pkgs = append(pkgs, Package{
+				Type:    TypeDeb,
+				Name:    fields["Package"],
+				Version: fields["Version"],
+				Arch:    fields["Architecture"],
+			})
+		}
+		fields = make(map[string]string)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		// continuation lines of multi-line fields, e.g. Description
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			fields[key] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return pkgs, nil
+}
@@ -0,0 +1,229 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sbom
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/apptainer/apptainer/internal/pkg/util/fs"
+	// registers the sqlite3 driver of database/sql
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// rpmDBDirs are the locations of the rpm database, relative to the root
+// filesystem, by order of preference.
+var rpmDBDirs = []string{"usr/lib/sysimage/rpm", "var/lib/rpm"}
+
+const (
+	// rpmSqliteDB is the sqlite rpm database, used since rpm 4.16.
+	rpmSqliteDB = "rpmdb.sqlite"
+	// rpmBerkeleyDB is the Berkeley DB rpm database.
+	rpmBerkeleyDB = "Packages"
+	// rpmNDB is the ndb rpm database, used by SUSE.
+	rpmNDB = "Packages.db"
+)
+
+// rpm header tags and types, see rpmtag.h
+const (
+	rpmTagName    = 1000
+	rpmTagVersion = 1001
+	rpmTagRelease = 1002
+	rpmTagEpoch   = 1003
+	rpmTagArch    = 1022
+
+	rpmTypeInt32  = 4
+	rpmTypeString = 6
+)
+
+// readRPM returns the packages installed in the rpm database of the root
+// filesystem rootfs. The sqlite databases are read directly, the other
+// formats with the rpm command of the host.
+func readRPM(rootfs string) ([]Package, error) {
+	for _, d := range rpmDBDirs {
+		dir := filepath.Join(rootfs, d)
+		if _, err := os.Lstat(filepath.Join(dir, rpmSqliteDB)); err == nil {
+			return readRPMSqlite(filepath.Join(dir, rpmSqliteDB))
+		}
+		for _, name := range []string{rpmBerkeleyDB, rpmNDB} {
+			if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+				return queryRPM(dir)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// readRPMSqlite returns the packages of the sqlite rpm database path.
+func readRPMSqlite(path string) ([]Package, error) {
+	// immutable prevents any lock or journal file to be created in the
+	// root filesystem
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&immutable=1")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT blob FROM Packages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pkgs []Package
+	for rows.Next() {
+		var blob []byte
+		if err := rows.Scan(&blob); err != nil {
+			return nil, err
+		}
+		p, err := parseRPMHeader(blob)
+		if err != nil {
+			return nil, err
+		}
+		// the imported keys are stored as pseudo packages
+		if p.Name == "gpg-pubkey" {
+			continue
+		}
+		pkgs = append(pkgs, p)
+	}
+	return pkgs, rows.Err()
+}
+
+// parseRPMHeader returns the package described by the rpm header blob, as
+// stored in the rpm database.
+func parseRPMHeader(blob []byte) (Package, error) {
+	p := Package{Type: TypeRPM}
+
+	if len(blob) < 8 {
+		return p, errors.New("truncated rpm header")
+	}
+	count := binary.BigEndian.Uint32(blob[0:4])
+	size := binary.BigEndian.Uint32(blob[4:8])
+	entries := blob[8:]
+	if uint64(len(entries)) < uint64(count)*16+uint64(size) {
+		return p, errors.New("truncated rpm header")
+	}
+	data := entries[count*16 : count*16+size]
+
+	var version, release string
+	epoch := -1
+	for i := uint32(0); i < count; i++ {
+		e := entries[i*16 : i*16+16]
+		tag := binary.BigEndian.Uint32(e[0:4])
+		typ := binary.BigEndian.Uint32(e[4:8])
+		offset := binary.BigEndian.Uint32(e[8:12])
+		if offset >= size {
+			continue
+		}
+
+		switch {
+		case typ == rpmTypeString:
+			s := data[offset:]
+			if end := bytes.IndexByte(s, 0); end >= 0 {
+				s = s[:end]
+			}
+			switch tag {
+			case rpmTagName:
+				p.Name = string(s)
+			case rpmTagVersion:
+				version = string(s)
+			case rpmTagRelease:
+				release = string(s)
+			case rpmTagArch:
+				p.Arch = string(s)
+			}
+		case typ == rpmTypeInt32 && tag == rpmTagEpoch && offset+4 <= size:
+			epoch = int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		}
+	}
+	if p.Name == "" {
+		return p, errors.New("rpm header without package name")
+	}
+
+	p.Version = version
+	if release != "" {
+		p.Version += "-" + release
+	}
+	if epoch > 0 {
+		p.Version = strconv.Itoa(epoch) + ":" + p.Version
+	}
+	return p, nil
+}
+
+// rpmQueryFormat is the query format of the packages listed by queryRPM.
+const rpmQueryFormat = `%{NAME}\t%|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}\t%{ARCH}\n`
+
+// queryRPM returns the packages of the rpm database dir, listed with the
+// rpm command of the host. The database is queried from a scratch copy, as
+// rpm may create lock or environment files, or rebuild the indexes, in its
+// dbpath, which would modify the image.
+func queryRPM(dir string) ([]Package, error) {
+	rpm, err := exec.LookPath("rpm")
+	if err != nil {
+		return nil, fmt.Errorf("the rpm command is required to read the database in %s: %w", dir, err)
+	}
+
+	dbpath, err := os.MkdirTemp("", "sbom-rpmdb-")
+	if err != nil {
+		return nil, fmt.Errorf("while creating a copy of the database in %s: %s", dir, err)
+	}
+	defer os.RemoveAll(dbpath)
+	if err := copyRPMDB(dir, dbpath); err != nil {
+		return nil, fmt.Errorf("while copying the database in %s: %s", dir, err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(rpm, "--dbpath", dbpath, "-qa", "--qf", rpmQueryFormat)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("while querying the database in %s: %s: %s", dir, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var pkgs []Package
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 || fields[0] == "gpg-pubkey" {
+			continue
+		}
+		arch := fields[2]
+		if arch == "(none)" {
+			arch = ""
+		}
+		pkgs = append(pkgs, Package{Type: TypeRPM, Name: fields[0], Version: fields[1], Arch: arch})
+	}
+	return pkgs, nil
+}
+
+// copyRPMDB copies the regular files of the rpm database dir to dst. The
+// symlinks, which could point out of the root filesystem, and the
+// directories aren't copied.
+func copyRPMDB(dir, dst string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if err := fs.CopyFile(filepath.Join(dir, e.Name()), filepath.Join(dst, e.Name()), 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package sbom generates a minimal software bill of materials of a root
+// filesystem, from its os-release file and package databases.
+package sbom
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// TypeDeb is the type of the packages of the dpkg database.
+	TypeDeb = "deb"
+	// TypeRPM is the type of the packages of the rpm database.
+	TypeRPM = "rpm"
+)
+
+// OS identifies the distribution of a root filesystem, from its os-release
+// file.
+type OS struct {
+	ID         string `json:"id,omitempty"`
+	VersionID  string `json:"versionID,omitempty"`
+	PrettyName string `json:"prettyName,omitempty"`
+}
+
+// Package is a package installed in a root filesystem.
+type Package struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch,omitempty"`
+}
+
+// SBOM lists the packages installed in a root filesystem.
+type SBOM struct {
+	OS       OS        `json:"os"`
+	Packages []Package `json:"packages"`
+}
+
+// Generate returns the SBOM of the root filesystem rootfs. The packages are
+// read from the dpkg and rpm databases found, and sorted by type and name.
+func Generate(rootfs string) (*SBOM, error) {
+	s := &SBOM{Packages: []Package{}}
+
+	osInfo, err := readOSRelease(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	s.OS = osInfo
+
+	debs, err := readDpkg(rootfs)
+	if err != nil {
+		return nil, fmt.Errorf("while reading dpkg database: %s", err)
+	}
+	rpms, err := readRPM(rootfs)
+	if err != nil {
+		return nil, fmt.Errorf("while reading rpm database: %s", err)
+	}
+	s.Packages = append(s.Packages, debs...)
+	s.Packages = append(s.Packages, rpms...)
+
+	sort.SliceStable(s.Packages, func(i, j int) bool {
+		pi, pj := s.Packages[i], s.Packages[j]
+		if pi.Type != pj.Type {
+			return pi.Type < pj.Type
+		}
+		if pi.Name != pj.Name {
+			return pi.Name < pj.Name
+		}
+		return pi.Arch < pj.Arch
+	})
+	return s, nil
+}
+
+// osReleasePaths are the locations of the os-release file, relative to the
+// root filesystem, by order of preference.
+var osReleasePaths = []string{"etc/os-release", "usr/lib/os-release"}
+
+// readOSRelease returns the distribution of the root filesystem rootfs, empty
+// if it has no os-release file.
+func readOSRelease(rootfs string) (OS, error) {
+	var osInfo OS
+
+	for _, p := range osReleasePaths {
+		path := filepath.Join(rootfs, p)
+		// a symlink would be resolved against the host, etc/os-release
+		// usually links to the usr/lib one anyway
+		fi, err := os.Lstat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return osInfo, fmt.Errorf("while reading %s: %s", p, err)
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+			if !ok || strings.HasPrefix(key, "#") {
+				continue
+			}
+			if v, err := strconv.Unquote(value); err == nil {
+				value = v
+			} else {
+				value = strings.Trim(value, `'"`)
+			}
+			switch key {
+			case "ID":
+				osInfo.ID = value
+			case "VERSION_ID":
+				osInfo.VersionID = value
+			case "PRETTY_NAME":
+				osInfo.PrettyName = value
+			}
+		}
+		return osInfo, scanner.Err()
+	}
+	return osInfo, nil
+}
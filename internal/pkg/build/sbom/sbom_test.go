@@ -0,0 +1,207 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sbom
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// rpmHeader returns an rpm header blob with the string tags and the epoch,
+// if not negative.
+func rpmHeader(tags map[uint32]string, epoch int) []byte {
+	var entries, data bytes.Buffer
+
+	entry := func(tag, typ uint32) {
+		binary.Write(&entries, binary.BigEndian, [4]uint32{tag, typ, uint32(data.Len()), 1})
+	}
+	// an immutable region tag, ignored
+	entry(63, 7)
+	data.Write(make([]byte, 16))
+	for tag, s := range tags {
+		entry(tag, rpmTypeString)
+		data.WriteString(s)
+		data.WriteByte(0)
+	}
+	if epoch >= 0 {
+		// int32 values are aligned
+		for data.Len()%4 != 0 {
+			data.WriteByte(0)
+		}
+		entry(rpmTagEpoch, rpmTypeInt32)
+		binary.Write(&data, binary.BigEndian, uint32(epoch))
+	}
+
+	var blob bytes.Buffer
+	binary.Write(&blob, binary.BigEndian, [2]uint32{uint32(entries.Len() / 16), uint32(data.Len())})
+	blob.Write(entries.Bytes())
+	blob.Write(data.Bytes())
+	return blob.Bytes()
+}
+
+// makeRPMRootfs creates a root filesystem with a sqlite rpm database
+// holding the headers blobs.
+func makeRPMRootfs(t *testing.T, blobs ...[]byte) string {
+	t.Helper()
+
+	rootfs := t.TempDir()
+	dbDir := filepath.Join(rootfs, "usr", "lib", "sysimage", "rpm")
+	if err := os.MkdirAll(dbDir, 0o755); err != nil {
+		t.Fatalf("while creating %s: %s", dbDir, err)
+	}
+	etc := filepath.Join(rootfs, "etc")
+	if err := os.MkdirAll(etc, 0o755); err != nil {
+		t.Fatalf("while creating %s: %s", etc, err)
+	}
+	osRelease := "NAME=\"Rocky Linux\"\nID=\"rocky\"\nVERSION_ID=\"9.3\"\nPRETTY_NAME=\"Rocky Linux 9.3 (Blue Onyx)\"\n"
+	if err := os.WriteFile(filepath.Join(rootfs, "usr", "lib", "os-release"), []byte(osRelease), 0o644); err != nil {
+		t.Fatalf("while writing os-release: %s", err)
+	}
+	if err := os.Symlink("../usr/lib/os-release", filepath.Join(etc, "os-release")); err != nil {
+		t.Fatalf("while creating os-release symlink: %s", err)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(dbDir, rpmSqliteDB))
+	if err != nil {
+		t.Fatalf("while creating rpm database: %s", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE Packages (hnum INTEGER PRIMARY KEY AUTOINCREMENT, blob BLOB NOT NULL)"); err != nil {
+		t.Fatalf("while creating rpm database: %s", err)
+	}
+	for _, b := range blobs {
+		if _, err := db.Exec("INSERT INTO Packages (blob) VALUES (?)", b); err != nil {
+			t.Fatalf("while inserting rpm header: %s", err)
+		}
+	}
+	return rootfs
+}
+
+func TestGenerateDpkg(t *testing.T) {
+	s, err := Generate(filepath.Join("testdata", "debian"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	wantOS := OS{ID: "debian", VersionID: "12", PrettyName: "Debian GNU/Linux 12 (bookworm)"}
+	if s.OS != wantOS {
+		t.Errorf("unexpected os: got %+v, want %+v", s.OS, wantOS)
+	}
+	want := []Package{
+		{Type: TypeDeb, Name: "base-files", Version: "12.4+deb12u5", Arch: "amd64"},
+		{Type: TypeDeb, Name: "libc6", Version: "2.36-9+deb12u7", Arch: "amd64"},
+		{Type: TypeDeb, Name: "tzdata", Version: "2024a-0+deb12u1", Arch: "all"},
+	}
+	if !reflect.DeepEqual(s.Packages, want) {
+		t.Errorf("unexpected packages: got %+v, want %+v", s.Packages, want)
+	}
+}
+
+func TestGenerateRPM(t *testing.T) {
+	rootfs := makeRPMRootfs(t,
+		rpmHeader(map[uint32]string{rpmTagName: "zlib", rpmTagVersion: "1.2.11", rpmTagRelease: "40.el9", rpmTagArch: "x86_64"}, -1),
+		rpmHeader(map[uint32]string{rpmTagName: "bash", rpmTagVersion: "5.1.8", rpmTagRelease: "6.el9_1", rpmTagArch: "x86_64"}, -1),
+		rpmHeader(map[uint32]string{rpmTagName: "openssl-libs", rpmTagVersion: "3.0.7", rpmTagRelease: "24.el9", rpmTagArch: "x86_64"}, 1),
+		rpmHeader(map[uint32]string{rpmTagName: "gpg-pubkey", rpmTagVersion: "350d275d", rpmTagRelease: "6267f4c4"}, -1),
+	)
+
+	s, err := Generate(rootfs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// etc/os-release is a symlink, the usr/lib one is read
+	wantOS := OS{ID: "rocky", VersionID: "9.3", PrettyName: "Rocky Linux 9.3 (Blue Onyx)"}
+	if s.OS != wantOS {
+		t.Errorf("unexpected os: got %+v, want %+v", s.OS, wantOS)
+	}
+	want := []Package{
+		{Type: TypeRPM, Name: "bash", Version: "5.1.8-6.el9_1", Arch: "x86_64"},
+		{Type: TypeRPM, Name: "openssl-libs", Version: "1:3.0.7-24.el9", Arch: "x86_64"},
+		{Type: TypeRPM, Name: "zlib", Version: "1.2.11-40.el9", Arch: "x86_64"},
+	}
+	if !reflect.DeepEqual(s.Packages, want) {
+		t.Errorf("unexpected packages: got %+v, want %+v", s.Packages, want)
+	}
+
+	// the database is read without creating any file next to it
+	entries, err := os.ReadDir(filepath.Join(rootfs, "usr", "lib", "sysimage", "rpm"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("unexpected files in rpm database directory: %v", entries)
+	}
+}
+
+func TestQueryRPM(t *testing.T) {
+	// the fake rpm command creates a lock file in its dbpath, and lists
+	// the database copied there
+	bin := t.TempDir()
+	script := "#!/bin/sh\ntouch \"$2/.rpm.lock\"\ncat \"$2/" + rpmBerkeleyDB + "\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "rpm"), []byte(script), 0o755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	rootfs := t.TempDir()
+	dir := filepath.Join(rootfs, "var", "lib", "rpm")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	db := "bash\t5.1.8-6.el9_1\tx86_64\ngpg-pubkey\t350d275d-6267f4c4\t(none)\nfilesystem\t3.16-2.el9\t(none)\n"
+	if err := os.WriteFile(filepath.Join(dir, rpmBerkeleyDB), []byte(db), 0o644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pkgs, err := readRPM(rootfs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []Package{
+		{Type: TypeRPM, Name: "bash", Version: "5.1.8-6.el9_1", Arch: "x86_64"},
+		{Type: TypeRPM, Name: "filesystem", Version: "3.16-2.el9"},
+	}
+	if !reflect.DeepEqual(pkgs, want) {
+		t.Errorf("unexpected packages: got %+v, want %+v", pkgs, want)
+	}
+
+	// the database of the root filesystem isn't written to
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("unexpected files in rpm database directory: %v", entries)
+	}
+}
+
+func TestGenerateEmpty(t *testing.T) {
+	s, err := Generate(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.OS != (OS{}) || len(s.Packages) != 0 {
+		t.Errorf("unexpected sbom %+v", s)
+	}
+}
+
+func TestParseRPMHeaderTruncated(t *testing.T) {
+	blob := rpmHeader(map[uint32]string{rpmTagName: "bash"}, -1)
+	for _, b := range [][]byte{blob[:4], blob[:len(blob)-1]} {
+		if _, err := parseRPMHeader(b); err == nil {
+			t.Errorf("unexpected success parsing %d bytes", len(b))
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/util/fs"
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"golang.org/x/sys/unix"
+)
+
+// scratchPrefixes are the name prefixes of the scratch directories
+// created by a build in the temporary directory.
+var scratchPrefixes = []string{"build-temp-", "bundle-temp-"}
+
+// CleanupBuildScratch removes the build scratch directories found in tmpDir
+// which are older than maxAge, as left behind by failed or killed builds.
+// Only directories owned by the current user are considered, and
+// directories locked by a running build are never removed: a build locks
+// its scratch directories before creating them. It returns the list of
+// removed directories, or the directories which would be removed when
+// dryRun is set. The lock files left without their directory are removed
+// too.
+func CleanupBuildScratch(tmpDir string, maxAge time.Duration, dryRun bool) ([]string, error) {
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", tmpDir, err)
+	}
+
+	var removed []string
+	now := time.Now()
+	uid := os.Getuid()
+
+	for _, e := range entries {
+		if !isScratchName(e.Name()) {
+			continue
+		}
+		path := filepath.Join(tmpDir, e.Name())
+		orphanLock := false
+		if !e.IsDir() {
+			// the directory of a lock file is checked along with it
+			dir := strings.TrimSuffix(path, types.ScratchLockSuffix)
+			if dir == path || !e.Type().IsRegular() {
+				continue
+			}
+			if _, err := os.Lstat(dir); !errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			orphanLock = true
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			sylog.Debugf("Skipping %s: %v", path, err)
+			continue
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != uid {
+			continue
+		}
+		if now.Sub(fi.ModTime()) < maxAge {
+			continue
+		}
+
+		if orphanLock {
+			if !dryRun {
+				removeOrphanLock(path)
+			}
+			continue
+		}
+
+		lock, err := lockScratch(path)
+		if errors.Is(err, errScratchInUse) {
+			sylog.Debugf("Skipping %s: in use by a running build", path)
+			continue
+		} else if err != nil {
+			sylog.Warningf("Skipping %s: %v", path, err)
+			continue
+		}
+
+		if !dryRun {
+			err = fs.ForceRemoveAll(path)
+			if err != nil {
+				sylog.Warningf("Could not remove %s: %v", path, err)
+			}
+		}
+		if lock != nil {
+			if dryRun || err != nil {
+				lock.Close()
+			} else {
+				types.ReleaseScratchLock(lock)
+			}
+		}
+		if err != nil {
+			continue
+		}
+		removed = append(removed, path)
+	}
+
+	return removed, nil
+}
+
+func isScratchName(name string) bool {
+	for _, p := range scratchPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// errScratchInUse is returned for a scratch directory locked by a running
+// build.
+var errScratchInUse = errors.New("scratch directory in use")
+
+// lockScratch takes the lock of the scratch directory dir, held by a
+// running build, or returns errScratchInUse. It returns a nil lock for a
+// directory without a lock file.
+func lockScratch(dir string) (*os.File, error) {
+	path := dir + types.ScratchLockSuffix
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		f.Close()
+		return nil, errScratchInUse
+	} else if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// the lock file released by the build may have been replaced by the
+	// lock file of a new build using the same name
+	if !sameFile(f, path) {
+		f.Close()
+		return nil, errScratchInUse
+	}
+	return f, nil
+}
+
+// removeOrphanLock removes the lock file at path, left without its scratch
+// directory, unless it is held by a running build.
+func removeOrphanLock(path string) {
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB) != nil || !sameFile(f, path) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		sylog.Debugf("Could not remove %s: %v", path, err)
+	}
+}
+
+// sameFile reports whether the open file f is still the file at path.
+func sameFile(f *os.File, path string) bool {
+	ofi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	fi, err := os.Lstat(path)
+	return err == nil && os.SameFile(ofi, fi)
+}
@@ -0,0 +1,112 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+)
+
+func TestCleanupBuildScratch(t *testing.T) {
+	tmpDir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+
+	mkdir := func(name string) string {
+		path := filepath.Join(tmpDir, name)
+		assert.NilError(t, os.MkdirAll(filepath.Join(path, "rootfs"), 0o755))
+		assert.NilError(t, os.WriteFile(filepath.Join(path, "rootfs", "file"), []byte("data"), 0o644))
+		return path
+	}
+
+	// stale directories, with and without a released lock file
+	stale := mkdir("build-temp-111")
+	staleBundle := mkdir("bundle-temp-222")
+	assert.NilError(t, os.WriteFile(staleBundle+types.ScratchLockSuffix, []byte("1\n"), 0o600))
+
+	// old directory held by a running build
+	active := mkdir("build-temp-333")
+	lock, err := os.OpenFile(active+types.ScratchLockSuffix, os.O_CREATE|os.O_WRONLY, 0o600)
+	assert.NilError(t, err)
+	defer lock.Close()
+	assert.NilError(t, unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB))
+
+	// recent directory and unrelated directory
+	recent := mkdir("bundle-temp-444")
+	other := mkdir("other-temp-555")
+
+	// lock file left without its directory
+	orphan := filepath.Join(tmpDir, "bundle-temp-666"+types.ScratchLockSuffix)
+	assert.NilError(t, os.WriteFile(orphan, []byte("1\n"), 0o600))
+
+	for _, p := range []string{stale, staleBundle, active, other, orphan} {
+		assert.NilError(t, os.Chtimes(p, old, old))
+	}
+
+	removed, err := CleanupBuildScratch(tmpDir, 24*time.Hour, true)
+	assert.NilError(t, err)
+	sort.Strings(removed)
+	assert.DeepEqual(t, removed, []string{stale, staleBundle})
+	for _, p := range []string{stale, staleBundle, staleBundle + types.ScratchLockSuffix, active, recent, other, orphan} {
+		_, err := os.Stat(p)
+		assert.NilError(t, err, "dry run removed %s", p)
+	}
+
+	removed, err = CleanupBuildScratch(tmpDir, 24*time.Hour, false)
+	assert.NilError(t, err)
+	sort.Strings(removed)
+	assert.DeepEqual(t, removed, []string{stale, staleBundle})
+	for _, p := range []string{stale, staleBundle, staleBundle + types.ScratchLockSuffix, orphan} {
+		_, err := os.Stat(p)
+		assert.Assert(t, os.IsNotExist(err), "%s was not removed", p)
+	}
+	for _, p := range []string{active, active + types.ScratchLockSuffix, recent, other} {
+		_, err := os.Stat(p)
+		assert.NilError(t, err, "%s was removed", p)
+	}
+
+	// once the build is over, its directory is removed
+	assert.NilError(t, lock.Close())
+	removed, err = CleanupBuildScratch(tmpDir, 24*time.Hour, false)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, removed, []string{active})
+}
+
+func TestCleanupBuildScratchLive(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// a scratch directory is locked as soon as it exists, and is kept
+	// without any minimum age
+	dir, lock, err := types.MkdirScratch(tmpDir, "build-temp-")
+	assert.NilError(t, err)
+	assert.Equal(t, filepath.Dir(dir), tmpDir)
+	removed, err := CleanupBuildScratch(tmpDir, 0, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(removed), 0)
+	_, err = os.Stat(dir)
+	assert.NilError(t, err)
+
+	// the lock file of a released lock is removed, the directory is then
+	// orphaned
+	types.ReleaseScratchLock(lock)
+	_, err = os.Stat(dir + types.ScratchLockSuffix)
+	assert.Assert(t, os.IsNotExist(err))
+	removed, err = CleanupBuildScratch(tmpDir, 0, false)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, removed, []string{dir})
+
+	_, _, err = types.MkdirScratch(filepath.Join(tmpDir, "missing"), "build-temp-")
+	assert.ErrorContains(t, err, "no such file or directory")
+}
@@ -0,0 +1,83 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/apptainer/apptainer/pkg/util/namespaces"
+)
+
+// CpioConveyorPacker holds the cpio archive, optionally gzip compressed,
+// unpacked into the rootfs of the bundle, e.g. an initramfs image
+type CpioConveyorPacker struct {
+	b   *types.Bundle
+	src string
+}
+
+// Get checks the cpio archive given in the From header exists
+func (cp *CpioConveyorPacker) Get(ctx context.Context, b *types.Bundle) (err error) {
+	cp.b = b
+
+	cp.src = filepath.Clean(b.Recipe.Header["from"])
+	if b.Recipe.Header["from"] == "" {
+		return fmt.Errorf("no cpio archive given in the From header")
+	}
+	if _, err := os.Stat(cp.src); err != nil {
+		return fmt.Errorf("while checking cpio archive: %v", err)
+	}
+
+	return nil
+}
+
+// Pack unpacks the cpio archive into the rootfs of the bundle
+func (cp *CpioConveyorPacker) Pack(context.Context) (*types.Bundle, error) {
+	var warnings *warningRecorder
+	if cp.b.Opts.WarningsAsErrors {
+		warnings = &warningRecorder{}
+	}
+
+	f, err := os.Open(cp.src)
+	if err != nil {
+		return nil, fmt.Errorf("while opening cpio archive: %v", err)
+	}
+	defer f.Close()
+
+	sylog.Debugf("Extracting %s to %s", cp.src, cp.b.RootfsPath)
+	if err := extractCpio(f, cp.b.RootfsPath, namespaces.IsUnprivileged(), warnings); err != nil {
+		return nil, fmt.Errorf("while extracting %s: %v", cp.src, err)
+	}
+
+	if err := finalizeRootfs(cp.b, nil, warnings); err != nil {
+		return nil, err
+	}
+
+	if err := makeBaseEnv(cp.b.RootfsPath); err != nil {
+		return nil, fmt.Errorf("while inserting base environment: %v", err)
+	}
+	// an initramfs has no runscript, keep the one of an image built from it
+	runscript := filepath.Join(cp.b.RootfsPath, ".singularity.d", "runscript")
+	if _, err := os.Lstat(runscript); os.IsNotExist(err) {
+		if err := os.WriteFile(runscript, []byte("#!/bin/sh\n"), 0o755); err != nil {
+			return nil, fmt.Errorf("while inserting runscript: %v", err)
+		}
+	}
+
+	return cp.b, warnings.err()
+}
+
+// CleanUp removes any tmpfs owned by the conveyorPacker on the filesystem
+func (cp *CpioConveyorPacker) CleanUp() {
+	cp.b.Remove()
+}
@@ -0,0 +1,379 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+)
+
+// cpioEntry is an entry of the cpio archives written by writeCpio.
+type cpioEntry struct {
+	name  string
+	mode  uint32
+	body  string
+	ino   uint32
+	nlink uint32
+	rdev  [2]uint32
+}
+
+// cpioMtime is the modification time of the entries written by writeCpio.
+const cpioMtime = 1700000000
+
+// writeCpio returns the cpio archive of format holding entries, followed by
+// its trailer. In the newc format, the data of the files with several links
+// is only written with the last link, as done by GNU cpio.
+func writeCpio(t *testing.T, format cpioFormat, entries ...cpioEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	pad := func(align int) {
+		for buf.Len()%align != 0 {
+			buf.WriteByte(0)
+		}
+	}
+
+	entries = append(entries, cpioEntry{name: cpioTrailer, nlink: 1})
+	for i, e := range entries {
+		body := e.body
+		if format == cpioNewc && e.nlink > 1 {
+			for _, next := range entries[i+1:] {
+				if next.ino == e.ino {
+					body = ""
+				}
+			}
+		}
+		if e.nlink == 0 {
+			e.nlink = 1
+		}
+		ino := e.ino
+		if ino == 0 {
+			ino = uint32(i + 1000)
+		}
+		namesize := len(e.name) + 1
+
+		switch format {
+		case cpioNewc:
+			fmt.Fprintf(&buf, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+				ino, e.mode, 0, 0, e.nlink, cpioMtime, len(body), 0, 0, e.rdev[0], e.rdev[1], namesize, 0)
+			buf.WriteString(e.name + "\x00")
+			pad(4)
+			buf.WriteString(body)
+			pad(4)
+		case cpioODC:
+			fmt.Fprintf(&buf, "070707%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o",
+				0, ino, e.mode, 0, 0, e.nlink, e.rdev[0]<<8|e.rdev[1], cpioMtime, namesize, len(body))
+			buf.WriteString(e.name + "\x00")
+			buf.WriteString(body)
+		case cpioBinaryLE, cpioBinaryBE:
+			var order binary.ByteOrder = binary.LittleEndian
+			if format == cpioBinaryBE {
+				order = binary.BigEndian
+			}
+			h := [13]uint16{
+				0o70707, 0, uint16(ino), uint16(e.mode), 0, 0, uint16(e.nlink),
+				uint16(e.rdev[0]<<8 | e.rdev[1]), cpioMtime >> 16, cpioMtime & 0xffff,
+				uint16(namesize), uint16(len(body) >> 16), uint16(len(body) & 0xffff),
+			}
+			binary.Write(&buf, order, h)
+			buf.WriteString(e.name + "\x00")
+			pad(2)
+			buf.WriteString(body)
+			pad(2)
+		}
+	}
+	// archives are padded to a block size
+	pad(512)
+	return buf.Bytes()
+}
+
+// cpioTestEntries are the entries of the test archives.
+var cpioTestEntries = []cpioEntry{
+	{name: ".", mode: cpioTypeDir | 0o755},
+	{name: "etc", mode: cpioTypeDir | 0o755},
+	{name: "etc/hostname", mode: cpioTypeReg | 0o644, body: "initramfs\n"},
+	{name: "usr/bin", mode: cpioTypeDir | 0o755},
+	{name: "usr/bin/init", mode: cpioTypeReg | 0o755, body: "#!/bin/sh\n"},
+	{name: "bin", mode: cpioTypeSymlink | 0o777, body: "usr/bin"},
+	{name: "bin/sh", mode: cpioTypeReg | 0o755, body: "shell", ino: 1, nlink: 2},
+	{name: "bin/ash", mode: cpioTypeReg | 0o755, body: "shell", ino: 1, nlink: 2},
+	{name: "locked", mode: cpioTypeDir | 0o500},
+	{name: "locked/file", mode: cpioTypeReg | 0o400, body: "secret"},
+	{name: "run/fifo", mode: cpioTypeFifo | 0o600},
+	{name: "dev/console", mode: cpioTypeChar | 0o600, rdev: [2]uint32{5, 1}},
+	{name: "../../escape", mode: cpioTypeReg | 0o644, body: "escape"},
+}
+
+// assertCpioRootfs checks rootfs holds the content of cpioTestEntries.
+func assertCpioRootfs(t *testing.T, rootfs string) {
+	t.Helper()
+
+	files := map[string]string{
+		"etc/hostname": "initramfs\n",
+		"usr/bin/init": "#!/bin/sh\n",
+		"usr/bin/sh":   "shell",
+		"usr/bin/ash":  "shell",
+		"locked/file":  "secret",
+		"escape":       "escape",
+	}
+	for name, want := range files {
+		data, err := os.ReadFile(filepath.Join(rootfs, name))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		} else if string(data) != want {
+			t.Errorf("%s: unexpected content %q, want %q", name, data, want)
+		}
+	}
+
+	if target, err := os.Readlink(filepath.Join(rootfs, "bin")); err != nil || target != "usr/bin" {
+		t.Errorf("bin: unexpected symlink target %q (err=%v)", target, err)
+	}
+
+	sh, err := os.Stat(filepath.Join(rootfs, "usr/bin/sh"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ash, err := os.Stat(filepath.Join(rootfs, "usr/bin/ash"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !os.SameFile(sh, ash) {
+		t.Errorf("usr/bin/sh and usr/bin/ash are not hard links")
+	}
+
+	modes := map[string]os.FileMode{
+		"usr/bin/init": 0o755,
+		"locked":       os.ModeDir | 0o500,
+		"locked/file":  0o400,
+		"run/fifo":     os.ModeNamedPipe | 0o600,
+	}
+	for name, want := range modes {
+		fi, err := os.Lstat(filepath.Join(rootfs, name))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		if fi.Mode() != want {
+			t.Errorf("%s: unexpected mode %s, want %s", name, fi.Mode(), want)
+		}
+		if fi.ModTime().Unix() != cpioMtime {
+			t.Errorf("%s: unexpected modification time %s", name, fi.ModTime())
+		}
+	}
+}
+
+func TestExtractCpio(t *testing.T) {
+	test.DropPrivilege(t)
+	defer test.ResetPrivilege(t)
+
+	newc := writeCpio(t, cpioNewc, cpioTestEntries...)
+	// the early microcode archive prepended to initramfs images
+	early := writeCpio(t, cpioNewc, cpioEntry{name: "kernel", mode: cpioTypeDir | 0o755})
+
+	tests := []struct {
+		name    string
+		archive []byte
+	}{
+		{name: "newc", archive: newc},
+		{name: "odc", archive: writeCpio(t, cpioODC, cpioTestEntries...)},
+		{name: "binary little endian", archive: writeCpio(t, cpioBinaryLE, cpioTestEntries...)},
+		{name: "binary big endian", archive: writeCpio(t, cpioBinaryBE, cpioTestEntries...)},
+		{name: "gzip", archive: gzipBytes(t, newc)},
+		{name: "concatenated", archive: append(append([]byte{}, early...), gzipBytes(t, newc)...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := t.TempDir()
+			t.Cleanup(func() { os.Chmod(filepath.Join(rootfs, "locked"), 0o755) })
+
+			if err := extractCpio(bytes.NewReader(tt.archive), rootfs, true, nil); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			assertCpioRootfs(t, rootfs)
+			assertPaths(t, rootfs, map[string]bool{
+				// device nodes are skipped in rootless mode
+				"dev/console": false,
+				"kernel":      tt.name == "concatenated",
+			})
+		})
+	}
+}
+
+func TestExtractCpioErrors(t *testing.T) {
+	test.DropPrivilege(t)
+	defer test.ResetPrivilege(t)
+
+	newc := writeCpio(t, cpioNewc, cpioTestEntries...)
+	device := writeCpio(t, cpioNewc, cpioEntry{name: "dev/null", mode: cpioTypeChar | 0o666, rdev: [2]uint32{1, 3}})
+
+	tests := []struct {
+		name     string
+		archive  []byte
+		warnings *warningRecorder
+		wantErr  string
+	}{
+		{name: "not cpio", archive: []byte("not a cpio archive"), wantErr: "unsupported archive format"},
+		{name: "truncated", archive: newc[:200], wantErr: "unexpected EOF"},
+		{name: "device node strict", archive: device, warnings: &warningRecorder{}, wantErr: "device node"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := t.TempDir()
+			t.Cleanup(func() { os.Chmod(filepath.Join(rootfs, "locked"), 0o755) })
+
+			err := extractCpio(bytes.NewReader(tt.archive), rootfs, true, tt.warnings)
+			if err == nil {
+				err = tt.warnings.err()
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExtractCpioReplacedParent(t *testing.T) {
+	test.DropPrivilege(t)
+	defer test.ResetPrivilege(t)
+
+	// host stands for the host root filesystem, which the metadata of the
+	// directories replaced by a later symlink must not be restored to
+	host := t.TempDir()
+	if err := os.Mkdir(filepath.Join(host, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Lstat(filepath.Join(host, "etc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootfs := t.TempDir()
+	archive := writeCpio(t, cpioNewc,
+		cpioEntry{name: "a", mode: cpioTypeDir | 0o755},
+		cpioEntry{name: "a/etc", mode: cpioTypeDir | 0o700},
+		cpioEntry{name: "a", mode: cpioTypeSymlink | 0o777, body: host},
+	)
+	if err := extractCpio(bytes.NewReader(archive), rootfs, true, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	after, err := os.Lstat(filepath.Join(host, "etc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Mode() != before.Mode() {
+		t.Errorf("unexpected mode %s of the host directory, want %s", after.Mode(), before.Mode())
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("unexpected modification time %s of the host directory, want %s", after.ModTime(), before.ModTime())
+	}
+	if link, err := os.Readlink(filepath.Join(rootfs, "a")); err != nil || link != host {
+		t.Errorf("unexpected symlink a: %q, %v", link, err)
+	}
+}
+
+func TestExtractCpioPrivileged(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	rootfs := t.TempDir()
+	archive := writeCpio(t, cpioNewc,
+		cpioEntry{name: "dev/console", mode: cpioTypeChar | 0o600, rdev: [2]uint32{5, 1}},
+		cpioEntry{name: "dev/loop0", mode: cpioTypeBlock | 0o660, rdev: [2]uint32{7, 0}},
+	)
+	if err := extractCpio(bytes.NewReader(archive), rootfs, false, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	devices := map[string]struct {
+		mode os.FileMode
+		rdev uint64
+	}{
+		"dev/console": {mode: os.ModeDevice | os.ModeCharDevice | 0o600, rdev: 5<<8 | 1},
+		"dev/loop0":   {mode: os.ModeDevice | 0o660, rdev: 7 << 8},
+	}
+	for name, want := range devices {
+		fi, err := os.Lstat(filepath.Join(rootfs, name))
+		if err != nil {
+			// not permitted in a user namespace, already skipped with a
+			// warning
+			t.Logf("%s: %s", name, err)
+			continue
+		}
+		if fi.Mode() != want.mode {
+			t.Errorf("%s: unexpected mode %s, want %s", name, fi.Mode(), want.mode)
+		}
+		if rdev := fi.Sys().(*syscall.Stat_t).Rdev; rdev != want.rdev {
+			t.Errorf("%s: unexpected device %x, want %x", name, rdev, want.rdev)
+		}
+	}
+}
+
+func TestCpioConveyorPacker(t *testing.T) {
+	test.DropPrivilege(t)
+	defer test.ResetPrivilege(t)
+
+	archive := filepath.Join(t.TempDir(), "initramfs.img")
+	if err := os.WriteFile(archive, gzipBytes(t, writeCpio(t, cpioNewc, cpioTestEntries...)), 0o644); err != nil {
+		t.Fatalf("while writing archive: %s", err)
+	}
+
+	b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("while creating bundle: %s", err)
+	}
+	t.Cleanup(func() { os.Chmod(filepath.Join(b.RootfsPath, "locked"), 0o755) })
+	b.Recipe, err = sytypes.NewDefinitionFromURI("cpio:" + archive)
+	if err != nil {
+		t.Fatalf("while creating definition: %s", err)
+	}
+
+	cp := &CpioConveyorPacker{}
+	if err := cp.Get(context.Background(), b); err != nil {
+		t.Fatalf("failed to Get from %s: %s", archive, err)
+	}
+	defer cp.CleanUp()
+
+	if _, err := cp.Pack(context.Background()); err != nil {
+		t.Fatalf("failed to Pack from %s: %s", archive, err)
+	}
+	assertCpioRootfs(t, b.RootfsPath)
+	assertPaths(t, b.RootfsPath, map[string]bool{
+		".singularity.d/runscript": true,
+		".singularity.d/env":       true,
+	})
+}
+
+func TestCpioConveyorPackerMissing(t *testing.T) {
+	b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("while creating bundle: %s", err)
+	}
+	t.Cleanup(func() { b.Remove() })
+	b.Recipe, err = sytypes.NewDefinitionFromURI("cpio:" + filepath.Join(t.TempDir(), "missing.img"))
+	if err != nil {
+		t.Fatalf("while creating definition: %s", err)
+	}
+
+	cp := &CpioConveyorPacker{}
+	if err := cp.Get(context.Background(), b); err == nil {
+		t.Fatalf("unexpected success with a missing archive")
+	}
+}
@@ -70,6 +70,10 @@ func (cp *LibraryConveyorPacker) Get(ctx context.Context, b *types.Bundle) (err
 	sylog.Debugf("LibraryURL: %v", libraryURL)
 	sylog.Debugf("LibraryRef: %v", imageRef.String())
 
+	if err := library.CheckAllowedRegistry(libraryURL, imageRef, types.AllowedRegistries(b.Opts.AllowedRegistries)); err != nil {
+		return err
+	}
+
 	libraryConfig := &client.Config{
 		BaseURL:   libraryURL,
 		AuthToken: authToken,
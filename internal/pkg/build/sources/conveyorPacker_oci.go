@@ -17,16 +17,19 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"strings"
 	"text/template"
 
 	"github.com/apptainer/apptainer/internal/pkg/build/oci"
+	"github.com/apptainer/apptainer/internal/pkg/cache"
 	"github.com/apptainer/apptainer/internal/pkg/util/shell"
 	sytypes "github.com/apptainer/apptainer/pkg/build/types"
 	"github.com/apptainer/apptainer/pkg/image"
@@ -34,16 +37,25 @@ import (
 	"github.com/apptainer/apptainer/pkg/sylog"
 	useragent "github.com/apptainer/apptainer/pkg/util/user-agent"
 	"github.com/containers/image/v5/copy"
-	"github.com/containers/image/v5/docker"
 	dockerarchive "github.com/containers/image/v5/docker/archive"
 	dockerdaemon "github.com/containers/image/v5/docker/daemon"
+	"github.com/containers/image/v5/manifest"
 	ociarchive "github.com/containers/image/v5/oci/archive"
 	ocilayout "github.com/containers/image/v5/oci/layout"
 	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// subjectLabel is the label recording the digest of the subject of the image
+// manifest, the manifest an OCI 1.1 image refers to.
+const subjectLabel = "org.apptainer.oci.subject"
+
+// degradedLabel is the label recording the layers which failed to extract
+// with the KeepGoing option, marking the build as degraded.
+const degradedLabel = "org.apptainer.build.degraded"
+
 type ociRunscriptData struct {
 	PrependCmd        string
 	PrependEntrypoint string
@@ -136,11 +148,137 @@ type OCIConveyorPacker struct {
 	policyCtx *signature.PolicyContext
 	imgConfig imgspecv1.ImageConfig
 	sysCtx    *types.SystemContext
+	pinnedRef *dockerPinnedRef
+	limiter   *rateLimiter
+	// subject is the subject of the image manifest, recorded in the labels
+	subject *imgspecv1.Descriptor
+	// failedLayers are the layers which failed to extract, recorded in the
+	// labels
+	failedLayers []digest.Digest
+	// source is the reference of the source, reported in its errors
+	source string
+	// tag is the tag of the image in the layout of the temporary
+	// directory, tmp when empty
+	tag string
+	// merged are the images of the merged sources, in the same layout
+	merged []types.ImageReference
+	// sourceDigest is the manifest digest of the source image, recorded
+	// with the BuildProvenance option
+	sourceDigest digest.Digest
+	// healthcheck is the healthcheck of the image config, written as the
+	// test script with the Healthcheck option
+	healthcheck *manifest.Schema2HealthConfig
+}
+
+// sourceError returns err as a failure of the source of type typ, unless it
+// wraps a SourceError already, which is completed with the source.
+func (cp *OCIConveyorPacker) sourceError(typ string, err error) error {
+	var se *sytypes.SourceError
+	if errors.As(err, &se) {
+		if se.Source == "" {
+			se.Source = cp.source
+		}
+		return err
+	}
+	return &sytypes.SourceError{Type: typ, Source: cp.source, Err: err}
+}
+
+// sourceSystemContext returns the system context of the oci/docker sources
+// built with opts, storing its big files in tmpDir.
+func sourceSystemContext(opts sytypes.Options, tmpDir string) *types.SystemContext {
+	sysCtx := &types.SystemContext{
+		OCIInsecureSkipTLSVerify: opts.NoHTTPS,
+		DockerAuthConfig:         opts.DockerAuthConfig,
+		DockerDaemonHost:         opts.DockerDaemonHost,
+		OSChoice:                 "linux",
+		AuthFilePath:             syfs.DockerConf(),
+		DockerRegistryUserAgent:  useragent.Value(),
+		BigFilesTemporaryDir:     tmpDir,
+	}
+	if opts.NoHTTPS {
+		sysCtx.DockerInsecureSkipTLSVerify = types.NewOptionalBool(true)
+	}
+	return sysCtx
+}
+
+// setPlatformChoice sets the platform of the images selected from the image
+// indexes of oci/docker sources in sysCtx, from the arch, platform and
+// variant of opts.
+func setPlatformChoice(sysCtx *types.SystemContext, opts sytypes.Options) error {
+	if opts.Arch != "" {
+		if arch, ok := oci.ArchMap[opts.Arch]; ok {
+			sysCtx.ArchitectureChoice = arch.Arch
+			sysCtx.VariantChoice = arch.Var
+		} else {
+			keys := reflect.ValueOf(oci.ArchMap).MapKeys()
+			return fmt.Errorf("failed to parse the arch value: %s, should be one of %v", opts.Arch, keys)
+		}
+	}
+	if opts.Platform != "" {
+		p, err := parsePlatform(opts.Platform)
+		if err != nil {
+			return err
+		}
+		sysCtx.OSChoice = p.OS
+		sysCtx.ArchitectureChoice = p.Architecture
+		sysCtx.VariantChoice = p.Variant
+	}
+	if opts.ArchVariant != "" {
+		if sysCtx.ArchitectureChoice == "" {
+			sysCtx.ArchitectureChoice = runtime.GOARCH
+		}
+		sysCtx.VariantChoice = opts.ArchVariant
+		if !strings.HasPrefix(sysCtx.VariantChoice, "v") {
+			sysCtx.VariantChoice = "v" + sysCtx.VariantChoice
+		}
+	}
+	return nil
+}
+
+// definitionReference returns the reference of the source of def, with the
+// registry and namespace of its header, and for docker sources the default
+// registry or else the pull-through cache of opts. A docker source whose
+// registry isn't allowed by opts, or else by the configuration, is rejected.
+func definitionReference(def sytypes.Definition, opts sytypes.Options) (ref string, err error) {
+	// add registry and namespace to reference if specified
+	ref = def.Header["from"]
+	if def.Header["namespace"] != "" {
+		ref = def.Header["namespace"] + "/" + ref
+	}
+	if def.Header["registry"] != "" {
+		ref = def.Header["registry"] + "/" + ref
+	}
+	if def.Header["bootstrap"] != "docker" {
+		return ref, nil
+	}
+	if opts.DefaultRegistry != "" {
+		if ref, err = DefaultRegistryReference(ref, opts.DefaultRegistry); err != nil {
+			return "", err
+		}
+	}
+	if opts.PullThroughCache != "" {
+		if ref, err = pullThroughCacheReference(ref, opts.PullThroughCache); err != nil {
+			return "", err
+		}
+	}
+	if err := checkAllowedRegistry(ref, sytypes.AllowedRegistries(opts.AllowedRegistries)); err != nil {
+		return "", err
+	}
+	return ref, nil
 }
 
 // Get downloads container information from the specified source
 func (cp *OCIConveyorPacker) Get(ctx context.Context, b *sytypes.Bundle) (err error) {
 	cp.b = b
+	defer func() {
+		if err != nil {
+			err = cp.sourceError(sytypes.SourceErrorOther, err)
+		}
+	}()
+
+	if err := checkBuildMounts(b); err != nil {
+		return err
+	}
 
 	policy := &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}}
 	cp.policyCtx, err = signature.NewPolicyContext(policy)
@@ -154,43 +292,35 @@ func (cp *OCIConveyorPacker) Get(ctx context.Context, b *sytypes.Bundle) (err er
 	// of forcing it to false in order to delegate decision to /etc/containers/registries.conf:
 	// https://github.com/apptainer/singularity/issues/5172
 
-	cp.sysCtx = &types.SystemContext{
-		OCIInsecureSkipTLSVerify: cp.b.Opts.NoHTTPS,
-		DockerAuthConfig:         cp.b.Opts.DockerAuthConfig,
-		DockerDaemonHost:         cp.b.Opts.DockerDaemonHost,
-		OSChoice:                 "linux",
-		AuthFilePath:             syfs.DockerConf(),
-		DockerRegistryUserAgent:  useragent.Value(),
-		BigFilesTemporaryDir:     b.TmpDir,
+	cp.sysCtx = sourceSystemContext(cp.b.Opts, b.TmpDir)
+	if err := setPlatformChoice(cp.sysCtx, cp.b.Opts); err != nil {
+		return err
 	}
-	if cp.b.Opts.Arch != "" {
-		if arch, ok := oci.ArchMap[cp.b.Opts.Arch]; ok {
-			cp.sysCtx.ArchitectureChoice = arch.Arch
-			cp.sysCtx.VariantChoice = arch.Var
-		} else {
-			keys := reflect.ValueOf(oci.ArchMap).MapKeys()
-			return fmt.Errorf("failed to parse the arch value: %s, should be one of %v", cp.b.Opts.Arch, keys)
+
+	if cp.b.Opts.DockerClientCert != "" || cp.b.Opts.DockerClientKey != "" {
+		cp.sysCtx.DockerCertPath, err = clientCertDir(b.TmpDir, cp.b.Opts.DockerClientCert, cp.b.Opts.DockerClientKey)
+		if err != nil {
+			return err
 		}
 	}
 
-	if cp.b.Opts.NoHTTPS {
-		cp.sysCtx.DockerInsecureSkipTLSVerify = types.NewOptionalBool(true)
+	if cp.b.Opts.DownloadRateLimit > 0 {
+		cp.limiter = newRateLimiter(cp.b.Opts.DownloadRateLimit)
 	}
 
-	// add registry and namespace to reference if specified
-	ref := b.Recipe.Header["from"]
-	if b.Recipe.Header["namespace"] != "" {
-		ref = b.Recipe.Header["namespace"] + "/" + ref
-	}
-	if b.Recipe.Header["registry"] != "" {
-		ref = b.Recipe.Header["registry"] + "/" + ref
+	ref, err := definitionReference(b.Recipe, b.Opts)
+	if err != nil {
+		return cp.sourceError(sytypes.SourceErrorReference, err)
 	}
 	sylog.Debugf("Reference: %v", ref)
+	cp.source = b.Recipe.Header["bootstrap"] + ":" + ref
+	if b.Recipe.Header["bootstrap"] == "docker" {
+		cp.source = "docker://" + ref
+	}
 
 	switch b.Recipe.Header["bootstrap"] {
 	case "docker":
-		ref = "//" + ref
-		cp.srcRef, err = docker.ParseReference(ref)
+		cp.srcRef, cp.pinnedRef, err = parseDockerReference(ref)
 	case "docker-archive":
 		cp.srcRef, err = dockerarchive.ParseReference(ref)
 	case "docker-daemon":
@@ -226,12 +356,166 @@ func (cp *OCIConveyorPacker) Get(ctx context.Context, b *sytypes.Bundle) (err er
 			}
 		}
 
+	case "oci-http":
+		tmpDir, err := os.MkdirTemp(b.TmpDir, "temp-oci-")
+		if err != nil {
+			return fmt.Errorf("could not create temporary oci directory: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		cp.srcRef, err = fetchHTTPLayout(ctx, ref, tmpDir, cp.sysCtx, cp.b.Opts.NoHTTPS, cp.limiter)
+		if err != nil {
+			return fmt.Errorf("while fetching OCI layout: %v", err)
+		}
+
+	case "containerd":
+		tmpDir, err := os.MkdirTemp(b.TmpDir, "temp-oci-")
+		if err != nil {
+			return fmt.Errorf("could not create temporary oci directory: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		cp.srcRef, err = fetchContainerdImage(ctx, ref, tmpDir, cp.b.Opts.Containerd.Address, cp.b.Opts.Containerd.Namespace, cp.sysCtx)
+		if err != nil {
+			return cp.sourceError(sytypes.SourceErrorFetch, fmt.Errorf("while fetching containerd image: %w", err))
+		}
+
 	default:
 		return fmt.Errorf("oci conveyorPacker does not support %s", b.Recipe.Header["bootstrap"])
 	}
 
 	if err != nil {
-		return fmt.Errorf("invalid image source: %v", err)
+		return cp.sourceError(sytypes.SourceErrorReference, fmt.Errorf("invalid image source: %v", err))
+	}
+
+	if cp.pinnedRef != nil {
+		if err := cp.pinnedRef.verify(ctx, cp.sysCtx); err != nil {
+			return fmt.Errorf("while verifying pinned reference: %w", err)
+		}
+	}
+
+	if cp.b.Opts.LockFile != "" && b.Recipe.Header["bootstrap"] == "docker" && cp.pinnedRef == nil {
+		if cp.b.Opts.ContentTrust {
+			return fmt.Errorf("lock files are not supported with content trust verification")
+		}
+		lockedRef, pinned, err := lockDockerReference(ctx, ref, cp.b.Opts.LockFile, cp.b.Opts.UpdateLock, cp.sysCtx)
+		if err != nil {
+			return fmt.Errorf("while locking reference: %w", err)
+		}
+		if lockedRef != nil {
+			cp.srcRef, cp.pinnedRef = lockedRef, pinned
+		}
+	}
+
+	// the sources pinned to a digest, or locked, don't float
+	var latest bool
+	if b.Recipe.Header["bootstrap"] == "docker" && cp.pinnedRef == nil {
+		if latest, err = checkLatestTag(ref, cp.b.Opts.LatestTag); err != nil {
+			return cp.sourceError(sytypes.SourceErrorReference, err)
+		}
+	}
+
+	if cp.b.Opts.ContentTrust {
+		if b.Recipe.Header["bootstrap"] != "docker" {
+			return fmt.Errorf("content trust verification is not supported for %s sources", b.Recipe.Header["bootstrap"])
+		}
+		cp.srcRef, err = trustedDockerReference(ctx, ref, cp.b.Opts, cp.sysCtx)
+		if err != nil {
+			return fmt.Errorf("while verifying content trust: %w", err)
+		}
+	}
+
+	if b.Recipe.Header["bootstrap"] == "docker" {
+		// reuse the registry tokens across all of the fetches below
+		shared := newSharedSourceReference(cp.srcRef)
+		defer shared.Close()
+		cp.srcRef = shared
+
+		if cp.limiter != nil {
+			cp.srcRef = newRateLimitedReference(cp.srcRef, cp.limiter)
+		}
+
+		// the blobs of the shared blob cache aren't fetched again, nor
+		// limited
+		if cp.b.Opts.SharedBlobCache != "" {
+			store, err := cache.OpenSharedBlobStore(cp.b.Opts.SharedBlobCache)
+			if err != nil {
+				return err
+			}
+			cp.srcRef = newSharedBlobReference(cp.srcRef, store)
+		}
+	}
+
+	// the manifest is read by most of the steps below, fetch it once
+	manifestCache := cp.b.Opts.ManifestCache
+	if manifestCache == nil {
+		manifestCache = sytypes.NewMemoryManifestCache()
+	}
+	cp.srcRef = newManifestCacheReference(cp.srcRef, manifestCache)
+
+	// select the image matching the platform from an image index
+	cp.srcRef = newPlatformReference(cp.srcRef, wantedPlatform(cp.sysCtx))
+
+	if cp.b.Opts.BuildProvenance {
+		if cp.sourceDigest, err = cp.getSourceDigest(ctx); err != nil {
+			return cp.sourceError(sytypes.SourceErrorFetch, fmt.Errorf("while getting source digest: %w", err))
+		}
+	}
+
+	if latest {
+		d := cp.sourceDigest
+		if d == "" {
+			if d, err = cp.getSourceDigest(ctx); err != nil {
+				return cp.sourceError(sytypes.SourceErrorFetch, fmt.Errorf("while getting source digest: %w", err))
+			}
+		}
+		sylog.Infof("The latest tag of %s resolved to %s", strings.TrimPrefix(ref, "//"), d)
+	}
+
+	// the image config is checked before any layer is fetched
+	img, configData, err := cp.getConfig(ctx)
+	if err != nil {
+		return cp.sourceError(sytypes.SourceErrorManifest, fmt.Errorf("while getting config: %w", err))
+	}
+	if err := checkImagePlatform(img.Platform, cp.sysCtx); err != nil {
+		if !cp.b.Opts.IgnorePlatform {
+			return fmt.Errorf("%w (use --ignore-platform to build anyway)", err)
+		}
+		sylog.Warningf("Ignoring unsupported image platform: %v", err)
+	}
+	if err := checkImageUser(img.Config.User, sytypes.RootUserPolicy(cp.b.Opts.RootUser)); err != nil {
+		return cp.sourceError(sytypes.SourceErrorManifest, err)
+	}
+	cp.imgConfig = img.Config
+	if cp.b.Opts.Healthcheck {
+		if cp.healthcheck, err = parseHealthcheck(configData); err != nil {
+			return cp.sourceError(sytypes.SourceErrorManifest, fmt.Errorf("while getting healthcheck: %w", err))
+		}
+	}
+	if cp.b.Opts.NormalizeEnv {
+		var problems []string
+		cp.imgConfig.Env, problems = normalizeEnv(cp.imgConfig.Env)
+		for _, p := range problems {
+			sylog.Warningf("Image config env: %s", p)
+		}
+	}
+
+	if !cp.b.Opts.NoCache && cp.b.Opts.ImgCache != nil {
+		// the blobs of the cache aren't pruned while copied
+		unlock, err := cp.b.Opts.ImgCache.Lock(cache.OciBlobCacheType, "")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	if cp.b.Opts.ChunkSize > 0 && b.Recipe.Header["bootstrap"] == "docker" {
+		// the layers not fetched in chunks are fetched by the copy below
+		if err := cp.fetchChunked(ctx); ctx.Err() != nil {
+			return cp.sourceError(sytypes.SourceErrorFetch, fmt.Errorf("while fetching layers in chunks: %w", ctx.Err()))
+		} else if err != nil {
+			sylog.Warningf("Fetching the layers in one request: %s", err)
+		}
 	}
 
 	if !cp.b.Opts.NoCache {
@@ -244,19 +528,24 @@ func (cp *OCIConveyorPacker) Get(ctx context.Context, b *sytypes.Bundle) (err er
 
 	// To to do the RootFS extraction we also have to have a location that
 	// contains *only* this image
-	cp.tmpfsRef, err = ocilayout.ParseReference(cp.b.TmpDir + ":" + "tmp")
+	tag := cp.tag
+	if tag == "" {
+		tag = "tmp"
+	}
+	cp.tmpfsRef, err = ocilayout.ParseReference(cp.b.TmpDir + ":" + tag)
 	if err != nil {
 		return fmt.Errorf("while parsing reference: %w", err)
 	}
 
 	err = cp.fetch(ctx)
 	if err != nil {
-		return fmt.Errorf("while fetching image: %w", err)
+		return cp.sourceError(sytypes.SourceErrorFetch, fmt.Errorf("while fetching image: %w", err))
 	}
 
-	cp.imgConfig, err = cp.getConfig(ctx)
-	if err != nil {
-		return fmt.Errorf("while getting config: %w", err)
+	if len(cp.b.Opts.MergeSources) > 0 {
+		if cp.merged, err = cp.fetchMergeSources(ctx); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -266,7 +555,7 @@ func (cp *OCIConveyorPacker) Get(ctx context.Context, b *sytypes.Bundle) (err er
 func (cp *OCIConveyorPacker) Pack(ctx context.Context) (*sytypes.Bundle, error) {
 	err := cp.unpackTmpfs(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("while unpacking tmpfs: %v", err)
+		return nil, cp.sourceError(sytypes.SourceErrorRootfs, fmt.Errorf("while unpacking tmpfs: %w", err))
 	}
 
 	err = cp.insertBaseEnv()
@@ -284,6 +573,11 @@ func (cp *OCIConveyorPacker) Pack(ctx context.Context) (*sytypes.Bundle, error)
 		return nil, fmt.Errorf("while inserting docker specific environment: %v", err)
 	}
 
+	err = cp.insertHealthcheck()
+	if err != nil {
+		return nil, fmt.Errorf("while inserting healthcheck: %v", err)
+	}
+
 	err = cp.insertOCIConfig()
 	if err != nil {
 		return nil, fmt.Errorf("while inserting oci config: %v", err)
@@ -298,26 +592,94 @@ func (cp *OCIConveyorPacker) Pack(ctx context.Context) (*sytypes.Bundle, error)
 }
 
 func (cp *OCIConveyorPacker) fetch(ctx context.Context) error {
-	// cp.srcRef contains the cache source reference
-	_, err := copy.Image(ctx, cp.policyCtx, cp.tmpfsRef, cp.srcRef, &copy.Options{
+	opts := &copy.Options{
 		ReportWriter: io.Discard,
 		SourceCtx:    cp.sysCtx,
-	})
+	}
+	// cp.srcRef contains the cache source reference
+	_, err := copy.Image(ctx, cp.policyCtx, cp.tmpfsRef, cp.srcRef, opts)
+	if errors.Is(err, cache.ErrBlobDigestMismatch) {
+		// a poisoned entry of the shared blob cache is only found once
+		// read, the copy fetching it from the source again
+		sylog.Infof("Fetching the image again without the poisoned entries of the shared blob cache")
+		_, err = copy.Image(ctx, cp.policyCtx, cp.tmpfsRef, cp.srcRef, opts)
+	}
 	return err
 }
 
-func (cp *OCIConveyorPacker) getConfig(ctx context.Context) (imgspecv1.ImageConfig, error) {
+// fetchChunked fetches the large layers of a docker source with range
+// requests, into the layout the image is then copied to, so that an
+// interrupted download can resume. The partial downloads are kept in the
+// blob cache, even when not used, so that they resume in the next build.
+func (cp *OCIConveyorPacker) fetchChunked(ctx context.Context) error {
+	dir, partialDir := cp.b.TmpDir, cp.b.TmpDir
+	if cp.b.Opts.ImgCache != nil && !cp.b.Opts.ImgCache.IsDisabled() {
+		cacheDir, err := cp.b.Opts.ImgCache.GetOciCacheDir(cache.OciBlobCacheType)
+		if err != nil {
+			return err
+		}
+		partialDir = cacheDir
+		if !cp.b.Opts.NoCache {
+			dir = cacheDir
+		}
+	}
+
+	img, err := cp.srcRef.NewImage(ctx, cp.sysCtx)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	f, err := newChunkedFetcher(ctx, cp.srcRef, cp.sysCtx, cp.b.Opts.ChunkSize)
+	if err != nil {
+		return err
+	}
+	defer f.close()
+	f.limiter = cp.limiter
+	return f.fetchLayers(ctx, dir, partialDir, img.LayerInfos())
+}
+
+// getSourceDigest returns the digest of the manifest of the source image,
+// the one of the platform built for an image index.
+func (cp *OCIConveyorPacker) getSourceDigest(ctx context.Context) (digest.Digest, error) {
+	src, err := cp.srcRef.NewImageSource(ctx, cp.sysCtx)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	data, _, err := fetchManifest(ctx, src, cp.b.Opts.ManifestTimeout)
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest(data)
+}
+
+// SourceDigest returns the manifest digest of the source image, recorded by
+// Get with the BuildProvenance option, empty otherwise.
+func (cp *OCIConveyorPacker) SourceDigest() digest.Digest {
+	return cp.sourceDigest
+}
+
+// getConfig returns the config of the source image, converted to an OCI
+// image config, along with the config blob as stored in the source.
+func (cp *OCIConveyorPacker) getConfig(ctx context.Context) (*imgspecv1.Image, []byte, error) {
 	img, err := cp.srcRef.NewImage(ctx, cp.sysCtx)
 	if err != nil {
-		return imgspecv1.ImageConfig{}, err
+		return nil, nil, cp.sourceError(sytypes.SourceErrorFetch, err)
 	}
 	defer img.Close()
 
-	imgSpec, err := img.OCIConfig(ctx)
+	configData, err := img.ConfigBlob(ctx)
 	if err != nil {
-		return imgspecv1.ImageConfig{}, err
+		return nil, nil, cp.sourceError(sytypes.SourceErrorFetch, fmt.Errorf("while reading image config: %w", err))
 	}
-	return imgSpec.Config, nil
+	// the config blob is read once per image, OCIConfig reuses it
+	config, err := img.OCIConfig(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, configData, nil
 }
 
 func (cp *OCIConveyorPacker) insertOCIConfig() error {
@@ -408,7 +770,12 @@ func (cp *OCIConveyorPacker) extractArchive(src string, dst string) error {
 }
 
 func (cp *OCIConveyorPacker) unpackTmpfs(ctx context.Context) error {
-	return unpackRootfs(ctx, cp.b, cp.tmpfsRef, cp.sysCtx)
+	res, err := unpackRootfs(ctx, cp.b, cp.tmpfsRef, cp.sysCtx, cp.merged...)
+	if res != nil {
+		cp.subject = res.subject
+		cp.failedLayers = res.failedLayers
+	}
+	return err
 }
 
 func (cp *OCIConveyorPacker) insertBaseEnv() (err error) {
@@ -543,7 +910,23 @@ func (cp *OCIConveyorPacker) insertEnv() (err error) {
 }
 
 func (cp *OCIConveyorPacker) insertOCILabels() (err error) {
-	labels := cp.imgConfig.Labels
+	labels := make(map[string]string, len(cp.imgConfig.Labels))
+	for k, v := range cp.imgConfig.Labels {
+		labels[k] = v
+	}
+	// record the tag and the digest the tag was verified against
+	if cp.pinnedRef != nil {
+		labels[imgspecv1.AnnotationBaseImageName] = cp.pinnedRef.tagged.String()
+		labels[imgspecv1.AnnotationBaseImageDigest] = cp.pinnedRef.canonical.Digest().String()
+	}
+	// record the manifest the image refers to, to look up its referrers
+	if cp.subject != nil {
+		labels[subjectLabel] = cp.subject.Digest.String()
+	}
+	// mark the build as degraded
+	if len(cp.failedLayers) > 0 {
+		labels[degradedLabel] = joinDigests(cp.failedLayers)
+	}
 	var text []byte
 
 	// make new map into json
@@ -33,6 +33,10 @@ func (cp *OrasConveyorPacker) Get(ctx context.Context, b *types.Bundle) (err err
 	// full uri for name determination and output
 	fullRef := "oras:" + ref
 
+	if err := oras.CheckAllowedRegistry(fullRef, types.AllowedRegistries(b.Opts.AllowedRegistries)); err != nil {
+		return err
+	}
+
 	imagePath, err := oras.Pull(ctx, b.Opts.ImgCache, fullRef, b.Opts.TmpDir, b.Opts.DockerAuthConfig, b.Opts.NoHTTPS)
 	if err != nil {
 		return fmt.Errorf("while fetching library image: %v", err)
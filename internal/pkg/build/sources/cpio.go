@@ -0,0 +1,551 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/apptainer/apptainer/pkg/sylog"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"golang.org/x/sys/unix"
+)
+
+// cpioTrailer is the name of the entry ending a cpio archive.
+const cpioTrailer = "TRAILER!!!"
+
+// cpio file types, the S_IF* values of the mode.
+const (
+	cpioTypeMask    = 0o170000
+	cpioTypeSocket  = 0o140000
+	cpioTypeSymlink = 0o120000
+	cpioTypeReg     = 0o100000
+	cpioTypeBlock   = 0o060000
+	cpioTypeDir     = 0o040000
+	cpioTypeChar    = 0o020000
+	cpioTypeFifo    = 0o010000
+)
+
+// cpioFormat is one of the cpio header formats.
+type cpioFormat int
+
+const (
+	// cpioNewc is the SVR4 format with hexadecimal fields, used by the
+	// initramfs images, with or without checksum.
+	cpioNewc cpioFormat = iota
+	// cpioODC is the POSIX.1 portable format with octal fields.
+	cpioODC
+	// cpioBinaryLE and cpioBinaryBE are the old binary format, in little and
+	// big endian.
+	cpioBinaryLE
+	cpioBinaryBE
+)
+
+// cpioHeader is the header of an entry of a cpio archive.
+type cpioHeader struct {
+	name  string
+	mode  uint32
+	uid   int
+	gid   int
+	nlink uint32
+	mtime int64
+	size  int64
+	// dev and ino identify the hard links to the same file
+	dev uint64
+	ino uint64
+	// rdevMajor and rdevMinor are the device numbers of device nodes
+	rdevMajor uint32
+	rdevMinor uint32
+}
+
+// cpioReader reads the entries of a cpio archive.
+type cpioReader struct {
+	r      *bufio.Reader
+	format cpioFormat
+	// remaining is the size of the data of the current entry left to read,
+	// followed by pad bytes of padding
+	remaining int64
+	pad       int64
+}
+
+// newCpioReader returns a reader of the cpio archive read from r, whose
+// format is detected from its first header.
+func newCpioReader(r *bufio.Reader) (*cpioReader, error) {
+	magic, err := r.Peek(6)
+	if err != nil && len(magic) < 2 {
+		return nil, fmt.Errorf("while reading cpio header: %w", err)
+	}
+
+	cr := &cpioReader{r: r}
+	switch {
+	case bytes.Equal(magic, []byte("070701")), bytes.Equal(magic, []byte("070702")):
+		cr.format = cpioNewc
+	case bytes.Equal(magic, []byte("070707")):
+		cr.format = cpioODC
+	case magic[0] == 0xc7 && magic[1] == 0x71:
+		cr.format = cpioBinaryLE
+	case magic[0] == 0x71 && magic[1] == 0xc7:
+		cr.format = cpioBinaryBE
+	default:
+		return nil, fmt.Errorf("unsupported archive format")
+	}
+	return cr, nil
+}
+
+// next returns the header of the next entry of the archive, skipping the
+// unread data of the current one, or io.EOF at the end of the archive.
+func (cr *cpioReader) next() (*cpioHeader, error) {
+	if _, err := cr.r.Discard(int(cr.remaining + cr.pad)); err != nil {
+		return nil, fmt.Errorf("while skipping cpio entry: %w", noEOF(err))
+	}
+	cr.remaining, cr.pad = 0, 0
+
+	var h *cpioHeader
+	var namesize int64
+	var err error
+	switch cr.format {
+	case cpioNewc:
+		h, namesize, err = cr.readNewc()
+	case cpioODC:
+		h, namesize, err = cr.readODC()
+	default:
+		h, namesize, err = cr.readBinary()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if namesize <= 0 || namesize > 4096+1 {
+		return nil, fmt.Errorf("invalid cpio entry name size %d", namesize)
+	}
+	if h.size < 0 {
+		return nil, fmt.Errorf("invalid cpio entry size %d", h.size)
+	}
+
+	name := make([]byte, namesize)
+	if _, err := io.ReadFull(cr.r, name); err != nil {
+		return nil, fmt.Errorf("while reading cpio entry name: %w", noEOF(err))
+	}
+	h.name = string(bytes.TrimRight(name, "\x00"))
+
+	// the name and data are aligned on 4 bytes in the newc format, with the
+	// header, and on 2 bytes in the binary one
+	switch cr.format {
+	case cpioNewc:
+		if _, err := cr.r.Discard(int(padding(110+namesize, 4))); err != nil {
+			return nil, fmt.Errorf("while reading cpio entry name: %w", noEOF(err))
+		}
+		cr.pad = padding(h.size, 4)
+	case cpioBinaryLE, cpioBinaryBE:
+		if _, err := cr.r.Discard(int(padding(namesize, 2))); err != nil {
+			return nil, fmt.Errorf("while reading cpio entry name: %w", noEOF(err))
+		}
+		cr.pad = padding(h.size, 2)
+	}
+	cr.remaining = h.size
+
+	if h.name == cpioTrailer {
+		// the data and padding of the trailer are part of the archive
+		if _, err := cr.r.Discard(int(cr.remaining + cr.pad)); err != nil {
+			return nil, fmt.Errorf("while reading cpio trailer: %w", noEOF(err))
+		}
+		cr.remaining, cr.pad = 0, 0
+		return nil, io.EOF
+	}
+	return h, nil
+}
+
+// Read reads the data of the current entry.
+func (cr *cpioReader) Read(p []byte) (int, error) {
+	if cr.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err := cr.r.Read(p)
+	cr.remaining -= int64(n)
+	if err == io.EOF && cr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readNewc reads a newc header, returning it with the size of the name.
+func (cr *cpioReader) readNewc() (*cpioHeader, int64, error) {
+	var buf [110]byte
+	if _, err := io.ReadFull(cr.r, buf[:]); err != nil {
+		return nil, 0, fmt.Errorf("while reading cpio header: %w", noEOF(err))
+	}
+	if m := string(buf[:6]); m != "070701" && m != "070702" {
+		return nil, 0, fmt.Errorf("invalid cpio header magic %q", m)
+	}
+
+	var f [13]uint64
+	for i := range f {
+		v, err := strconv.ParseUint(string(buf[6+i*8:14+i*8]), 16, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid cpio header: %s", err)
+		}
+		f[i] = v
+	}
+	// ino mode uid gid nlink mtime filesize devmajor devminor rdevmajor
+	// rdevminor namesize check
+	return &cpioHeader{
+		ino:       f[0],
+		mode:      uint32(f[1]),
+		uid:       int(f[2]),
+		gid:       int(f[3]),
+		nlink:     uint32(f[4]),
+		mtime:     int64(f[5]),
+		size:      int64(f[6]),
+		dev:       unix.Mkdev(uint32(f[7]), uint32(f[8])),
+		rdevMajor: uint32(f[9]),
+		rdevMinor: uint32(f[10]),
+	}, int64(f[11]), nil
+}
+
+// readODC reads a POSIX.1 portable header, returning it with the size of
+// the name.
+func (cr *cpioReader) readODC() (*cpioHeader, int64, error) {
+	var buf [76]byte
+	if _, err := io.ReadFull(cr.r, buf[:]); err != nil {
+		return nil, 0, fmt.Errorf("while reading cpio header: %w", noEOF(err))
+	}
+	if m := string(buf[:6]); m != "070707" {
+		return nil, 0, fmt.Errorf("invalid cpio header magic %q", m)
+	}
+
+	// dev ino mode uid gid nlink rdev mtime namesize filesize
+	widths := []int{6, 6, 6, 6, 6, 6, 6, 11, 6, 11}
+	f := make([]uint64, len(widths))
+	offset := 6
+	for i, w := range widths {
+		v, err := strconv.ParseUint(string(buf[offset:offset+w]), 8, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid cpio header: %s", err)
+		}
+		f[i] = v
+		offset += w
+	}
+	return &cpioHeader{
+		dev:       f[0],
+		ino:       f[1],
+		mode:      uint32(f[2]),
+		uid:       int(f[3]),
+		gid:       int(f[4]),
+		nlink:     uint32(f[5]),
+		rdevMajor: unix.Major(f[6]),
+		rdevMinor: unix.Minor(f[6]),
+		mtime:     int64(f[7]),
+		size:      int64(f[9]),
+	}, int64(f[8]), nil
+}
+
+// readBinary reads an old binary header, returning it with the size of the
+// name.
+func (cr *cpioReader) readBinary() (*cpioHeader, int64, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if cr.format == cpioBinaryBE {
+		order = binary.BigEndian
+	}
+
+	// magic dev ino mode uid gid nlink rdev mtime[2] namesize filesize[2]
+	var f [13]uint16
+	if err := binary.Read(cr.r, order, &f); err != nil {
+		return nil, 0, fmt.Errorf("while reading cpio header: %w", noEOF(err))
+	}
+	if f[0] != 0o70707 {
+		return nil, 0, fmt.Errorf("invalid cpio header magic %o", f[0])
+	}
+	// the 32 bits values are stored most significant half first
+	long := func(hi, lo uint16) int64 {
+		return int64(hi)<<16 | int64(lo)
+	}
+	return &cpioHeader{
+		dev:       uint64(f[1]),
+		ino:       uint64(f[2]),
+		mode:      uint32(f[3]),
+		uid:       int(f[4]),
+		gid:       int(f[5]),
+		nlink:     uint32(f[6]),
+		rdevMajor: uint32(f[7] >> 8),
+		rdevMinor: uint32(f[7] & 0xff),
+		mtime:     long(f[8], f[9]),
+		size:      long(f[11], f[12]),
+	}, int64(f[10]), nil
+}
+
+// padding returns the number of bytes padding n to a multiple of align.
+func padding(n, align int64) int64 {
+	return (align - n%align) % align
+}
+
+// noEOF turns the EOF met in the middle of an archive into an unexpected
+// EOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// cpioExtractor extracts cpio archives into a root filesystem.
+type cpioExtractor struct {
+	rootfs string
+	// rootless doesn't restore the ownership of the entries, nor create
+	// device nodes
+	rootless bool
+	warnings *warningRecorder
+
+	// links maps the files with several links to the first path extracted
+	links map[[2]uint64]string
+	// dirs are the directories whose metadata are restored once their
+	// content is extracted
+	dirs []*cpioDir
+}
+
+// cpioDir is a directory whose metadata are restored once extracted.
+type cpioDir struct {
+	// name is the path of the directory in the archive, and path the one
+	// it was created at
+	name string
+	path string
+	h    *cpioHeader
+}
+
+// extractCpio extracts the cpio archives read from r into rootfs. The
+// archives may be gzip compressed, and concatenated as in initramfs images.
+// In rootless mode, the extracted content is owned by the current user and
+// device nodes are skipped.
+func extractCpio(r io.Reader, rootfs string, rootless bool, warnings *warningRecorder) error {
+	x := &cpioExtractor{
+		rootfs:   rootfs,
+		rootless: rootless,
+		warnings: warnings,
+		links:    make(map[[2]uint64]string),
+	}
+	if err := x.extractStream(bufio.NewReader(r)); err != nil {
+		return err
+	}
+
+	// restored last, as the extraction of their content modifies the
+	// directories and might require permissions they don't grant
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		if err := x.restoreDir(x.dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreDir restores the metadata of the directory d, unless a later entry
+// replaced it, or one of its parents, e.g. with a symlink pointing out of
+// the rootfs.
+func (x *cpioExtractor) restoreDir(d *cpioDir) error {
+	resolved, err := securejoin.SecureJoin(x.rootfs, d.name)
+	if err != nil {
+		return err
+	}
+	if resolved != d.path {
+		sylog.Debugf("Skipping metadata of %s: replaced by a later entry", d.name)
+		return nil
+	}
+	if fi, err := os.Lstat(d.path); err != nil || !fi.IsDir() {
+		sylog.Debugf("Skipping metadata of %s: replaced by a later entry", d.name)
+		return nil
+	}
+	return x.restoreMetadata(d.path, d.h)
+}
+
+// extractStream extracts the archives read from r, decompressing them when
+// gzip compressed.
+func (x *cpioExtractor) extractStream(r *bufio.Reader) error {
+	for {
+		// archives are usually padded with NUL bytes to a block size
+		for {
+			b, err := r.ReadByte()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if b != 0 {
+				r.UnreadByte()
+				break
+			}
+		}
+
+		magic, _ := r.Peek(2)
+		if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				return fmt.Errorf("while decompressing archive: %s", err)
+			}
+			// each gzip member is followed by the next archive
+			zr.Multistream(false)
+			if err := x.extractStream(bufio.NewReader(zr)); err != nil {
+				return err
+			}
+			zr.Close()
+			continue
+		}
+
+		cr, err := newCpioReader(r)
+		if err != nil {
+			return err
+		}
+		if err := x.extractArchive(cr); err != nil {
+			return err
+		}
+	}
+}
+
+// extractArchive extracts the entries of the archive read by cr.
+func (x *cpioExtractor) extractArchive(cr *cpioReader) error {
+	for {
+		h, err := cr.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := x.extractEntry(cr, h); err != nil {
+			return fmt.Errorf("while extracting %s: %s", h.name, err)
+		}
+	}
+}
+
+// extractEntry extracts the entry of header h, its data being read from r.
+func (x *cpioExtractor) extractEntry(r io.Reader, h *cpioHeader) error {
+	name := path.Clean("/" + h.name)
+	if name == "/" {
+		return nil
+	}
+
+	// symlinks of the parent directories are resolved within the rootfs
+	parent, err := securejoin.SecureJoin(x.rootfs, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return err
+	}
+	target := filepath.Join(parent, path.Base(name))
+
+	typ := h.mode & cpioTypeMask
+	if fi, err := os.Lstat(target); err == nil {
+		if typ == cpioTypeDir && fi.IsDir() {
+			x.dirs = append(x.dirs, &cpioDir{name: name, path: target, h: h})
+			return nil
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	switch typ {
+	case cpioTypeDir:
+		if err := os.Mkdir(target, 0o700); err != nil {
+			return err
+		}
+		x.dirs = append(x.dirs, &cpioDir{name: name, path: target, h: h})
+		return nil
+	case cpioTypeReg:
+		// the next links of a file are linked to its first path, the data
+		// might come with any of them, as with the last one in the newc
+		// format
+		key := [2]uint64{h.dev, h.ino}
+		first, linked := x.links[key]
+		if h.nlink > 1 && linked {
+			if err := os.Link(first, target); err != nil {
+				return err
+			}
+			if h.size == 0 {
+				return nil
+			}
+			target = first
+		} else if h.nlink > 1 {
+			x.links[key] = target
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case cpioTypeSymlink:
+		link, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(string(link), target); err != nil {
+			return err
+		}
+	case cpioTypeChar, cpioTypeBlock:
+		if x.rootless {
+			x.warnings.warnf("Skipping device node %s: device nodes can't be created without privileges", name)
+			return nil
+		}
+		dev := unix.Mkdev(h.rdevMajor, h.rdevMinor)
+		if err := unix.Mknod(target, typ|(h.mode&0o7777), int(dev)); err != nil {
+			// not permitted as root of a user namespace either
+			if errors.Is(err, unix.EPERM) {
+				x.warnings.warnf("Skipping device node %s: %s", name, err)
+				return nil
+			}
+			return err
+		}
+	case cpioTypeFifo:
+		if err := unix.Mkfifo(target, h.mode&0o7777); err != nil {
+			return err
+		}
+	case cpioTypeSocket:
+		sylog.Debugf("Skipping socket %s", name)
+		return nil
+	default:
+		return fmt.Errorf("unsupported file type %o", typ)
+	}
+
+	return x.restoreMetadata(target, h)
+}
+
+// restoreMetadata applies the ownership, permissions and modification time
+// of header h to path.
+func (x *cpioExtractor) restoreMetadata(path string, h *cpioHeader) error {
+	typ := h.mode & cpioTypeMask
+
+	if !x.rootless {
+		if err := os.Lchown(path, h.uid, h.gid); err != nil {
+			return err
+		}
+	}
+	// the permissions of symlinks are not used, and can't be changed
+	if typ != cpioTypeSymlink {
+		// after the ownership which resets the setuid and setgid bits
+		if err := unix.Chmod(path, h.mode&0o7777); err != nil {
+			return err
+		}
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(h.mtime * 1e9), unix.NsecToTimespec(h.mtime * 1e9)}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,130 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	dockerarchive "github.com/containers/image/v5/docker/archive"
+	dockerdaemon "github.com/containers/image/v5/docker/daemon"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	ociarchive "github.com/containers/image/v5/oci/archive"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ResolveSourceDigest returns the digest of the content the source of def
+// is built from with opts, without fetching it: the manifest digest of the
+// image selected for the platform of opts for oci/docker sources, the
+// digest locked for the tag of a docker source in the lock file of opts if
+// any, and the digest of the image file of a localimage source. It returns
+// an empty digest for a scratch source, and an error for the sources whose
+// content can't be resolved beforehand, e.g. the package manager ones.
+func ResolveSourceDigest(ctx context.Context, def sytypes.Definition, opts sytypes.Options) (string, error) {
+	bootstrap := def.Header["bootstrap"]
+	switch bootstrap {
+	case "scratch":
+		return "", nil
+	case "localimage":
+		f, err := os.Open(def.Header["from"])
+		if err != nil {
+			return "", fmt.Errorf("while opening local image: %v", err)
+		}
+		defer f.Close()
+		d, err := digest.FromReader(f)
+		if err != nil {
+			return "", fmt.Errorf("while reading local image: %v", err)
+		}
+		return d.String(), nil
+	case "docker", "docker-archive", "docker-daemon", "oci", "oci-archive":
+	default:
+		return "", fmt.Errorf("the digest of %s sources can't be resolved before the build", bootstrap)
+	}
+
+	ref, err := definitionReference(def, opts)
+	if err != nil {
+		return "", err
+	}
+	if bootstrap == "docker" && opts.LockFile != "" && !opts.UpdateLock {
+		if locked, err := lockedDigest(strings.TrimPrefix(ref, "//"), opts.LockFile); err != nil {
+			return "", err
+		} else if locked != "" {
+			return locked.String(), nil
+		}
+	}
+
+	var srcRef types.ImageReference
+	switch bootstrap {
+	case "docker":
+		srcRef, _, err = parseDockerReference(ref)
+	case "docker-archive":
+		srcRef, err = dockerarchive.ParseReference(ref)
+	case "docker-daemon":
+		srcRef, err = dockerdaemon.ParseReference(ref)
+	case "oci":
+		srcRef, err = ocilayout.ParseReference(ref)
+	case "oci-archive":
+		srcRef, err = ociarchive.ParseReference(ref)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid image source: %v", err)
+	}
+
+	sysCtx := sourceSystemContext(opts, opts.TmpDir)
+	if err := setPlatformChoice(sysCtx, opts); err != nil {
+		return "", err
+	}
+	if opts.ManifestCache != nil {
+		srcRef = newManifestCacheReference(srcRef, opts.ManifestCache)
+	}
+	// the image of an image index selected as for the build
+	srcRef = newPlatformReference(srcRef, wantedPlatform(sysCtx))
+	src, err := srcRef.NewImageSource(ctx, sysCtx)
+	if err != nil {
+		return "", fmt.Errorf("while opening image source: %w", err)
+	}
+	defer src.Close()
+	data, _, err := fetchManifest(ctx, src, opts.ManifestTimeout)
+	if err != nil {
+		return "", fmt.Errorf("while fetching manifest: %w", err)
+	}
+	d, err := manifest.Digest(data)
+	if err != nil {
+		return "", fmt.Errorf("while computing manifest digest: %w", err)
+	}
+	return d.String(), nil
+}
+
+// lockedDigest returns the digest recorded for the tag of the docker
+// transport reference ref (without the leading '//') in the lock file
+// path, or an empty digest if it isn't recorded.
+func lockedDigest(ref, path string) (digest.Digest, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := named.(reference.Canonical); ok {
+		return "", nil
+	}
+	tagged, ok := reference.TagNameOnly(named).(reference.NamedTagged)
+	if !ok {
+		return "", nil
+	}
+	lock, err := readBuildLock(path)
+	if err != nil {
+		return "", err
+	}
+	return lock.Sources[tagged.String()], nil
+}
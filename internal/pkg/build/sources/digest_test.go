@@ -0,0 +1,80 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestResolveSourceDigest(t *testing.T) {
+	reg := newStubRegistry(t)
+	v1 := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "v1"}))
+	v2 := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "v2"}))
+	reg.push("test/image", "latest", v2)
+
+	dir := t.TempDir()
+	layout := filepath.Join(dir, "layout")
+	v1.writeLayout(t, layout, "v1")
+	local := filepath.Join(dir, "image.sif")
+	if err := os.WriteFile(local, []byte("image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lockFile := filepath.Join(dir, "apptainer-build.lock")
+	lock, err := json.Marshal(buildLock{
+		Version: buildLockVersion,
+		Sources: map[string]digest.Digest{reg.host() + "/test/image:latest": v1.manifestDigest},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lockFile, lock, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		bootstrap string
+		from      string
+		lockFile  string
+		want      string
+		wantError bool
+	}{
+		{name: "docker", bootstrap: "docker", from: reg.host() + "/test/image", want: v2.manifestDigest.String()},
+		{name: "locked", bootstrap: "docker", from: reg.host() + "/test/image", lockFile: lockFile, want: v1.manifestDigest.String()},
+		{name: "oci", bootstrap: "oci", from: layout + ":v1", want: v1.manifestDigest.String()},
+		{name: "localimage", bootstrap: "localimage", from: local, want: digest.FromString("image").String()},
+		{name: "scratch", bootstrap: "scratch"},
+		{name: "yum", bootstrap: "yum", wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			def := sytypes.Definition{Header: map[string]string{"bootstrap": tt.bootstrap, "from": tt.from}}
+			opts := sytypes.Options{NoHTTPS: true, TmpDir: t.TempDir(), LockFile: tt.lockFile, Platform: "linux/amd64"}
+			got, err := ResolveSourceDigest(context.Background(), def, opts)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("unexpected success")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("unexpected digest %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/containers/image/v5/manifest"
+	digest "github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tarEntry describes an entry of a test layer.
+type tarEntry struct {
+	name     string
+	body     string
+	mode     int64
+	typeflag byte
+	linkname string
+	uid      int
+	gid      int
+	// xattrs are the extended attributes of the entry, by name
+	xattrs map[string]string
+}
+
+// dirEntry returns a directory entry for a test layer.
+func dirEntry(name string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeDir}
+}
+
+// makeLayer returns an uncompressed tar stream holding entries.
+func makeLayer(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Mode:     e.mode,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Uid:      e.uid,
+			Gid:      e.gid,
+			ModTime:  time.Unix(1600000000, 0),
+			Format:   tar.FormatPAX,
+		}
+		for name, value := range e.xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords["SCHILY.xattr."+name] = value
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o644
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Mode = 0o755
+			}
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("while writing tar header %s: %s", e.name, err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatalf("while writing tar content %s: %s", e.name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("while closing tar: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		t.Fatalf("while compressing: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("while compressing: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// testImage is an OCI image held in memory.
+type testImage struct {
+	manifest       imgspecv1.Manifest
+	manifestData   []byte
+	manifestDigest digest.Digest
+	config         imgspecv1.Image
+	configData     []byte
+	blobs          map[digest.Digest][]byte
+}
+
+// newTestImage returns an image made of the uncompressed tar layers, stored
+// gzip compressed. The config can be adjusted with the configure function.
+func newTestImage(t *testing.T, configure func(*imgspecv1.Image), layers ...[]byte) *testImage {
+	t.Helper()
+
+	img := &testImage{
+		blobs: make(map[digest.Digest][]byte),
+	}
+	img.config = imgspecv1.Image{
+		Platform: imgspecv1.Platform{
+			Architecture: "amd64",
+			OS:           "linux",
+		},
+		Config: imgspecv1.ImageConfig{
+			Env: []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+		},
+		RootFS: imgspecv1.RootFS{Type: "layers"},
+	}
+	img.manifest = imgspecv1.Manifest{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageManifest,
+	}
+
+	for _, l := range layers {
+		compressed := gzipBytes(t, l)
+		d := digest.FromBytes(compressed)
+		img.blobs[d] = compressed
+		img.config.RootFS.DiffIDs = append(img.config.RootFS.DiffIDs, digest.FromBytes(l))
+		img.manifest.Layers = append(img.manifest.Layers, imgspecv1.Descriptor{
+			MediaType: imgspecv1.MediaTypeImageLayerGzip,
+			Digest:    d,
+			Size:      int64(len(compressed)),
+		})
+	}
+
+	if configure != nil {
+		configure(&img.config)
+	}
+	img.update(t)
+
+	return img
+}
+
+// update recomputes the config and manifest blobs after a modification
+// of img.config or img.manifest.
+func (img *testImage) update(t *testing.T) {
+	t.Helper()
+
+	var err error
+
+	img.configData, err = json.Marshal(img.config)
+	if err != nil {
+		t.Fatalf("while encoding config: %s", err)
+	}
+	configDigest := digest.FromBytes(img.configData)
+	img.blobs[configDigest] = img.configData
+	configType := img.manifest.Config.MediaType
+	if configType == "" {
+		configType = imgspecv1.MediaTypeImageConfig
+	}
+	img.manifest.Config = imgspecv1.Descriptor{
+		MediaType: configType,
+		Digest:    configDigest,
+		Size:      int64(len(img.configData)),
+	}
+
+	img.manifestData, err = json.Marshal(img.manifest)
+	if err != nil {
+		t.Fatalf("while encoding manifest: %s", err)
+	}
+	img.manifestDigest = digest.FromBytes(img.manifestData)
+}
+
+// dockerSchema2 converts the image to a docker schema2 image.
+func (img *testImage) dockerSchema2(t *testing.T) {
+	t.Helper()
+
+	img.manifest.MediaType = manifest.DockerV2Schema2MediaType
+	img.manifest.Config.MediaType = manifest.DockerV2Schema2ConfigMediaType
+	for i := range img.manifest.Layers {
+		img.manifest.Layers[i].MediaType = manifest.DockerV2Schema2LayerMediaType
+	}
+	img.update(t)
+}
+
+// writeLayout writes the image as an OCI layout in dir, tagged with name.
+func (img *testImage) writeLayout(t *testing.T, dir, name string) {
+	t.Helper()
+
+	blobDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0o755); err != nil {
+		t.Fatalf("while creating %s: %s", blobDir, err)
+	}
+
+	blobs := map[digest.Digest][]byte{img.manifestDigest: img.manifestData}
+	for d, b := range img.blobs {
+		blobs[d] = b
+	}
+	for d, b := range blobs {
+		if err := os.WriteFile(filepath.Join(blobDir, d.Encoded()), b, 0o644); err != nil {
+			t.Fatalf("while writing blob %s: %s", d, err)
+		}
+	}
+
+	index := imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{
+			{
+				MediaType:   img.manifest.MediaType,
+				Digest:      img.manifestDigest,
+				Size:        int64(len(img.manifestData)),
+				Annotations: map[string]string{imgspecv1.AnnotationRefName: name},
+			},
+		},
+	}
+	indexData, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("while encoding index: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), indexData, 0o644); err != nil {
+		t.Fatalf("while writing index: %s", err)
+	}
+	layout := []byte(`{"imageLayoutVersion": "1.0.0"}`)
+	if err := os.WriteFile(filepath.Join(dir, imgspecv1.ImageLayoutFile), layout, 0o644); err != nil {
+		t.Fatalf("while writing layout: %s", err)
+	}
+}
+
+// stubRegistry is a minimal OCI distribution registry serving images
+// from memory.
+type stubRegistry struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// manifests maps repository -> tag or digest -> manifest data
+	manifests map[string]map[string][]byte
+	// mediaTypes maps manifest digests to their media types
+	mediaTypes map[digest.Digest]string
+	// blobs maps repository -> digest -> blob data
+	blobs map[string]map[digest.Digest][]byte
+	// requests counts the requests received per path
+	requests map[string]int
+	// handler is an optional handler called before the default one,
+	// returning true when the request has been fully handled
+	handler func(w http.ResponseWriter, r *http.Request) bool
+}
+
+// newStubRegistry starts a TLS stub registry, closed at the end of the test.
+func newStubRegistry(t *testing.T) *stubRegistry {
+	t.Helper()
+
+	return newStubMTLSRegistry(t, nil)
+}
+
+// newStubMTLSRegistry starts a TLS stub registry, closed at the end of the
+// test, requiring client certificates signed by clientCAs when not nil.
+func newStubMTLSRegistry(t *testing.T, clientCAs *x509.CertPool) *stubRegistry {
+	t.Helper()
+
+	reg := &stubRegistry{
+		manifests:  make(map[string]map[string][]byte),
+		mediaTypes: make(map[digest.Digest]string),
+		blobs:      make(map[string]map[digest.Digest][]byte),
+		requests:   make(map[string]int),
+	}
+	reg.Server = httptest.NewUnstartedServer(http.HandlerFunc(reg.serveHTTP))
+	if clientCAs != nil {
+		reg.TLS = &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+		}
+	}
+	reg.StartTLS()
+	t.Cleanup(reg.Close)
+
+	return reg
+}
+
+// getDockerSource gets the image ref, e.g. 127.0.0.1:5000/test/image:v1,
+// from a stub registry into a new bundle, set up by configure if not nil,
+// without cache and certificate verification.
+func getDockerSource(t *testing.T, ref string, configure func(*sytypes.Bundle)) (*OCIConveyorPacker, error) {
+	t.Helper()
+
+	b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("while creating bundle: %s", err)
+	}
+	t.Cleanup(func() { b.Remove() })
+
+	b.Recipe, err = sytypes.NewDefinitionFromURI("docker://" + ref)
+	if err != nil {
+		t.Fatalf("while parsing URI: %s", err)
+	}
+	b.Opts.NoCache = true
+	// the server certificate of the stub registry is self-signed
+	b.Opts.NoHTTPS = true
+	if configure != nil {
+		configure(b)
+	}
+
+	cp := &OCIConveyorPacker{}
+	err = cp.Get(context.Background(), b)
+	return cp, err
+}
+
+// host returns the host:port of the registry.
+func (reg *stubRegistry) host() string {
+	return strings.TrimPrefix(reg.URL, "https://")
+}
+
+// push stores the image in the registry repository under tag.
+func (reg *stubRegistry) push(repo, tag string, img *testImage) {
+	reg.pushManifest(repo, tag, img.manifest.MediaType, img.manifestData)
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for d, b := range img.blobs {
+		reg.blobs[repo][d] = b
+	}
+}
+
+// pushManifest stores raw manifest data in the registry repository
+// under tag, and under its digest.
+func (reg *stubRegistry) pushManifest(repo, tag, mediaType string, data []byte) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if reg.manifests[repo] == nil {
+		reg.manifests[repo] = make(map[string][]byte)
+		reg.blobs[repo] = make(map[digest.Digest][]byte)
+	}
+	d := digest.FromBytes(data)
+	reg.mediaTypes[d] = mediaType
+	reg.manifests[repo][d.String()] = data
+	if tag != "" {
+		reg.manifests[repo][tag] = data
+	}
+}
+
+// count returns the number of requests received with a path containing s.
+func (reg *stubRegistry) count(s string) int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	n := 0
+	for path, c := range reg.requests {
+		if strings.Contains(path, s) {
+			n += c
+		}
+	}
+	return n
+}
+
+func (reg *stubRegistry) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	reg.requests[r.URL.Path]++
+	handler := reg.handler
+	reg.mu.Unlock()
+
+	if handler != nil && handler(w, r) {
+		return
+	}
+
+	if r.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 {
+		reg.serveManifest(w, r, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i >= 0 {
+		reg.serveBlob(w, r, path[:i], path[i+len("/blobs/"):])
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (reg *stubRegistry) serveManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	reg.mu.Lock()
+	data, ok := reg.manifests[repo][ref]
+	reg.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+		return
+	}
+
+	d := digest.FromBytes(data)
+	w.Header().Set("Content-Type", reg.mediaTypes[d])
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
+
+func (reg *stubRegistry) serveBlob(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	reg.mu.Lock()
+	data, ok := reg.blobs[repo][digest.Digest(ref)]
+	reg.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[{"code":"BLOB_UNKNOWN","message":"blob unknown"}]}`)
+		return
+	}
+
+	w.Header().Set("Docker-Content-Digest", ref)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
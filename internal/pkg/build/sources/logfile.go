@@ -0,0 +1,79 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	apexlog "github.com/apex/log"
+)
+
+// colorCodes matches the color escape sequences of the sylog messages.
+var colorCodes = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// logTee writes the log lines of sylog and umoci to a log file.
+type logTee struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write writes the sylog output p without its color codes.
+func (t *logTee) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.w.Write(colorCodes.ReplaceAll(p, nil)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// apexLevels are the sylog names of the apex/log levels.
+var apexLevels = map[apexlog.Level]string{
+	apexlog.DebugLevel: "DEBUG",
+	apexlog.InfoLevel:  "INFO",
+	apexlog.WarnLevel:  "WARNING",
+	apexlog.ErrorLevel: "ERROR",
+	apexlog.FatalLevel: "FATAL",
+}
+
+// writeEntry writes the umoci log entry e, with its fields in order.
+func (t *logTee) writeEntry(e *apexlog.Entry) {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fields strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&fields, " %s=%v", name, e.Fields[name])
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	level, ok := apexLevels[e.Level]
+	if !ok {
+		level = strings.ToUpper(e.Level.String())
+	}
+	fmt.Fprintf(t.w, "%-8s umoci: %s%s\n", level+":", e.Message, fields.String())
+}
+
+// TeeLogs copies the log lines of sylog, and those logged by umoci through
+// apex/log during the extraction of oci/docker sources, to w until the
+// returned function is called, e.g. to keep the logs of the source phase of
+// a build in a log file. The lines are filtered by the current log level,
+// and written without their color codes.
+func TeeLogs(w io.Writer) (restore func()) {
+	t := &logTee{w: w}
+	return logHandlers.add(&logHandler{w: t, entry: t.writeEntry})
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	apexlog "github.com/apex/log"
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestTeeLogs(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	// keep the terminal output of the test quiet
+	var terminal bytes.Buffer
+	oldWriter := sylog.SetWriter(&terminal)
+	defer sylog.SetWriter(oldWriter)
+
+	// a foreign layer is reported by a warning during the extraction
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	img.manifest.Layers[0].MediaType = imgspecv1.MediaTypeImageLayerNonDistributableGzip //nolint:staticcheck
+	img.update(t)
+
+	path := filepath.Join(t.TempDir(), "build.log")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer f.Close()
+
+	// the tees of concurrent builds are restored in any order
+	var other bytes.Buffer
+	restoreOther := TeeLogs(&other)
+	restore := TeeLogs(f)
+	restoreOther()
+	sylog.Infof("Extracting the test image")
+	if _, err := unpackTestImage(t, img, nil); err != nil {
+		restore()
+		t.Fatalf("unexpected error: %s", err)
+	}
+	apexlog.WithField("path", "/file").Warnf("xattr dropped")
+	restore()
+	sylog.Infof("Not logged to the file")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	log := string(data)
+	for _, want := range []string{
+		"INFO:    Extracting the test image\n",
+		"WARNING: Layer " + img.manifest.Layers[0].Digest.String() + " is a foreign layer",
+		"WARNING: umoci: xattr dropped path=/file\n",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("%q not found in the log file:\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, "\x1b[") || strings.Contains(log, "Not logged") {
+		t.Errorf("unexpected content of the log file:\n%s", log)
+	}
+	if other.Len() != 0 {
+		t.Errorf("unexpected log lines after restore:\n%s", other.String())
+	}
+	if w := sylog.SetWriter(nil); w != &terminal {
+		t.Errorf("sylog writer not restored: %T", w)
+	}
+	if !strings.Contains(terminal.String(), "Not logged to the file") || !strings.Contains(terminal.String(), "is a foreign layer") {
+		t.Errorf("log lines not written to the terminal:\n%s", terminal.String())
+	}
+}
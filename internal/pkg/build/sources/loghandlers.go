@@ -0,0 +1,172 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"io"
+	"sync"
+
+	apexlog "github.com/apex/log"
+	"github.com/apptainer/apptainer/pkg/sylog"
+)
+
+// logHandler is the handler of the log lines of sylog and entries of umoci
+// added for a build.
+type logHandler struct {
+	// w, if set, is written the sylog output.
+	w io.Writer
+	// entry, if set, is passed the entries of the log level.
+	entry func(e *apexlog.Entry)
+	// warnings also passes the warnings hidden by the log level to entry.
+	warnings bool
+}
+
+// logDispatcher is the apex/log handler passing the entries logged by umoci
+// to the handler it replaced and to the handlers added for the builds in
+// progress, and the sylog writer doing the same for the sylog output while
+// a handler writes it. The builds only add and remove their own handler,
+// so that the concurrent builds of a process don't replace or restore the
+// handlers of each other. As sylog and umoci log globally, the lines of
+// concurrent builds are passed to the handlers of all of them.
+type logDispatcher struct {
+	mu        sync.Mutex
+	installed bool
+	logger    *apexlog.Logger
+	// handler is the apex/log handler replaced, passed the entries of
+	// level.
+	handler apexlog.Handler
+	level   apexlog.Level
+	// writer is the sylog writer replaced while writers handlers write
+	// the sylog output.
+	writer   io.Writer
+	writers  int
+	handlers map[*logHandler]struct{}
+}
+
+// logHandlers dispatches the log lines of sylog and umoci.
+var logHandlers = &logDispatcher{handlers: make(map[*logHandler]struct{})}
+
+// install replaces the apex/log handler, if not done yet. It is called with
+// d.mu held.
+func (d *logDispatcher) install() {
+	if d.installed {
+		return
+	}
+	d.installed = true
+	logger, ok := apexlog.Log.(*apexlog.Logger)
+	if !ok {
+		return
+	}
+	d.logger, d.handler, d.level = logger, logger.Handler, logger.Level
+	logger.Handler = d
+}
+
+// updateLevel sets the level of the apex/log logger to the lowest level
+// passed to a handler. It is called with d.mu held.
+func (d *logDispatcher) updateLevel() {
+	if d.logger == nil {
+		return
+	}
+	level := d.level
+	for h := range d.handlers {
+		if h.warnings && level > apexlog.WarnLevel {
+			level = apexlog.WarnLevel
+		}
+	}
+	d.logger.Level = level
+}
+
+// setLevel sets the log level of the entries logged by umoci.
+func (d *logDispatcher) setLevel(level apexlog.Level) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.install()
+	if d.logger == nil {
+		apexlog.SetLevel(level)
+		return
+	}
+	d.level = level
+	d.updateLevel()
+}
+
+// add adds the handler h until the returned function is called.
+func (d *logDispatcher) add(h *logHandler) (remove func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.install()
+	d.handlers[h] = struct{}{}
+	d.updateLevel()
+	if h.w != nil {
+		if d.writers == 0 {
+			d.writer = sylog.SetWriter(d)
+		}
+		d.writers++
+	}
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if _, ok := d.handlers[h]; !ok {
+			return
+		}
+		delete(d.handlers, h)
+		d.updateLevel()
+		if h.w != nil {
+			d.writers--
+			if d.writers == 0 {
+				sylog.SetWriter(d.writer)
+			}
+		}
+	}
+}
+
+// Write writes the sylog output p to the writer it replaced and to the
+// handlers writing it.
+func (d *logDispatcher) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	writer := d.writer
+	writers := make([]io.Writer, 0, d.writers)
+	for h := range d.handlers {
+		if h.w != nil {
+			writers = append(writers, h.w)
+		}
+	}
+	d.mu.Unlock()
+
+	// the errors of the copies don't fail the sylog output, nor are they
+	// logged through it
+	for _, w := range writers {
+		w.Write(p)
+	}
+	return writer.Write(p)
+}
+
+// HandleLog passes e to the handlers of its level.
+func (d *logDispatcher) HandleLog(e *apexlog.Entry) error {
+	d.mu.Lock()
+	handler, level := d.handler, d.level
+	handlers := make([]*logHandler, 0, len(d.handlers))
+	for h := range d.handlers {
+		handlers = append(handlers, h)
+	}
+	d.mu.Unlock()
+
+	for _, h := range handlers {
+		if h.entry == nil {
+			continue
+		}
+		if e.Level >= level || (h.warnings && e.Level == apexlog.WarnLevel) {
+			h.entry(e)
+		}
+	}
+	if e.Level < level {
+		return nil
+	}
+	return handler.HandleLog(e)
+}
@@ -0,0 +1,218 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	umocilayer "github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/idtools"
+	"golang.org/x/sys/unix"
+)
+
+// The xattrs holding the POSIX ACLs of a file, and the default ACLs of a
+// directory.
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+)
+
+// The version of the xattr encoding of the ACLs, and the tags of the ACL
+// entries naming a user or a group.
+const (
+	aclXattrVersion = 2
+	aclTagUser      = 0x02
+	aclTagGroup     = 0x08
+)
+
+// aclEntry is an entry of a POSIX ACL.
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// decodeACL decodes the value of an ACL xattr.
+func decodeACL(value []byte) ([]aclEntry, error) {
+	if len(value) < 4 || (len(value)-4)%8 != 0 {
+		return nil, fmt.Errorf("invalid ACL size %d", len(value))
+	}
+	if v := binary.LittleEndian.Uint32(value); v != aclXattrVersion {
+		return nil, fmt.Errorf("unsupported ACL version %d", v)
+	}
+	entries := make([]aclEntry, 0, (len(value)-4)/8)
+	for b := value[4:]; len(b) > 0; b = b[8:] {
+		entries = append(entries, aclEntry{
+			tag:  binary.LittleEndian.Uint16(b),
+			perm: binary.LittleEndian.Uint16(b[2:]),
+			id:   binary.LittleEndian.Uint32(b[4:]),
+		})
+	}
+	return entries, nil
+}
+
+// encodeACL returns the xattr value of the ACL entries.
+func encodeACL(entries []aclEntry) []byte {
+	value := make([]byte, 4, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(value, aclXattrVersion)
+	for _, e := range entries {
+		var b [8]byte
+		binary.LittleEndian.PutUint16(b[:], e.tag)
+		binary.LittleEndian.PutUint16(b[2:], e.perm)
+		binary.LittleEndian.PutUint32(b[4:], e.id)
+		value = append(value, b[:]...)
+	}
+	return value
+}
+
+// mapACL maps the users and groups named by the ACL xattr value onto the
+// host ids of the extraction. The entries naming an id without a mapping,
+// e.g. of a rootless extraction, are dropped and counted.
+func mapACL(value []byte, mapOptions umocilayer.MapOptions) ([]byte, int, error) {
+	entries, err := decodeACL(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	mapped := entries[:0]
+	dropped := 0
+	for _, e := range entries {
+		var idMap []rspec.LinuxIDMapping
+		switch e.tag {
+		case aclTagUser:
+			idMap = mapOptions.UIDMappings
+		case aclTagGroup:
+			idMap = mapOptions.GIDMappings
+		default:
+			mapped = append(mapped, e)
+			continue
+		}
+		id, err := idtools.ToHost(int(e.id), idMap)
+		if err != nil {
+			dropped++
+			continue
+		}
+		e.id = uint32(id)
+		mapped = append(mapped, e)
+	}
+	return encodeACL(mapped), dropped, nil
+}
+
+// aclHandler removes the ACL xattrs from the tar entries, before their
+// extraction by umoci which would set them as is, and applies them to the
+// extracted files with the sytypes.ACLPreserve policy. The ACLs name users
+// and groups, mapped as the owners of the files, and setting them fails on
+// the filesystems without ACLs.
+type aclHandler struct {
+	preserve   bool
+	mapOptions umocilayer.MapOptions
+	// files counts the files with ACLs, dropped the ones whose ACLs were
+	// dropped, and partial the ones whose ACLs were applied without the
+	// entries naming an unmapped id
+	files, dropped, partial int
+	// unsupported records that the rootfs doesn't support ACLs
+	unsupported bool
+}
+
+// newACLHandler returns the handler of the ACLs of the policy, extracted
+// with mapOptions.
+func newACLHandler(policy string, mapOptions umocilayer.MapOptions) (*aclHandler, error) {
+	switch policy {
+	case "", sytypes.ACLDrop, sytypes.ACLPreserve:
+	default:
+		return nil, fmt.Errorf("invalid policy %q for ACLs, should be %s or %s", policy, sytypes.ACLDrop, sytypes.ACLPreserve)
+	}
+	return &aclHandler{preserve: policy == sytypes.ACLPreserve, mapOptions: mapOptions}, nil
+}
+
+// strip removes the ACL xattrs from the tar entry hdr, and returns them.
+func (h *aclHandler) strip(hdr *tar.Header) map[string][]byte {
+	var acls map[string][]byte
+	for _, name := range []string{aclAccessXattr, aclDefaultXattr} {
+		value, ok := hdr.PAXRecords["SCHILY.xattr."+name]
+		if !ok {
+			value, ok = hdr.Xattrs[name] //nolint:staticcheck
+		}
+		if !ok {
+			continue
+		}
+		delete(hdr.PAXRecords, "SCHILY.xattr."+name)
+		delete(hdr.Xattrs, name) //nolint:staticcheck
+		if acls == nil {
+			acls = make(map[string][]byte)
+			h.files++
+		}
+		acls[name] = []byte(value)
+	}
+	if acls != nil && !h.preserve {
+		h.dropped++
+		return nil
+	}
+	return acls
+}
+
+// apply sets the ACL xattrs acls of the tar entry hdr extracted in rootfs.
+// The ACLs are dropped once the rootfs is found to not support them.
+func (h *aclHandler) apply(rootfs string, hdr *tar.Header, acls map[string][]byte) error {
+	if h.unsupported || hdr.Typeflag == tar.TypeSymlink {
+		h.dropped++
+		return nil
+	}
+	dir, file := filepath.Split(cleanEntryPath(hdr.Name))
+	dir, err := securejoin.SecureJoin(rootfs, dir)
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %w", hdr.Name, err)
+	}
+	path := filepath.Join(dir, file)
+
+	partial := false
+	for _, name := range []string{aclAccessXattr, aclDefaultXattr} {
+		value, ok := acls[name]
+		if !ok {
+			continue
+		}
+		value, dropped, err := mapACL(value, h.mapOptions)
+		if err != nil {
+			return fmt.Errorf("error decoding %s of %s: %w", name, hdr.Name, err)
+		}
+		partial = partial || dropped > 0
+		err = unix.Lsetxattr(path, name, value, 0)
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+			sylog.Warningf("Could not set the ACLs of %s, the ACLs of the image are dropped: %s", hdr.Name, err)
+			h.unsupported = true
+			h.dropped++
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error setting %s of %s: %w", name, hdr.Name, err)
+		}
+	}
+	if partial {
+		h.partial++
+	}
+	return nil
+}
+
+// report logs the ACLs dropped, if any.
+func (h *aclHandler) report() {
+	if h.dropped > 0 && !h.preserve {
+		sylog.Infof("Dropped the ACLs of %d files of the image (use --acls=%s to keep them)", h.dropped, sytypes.ACLPreserve)
+	} else if h.dropped > 0 {
+		sylog.Warningf("Dropped the ACLs of %d of %d files of the image", h.dropped, h.files)
+	}
+	if h.partial > 0 {
+		sylog.Warningf("The ACLs of %d files name users or groups without a mapping on the host, their entries were dropped", h.partial)
+	}
+}
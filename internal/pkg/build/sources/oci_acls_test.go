@@ -0,0 +1,205 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	umocilayer "github.com/opencontainers/umoci/oci/layer"
+	"golang.org/x/sys/unix"
+)
+
+// testACL is the ACL u::rwx,u:1000:rw-,g::r-x,g:100:r--,m::rw-,o::r--.
+var testACL = []aclEntry{
+	{tag: 0x01, perm: 7, id: 0xffffffff},
+	{tag: aclTagUser, perm: 6, id: 1000},
+	{tag: 0x04, perm: 5, id: 0xffffffff},
+	{tag: aclTagGroup, perm: 4, id: 100},
+	{tag: 0x10, perm: 6, id: 0xffffffff},
+	{tag: 0x20, perm: 4, id: 0xffffffff},
+}
+
+func TestMapACL(t *testing.T) {
+	value := encodeACL(testACL)
+	if len(value) != 4+8*len(testACL) {
+		t.Fatalf("unexpected ACL size %d", len(value))
+	}
+	entries, err := decodeACL(value)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(entries, testACL) {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	mapping := func(container, host, size uint32) []rspec.LinuxIDMapping {
+		return []rspec.LinuxIDMapping{{ContainerID: container, HostID: host, Size: size}}
+	}
+	tests := []struct {
+		name        string
+		opts        umocilayer.MapOptions
+		wantUID     uint32
+		wantGID     uint32
+		wantDropped int
+	}{
+		{name: "identity", wantUID: 1000, wantGID: 100},
+		{
+			name:    "subordinate ids",
+			opts:    umocilayer.MapOptions{UIDMappings: mapping(0, 100000, 65536), GIDMappings: mapping(0, 200000, 65536)},
+			wantUID: 101000,
+			wantGID: 200100,
+		},
+		{
+			name:        "rootless",
+			opts:        umocilayer.MapOptions{UIDMappings: mapping(0, 1000, 1), GIDMappings: mapping(0, 1000, 1), Rootless: true},
+			wantDropped: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapped, dropped, err := mapACL(encodeACL(testACL), tt.opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if dropped != tt.wantDropped {
+				t.Errorf("unexpected %d dropped entries, want %d", dropped, tt.wantDropped)
+			}
+			entries, err := decodeACL(mapped)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(entries) != len(testACL)-tt.wantDropped {
+				t.Fatalf("unexpected entries %v", entries)
+			}
+			for _, e := range entries {
+				switch {
+				case e.tag == aclTagUser && e.id != tt.wantUID:
+					t.Errorf("user entry mapped to %d, want %d", e.id, tt.wantUID)
+				case e.tag == aclTagGroup && e.id != tt.wantGID:
+					t.Errorf("group entry mapped to %d, want %d", e.id, tt.wantGID)
+				}
+			}
+		})
+	}
+
+	for _, value := range [][]byte{nil, {2, 0, 0, 0, 1}, {1, 0, 0, 0}} {
+		if _, _, err := mapACL(value, umocilayer.MapOptions{}); err == nil {
+			t.Errorf("unexpected success decoding %v", value)
+		}
+	}
+}
+
+func TestACLHandlerStrip(t *testing.T) {
+	value := string(encodeACL(testACL))
+	header := func() *tar.Header {
+		return &tar.Header{
+			Name: "file",
+			PAXRecords: map[string]string{
+				"SCHILY.xattr." + aclAccessXattr: value,
+				"SCHILY.xattr.user.comment":      "kept",
+			},
+			Xattrs: map[string]string{aclAccessXattr: value, "user.comment": "kept"}, //nolint:staticcheck
+		}
+	}
+
+	if _, err := newACLHandler("keep", umocilayer.MapOptions{}); err == nil {
+		t.Errorf("unexpected success with an invalid policy")
+	}
+
+	for _, policy := range []string{"", sytypes.ACLDrop, sytypes.ACLPreserve} {
+		h, err := newACLHandler(policy, umocilayer.MapOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		hdr := header()
+		acls := h.strip(hdr)
+		if _, ok := hdr.PAXRecords["SCHILY.xattr."+aclAccessXattr]; ok {
+			t.Errorf("%q: ACL left in the PAX records", policy)
+		}
+		if _, ok := hdr.Xattrs[aclAccessXattr]; ok { //nolint:staticcheck
+			t.Errorf("%q: ACL left in the xattrs", policy)
+		}
+		if hdr.PAXRecords["SCHILY.xattr.user.comment"] != "kept" || hdr.Xattrs["user.comment"] != "kept" { //nolint:staticcheck
+			t.Errorf("%q: unexpected removal of the other xattrs", policy)
+		}
+		if want := policy == sytypes.ACLPreserve; (acls != nil) != want {
+			t.Errorf("%q: unexpected ACLs %v", policy, acls)
+		} else if want && !bytes.Equal(acls[aclAccessXattr], []byte(value)) {
+			t.Errorf("%q: unexpected access ACL %v", policy, acls[aclAccessXattr])
+		}
+		if h.strip(&tar.Header{Name: "other"}) != nil {
+			t.Errorf("%q: unexpected ACLs of an entry without ACLs", policy)
+		}
+	}
+}
+
+func TestUnpackRootfsACLs(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	// the extraction happens in a temporary directory like the probe
+	probe := filepath.Join(t.TempDir(), "probe")
+	if err := os.WriteFile(probe, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(probe, aclAccessXattr, encodeACL(testACL), 0); errors.Is(err, unix.ENOTSUP) {
+		t.Skipf("ACLs not supported by the temporary directory: %s", err)
+	} else if err != nil {
+		t.Fatalf("while setting probe ACL: %s", err)
+	}
+
+	acl := string(encodeACL(testACL))
+	img := newTestImage(t, nil, makeLayer(t,
+		tarEntry{name: "srv/", typeflag: tar.TypeDir, mode: 0o775, xattrs: map[string]string{aclDefaultXattr: acl}},
+		tarEntry{name: "srv/data", body: "data", mode: 0o664, xattrs: map[string]string{aclAccessXattr: acl}},
+		tarEntry{name: "srv/plain", body: "plain"},
+	))
+
+	for _, policy := range []string{"", sytypes.ACLPreserve} {
+		t.Run("policy "+policy, func(t *testing.T) {
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.ACLs = policy
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			for path, name := range map[string]string{"srv": aclDefaultXattr, "srv/data": aclAccessXattr} {
+				buf := make([]byte, 256)
+				n, err := unix.Lgetxattr(filepath.Join(b.RootfsPath, path), name, buf)
+				if policy != sytypes.ACLPreserve {
+					if !errors.Is(err, unix.ENODATA) {
+						t.Errorf("%s: unexpected %s (err=%v)", path, name, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s: unexpected error: %s", path, err)
+				}
+				entries, err := decodeACL(buf[:n])
+				if err != nil || !reflect.DeepEqual(entries, testACL) {
+					t.Errorf("%s: unexpected ACL %v (err=%v)", path, entries, err)
+				}
+			}
+			// the files only hold the ACLs of their entry, not the inherited
+			// default ACL of their directory
+			if _, err := unix.Lgetxattr(filepath.Join(b.RootfsPath, "srv/plain"), aclAccessXattr, nil); !errors.Is(err, unix.ENODATA) {
+				t.Errorf("srv/plain: unexpected ACL (err=%v)", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isCaseInsensitive is overridden by tests to simulate a case-insensitive
+// filesystem.
+var isCaseInsensitive = caseInsensitive
+
+// caseInsensitive reports whether the filesystem holding the directory dir
+// resolves names regardless of their case.
+func caseInsensitive(dir string) (bool, error) {
+	f, err := os.CreateTemp(dir, ".case-check-")
+	if err != nil {
+		return false, err
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	_, err = os.Lstat(filepath.Join(dir, strings.ToUpper(filepath.Base(name))))
+	if err == nil {
+		return true, nil
+	} else if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// caseCollisions detects the layer entries whose paths only differ by case
+// from a path extracted before, which overwrite each other when extracted
+// on a case-insensitive filesystem.
+type caseCollisions struct {
+	// paths maps the case folded paths extracted so far to their path
+	paths map[string]string
+	// found lists the collisions found, once per pair of paths
+	found []string
+	seen  map[string]bool
+}
+
+func newCaseCollisions() *caseCollisions {
+	return &caseCollisions{
+		paths: make(map[string]string),
+		seen:  make(map[string]bool),
+	}
+}
+
+// check records the tar entry hdr, and returns the collisions of its path
+// or of its parent directories with the paths extracted before.
+func (c *caseCollisions) check(hdr *tar.Header) []string {
+	path := cleanEntryPath(hdr.Name)
+	dir, base := filepath.Split(path)
+
+	// whiteouts remove their target whatever its case
+	switch {
+	case base == whiteoutOpaqueDir:
+		c.forget(cleanEntryPath(dir), false)
+		return nil
+	case strings.HasPrefix(base, whiteoutPrefix):
+		c.forget(cleanEntryPath(dir+strings.TrimPrefix(base, whiteoutPrefix)), true)
+		return nil
+	}
+
+	var collisions []string
+	elems := strings.Split(path, "/")
+	for i := range elems {
+		p := strings.Join(elems[:i+1], "/")
+		key := strings.ToLower(p)
+		prev, ok := c.paths[key]
+		if !ok {
+			c.paths[key] = p
+			continue
+		}
+		if prev == p {
+			continue
+		}
+		collision := fmt.Sprintf("%s collides with %s", p, prev)
+		if !c.seen[collision] {
+			c.seen[collision] = true
+			c.found = append(c.found, collision)
+			collisions = append(collisions, collision)
+		}
+	}
+	return collisions
+}
+
+// forget removes the paths below path, and path itself when self is set,
+// whatever their case.
+func (c *caseCollisions) forget(path string, self bool) {
+	key := strings.ToLower(path)
+	prefix := key + "/"
+	if key == "" {
+		prefix = ""
+	}
+	for k := range c.paths {
+		if (self && k == key) || (k != key && strings.HasPrefix(k, prefix)) {
+			delete(c.paths, k)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+)
+
+func TestCaseInsensitive(t *testing.T) {
+	dir := t.TempDir()
+
+	// test temporary directories are on case-sensitive filesystems
+	insensitive, err := caseInsensitive(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if insensitive {
+		t.Errorf("%s reported as case-insensitive", dir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("check file left in %s", dir)
+	}
+}
+
+func TestUnpackRootfsCaseCollisions(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	isCaseInsensitive = func(string) (bool, error) { return true, nil }
+	t.Cleanup(func() { isCaseInsensitive = caseInsensitive })
+
+	tests := []struct {
+		name       string
+		layers     [][]byte
+		warn       bool
+		collisions []string
+	}{
+		{
+			name: "same layer",
+			layers: [][]byte{makeLayer(t,
+				dirEntry("etc/"),
+				tarEntry{name: "etc/config", body: "lower"},
+				tarEntry{name: "etc/Config", body: "upper"},
+			)},
+			collisions: []string{"etc/Config collides with etc/config"},
+		},
+		{
+			name: "across layers",
+			layers: [][]byte{
+				makeLayer(t, dirEntry("opt/"), tarEntry{name: "opt/README", body: "lower"}),
+				makeLayer(t, dirEntry("opt/"), tarEntry{name: "opt/readme", body: "upper"}),
+			},
+			collisions: []string{"opt/readme collides with opt/README"},
+		},
+		{
+			name: "parent directory",
+			layers: [][]byte{makeLayer(t,
+				dirEntry("usr/"),
+				dirEntry("usr/lib/"),
+				tarEntry{name: "USR/lib/file", body: "file"},
+			)},
+			collisions: []string{"USR collides with usr"},
+		},
+		{
+			name: "whiteout",
+			layers: [][]byte{
+				makeLayer(t, dirEntry("etc/"), tarEntry{name: "etc/config", body: "lower"}),
+				makeLayer(t, tarEntry{name: "etc/.wh.config"}, tarEntry{name: "etc/Config", body: "upper"}),
+			},
+		},
+		{
+			name: "opaque whiteout",
+			layers: [][]byte{
+				makeLayer(t, dirEntry("etc/"), tarEntry{name: "etc/config", body: "lower"}),
+				makeLayer(t, dirEntry("etc/"), tarEntry{name: "etc/.wh..wh..opq"}, tarEntry{name: "etc/Config", body: "upper"}),
+			},
+		},
+		{
+			name: "warnings",
+			layers: [][]byte{makeLayer(t,
+				dirEntry("etc/"),
+				tarEntry{name: "etc/config", body: "lower"},
+				tarEntry{name: "etc/Config", body: "upper"},
+			)},
+			warn: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := newTestImage(t, nil, tt.layers...)
+			_, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.CaseCollisionWarnings = tt.warn
+			})
+			if len(tt.collisions) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("unexpected success")
+			}
+			for _, c := range tt.collisions {
+				if !strings.Contains(err.Error(), c) {
+					t.Errorf("error %q doesn't report %q", err, c)
+				}
+			}
+		})
+	}
+}
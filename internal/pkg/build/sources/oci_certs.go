@@ -0,0 +1,54 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// clientCertName and clientKeyName are the names of the client
+	// certificate and key of a certificate directory, a .cert file being
+	// paired with the .key file of the same name by containers/image.
+	clientCertName = "client.cert"
+	clientKeyName  = "client.key"
+)
+
+// clientCertDir creates a certificate directory in tmpDir holding the PEM
+// encoded client certificate cert and its private key key, presented to the
+// registries requiring mutual TLS when used as the DockerCertPath of a system
+// context, and returns its path. The files are linked, not copied.
+func clientCertDir(tmpDir, cert, key string) (string, error) {
+	if cert == "" || key == "" {
+		return "", fmt.Errorf("a client certificate requires both a certificate and a key")
+	}
+	// fail early on unusable files, their error would only be reported by
+	// the TLS handshake otherwise
+	if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+		return "", fmt.Errorf("while loading client certificate %s and key %s: %s", cert, key, err)
+	}
+
+	dir, err := os.MkdirTemp(tmpDir, "client-cert-")
+	if err != nil {
+		return "", fmt.Errorf("while creating certificate directory: %s", err)
+	}
+	for name, path := range map[string]string{clientCertName: cert, clientKeyName: key} {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		if err := os.Symlink(abs, filepath.Join(dir, name)); err != nil {
+			return "", fmt.Errorf("while linking %s: %s", path, err)
+		}
+	}
+	return dir, nil
+}
@@ -0,0 +1,166 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+)
+
+// testCA is a certificate authority issuing test client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+// newTestCA returns a new self-signed certificate authority.
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("while generating CA key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("while creating CA certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("while parsing CA certificate: %s", err)
+	}
+	ca := &testCA{cert: cert, key: key, pool: x509.NewCertPool()}
+	ca.pool.AddCert(cert)
+	return ca
+}
+
+// issue writes a client certificate signed by the CA and its key as PEM
+// files in dir, and returns their paths.
+func (ca *testCA) issue(t *testing.T, dir string) (certPath, keyPath string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("while generating client key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("while creating client certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("while encoding client key: %s", err)
+	}
+
+	certPath = filepath.Join(dir, "client.pem")
+	keyPath = filepath.Join(dir, "client-key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatalf("while writing client certificate: %s", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("while writing client key: %s", err)
+	}
+	return certPath, keyPath
+}
+
+func TestOCIConveyorPackerClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	certPath, keyPath := ca.issue(t, t.TempDir())
+	otherCert, otherKey := newTestCA(t).issue(t, t.TempDir())
+
+	body := make([]byte, 1024)
+	if _, err := rand.Read(body); err != nil {
+		t.Fatalf("while generating layer content: %s", err)
+	}
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: string(body)}))
+	reg := newStubMTLSRegistry(t, ca.pool)
+	reg.push("test/image", "v1", img)
+
+	var mu sync.Mutex
+	ranges := 0
+	reg.handler = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Range") != "" {
+			mu.Lock()
+			ranges++
+			mu.Unlock()
+		}
+		return false
+	}
+
+	tests := []struct {
+		name      string
+		cert      string
+		key       string
+		chunkSize int64
+		wantError string
+	}{
+		{name: "client certificate", cert: certPath, key: keyPath},
+		{name: "chunked fetch", cert: certPath, key: keyPath, chunkSize: 128},
+		// the handshake fails, then the fallback to http of --no-https
+		{name: "no client certificate", wantError: "pinging container registry"},
+		{name: "unknown authority", cert: otherCert, key: otherKey, wantError: "pinging container registry"},
+		{name: "missing key", cert: certPath, wantError: "requires both a certificate and a key"},
+		{name: "mismatched key", cert: certPath, key: otherKey, wantError: "while loading client certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := getDockerSource(t, reg.host()+"/test/image:v1", func(b *sytypes.Bundle) {
+				b.Opts.DockerClientCert = tt.cert
+				b.Opts.DockerClientKey = tt.key
+				b.Opts.ChunkSize = tt.chunkSize
+			})
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.chunkSize > 0 && ranges == 0 {
+				t.Errorf("layer not fetched in chunks")
+			}
+		})
+	}
+}
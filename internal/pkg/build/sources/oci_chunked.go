@@ -0,0 +1,275 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+
+	"github.com/apptainer/apptainer/internal/pkg/util/fs"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// chunkRetries is the number of attempts made to fetch the rest of a blob.
+const chunkRetries = 3
+
+// partialSuffix is appended to the blob path of a partially fetched blob.
+const partialSuffix = ".partial"
+
+// errRangeUnsupported is returned when the image source doesn't support
+// range requests.
+var errRangeUnsupported = errors.New("range requests are not supported")
+
+// chunkedFetcher fetches large blobs from a docker registry with HTTP range
+// requests, into an OCI layout, through the image source of the docker
+// transport of containers/image, and so its credentials, certificates,
+// mirrors and proxies. The part of a blob fetched so far is kept in a
+// partial file, so that an interrupted download resumes from where it
+// stopped instead of restarting from the beginning of the blob.
+type chunkedFetcher struct {
+	src types.ImageSource
+	// closeSrc closes src when the fetcher opened it
+	closeSrc  bool
+	chunkSize int64
+	// limiter limits the download rate when not nil
+	limiter *rateLimiter
+}
+
+// newChunkedFetcher returns a fetcher for the blobs of the docker image
+// reference ref larger than chunkSize bytes. The image source of the
+// sharedSourceReference wrapped by ref, if any, is used, along with the
+// bearer tokens it obtained.
+func newChunkedFetcher(ctx context.Context, ref types.ImageReference, sysCtx *types.SystemContext, chunkSize int64) (*chunkedFetcher, error) {
+	for {
+		if shared, ok := ref.(*sharedSourceReference); ok {
+			src, err := shared.NewImageSource(ctx, sysCtx)
+			if err != nil {
+				return nil, err
+			}
+			return &chunkedFetcher{src: src.(sharedSource).ImageSource, chunkSize: chunkSize}, nil
+		}
+		u, ok := ref.(interface{ Unwrap() types.ImageReference })
+		if !ok {
+			break
+		}
+		ref = u.Unwrap()
+	}
+	if ref.Transport().Name() != "docker" {
+		return nil, fmt.Errorf("%s is not a docker reference", ref.StringWithinTransport())
+	}
+	src, err := ref.NewImageSource(ctx, sysCtx)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkedFetcher{src: src, closeSrc: true, chunkSize: chunkSize}, nil
+}
+
+// close closes the image source opened by the fetcher.
+func (f *chunkedFetcher) close() {
+	if f.closeSrc {
+		f.src.Close()
+	}
+}
+
+// fetchLayers fetches the layers larger than the chunk size into the OCI
+// layout dir, skipping the layers already present. The partial files are
+// kept in partialDir, e.g. the blob cache when the layout is temporary. A
+// layer which can't be fetched is left to the copy of the image, with its
+// partial file to resume from in the next build.
+func (f *chunkedFetcher) fetchLayers(ctx context.Context, dir, partialDir string, layers []types.BlobInfo) error {
+	for _, l := range layers {
+		if l.Size <= f.chunkSize {
+			continue
+		}
+		if err := l.Digest.Validate(); err != nil {
+			return fmt.Errorf("invalid layer digest %s: %w", l.Digest, err)
+		}
+
+		dst := filepath.Join(dir, "blobs", l.Digest.Algorithm().String(), l.Digest.Encoded())
+		if _, err := os.Stat(dst); err == nil {
+			sylog.Debugf("Layer %s already fetched", l.Digest)
+			continue
+		}
+		partial := filepath.Join(partialDir, "blobs", l.Digest.Algorithm().String(), l.Digest.Encoded()) + partialSuffix
+		for _, d := range []string{filepath.Dir(dst), filepath.Dir(partial)} {
+			if err := os.MkdirAll(d, 0o755); err != nil {
+				return fmt.Errorf("while creating blob directory: %w", err)
+			}
+		}
+
+		err := f.fetchBlob(ctx, partial, dst, l)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if errors.Is(err, errRangeUnsupported) {
+			sylog.Debugf("Fetching layer %s in one request: %s", l.Digest, err)
+		} else if err != nil {
+			sylog.Warningf("Fetching layer %s in one request: %s", l.Digest, err)
+		}
+	}
+	return nil
+}
+
+// fetchBlob fetches the blob described by info into dst, resuming from the
+// content of the partial file left by a previous attempt, and checks its
+// digest once complete.
+func (f *chunkedFetcher) fetchBlob(ctx context.Context, partial, dst string, info types.BlobInfo) error {
+	file, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := fi.Size()
+	if offset > info.Size {
+		offset = 0
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+	} else if offset > 0 {
+		sylog.Infof("Resuming download of layer %s at %d/%d bytes", info.Digest, offset, info.Size)
+	}
+
+	// a request fetches the rest of the blob, a registry ignoring the range
+	// sending the whole blob skipped up to offset
+	for attempt := 1; offset < info.Size && attempt <= chunkRetries; attempt++ {
+		var n int64
+		n, err = f.fetchRange(ctx, file, info, offset, info.Size)
+		// the bytes received are kept even if the range is incomplete, a
+		// retry only requests the missing part
+		offset += n
+		if err == nil || errors.Is(err, errRangeUnsupported) || ctx.Err() != nil {
+			break
+		}
+		sylog.Debugf("Retrying bytes %d-%d of layer %s: %s", offset, info.Size-1, info.Digest, err)
+	}
+	if err != nil {
+		if offset == 0 {
+			file.Close()
+			os.Remove(partial)
+		}
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := checkBlobDigest(partial, info.Digest); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return moveFile(partial, dst)
+}
+
+// fetchRange appends the bytes from offset to end (excluded) of the blob
+// info to file, and returns the number of bytes appended.
+func (f *chunkedFetcher) fetchRange(ctx context.Context, file io.Writer, info types.BlobInfo, offset, end int64) (int64, error) {
+	rc, err := getBlobAt(ctx, f.src, info, offset, end-offset)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	n, err := io.Copy(file, io.LimitReader(f.limiter.reader(ctx, rc), end-offset))
+	if err != nil {
+		return n, err
+	}
+	if n != end-offset {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+// getBlobAt returns the length bytes at offset of the blob info of src,
+// with the GetBlobAt method of the image sources of containers/image. The
+// method isn't part of the public interface of the image sources, so it is
+// called through reflection, errRangeUnsupported being returned when src
+// doesn't have it.
+func getBlobAt(ctx context.Context, src types.ImageSource, info types.BlobInfo, offset, length int64) (io.ReadCloser, error) {
+	m := reflect.ValueOf(src).MethodByName("GetBlobAt")
+	if !m.IsValid() || m.Type().NumIn() != 3 || m.Type().NumOut() != 3 ||
+		m.Type().In(2).Kind() != reflect.Slice || m.Type().In(2).Elem().Kind() != reflect.Struct {
+		return nil, errRangeUnsupported
+	}
+	chunks := reflect.MakeSlice(m.Type().In(2), 1, 1)
+	for name, v := range map[string]int64{"Offset": offset, "Length": length} {
+		field := chunks.Index(0).FieldByName(name)
+		if !field.IsValid() || field.Kind() != reflect.Uint64 {
+			return nil, errRangeUnsupported
+		}
+		field.SetUint(uint64(v))
+	}
+
+	out := m.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(info), chunks})
+	if err, _ := out[2].Interface().(error); err != nil {
+		return nil, err
+	}
+	streams, ok := out[0].Interface().(chan io.ReadCloser)
+	if !ok {
+		return nil, errRangeUnsupported
+	}
+	errs, ok := out[1].Interface().(chan error)
+	if !ok {
+		return nil, errRangeUnsupported
+	}
+	select {
+	case rc, ok := <-streams:
+		if ok {
+			return rc, nil
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+// moveFile renames src to dst, copying it when they are on different
+// filesystems.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := fs.CopyFileAtomic(src, dst, 0o644); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// checkBlobDigest checks that the content of the file at path matches d.
+func checkBlobDigest(path string, d digest.Digest) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	verifier := d.Verifier()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("digest of the assembled blob doesn't match %s", d)
+	}
+	return nil
+}
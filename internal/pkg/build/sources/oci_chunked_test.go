@@ -0,0 +1,205 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+)
+
+func TestChunkedFetcher(t *testing.T) {
+	const chunkSize = 1024
+
+	body := make([]byte, 8*chunkSize)
+	if _, err := rand.Read(body); err != nil {
+		t.Fatalf("while generating layer content: %s", err)
+	}
+	img := newTestImage(t, nil,
+		makeLayer(t, tarEntry{name: "large", body: string(body)}),
+		makeLayer(t, tarEntry{name: "small", body: "small"}),
+	)
+	large, small := img.manifest.Layers[0], img.manifest.Layers[1]
+	blob := img.blobs[large.Digest]
+	last := len(blob) - 1
+	layers := []types.BlobInfo{
+		{Digest: large.Digest, Size: large.Size},
+		{Digest: small.Digest, Size: small.Size},
+	}
+
+	tests := []struct {
+		name string
+		// partial is the content of the partial file left by a previous
+		// attempt
+		partial []byte
+		// abortAt aborts the range request with this number, after sending
+		// half of the requested bytes
+		abortAt int
+		// noRange makes the registry ignore range requests
+		noRange bool
+		// token requires a bearer token
+		token      bool
+		wantRanges []string
+		wantBlob   bool
+	}{
+		{
+			name:       "range",
+			wantRanges: []string{fmt.Sprintf("bytes=0-%d", last)},
+			wantBlob:   true,
+		},
+		{
+			name:       "interrupted range",
+			abortAt:    1,
+			wantRanges: []string{fmt.Sprintf("bytes=0-%d", last), fmt.Sprintf("bytes=%d-%d", len(blob)/2, last)},
+			wantBlob:   true,
+		},
+		{
+			name:       "resume partial file",
+			partial:    blob[:3000],
+			wantRanges: []string{fmt.Sprintf("bytes=3000-%d", last)},
+			wantBlob:   true,
+		},
+		{
+			name:     "corrupted partial file",
+			partial:  bytes.Repeat([]byte{0}, 3000),
+			wantBlob: false,
+		},
+		{
+			name:     "token",
+			token:    true,
+			wantBlob: true,
+		},
+		{
+			name:     "range ignored",
+			noRange:  true,
+			wantBlob: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newStubRegistry(t)
+			reg.push("test/image", "v1", img)
+
+			var mu sync.Mutex
+			var ranges []string
+			reg.handler = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.URL.Path == "/token" {
+					fmt.Fprint(w, `{"token":"stub-token"}`)
+					return true
+				}
+				if tt.token && r.Header.Get("Authorization") != "Bearer stub-token" {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="`+reg.URL+`/token",service="stub"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return true
+				}
+				if !strings.Contains(r.URL.Path, "/blobs/") || r.Header.Get("Range") == "" {
+					return false
+				}
+				if tt.noRange {
+					r.Header.Del("Range")
+					return false
+				}
+
+				mu.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				n := len(ranges)
+				mu.Unlock()
+				if n != tt.abortAt {
+					return false
+				}
+
+				var start, end int
+				fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(blob)))
+				w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(blob[start : start+(end-start+1)/2])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+
+			// the partial files are kept out of the layout, e.g. in the
+			// blob cache
+			dir, partialDir := t.TempDir(), t.TempDir()
+			dst := filepath.Join(dir, "blobs", "sha256", large.Digest.Encoded())
+			partial := filepath.Join(partialDir, "blobs", "sha256", large.Digest.Encoded()) + partialSuffix
+			if tt.partial != nil {
+				if err := os.MkdirAll(filepath.Dir(partial), 0o755); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if err := os.WriteFile(partial, tt.partial, 0o644); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+
+			ref, _, err := parseDockerReference("//" + reg.host() + "/test/image:v1")
+			if err != nil {
+				t.Fatalf("while parsing reference: %s", err)
+			}
+			f, err := newChunkedFetcher(context.Background(), ref, stubSysCtx(), chunkSize)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer f.close()
+
+			// a layer which can't be fetched is left to the copy of the
+			// image
+			if err := f.fetchLayers(context.Background(), dir, partialDir, layers); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			requested := make(map[string]bool)
+			for _, r := range ranges {
+				requested[r] = true
+			}
+			for _, want := range tt.wantRanges {
+				if !requested[want] {
+					t.Errorf("range %s not requested, got %v", want, ranges)
+				}
+			}
+			if tt.partial != nil && len(tt.wantRanges) > 0 && (len(ranges) == 0 || ranges[0] != tt.wantRanges[0]) {
+				t.Errorf("download not resumed from the partial file, got %v", ranges)
+			}
+
+			data, err := os.ReadFile(dst)
+			if !tt.wantBlob {
+				if err == nil {
+					t.Errorf("unexpected blob fetched")
+				}
+				if _, err := os.Stat(partial); !os.IsNotExist(err) {
+					t.Errorf("empty or corrupted partial file left")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("blob not fetched: %s", err)
+			}
+			if !bytes.Equal(data, blob) {
+				t.Errorf("fetched blob differs from the registry one")
+			}
+			if _, err := os.Stat(partial); !os.IsNotExist(err) {
+				t.Errorf("partial file left after the fetch")
+			}
+			smallPath := filepath.Join(dir, "blobs", "sha256", small.Digest.Encoded())
+			if _, err := os.Stat(smallPath); !os.IsNotExist(err) {
+				t.Errorf("layer smaller than the chunk size unexpectedly fetched")
+			}
+		})
+	}
+}
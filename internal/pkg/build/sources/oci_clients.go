@@ -0,0 +1,237 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/containers/image/v5/pkg/tlsclientconfig"
+	"github.com/containers/image/v5/types"
+)
+
+const (
+	// maxPooledClients is the number of clients kept by registryClients.
+	maxPooledClients = 32
+	// pooledClientIdleTimeout is the time after which a client nobody
+	// borrowed is evicted from registryClients.
+	pooledClientIdleTimeout = 5 * time.Minute
+	// maxConnsPerClient limits the connections of a pooled client, shared
+	// by the concurrent builds borrowing it.
+	maxConnsPerClient = 16
+)
+
+// registryClients is the pool of the HTTP clients of the servers the
+// oci-http sources are fetched from, shared by the builds of the process.
+// The docker sources aren't fetched with it: containers/image creates the
+// client of each image source, so the manifest, layer and chunked fetches of
+// a build share the one image source of its sharedSourceReference instead.
+var registryClients = newClientPool(maxPooledClients, pooledClientIdleTimeout)
+
+// clientKey identifies the pooled client of a host. The credentials are
+// part of the key so that the bearer tokens cached with a client are only
+// used with the credentials they were obtained with. The certificates are
+// identified by their content, the builds writing the same client
+// certificate to their own directory sharing the client.
+type clientKey struct {
+	host     string
+	auth     [sha256.Size]byte
+	insecure bool
+	certs    [sha256.Size]byte
+}
+
+// pooledClient is a client of a clientPool.
+type pooledClient struct {
+	client *http.Client
+	// users is the number of borrowers of the client
+	users    int
+	lastUsed time.Time
+	// tokens caches the bearer tokens obtained per repository
+	tokens map[string]string
+}
+
+// clientPool is a concurrency safe pool of HTTP clients keyed by host and
+// credentials. Reusing the client of a host across builds reuses its
+// connections, and the bearer tokens obtained for its repositories.
+type clientPool struct {
+	mu          sync.Mutex
+	clients     map[clientKey]*pooledClient
+	max         int
+	idleTimeout time.Duration
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// newClientPool returns a pool keeping up to max clients, the ones unused
+// for idleTimeout being evicted.
+func newClientPool(max int, idleTimeout time.Duration) *clientPool {
+	return &clientPool{
+		clients:     make(map[clientKey]*pooledClient),
+		max:         max,
+		idleTimeout: idleTimeout,
+		now:         time.Now,
+	}
+}
+
+// borrowedClient is a client borrowed from a clientPool, to release once
+// done with it.
+type borrowedClient struct {
+	*http.Client
+	pool *clientPool
+	key  clientKey
+	pc   *pooledClient
+}
+
+// borrow returns the client of host for the credentials auth, skipping the
+// TLS verification when insecure. The CA and client certificates of the
+// certDir directory are used when not empty, as the DockerCertPath of a
+// system context. The client is created if not pooled, and not kept in the
+// pool when it is full of borrowed clients.
+func (p *clientPool) borrow(host string, auth *types.DockerAuthConfig, insecure bool, certDir string) (*borrowedClient, error) {
+	key := clientKey{host: host, insecure: insecure}
+	if certDir != "" {
+		certs, err := certDirDigest(certDir)
+		if err != nil {
+			return nil, err
+		}
+		key.certs = certs
+	}
+	if auth != nil {
+		key.auth = sha256.Sum256([]byte(auth.Username + "\x00" + auth.Password + "\x00" + auth.IdentityToken))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.evict()
+	pc, ok := p.clients[key]
+	if !ok {
+		client, err := newPooledHTTPClient(insecure, certDir)
+		if err != nil {
+			return nil, err
+		}
+		pc = &pooledClient{client: client, tokens: make(map[string]string)}
+		if len(p.clients) >= p.max {
+			p.evictOldest()
+		}
+		if len(p.clients) < p.max {
+			p.clients[key] = pc
+		} else {
+			sylog.Debugf("Client pool full, not pooling the client of %s", host)
+		}
+	}
+	pc.users++
+	pc.lastUsed = p.now()
+	return &borrowedClient{Client: pc.client, pool: p, key: key, pc: pc}, nil
+}
+
+// certDirDigest returns the digest of the names and content of the files
+// of the certificates directory certDir.
+func certDirDigest(certDir string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	entries, err := os.ReadDir(certDir)
+	if err != nil {
+		return sum, fmt.Errorf("while loading certificates from %s: %w", certDir, err)
+	}
+	h := sha256.New()
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(certDir, e.Name()))
+		if err != nil {
+			return sum, fmt.Errorf("while loading certificates from %s: %w", certDir, err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", e.Name(), len(data))
+		h.Write(data)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// evict removes the clients unused for the idle timeout.
+func (p *clientPool) evict() {
+	now := p.now()
+	for k, pc := range p.clients {
+		if pc.users == 0 && now.Sub(pc.lastUsed) >= p.idleTimeout {
+			pc.client.CloseIdleConnections()
+			delete(p.clients, k)
+		}
+	}
+}
+
+// evictOldest removes the least recently used of the clients nobody
+// borrowed, if any.
+func (p *clientPool) evictOldest() {
+	var oldest *pooledClient
+	var oldestKey clientKey
+	for k, pc := range p.clients {
+		if pc.users == 0 && (oldest == nil || pc.lastUsed.Before(oldest.lastUsed)) {
+			oldest, oldestKey = pc, k
+		}
+	}
+	if oldest != nil {
+		oldest.client.CloseIdleConnections()
+		delete(p.clients, oldestKey)
+	}
+}
+
+// release returns the client to its pool, closing its connections when
+// it isn't pooled.
+func (c *borrowedClient) release() {
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+
+	c.pc.users--
+	c.pc.lastUsed = c.pool.now()
+	if c.pool.clients[c.key] != c.pc && c.pc.users == 0 {
+		c.pc.client.CloseIdleConnections()
+	}
+}
+
+// token returns the bearer token cached for the repository repo.
+func (c *borrowedClient) token(repo string) string {
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+
+	return c.pc.tokens[repo]
+}
+
+// setToken caches the bearer token of the repository repo.
+func (c *borrowedClient) setToken(repo, token string) {
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+
+	c.pc.tokens[repo] = token
+}
+
+// newPooledHTTPClient returns a client whose connections are limited to
+// maxConnsPerClient, skipping the TLS verification when insecure, and using
+// the certificates of certDir when not empty.
+func newPooledHTTPClient(insecure bool, certDir string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = maxConnsPerClient
+	transport.MaxIdleConnsPerHost = maxConnsPerClient
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+	if certDir != "" {
+		if err := tlsclientconfig.SetupCertificates(certDir, transport.TLSClientConfig); err != nil {
+			return nil, fmt.Errorf("while loading certificates from %s: %w", certDir, err)
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,222 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/types"
+)
+
+// mustBorrow borrows the client of host from p, without certificates.
+func mustBorrow(t *testing.T, p *clientPool, host string, auth *types.DockerAuthConfig, insecure bool) *borrowedClient {
+	t.Helper()
+
+	c, err := p.borrow(host, auth, insecure, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return c
+}
+
+func TestClientPoolBorrow(t *testing.T) {
+	p := newClientPool(4, time.Minute)
+	alice := &types.DockerAuthConfig{Username: "alice", Password: "secret"}
+
+	c := mustBorrow(t, p, "registry.example", alice, false)
+	c.setToken("library/alpine", "alice-token")
+	c.release()
+
+	same := mustBorrow(t, p, "registry.example", &types.DockerAuthConfig{Username: "alice", Password: "secret"}, false)
+	defer same.release()
+	if same.Client != c.Client {
+		t.Errorf("client not reused for the same registry and credentials")
+	}
+	if tok := same.token("library/alpine"); tok != "alice-token" {
+		t.Errorf("unexpected cached token %q", tok)
+	}
+
+	others := map[string]*borrowedClient{
+		"other credentials": mustBorrow(t, p, "registry.example", &types.DockerAuthConfig{Username: "bob", Password: "secret"}, false),
+		"anonymous":         mustBorrow(t, p, "registry.example", nil, false),
+		"insecure":          mustBorrow(t, p, "registry.example", alice, true),
+		"other registry":    mustBorrow(t, p, "other.example", alice, false),
+	}
+	for name, o := range others {
+		defer o.release()
+		if o.Client == c.Client {
+			t.Errorf("%s: unexpected client reused", name)
+		}
+		if tok := o.token("library/alpine"); tok != "" {
+			t.Errorf("%s: unexpected cached token %q", name, tok)
+		}
+	}
+}
+
+func TestClientPoolBorrowCertDir(t *testing.T) {
+	p := newClientPool(4, time.Minute)
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, t.TempDir())
+	otherCert, otherKey := ca.issue(t, t.TempDir())
+
+	// each build links the client certificate in its own directory
+	borrowCert := func(cert, key string) *borrowedClient {
+		t.Helper()
+		dir, err := clientCertDir(t.TempDir(), cert, key)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		c, err := p.borrow("registry.example", nil, false, dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return c
+	}
+
+	c := borrowCert(cert, key)
+	defer c.release()
+	same := borrowCert(cert, key)
+	defer same.release()
+	if same.Client != c.Client {
+		t.Errorf("client not reused for the same client certificate")
+	}
+
+	other := borrowCert(otherCert, otherKey)
+	defer other.release()
+	none := mustBorrow(t, p, "registry.example", nil, false)
+	defer none.release()
+	if other.Client == c.Client || none.Client == c.Client {
+		t.Errorf("client reused for another client certificate")
+	}
+}
+
+func TestClientPoolEviction(t *testing.T) {
+	now := time.Now()
+	p := newClientPool(2, time.Minute)
+	p.now = func() time.Time { return now }
+
+	// borrowed clients are never evicted
+	held := mustBorrow(t, p, "held.example", nil, false)
+	now = now.Add(time.Hour)
+	if c := mustBorrow(t, p, "held.example", nil, false); c.Client != held.Client {
+		t.Errorf("borrowed client evicted")
+	} else {
+		c.release()
+	}
+
+	// idle clients are evicted after the idle timeout
+	idle := mustBorrow(t, p, "idle.example", nil, false)
+	idle.release()
+	now = now.Add(30 * time.Second)
+	if c := mustBorrow(t, p, "idle.example", nil, false); c.Client != idle.Client {
+		t.Errorf("client evicted before the idle timeout")
+	} else {
+		c.release()
+	}
+	now = now.Add(2 * time.Minute)
+	if c := mustBorrow(t, p, "idle.example", nil, false); c.Client == idle.Client {
+		t.Errorf("client not evicted after the idle timeout")
+	} else {
+		idle = c
+	}
+
+	// the pool is full of borrowed clients, the next one isn't pooled
+	extra := mustBorrow(t, p, "extra.example", nil, false)
+	extra.release()
+	if len(p.clients) != 2 {
+		t.Errorf("unexpected pooled clients: got %d, want 2", len(p.clients))
+	}
+	if c := mustBorrow(t, p, "extra.example", nil, false); c.Client == extra.Client {
+		t.Errorf("client reused while not pooled")
+	} else {
+		c.release()
+	}
+
+	// once released, the least recently used client makes room
+	idle.release()
+	now = now.Add(time.Second)
+	extra = mustBorrow(t, p, "extra.example", nil, false)
+	defer extra.release()
+	if _, ok := p.clients[clientKey{host: "idle.example"}]; ok {
+		t.Errorf("least recently used client not evicted from the full pool")
+	}
+	if _, ok := p.clients[clientKey{host: "extra.example"}]; !ok {
+		t.Errorf("client not pooled once room was made")
+	}
+	held.release()
+}
+
+func TestChunkedFetcherSharedSource(t *testing.T) {
+	const chunkSize = 1024
+
+	body := make([]byte, 4*chunkSize)
+	if _, err := rand.Read(body); err != nil {
+		t.Fatalf("while generating layer content: %s", err)
+	}
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "large", body: string(body)}))
+	large := img.manifest.Layers[0]
+	layers := []types.BlobInfo{{Digest: large.Digest, Size: large.Size}}
+
+	reg := newStubRegistry(t)
+	reg.push("test/image", "v1", img)
+
+	var mu sync.Mutex
+	conns := make(map[string]bool)
+	reg.handler = func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		conns[r.RemoteAddr] = true
+		mu.Unlock()
+
+		if r.URL.Path == "/token" {
+			fmt.Fprint(w, `{"token":"stub-token"}`)
+			return true
+		}
+		if r.Header.Get("Authorization") != "Bearer stub-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+reg.URL+`/token",service="stub"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return true
+		}
+		return false
+	}
+
+	ref, _, err := parseDockerReference("//" + reg.host() + "/test/image:v1")
+	if err != nil {
+		t.Fatalf("while parsing reference: %s", err)
+	}
+
+	// the fetchers of a build reuse its shared image source, and the
+	// token it obtained
+	shared := newSharedSourceReference(ref)
+	defer shared.Close()
+	for i := 0; i < 2; i++ {
+		f, err := newChunkedFetcher(context.Background(), newRateLimitedReference(shared, nil), stubSysCtx(), chunkSize)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		dir := t.TempDir()
+		err = f.fetchLayers(context.Background(), dir, dir, layers)
+		f.close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if n := reg.count("/token"); n != 1 {
+		t.Errorf("unexpected token requests: got %d, want 1", n)
+	}
+	if len(conns) != 1 {
+		t.Errorf("unexpected connections to the registry: got %d, want 1", len(conns))
+	}
+}
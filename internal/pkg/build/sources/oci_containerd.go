@@ -0,0 +1,261 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apptainer/apptainer/pkg/sylog"
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The default socket and namespace of containerd, as used by ctr.
+const (
+	defaultContainerdAddress   = "/run/containerd/containerd.sock"
+	defaultContainerdNamespace = "default"
+)
+
+// containerdNamespaceHeader is the gRPC header selecting the namespace of
+// the containerd requests.
+const containerdNamespaceHeader = "containerd-namespace"
+
+// containerdEndpoint returns the socket address and the namespace of the
+// containerd image store, defaulting to the CONTAINERD_ADDRESS and
+// CONTAINERD_NAMESPACE environment variables, as for ctr, and then to the
+// containerd defaults.
+func containerdEndpoint(address, namespace string) (string, string) {
+	if address == "" {
+		address = os.Getenv("CONTAINERD_ADDRESS")
+	}
+	if address == "" {
+		address = defaultContainerdAddress
+	}
+	if namespace == "" {
+		namespace = os.Getenv("CONTAINERD_NAMESPACE")
+	}
+	if namespace == "" {
+		namespace = defaultContainerdNamespace
+	}
+	return address, namespace
+}
+
+// fetchContainerdImage copies the image named ref from the namespace of
+// the containerd image store listening at address into the layout
+// directory dir, and returns a reference to the local copy. An image index
+// is resolved to the image matching the platform of sysCtx, only its blobs
+// are copied.
+func fetchContainerdImage(ctx context.Context, ref, dir, address, namespace string, sysCtx *types.SystemContext) (types.ImageReference, error) {
+	address, namespace = containerdEndpoint(address, namespace)
+	conn, err := grpc.DialContext(ctx, "unix:"+address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("while connecting to containerd at %s: %w", address, err)
+	}
+	defer conn.Close()
+
+	f := &containerdFetcher{
+		images:    imagesapi.NewImagesClient(conn),
+		content:   contentapi.NewContentClient(conn),
+		address:   address,
+		namespace: namespace,
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, containerdNamespaceHeader, namespace)
+	if err := f.fetch(ctx, strings.TrimPrefix(ref, "//"), dir, sysCtx); err != nil {
+		return nil, err
+	}
+	return ocilayout.ParseReference(dir)
+}
+
+// containerdFetcher copies an image from the content store of containerd,
+// through its gRPC API.
+type containerdFetcher struct {
+	images    imagesapi.ImagesClient
+	content   contentapi.ContentClient
+	address   string
+	namespace string
+}
+
+// fetch copies the image named ref into the layout directory dir.
+func (f *containerdFetcher) fetch(ctx context.Context, ref, dir string, sysCtx *types.SystemContext) error {
+	desc, err := f.resolve(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	if manifest.MIMETypeIsMultiImage(desc.MediaType) {
+		data, err := f.fetchMetadataBlob(ctx, dir, desc)
+		if err != nil {
+			return err
+		}
+		list, err := manifest.ListFromBlob(data, desc.MediaType)
+		if err != nil {
+			return fmt.Errorf("while decoding image index %s: %w", desc.Digest, err)
+		}
+		d, err := selectPlatformInstance(list, wantedPlatform(sysCtx))
+		if err != nil {
+			return fmt.Errorf("while choosing image in index %s: %w", desc.Digest, err)
+		}
+		instance, err := list.Instance(d)
+		if err != nil {
+			return err
+		}
+		desc = imgspecv1.Descriptor{MediaType: instance.MediaType, Digest: d, Size: instance.Size}
+	}
+
+	data, err := f.fetchMetadataBlob(ctx, dir, desc)
+	if err != nil {
+		return err
+	}
+	m, err := manifest.FromBlob(data, desc.MediaType)
+	if err != nil {
+		return fmt.Errorf("while decoding manifest %s: %w", desc.Digest, err)
+	}
+	blobs := []types.BlobInfo{m.ConfigInfo()}
+	for _, layer := range m.LayerInfos() {
+		blobs = append(blobs, layer.BlobInfo)
+	}
+	for _, blob := range blobs {
+		if err := f.fetchBlob(ctx, dir, imgspecv1.Descriptor{Digest: blob.Digest, Size: blob.Size}); err != nil {
+			return err
+		}
+	}
+
+	// the local layout only holds the fetched image
+	return writeLayoutIndex(dir, desc)
+}
+
+// resolve returns the descriptor of the target of the image named ref. The
+// images pulled by containerd are named by their fully qualified reference,
+// e.g. docker.io/library/alpine:latest, ref is also looked up in that form.
+func (f *containerdFetcher) resolve(ctx context.Context, ref string) (imgspecv1.Descriptor, error) {
+	names := []string{ref}
+	if named, err := reference.ParseNormalizedNamed(ref); err == nil {
+		if name := reference.TagNameOnly(named).String(); name != ref {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		resp, err := f.images.Get(ctx, &imagesapi.GetImageRequest{Name: name})
+		if status.Code(err) == codes.NotFound {
+			continue
+		} else if err != nil {
+			return imgspecv1.Descriptor{}, f.apiError(err)
+		}
+		target := resp.GetImage().GetTarget()
+		sylog.Debugf("Resolved containerd image %s to %s", name, target.GetDigest())
+		d, err := digest.Parse(target.GetDigest())
+		if err != nil {
+			return imgspecv1.Descriptor{}, fmt.Errorf("invalid digest of containerd image %s: %w", name, err)
+		}
+		return imgspecv1.Descriptor{MediaType: target.GetMediaType(), Digest: d, Size: target.GetSize()}, nil
+	}
+	return imgspecv1.Descriptor{}, fmt.Errorf("no image %s in the %q namespace of containerd", ref, f.namespace)
+}
+
+// apiError returns the error err of a containerd request, pointing at the
+// socket when containerd can't be reached.
+func (f *containerdFetcher) apiError(err error) error {
+	if status.Code(err) == codes.Unavailable {
+		return fmt.Errorf("containerd is not reachable at %s: %w", f.address, err)
+	}
+	return fmt.Errorf("containerd request failed: %w", err)
+}
+
+// fetchMetadataBlob fetches the blob described by desc into the layout
+// directory dir, and returns its content.
+func (f *containerdFetcher) fetchMetadataBlob(ctx context.Context, dir string, desc imgspecv1.Descriptor) ([]byte, error) {
+	if desc.Size > maxLayoutFileSize {
+		return nil, fmt.Errorf("manifest %s is too large: %d bytes", desc.Digest, desc.Size)
+	}
+	if err := f.fetchBlob(ctx, dir, desc); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(dir, imgspecv1.ImageBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+}
+
+// fetchBlob reads the blob described by desc from the content store into
+// the layout directory dir, and checks its digest.
+func (f *containerdFetcher) fetchBlob(ctx context.Context, dir string, desc imgspecv1.Descriptor) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid blob digest %s: %w", desc.Digest, err)
+	}
+	dst := filepath.Join(dir, imgspecv1.ImageBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("while creating blob directory: %w", err)
+	}
+
+	partial := dst + partialSuffix
+	file, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := f.readBlob(ctx, file, desc); err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("while fetching blob %s: %w", desc.Digest, err)
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := checkBlobDigest(partial, desc.Digest); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, dst)
+}
+
+// readBlob writes the content of the blob described by desc to file. The
+// layers of the images unpacked by containerd may have been discarded from
+// the content store, they can't be read anymore.
+func (f *containerdFetcher) readBlob(ctx context.Context, file *os.File, desc imgspecv1.Descriptor) error {
+	stream, err := f.content.Read(ctx, &contentapi.ReadContentRequest{Digest: desc.Digest.String()})
+	if err != nil {
+		return f.apiError(err)
+	}
+	var size int64
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if status.Code(err) == codes.NotFound {
+			return fmt.Errorf("blob missing from the content store of containerd, the image must be pulled again: %w", err)
+		} else if err != nil {
+			return f.apiError(err)
+		}
+		if _, err := file.WriteAt(resp.GetData(), resp.GetOffset()); err != nil {
+			return err
+		}
+		if end := resp.GetOffset() + int64(len(resp.GetData())); end > size {
+			size = end
+		}
+	}
+	if desc.Size > 0 && size != desc.Size {
+		return fmt.Errorf("read %d bytes, expected %d", size, desc.Size)
+	}
+	return nil
+}
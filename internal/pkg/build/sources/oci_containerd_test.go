@@ -0,0 +1,304 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	apitypes "github.com/containerd/containerd/api/types"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// stubContainerd serves the images and blobs of a containerd namespace
+// through the images and content services of the containerd API.
+type stubContainerd struct {
+	namespace string
+	images    map[string]imgspecv1.Descriptor
+	blobs     map[digest.Digest][]byte
+}
+
+// newStubContainerd returns a stub containerd serving the namespace on a
+// socket, whose address is returned.
+func newStubContainerd(t *testing.T, namespace string) (*stubContainerd, string) {
+	t.Helper()
+
+	c := &stubContainerd{
+		namespace: namespace,
+		images:    make(map[string]imgspecv1.Descriptor),
+		blobs:     make(map[digest.Digest][]byte),
+	}
+	address := filepath.Join(t.TempDir(), "containerd.sock")
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatalf("while listening on %s: %s", address, err)
+	}
+	s := grpc.NewServer()
+	imagesapi.RegisterImagesServer(s, stubImages{c: c})
+	contentapi.RegisterContentServer(s, stubContent{c: c})
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	return c, address
+}
+
+// add adds the image img named name.
+func (c *stubContainerd) add(name string, img *testImage) {
+	c.images[name] = imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Digest:    img.manifestDigest,
+		Size:      int64(len(img.manifestData)),
+	}
+	c.blobs[img.manifestDigest] = img.manifestData
+	for d, b := range img.blobs {
+		c.blobs[d] = b
+	}
+}
+
+func (c *stubContainerd) inNamespace(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ns := md.Get(containerdNamespaceHeader)
+	return len(ns) == 1 && ns[0] == c.namespace
+}
+
+// stubImages is the images service of a stubContainerd.
+type stubImages struct {
+	imagesapi.UnimplementedImagesServer
+	c *stubContainerd
+}
+
+func (s stubImages) Get(ctx context.Context, req *imagesapi.GetImageRequest) (*imagesapi.GetImageResponse, error) {
+	desc, ok := s.c.images[req.GetName()]
+	if !ok || !s.c.inNamespace(ctx) {
+		return nil, status.Errorf(codes.NotFound, "image %q: not found", req.GetName())
+	}
+	return &imagesapi.GetImageResponse{Image: &imagesapi.Image{
+		Name:   req.GetName(),
+		Target: &apitypes.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest.String(), Size: desc.Size},
+	}}, nil
+}
+
+// stubContent is the content service of a stubContainerd.
+type stubContent struct {
+	contentapi.UnimplementedContentServer
+	c *stubContainerd
+}
+
+func (s stubContent) Read(req *contentapi.ReadContentRequest, srv contentapi.Content_ReadServer) error {
+	blob, ok := s.c.blobs[digest.Digest(req.GetDigest())]
+	if !ok || !s.c.inNamespace(srv.Context()) {
+		return status.Errorf(codes.NotFound, "content digest %s: not found", req.GetDigest())
+	}
+	// sent in several chunks
+	const chunk = 100
+	for offset := 0; offset < len(blob); offset += chunk {
+		end := offset + chunk
+		if end > len(blob) {
+			end = len(blob)
+		}
+		if err := srv.Send(&contentapi.ReadContentResponse{Offset: int64(offset), Data: blob[offset:end]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFetchContainerdImage(t *testing.T) {
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	c, address := newStubContainerd(t, "builds")
+	c.add("docker.io/library/test:latest", img)
+	c.add("localhost/tools:1.0", img)
+
+	// an index holding only the image of the host platform, as pulled by
+	// containerd
+	index := imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{
+			{
+				MediaType: imgspecv1.MediaTypeImageManifest,
+				Digest:    img.manifestDigest,
+				Size:      int64(len(img.manifestData)),
+				Platform:  &imgspecv1.Platform{OS: "linux", Architecture: "amd64"},
+			},
+			{
+				MediaType: imgspecv1.MediaTypeImageManifest,
+				Digest:    digest.FromString("arm64 manifest"),
+				Size:      100,
+				Platform:  &imgspecv1.Platform{OS: "linux", Architecture: "arm64"},
+			},
+		},
+	}
+	indexData, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("while encoding index: %s", err)
+	}
+	indexDigest := digest.FromBytes(indexData)
+	c.images["docker.io/library/multi:latest"] = imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageIndex, Digest: indexDigest, Size: int64(len(indexData))}
+	c.blobs[indexDigest] = indexData
+
+	broken := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "discarded"}))
+	c.add("docker.io/library/broken:latest", broken)
+	delete(c.blobs, broken.manifest.Layers[0].Digest)
+
+	tests := []struct {
+		name      string
+		ref       string
+		address   string
+		namespace string
+		wantError string
+	}{
+		{name: "short name", ref: "test", namespace: "builds"},
+		{name: "uri form", ref: "//test:latest", namespace: "builds"},
+		{name: "full name", ref: "localhost/tools:1.0", namespace: "builds"},
+		{name: "index", ref: "multi", namespace: "builds"},
+		{name: "missing image", ref: "missing", namespace: "builds", wantError: `no image missing in the "builds" namespace of containerd`},
+		{name: "other namespace", ref: "test", namespace: "default", wantError: `no image test in the "default" namespace of containerd`},
+		{name: "discarded layer", ref: "broken", namespace: "builds", wantError: "blob missing from the content store of containerd"},
+		{name: "unreachable", ref: "test", address: filepath.Join(t.TempDir(), "none.sock"), namespace: "builds", wantError: "containerd is not reachable at"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.address == "" {
+				tt.address = address
+			}
+			dir := t.TempDir()
+			sysCtx := &types.SystemContext{OSChoice: "linux", ArchitectureChoice: "amd64"}
+			_, err := fetchContainerdImage(context.Background(), tt.ref, dir, tt.address, tt.namespace, sysCtx)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(dir, imgspecv1.ImageIndexFile))
+			if err != nil {
+				t.Fatalf("while reading index: %s", err)
+			}
+			var got imgspecv1.Index
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("while decoding index: %s", err)
+			}
+			if len(got.Manifests) != 1 || got.Manifests[0].Digest != img.manifestDigest {
+				t.Errorf("unexpected layout index: %+v", got.Manifests)
+			}
+			for d := range img.blobs {
+				if _, err := os.Stat(filepath.Join(dir, "blobs", "sha256", d.Encoded())); err != nil {
+					t.Errorf("blob %s not fetched: %s", d, err)
+				}
+			}
+		})
+	}
+
+	t.Run("conveyor", func(t *testing.T) {
+		b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+		if err != nil {
+			t.Fatalf("while creating bundle: %s", err)
+		}
+		t.Cleanup(func() { b.Remove() })
+		b.Recipe, err = sytypes.NewDefinitionFromURI("containerd:test")
+		if err != nil {
+			t.Fatalf("while parsing URI: %s", err)
+		}
+		b.Opts.NoCache = true
+		b.Opts.Containerd = sytypes.ContainerdOptions{Address: address, Namespace: "builds"}
+
+		cp := &OCIConveyorPacker{}
+		if err := cp.Get(context.Background(), b); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := cp.Pack(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if data, err := os.ReadFile(filepath.Join(b.RootfsPath, "file")); err != nil || string(data) != "content" {
+			t.Errorf("unexpected rootfs content: %q, %v", data, err)
+		}
+	})
+}
+
+func TestContainerdSource(t *testing.T) {
+	address, _ := containerdEndpoint("", "")
+	if _, err := os.Stat(address); err != nil {
+		t.Skipf("skipping test, containerd is not running: %s", err)
+	}
+	ctr, err := exec.LookPath("ctr")
+	if err != nil {
+		t.Skip("skipping test, ctr not installed")
+	}
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "containerd"}))
+	layout := t.TempDir()
+	img.writeLayout(t, layout, "latest")
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	if out, err := exec.Command("tar", "-C", layout, "-cf", archive, ".").CombinedOutput(); err != nil {
+		t.Fatalf("while creating archive: %s: %s", err, out)
+	}
+	const namespace = "apptainer-test"
+	const name = "localhost/apptainer-test:latest"
+	if out, err := exec.Command(ctr, "-a", address, "-n", namespace, "images", "import", "--base-name", "localhost/apptainer-test", archive).CombinedOutput(); err != nil {
+		t.Fatalf("while importing image: %s: %s", err, out)
+	}
+	t.Cleanup(func() {
+		exec.Command(ctr, "-a", address, "-n", namespace, "images", "rm", name).Run()
+	})
+
+	for _, ref := range []string{name, "missing"} {
+		t.Run(ref, func(t *testing.T) {
+			b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+			if err != nil {
+				t.Fatalf("while creating bundle: %s", err)
+			}
+			t.Cleanup(func() { b.Remove() })
+			b.Recipe, err = sytypes.NewDefinitionFromURI("containerd:" + ref)
+			if err != nil {
+				t.Fatalf("while parsing URI: %s", err)
+			}
+			b.Opts.NoCache = true
+			b.Opts.Containerd.Namespace = namespace
+
+			cp := &OCIConveyorPacker{}
+			err = cp.Get(context.Background(), b)
+			if ref == "missing" {
+				if err == nil || !strings.Contains(err.Error(), "no image missing") {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if _, err := cp.Pack(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if data, err := os.ReadFile(filepath.Join(b.RootfsPath, "file")); err != nil || string(data) != "containerd" {
+				t.Errorf("unexpected rootfs content: %q, %v", data, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/apptainer/apptainer/internal/pkg/util/env"
+)
+
+// envName matches the valid names of environment variables.
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// normalizeEnv returns the env entries of an image config without the
+// malformed entries, with a single entry for each variable holding its last
+// value, and with PATH set to the default path if missing. The problems
+// found are returned as messages.
+func normalizeEnv(entries []string) (normalized []string, problems []string) {
+	last := make(map[string]int)
+	valid := make([]bool, len(entries))
+	for i, entry := range entries {
+		name, _, ok := strings.Cut(entry, "=")
+		if !ok {
+			problems = append(problems, fmt.Sprintf("dropping env entry %q without a value", entry))
+			continue
+		} else if !envName.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("dropping env entry %q with an invalid variable name", entry))
+			continue
+		}
+		if j, ok := last[name]; ok {
+			problems = append(problems, fmt.Sprintf("%s is set several times, keeping its last value", name))
+			valid[j] = false
+		}
+		last[name] = i
+		valid[i] = true
+	}
+
+	for i, entry := range entries {
+		if valid[i] {
+			normalized = append(normalized, entry)
+		}
+	}
+	if _, ok := last["PATH"]; !ok {
+		problems = append(problems, fmt.Sprintf("PATH is not set, setting it to %s", env.DefaultPath))
+		normalized = append(normalized, "PATH="+env.DefaultPath)
+	}
+	return normalized, problems
+}
@@ -0,0 +1,106 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/util/env"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/image"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestNormalizeEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      []string
+		want     []string
+		problems int
+	}{
+		{
+			name: "clean",
+			env:  []string{"PATH=/usr/bin:/bin", "LANG=C.UTF-8"},
+			want: []string{"PATH=/usr/bin:/bin", "LANG=C.UTF-8"},
+		},
+		{
+			name: "messy",
+			env: []string{
+				"LANG=C",
+				"PATH=/bin",
+				"NOVALUE",
+				"1INVALID=x",
+				"BAD-NAME=x",
+				"=empty",
+				"LANG=C.UTF-8",
+				"OPTS=a=b",
+				"PATH=/usr/bin:/bin",
+				"EMPTY=",
+			},
+			want:     []string{"LANG=C.UTF-8", "OPTS=a=b", "PATH=/usr/bin:/bin", "EMPTY="},
+			problems: 6,
+		},
+		{
+			name:     "missing PATH",
+			env:      []string{"HOME=/root"},
+			want:     []string{"HOME=/root", "PATH=" + env.DefaultPath},
+			problems: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, problems := normalizeEnv(tt.env)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected env:\n\thave: %q\n\twant: %q", got, tt.want)
+			}
+			if len(problems) != tt.problems {
+				t.Errorf("unexpected problems: %q", problems)
+			}
+		})
+	}
+}
+
+func TestOCIConveyorPackerNormalizeEnv(t *testing.T) {
+	img := newTestImage(t, func(c *imgspecv1.Image) {
+		c.Config.Env = []string{"A=1", "A=2", "NOVALUE"}
+	}, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	dir := t.TempDir()
+	img.writeLayout(t, dir, "test")
+
+	b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("while creating bundle: %s", err)
+	}
+	t.Cleanup(func() { b.Remove() })
+	b.Recipe, err = sytypes.NewDefinitionFromURI("oci:" + dir + ":test")
+	if err != nil {
+		t.Fatalf("while parsing URI: %s", err)
+	}
+	b.Opts.NoCache = true
+	b.Opts.NormalizeEnv = true
+
+	cp := &OCIConveyorPacker{}
+	if err := cp.Get(context.Background(), b); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := cp.insertOCIConfig(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var config imgspecv1.ImageConfig
+	if err := json.Unmarshal(b.JSONObjects[image.SIFDescOCIConfigJSON], &config); err != nil {
+		t.Fatalf("while decoding config: %s", err)
+	}
+	if want := []string{"A=2", "PATH=" + env.DefaultPath}; !reflect.DeepEqual(config.Env, want) {
+		t.Errorf("unexpected env in the SIF metadata:\n\thave: %q\n\twant: %q", config.Env, want)
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	umocilayer "github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/idtools"
+	"golang.org/x/sys/unix"
+)
+
+// fsExtractor extracts the entries of a layer into a RootfsFS, with the
+// semantics of umoci's TarExtractor. Extended attributes aren't supported,
+// they are dropped with a warning.
+type fsExtractor struct {
+	fsys sytypes.RootfsFS
+	opts umocilayer.MapOptions
+	// upper are the paths written by the layer, which its whiteouts don't
+	// remove
+	upper    map[string]bool
+	warnings *warningRecorder
+}
+
+// newFSExtractor returns an extractor of the entries of a layer into fsys.
+func newFSExtractor(fsys sytypes.RootfsFS, opts umocilayer.MapOptions, warnings *warningRecorder) *fsExtractor {
+	return &fsExtractor{
+		fsys:     fsys,
+		opts:     opts,
+		upper:    make(map[string]bool),
+		warnings: warnings,
+	}
+}
+
+// isNotExistFS returns whether err reports a missing path, or a parent of
+// the path which isn't a directory.
+func isNotExistFS(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// resolve returns the path of the directory dir, with the symlinks of the
+// root filesystem in its components followed within it.
+func (e *fsExtractor) resolve(dir string) string {
+	return resolveEntryPath(dir, func(path string) (string, bool) {
+		fi, err := e.fsys.Lstat(path)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return "", false
+		}
+		link, err := e.fsys.Readlink(path)
+		return link, err == nil
+	})
+}
+
+// unpackEntry extracts the tar entry hdr, with the content r.
+func (e *fsExtractor) unpackEntry(hdr *tar.Header, r io.Reader) (err error) {
+	name := cleanEntryPath(hdr.Name)
+	path := ""
+	if name == "" {
+		if hdr.Typeflag != tar.TypeDir {
+			return errors.New("refusing to change the type of the root directory")
+		}
+	} else {
+		unsafeDir, base := filepath.Split(name)
+		dir := e.resolve(unsafeDir)
+		path = joinEntryPath(dir, base)
+
+		// the times of the parent directory are kept
+		if dirFi, lerr := e.fsys.Lstat(dir); lerr == nil {
+			defer func() {
+				if rerr := e.fsys.Lchtimes(dir, fileAtime(dirFi), dirFi.ModTime()); rerr != nil && err == nil {
+					err = fmt.Errorf("error restoring parent directory times: %s", rerr)
+				}
+			}()
+		}
+
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			return e.whiteout(dir, base)
+		}
+		if err := e.mkdirAll(dir); err != nil {
+			return fmt.Errorf("error creating parent directory: %s", err)
+		}
+	}
+
+	fi, err := e.fsys.Lstat(path)
+	exists := err == nil
+	if exists && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := e.fsys.RemoveAll(path); err != nil {
+			return fmt.Errorf("error removing %s: %s", path, err)
+		}
+		exists = false
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA: //nolint:staticcheck
+		if err := e.writeFile(path, hdr, r); err != nil {
+			return err
+		}
+	case tar.TypeDir:
+		if !exists {
+			if err := e.fsys.Mkdir(path, 0o755); err != nil {
+				return err
+			}
+		}
+	case tar.TypeSymlink:
+		if err := e.fsys.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		unsafeDir, base := filepath.Split(cleanEntryPath(hdr.Linkname))
+		if err := e.fsys.Link(joinEntryPath(e.resolve(unsafeDir), base), path); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if hdr.Typeflag != tar.TypeFifo && e.opts.Rootless {
+			// as umoci does, devices can't be created without privileges
+			sylog.Warningf("Creating an empty file in place of device %s", hdr.Name)
+			if err := e.writeFile(path, &tar.Header{}, nil); err != nil {
+				return err
+			}
+			break
+		}
+		mode := os.ModeNamedPipe
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			mode = os.ModeDevice | os.ModeCharDevice
+		case tar.TypeBlock:
+			mode = os.ModeDevice
+		}
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := e.fsys.Mknod(path, mode|hdr.FileInfo().Mode().Perm(), dev); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown typeflag '\\x%x'", hdr.Typeflag)
+	}
+
+	// a hard link shares the metadata of its target
+	if hdr.Typeflag != tar.TypeLink {
+		if err := e.applyMetadata(path, hdr); err != nil {
+			return err
+		}
+	}
+
+	for p := path; p != ""; p = parentEntryPath(p) {
+		e.upper[p] = true
+	}
+	return nil
+}
+
+// writeFile creates the regular file path with the content r of the entry
+// hdr.
+func (e *fsExtractor) writeFile(path string, hdr *tar.Header, r io.Reader) error {
+	w, err := e.fsys.Create(path, 0o600)
+	if err != nil {
+		return err
+	}
+	var n int64
+	if r != nil {
+		n, err = io.Copy(w, r)
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	} else if n != hdr.Size {
+		return fmt.Errorf("error writing %s: %s", path, io.ErrShortWrite)
+	}
+	return nil
+}
+
+// mkdirAll creates the missing directories of the path dir.
+func (e *fsExtractor) mkdirAll(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	fi, err := e.fsys.Lstat(dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := e.mkdirAll(parentEntryPath(dir)); err != nil {
+		return err
+	}
+	return e.fsys.Mkdir(dir, 0o755)
+}
+
+// applyMetadata restores the ownership, permissions and times of the entry
+// hdr on path.
+func (e *fsExtractor) applyMetadata(path string, hdr *tar.Header) error {
+	if !e.opts.Rootless {
+		uid, err := idtools.ToHost(hdr.Uid, e.opts.UIDMappings)
+		if err != nil {
+			return fmt.Errorf("error mapping uid %d: %s", hdr.Uid, err)
+		}
+		gid, err := idtools.ToHost(hdr.Gid, e.opts.GIDMappings)
+		if err != nil {
+			return fmt.Errorf("error mapping gid %d: %s", hdr.Gid, err)
+		}
+		if err := e.fsys.Lchown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if err := e.fsys.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+
+	if hasXattrRecords(hdr.PAXRecords) {
+		e.warnings.warnf("Dropping the extended attributes of %s, not supported by the rootfs filesystem", hdr.Name)
+	}
+
+	mtime := hdr.ModTime
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = mtime
+	}
+	return e.fsys.Lchtimes(path, atime, mtime)
+}
+
+// hasXattrRecords returns whether the PAX records of a tar entry hold
+// extended attributes.
+func hasXattrRecords(records map[string]string) bool {
+	for k := range records {
+		if strings.HasPrefix(k, "SCHILY.xattr.") {
+			return true
+		}
+	}
+	return false
+}
+
+// whiteout removes the path of the directory dir hidden by the whiteout
+// entry base, from the lower layers.
+func (e *fsExtractor) whiteout(dir, base string) error {
+	opaque := base == whiteoutOpaqueDir
+	target := joinEntryPath(dir, strings.TrimPrefix(base, whiteoutPrefix))
+	if opaque {
+		target = dir
+	}
+	if _, err := e.fsys.Lstat(target); isNotExistFS(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return e.removeLower(target, opaque)
+}
+
+// removeLower removes path and its content, except what was written by the
+// layer. An opaque whiteout keeps the directory itself, with keep.
+func (e *fsExtractor) removeLower(path string, keep bool) error {
+	if !e.upper[path] && !keep {
+		return e.fsys.RemoveAll(path)
+	}
+	fi, err := e.fsys.Lstat(path)
+	if err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return nil
+	}
+	entries, err := e.fsys.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, ent := range entries {
+		if err := e.removeLower(joinEntryPath(path, ent.Name()), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileAtime returns the access time of fi, its modification time when
+// unknown.
+func fileAtime(fi os.FileInfo) time.Time {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return fi.ModTime()
+}
+
+// clampFSMtimes sets the modification time of the files of fsys below
+// path newer than epoch to epoch, as sytypes.ClampMtimes does.
+func clampFSMtimes(fsys sytypes.RootfsFS, path string, epoch time.Time) error {
+	fi, err := fsys.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().After(epoch) {
+		if err := fsys.Lchtimes(path, epoch, epoch); err != nil {
+			return err
+		}
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, ent := range entries {
+		if err := clampFSMtimes(fsys, joinEntryPath(path, ent.Name()), epoch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+)
+
+// newFSExtractTestImage returns an image whose layers hold all of the entry
+// types, on top of the layers of newVerifyTestImage.
+func newFSExtractTestImage(t *testing.T) *testImage {
+	layer := makeLayer(t,
+		tarEntry{name: "dev/null", typeflag: tar.TypeChar, mode: 0o666},
+		tarEntry{name: "run/fifo", typeflag: tar.TypeFifo, mode: 0o600},
+		tarEntry{name: "home/user/file", body: "user", uid: 1000, gid: 1000},
+		tarEntry{name: "usr/bin/su", body: "su", mode: 0o4755},
+		dirEntry("tmp/"),
+		tarEntry{name: "tmp/", typeflag: tar.TypeDir, mode: 0o1777},
+		// a directory replaced by a file, and a file by a directory
+		tarEntry{name: "opt/app", body: "app"},
+		dirEntry("etc/passwd/"),
+		tarEntry{name: "etc/passwd/x", body: "x"},
+	)
+	return newTestImage(t, nil, append(verifyTestLayers(t), layer)...)
+}
+
+// fsTree returns a description of each path of fsys.
+func fsTree(t *testing.T, fsys sytypes.RootfsFS) map[string]string {
+	t.Helper()
+
+	tree := make(map[string]string)
+	var walk func(path string)
+	walk = func(path string) {
+		fi, err := fsys.Lstat(path)
+		if err != nil {
+			t.Fatalf("while reading %s: %s", path, err)
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		desc := fmt.Sprintf("mode=%o uid=%d gid=%d", st.Mode, st.Uid, st.Gid)
+		switch {
+		case fi.IsDir():
+			entries, err := fsys.ReadDir(path)
+			if err != nil {
+				t.Fatalf("while reading %s: %s", path, err)
+			}
+			for _, e := range entries {
+				walk(joinEntryPath(path, e.Name()))
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := fsys.Readlink(path)
+			if err != nil {
+				t.Fatalf("while reading %s: %s", path, err)
+			}
+			desc += " link=" + link
+		case fi.Mode().IsRegular():
+			r, err := fsys.Open(path)
+			if err != nil {
+				t.Fatalf("while opening %s: %s", path, err)
+			}
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("while reading %s: %s", path, err)
+			}
+			desc += fmt.Sprintf(" nlink=%d content=%q", st.Nlink, data)
+		default:
+			desc += fmt.Sprintf(" rdev=%d", st.Rdev)
+		}
+		// the times of the directories depend on the extraction time
+		if !fi.IsDir() {
+			desc += fmt.Sprintf(" mtime=%d", fi.ModTime().Unix())
+		}
+		tree["/"+path] = desc
+	}
+	walk("")
+	return tree
+}
+
+func TestUnpackRootfsFS(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newFSExtractTestImage(t)
+	b, err := unpackTestImage(t, img, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := fsTree(t, sytypes.NewDirFS(b.RootfsPath))
+
+	tests := []struct {
+		name string
+		fsys sytypes.RootfsFS
+	}{
+		{name: "memory", fsys: sytypes.NewMemFS()},
+		{name: "directory", fsys: sytypes.NewDirFS(t.TempDir())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.RootfsFS = tt.fsys
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if _, err := os.Stat(b.RootfsPath + "/etc"); !os.IsNotExist(err) {
+				t.Errorf("rootfs extracted to %s", b.RootfsPath)
+			}
+
+			got := fsTree(t, tt.fsys)
+			if !reflect.DeepEqual(got, want) {
+				for p, w := range want {
+					if g, ok := got[p]; !ok {
+						t.Errorf("%s: missing", p)
+					} else if g != w {
+						t.Errorf("%s: got %s, want %s", p, g, w)
+					}
+				}
+				for p := range got {
+					if _, ok := want[p]; !ok {
+						t.Errorf("%s: not extracted by umoci", p)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsFSUnsupportedOptions(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	_, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+		b.Opts.RootfsFS = sytypes.NewMemFS()
+		b.Opts.SBOM = true
+		b.Opts.FixPerms = true
+	})
+	if err == nil || !strings.Contains(err.Error(), "SBOM, FixPerms not supported") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUnpackRootfsOverlay(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	base := [][]byte{makeLayer(t,
+		dirEntry("etc/"),
+		tarEntry{name: "etc/motd", body: "motd"},
+		tarEntry{name: "etc/removed", body: "removed"},
+		dirEntry("opt/"),
+		dirEntry("opt/dir/"),
+		tarEntry{name: "opt/dir/a", body: "a"},
+		tarEntry{name: "opt/dir/b", body: "b"},
+		dirEntry("srv/"),
+		dirEntry("srv/data/"),
+		tarEntry{name: "srv/data/old", body: "old"},
+		dirEntry("usr/"),
+		dirEntry("usr/bin/"),
+		tarEntry{name: "usr/bin/tool", body: "tool", mode: 0o755},
+	)}
+	layers := [][]byte{
+		makeLayer(t,
+			tarEntry{name: "etc/added", body: "added"},
+			tarEntry{name: "etc/.wh.removed"},
+			tarEntry{name: "opt/dir/.wh..wh..opq"},
+			tarEntry{name: "opt/dir/c", body: "c"},
+			tarEntry{name: "usr/bin/tool", body: "new tool", mode: 0o755},
+			tarEntry{name: "srv/.wh.data"},
+		),
+		// a directory of the lower rootfs removed, then created again
+		makeLayer(t,
+			dirEntry("srv/data/"),
+			tarEntry{name: "srv/data/new", body: "new"},
+		),
+	}
+
+	lowerBundle, err := unpackTestImage(t, newTestImage(t, nil, base...), nil)
+	if err != nil {
+		t.Fatalf("while extracting lower rootfs: %s", err)
+	}
+	lower := lowerBundle.RootfsPath
+	lowerTree := fsTree(t, sytypes.NewDirFS(lower))
+	merged, err := unpackTestImage(t, newTestImage(t, nil, append(base, layers...)...), nil)
+	if err != nil {
+		t.Fatalf("while extracting merged rootfs: %s", err)
+	}
+	want := fsTree(t, sytypes.NewDirFS(merged.RootfsPath))
+
+	upper := t.TempDir() + "/upper"
+	b, err := unpackTestImage(t, newTestImage(t, nil, layers...), func(b *sytypes.Bundle) {
+		b.Opts.LowerDir = lower
+		b.Opts.UpperDir = upper
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := os.Stat(b.RootfsPath + "/etc"); !os.IsNotExist(err) {
+		t.Errorf("rootfs extracted to %s", b.RootfsPath)
+	}
+
+	// the deletions are whiteouts, and the additions are in upper
+	upperTree := fsTree(t, sytypes.NewDirFS(upper))
+	for _, p := range []string{"/etc/removed", "/opt/dir/a", "/opt/dir/b"} {
+		if desc := upperTree[p]; !strings.HasPrefix(desc, "mode=20000 ") || !strings.Contains(desc, " rdev=0 ") {
+			t.Errorf("%s: not a whiteout: %q", p, desc)
+		}
+	}
+	for p, content := range map[string]string{
+		"/etc/added":    "added",
+		"/opt/dir/c":    "c",
+		"/usr/bin/tool": "new tool",
+		"/srv/data/new": "new",
+	} {
+		if !strings.Contains(upperTree[p], fmt.Sprintf("content=%q", content)) {
+			t.Errorf("%s: unexpected upper content: %q", p, upperTree[p])
+		}
+	}
+	for _, p := range []string{"/etc/motd", "/srv/data/old"} {
+		if desc, ok := upperTree[p]; ok {
+			t.Errorf("%s: unexpected in upper: %q", p, desc)
+		}
+	}
+	buf := make([]byte, 1)
+	if n, err := syscall.Getxattr(upper+"/srv/data", sytypes.OverlayOpaqueXattr, buf); err != nil || n != 1 || buf[0] != 'y' {
+		t.Errorf("srv/data is not opaque: %v", err)
+	}
+
+	// the lower rootfs is unchanged, and merged with upper it is the
+	// rootfs of all of the layers
+	if got := fsTree(t, sytypes.NewDirFS(lower)); !reflect.DeepEqual(got, lowerTree) {
+		t.Errorf("lower rootfs modified")
+	}
+	got := fsTree(t, sytypes.NewOverlayFS(lower, upper))
+	for p, w := range want {
+		if g, ok := got[p]; !ok {
+			t.Errorf("%s: missing from the overlay", p)
+		} else if g != w {
+			t.Errorf("%s: got %s, want %s", p, g, w)
+		}
+	}
+	for p := range got {
+		if _, ok := want[p]; !ok {
+			t.Errorf("%s: unexpected in the overlay", p)
+		}
+	}
+
+	if _, err := unpackTestImage(t, newTestImage(t, nil, layers...), func(b *sytypes.Bundle) {
+		b.Opts.UpperDir = upper
+	}); err == nil || !strings.Contains(err.Error(), "requires both an upper and a lower directory") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
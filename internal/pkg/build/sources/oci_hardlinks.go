@@ -0,0 +1,219 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	securejoin "github.com/cyphar/filepath-securejoin"
+)
+
+// hardlinkResolver applies the policy of Options.DanglingHardlinks to the
+// hard links of a layer whose target isn't extracted, because it was dropped
+// from the layer by the filters of the unpacker, or doesn't exist.
+type hardlinkResolver struct {
+	policy string
+	// tmpDir is the directory the spool directory is created in
+	tmpDir string
+	// spoolDir holds the content of the regular files dropped from the
+	// layer with the copy policy, created when first needed
+	spoolDir string
+	// dropped maps the entries dropped from the layer, by their cleaned
+	// name in the layer
+	dropped  map[string]*droppedEntry
+	warnings *warningRecorder
+}
+
+// droppedEntry is an entry dropped from a layer.
+type droppedEntry struct {
+	hdr *tar.Header
+	// spooled is the path of the copy of the content of a regular file,
+	// empty for the other entries
+	spooled string
+}
+
+// newHardlinkResolver returns a resolver for the policy, spooling the
+// content of the dropped files into tmpDir, or nil for the default policy.
+func newHardlinkResolver(policy, tmpDir string, warnings *warningRecorder) (*hardlinkResolver, error) {
+	switch policy {
+	case "":
+		return nil, nil
+	case sytypes.DanglingHardlinkCopy, sytypes.DanglingHardlinkSkip, sytypes.DanglingHardlinkError:
+	default:
+		return nil, fmt.Errorf("invalid policy %q for dangling hard links, should be %s, %s or %s", policy,
+			sytypes.DanglingHardlinkCopy, sytypes.DanglingHardlinkSkip, sytypes.DanglingHardlinkError)
+	}
+	return &hardlinkResolver{
+		policy:   policy,
+		tmpDir:   tmpDir,
+		dropped:  make(map[string]*droppedEntry),
+		warnings: warnings,
+	}, nil
+}
+
+// reset forgets the entries dropped from the previous layer.
+func (r *hardlinkResolver) reset() {
+	for path := range r.dropped {
+		r.forget(path)
+	}
+}
+
+// close removes the spooled content.
+func (r *hardlinkResolver) close() error {
+	r.reset()
+	if r.spoolDir == "" {
+		return nil
+	}
+	return os.RemoveAll(r.spoolDir)
+}
+
+func (r *hardlinkResolver) forget(path string) {
+	if d, ok := r.dropped[path]; ok {
+		if d.spooled != "" {
+			os.Remove(d.spooled)
+		}
+		delete(r.dropped, path)
+	}
+}
+
+// drop records the entry hdr dropped from the layer, and the content of a
+// regular file with the copy policy, when not nil.
+func (r *hardlinkResolver) drop(hdr *tar.Header, content io.Reader) error {
+	path := cleanEntryPath(hdr.Name)
+	r.forget(path)
+	d := &droppedEntry{hdr: hdr}
+	if content != nil && r.policy == sytypes.DanglingHardlinkCopy && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) { //nolint:staticcheck
+		if r.spoolDir == "" {
+			dir, err := os.MkdirTemp(r.tmpDir, "hardlinks-")
+			if err != nil {
+				return fmt.Errorf("error creating hard link spool directory: %s", err)
+			}
+			r.spoolDir = dir
+		}
+		f, err := os.CreateTemp(r.spoolDir, "entry-")
+		if err != nil {
+			return fmt.Errorf("error spooling %s: %s", hdr.Name, err)
+		}
+		d.spooled = f.Name()
+		_, err = io.Copy(f, content)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(d.spooled)
+			return fmt.Errorf("error spooling %s: %s", hdr.Name, err)
+		}
+	}
+	r.dropped[path] = d
+	return nil
+}
+
+// resolve returns the entry extracted in place of hdr, the entry orig of
+// the layer as transformed by the filters, and the reader of its content,
+// nil to read it from the layer. A hard link whose target was dropped, or
+// doesn't exist according to exists, is handled with the policy: it is
+// returned as a copy of its target, transformed by filter, with the copy
+// policy, or nil with the skip policy. The copy policy fails when the
+// target isn't a regular file dropped from the layer.
+func (r *hardlinkResolver) resolve(orig, hdr *tar.Header, exists func(path string) bool, filter func(*tar.Header) (*tar.Header, error)) (*tar.Header, io.ReadCloser, error) {
+	if hdr.Typeflag != tar.TypeLink {
+		// an entry replacing a dropped one is a valid target again
+		r.forget(cleanEntryPath(orig.Name))
+		return hdr, nil, nil
+	}
+	target, dropped := r.dropped[cleanEntryPath(orig.Linkname)]
+	if !dropped && exists(cleanEntryPath(hdr.Linkname)) {
+		r.forget(cleanEntryPath(orig.Name))
+		return hdr, nil, nil
+	}
+
+	switch r.policy {
+	case sytypes.DanglingHardlinkSkip:
+		r.warnings.warnf("Skipping hard link %s: target %s is not extracted", orig.Name, orig.Linkname)
+		return nil, nil, nil
+	case sytypes.DanglingHardlinkCopy:
+		if !dropped || target.spooled == "" {
+			break
+		}
+		sylog.Debugf("Extracting hard link %s as a copy of %s", orig.Name, orig.Linkname)
+		copied := *target.hdr
+		copied.Name = orig.Name
+		hdr, err := filter(&copied)
+		if err != nil || hdr == nil {
+			return nil, nil, err
+		}
+		r.forget(cleanEntryPath(orig.Name))
+		f, err := os.Open(target.spooled)
+		if err != nil {
+			return nil, nil, &entryError{name: orig.Name, err: err}
+		}
+		return hdr, f, nil
+	}
+	return nil, nil, &entryError{name: orig.Name, err: fmt.Errorf("hard link target %s is not extracted", orig.Linkname)}
+}
+
+// filterLinkedEntry returns the tar entry hdr as transformed by
+// filterEntry, with the oversized files and the dangling hard links handled
+// by u, and the reader of its content, nil to read it from the layer.
+// exists reports whether a path is found in the rootfs.
+func (u *rootfsUnpacker) filterLinkedEntry(hdr *tar.Header, content io.Reader, exists func(path string) bool) (*tar.Header, io.ReadCloser, error) {
+	orig := *hdr
+	hdr, err := u.filterEntry(hdr)
+	if err != nil {
+		return nil, nil, err
+	} else if hdr == nil {
+		if u.links == nil {
+			return nil, nil, nil
+		} else if u.oversized(&orig) {
+			// the content of an oversized file is never spooled
+			content = nil
+		}
+		return nil, nil, u.links.drop(&orig, content)
+	}
+
+	if u.oversized(hdr) {
+		if !u.skipOversized {
+			return nil, nil, &entryError{name: hdr.Name, err: fmt.Errorf("%w of %d bytes set for the build: %d bytes", errFileTooLarge, u.maxFileSize, hdr.Size)}
+		}
+		u.warnings.warnf("Skipping %s: its %d bytes exceed the maximum file size of %d bytes", hdr.Name, hdr.Size, u.maxFileSize)
+		if u.links != nil {
+			return nil, nil, u.links.drop(&orig, nil)
+		}
+		return nil, nil, nil
+	}
+	if u.links == nil {
+		return hdr, nil, nil
+	}
+	return u.links.resolve(&orig, hdr, exists, u.filterEntry)
+}
+
+// oversized reports whether the tar entry hdr is a regular file larger than
+// the maximum file size of u. The tar reader never returns more content
+// than the size of the entry.
+func (u *rootfsUnpacker) oversized(hdr *tar.Header) bool {
+	return u.maxFileSize > 0 && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) && hdr.Size > u.maxFileSize //nolint:staticcheck
+}
+
+// rootfsExists reports whether the path of the rootfs exists, its parents
+// being resolved within the rootfs.
+func rootfsExists(rootfs, path string) bool {
+	dir, base := filepath.Split(path)
+	parent, err := securejoin.SecureJoin(rootfs, dir)
+	if err != nil {
+		return false
+	}
+	_, err = os.Lstat(filepath.Join(parent, base))
+	return err == nil
+}
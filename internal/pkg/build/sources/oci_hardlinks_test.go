@@ -0,0 +1,105 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+)
+
+func TestUnpackRootfsDanglingHardlinks(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t,
+		dirEntry("opt/"),
+		dirEntry("opt/myapp/"),
+		tarEntry{name: "opt/myapp/bin.orig", body: "bin", mode: 0o750},
+		tarEntry{name: "opt/myapp/bin", typeflag: tar.TypeLink, linkname: "opt/myapp/bin.orig"},
+		tarEntry{name: "opt/myapp/other", body: "other"},
+	))
+	// the target of the hard link is excluded
+	exclude := []sytypes.TarFilter{
+		sytypes.NewDropTarFilter(func(name string) bool { return strings.HasSuffix(name, ".orig") }),
+	}
+
+	tests := []struct {
+		name     string
+		policy   string
+		include  []string
+		wantErr  string
+		wantLink bool
+	}{
+		{name: "default", wantErr: "error extracting opt/myapp/bin"},
+		{name: "error", policy: sytypes.DanglingHardlinkError, wantErr: "hard link target opt/myapp/bin.orig is not extracted"},
+		{name: "skip", policy: sytypes.DanglingHardlinkSkip},
+		{name: "copy", policy: sytypes.DanglingHardlinkCopy, wantLink: true},
+		{name: "default include", include: []string{"opt/myapp/bin", "opt/myapp/other"}},
+		{name: "copy include", policy: sytypes.DanglingHardlinkCopy, include: []string{"opt/myapp/bin", "opt/myapp/other"}, wantLink: true},
+		{name: "invalid", policy: "link", wantErr: `invalid policy "link" for dangling hard links`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.DanglingHardlinks = tt.policy
+				if tt.include != nil {
+					b.Opts.IncludePaths = tt.include
+				} else {
+					b.Opts.TarFilters = exclude
+				}
+				b.Opts.VerifyRootfs = tt.wantErr == ""
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			assertPaths(t, b.RootfsPath, map[string]bool{
+				"opt/myapp/bin.orig": false,
+				"opt/myapp/bin":      tt.wantLink,
+				"opt/myapp/other":    true,
+			})
+			if !tt.wantLink {
+				return
+			}
+			// the copy has the content and metadata of the target
+			path := filepath.Join(b.RootfsPath, "opt/myapp/bin")
+			fi, err := os.Lstat(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if fi.Mode() != 0o750 {
+				t.Errorf("unexpected mode %s", fi.Mode())
+			}
+			data, err := os.ReadFile(path)
+			if err != nil || string(data) != "bin" {
+				t.Errorf("unexpected content %q: %v", data, err)
+			}
+			// the spooled content is removed
+			entries, err := os.ReadDir(b.TmpDir)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), "hardlinks-") {
+					t.Errorf("spool directory %s left behind", e.Name())
+				}
+			}
+		})
+	}
+}
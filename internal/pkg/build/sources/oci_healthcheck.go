@@ -0,0 +1,77 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apptainer/apptainer/internal/pkg/util/shell"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/containers/image/v5/manifest"
+)
+
+// parseHealthcheck returns the healthcheck of the image config configData,
+// the HEALTHCHECK instruction of a Dockerfile recorded in the docker image
+// configs, and in the OCI ones of some tools although not part of the OCI
+// image spec. It returns nil when the config has no healthcheck.
+func parseHealthcheck(configData []byte) (*manifest.Schema2HealthConfig, error) {
+	var config struct {
+		Config struct {
+			Healthcheck *manifest.Schema2HealthConfig `json:"Healthcheck"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("while decoding image config: %s", err)
+	}
+	return config.Config.Healthcheck, nil
+}
+
+// healthcheckScript returns the test script running the test of the
+// healthcheck hc once, or false when hc has no test, or disables the
+// healthcheck inherited from a base image. The interval, timeout and
+// retries of the healthcheck, for the checks of a running container, don't
+// apply to a test.
+func healthcheckScript(hc *manifest.Schema2HealthConfig) (string, bool, error) {
+	if hc == nil || len(hc.Test) == 0 {
+		return "", false, nil
+	}
+	switch hc.Test[0] {
+	case "NONE":
+		return "", false, nil
+	case "CMD":
+		if len(hc.Test) < 2 {
+			return "", false, fmt.Errorf("healthcheck CMD without command")
+		}
+		return "#!/bin/sh\n\nexec " + shell.ArgsQuoted(hc.Test[1:]) + "\n", true, nil
+	case "CMD-SHELL":
+		if len(hc.Test) != 2 {
+			return "", false, fmt.Errorf("healthcheck CMD-SHELL takes a single command, got %d", len(hc.Test)-1)
+		}
+		return "#!/bin/sh\n\n" + hc.Test[1] + "\n", true, nil
+	default:
+		return "", false, fmt.Errorf("unsupported healthcheck test type %q", hc.Test[0])
+	}
+}
+
+// insertHealthcheck writes the healthcheck of the source image as the test
+// script of the container, run by apptainer test. A %test section of the
+// definition replaces it afterwards.
+func (cp *OCIConveyorPacker) insertHealthcheck() error {
+	script, ok, err := healthcheckScript(cp.healthcheck)
+	if err != nil || !ok {
+		return err
+	}
+	sylog.Infof("Adding the image healthcheck as testscript")
+	sylog.Debugf("Healthcheck test: %s", strings.Join(cp.healthcheck.Test, " "))
+	return os.WriteFile(filepath.Join(cp.b.RootfsPath, ".singularity.d", "test"), []byte(script), 0o755)
+}
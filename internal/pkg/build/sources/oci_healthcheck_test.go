@@ -0,0 +1,143 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/containers/image/v5/manifest"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestHealthcheckScript(t *testing.T) {
+	tests := []struct {
+		name      string
+		test      []string
+		want      string
+		wantError bool
+	}{
+		{name: "inherit"},
+		{name: "none", test: []string{"NONE"}},
+		{name: "cmd", test: []string{"CMD", "/bin/check", "--url", "http://localhost/$path"}, want: "exec \"/bin/check\" \"--url\" \"http://localhost/\\$path\"\n"},
+		{name: "cmd shell", test: []string{"CMD-SHELL", "curl -f http://localhost/ || exit 1"}, want: "curl -f http://localhost/ || exit 1\n"},
+		{name: "cmd without command", test: []string{"CMD"}, wantError: true},
+		{name: "unknown", test: []string{"HTTP", "/health"}, wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, ok, err := healthcheckScript(&manifest.Schema2HealthConfig{Test: tt.test})
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("unexpected success")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if ok != (tt.want != "") {
+				t.Fatalf("unexpected script presence %v", ok)
+			}
+			if ok && script != "#!/bin/sh\n\n"+tt.want {
+				t.Errorf("unexpected script %q", script)
+			}
+		})
+	}
+}
+
+func TestInsertHealthcheck(t *testing.T) {
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	img.dockerSchema2(t)
+
+	// the healthcheck is only part of the docker image configs
+	var config map[string]interface{}
+	if err := json.Unmarshal(img.configData, &config); err != nil {
+		t.Fatal(err)
+	}
+	config["config"].(map[string]interface{})["Healthcheck"] = map[string]interface{}{
+		"Test":     []string{"CMD-SHELL", `test -f "$MARKER" && echo healthy`},
+		"Interval": 30000000000,
+		"Retries":  3,
+	}
+	configData, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.configData = configData
+	img.blobs[digest.FromBytes(configData)] = configData
+	img.manifest.Config.Digest = digest.FromBytes(configData)
+	img.manifest.Config.Size = int64(len(configData))
+	if img.manifestData, err = json.Marshal(img.manifest); err != nil {
+		t.Fatal(err)
+	}
+	img.manifestDigest = digest.FromBytes(img.manifestData)
+
+	dir := t.TempDir()
+	img.writeLayout(t, dir, "tmp")
+	ref, err := ocilayout.ParseReference(dir)
+	if err != nil {
+		t.Fatalf("while parsing layout reference: %s", err)
+	}
+	b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("while creating bundle: %s", err)
+	}
+	t.Cleanup(func() { b.Remove() })
+	if err := os.MkdirAll(filepath.Join(b.RootfsPath, ".singularity.d"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	cp := &OCIConveyorPacker{b: b, srcRef: ref, sysCtx: stubSysCtx()}
+	_, blob, err := cp.getConfig(context.Background())
+	if err != nil {
+		t.Fatalf("while getting config: %s", err)
+	}
+	if cp.healthcheck, err = parseHealthcheck(blob); err != nil {
+		t.Fatalf("while getting healthcheck: %s", err)
+	}
+	if cp.healthcheck == nil || cp.healthcheck.Retries != 3 {
+		t.Fatalf("unexpected healthcheck %+v", cp.healthcheck)
+	}
+	if err := cp.insertHealthcheck(); err != nil {
+		t.Fatalf("while inserting healthcheck: %s", err)
+	}
+
+	// the test script runs the healthcheck
+	testScript := filepath.Join(b.RootfsPath, ".singularity.d", "test")
+	marker := filepath.Join(t.TempDir(), "marker")
+	run := func() (string, error) {
+		cmd := exec.Command(testScript)
+		cmd.Env = append(os.Environ(), "MARKER="+marker)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	if out, err := run(); err == nil {
+		t.Errorf("unexpected success of an unhealthy check: %q", out)
+	}
+	if err := os.WriteFile(marker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run(); err != nil || strings.TrimSpace(out) != "healthy" {
+		t.Errorf("unexpected result of a healthy check: %q (%v)", out, err)
+	}
+
+	// an image without healthcheck has no test script
+	plain := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	hc, err := parseHealthcheck(plain.configData)
+	if err != nil || hc != nil {
+		t.Errorf("unexpected healthcheck %+v (err=%v)", hc, err)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/image"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// recordLayerHistory stores the history of the config of the image of the
+// source src, correlated to the layers of its manifest, in the image
+// metadata. A history not matching the layers is only warned about.
+func recordLayerHistory(ctx context.Context, b *sytypes.Bundle, src types.ImageSource, manifest imgspecv1.Manifest, warnings *warningRecorder) error {
+	configData, err := fetchConfigBlob(ctx, src, manifest.Config)
+	if err != nil {
+		return err
+	}
+	var config imgspecv1.Image
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return fmt.Errorf("error decoding image config: %s", err)
+	}
+
+	layers := make([]digest.Digest, 0, len(manifest.Layers))
+	for _, l := range manifest.Layers {
+		layers = append(layers, l.Digest)
+	}
+	history, err := sytypes.NewLayerHistory(config.History, layers)
+	if err != nil {
+		warnings.warnf("Not recording the layer history: %s", err)
+		return nil
+	}
+
+	if b.Opts.SandboxTarget {
+		sylog.Warningf("The layer history is only recorded in SIF images")
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		return fmt.Errorf("error encoding layer history: %s", err)
+	}
+	b.JSONObjects[image.SIFDescLayerHistoryJSON] = data
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/image"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestUnpackRootfsLayerHistory(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	created := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	history := []imgspecv1.History{
+		{Created: &created, CreatedBy: "/bin/sh -c #(nop) ADD file:base in /", Author: "base"},
+		{CreatedBy: "/bin/sh -c #(nop) ENV PATH=/usr/bin", EmptyLayer: true},
+		{CreatedBy: "/bin/sh -c make install", Comment: "buildkit.dockerfile.v0"},
+		{CreatedBy: "/bin/sh -c #(nop) CMD [\"sh\"]", EmptyLayer: true},
+	}
+	img := newTestImage(t, func(c *imgspecv1.Image) {
+		c.History = history
+	}, makeLayer(t, tarEntry{name: "base", body: "base"}), makeLayer(t, tarEntry{name: "app", body: "app"}))
+
+	tests := []struct {
+		name    string
+		enabled bool
+	}{
+		{name: "disabled"},
+		{name: "enabled", enabled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.LayerHistory = tt.enabled
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			data, ok := b.JSONObjects[image.SIFDescLayerHistoryJSON]
+			if ok != tt.enabled {
+				t.Fatalf("unexpected presence of the layer history: %v", ok)
+			} else if !ok {
+				return
+			}
+
+			h, err := sytypes.ParseLayerHistory(data)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(h) != len(history) {
+				t.Fatalf("unexpected history %+v", h)
+			}
+			// the empty layers are skipped when correlating the layers
+			layers := []int{0, -1, 1, -1}
+			for i, e := range h {
+				want := history[i]
+				if layers[i] < 0 {
+					if e.Layer != "" || !e.EmptyLayer {
+						t.Errorf("entry %d: unexpected layer %s", i, e.Layer)
+					}
+				} else if e.Layer != img.manifest.Layers[layers[i]].Digest {
+					t.Errorf("entry %d: unexpected layer %s, want %s", i, e.Layer, img.manifest.Layers[layers[i]].Digest)
+				}
+				if e.CreatedBy != want.CreatedBy || e.Author != want.Author || e.Comment != want.Comment {
+					t.Errorf("entry %d: unexpected entry %+v", i, e)
+				}
+			}
+			if h[0].Created == nil || !h[0].Created.Equal(created) {
+				t.Errorf("unexpected creation time %v", h[0].Created)
+			}
+		})
+	}
+}
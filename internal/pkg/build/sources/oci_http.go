@@ -0,0 +1,359 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/containers/image/v5/manifest"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/types"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxLayoutFileSize limits the size of the layout files and manifests read
+// in memory.
+const maxLayoutFileSize = 4 << 20
+
+// errLayoutFileNotFound is returned when a file of the layout is missing on
+// the server.
+var errLayoutFileNotFound = errors.New("not found")
+
+// fetchHTTPLayout copies the image of the OCI layout served over HTTP(S) at
+// the oci-http reference ref into the layout directory dir, and returns a
+// reference to the local copy.
+func fetchHTTPLayout(ctx context.Context, ref, dir string, sysCtx *types.SystemContext, noHTTPS bool, limiter *rateLimiter) (types.ImageReference, error) {
+	base, tag, err := parseHTTPLayoutReference(ref, noHTTPS)
+	if err != nil {
+		return nil, err
+	}
+	// the clients are pooled per server, the layouts are fetched without
+	// credentials
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	client, err := registryClients.borrow(u.Scheme+"://"+u.Host, nil, false, sysCtx.DockerCertPath)
+	if err != nil {
+		return nil, err
+	}
+	defer client.release()
+
+	f := &httpLayoutFetcher{
+		client:    client.Client,
+		base:      base,
+		userAgent: sysCtx.DockerRegistryUserAgent,
+		limiter:   limiter,
+	}
+	if err := f.fetch(ctx, dir, tag, sysCtx); err != nil {
+		return nil, err
+	}
+	return ocilayout.ParseReference(dir)
+}
+
+// parseHTTPLayoutReference splits the oci-http reference ref, of the form
+// [http[s]://]host/path[:tag], into the base URL of the layout and the tag
+// of the image. The scheme defaults to https, or http with noHTTPS.
+func parseHTTPLayoutReference(ref string, noHTTPS bool) (base, tag string, err error) {
+	scheme := "https"
+	if noHTTPS {
+		scheme = "http"
+	}
+	if s, rest, ok := strings.Cut(ref, "://"); ok {
+		if s != "http" && s != "https" {
+			return "", "", fmt.Errorf("unsupported scheme %q in %s", s, ref)
+		}
+		scheme, ref = s, rest
+	}
+	ref = strings.TrimPrefix(ref, "//")
+
+	host, path, _ := strings.Cut(ref, "/")
+	if host == "" {
+		return "", "", fmt.Errorf("no host in oci-http reference %s", ref)
+	}
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		path, tag = path[:i], path[i+1:]
+	}
+
+	u := url.URL{Scheme: scheme, Host: host, Path: "/" + strings.Trim(path, "/")}
+	return strings.TrimSuffix(u.String(), "/"), tag, nil
+}
+
+// httpLayoutFetcher copies an image from an OCI layout served by a plain
+// HTTP(S) file server, without any registry API.
+type httpLayoutFetcher struct {
+	client    *http.Client
+	base      string
+	userAgent string
+	// limiter limits the download rate when not nil
+	limiter *rateLimiter
+}
+
+// fetch copies the image tagged tag, or the only image of the layout when
+// tag is empty, into the layout directory dir. An image index is resolved
+// to the image matching the platform of sysCtx.
+func (f *httpLayoutFetcher) fetch(ctx context.Context, dir, tag string, sysCtx *types.SystemContext) error {
+	data, err := f.getFile(ctx, imgspecv1.ImageLayoutFile)
+	if errors.Is(err, errLayoutFileNotFound) {
+		return fmt.Errorf("no OCI layout at %s: %w", f.base, err)
+	} else if err != nil {
+		return err
+	}
+	var layout imgspecv1.ImageLayout
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return fmt.Errorf("while decoding %s: %w", imgspecv1.ImageLayoutFile, err)
+	}
+	if layout.Version != imgspecv1.ImageLayoutVersion {
+		return fmt.Errorf("unsupported OCI layout version %q at %s", layout.Version, f.base)
+	}
+
+	data, err = f.getFile(ctx, imgspecv1.ImageIndexFile)
+	if err != nil {
+		return err
+	}
+	var index imgspecv1.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("while decoding %s: %w", imgspecv1.ImageIndexFile, err)
+	}
+	desc, err := selectLayoutManifest(index, tag)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.base, err)
+	}
+
+	if desc.MediaType == imgspecv1.MediaTypeImageIndex {
+		data, err := f.fetchMetadataBlob(ctx, dir, desc)
+		if err != nil {
+			return err
+		}
+		list, err := manifest.OCI1IndexFromManifest(data)
+		if err != nil {
+			return fmt.Errorf("while decoding image index %s: %w", desc.Digest, err)
+		}
+		d, err := selectPlatformInstance(list, wantedPlatform(sysCtx))
+		if err != nil {
+			return fmt.Errorf("while choosing image in index %s: %w", desc.Digest, err)
+		}
+		for _, m := range list.Manifests {
+			if m.Digest == d {
+				desc = m
+				break
+			}
+		}
+	}
+	if desc.MediaType != imgspecv1.MediaTypeImageManifest {
+		return fmt.Errorf("unsupported manifest media type %s", desc.MediaType)
+	}
+
+	data, err = f.fetchMetadataBlob(ctx, dir, desc)
+	if err != nil {
+		return err
+	}
+	var m imgspecv1.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("while decoding manifest %s: %w", desc.Digest, err)
+	}
+	for _, blob := range append([]imgspecv1.Descriptor{m.Config}, m.Layers...) {
+		if err := f.fetchBlob(ctx, dir, blob); err != nil {
+			return err
+		}
+	}
+
+	// the local layout only holds the fetched image
+	return writeLayoutIndex(dir, desc)
+}
+
+// writeLayoutIndex writes the layout files of the layout directory dir,
+// holding the blobs of the image whose manifest is described by desc.
+func writeLayoutIndex(dir string, desc imgspecv1.Descriptor) error {
+	data, err := json.Marshal(imgspecv1.ImageLayout{Version: imgspecv1.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, imgspecv1.ImageLayoutFile), data, 0o644); err != nil {
+		return err
+	}
+	data, err = json.Marshal(imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{desc},
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, imgspecv1.ImageIndexFile), data, 0o644)
+}
+
+// selectLayoutManifest returns the descriptor of index tagged tag, or its
+// only descriptor when tag is empty.
+func selectLayoutManifest(index imgspecv1.Index, tag string) (imgspecv1.Descriptor, error) {
+	if tag == "" {
+		if len(index.Manifests) != 1 {
+			return imgspecv1.Descriptor{}, fmt.Errorf("layout holds %d images, a tag must be specified", len(index.Manifests))
+		}
+		return index.Manifests[0], nil
+	}
+	for _, desc := range index.Manifests {
+		if desc.Annotations[imgspecv1.AnnotationRefName] == tag {
+			return desc, nil
+		}
+	}
+	return imgspecv1.Descriptor{}, fmt.Errorf("no image tagged %s in layout", tag)
+}
+
+// fetchMetadataBlob fetches the blob described by desc into the layout
+// directory dir, and returns its content.
+func (f *httpLayoutFetcher) fetchMetadataBlob(ctx context.Context, dir string, desc imgspecv1.Descriptor) ([]byte, error) {
+	if desc.Size > maxLayoutFileSize {
+		return nil, fmt.Errorf("manifest %s is too large: %d bytes", desc.Digest, desc.Size)
+	}
+	if err := f.fetchBlob(ctx, dir, desc); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(dir, imgspecv1.ImageBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+}
+
+// fetchBlob fetches the blob described by desc into the layout directory
+// dir. An interrupted download is resumed from the bytes already received
+// with a range request, and the digest is checked once complete.
+func (f *httpLayoutFetcher) fetchBlob(ctx context.Context, dir string, desc imgspecv1.Descriptor) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid blob digest %s: %w", desc.Digest, err)
+	}
+	path := imgspecv1.ImageBlobsDir + "/" + desc.Digest.Algorithm().String() + "/" + desc.Digest.Encoded()
+	dst := filepath.Join(dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("while creating blob directory: %w", err)
+	}
+
+	partial := dst + partialSuffix
+	file, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+	for attempt := 1; attempt <= chunkRetries; attempt++ {
+		offset, err = f.fetchFrom(ctx, file, path, offset, desc.Size)
+		if err == nil || errors.Is(err, errLayoutFileNotFound) || ctx.Err() != nil {
+			break
+		}
+		sylog.Debugf("Resuming download of blob %s at %d/%d bytes: %s", desc.Digest, offset, desc.Size, err)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("while fetching blob %s: %w", desc.Digest, err)
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := checkBlobDigest(partial, desc.Digest); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, dst)
+}
+
+// fetchFrom writes the content of the layout file at path, from offset up
+// to size, to file at the same offset. It returns the number of bytes of
+// the file received so far. When the server ignores the range request, the
+// file is received again from the beginning.
+func (f *httpLayoutFetcher) fetchFrom(ctx context.Context, file *os.File, path string, offset, size int64) (int64, error) {
+	resp, err := f.get(ctx, path, offset)
+	if err != nil {
+		return offset, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		offset = 0
+		if err := file.Truncate(0); err != nil {
+			return 0, err
+		}
+	case http.StatusPartialContent:
+		if want := fmt.Sprintf("bytes %d-", offset); !strings.HasPrefix(resp.Header.Get("Content-Range"), want) {
+			return offset, fmt.Errorf("unexpected content range %q", resp.Header.Get("Content-Range"))
+		}
+	default:
+		return offset, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	n, err := io.Copy(file, io.LimitReader(f.limiter.reader(ctx, resp.Body), size-offset))
+	offset += n
+	if err != nil {
+		return offset, err
+	}
+	if offset != size {
+		return offset, io.ErrUnexpectedEOF
+	}
+	return offset, nil
+}
+
+// getFile returns the content of the small layout file at path.
+func (f *httpLayoutFetcher) getFile(ctx context.Context, path string) ([]byte, error) {
+	resp, err := f.get(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("while fetching %s: unexpected status %s", path, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(f.limiter.reader(ctx, resp.Body), maxLayoutFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("while fetching %s: %w", path, err)
+	}
+	if len(data) > maxLayoutFileSize {
+		return nil, fmt.Errorf("%s is too large", path)
+	}
+	return data, nil
+}
+
+// get requests the layout file at path, from offset. A missing file is
+// reported as errLayoutFileNotFound.
+func (f *httpLayoutFetcher) get(ctx context.Context, path string, offset int64) (*http.Response, error) {
+	u := f.base + "/" + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	if f.userAgent != "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", u, errLayoutFileNotFound)
+	}
+	return resp, nil
+}
@@ -0,0 +1,264 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParseHTTPLayoutReference(t *testing.T) {
+	tests := []struct {
+		ref      string
+		noHTTPS  bool
+		wantBase string
+		wantTag  string
+		wantErr  bool
+	}{
+		{ref: "example.com/layouts/alpine:3.18", wantBase: "https://example.com/layouts/alpine", wantTag: "3.18"},
+		{ref: "//example.com/layouts/alpine", wantBase: "https://example.com/layouts/alpine"},
+		{ref: "example.com:8080/alpine:latest", noHTTPS: true, wantBase: "http://example.com:8080/alpine", wantTag: "latest"},
+		{ref: "http://example.com/alpine/", wantBase: "http://example.com/alpine"},
+		{ref: "https://example.com:8443/alpine:v1", noHTTPS: true, wantBase: "https://example.com:8443/alpine", wantTag: "v1"},
+		{ref: "example.com", wantBase: "https://example.com"},
+		{ref: "ftp://example.com/alpine", wantErr: true},
+		{ref: "/alpine", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			base, tag, err := parseHTTPLayoutReference(tt.ref, tt.noHTTPS)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("unexpected success: %s %s", base, tag)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if base != tt.wantBase || tag != tt.wantTag {
+				t.Errorf("got %s %q, want %s %q", base, tag, tt.wantBase, tt.wantTag)
+			}
+		})
+	}
+}
+
+// serveTestLayout writes the images as a single OCI layout, tagged with the
+// keys of images, and serves it under /layout.
+func serveTestLayout(t *testing.T, images map[string]*testImage) (string, *httptest.Server) {
+	t.Helper()
+
+	dir := t.TempDir()
+	index := imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+	}
+	for tag, img := range images {
+		img.writeLayout(t, dir, tag)
+		index.Manifests = append(index.Manifests, imgspecv1.Descriptor{
+			MediaType:   img.manifest.MediaType,
+			Digest:      img.manifestDigest,
+			Size:        int64(len(img.manifestData)),
+			Annotations: map[string]string{imgspecv1.AnnotationRefName: tag},
+		})
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("while encoding index: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), data, 0o644); err != nil {
+		t.Fatalf("while writing index: %s", err)
+	}
+
+	srv := httptest.NewServer(http.StripPrefix("/layout", http.FileServer(http.Dir(dir))))
+	t.Cleanup(srv.Close)
+	return dir, srv
+}
+
+func TestHTTPLayoutFetcher(t *testing.T) {
+	body := make([]byte, 64<<10)
+	if _, err := rand.Read(body); err != nil {
+		t.Fatalf("while generating layer content: %s", err)
+	}
+	v1 := newTestImage(t, nil, makeLayer(t, tarEntry{name: "large", body: string(body)}))
+	v2 := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "v2"}))
+	layer := v1.manifest.Layers[0]
+	blobPath := "/layout/blobs/sha256/" + layer.Digest.Encoded()
+
+	tests := []struct {
+		name string
+		path string
+		tag  string
+		// interrupt aborts the first download of the v1 layer halfway
+		interrupt bool
+		// noRange makes the server ignore range requests
+		noRange bool
+		// removeBlob removes the v1 layer from the served layout
+		removeBlob bool
+		wantRange  bool
+		wantErr    string
+	}{
+		{name: "tag", path: "/layout", tag: "v1"},
+		{name: "other tag", path: "/layout", tag: "v2"},
+		{name: "interrupted blob", path: "/layout", tag: "v1", interrupt: true, wantRange: true},
+		{name: "range unsupported", path: "/layout", tag: "v1", interrupt: true, noRange: true, wantRange: true},
+		{name: "no tag", path: "/layout", wantErr: "a tag must be specified"},
+		{name: "unknown tag", path: "/layout", tag: "v3", wantErr: "no image tagged v3"},
+		{name: "no layout", path: "/other", tag: "v1", wantErr: "no OCI layout"},
+		{name: "missing blob", path: "/layout", tag: "v1", removeBlob: true, wantErr: "not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			images := map[string]*testImage{"v1": v1, "v2": v2}
+			served, srv := serveTestLayout(t, images)
+			if tt.removeBlob {
+				if err := os.Remove(filepath.Join(served, "blobs", "sha256", layer.Digest.Encoded())); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+
+			var mu sync.Mutex
+			var ranges []string
+			interrupted := false
+			files := srv.Config.Handler
+			srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != blobPath {
+					files.ServeHTTP(w, r)
+					return
+				}
+				mu.Lock()
+				if rng := r.Header.Get("Range"); rng != "" {
+					ranges = append(ranges, rng)
+				}
+				abort := tt.interrupt && !interrupted
+				interrupted = true
+				mu.Unlock()
+
+				if tt.noRange {
+					r.Header.Del("Range")
+				}
+				if !abort {
+					files.ServeHTTP(w, r)
+					return
+				}
+				blob := v1.blobs[layer.Digest]
+				w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+				w.WriteHeader(http.StatusOK)
+				w.Write(blob[:len(blob)/2])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			})
+
+			dir := t.TempDir()
+			f := &httpLayoutFetcher{client: srv.Client(), base: srv.URL + tt.path}
+			err := f.fetch(context.Background(), dir, tt.tag, stubSysCtx())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if got := len(ranges) > 0; got != tt.wantRange {
+				t.Errorf("unexpected range requests: %v", ranges)
+			}
+			if tt.wantRange && ranges[0] != fmt.Sprintf("bytes=%d-", len(v1.blobs[layer.Digest])/2) {
+				t.Errorf("download not resumed from the received bytes, got %v", ranges)
+			}
+
+			// the local layout only holds the selected image
+			ref, err := ocilayout.ParseReference(dir)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			src, err := ref.NewImageSource(context.Background(), stubSysCtx())
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer src.Close()
+			data, _, err := src.GetManifest(context.Background(), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			want := images[tt.tag]
+			if !bytes.Equal(data, want.manifestData) {
+				t.Errorf("unexpected manifest fetched:\n%s\nwant:\n%s", data, want.manifestData)
+			}
+			for d, blob := range want.blobs {
+				got, err := os.ReadFile(filepath.Join(dir, "blobs", "sha256", d.Encoded()))
+				if err != nil {
+					t.Errorf("blob %s not fetched: %s", d, err)
+				} else if !bytes.Equal(got, blob) {
+					t.Errorf("blob %s differs from the served one", d)
+				}
+			}
+			matches, _ := filepath.Glob(filepath.Join(dir, "blobs", "sha256", "*"+partialSuffix))
+			if len(matches) > 0 {
+				t.Errorf("partial files left: %v", matches)
+			}
+		})
+	}
+}
+
+func TestOCIConveyorPackerHTTPLayout(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t, dirEntry("etc/"), tarEntry{name: "etc/motd", body: "served"}))
+	_, srv := serveTestLayout(t, map[string]*testImage{"v1": img})
+
+	b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("while creating bundle: %s", err)
+	}
+	t.Cleanup(func() { b.Remove() })
+	b.Opts.NoCache = true
+	b.Opts.NoHTTPS = true
+
+	uri := "oci-http://" + strings.TrimPrefix(srv.URL, "http://") + "/layout:v1"
+	b.Recipe, err = sytypes.NewDefinitionFromURI(uri)
+	if err != nil {
+		t.Fatalf("unable to parse URI %s: %s", uri, err)
+	}
+
+	cp := &OCIConveyorPacker{}
+	if err := cp.Get(context.Background(), b); err != nil {
+		t.Fatalf("failed to Get from %s: %s", uri, err)
+	}
+	if _, err := cp.Pack(context.Background()); err != nil {
+		t.Fatalf("failed to Pack from %s: %s", uri, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(b.RootfsPath, "etc", "motd"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(data) != "served" {
+		t.Errorf("unexpected content %q", data)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apptainer/apptainer/pkg/sylog"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/pkg/idtools"
+)
+
+// idReport lists the uids and gids owning the entries of the layers of an
+// image, and those of them outside of the available id mappings.
+type idReport struct {
+	UIDs         []int
+	GIDs         []int
+	UnmappedUIDs []int
+	UnmappedGIDs []int
+}
+
+// preflightIDs reads the tar headers of the layers of manifest, without
+// extracting anything, and reports the ids owning the entries selected for
+// extraction against the uid and gid mappings available.
+func (u *rootfsUnpacker) preflightIDs(ctx context.Context, manifest imgspecv1.Manifest, uidMap, gidMap []rspec.LinuxIDMapping) (*idReport, error) {
+	diffIDs, err := u.diffIDs(ctx, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	uids := make(map[int]bool)
+	gids := make(map[int]bool)
+	for i, desc := range manifest.Layers {
+		sylog.Debugf("Scanning ownership of layer %s", desc.Digest)
+		_, err := u.readBlob(ctx, desc, diffIDs[i], func(layer io.Reader) error {
+			tr := tar.NewReader(layer)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				} else if err != nil {
+					return fmt.Errorf("error reading tar entry: %s", err)
+				}
+				hdr, err = u.filterEntry(hdr)
+				if err != nil {
+					return err
+				} else if hdr == nil {
+					continue
+				}
+				// whiteouts only remove paths, their ownership is not extracted
+				if strings.HasPrefix(filepath.Base(hdr.Name), whiteoutPrefix) {
+					continue
+				}
+				uids[hdr.Uid] = true
+				gids[hdr.Gid] = true
+			}
+		})
+		if err != nil && !errors.Is(err, errSkippedLayer) {
+			return nil, fmt.Errorf("layer %s: %s", desc.Digest, err)
+		}
+	}
+
+	r := &idReport{
+		UIDs: sortedIDs(uids),
+		GIDs: sortedIDs(gids),
+	}
+	r.UnmappedUIDs = unmappedIDs(r.UIDs, uidMap)
+	r.UnmappedGIDs = unmappedIDs(r.GIDs, gidMap)
+	return r, nil
+}
+
+// log reports the ids used by the image, and warns about the ids which
+// can't be mapped.
+func (r *idReport) log(warnings *warningRecorder) {
+	sylog.Infof("Image content is owned by uids %s and gids %s", joinIDs(r.UIDs), joinIDs(r.GIDs))
+	if len(r.UnmappedUIDs) == 0 && len(r.UnmappedGIDs) == 0 {
+		return
+	}
+	var unmapped []string
+	if len(r.UnmappedUIDs) > 0 {
+		unmapped = append(unmapped, "uids "+joinIDs(r.UnmappedUIDs))
+	}
+	if len(r.UnmappedGIDs) > 0 {
+		unmapped = append(unmapped, "gids "+joinIDs(r.UnmappedGIDs))
+	}
+	warnings.warnf("The image uses %s, outside of the available id mappings: their ownership won't be preserved, consider building with --fakeroot", strings.Join(unmapped, " and "))
+}
+
+// sortedIDs returns the ids of the set ids in increasing order.
+func sortedIDs(ids map[int]bool) []int {
+	s := make([]int, 0, len(ids))
+	for id := range ids {
+		s = append(s, id)
+	}
+	sort.Ints(s)
+	return s
+}
+
+// unmappedIDs returns the ids not covered by idMap.
+func unmappedIDs(ids []int, idMap []rspec.LinuxIDMapping) []int {
+	var unmapped []int
+	for _, id := range ids {
+		if _, err := idtools.ToHost(id, idMap); err != nil {
+			unmapped = append(unmapped, id)
+		}
+	}
+	return unmapped
+}
+
+func joinIDs(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
+}
+
+// readIDMappings returns all of the mappings of the uid_map or gid_map file
+// at path.
+func readIDMappings(path string) ([]rspec.LinuxIDMapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mappings []rspec.LinuxIDMapping
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed id mapping %q in %s", scanner.Text(), path)
+		}
+		var ids [3]uint32
+		for i, field := range fields {
+			id, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("malformed id mapping %q in %s: %s", scanner.Text(), path, err)
+			}
+			ids[i] = uint32(id)
+		}
+		mappings = append(mappings, rspec.LinuxIDMapping{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+func TestPreflightIDs(t *testing.T) {
+	img := newTestImage(t, nil,
+		makeLayer(t,
+			dirEntry("etc/"),
+			tarEntry{name: "etc/passwd", body: "root"},
+			dirEntry("home/"),
+			tarEntry{name: "home/user/", typeflag: tar.TypeDir, uid: 1000, gid: 1000},
+			tarEntry{name: "home/user/file", body: "file", uid: 1000, gid: 100},
+		),
+		makeLayer(t,
+			tarEntry{name: "var/lib/db", body: "db", uid: 70000, gid: 70000},
+			// whiteouts don't carry the ownership of extracted content
+			tarEntry{name: "etc/.wh.passwd", uid: 5, gid: 5},
+		),
+	)
+
+	tests := []struct {
+		name         string
+		include      []string
+		uidMap       []rspec.LinuxIDMapping
+		gidMap       []rspec.LinuxIDMapping
+		wantUIDs     []int
+		wantGIDs     []int
+		unmappedUIDs []int
+		unmappedGIDs []int
+	}{
+		{
+			name:     "all mapped",
+			uidMap:   []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 4294967295}},
+			gidMap:   []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 4294967295}},
+			wantUIDs: []int{0, 1000, 70000},
+			wantGIDs: []int{0, 100, 1000, 70000},
+		},
+		{
+			name: "subordinate range",
+			uidMap: []rspec.LinuxIDMapping{
+				{ContainerID: 0, HostID: 1000, Size: 1},
+				{ContainerID: 1, HostID: 100000, Size: 65536},
+			},
+			gidMap: []rspec.LinuxIDMapping{
+				{ContainerID: 0, HostID: 1000, Size: 1},
+				{ContainerID: 1, HostID: 100000, Size: 65536},
+			},
+			wantUIDs:     []int{0, 1000, 70000},
+			wantGIDs:     []int{0, 100, 1000, 70000},
+			unmappedUIDs: []int{70000},
+			unmappedGIDs: []int{70000},
+		},
+		{
+			name:         "rootless",
+			uidMap:       []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}},
+			gidMap:       []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}},
+			wantUIDs:     []int{0, 1000, 70000},
+			wantGIDs:     []int{0, 100, 1000, 70000},
+			unmappedUIDs: []int{1000, 70000},
+			unmappedGIDs: []int{100, 1000, 70000},
+		},
+		{
+			name:     "include paths",
+			include:  []string{"/etc"},
+			uidMap:   []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}},
+			gidMap:   []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}},
+			wantUIDs: []int{0},
+			wantGIDs: []int{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			img.writeLayout(t, dir, "tmp")
+			engineExt, err := umoci.OpenLayout(dir)
+			if err != nil {
+				t.Fatalf("while opening layout: %s", err)
+			}
+			defer engineExt.Close()
+
+			rootfs := filepath.Join(t.TempDir(), "rootfs")
+			u := &rootfsUnpacker{
+				engine:  casext.NewEngine(engineExt),
+				rootfs:  rootfs,
+				include: newPathFilter(tt.include),
+			}
+			r, err := u.preflightIDs(context.Background(), img.manifest, tt.uidMap, tt.gidMap)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			want := &idReport{
+				UIDs:         tt.wantUIDs,
+				GIDs:         tt.wantGIDs,
+				UnmappedUIDs: tt.unmappedUIDs,
+				UnmappedGIDs: tt.unmappedGIDs,
+			}
+			if !reflect.DeepEqual(r, want) {
+				t.Errorf("unexpected report: got %+v, want %+v", r, want)
+			}
+			if _, err := os.Lstat(rootfs); !os.IsNotExist(err) {
+				t.Errorf("preflight created the rootfs")
+			}
+		})
+	}
+}
+
+func TestReadIDMappings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uid_map")
+	content := "         0       1000          1\n         1     100000      65536\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got, err := readIDMappings(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []rspec.LinuxIDMapping{
+		{ContainerID: 0, HostID: 1000, Size: 1},
+		{ContainerID: 1, HostID: 100000, Size: 65536},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte("0 1000\n"), 0o644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := readIDMappings(path); err == nil {
+		t.Errorf("unexpected success with a malformed mapping")
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// maxIndexDepth is the depth of the nested image indexes followed by
+// InspectOCILayout.
+const maxIndexDepth = 8
+
+// LayoutInfo is the content of an OCI layout, as returned by
+// InspectOCILayout.
+type LayoutInfo struct {
+	// Manifests are the entries of the index of the layout
+	Manifests []ManifestInfo `json:"manifests"`
+}
+
+// ManifestInfo describes an image manifest, or an image index, referenced
+// by an index of an OCI layout.
+type ManifestInfo struct {
+	Digest    digest.Digest       `json:"digest"`
+	MediaType string              `json:"mediaType"`
+	Size      int64               `json:"size"`
+	RefName   string              `json:"refName,omitempty"`
+	Platform  *imgspecv1.Platform `json:"platform,omitempty"`
+	// Config and Layers are set for an image manifest.
+	Config *ConfigInfo `json:"config,omitempty"`
+	Layers []LayerInfo `json:"layers,omitempty"`
+	// Manifests are the entries of an image index.
+	Manifests []ManifestInfo `json:"manifests,omitempty"`
+}
+
+// LayerInfo describes a layer of an image manifest.
+type LayerInfo struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size"`
+	// DiffID is the digest of the uncompressed layer from the image config
+	DiffID digest.Digest `json:"diffID,omitempty"`
+}
+
+// ConfigInfo summarizes the config of an image.
+type ConfigInfo struct {
+	Digest       digest.Digest     `json:"digest"`
+	OS           string            `json:"os,omitempty"`
+	Architecture string            `json:"architecture,omitempty"`
+	Variant      string            `json:"variant,omitempty"`
+	Created      *time.Time        `json:"created,omitempty"`
+	Author       string            `json:"author,omitempty"`
+	User         string            `json:"user,omitempty"`
+	Entrypoint   []string          `json:"entrypoint,omitempty"`
+	Cmd          []string          `json:"cmd,omitempty"`
+	Env          []string          `json:"env,omitempty"`
+	WorkingDir   string            `json:"workingDir,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	// History is the number of history entries of the image
+	History int `json:"history"`
+}
+
+// InspectOCILayout returns the content of the OCI layout at path, e.g. the
+// temporary layout an oci/docker source is fetched into during a build: the
+// entries of its index, with the layers and the config summary of their
+// image manifests, and the entries of the nested image indexes. The blobs
+// are read, and must be present, but the layers are not decompressed.
+func InspectOCILayout(ctx context.Context, path string) (*LayoutInfo, error) {
+	engineExt, err := umoci.OpenLayout(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening layout: %s", err)
+	}
+	defer engineExt.Close()
+	engine := casext.NewEngine(engineExt)
+
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading layout index: %s", err)
+	}
+	info := &LayoutInfo{}
+	for _, desc := range index.Manifests {
+		m, err := inspectDescriptor(ctx, engine, desc, 0)
+		if err != nil {
+			return nil, err
+		}
+		info.Manifests = append(info.Manifests, m)
+	}
+	return info, nil
+}
+
+// inspectDescriptor returns the description of the image manifest or index
+// described by desc, found at the depth nested indexes.
+func inspectDescriptor(ctx context.Context, engine casext.Engine, desc imgspecv1.Descriptor, depth int) (ManifestInfo, error) {
+	m := ManifestInfo{
+		Digest:    desc.Digest,
+		MediaType: desc.MediaType,
+		Size:      desc.Size,
+		RefName:   desc.Annotations[imgspecv1.AnnotationRefName],
+		Platform:  desc.Platform,
+	}
+
+	blob, err := engine.FromDescriptor(ctx, desc)
+	if err != nil {
+		return m, fmt.Errorf("error reading %s: %s", desc.Digest, err)
+	}
+	defer blob.Close()
+
+	switch data := blob.Data.(type) {
+	case imgspecv1.Index:
+		if depth >= maxIndexDepth {
+			return m, fmt.Errorf("image index %s is nested more than %d levels deep", desc.Digest, maxIndexDepth)
+		}
+		for _, d := range data.Manifests {
+			nested, err := inspectDescriptor(ctx, engine, d, depth+1)
+			if err != nil {
+				return m, err
+			}
+			m.Manifests = append(m.Manifests, nested)
+		}
+	case imgspecv1.Manifest:
+		config, diffIDs, err := inspectConfig(ctx, engine, data.Config)
+		if err != nil {
+			return m, err
+		}
+		if len(diffIDs) != len(data.Layers) {
+			return m, fmt.Errorf("image config %s has %d diff IDs for the %d layers of manifest %s", data.Config.Digest, len(diffIDs), len(data.Layers), desc.Digest)
+		}
+		m.Config = config
+		for i, l := range data.Layers {
+			m.Layers = append(m.Layers, LayerInfo{
+				Digest:    l.Digest,
+				MediaType: l.MediaType,
+				Size:      l.Size,
+				DiffID:    diffIDs[i],
+			})
+		}
+	default:
+		return m, fmt.Errorf("unsupported media type %s of %s", desc.MediaType, desc.Digest)
+	}
+	return m, nil
+}
+
+// inspectConfig returns the summary of the image config described by desc,
+// and the diff IDs of the image layers.
+func inspectConfig(ctx context.Context, engine casext.Engine, desc imgspecv1.Descriptor) (*ConfigInfo, []digest.Digest, error) {
+	blob, err := engine.FromDescriptor(ctx, desc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading config %s: %s", desc.Digest, err)
+	}
+	defer blob.Close()
+	config, ok := blob.Data.(imgspecv1.Image)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported config media type %s of %s", desc.MediaType, desc.Digest)
+	}
+	return newConfigInfo(desc.Digest, config), config.RootFS.DiffIDs, nil
+}
+
+// newConfigInfo returns the summary of the image config of digest d.
+func newConfigInfo(d digest.Digest, config imgspecv1.Image) *ConfigInfo {
+	return &ConfigInfo{
+		Digest:       d,
+		OS:           config.OS,
+		Architecture: config.Architecture,
+		Variant:      config.Variant,
+		Created:      config.Created,
+		Author:       config.Author,
+		User:         config.Config.User,
+		Entrypoint:   config.Config.Entrypoint,
+		Cmd:          config.Config.Cmd,
+		Env:          config.Config.Env,
+		WorkingDir:   config.Config.WorkingDir,
+		Labels:       config.Config.Labels,
+		History:      len(config.History),
+	}
+}
+
+// InspectRemoteImage returns the summary of the config of the image ref,
+// e.g. a docker reference, fetching only its manifest and config: the layer
+// blobs aren't fetched. For an image index, the image matching the platform
+// of sysCtx is selected, as for a build.
+func InspectRemoteImage(ctx context.Context, ref types.ImageReference, sysCtx *types.SystemContext) (*ConfigInfo, error) {
+	src, err := newPlatformReference(ref, wantedPlatform(sysCtx)).NewImageSource(ctx, sysCtx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating image source: %s", err)
+	}
+	defer src.Close()
+
+	manifestData, mediaType, err := fetchManifest(ctx, src, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error obtaining manifest source: %s", err)
+	}
+	manifest, err := parseManifest(manifestData, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	configData, err := fetchConfigBlob(ctx, src, manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConfigMediaType(&manifest, configData); err != nil {
+		return nil, err
+	}
+	var config imgspecv1.Image
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("error decoding config blob: %s", err)
+	}
+	return newConfigInfo(manifest.Config.Digest, config), nil
+}
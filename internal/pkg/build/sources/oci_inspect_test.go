@@ -0,0 +1,207 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestInspectOCILayout(t *testing.T) {
+	img := newTestImage(t, func(c *imgspecv1.Image) {
+		c.Config.Cmd = []string{"/bin/sh"}
+		c.Config.WorkingDir = "/work"
+		c.Config.Labels = map[string]string{"maintainer": "test"}
+		c.History = []imgspecv1.History{{CreatedBy: "first"}, {CreatedBy: "second"}}
+	},
+		makeLayer(t, tarEntry{name: "first", body: "1"}),
+		makeLayer(t, tarEntry{name: "second", body: "2"}),
+	)
+	dir := t.TempDir()
+	img.writeLayout(t, dir, "test")
+
+	info, err := InspectOCILayout(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := &LayoutInfo{
+		Manifests: []ManifestInfo{
+			{
+				Digest:    img.manifestDigest,
+				MediaType: imgspecv1.MediaTypeImageManifest,
+				Size:      int64(len(img.manifestData)),
+				RefName:   "test",
+				Config: &ConfigInfo{
+					Digest:       img.manifest.Config.Digest,
+					OS:           "linux",
+					Architecture: "amd64",
+					Cmd:          []string{"/bin/sh"},
+					Env:          img.config.Config.Env,
+					WorkingDir:   "/work",
+					Labels:       map[string]string{"maintainer": "test"},
+					History:      2,
+				},
+			},
+		},
+	}
+	for i, l := range img.manifest.Layers {
+		want.Manifests[0].Layers = append(want.Manifests[0].Layers, LayerInfo{
+			Digest:    l.Digest,
+			MediaType: imgspecv1.MediaTypeImageLayerGzip,
+			Size:      l.Size,
+			DiffID:    img.config.RootFS.DiffIDs[i],
+		})
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("unexpected layout info:\ngot  %+v\nwant %+v", info, want)
+	}
+}
+
+func TestInspectOCILayoutIndex(t *testing.T) {
+	images := armImages(t)
+	dir := t.TempDir()
+	writeIndexLayout(t, dir, "test", images)
+
+	info, err := InspectOCILayout(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(info.Manifests) != 1 {
+		t.Fatalf("unexpected index entries: %+v", info.Manifests)
+	}
+	index := info.Manifests[0]
+	if index.MediaType != imgspecv1.MediaTypeImageIndex || index.RefName != "test" || index.Config != nil {
+		t.Errorf("unexpected index entry: %+v", index)
+	}
+	if len(index.Manifests) != len(images) {
+		t.Fatalf("unexpected nested manifests: got %d, want %d", len(index.Manifests), len(images))
+	}
+	for i, m := range index.Manifests {
+		pi := images[i]
+		if m.Digest != pi.img.manifestDigest {
+			t.Errorf("manifest %d: unexpected digest %s", i, m.Digest)
+		}
+		if m.Platform == nil || !reflect.DeepEqual(*m.Platform, pi.platform) {
+			t.Errorf("manifest %d: unexpected platform %+v", i, m.Platform)
+		}
+		if m.Config == nil || m.Config.Architecture != pi.platform.Architecture || m.Config.Variant != pi.platform.Variant {
+			t.Errorf("manifest %d: unexpected config %+v", i, m.Config)
+		}
+		if len(m.Layers) != 1 || m.Layers[0].Digest != pi.img.manifest.Layers[0].Digest {
+			t.Errorf("manifest %d: unexpected layers %+v", i, m.Layers)
+		}
+	}
+}
+
+func TestInspectOCILayoutMissingBlob(t *testing.T) {
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	dir := t.TempDir()
+	img.writeLayout(t, dir, "test")
+	config := img.manifest.Config.Digest
+	if err := os.Remove(filepath.Join(dir, "blobs", "sha256", config.Encoded())); err != nil {
+		t.Fatalf("while removing config blob: %s", err)
+	}
+
+	_, err := InspectOCILayout(context.Background(), dir)
+	if err == nil || !strings.Contains(err.Error(), "error reading config "+config.String()) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestInspectRemoteImage(t *testing.T) {
+	img := newTestImage(t, func(c *imgspecv1.Image) {
+		c.Config.Entrypoint = []string{"/entrypoint.sh"}
+		c.Config.Env = []string{"PATH=/bin", "LANG=C"}
+		c.Config.Labels = map[string]string{"maintainer": "test"}
+	}, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	reg := newStubRegistry(t)
+	reg.push("test/image", "v1", img)
+	images := armImages(t)
+	for _, pi := range images {
+		reg.push("test/image", "", pi.img)
+	}
+	_, data := testIndex(t, images)
+	reg.pushManifest("test/image", "multi", imgspecv1.MediaTypeImageIndex, data)
+
+	armSysCtx := stubSysCtx()
+	armSysCtx.ArchitectureChoice = "arm"
+	armSysCtx.VariantChoice = "v7"
+
+	tests := []struct {
+		name      string
+		tag       string
+		sysCtx    *types.SystemContext
+		want      *ConfigInfo
+		wantError string
+	}{
+		{
+			name:   "image",
+			tag:    "v1",
+			sysCtx: stubSysCtx(),
+			want: &ConfigInfo{
+				Digest:       img.manifest.Config.Digest,
+				OS:           "linux",
+				Architecture: "amd64",
+				Entrypoint:   []string{"/entrypoint.sh"},
+				Env:          []string{"PATH=/bin", "LANG=C"},
+				Labels:       map[string]string{"maintainer": "test"},
+			},
+		},
+		{
+			name:   "index",
+			tag:    "multi",
+			sysCtx: armSysCtx,
+			want: &ConfigInfo{
+				Digest:       images[2].img.manifest.Config.Digest,
+				OS:           "linux",
+				Architecture: "arm",
+				Variant:      "v7",
+				Env:          images[2].img.config.Config.Env,
+			},
+		},
+		{name: "missing tag", tag: "v2", sysCtx: stubSysCtx(), wantError: "error creating image source"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, _, err := parseDockerReference("//" + reg.host() + "/test/image:" + tt.tag)
+			if err != nil {
+				t.Fatalf("while parsing reference: %s", err)
+			}
+			info, err := InspectRemoteImage(context.Background(), ref, tt.sysCtx)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(info, tt.want) {
+				t.Errorf("unexpected config info:\ngot  %+v\nwant %+v", info, tt.want)
+			}
+		})
+	}
+
+	if reg.count(img.manifest.Config.Digest.Encoded()) == 0 {
+		t.Errorf("config blob not fetched")
+	}
+	for _, l := range append(img.manifest.Layers, images[2].img.manifest.Layers...) {
+		if n := reg.count(l.Digest.Encoded()); n != 0 {
+			t.Errorf("layer %s fetched %d times", l.Digest, n)
+		}
+	}
+}
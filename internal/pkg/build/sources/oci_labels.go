@@ -0,0 +1,163 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/apptainer/apptainer/internal/pkg/security/selinux"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"golang.org/x/sys/unix"
+)
+
+// noLabel is the label of the policy rules leaving the matching paths
+// unlabeled, as in the file_contexts files of SELinux.
+const noLabel = "<<none>>"
+
+// labelFileTypes maps the file types of the rules of a label policy to the
+// file modes they match, as in the file_contexts files of SELinux.
+var labelFileTypes = map[string]fs.FileMode{
+	"--": 0,
+	"-d": fs.ModeDir,
+	"-l": fs.ModeSymlink,
+	"-c": fs.ModeDevice | fs.ModeCharDevice,
+	"-b": fs.ModeDevice,
+	"-s": fs.ModeSocket,
+	"-p": fs.ModeNamedPipe,
+}
+
+// labelRule is a rule of a label policy.
+type labelRule struct {
+	path *regexp.Regexp
+	// fileType is the type of the files matched, all types when nil
+	fileType *fs.FileMode
+	// label is the SELinux label of the matching paths, empty to leave
+	// them unlabeled
+	label string
+}
+
+// labelPolicy sets the SELinux labels of the paths of a rootfs, in the
+// format of the file_contexts files of SELinux: one rule per line, made of
+// a regular expression matching the whole path in the rootfs, an optional
+// file type (--, -d, -l, -c, -b, -s or -p) and the label, or <<none>> to
+// leave the paths unlabeled. The last rule matching a path applies.
+type labelPolicy struct {
+	rules []labelRule
+}
+
+// parseLabelPolicy parses the label policy read from r.
+func parseLabelPolicy(r io.Reader) (*labelPolicy, error) {
+	p := &labelPolicy{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var rule labelRule
+		switch len(fields) {
+		case 2:
+			rule.label = fields[1]
+		case 3:
+			mode, ok := labelFileTypes[fields[1]]
+			if !ok {
+				return nil, fmt.Errorf("line %d: invalid file type %q", n, fields[1])
+			}
+			rule.fileType = &mode
+			rule.label = fields[2]
+		default:
+			return nil, fmt.Errorf("line %d: expected a path expression, an optional file type and a label", n)
+		}
+		re, err := regexp.Compile("^(?:" + fields[0] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid path expression: %s", n, err)
+		}
+		rule.path = re
+		if rule.label == noLabel {
+			rule.label = ""
+		}
+		p.rules = append(p.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// readLabelPolicy reads the label policy file at path.
+func readLabelPolicy(path string) (*labelPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("while opening label policy: %w", err)
+	}
+	defer f.Close()
+	p, err := parseLabelPolicy(f)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing label policy %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// label returns the label of the path of the rootfs, e.g. /usr/bin/env,
+// of a file of type mode, empty when it's left unlabeled.
+func (p *labelPolicy) label(path string, mode fs.FileMode) string {
+	mode &= fs.ModeType
+	for i := len(p.rules) - 1; i >= 0; i-- {
+		rule := p.rules[i]
+		if rule.fileType != nil && *rule.fileType != mode {
+			continue
+		}
+		if rule.path.MatchString(path) {
+			return rule.label
+		}
+	}
+	return ""
+}
+
+// applyLabels sets the SELinux labels of the paths of rootfs as set by the
+// policy p, in their security.selinux xattrs, which are kept in the SIF
+// image. The labeling is skipped with a warning when the labels can't be
+// set, e.g. on a filesystem without xattrs.
+func applyLabels(rootfs string, p *labelPolicy) error {
+	labeled := 0
+	err := filepath.WalkDir(rootfs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		label := p.label(filepath.Join("/", rel), d.Type())
+		if label == "" {
+			return nil
+		}
+		if err := selinux.LsetFileLabel(path, label); err != nil {
+			return err
+		}
+		labeled++
+		return nil
+	})
+	if errors.Is(err, unix.ENOTSUP) {
+		sylog.Warningf("SELinux labels not applied to the rootfs: %s", err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error applying SELinux labels: %s", err)
+	}
+	sylog.Debugf("Applied SELinux labels to %d paths of the rootfs", labeled)
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/security/selinux"
+	"golang.org/x/sys/unix"
+)
+
+const testLabelPolicy = `
+# default label
+/.*                    system_u:object_r:container_file_t:s0
+/usr/bin(/.*)?         system_u:object_r:bin_t:s0
+/usr/bin     -d        system_u:object_r:usr_t:s0
+/usr/bin/env -l        system_u:object_r:usr_t:s0
+/tmp(/.*)?             <<none>>
+`
+
+func TestLabelPolicy(t *testing.T) {
+	p, err := parseLabelPolicy(strings.NewReader(testLabelPolicy))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		path string
+		mode fs.FileMode
+		want string
+	}{
+		{path: "/etc/passwd", want: "system_u:object_r:container_file_t:s0"},
+		{path: "/usr/bin/ls", want: "system_u:object_r:bin_t:s0"},
+		{path: "/usr/bin", mode: fs.ModeDir | 0o755, want: "system_u:object_r:usr_t:s0"},
+		{path: "/usr/bin/env", want: "system_u:object_r:bin_t:s0"},
+		{path: "/usr/bin/env", mode: fs.ModeSymlink, want: "system_u:object_r:usr_t:s0"},
+		{path: "/usr/binaries", want: "system_u:object_r:container_file_t:s0"},
+		{path: "/tmp", mode: fs.ModeDir, want: ""},
+		{path: "/tmp/file", want: ""},
+	}
+	for _, tt := range tests {
+		if got := p.label(tt.path, tt.mode); got != tt.want {
+			t.Errorf("unexpected label of %s (%s): got %q, want %q", tt.path, tt.mode, got, tt.want)
+		}
+	}
+
+	for _, policy := range []string{
+		"/usr/bin",
+		"/usr/bin -x system_u:object_r:bin_t:s0",
+		"/usr/(bin system_u:object_r:bin_t:s0",
+		"/usr/bin -- system_u:object_r:bin_t:s0 extra",
+	} {
+		if _, err := parseLabelPolicy(strings.NewReader(policy)); err == nil {
+			t.Errorf("unexpected success parsing %q", policy)
+		}
+	}
+}
+
+func TestApplyLabels(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "usr/bin"), 0o755); err != nil {
+		t.Fatalf("while creating usr/bin: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "usr/bin/ls"), []byte("ls"), 0o755); err != nil {
+		t.Fatalf("while writing usr/bin/ls: %s", err)
+	}
+	if err := os.Symlink("ls", filepath.Join(rootfs, "usr/bin/env")); err != nil {
+		t.Fatalf("while creating usr/bin/env: %s", err)
+	}
+
+	const label = "system_u:object_r:bin_t:s0"
+	if err := selinux.LsetFileLabel(filepath.Join(rootfs, "usr/bin/ls"), label); err != nil {
+		t.Skipf("skipping test, unable to set SELinux labels: %s", err)
+	}
+
+	p, err := parseLabelPolicy(strings.NewReader(testLabelPolicy))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := applyLabels(rootfs, p); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := map[string]string{
+		"usr":         "system_u:object_r:container_file_t:s0",
+		"usr/bin":     "system_u:object_r:usr_t:s0",
+		"usr/bin/ls":  "system_u:object_r:bin_t:s0",
+		"usr/bin/env": "system_u:object_r:usr_t:s0",
+	}
+	for path, label := range want {
+		buf := make([]byte, 256)
+		n, err := unix.Lgetxattr(filepath.Join(rootfs, path), "security.selinux", buf)
+		if err != nil {
+			t.Errorf("while reading label of %s: %s", path, err)
+			continue
+		}
+		if got := strings.TrimRight(string(buf[:n]), "\x00"); got != label {
+			t.Errorf("unexpected label of %s: got %q, want %q", path, got, label)
+		}
+	}
+}
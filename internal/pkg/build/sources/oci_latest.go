@@ -0,0 +1,65 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// errLatestTag is returned for a docker source using the latest tag with
+// the sytypes.LatestTagError policy.
+var errLatestTag = errors.New("source uses the latest tag")
+
+// isLatestTag reports whether the docker transport reference ref, with or
+// without the leading '//', floats on the latest tag: it names the latest
+// tag, or neither a tag nor a digest, and isn't pinned to a digest.
+func isLatestTag(ref string) (bool, error) {
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(ref, "//"))
+	if err != nil {
+		return false, err
+	}
+	if _, ok := named.(reference.Canonical); ok {
+		return false, nil
+	}
+	tagged, ok := reference.TagNameOnly(named).(reference.NamedTagged)
+	return ok && tagged.Tag() == "latest", nil
+}
+
+// checkLatestTag applies the policy to the docker transport reference ref,
+// failing with errLatestTag or warning with the sytypes.LatestTagError and
+// sytypes.LatestTagWarn policies when it floats on the latest tag. It
+// returns whether ref floats on the latest tag and isn't ignored, for the
+// digest it resolves to to be reported.
+func checkLatestTag(ref, policy string) (bool, error) {
+	switch policy {
+	case "", sytypes.LatestTagWarn, sytypes.LatestTagError:
+	case sytypes.LatestTagIgnore:
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid policy %q for the sources using the latest tag, should be %s, %s or %s", policy,
+			sytypes.LatestTagWarn, sytypes.LatestTagError, sytypes.LatestTagIgnore)
+	}
+	latest, err := isLatestTag(ref)
+	if err != nil || !latest {
+		return false, err
+	}
+
+	name := strings.TrimPrefix(ref, "//")
+	if policy == sytypes.LatestTagError {
+		return false, fmt.Errorf("%w: %s, pin a tag or digest for a reproducible build or use --latest-tag=warn", errLatestTag, name)
+	}
+	sylog.Warningf("The source %s uses the floating latest tag, pin a tag or digest for a reproducible build", name)
+	return true, nil
+}
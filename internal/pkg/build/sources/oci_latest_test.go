@@ -0,0 +1,112 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+)
+
+func TestCheckLatestTag(t *testing.T) {
+	const d = "sha256:b5b2b2c507a0944348e0303114d8d93aaaa081732b86451d9bce1f432a537bc7"
+
+	tests := []struct {
+		name       string
+		ref        string
+		policy     string
+		wantLatest bool
+		wantError  bool
+	}{
+		{name: "latest warn", ref: "//alpine:latest", wantLatest: true},
+		{name: "no tag warn", ref: "//docker.io/library/alpine", policy: sytypes.LatestTagWarn, wantLatest: true},
+		{name: "latest error", ref: "//alpine:latest", policy: sytypes.LatestTagError, wantError: true},
+		{name: "no tag error", ref: "//registry.example.com:5000/alpine", policy: sytypes.LatestTagError, wantError: true},
+		{name: "latest ignore", ref: "//alpine:latest", policy: sytypes.LatestTagIgnore},
+		{name: "pinned tag", ref: "//alpine:3.18", policy: sytypes.LatestTagError},
+		{name: "digest", ref: "//alpine@" + d, policy: sytypes.LatestTagError},
+		{name: "latest digest", ref: "//alpine:latest@" + d, policy: sytypes.LatestTagError},
+		{name: "invalid policy", ref: "//alpine:3.18", policy: "allow", wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			oldWriter := sylog.SetWriter(&output)
+			latest, err := checkLatestTag(tt.ref, tt.policy)
+			sylog.SetWriter(oldWriter)
+
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("unexpected success")
+				}
+				if tt.policy == sytypes.LatestTagError && !errors.Is(err, errLatestTag) {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if latest != tt.wantLatest {
+				t.Errorf("unexpected latest %v, want %v", latest, tt.wantLatest)
+			}
+			if warned := strings.Contains(output.String(), "latest tag"); warned != tt.wantLatest {
+				t.Errorf("unexpected warning %v: %q", warned, output.String())
+			}
+		})
+	}
+}
+
+func TestOCIConveyorPackerLatestTag(t *testing.T) {
+	reg := newStubRegistry(t)
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	reg.push("test/image", "latest", img)
+	reg.push("test/image", "v1", img)
+
+	get := func(t *testing.T, tag, policy string) (string, error) {
+		var output bytes.Buffer
+		oldWriter := sylog.SetWriter(&output)
+		defer sylog.SetWriter(oldWriter)
+		cp, err := getDockerSource(t, reg.host()+"/test/image"+tag, func(b *sytypes.Bundle) {
+			b.Opts.LatestTag = policy
+		})
+		cp.CleanUp()
+		return output.String(), err
+	}
+
+	// the resolved digest of the latest tag is reported
+	out, err := get(t, ":latest", "")
+	if err != nil {
+		t.Fatalf("while getting image: %s", err)
+	}
+	if !strings.Contains(out, "floating latest tag") || !strings.Contains(out, img.manifestDigest.String()) {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	// the source without tag fails before any fetch
+	before := reg.count("/test/image/")
+	if _, err := get(t, "", sytypes.LatestTagError); !errors.Is(err, errLatestTag) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := reg.count("/test/image/"); n != before {
+		t.Errorf("unexpected %d fetches with the latest tag refused", n-before)
+	}
+
+	// a pinned tag is silent
+	out, err = get(t, ":v1", sytypes.LatestTagError)
+	if err != nil {
+		t.Fatalf("while getting image: %s", err)
+	}
+	if strings.Contains(out, "latest") {
+		t.Errorf("unexpected output: %q", out)
+	}
+}
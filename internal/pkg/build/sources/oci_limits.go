@@ -0,0 +1,158 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/apptainer/apptainer/pkg/sylog"
+	units "github.com/docker/go-units"
+	"golang.org/x/sys/unix"
+)
+
+// errResourceLimit is returned when the extraction exceeds one of the
+// resource limits of the build.
+var errResourceLimit = errors.New("extraction aborted")
+
+// resourceSampleInterval is the minimum interval between two samples of the
+// resources used by the build process.
+var resourceSampleInterval = 100 * time.Millisecond
+
+// resourceMonitor accounts for the CPU time and memory used by the build
+// process during the extraction, and aborts the reads of the layers once
+// they exceed the limits. The limits are best-effort, not enforced by the
+// kernel: the resources are sampled before the reads, at most every
+// resourceSampleInterval, so the process overshoots them by what it uses
+// until the next sample, e.g. the memory allocated to decompress a single
+// read.
+type resourceMonitor struct {
+	// maxMemory is the limit of the resident memory of the build process
+	// in bytes, none when zero
+	maxMemory int64
+	// maxCPUTime is the limit of the CPU time used by the build process
+	// since the start of the extraction, none when zero
+	maxCPUTime time.Duration
+
+	startCPU   time.Duration
+	lastSample time.Time
+	cpuTime    time.Duration
+	peakMemory int64
+	// err is the error of the limit exceeded, returned by all reads after
+	// the sample detecting it
+	err error
+}
+
+// newResourceMonitor returns a monitor of the resources used by the build
+// process from now on, nil if there is no limit.
+func newResourceMonitor(maxMemory int64, maxCPUTime time.Duration) (*resourceMonitor, error) {
+	if maxMemory <= 0 && maxCPUTime <= 0 {
+		return nil, nil
+	}
+	startCPU, err := processCPUTime()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CPU time: %s", err)
+	}
+	return &resourceMonitor{maxMemory: maxMemory, maxCPUTime: maxCPUTime, startCPU: startCPU}, nil
+}
+
+// sample measures the resources used, returning an errResourceLimit error
+// once a limit is exceeded. Samples closer than resourceSampleInterval to
+// the previous one are skipped.
+func (m *resourceMonitor) sample() error {
+	if m.err != nil {
+		return m.err
+	}
+	now := time.Now()
+	if now.Sub(m.lastSample) < resourceSampleInterval {
+		return nil
+	}
+	m.lastSample = now
+
+	cpu, err := processCPUTime()
+	if err != nil {
+		return fmt.Errorf("error reading CPU time: %s", err)
+	}
+	m.cpuTime = cpu - m.startCPU
+	memory, err := processResidentMemory()
+	if err != nil {
+		return fmt.Errorf("error reading memory usage: %s", err)
+	}
+	if memory > m.peakMemory {
+		m.peakMemory = memory
+	}
+
+	if m.maxCPUTime > 0 && m.cpuTime > m.maxCPUTime {
+		m.err = fmt.Errorf("%w: CPU time limit of %s exceeded, %s used", errResourceLimit, m.maxCPUTime, m.cpuTime.Round(time.Millisecond))
+	} else if m.maxMemory > 0 && memory > m.maxMemory {
+		m.err = fmt.Errorf("%w: memory limit of %s exceeded, %s used", errResourceLimit, units.BytesSize(float64(m.maxMemory)), units.BytesSize(float64(memory)))
+	}
+	return m.err
+}
+
+// log reports the resources used by the extraction.
+func (m *resourceMonitor) log() {
+	m.lastSample = time.Time{}
+	if err := m.sample(); err != nil && !errors.Is(err, errResourceLimit) {
+		sylog.Debugf("Could not account for the resources used by the extraction: %s", err)
+		return
+	}
+	sylog.Debugf("Extraction used %s of CPU time, with a peak resident memory of %s", m.cpuTime.Round(time.Millisecond), units.BytesSize(float64(m.peakMemory)))
+}
+
+// reader returns a reader of r sampling the resources used before each
+// read.
+func (m *resourceMonitor) reader(r io.Reader) io.Reader {
+	return &monitoredReader{r: r, m: m}
+}
+
+type monitoredReader struct {
+	r io.Reader
+	m *resourceMonitor
+}
+
+func (r *monitoredReader) Read(p []byte) (int, error) {
+	if err := r.m.sample(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// processCPUTime returns the user and system CPU time used by all threads
+// of the process.
+func processCPUTime() (time.Duration, error) {
+	var ru unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &ru); err != nil {
+		return 0, err
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
+
+// processResidentMemory returns the resident memory of the process in
+// bytes.
+func processResidentMemory() (int64, error) {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	fields := bytes.Fields(data)
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected content of /proc/self/statm: %q", data)
+	}
+	pages, err := strconv.ParseInt(string(fields[1]), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
@@ -0,0 +1,150 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+)
+
+func TestUnpackRootfsResourceLimits(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	// sample the resources on each read
+	oldInterval := resourceSampleInterval
+	resourceSampleInterval = 0
+	defer func() { resourceSampleInterval = oldInterval }()
+
+	img := newTestImage(t, nil,
+		makeLayer(t, tarEntry{name: "file", body: "content"}),
+		makeLayer(t, tarEntry{name: "data", body: string(compressibleData(16 << 20))}),
+	)
+
+	tests := []struct {
+		name       string
+		maxMemory  int64
+		maxCPUTime time.Duration
+		keepGoing  bool
+		wantErr    string
+	}{
+		{name: "no limit"},
+		{name: "within limits", maxMemory: 1 << 40, maxCPUTime: time.Hour},
+		{name: "CPU time", maxCPUTime: time.Nanosecond, wantErr: "CPU time limit of 1ns exceeded"},
+		{name: "memory", maxMemory: 1 << 20, wantErr: "memory limit of 1MiB exceeded"},
+		{name: "keep going", maxMemory: 1 << 20, keepGoing: true, wantErr: "memory limit of 1MiB exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.MaxExtractMemory = tt.maxMemory
+				b.Opts.MaxExtractCPUTime = tt.maxCPUTime
+				b.Opts.KeepGoing = tt.keepGoing
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), img.manifest.Layers[0].Digest.String()) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			assertPaths(t, b.RootfsPath, map[string]bool{"file": true, "data": true})
+		})
+	}
+}
+
+func TestResourceMonitor(t *testing.T) {
+	if m, err := newResourceMonitor(0, 0); m != nil || err != nil {
+		t.Fatalf("unexpected monitor %+v (err=%v) without limits", m, err)
+	}
+
+	m, err := newResourceMonitor(1<<40, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := m.sample(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if m.peakMemory <= 0 {
+		t.Errorf("unexpected peak memory %d", m.peakMemory)
+	}
+
+	// the samples closer than the interval are skipped, an exceeded limit
+	// is reported by all samples
+	m.maxMemory = 1
+	if err := m.sample(); err != nil {
+		t.Fatalf("unexpected error for a skipped sample: %s", err)
+	}
+	m.lastSample = time.Time{}
+	for i := 0; i < 2; i++ {
+		if err := m.sample(); err == nil || !strings.Contains(err.Error(), "memory limit") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestResourceMonitorThresholds(t *testing.T) {
+	const margin = 64 << 20
+
+	// the memory limit is only exceeded once the resident memory grows
+	// past it
+	rss, err := processResidentMemory()
+	if err != nil {
+		t.Fatalf("while reading memory usage: %s", err)
+	}
+	m, err := newResourceMonitor(rss+margin, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := m.sample(); err != nil {
+		t.Fatalf("unexpected error below the memory limit: %s", err)
+	}
+	data := make([]byte, 2*margin)
+	for i := range data {
+		data[i] = 1
+	}
+	m.lastSample = time.Time{}
+	if err := m.sample(); err == nil || !strings.Contains(err.Error(), "memory limit") {
+		t.Errorf("unexpected error above the memory limit: %v", err)
+	}
+	runtime.KeepAlive(data)
+
+	// as is the CPU time limit
+	const limit = 200 * time.Millisecond
+	m, err = newResourceMonitor(0, limit)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	burn := func(d time.Duration) {
+		for {
+			cpu, err := processCPUTime()
+			if err != nil {
+				t.Fatalf("while reading CPU time: %s", err)
+			}
+			if cpu-m.startCPU >= d {
+				return
+			}
+		}
+	}
+	burn(limit / 2)
+	m.lastSample = time.Time{}
+	if err := m.sample(); err != nil {
+		t.Fatalf("unexpected error below the CPU time limit: %s", err)
+	}
+	burn(limit + 10*time.Millisecond)
+	m.lastSample = time.Time{}
+	if err := m.sample(); err == nil || !strings.Contains(err.Error(), "CPU time limit") {
+		t.Errorf("unexpected error above the CPU time limit: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/apptainer/apptainer/pkg/util/fs/lock"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// buildLockVersion is the version of the lock file format.
+const buildLockVersion = 1
+
+// buildLock is the content of a build lock file, recording the digests the
+// tags of the docker sources of builds were resolved to.
+type buildLock struct {
+	Version int `json:"version"`
+	// Sources maps the docker references, with their tag, to the digest of
+	// their manifest.
+	Sources map[string]digest.Digest `json:"sources"`
+}
+
+// readBuildLock reads the lock file path, returning an empty lock if it
+// doesn't exist.
+func readBuildLock(path string) (*buildLock, error) {
+	l := &buildLock{Version: buildLockVersion, Sources: make(map[string]digest.Digest)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("while reading lock file: %w", err)
+	}
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("while decoding lock file %s: %w", path, err)
+	}
+	if l.Version != buildLockVersion {
+		return nil, fmt.Errorf("unsupported version %d of lock file %s", l.Version, path)
+	}
+	if l.Sources == nil {
+		l.Sources = make(map[string]digest.Digest)
+	}
+	return l, nil
+}
+
+// write replaces the lock file path with l.
+func (l *buildLock) write(path string) error {
+	data, err := json.MarshalIndent(l, "", "\t")
+	if err != nil {
+		return fmt.Errorf("while encoding lock file: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("while writing lock file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("while writing lock file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("while writing lock file: %w", err)
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return fmt.Errorf("while writing lock file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("while writing lock file: %w", err)
+	}
+	return nil
+}
+
+// updateBuildLock records the digest d of the docker reference key in the
+// lock file path. The directory of the lock file is locked while it is read
+// and replaced, so that the concurrent builds sharing the lock file don't
+// drop the digests recorded by each other.
+func updateBuildLock(path, key string, d digest.Digest) error {
+	fd, err := lock.Exclusive(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("while locking the directory of lock file %s: %w", path, err)
+	}
+	defer lock.Release(fd)
+
+	l, err := readBuildLock(path)
+	if err != nil {
+		return err
+	}
+	l.Sources[key] = d
+	return l.write(path)
+}
+
+// lockDockerReference returns the docker transport reference ref (without
+// the leading '//') pinned to the digest recorded for its tag in the lock
+// file path. A tag missing from the lock file, or every tag with update, is
+// resolved and recorded. A warning is displayed when a locked tag now
+// resolves to another digest. It returns a nil reference for a reference
+// given by digest, which needs no lock.
+func lockDockerReference(ctx context.Context, ref, path string, update bool, sysCtx *types.SystemContext) (types.ImageReference, *dockerPinnedRef, error) {
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(ref, "//"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := named.(reference.Canonical); ok {
+		sylog.Debugf("%s is referenced by digest, not locked", reference.FamiliarString(named))
+		return nil, nil, nil
+	}
+	tagged, ok := reference.TagNameOnly(named).(reference.NamedTagged)
+	if !ok {
+		return nil, nil, fmt.Errorf("no tag for %s", reference.FamiliarString(named))
+	}
+
+	l, err := readBuildLock(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := tagged.String()
+	locked, isLocked := l.Sources[key]
+
+	tagRef, err := docker.NewReference(tagged)
+	if err != nil {
+		return nil, nil, err
+	}
+	current, err := docker.GetDigest(ctx, sysCtx, tagRef)
+	if err != nil {
+		if !isLocked || update {
+			return nil, nil, fmt.Errorf("while resolving tag %s: %w", reference.FamiliarString(tagged), err)
+		}
+		// the locked digest may still be available, e.g. from the cache
+		sylog.Debugf("Could not resolve tag %s, using the locked digest: %s", reference.FamiliarString(tagged), err)
+		current = locked
+	}
+
+	pinned := locked
+	switch {
+	case !isLocked || update:
+		pinned = current
+		if !isLocked || locked != current {
+			sylog.Infof("Locking %s to digest %s in %s", reference.FamiliarString(tagged), current, path)
+			if err := updateBuildLock(path, key, current); err != nil {
+				return nil, nil, err
+			}
+		}
+	case locked != current:
+		sylog.Warningf("Tag %s now points at digest %s, building the digest %s locked in %s (use --update-lock to update it)",
+			reference.FamiliarString(tagged), current, locked, path)
+	}
+
+	canonical, err := reference.WithDigest(reference.TrimNamed(tagged), pinned)
+	if err != nil {
+		return nil, nil, err
+	}
+	srcRef, err := docker.NewReference(canonical)
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcRef, &dockerPinnedRef{tagged: tagged, canonical: canonical}, nil
+}
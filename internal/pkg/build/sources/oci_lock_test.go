@@ -0,0 +1,161 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/containers/image/v5/docker/reference"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// lockTestReference locks ref with the lock file path, returning the pinned
+// digest and the warnings displayed.
+func lockTestReference(t *testing.T, ref, path string, update bool) (digest.Digest, string, error) {
+	t.Helper()
+
+	var output bytes.Buffer
+	oldWriter := sylog.SetWriter(&output)
+	defer sylog.SetWriter(oldWriter)
+
+	srcRef, pinned, err := lockDockerReference(context.Background(), ref, path, update, stubSysCtx())
+	if err != nil || srcRef == nil {
+		return "", output.String(), err
+	}
+	canonical, ok := srcRef.DockerReference().(reference.Canonical)
+	if !ok || canonical.Digest() != pinned.canonical.Digest() {
+		t.Fatalf("unexpected source reference %s", srcRef.DockerReference())
+	}
+	return canonical.Digest(), output.String(), nil
+}
+
+func TestLockDockerReference(t *testing.T) {
+	reg := newStubRegistry(t)
+
+	v1 := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "v1"}))
+	v2 := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "v2"}))
+	reg.push("test/image", "latest", v1)
+
+	path := filepath.Join(t.TempDir(), "apptainer-build.lock")
+	ref := "//" + reg.host() + "/test/image"
+	key := reg.host() + "/test/image:latest"
+
+	// creation, the tag is resolved and recorded
+	got, warnings, err := lockTestReference(t, ref, path, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != v1.manifestDigest || !strings.Contains(warnings, "Locking") {
+		t.Errorf("unexpected digest %s, warnings %q", got, warnings)
+	}
+	lock, err := readBuildLock(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if lock.Sources[key] != v1.manifestDigest {
+		t.Errorf("unexpected lock %+v", lock.Sources)
+	}
+
+	// reuse, the tag now differs from the locked digest
+	reg.push("test/image", "latest", v2)
+	got, warnings, err = lockTestReference(t, ref, path, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != v1.manifestDigest {
+		t.Errorf("unexpected digest %s, want the locked %s", got, v1.manifestDigest)
+	}
+	if !strings.Contains(warnings, "now points at digest "+v2.manifestDigest.String()) {
+		t.Errorf("no drift warning in %q", warnings)
+	}
+
+	// update, the current digest is recorded
+	got, warnings, err = lockTestReference(t, ref+":latest", path, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != v2.manifestDigest || strings.Contains(warnings, "now points at") {
+		t.Errorf("unexpected digest %s, warnings %q", got, warnings)
+	}
+	if lock, err = readBuildLock(path); err != nil || lock.Sources[key] != v2.manifestDigest {
+		t.Errorf("unexpected lock %+v (err=%v)", lock, err)
+	}
+	_, warnings, err = lockTestReference(t, ref, path, false)
+	if err != nil || warnings != "" {
+		t.Errorf("unexpected warnings %q after update (err=%v)", warnings, err)
+	}
+
+	// a reference by digest is used as is
+	got, _, err = lockTestReference(t, ref+"@"+v1.manifestDigest.String(), path, false)
+	if err != nil || got != "" {
+		t.Errorf("unexpected digest %s for a reference by digest (err=%v)", got, err)
+	}
+
+	// an unknown tag can't be locked
+	if _, _, err := lockTestReference(t, ref+":unknown", path, false); err == nil || !strings.Contains(err.Error(), "while resolving tag") {
+		t.Errorf("unexpected error for an unknown tag: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"version": 2}`), 0o644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, _, err := lockTestReference(t, ref, path, false); err == nil || !strings.Contains(err.Error(), "unsupported version 2") {
+		t.Errorf("unexpected error for an unsupported lock file: %v", err)
+	}
+}
+
+func TestUpdateBuildLockConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "apptainer-build.lock")
+
+	// concurrent builds sharing the lock file keep the digests of each other
+	const builds, sources = 16, 4
+	var wg sync.WaitGroup
+	errs := make(chan error, builds*sources)
+	for i := 0; i < builds; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < sources; j++ {
+				key := fmt.Sprintf("registry.example.com/build%d/image%d:latest", i, j)
+				errs <- updateBuildLock(path, key, digest.FromString(key))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	l, err := readBuildLock(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(l.Sources) != builds*sources {
+		t.Errorf("unexpected locked sources: got %d, want %d", len(l.Sources), builds*sources)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("unexpected files next to the lock file: %v", entries)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// manifestCacheReference is an image reference whose manifests are fetched
+// once for the build, and then read from cache, see
+// sytypes.ManifestCache.
+type manifestCacheReference struct {
+	types.ImageReference
+	cache sytypes.ManifestCache
+}
+
+func newManifestCacheReference(ref types.ImageReference, cache sytypes.ManifestCache) *manifestCacheReference {
+	return &manifestCacheReference{ImageReference: ref, cache: cache}
+}
+
+// Unwrap returns the underlying image reference.
+func (r *manifestCacheReference) Unwrap() types.ImageReference {
+	return r.ImageReference
+}
+
+// NewImageSource returns an image source reading its manifests from cache.
+func (r *manifestCacheReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &manifestCacheSource{ImageSource: src, key: transports.ImageName(r.ImageReference), cache: r.cache}, nil
+}
+
+// NewImage returns the image of an image source reading its manifests from
+// cache.
+func (r *manifestCacheReference) NewImage(ctx context.Context, sys *types.SystemContext) (types.ImageCloser, error) {
+	src, err := r.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return image.FromSource(ctx, sys, src)
+}
+
+// manifestCacheSource is an image source reading its manifests from cache,
+// under key for the top-level manifest.
+type manifestCacheSource struct {
+	types.ImageSource
+	key   string
+	cache sytypes.ManifestCache
+}
+
+func (s *manifestCacheSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	key := s.key
+	if instanceDigest != nil {
+		key += "@" + instanceDigest.String()
+	}
+	if data, mediaType, ok := s.cache.GetManifest(key); ok {
+		return data, mediaType, nil
+	}
+	data, mediaType, err := s.ImageSource.GetManifest(ctx, instanceDigest)
+	if err != nil {
+		return nil, "", err
+	}
+	s.cache.PutManifest(key, data, mediaType)
+	return data, mediaType, nil
+}
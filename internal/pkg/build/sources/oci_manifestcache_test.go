@@ -0,0 +1,63 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestManifestCache(t *testing.T) {
+	reg := newStubRegistry(t)
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	reg.push("test/image", "", img)
+	_, data := testIndex(t, []platformImage{
+		{img: img, platform: imgspecv1.Platform{OS: "linux", Architecture: runtime.GOARCH}},
+	})
+	reg.pushManifest("test/image", "multi", imgspecv1.MediaTypeImageIndex, data)
+
+	cp, err := getDockerSource(t, reg.host()+"/test/image:multi", func(b *sytypes.Bundle) {
+		// the source digest and the healthcheck read the manifest as well
+		// as the fetch and the config
+		b.Opts.BuildProvenance = true
+		b.Opts.Healthcheck = true
+		b.Opts.ManifestCache = sytypes.NewMemoryManifestCache()
+	})
+	if err != nil {
+		t.Fatalf("while getting image: %s", err)
+	}
+	cp.CleanUp()
+
+	if cp.SourceDigest() != img.manifestDigest {
+		t.Errorf("unexpected source digest %s, want %s", cp.SourceDigest(), img.manifestDigest)
+	}
+	if n := reg.count("/manifests/multi"); n != 1 {
+		t.Errorf("unexpected %d fetches of the index, want 1", n)
+	}
+	if n := reg.count("/manifests/" + img.manifestDigest.String()); n != 1 {
+		t.Errorf("unexpected %d fetches of the manifest, want 1", n)
+	}
+
+	// the digest resolved with the cache of the build is the one of the
+	// cached manifest
+	d, err := ResolveSourceDigest(context.Background(), cp.b.Recipe, cp.b.Opts)
+	if err != nil {
+		t.Fatalf("while resolving source digest: %s", err)
+	}
+	if d != img.manifestDigest.String() {
+		t.Errorf("unexpected digest %s, want %s", d, img.manifestDigest)
+	}
+	if n := reg.count("/manifests/" + img.manifestDigest.String()); n != 1 {
+		t.Errorf("unexpected %d fetches of the manifest, want 1", n)
+	}
+}
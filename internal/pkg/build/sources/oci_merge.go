@@ -0,0 +1,127 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// fetchMergeSources fetches the images of the MergeSources of the bundle
+// into its temporary layout, next to the image of the source of the
+// definition, and returns their references in order.
+func (cp *OCIConveyorPacker) fetchMergeSources(ctx context.Context) ([]types.ImageReference, error) {
+	refs := make([]types.ImageReference, 0, len(cp.b.Opts.MergeSources))
+	for i, uri := range cp.b.Opts.MergeSources {
+		def, err := sytypes.NewDefinitionFromURI(uri)
+		if err != nil {
+			return nil, fmt.Errorf("invalid merged source %s: %v", uri, err)
+		}
+		// the source only contributes its layers, its config is discarded
+		b := *cp.b
+		b.Recipe = def
+		b.Opts.MergeSources = nil
+		b.Opts.NormalizeEnv = false
+
+		sylog.Infof("Fetching merged source %s", uri)
+		merged := &OCIConveyorPacker{tag: fmt.Sprintf("merge-%d", i)}
+		if err := merged.Get(ctx, &b); err != nil {
+			return nil, fmt.Errorf("while fetching merged source %s: %w", uri, err)
+		}
+		refs = append(refs, merged.tmpfsRef)
+	}
+	return refs, nil
+}
+
+// mergeManifests returns the manifest extracting the layers of manifest,
+// followed by the layers of the images of the merged references in order,
+// as a single image. The merged config, written to the layout of engine, is
+// the config of manifest with the diff IDs and history of every image, so
+// the layers of an image are applied atop the layers of the images before
+// it, and its whiteouts remove their paths.
+func mergeManifests(ctx context.Context, engine casext.Engine, manifest imgspecv1.Manifest, merged []types.ImageReference, sysCtx *types.SystemContext, timeout time.Duration) (imgspecv1.Manifest, error) {
+	config, err := readImageConfig(ctx, engine, manifest)
+	if err != nil {
+		return imgspecv1.Manifest{}, err
+	}
+	layers := append([]imgspecv1.Descriptor{}, manifest.Layers...)
+
+	for _, ref := range merged {
+		m, err := readLayoutManifest(ctx, ref, sysCtx, timeout)
+		if err != nil {
+			return imgspecv1.Manifest{}, err
+		}
+		c, err := readImageConfig(ctx, engine, m)
+		if err != nil {
+			return imgspecv1.Manifest{}, err
+		}
+		sylog.Debugf("Merging %d layers of %s", len(m.Layers), ref.StringWithinTransport())
+		layers = append(layers, m.Layers...)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, c.RootFS.DiffIDs...)
+		config.History = append(config.History, c.History...)
+	}
+
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, config)
+	if err != nil {
+		return imgspecv1.Manifest{}, fmt.Errorf("error writing merged config: %s", err)
+	}
+	manifest.Config = imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+	manifest.Layers = layers
+	return manifest, nil
+}
+
+// readLayoutManifest returns the manifest of the image of ref.
+func readLayoutManifest(ctx context.Context, ref types.ImageReference, sysCtx *types.SystemContext, timeout time.Duration) (imgspecv1.Manifest, error) {
+	src, err := ref.NewImageSource(ctx, sysCtx)
+	if err != nil {
+		return imgspecv1.Manifest{}, fmt.Errorf("error creating image source: %s", err)
+	}
+	defer src.Close()
+	data, mediaType, err := fetchManifest(ctx, src, timeout)
+	if err != nil {
+		return imgspecv1.Manifest{}, fmt.Errorf("error obtaining manifest source: %s", err)
+	}
+	m, err := parseManifest(data, mediaType)
+	if err != nil {
+		return imgspecv1.Manifest{}, err
+	}
+	if err := resolveConfigMediaType(ctx, src, &m); err != nil {
+		return imgspecv1.Manifest{}, err
+	}
+	return m, nil
+}
+
+// readImageConfig returns the image config of manifest, whose layers must
+// all be described by the diff IDs of the config.
+func readImageConfig(ctx context.Context, engine casext.Engine, manifest imgspecv1.Manifest) (imgspecv1.Image, error) {
+	blob, err := engine.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return imgspecv1.Image{}, fmt.Errorf("error obtaining config blob: %s", err)
+	}
+	defer blob.Close()
+	config, ok := blob.Data.(imgspecv1.Image)
+	if !ok {
+		return imgspecv1.Image{}, fmt.Errorf("unexpected config media type: %s", blob.Descriptor.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return imgspecv1.Image{}, fmt.Errorf("image config has %d diff IDs for %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	return config, nil
+}
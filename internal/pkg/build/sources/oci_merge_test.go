@@ -0,0 +1,122 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestOCIConveyorPackerMergeSources(t *testing.T) {
+	base := newTestImage(t, func(c *imgspecv1.Image) {
+		c.Config.Env = []string{"BASE=1"}
+	},
+		makeLayer(t,
+			dirEntry("etc/"),
+			tarEntry{name: "etc/os-release", body: "base"},
+			tarEntry{name: "etc/removed", body: "base"},
+			dirEntry("opt/"),
+			dirEntry("opt/cache/"),
+			tarEntry{name: "opt/cache/stale", body: "base"},
+		),
+		makeLayer(t, tarEntry{name: "etc/motd", body: "base"}),
+	)
+	tools := newTestImage(t, func(c *imgspecv1.Image) {
+		c.Config.Env = []string{"TOOLS=1"}
+	},
+		makeLayer(t,
+			tarEntry{name: "etc/.wh.removed"},
+			tarEntry{name: "etc/motd", body: "tools"},
+			dirEntry("opt/cache/"),
+			tarEntry{name: "opt/cache/.wh..wh..opq"},
+			tarEntry{name: "opt/cache/fresh", body: "tools"},
+			tarEntry{name: "opt/tool", body: "tools"},
+		),
+	)
+	app := newTestImage(t, nil, makeLayer(t, tarEntry{name: "opt/tool", body: "app"}))
+
+	dir, toolsDir, appDir := t.TempDir(), t.TempDir(), t.TempDir()
+	base.writeLayout(t, dir, "base")
+	tools.writeLayout(t, toolsDir, "tools")
+	app.writeLayout(t, appDir, "app")
+
+	b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("while creating bundle: %s", err)
+	}
+	t.Cleanup(func() { b.Remove() })
+	b.Recipe, err = sytypes.NewDefinitionFromURI("oci:" + dir + ":base")
+	if err != nil {
+		t.Fatalf("while parsing URI: %s", err)
+	}
+	b.Opts.NoCache = true
+	b.Opts.MergeSources = []string{"oci:" + toolsDir + ":tools", "oci:" + appDir + ":app"}
+	b.Opts.VerifyLayers = true
+
+	cp := &OCIConveyorPacker{}
+	if err := cp.Get(context.Background(), b); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := cp.Pack(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the later sources win, and their whiteouts remove the paths of the
+	// earlier ones
+	want := map[string]string{
+		"etc/os-release":  "base",
+		"etc/motd":        "tools",
+		"etc/removed":     "",
+		"opt/cache/stale": "",
+		"opt/cache/fresh": "tools",
+		"opt/tool":        "app",
+	}
+	for path, content := range want {
+		data, err := os.ReadFile(filepath.Join(b.RootfsPath, path))
+		if content == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s not removed by the whiteouts: %v", path, err)
+			}
+		} else if err != nil || string(data) != content {
+			t.Errorf("unexpected content of %s: %q, %v", path, data, err)
+		}
+	}
+
+	// the image config is the one of the source of the definition
+	if want := []string{"BASE=1"}; !reflect.DeepEqual(cp.imgConfig.Env, want) {
+		t.Errorf("unexpected env:\n\thave: %q\n\twant: %q", cp.imgConfig.Env, want)
+	}
+
+	t.Run("invalid source", func(t *testing.T) {
+		b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+		if err != nil {
+			t.Fatalf("while creating bundle: %s", err)
+		}
+		t.Cleanup(func() { b.Remove() })
+		b.Recipe, err = sytypes.NewDefinitionFromURI("oci:" + dir + ":base")
+		if err != nil {
+			t.Fatalf("while parsing URI: %s", err)
+		}
+		b.Opts.NoCache = true
+		b.Opts.MergeSources = []string{"library://tools"}
+
+		cp := &OCIConveyorPacker{}
+		err = cp.Get(context.Background(), b)
+		if err == nil || !strings.Contains(err.Error(), "while fetching merged source library://tools") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"fmt"
+	"strings"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/apptainer/apptainer/pkg/util/fs/proc"
+)
+
+// mountInfoPath is the file the mount preflight reads the mount points
+// from, replaced by the tests.
+var mountInfoPath = "/proc/self/mountinfo"
+
+// checkBuildMounts is the preflight checking the mount options of the
+// directory oci/docker sources are extracted to, the rootfs of b. It fails
+// when the image can't be stored there, or can't run the %post or %test
+// sections of the definition, and warns about the options breaking part
+// of its content.
+func checkBuildMounts(b *sytypes.Bundle) error {
+	entries, err := proc.GetMountInfoEntry(mountInfoPath)
+	if err != nil {
+		sylog.Debugf("Skipping the mount options preflight: %s", err)
+		return nil
+	}
+
+	e := findMountEntry(b.RootfsPath, entries)
+	if e == nil {
+		return nil
+	}
+	if hasMountOption(e, "ro") {
+		return fmt.Errorf("the root filesystem %s is on the read-only mount %s, the image can't be extracted: "+
+			"use --tmpdir or APPTAINER_TMPDIR to build on a writable filesystem", b.RootfsPath, e.Point)
+	} else if hasMountOption(e, "noexec") {
+		if runsBuildScripts(b) {
+			return fmt.Errorf("the root filesystem %s is on the mount %s mounted with noexec, the %%post and %%test sections can't run: "+
+				"use --tmpdir or APPTAINER_TMPDIR to build on a filesystem mounted without noexec", b.RootfsPath, e.Point)
+		}
+		sylog.Warningf("The root filesystem %s is on the mount %s mounted with noexec, the programs of the image won't run until it is packed", b.RootfsPath, e.Point)
+	}
+	if hasMountOption(e, "nodev") {
+		sylog.Warningf("The root filesystem %s is on the mount %s mounted with nodev, the device nodes of the image won't be usable during the build", b.RootfsPath, e.Point)
+	}
+	if hasMountOption(e, "nosuid") {
+		sylog.Warningf("The root filesystem %s is on the mount %s mounted with nosuid, the setuid and setgid programs of the image won't gain their privileges during the build", b.RootfsPath, e.Point)
+	}
+	return nil
+}
+
+// runsBuildScripts reports whether the build of b runs programs of the
+// image, the %post, %appinstall or %test sections of its definition.
+func runsBuildScripts(b *sytypes.Bundle) bool {
+	if b.RunSection("post") {
+		if b.Recipe.BuildData.Post.Script != "" {
+			return true
+		}
+		for k := range b.Recipe.CustomData {
+			if strings.HasPrefix(k, "appinstall") {
+				return true
+			}
+		}
+	}
+	return b.RunSection("test") && b.Recipe.ImageData.Test.Script != ""
+}
+
+// findMountEntry returns the entry of the mount holding path, nil if not
+// found.
+func findMountEntry(path string, entries []proc.MountInfoEntry) *proc.MountInfoEntry {
+	e, err := proc.FindParentMountEntry(path, entries)
+	if err != nil {
+		sylog.Debugf("Skipping the mount options preflight of %s: %s", path, err)
+		return nil
+	}
+	return e
+}
+
+// hasMountOption reports whether the mount of e has the option opt.
+func hasMountOption(e *proc.MountInfoEntry, opt string) bool {
+	for _, o := range e.Options {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"golang.org/x/sys/unix"
+)
+
+// stubMountInfo replaces the mount information read by the preflight with
+// mount points at the temporary directory and the rootfs of b, mounted
+// with the options.
+func stubMountInfo(t *testing.T, b *sytypes.Bundle, tmpOptions, rootfsOptions string) {
+	t.Helper()
+
+	var lines []string
+	for i, m := range []struct{ path, options string }{
+		{b.TmpDir, tmpOptions},
+		{b.RootfsPath, rootfsOptions},
+	} {
+		path, err := filepath.EvalSymlinks(m.path)
+		if err != nil {
+			t.Fatalf("while resolving %s: %s", m.path, err)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil {
+			t.Fatalf("while getting stat for %s: %s", path, err)
+		}
+		dev := fmt.Sprintf("%d:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)))
+		lines = append(lines, fmt.Sprintf("%d 1 %s / %s %s shared:1 - ext4 /dev/sda1 rw", 100+i, dev, path, m.options))
+	}
+
+	stub := filepath.Join(t.TempDir(), "mountinfo")
+	if err := os.WriteFile(stub, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatalf("while writing mountinfo: %s", err)
+	}
+	old := mountInfoPath
+	mountInfoPath = stub
+	t.Cleanup(func() { mountInfoPath = old })
+}
+
+func TestCheckBuildMounts(t *testing.T) {
+	tests := []struct {
+		name          string
+		tmpOptions    string
+		rootfsOptions string
+		recipe        sytypes.Definition
+		sections      []string
+		wantError     string
+		wantWarning   string
+	}{
+		{name: "default", tmpOptions: "rw,relatime", rootfsOptions: "rw,relatime"},
+		{name: "nodev", tmpOptions: "rw,nodev", rootfsOptions: "rw,nodev", wantWarning: "mounted with nodev, the device nodes of the image won't be usable"},
+		{name: "nosuid", tmpOptions: "rw", rootfsOptions: "rw,nosuid", wantWarning: "mounted with nosuid, the setuid and setgid programs"},
+		{name: "noexec", tmpOptions: "rw", rootfsOptions: "rw,noexec", wantWarning: "mounted with noexec, the programs of the image won't run until it is packed"},
+		{
+			name:          "noexec post",
+			tmpOptions:    "rw",
+			rootfsOptions: "rw,nodev,noexec",
+			recipe:        sytypes.Definition{BuildData: sytypes.Data{Scripts: sytypes.Scripts{Post: sytypes.Script{Script: "true"}}}},
+			wantError:     "mounted with noexec, the %post and %test sections can't run: use --tmpdir",
+		},
+		{
+			name:          "noexec appinstall",
+			tmpOptions:    "rw",
+			rootfsOptions: "rw,noexec",
+			recipe:        sytypes.Definition{CustomData: map[string]string{"appinstall foo": "true"}},
+			wantError:     "mounted with noexec, the %post and %test sections can't run",
+		},
+		{
+			name:          "noexec test",
+			tmpOptions:    "rw",
+			rootfsOptions: "rw,noexec",
+			recipe:        sytypes.Definition{ImageData: sytypes.ImageData{ImageScripts: sytypes.ImageScripts{Test: sytypes.Script{Script: "true"}}}},
+			wantError:     "mounted with noexec, the %post and %test sections can't run",
+		},
+		{
+			name:          "noexec skipped test",
+			tmpOptions:    "rw",
+			rootfsOptions: "rw,noexec",
+			recipe:        sytypes.Definition{ImageData: sytypes.ImageData{ImageScripts: sytypes.ImageScripts{Test: sytypes.Script{Script: "true"}}}},
+			sections:      []string{"post"},
+			wantWarning:   "mounted with noexec, the programs of the image won't run until it is packed",
+		},
+		{name: "noexec layout", tmpOptions: "rw,noexec", rootfsOptions: "rw"},
+		{name: "read-only layout", tmpOptions: "ro", rootfsOptions: "rw"},
+		{name: "read-only rootfs", tmpOptions: "rw", rootfsOptions: "ro", wantError: "the image can't be extracted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+			if err != nil {
+				t.Fatalf("while creating bundle: %s", err)
+			}
+			t.Cleanup(func() { b.Remove() })
+			b.Recipe = tt.recipe
+			b.Opts.Sections = tt.sections
+			if b.Opts.Sections == nil {
+				b.Opts.Sections = []string{"all"}
+			}
+			stubMountInfo(t, b, tt.tmpOptions, tt.rootfsOptions)
+
+			var output bytes.Buffer
+			oldWriter := sylog.SetWriter(&output)
+			err = checkBuildMounts(b)
+			sylog.SetWriter(oldWriter)
+
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: %v, want %q", err, tt.wantError)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.wantWarning != "" && !strings.Contains(output.String(), tt.wantWarning) {
+				t.Errorf("unexpected output %q, want %q", output.String(), tt.wantWarning)
+			} else if tt.wantWarning == "" && strings.Contains(output.String(), "WARNING") {
+				t.Errorf("unexpected warning %q", output.String())
+			}
+		})
+	}
+}
+
+func TestOCIConveyorPackerMountPreflight(t *testing.T) {
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+
+	_, err := getOCILayout(t, img, func(b *sytypes.Bundle) {
+		b.Recipe.BuildData.Post.Script = "true"
+		b.Opts.Sections = []string{"all"}
+		stubMountInfo(t, b, "rw", "rw,noexec")
+	})
+	if err == nil || !strings.Contains(err.Error(), "mounted with noexec") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var serr *sytypes.SourceError
+	if !errors.As(err, &serr) || serr.Type != sytypes.SourceErrorOther {
+		t.Errorf("unexpected error type: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BundleToOCILayout writes the rootfs of the bundle b as the single layer
+// of an image of the new OCI layout outDir, tagged latest, and returns the
+// descriptor of its manifest. The image config and the manifest
+// annotations of an oci/docker source, recorded in the bundle, are kept,
+// and the labels of the container are set as image labels, as
+// SIFToOCILayout does for SIF images.
+func BundleToOCILayout(ctx context.Context, b *sytypes.Bundle, outDir string) (imgspecv1.Descriptor, error) {
+	config, annotations, err := imageConfig(func(name string) ([]byte, error) {
+		if data := b.JSONObjects[name]; len(data) > 0 {
+			return data, nil
+		}
+		return nil, nil
+	}, b.RootfsPath)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	return rootfsToLayout(ctx, b.RootfsPath, outDir, config, annotations)
+}
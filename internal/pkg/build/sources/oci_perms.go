@@ -0,0 +1,189 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// permsState records the result of the scan for restrictive permissions of
+// a sandbox rootfs extracted from oci/docker sources. The result for a path
+// only depends on the entry of the layer which last wrote it, so a rebuild
+// only has to scan the paths last written by layers missing from the state.
+type permsState struct {
+	// Layers maps the digests of the layers to the paths they last wrote,
+	// mapped to true when they have restrictive permissions.
+	Layers map[digest.Digest]map[string]bool `json:"layers"`
+}
+
+// readPermsState reads the perms state file at path. A missing file
+// returns a nil state, and a full scan of the rootfs.
+func readPermsState(path string) (*permsState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("while reading perms state file: %w", err)
+	}
+	s := &permsState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("while decoding perms state file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// write replaces the perms state file at path with s.
+func (s *permsState) write(path string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("while encoding perms state file: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("while writing perms state file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("while writing perms state file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("while writing perms state file: %w", err)
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return fmt.Errorf("while writing perms state file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("while writing perms state file: %w", err)
+	}
+	return nil
+}
+
+// restrictivePerms returns true for the directories not `rwX` by their
+// owner - technically other combinations may be traversable / removable...
+// but are confusing to the user vs the Singularity 3.4 behavior.
+func restrictivePerms(f os.FileInfo) bool {
+	return f.Mode().IsDir() && f.Mode().Perm()&0o700 != 0o700
+}
+
+// scanPerms returns the paths of rootfs with restrictive permissions, and
+// the state recording them for the provenance index prov. The paths last
+// written by a layer of the previous state prev are not scanned again,
+// the others are returned in scanned. The whole rootfs is scanned when prev
+// is nil, the paths written by the build and not by a layer are not
+// scanned otherwise.
+func scanPerms(rootfs string, prov sytypes.Provenance, prev *permsState) (restrictive, scanned []string, next *permsState, err error) {
+	found := make(map[string]bool)
+	if prev == nil {
+		paths, err := findRestrictivePerms(rootfs)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, path := range paths {
+			rel, err := filepath.Rel(rootfs, path)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			found["/"+rel] = true
+		}
+		restrictive = paths
+	}
+
+	paths := make([]string, 0, len(prov))
+	for path := range prov {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	next = &permsState{Layers: make(map[digest.Digest]map[string]bool)}
+	for _, path := range paths {
+		layer := prov[path]
+		if next.Layers[layer] == nil {
+			next.Layers[layer] = make(map[string]bool)
+		}
+		if prev == nil {
+			next.Layers[layer][path] = found[path]
+			continue
+		}
+
+		isRestrictive, ok := prev.Layers[layer][path]
+		if !ok {
+			scanned = append(scanned, path)
+			f, err := os.Lstat(filepath.Join(rootfs, path))
+			if errors.Is(err, os.ErrNotExist) {
+				// removed after the extraction, e.g. by NormalizeNetFiles
+				continue
+			} else if os.IsPermission(err) {
+				// below a directory with restrictive permissions, which is
+				// reported itself, the path is scanned again next time
+				continue
+			} else if err != nil {
+				return nil, nil, nil, fmt.Errorf("unable to access rootfs path %s: %s", path, err)
+			}
+			isRestrictive = restrictivePerms(f)
+		}
+		next.Layers[layer][path] = isRestrictive
+		if isRestrictive {
+			sylog.Debugf("Path %q has restrictive permissions", path)
+			restrictive = append(restrictive, filepath.Join(rootfs, path))
+		}
+	}
+	return restrictive, scanned, next, nil
+}
+
+// checkPermsIncremental reports the paths of rootfs with restrictive
+// permissions, as checkPerms, only scanning the paths last written by the
+// layers which changed since the build recording the perms state file at
+// statePath. The state file is replaced with the result of the scan.
+func checkPermsIncremental(rootfs string, prov sytypes.Provenance, statePath string, handler sytypes.RestrictivePermsHandler, warnings *warningRecorder) error {
+	prev, err := readPermsState(statePath)
+	if err != nil {
+		sylog.Warningf("Scanning the whole rootfs for restrictive permissions: %s", err)
+		prev = nil
+	}
+	restrictive, scanned, next, err := scanPerms(rootfs, prov, prev)
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		sylog.Debugf("Scanned %d of the %d paths written by the layers for restrictive permissions", len(scanned), len(prov))
+	}
+	if err := next.write(statePath); err != nil {
+		return err
+	}
+	return reportRestrictivePerms(restrictive, handler, warnings)
+}
+
+// injectedProvenance returns the provenance index prov with the paths of
+// the injected files, as if written by a layer whose digest is the one of
+// the files, so that they are scanned again when they change.
+func injectedProvenance(prov sytypes.Provenance, files []sytypes.InjectedFile) (sytypes.Provenance, error) {
+	data, err := json.Marshal(files)
+	if err != nil {
+		return nil, fmt.Errorf("while encoding injected files: %w", err)
+	}
+	layer := digest.FromBytes(data)
+	next := make(sytypes.Provenance, len(prov)+len(files))
+	for path, d := range prov {
+		next[path] = d
+	}
+	for _, f := range files {
+		next[filepath.Clean("/"+f.Path)] = layer
+	}
+	return next, nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestCheckPermsIncremental(t *testing.T) {
+	rootfs := t.TempDir()
+	for _, dir := range []string{"base", "base/ro", "app"} {
+		if err := os.Mkdir(filepath.Join(rootfs, dir), 0o755); err != nil {
+			t.Fatalf("while creating %s: %s", dir, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "app/run"), []byte("run"), 0o755); err != nil {
+		t.Fatalf("while writing app/run: %s", err)
+	}
+	if err := os.Chmod(filepath.Join(rootfs, "base/ro"), 0o500); err != nil {
+		t.Fatalf("while changing base/ro permissions: %s", err)
+	}
+	t.Cleanup(func() {
+		os.Chmod(filepath.Join(rootfs, "base/ro"), 0o755)
+		os.Chmod(filepath.Join(rootfs, "app"), 0o755)
+	})
+
+	base := digest.FromString("base")
+	app := digest.FromString("app")
+	statePath := filepath.Join(t.TempDir(), "perms.json")
+
+	check := func(prov sytypes.Provenance) []string {
+		var got []string
+		err := checkPermsIncremental(rootfs, prov, statePath, func(paths []string) error {
+			got = paths
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return got
+	}
+
+	// without a state file, the whole rootfs is scanned
+	got := check(sytypes.Provenance{"/base": base, "/base/ro": base, "/app": app, "/app/run": app})
+	if want := []string{filepath.Join(rootfs, "base/ro")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected restrictive paths on the first build:\n\thave: %v\n\twant: %v", got, want)
+	}
+
+	// the top layer changed, only its paths are scanned
+	if err := os.Chmod(filepath.Join(rootfs, "app"), 0o500); err != nil {
+		t.Fatalf("while changing app permissions: %s", err)
+	}
+	newApp := digest.FromString("app v2")
+	prov := sytypes.Provenance{"/base": base, "/base/ro": base, "/app": newApp, "/app/run": newApp}
+	prev, err := readPermsState(statePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, scanned, _, err := scanPerms(rootfs, prov, prev)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := []string{"/app", "/app/run"}; !reflect.DeepEqual(scanned, want) {
+		t.Errorf("unexpected scanned paths on the rebuild:\n\thave: %v\n\twant: %v", scanned, want)
+	}
+
+	got = check(prov)
+	if want := []string{filepath.Join(rootfs, "app"), filepath.Join(rootfs, "base/ro")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected restrictive paths on the rebuild:\n\thave: %v\n\twant: %v", got, want)
+	}
+
+	// nothing changed, nothing is scanned
+	prev, err = readPermsState(statePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, scanned, _, err = scanPerms(rootfs, prov, prev); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if len(scanned) != 0 {
+		t.Errorf("unexpected scanned paths without changes: %v", scanned)
+	}
+}
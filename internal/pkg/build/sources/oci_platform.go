@@ -0,0 +1,363 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// variantCompatibility lists the variants of the architectures having some,
+// from the most recent one. An image built for a variant runs on the hosts
+// of the variants listed before it.
+var variantCompatibility = map[string][]string{
+	"arm":   {"v8", "v7", "v6", "v5"},
+	"arm64": {"v9", "v8"},
+}
+
+// checkImagePlatform returns an error if the platform declared by an image
+// config can't run on the host, or doesn't match the architecture requested
+// in sysCtx. An image config without OS or architecture is accepted.
+func checkImagePlatform(p imgspecv1.Platform, sysCtx *types.SystemContext) error {
+	if p.OS != "" && p.OS != "linux" {
+		return fmt.Errorf("image is built for the %s operating system, only linux images are supported", p.OS)
+	}
+
+	want := wantedPlatform(sysCtx)
+	if p.Architecture != "" && p.Architecture != want.Architecture {
+		return fmt.Errorf("image is built for the %s architecture, expected %s", p.Architecture, want.Architecture)
+	}
+	if p.Architecture != "" {
+		if _, ok := variantRank(want.Architecture, want.Variant, p.Variant); !ok {
+			return fmt.Errorf("image is built for the %s variant of the %s architecture, expected %s", p.Variant, p.Architecture, want.Variant)
+		}
+	}
+	return nil
+}
+
+// wantedPlatform returns the platform of the images to build from: the OS,
+// architecture and variant chosen in sysCtx, or those of the host.
+func wantedPlatform(sysCtx *types.SystemContext) imgspecv1.Platform {
+	p := imgspecv1.Platform{
+		OS:           "linux",
+		Architecture: runtime.GOARCH,
+	}
+	if sysCtx != nil && sysCtx.OSChoice != "" {
+		p.OS = sysCtx.OSChoice
+	}
+	if sysCtx != nil && sysCtx.ArchitectureChoice != "" {
+		p.Architecture = sysCtx.ArchitectureChoice
+	} else {
+		p.Variant = hostVariant()
+	}
+	if sysCtx != nil && sysCtx.VariantChoice != "" {
+		p.Variant = sysCtx.VariantChoice
+	}
+	return p
+}
+
+// hostVariant returns the architecture variant of the host, or an empty
+// string when unknown.
+func hostVariant() string {
+	switch runtime.GOARCH {
+	case "arm64":
+		return "v8"
+	case "arm":
+		data, err := os.ReadFile("/proc/cpuinfo")
+		if err != nil {
+			return ""
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if k, v, ok := strings.Cut(line, ":"); ok && strings.TrimSpace(k) == "CPU architecture" {
+				return "v" + strings.TrimSpace(v)
+			}
+		}
+	}
+	return ""
+}
+
+// variantRank returns whether an image built for the variant got of arch
+// runs on the wanted variant, and its rank; the lower ranks are the closest
+// matches. Any variant is accepted when the wanted one is unknown.
+func variantRank(arch, want, got string) (int, bool) {
+	compat := variantCompatibility[arch]
+	switch {
+	case got == want:
+		return 0, true
+	case got == "":
+		return len(compat) + 1, true
+	case want == "":
+		return 1, true
+	}
+	for i, v := range compat {
+		if v != want {
+			continue
+		}
+		for j, older := range compat[i+1:] {
+			if older == got {
+				return j + 1, true
+			}
+		}
+		break
+	}
+	return 0, false
+}
+
+// platformString formats p as os/architecture[/variant], followed by its OS
+// features if any.
+func platformString(p imgspecv1.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	if len(p.OSFeatures) > 0 {
+		s += " (os.features " + strings.Join(p.OSFeatures, ",") + ")"
+	}
+	return s
+}
+
+// parsePlatform parses the platform s in the os/architecture[/variant]
+// form, e.g. linux/arm64/v8.
+func parsePlatform(s string) (imgspecv1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return imgspecv1.Platform{}, fmt.Errorf("invalid platform %q, should be os/architecture[/variant] or %s", s, sytypes.PlatformAll)
+	}
+	if parts[0] != "linux" {
+		return imgspecv1.Platform{}, fmt.Errorf("invalid platform %q, only linux images are supported", s)
+	}
+	p := imgspecv1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// IndexPlatforms returns the platforms of the linux images of the image
+// index of the docker or oci source of def, in the os/architecture[/variant]
+// form and in the order of the index. The entries without platform, or for
+// another OS, e.g. the unknown/unknown attestations of buildx, are skipped.
+func IndexPlatforms(ctx context.Context, def sytypes.Definition, opts sytypes.Options) ([]string, error) {
+	ref, err := definitionReference(def, opts)
+	if err != nil {
+		return nil, err
+	}
+	var srcRef types.ImageReference
+	switch def.Header["bootstrap"] {
+	case "docker":
+		srcRef, _, err = parseDockerReference(ref)
+	case "oci":
+		srcRef, err = ocilayout.ParseReference(ref)
+	default:
+		return nil, fmt.Errorf("building for all platforms is not supported for %s sources", def.Header["bootstrap"])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid image source: %v", err)
+	}
+
+	src, err := srcRef.NewImageSource(ctx, sourceSystemContext(opts, opts.TmpDir))
+	if err != nil {
+		return nil, fmt.Errorf("while opening image source: %w", err)
+	}
+	defer src.Close()
+	data, mediaType, err := fetchManifest(ctx, src, opts.ManifestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("while fetching manifest: %w", err)
+	}
+	if !manifest.MIMETypeIsMultiImage(mediaType) {
+		return nil, fmt.Errorf("%s is not an image index, it has a single platform", ref)
+	}
+	list, err := manifest.ListFromBlob(data, mediaType)
+	if err != nil {
+		return nil, fmt.Errorf("while decoding image index: %w", err)
+	}
+
+	var platforms []string
+	seen := make(map[string]bool)
+	for _, d := range list.Instances() {
+		instance, err := list.Instance(d)
+		if err != nil {
+			return nil, err
+		}
+		p := instance.ReadOnly.Platform
+		if p == nil || p.OS != "linux" {
+			continue
+		}
+		s := p.OS + "/" + p.Architecture
+		if p.Variant != "" {
+			s += "/" + p.Variant
+		}
+		if !seen[s] {
+			seen[s] = true
+			platforms = append(platforms, s)
+		}
+	}
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("no linux image in the image index of %s", ref)
+	}
+	return platforms, nil
+}
+
+// selectPlatformInstance returns the digest of the image of list matching
+// the wanted platform best. An image matches when its OS and architecture
+// are the wanted ones, its variant runs on the wanted variant and its OS
+// features are all wanted; an image without platform matches any.
+func selectPlatformInstance(list manifest.List, want imgspecv1.Platform) (digest.Digest, error) {
+	var best digest.Digest
+	bestRank := -1
+	var available []string
+
+	for _, d := range list.Instances() {
+		instance, err := list.Instance(d)
+		if err != nil {
+			return "", err
+		}
+		rank := len(variantCompatibility[want.Architecture]) + 2
+		if p := instance.ReadOnly.Platform; p != nil {
+			available = append(available, platformString(*p))
+			var ok bool
+			if rank, ok = platformRank(*p, want); !ok {
+				continue
+			}
+		}
+		if bestRank < 0 || rank < bestRank {
+			best, bestRank = d, rank
+		}
+	}
+
+	if bestRank < 0 {
+		return "", fmt.Errorf("no image in the index matches the %s platform, available: %s", platformString(want), strings.Join(available, ", "))
+	}
+	return best, nil
+}
+
+// platformRank returns whether the image platform p matches the wanted
+// platform, and the rank of its variant.
+func platformRank(p, want imgspecv1.Platform) (int, bool) {
+	if p.OS != want.OS || p.Architecture != want.Architecture {
+		return 0, false
+	}
+	for _, f := range p.OSFeatures {
+		found := false
+		for _, w := range want.OSFeatures {
+			found = found || f == w
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return variantRank(want.Architecture, want.Variant, p.Variant)
+}
+
+// platformReference is an image reference resolving an image index to the
+// image matching the wanted platform, selected with selectPlatformInstance.
+// The references to a single image are left as is.
+type platformReference struct {
+	types.ImageReference
+	want imgspecv1.Platform
+}
+
+func newPlatformReference(ref types.ImageReference, want imgspecv1.Platform) *platformReference {
+	return &platformReference{ImageReference: ref, want: want}
+}
+
+// Unwrap returns the underlying image reference.
+func (r *platformReference) Unwrap() types.ImageReference {
+	return r.ImageReference
+}
+
+// NewImageSource returns an image source whose manifest is the one of the
+// selected image when the reference points to an image index.
+func (r *platformReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	data, mediaType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	if !manifest.MIMETypeIsMultiImage(mediaType) {
+		return src, nil
+	}
+
+	list, err := manifest.ListFromBlob(data, mediaType)
+	if err == nil {
+		var d digest.Digest
+		if d, err = selectPlatformInstance(list, r.want); err == nil {
+			sylog.Debugf("Selected image %s of the index for the %s platform", d, platformString(r.want))
+			return &platformSource{ImageSource: src, ref: instanceReference{ImageReference: r.ImageReference, instance: d}}, nil
+		}
+	}
+	src.Close()
+	return nil, err
+}
+
+// NewImage returns the image of the selected image source.
+func (r *platformReference) NewImage(ctx context.Context, sys *types.SystemContext) (types.ImageCloser, error) {
+	src, err := r.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return image.FromSource(ctx, sys, src)
+}
+
+// platformSource is an image source of an image index returning the
+// manifest of the selected image as its own.
+type platformSource struct {
+	types.ImageSource
+	ref instanceReference
+}
+
+func (s *platformSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *platformSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	if instanceDigest == nil {
+		instanceDigest = &s.ref.instance
+	}
+	return s.ImageSource.GetManifest(ctx, instanceDigest)
+}
+
+// instanceReference is the reference of the image instance of an image
+// index.
+type instanceReference struct {
+	types.ImageReference
+	instance digest.Digest
+}
+
+// DockerReference returns the docker reference of the index, pinned to the
+// digest of the instance when the index one is pinned, for the digest of
+// the manifest to be checked against the instance.
+func (r instanceReference) DockerReference() reference.Named {
+	named := r.ImageReference.DockerReference()
+	if _, ok := named.(reference.Digested); !ok {
+		return named
+	}
+	pinned, err := reference.WithDigest(reference.TrimNamed(named), r.instance)
+	if err != nil {
+		return named
+	}
+	return pinned
+}
@@ -0,0 +1,492 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/manifest"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/signature"
+	digest "github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// getOCILayout runs the OCI conveyor Get step on img stored as an OCI
+// layout, with a bundle configured by configure.
+func getOCILayout(t *testing.T, img *testImage, configure func(*sytypes.Bundle)) (*OCIConveyorPacker, error) {
+	t.Helper()
+
+	dir := t.TempDir()
+	img.writeLayout(t, dir, "test")
+
+	b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("while creating bundle: %s", err)
+	}
+	t.Cleanup(func() { b.Remove() })
+
+	b.Recipe, err = sytypes.NewDefinitionFromURI("oci:" + dir + ":test")
+	if err != nil {
+		t.Fatalf("while parsing URI: %s", err)
+	}
+	b.Opts.NoCache = true
+	if configure != nil {
+		configure(b)
+	}
+
+	cp := &OCIConveyorPacker{}
+	err = cp.Get(context.Background(), b)
+	return cp, err
+}
+
+func TestOCIConveyorPackerPlatform(t *testing.T) {
+	layer := makeLayer(t, tarEntry{name: "file", body: "content"})
+	otherArch := "arm64"
+	if runtime.GOARCH == otherArch {
+		otherArch = "amd64"
+	}
+
+	tests := []struct {
+		name           string
+		os             string
+		arch           string
+		ignorePlatform bool
+		wantError      string
+	}{
+		{
+			name: "matching platform",
+			os:   "linux",
+			arch: runtime.GOARCH,
+		},
+		{
+			name: "undeclared platform",
+		},
+		{
+			name:      "windows image",
+			os:        "windows",
+			arch:      runtime.GOARCH,
+			wantError: "only linux images are supported",
+		},
+		{
+			name:      "foreign architecture",
+			os:        "linux",
+			arch:      otherArch,
+			wantError: "image is built for the " + otherArch + " architecture",
+		},
+		{
+			name:           "foreign architecture ignored",
+			os:             "linux",
+			arch:           otherArch,
+			ignorePlatform: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := newTestImage(t, func(c *imgspecv1.Image) {
+				c.OS = tt.os
+				c.Architecture = tt.arch
+			}, layer)
+
+			cp, err := getOCILayout(t, img, func(b *sytypes.Bundle) {
+				b.Opts.IgnorePlatform = tt.ignorePlatform
+			})
+			if tt.wantError == "" && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			} else if tt.wantError != "" && (err == nil || !strings.Contains(err.Error(), tt.wantError)) {
+				t.Errorf("unexpected error: got %v, want %q", err, tt.wantError)
+			}
+
+			// the platform is checked before the layers are fetched
+			blob := filepath.Join(cp.b.TmpDir, "blobs", "sha256", img.manifest.Layers[0].Digest.Encoded())
+			if _, err := os.Stat(blob); (tt.wantError == "") == os.IsNotExist(err) {
+				t.Errorf("unexpected fetch of the layer: %v", err)
+			}
+		})
+	}
+}
+
+// platformImage is an image of an image index, for the platform.
+type platformImage struct {
+	img      *testImage
+	platform imgspecv1.Platform
+}
+
+// testIndex returns an image index of the images, and its encoding.
+func testIndex(t *testing.T, images []platformImage) (imgspecv1.Index, []byte) {
+	t.Helper()
+
+	index := imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+	}
+	for _, pi := range images {
+		platform := pi.platform
+		index.Manifests = append(index.Manifests, imgspecv1.Descriptor{
+			MediaType: imgspecv1.MediaTypeImageManifest,
+			Digest:    pi.img.manifestDigest,
+			Size:      int64(len(pi.img.manifestData)),
+			Platform:  &platform,
+		})
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("while encoding index: %s", err)
+	}
+	return index, data
+}
+
+// armImages returns images of several arm variants, whose config holds the
+// VARIANT variable set to their platform.
+func armImages(t *testing.T) []platformImage {
+	t.Helper()
+
+	platforms := []imgspecv1.Platform{
+		{OS: "linux", Architecture: "arm", Variant: "v6"},
+		{OS: "linux", Architecture: "arm", Variant: "v7", OSFeatures: []string{"sse4"}},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "windows", Architecture: "arm64", Variant: "v8"},
+	}
+	var images []platformImage
+	for _, p := range platforms {
+		p := p
+		img := newTestImage(t, func(c *imgspecv1.Image) {
+			c.Platform = p
+			c.Config.Env = append(c.Config.Env, "VARIANT="+platformString(p))
+		}, makeLayer(t, tarEntry{name: "file", body: platformString(p)}))
+		images = append(images, platformImage{img: img, platform: p})
+	}
+	return images
+}
+
+func TestSelectPlatformInstance(t *testing.T) {
+	images := armImages(t)
+	_, data := testIndex(t, images)
+	list, err := manifest.ListFromBlob(data, imgspecv1.MediaTypeImageIndex)
+	if err != nil {
+		t.Fatalf("while decoding index: %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		want      imgspecv1.Platform
+		wantImage int
+		wantError string
+	}{
+		{
+			name:      "exact variant",
+			want:      imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+			wantImage: 2,
+		},
+		{
+			name:      "older variant",
+			want:      imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v8"},
+			wantImage: 2,
+		},
+		{
+			name:      "os features",
+			want:      imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v7", OSFeatures: []string{"sse4"}},
+			wantImage: 1,
+		},
+		{
+			name:      "oldest variant",
+			want:      imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"},
+			wantImage: 0,
+		},
+		{
+			name:      "unknown variant",
+			want:      imgspecv1.Platform{OS: "linux", Architecture: "arm"},
+			wantImage: 0,
+		},
+		{
+			name:      "os",
+			want:      imgspecv1.Platform{OS: "windows", Architecture: "arm64", Variant: "v8"},
+			wantImage: 4,
+		},
+		{
+			name:      "no matching variant",
+			want:      imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v5"},
+			wantError: "no image in the index matches the linux/arm/v5 platform",
+		},
+		{
+			name:      "no matching architecture",
+			want:      imgspecv1.Platform{OS: "linux", Architecture: "amd64"},
+			wantError: "available: linux/arm/v6, linux/arm/v7 (os.features sse4)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := selectPlatformInstance(list, tt.want)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if want := images[tt.wantImage]; d != want.img.manifestDigest {
+				t.Errorf("unexpected image selected: %s, want the %s one", d, platformString(want.platform))
+			}
+		})
+	}
+}
+
+// writeIndexLayout writes the images as an OCI layout in dir, referenced
+// by an image index tagged with name.
+func writeIndexLayout(t *testing.T, dir, name string, images []platformImage) {
+	t.Helper()
+
+	for _, pi := range images {
+		pi.img.writeLayout(t, dir, name)
+	}
+	_, data := testIndex(t, images)
+	d := digest.FromBytes(data)
+	if err := os.WriteFile(filepath.Join(dir, "blobs", "sha256", d.Encoded()), data, 0o644); err != nil {
+		t.Fatalf("while writing index blob: %s", err)
+	}
+
+	index := imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{
+			{
+				MediaType:   imgspecv1.MediaTypeImageIndex,
+				Digest:      d,
+				Size:        int64(len(data)),
+				Annotations: map[string]string{imgspecv1.AnnotationRefName: name},
+			},
+		},
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("while encoding index: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), data, 0o644); err != nil {
+		t.Fatalf("while writing index: %s", err)
+	}
+}
+
+func TestOCIConveyorPackerIndexVariant(t *testing.T) {
+	images := armImages(t)
+	dir := t.TempDir()
+	writeIndexLayout(t, dir, "test", images)
+
+	tests := []struct {
+		name        string
+		arch        string
+		archVariant string
+		wantImage   int
+		wantError   string
+	}{
+		{name: "arch variant", arch: "arm32v7", wantImage: 2},
+		{name: "older arch variant", arch: "arm32v6", wantImage: 0},
+		{name: "variant override", arch: "arm32v7", archVariant: "6", wantImage: 0},
+		{name: "arm64", arch: "arm64v8", wantImage: 3},
+		{name: "no matching variant", arch: "arm32v5", wantError: "no image in the index matches the linux/arm/v5 platform"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+			if err != nil {
+				t.Fatalf("while creating bundle: %s", err)
+			}
+			t.Cleanup(func() { b.Remove() })
+			b.Recipe, err = sytypes.NewDefinitionFromURI("oci:" + dir + ":test")
+			if err != nil {
+				t.Fatalf("while parsing URI: %s", err)
+			}
+			b.Opts.NoCache = true
+			b.Opts.Arch = tt.arch
+			b.Opts.ArchVariant = tt.archVariant
+			b.Opts.BuildProvenance = true
+
+			cp := &OCIConveyorPacker{}
+			err = cp.Get(context.Background(), b)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			want := "VARIANT=" + platformString(images[tt.wantImage].platform)
+			found := false
+			for _, env := range cp.imgConfig.Env {
+				found = found || env == want
+			}
+			if !found {
+				t.Errorf("unexpected image selected: %v, want %s", cp.imgConfig.Env, want)
+			}
+			// the source digest is the one of the selected manifest
+			if d := cp.SourceDigest(); d != images[tt.wantImage].img.manifestDigest {
+				t.Errorf("unexpected source digest %s, want %s", d, images[tt.wantImage].img.manifestDigest)
+			}
+		})
+	}
+}
+
+func TestPlatformReferencePinnedIndex(t *testing.T) {
+	reg := newStubRegistry(t)
+	images := armImages(t)
+	for _, pi := range images {
+		reg.push("test/image", "", pi.img)
+	}
+	_, data := testIndex(t, images)
+	reg.pushManifest("test/image", "v1", imgspecv1.MediaTypeImageIndex, data)
+
+	// the digest of the selected manifest differs from the pinned one
+	src, _, err := parseDockerReference("//" + reg.host() + "/test/image:v1@" + digest.FromBytes(data).String())
+	if err != nil {
+		t.Fatalf("while parsing reference: %s", err)
+	}
+	ref := newPlatformReference(src, imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+
+	policyCtx, err := signature.NewPolicyContext(&signature.Policy{
+		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
+	})
+	if err != nil {
+		t.Fatalf("while creating policy context: %s", err)
+	}
+	dst, err := ocilayout.ParseReference(t.TempDir() + ":tmp")
+	if err != nil {
+		t.Fatalf("while parsing layout reference: %s", err)
+	}
+	if _, err := copy.Image(context.Background(), policyCtx, dst, ref, &copy.Options{SourceCtx: stubSysCtx()}); err != nil {
+		t.Fatalf("while copying image: %s", err)
+	}
+
+	img, err := dst.NewImage(context.Background(), stubSysCtx())
+	if err != nil {
+		t.Fatalf("while opening image: %s", err)
+	}
+	defer img.Close()
+	got, _, err := img.Manifest(context.Background())
+	if err != nil {
+		t.Fatalf("while getting manifest: %s", err)
+	}
+	if digest.FromBytes(got) != images[2].img.manifestDigest {
+		t.Errorf("unexpected image copied: %s", got)
+	}
+}
+
+func TestIndexPlatforms(t *testing.T) {
+	images := armImages(t)
+	dir := t.TempDir()
+	writeIndexLayout(t, dir, "test", images)
+	single := t.TempDir()
+	images[0].img.writeLayout(t, single, "test")
+
+	tests := []struct {
+		name      string
+		uri       string
+		want      []string
+		wantError string
+	}{
+		{name: "index", uri: "oci:" + dir + ":test", want: []string{"linux/arm/v6", "linux/arm/v7", "linux/arm64/v8"}},
+		{name: "single image", uri: "oci:" + single + ":test", wantError: "is not an image index"},
+		{name: "unsupported source", uri: "docker-archive:" + dir, wantError: "not supported for docker-archive sources"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			def, err := sytypes.NewDefinitionFromURI(tt.uri)
+			if err != nil {
+				t.Fatalf("while parsing URI: %s", err)
+			}
+			got, err := IndexPlatforms(context.Background(), def, sytypes.Options{TmpDir: t.TempDir()})
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected platforms:\n\thave: %v\n\twant: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOCIConveyorPackerPlatformOption(t *testing.T) {
+	var images []platformImage
+	for _, p := range []imgspecv1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	} {
+		p := p
+		img := newTestImage(t, func(c *imgspecv1.Image) {
+			c.Platform = p
+		}, makeLayer(t, tarEntry{name: "arch", body: p.Architecture}))
+		images = append(images, platformImage{img: img, platform: p})
+	}
+	dir := t.TempDir()
+	writeIndexLayout(t, dir, "test", images)
+
+	tests := []struct {
+		platform  string
+		want      string
+		wantError string
+	}{
+		{platform: "linux/amd64", want: "amd64"},
+		{platform: "linux/arm64/v8", want: "arm64"},
+		{platform: "linux/ppc64le", wantError: "no image in the index matches the linux/ppc64le platform"},
+		{platform: "arm64", wantError: "invalid platform"},
+		{platform: "windows/amd64", wantError: "only linux images are supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+			if err != nil {
+				t.Fatalf("while creating bundle: %s", err)
+			}
+			t.Cleanup(func() { b.Remove() })
+			b.Recipe, err = sytypes.NewDefinitionFromURI("oci:" + dir + ":test")
+			if err != nil {
+				t.Fatalf("while parsing URI: %s", err)
+			}
+			b.Opts.NoCache = true
+			b.Opts.Platform = tt.platform
+
+			cp := &OCIConveyorPacker{}
+			err = cp.Get(context.Background(), b)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if _, err := cp.Pack(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if data, err := os.ReadFile(filepath.Join(b.RootfsPath, "arch")); err != nil || string(data) != tt.want {
+				t.Errorf("unexpected rootfs content: %q, %v", data, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// rateLimiter limits the rate of the bytes read through it, across all of
+// the readers sharing it. A nil limiter doesn't limit anything.
+type rateLimiter struct {
+	// rate is the limit in bytes per second
+	rate int64
+
+	mu sync.Mutex
+	// next is the time at which the bytes read so far are within the limit
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes can be read within the limit, or ctx is
+// done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reader returns a reader reading from r within the limit.
+func (l *rateLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+// rateLimitedReader reads from r within the limit of limiter.
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// reads are kept small enough to smooth the rate over a second
+	max := int(r.limiter.rate / 4)
+	if max < 1 {
+		max = 1
+	}
+	if len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	if werr := r.limiter.wait(r.ctx, n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// rateLimitedReadCloser is a rate limited reader closing the underlying
+// stream.
+type rateLimitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// rateLimitedReference is an image reference whose manifest and blob
+// fetches are kept within the limit of a rate limiter.
+type rateLimitedReference struct {
+	types.ImageReference
+	limiter *rateLimiter
+}
+
+func newRateLimitedReference(ref types.ImageReference, limiter *rateLimiter) *rateLimitedReference {
+	return &rateLimitedReference{ImageReference: ref, limiter: limiter}
+}
+
+// Unwrap returns the underlying image reference.
+func (r *rateLimitedReference) Unwrap() types.ImageReference {
+	return r.ImageReference
+}
+
+// NewImageSource returns a rate limited image source.
+func (r *rateLimitedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimitedSource{ImageSource: src, limiter: r.limiter}, nil
+}
+
+// NewImage returns the image of a rate limited image source.
+func (r *rateLimitedReference) NewImage(ctx context.Context, sys *types.SystemContext) (types.ImageCloser, error) {
+	src, err := r.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return image.FromSource(ctx, sys, src)
+}
+
+// rateLimitedSource is an image source whose manifest and blob fetches are
+// kept within the limit of limiter.
+type rateLimitedSource struct {
+	types.ImageSource
+	limiter *rateLimiter
+}
+
+func (s *rateLimitedSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	data, mediaType, err := s.ImageSource.GetManifest(ctx, instanceDigest)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.limiter.wait(ctx, len(data)); err != nil {
+		return nil, "", err
+	}
+	return data, mediaType, nil
+}
+
+func (s *rateLimitedSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	rc, size, err := s.ImageSource.GetBlob(ctx, info, cache)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rateLimitedReadCloser{Reader: s.limiter.reader(ctx, rc), Closer: rc}, size, nil
+}
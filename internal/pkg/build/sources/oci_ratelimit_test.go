@@ -0,0 +1,123 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+)
+
+// measureRate reads r to the end and returns the number of bytes read and
+// the effective rate in bytes per second.
+func measureRate(t *testing.T, r io.Reader) ([]byte, float64) {
+	t.Helper()
+
+	start := time.Now()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("while reading: %s", err)
+	}
+	return data, float64(len(data)) / time.Since(start).Seconds()
+}
+
+func TestRateLimiterReader(t *testing.T) {
+	const rate = 64 << 10
+
+	body := make([]byte, 32<<10)
+	if _, err := rand.Read(body); err != nil {
+		t.Fatalf("while generating content: %s", err)
+	}
+
+	l := newRateLimiter(rate)
+	data, got := measureRate(t, l.reader(context.Background(), bytes.NewReader(body)))
+	if !bytes.Equal(data, body) {
+		t.Fatalf("unexpected content read")
+	}
+	if got > rate {
+		t.Errorf("effective rate %.0f B/s above the limit of %d B/s", got, rate)
+	}
+
+	// a nil limiter doesn't limit anything
+	var nl *rateLimiter
+	if r := nl.reader(context.Background(), bytes.NewReader(body)); r == nil {
+		t.Fatalf("nil reader returned")
+	}
+	if err := nl.wait(context.Background(), len(body)); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := newRateLimiter(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := l.wait(ctx, 1<<20)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRateLimitedReference(t *testing.T) {
+	const rate = 64 << 10
+
+	body := make([]byte, 48<<10)
+	if _, err := rand.Read(body); err != nil {
+		t.Fatalf("while generating layer content: %s", err)
+	}
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "large", body: string(body)}))
+	dir := t.TempDir()
+	img.writeLayout(t, dir, "v1")
+
+	base, err := ocilayout.ParseReference(dir + ":v1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ref := newRateLimitedReference(base, newRateLimiter(rate))
+	if ref.Unwrap() != base {
+		t.Errorf("unexpected unwrapped reference")
+	}
+
+	src, err := ref.NewImageSource(context.Background(), stubSysCtx())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer src.Close()
+
+	data, _, err := src.GetManifest(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(data, img.manifestData) {
+		t.Errorf("unexpected manifest fetched")
+	}
+
+	layer := img.manifest.Layers[0]
+	rc, _, err := src.GetBlob(context.Background(), types.BlobInfo{Digest: layer.Digest, Size: layer.Size}, none.NoCache)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer rc.Close()
+	blob, got := measureRate(t, rc)
+	if !bytes.Equal(blob, img.blobs[layer.Digest]) {
+		t.Fatalf("unexpected blob content")
+	}
+	if got > rate {
+		t.Errorf("effective rate %.0f B/s above the limit of %d B/s", got, rate)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/apptainer/apptainer/internal/pkg/client/notary"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/types"
+)
+
+// dockerPinnedRef holds a docker reference given in the name:tag@digest form.
+type dockerPinnedRef struct {
+	// tagged is the reference without the digest, used to resolve the tag.
+	tagged reference.NamedTagged
+	// canonical is the reference without the tag, used to fetch the image.
+	canonical reference.Canonical
+}
+
+// parseDockerReference parses a docker transport reference (without the
+// leading '//'). The name:tag@digest form isn't supported by containers/image,
+// in that case the returned image reference is pinned to the digest and the
+// tag information is returned so it can be checked against the digest.
+func parseDockerReference(ref string) (types.ImageReference, *dockerPinnedRef, error) {
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(ref, "//"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tagged, isTagged := named.(reference.NamedTagged)
+	canonical, isDigested := named.(reference.Canonical)
+	if !isTagged || !isDigested {
+		srcRef, err := docker.NewReference(reference.TagNameOnly(named))
+		return srcRef, nil, err
+	}
+
+	pinned := &dockerPinnedRef{}
+	pinned.tagged, err = reference.WithTag(reference.TrimNamed(named), tagged.Tag())
+	if err != nil {
+		return nil, nil, err
+	}
+	pinned.canonical, err = reference.WithDigest(reference.TrimNamed(named), canonical.Digest())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	srcRef, err := docker.NewReference(pinned.canonical)
+	return srcRef, pinned, err
+}
+
+// namesRegistry reports whether the docker reference name starts with its
+// registry host, detected as the reference parser does.
+func namesRegistry(name string) bool {
+	host, _, ok := strings.Cut(name, "/")
+	return ok && (strings.ContainsAny(host, ".:") || host == "localhost")
+}
+
+// DefaultRegistryReference returns the docker transport reference ref
+// resolved from registry, a registry host with an optional port and
+// repository prefix, when it doesn't name its registry, e.g. ubuntu:22.04
+// from quay.io is quay.io/ubuntu:22.04. Unlike with a pull-through cache of
+// Docker Hub, the library namespace isn't added to the official images. A
+// reference naming its registry is returned as is.
+func DefaultRegistryReference(ref, registry string) (string, error) {
+	name := strings.TrimPrefix(ref, "//")
+	if namesRegistry(name) {
+		return ref, nil
+	}
+	registry = strings.Trim(strings.TrimPrefix(registry, "https://"), "/")
+	if !namesRegistry(registry + "/") {
+		return "", fmt.Errorf("invalid default pull registry %q: should be a registry host", registry)
+	}
+	if _, err := reference.ParseNormalizedNamed(registry + "/" + name); err != nil {
+		return "", fmt.Errorf("invalid reference %s from the default pull registry %s: %s", name, registry, err)
+	}
+	sylog.Debugf("Resolving %s from the default pull registry %s", name, registry)
+	return "//" + registry + "/" + name, nil
+}
+
+// pullThroughCacheReference returns the docker transport reference ref
+// resolved through the pull-through cache of Docker Hub at cache, a
+// registry host with an optional port and repository prefix, e.g.
+// cache.example.com:5000/dockerhub. A reference naming its registry is
+// returned as is.
+func pullThroughCacheReference(ref, cache string) (string, error) {
+	name := strings.TrimPrefix(ref, "//")
+	if namesRegistry(name) {
+		return ref, nil
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", err
+	}
+
+	cache = strings.Trim(strings.TrimPrefix(cache, "https://"), "/")
+	cached := cache + "/" + strings.TrimPrefix(named.String(), reference.Domain(named)+"/")
+	if _, err := reference.ParseNamed(cached); err != nil {
+		return "", fmt.Errorf("invalid pull-through cache %q: %s", cache, err)
+	}
+	sylog.Debugf("Resolving %s through the pull-through cache %s", reference.FamiliarString(named), cache)
+	return "//" + cached, nil
+}
+
+// checkAllowedRegistry checks that the registry of the docker transport
+// reference ref matches one of the allowed registry patterns, before any
+// request is sent to it.
+func checkAllowedRegistry(ref string, patterns []string) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(ref, "//"))
+	if err != nil {
+		return err
+	}
+	return sytypes.CheckRegistryAllowed(patterns, reference.Domain(named), reference.FamiliarString(named))
+}
+
+// verify checks that the tag of the pinned reference still resolves to
+// the pinned digest.
+func (p *dockerPinnedRef) verify(ctx context.Context, sysCtx *types.SystemContext) error {
+	tagRef, err := docker.NewReference(p.tagged)
+	if err != nil {
+		return err
+	}
+	d, err := docker.GetDigest(ctx, sysCtx, tagRef)
+	if err != nil {
+		return fmt.Errorf("while resolving tag %s: %w", reference.FamiliarString(p.tagged), err)
+	}
+	if d != p.canonical.Digest() {
+		return fmt.Errorf("tag %s no longer points at digest %s (now %s)", reference.FamiliarString(p.tagged), p.canonical.Digest(), d)
+	}
+	return nil
+}
+
+// trustedDockerReference resolves the tag of a docker transport reference
+// through its Docker Content Trust data, and returns the image reference
+// pinned to the signed manifest digest. A reference given by digest only is
+// content addressed, and is returned as is.
+func trustedDockerReference(ctx context.Context, ref string, opts sytypes.Options, sysCtx *types.SystemContext) (types.ImageReference, error) {
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(ref, "//"))
+	if err != nil {
+		return nil, err
+	}
+	named = reference.TagNameOnly(named)
+
+	tagged, ok := named.(reference.NamedTagged)
+	if !ok {
+		sylog.Debugf("%s is referenced by digest, no tag to verify", reference.FamiliarString(named))
+		return docker.NewReference(named)
+	}
+	tagName := reference.FamiliarName(named) + ":" + tagged.Tag()
+
+	cfg := notary.Config{
+		Server:   opts.ContentTrustServer,
+		TrustDir: opts.ContentTrustDir,
+	}
+	if cfg.Server == "" {
+		cfg.Server = notary.DefaultServer(named)
+	}
+	if cfg.TrustDir == "" {
+		cfg.TrustDir = notary.DefaultTrustDir()
+	}
+	if opts.DockerAuthConfig != nil {
+		cfg.Username = opts.DockerAuthConfig.Username
+		cfg.Password = opts.DockerAuthConfig.Password
+	}
+	if sysCtx.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue {
+		cfg.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+			},
+		}
+	}
+
+	d, err := notary.ResolveTag(ctx, cfg, named.Name(), tagged.Tag())
+	if err != nil {
+		return nil, fmt.Errorf("while resolving tag %s: %w", tagName, err)
+	}
+	if canonical, ok := named.(reference.Canonical); ok && canonical.Digest() != d {
+		return nil, fmt.Errorf("tag %s is signed for digest %s, not %s", tagName, d, canonical.Digest())
+	}
+	sylog.Infof("Tag %s is signed for digest %s", tagName, d)
+
+	signed, err := reference.WithDigest(reference.TrimNamed(named), d)
+	if err != nil {
+		return nil, err
+	}
+	return docker.NewReference(signed)
+}
+
+// sharedSourceReference is an image reference whose image source is opened
+// once, and shared by all of the users of the reference until closed. A
+// docker image source caches the bearer tokens it obtains from the registry
+// until they expire, so sharing it avoids negotiating a new token for each
+// of the manifest and blob fetches of a build.
+type sharedSourceReference struct {
+	types.ImageReference
+
+	mu  sync.Mutex
+	src types.ImageSource
+}
+
+func newSharedSourceReference(ref types.ImageReference) *sharedSourceReference {
+	return &sharedSourceReference{ImageReference: ref}
+}
+
+// Unwrap returns the underlying image reference.
+func (r *sharedSourceReference) Unwrap() types.ImageReference {
+	return r.ImageReference
+}
+
+// NewImageSource returns the shared image source, opening it on first use.
+// Closing the returned source has no effect, the shared source is closed
+// by Close.
+func (r *sharedSourceReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.src == nil {
+		src, err := r.ImageReference.NewImageSource(ctx, sys)
+		if err != nil {
+			return nil, err
+		}
+		r.src = src
+	}
+	return sharedSource{r.src}, nil
+}
+
+// NewImage returns the image of the shared image source.
+func (r *sharedSourceReference) NewImage(ctx context.Context, sys *types.SystemContext) (types.ImageCloser, error) {
+	src, err := r.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return image.FromSource(ctx, sys, src)
+}
+
+// Close closes the shared image source, a subsequent use of the reference
+// opens a new one.
+func (r *sharedSourceReference) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.src == nil {
+		return nil
+	}
+	err := r.src.Close()
+	r.src = nil
+	return err
+}
+
+// sharedSource is an image source which isn't closed by its users.
+type sharedSource struct {
+	types.ImageSource
+}
+
+func (sharedSource) Close() error {
+	return nil
+}
@@ -0,0 +1,670 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/cache"
+	testNotary "github.com/apptainer/apptainer/internal/pkg/test/tool/notary"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/util/apptainerconf"
+	"github.com/containers/image/v5/copy"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func stubSysCtx() *types.SystemContext {
+	return &types.SystemContext{
+		DockerInsecureSkipTLSVerify: types.NewOptionalBool(true),
+		OSChoice:                    "linux",
+		ArchitectureChoice:          "amd64",
+	}
+}
+
+func TestParseDockerReference(t *testing.T) {
+	d := digest.FromString("test").String()
+
+	tests := []struct {
+		name      string
+		ref       string
+		wantRef   string
+		wantPin   bool
+		wantError bool
+	}{
+		{
+			name:    "name only",
+			ref:     "//alpine",
+			wantRef: "docker://alpine:latest",
+		},
+		{
+			name:    "tag",
+			ref:     "//alpine:3.18",
+			wantRef: "docker://alpine:3.18",
+		},
+		{
+			name:    "digest",
+			ref:     "//alpine@" + d,
+			wantRef: "docker://alpine@" + d,
+		},
+		{
+			name:    "tag and digest",
+			ref:     "//alpine:3.18@" + d,
+			wantRef: "docker://alpine@" + d,
+			wantPin: true,
+		},
+		{
+			name:    "nested repository with port",
+			ref:     "//registry.example.com:5000/team/project/subpath/image:tag",
+			wantRef: "docker://registry.example.com:5000/team/project/subpath/image:tag",
+		},
+		{
+			name:    "nested repository with port, tag and digest",
+			ref:     "//registry.example.com:5000/team/project/subpath/image:3.18@" + d,
+			wantRef: "docker://registry.example.com:5000/team/project/subpath/image@" + d,
+			wantPin: true,
+		},
+		{
+			name:    "localhost with port",
+			ref:     "//localhost:5000/team/image",
+			wantRef: "docker://localhost:5000/team/image:latest",
+		},
+		{
+			name:      "bad digest",
+			ref:       "//alpine:3.18@sha256:abc",
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, pinned, err := parseDockerReference(tt.ref)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("unexpected success")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := transports.ImageName(ref); got != tt.wantRef {
+				t.Errorf("unexpected reference: got %s, want %s", got, tt.wantRef)
+			}
+			if (pinned != nil) != tt.wantPin {
+				t.Fatalf("unexpected pinned reference: %v", pinned)
+			}
+			if pinned != nil && pinned.tagged.Tag() != "3.18" {
+				t.Errorf("unexpected pinned tag: %s", pinned.tagged.Tag())
+			}
+		})
+	}
+}
+
+func TestDockerPinnedRefVerify(t *testing.T) {
+	reg := newStubRegistry(t)
+
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	reg.push("test/image", "v1", img)
+	other := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "other"}))
+	reg.push("test/image", "v2", other)
+
+	tests := []struct {
+		name      string
+		tag       string
+		digest    digest.Digest
+		wantError string
+	}{
+		{
+			name:   "matching tag and digest",
+			tag:    "v1",
+			digest: img.manifestDigest,
+		},
+		{
+			name:      "tag moved to another digest",
+			tag:       "v2",
+			digest:    img.manifestDigest,
+			wantError: "no longer points at digest",
+		},
+		{
+			name:      "unknown tag",
+			tag:       "v3",
+			digest:    img.manifestDigest,
+			wantError: "while resolving tag",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref := "//" + reg.host() + "/test/image:" + tt.tag + "@" + tt.digest.String()
+			_, pinned, err := parseDockerReference(ref)
+			if err != nil {
+				t.Fatalf("while parsing %s: %s", ref, err)
+			}
+
+			err = pinned.verify(context.Background(), stubSysCtx())
+			if tt.wantError == "" && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			} else if tt.wantError != "" && (err == nil || !strings.Contains(err.Error(), tt.wantError)) {
+				t.Errorf("unexpected error: got %v, want %q", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestDockerReferenceNestedRepository(t *testing.T) {
+	reg := newStubRegistry(t)
+
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	reg.push("team/project/subpath/image", "tag", img)
+
+	// the registry host holds the port of the stub registry
+	repo := "//" + reg.host() + "/team/project/subpath/image"
+	tests := []struct {
+		name string
+		ref  string
+	}{
+		{name: "tag", ref: repo + ":tag"},
+		{name: "digest", ref: repo + "@" + img.manifestDigest.String()},
+		{name: "tag and digest", ref: repo + ":tag@" + img.manifestDigest.String()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, pinned, err := parseDockerReference(tt.ref)
+			if err != nil {
+				t.Fatalf("while parsing %s: %s", tt.ref, err)
+			}
+			if pinned != nil {
+				if err := pinned.verify(context.Background(), stubSysCtx()); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+
+			src, err := ref.NewImageSource(context.Background(), stubSysCtx())
+			if err != nil {
+				t.Fatalf("while creating image source: %s", err)
+			}
+			defer src.Close()
+			data, _, err := fetchManifest(context.Background(), src, 0)
+			if err != nil {
+				t.Fatalf("while fetching manifest: %s", err)
+			}
+			if d := digest.FromBytes(data); d != img.manifestDigest {
+				t.Errorf("unexpected manifest %s, want %s", d, img.manifestDigest)
+			}
+		})
+	}
+}
+
+func TestPullThroughCacheReference(t *testing.T) {
+	d := digest.FromString("test").String()
+
+	tests := []struct {
+		name      string
+		ref       string
+		cache     string
+		wantRef   string
+		wantError string
+	}{
+		{
+			name:    "official image",
+			ref:     "//ubuntu",
+			cache:   "cache.example.com",
+			wantRef: "//cache.example.com/library/ubuntu",
+		},
+		{
+			name:    "user image with tag",
+			ref:     "//library/ubuntu:22.04",
+			cache:   "cache.example.com:5000/dockerhub/",
+			wantRef: "//cache.example.com:5000/dockerhub/library/ubuntu:22.04",
+		},
+		{
+			name:    "tag and digest",
+			ref:     "//team/image:v1@" + d,
+			cache:   "https://cache.example.com",
+			wantRef: "//cache.example.com/team/image:v1@" + d,
+		},
+		{
+			name:    "explicit docker hub",
+			ref:     "//docker.io/library/ubuntu",
+			cache:   "cache.example.com",
+			wantRef: "//docker.io/library/ubuntu",
+		},
+		{
+			name:    "explicit registry with port",
+			ref:     "//registry.example.com:5000/team/image:v1",
+			cache:   "cache.example.com",
+			wantRef: "//registry.example.com:5000/team/image:v1",
+		},
+		{
+			name:    "localhost",
+			ref:     "//localhost/team/image",
+			cache:   "cache.example.com",
+			wantRef: "//localhost/team/image",
+		},
+		{
+			name:      "cache without registry host",
+			ref:       "//ubuntu",
+			cache:     "cache",
+			wantError: `invalid pull-through cache "cache"`,
+		},
+		{
+			name:      "bad reference",
+			ref:       "//Ubuntu",
+			cache:     "cache.example.com",
+			wantError: "must be lowercase",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := pullThroughCacheReference(tt.ref, tt.cache)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if ref != tt.wantRef {
+				t.Errorf("unexpected reference: got %s, want %s", ref, tt.wantRef)
+			}
+		})
+	}
+
+	// the manifest is resolved through the cache
+	reg := newStubRegistry(t)
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	reg.push("dockerhub/library/alpine", "3.18", img)
+
+	cached, err := pullThroughCacheReference("//alpine:3.18", reg.host()+"/dockerhub")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ref, _, err := parseDockerReference(cached)
+	if err != nil {
+		t.Fatalf("while parsing %s: %s", cached, err)
+	}
+	src, err := ref.NewImageSource(context.Background(), stubSysCtx())
+	if err != nil {
+		t.Fatalf("while creating image source: %s", err)
+	}
+	defer src.Close()
+	data, _, err := fetchManifest(context.Background(), src, 0)
+	if err != nil {
+		t.Fatalf("while fetching manifest: %s", err)
+	}
+	if digest.FromBytes(data) != img.manifestDigest {
+		t.Errorf("unexpected manifest fetched through the cache")
+	}
+}
+
+func TestDefaultRegistryReference(t *testing.T) {
+	tests := []struct {
+		name      string
+		ref       string
+		registry  string
+		wantRef   string
+		wantError string
+	}{
+		{
+			name:     "official image",
+			ref:      "//ubuntu:22.04",
+			registry: "quay.io",
+			wantRef:  "//quay.io/ubuntu:22.04",
+		},
+		{
+			name:     "repository prefix",
+			ref:      "//team/image",
+			registry: "https://registry.example.com:5000/mirror/",
+			wantRef:  "//registry.example.com:5000/mirror/team/image",
+		},
+		{
+			name:     "docker hub",
+			ref:      "//ubuntu",
+			registry: "docker.io",
+			wantRef:  "//docker.io/ubuntu",
+		},
+		{
+			name:     "explicit registry",
+			ref:      "//ghcr.io/team/image:v1",
+			registry: "quay.io",
+			wantRef:  "//ghcr.io/team/image:v1",
+		},
+		{
+			name:      "registry without host",
+			ref:       "//ubuntu",
+			registry:  "mirror",
+			wantError: `invalid default pull registry "mirror"`,
+		},
+		{
+			name:      "bad reference",
+			ref:       "//Ubuntu",
+			registry:  "quay.io",
+			wantError: "invalid reference Ubuntu",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := DefaultRegistryReference(tt.ref, tt.registry)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if ref != tt.wantRef {
+				t.Errorf("unexpected reference: got %s, want %s", ref, tt.wantRef)
+			}
+		})
+	}
+
+	// the short names of the definitions are resolved from the default
+	// registry of the remote, before the pull-through cache
+	for _, tt := range []struct {
+		from    string
+		header  map[string]string
+		opts    sytypes.Options
+		wantRef string
+	}{
+		{from: "ubuntu", opts: sytypes.Options{DefaultRegistry: "site.example.com"}, wantRef: "//site.example.com/ubuntu"},
+		{from: "ubuntu", opts: sytypes.Options{DefaultRegistry: "site.example.com", PullThroughCache: "cache.example.com"}, wantRef: "//site.example.com/ubuntu"},
+		{from: "ubuntu", opts: sytypes.Options{PullThroughCache: "cache.example.com"}, wantRef: "//cache.example.com/library/ubuntu"},
+		{from: "ubuntu", header: map[string]string{"registry": "quay.io"}, opts: sytypes.Options{DefaultRegistry: "site.example.com"}, wantRef: "quay.io/ubuntu"},
+		{from: "ubuntu", opts: sytypes.Options{DefaultRegistry: "site.example.com", AllowedRegistries: []string{"*.example.com"}}, wantRef: "//site.example.com/ubuntu"},
+	} {
+		def := sytypes.Definition{Header: map[string]string{"bootstrap": "docker", "from": tt.from}}
+		for k, v := range tt.header {
+			def.Header[k] = v
+		}
+		ref, err := definitionReference(def, tt.opts)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if ref != tt.wantRef {
+			t.Errorf("unexpected reference of %v with %+v: got %s, want %s", def.Header, tt.opts, ref, tt.wantRef)
+		}
+	}
+}
+
+func TestAllowedRegistries(t *testing.T) {
+	reg := newStubRegistry(t)
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	reg.push("test/image", "v1", img)
+
+	tests := []struct {
+		name      string
+		from      string
+		pullCache string
+		allowed   []string
+		// configured are the allowed registries of the configuration
+		configured []string
+		wantError  string
+	}{
+		{name: "no allow-list", from: reg.host() + "/test/image:v1"},
+		{name: "allowed host on any port", from: reg.host() + "/test/image:v1", allowed: []string{"docker.io", "127.0.0.1"}},
+		{name: "allowed host and port", from: reg.host() + "/test/image:v1", allowed: []string{reg.host()}},
+		{name: "allowed wildcard", from: reg.host() + "/test/image:v1", allowed: []string{"127.0.0.*"}},
+		{name: "disallowed", from: reg.host() + "/test/image:v1", allowed: []string{"*.example.com"}, wantError: "registry not allowed: " + reg.host()},
+		{name: "disallowed port", from: reg.host() + "/test/image:v1", allowed: []string{"127.0.0.1:1"}, wantError: "registry not allowed"},
+		{name: "docker hub", from: "alpine", allowed: []string{"quay.io"}, wantError: "registry not allowed: docker.io of alpine"},
+		// the registry checked is the one of the pull-through cache
+		{name: "pull-through cache", from: "alpine", pullCache: "cache.example.com", allowed: []string{"docker.io"}, wantError: "registry not allowed: cache.example.com"},
+		{name: "invalid pattern", from: "alpine", allowed: []string{"docker.io/library"}, wantError: "invalid allowed registry"},
+		// the configuration applies without the build option
+		{name: "configured", from: reg.host() + "/test/image:v1", configured: []string{"127.0.0.1"}},
+		{name: "disallowed by configuration", from: "alpine", configured: []string{"quay.io"}, wantError: "registry not allowed: docker.io of alpine"},
+		{name: "option over configuration", from: reg.host() + "/test/image:v1", allowed: []string{"127.0.0.1"}, configured: []string{"127.0.0.*"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAllowedRegistries(t, tt.configured)
+
+			before := reg.count("/v2/")
+			_, err := getDockerSource(t, tt.from, func(b *sytypes.Bundle) {
+				b.Opts.PullThroughCache = tt.pullCache
+				b.Opts.AllowedRegistries = tt.allowed
+			})
+			if tt.wantError == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+			}
+			var serr *sytypes.SourceError
+			if !errors.As(err, &serr) || serr.Type != sytypes.SourceErrorReference {
+				t.Errorf("unexpected error type: %#v", err)
+			}
+			// the source is rejected before any request
+			if n := reg.count("/v2/") - before; n != 0 {
+				t.Errorf("unexpected %d requests to the registry", n)
+			}
+		})
+	}
+}
+
+func TestTrustedDockerReference(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2}`)
+	signed := digest.FromBytes(manifest)
+	other := digest.FromString("other")
+
+	srv := testNotary.NewServer(t)
+	srv.Sign("registry.example.com/test/image", "v1", manifest)
+
+	tests := []struct {
+		name      string
+		ref       string
+		wantRef   string
+		wantError string
+	}{
+		{
+			name:    "signed tag",
+			ref:     "//registry.example.com/test/image:v1",
+			wantRef: "docker://registry.example.com/test/image@" + signed.String(),
+		},
+		{
+			name:    "signed tag and digest",
+			ref:     "//registry.example.com/test/image:v1@" + signed.String(),
+			wantRef: "docker://registry.example.com/test/image@" + signed.String(),
+		},
+		{
+			name:    "digest only",
+			ref:     "//registry.example.com/test/image@" + other.String(),
+			wantRef: "docker://registry.example.com/test/image@" + other.String(),
+		},
+		{
+			name:      "signed tag and other digest",
+			ref:       "//registry.example.com/test/image:v1@" + other.String(),
+			wantError: "is signed for digest",
+		},
+		{
+			name:      "unsigned tag",
+			ref:       "//registry.example.com/test/image:v2",
+			wantError: "no signed trust data",
+		},
+		{
+			name:      "unsigned image",
+			ref:       "//registry.example.com/test/other:v1",
+			wantError: "no signed trust data",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := sytypes.Options{
+				ContentTrust:       true,
+				ContentTrustServer: srv.URL,
+				ContentTrustDir:    t.TempDir(),
+			}
+			ref, err := trustedDockerReference(context.Background(), tt.ref, opts, stubSysCtx())
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := transports.ImageName(ref); got != tt.wantRef {
+				t.Errorf("unexpected reference: got %s, want %s", got, tt.wantRef)
+			}
+		})
+	}
+}
+
+func TestSharedSourceReferenceTokens(t *testing.T) {
+	reg := newStubRegistry(t)
+	reg.handler = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path == "/token" {
+			fmt.Fprint(w, `{"token":"stub-token","expires_in":300}`)
+			return true
+		}
+		if r.Header.Get("Authorization") != "Bearer stub-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+reg.URL+`/token",service="stub"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return true
+		}
+		return false
+	}
+
+	img := newTestImage(t, nil,
+		makeLayer(t, tarEntry{name: "one", body: "1"}),
+		makeLayer(t, tarEntry{name: "two", body: "2"}),
+		makeLayer(t, tarEntry{name: "three", body: "3"}),
+	)
+	reg.push("test/image", "v1", img)
+
+	policyCtx, err := signature.NewPolicyContext(&signature.Policy{
+		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
+	})
+	if err != nil {
+		t.Fatalf("while creating policy context: %s", err)
+	}
+
+	// fetch the image and its config, as done by the oci conveyor
+	build := func(ref types.ImageReference) {
+		sysCtx := stubSysCtx()
+		dst, err := ocilayout.ParseReference(t.TempDir() + ":tmp")
+		if err != nil {
+			t.Fatalf("while parsing layout reference: %s", err)
+		}
+		if _, err := copy.Image(context.Background(), policyCtx, dst, ref, &copy.Options{SourceCtx: sysCtx}); err != nil {
+			t.Fatalf("while copying image: %s", err)
+		}
+		i, err := ref.NewImage(context.Background(), sysCtx)
+		if err != nil {
+			t.Fatalf("while opening image: %s", err)
+		}
+		defer i.Close()
+		if _, err := i.OCIConfig(context.Background()); err != nil {
+			t.Fatalf("while getting config: %s", err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		shared     bool
+		wantTokens int
+	}{
+		{name: "without cache", shared: false, wantTokens: 2},
+		{name: "with cache", shared: true, wantTokens: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, _, err := parseDockerReference("//" + reg.host() + "/test/image:v1")
+			if err != nil {
+				t.Fatalf("while parsing reference: %s", err)
+			}
+			if tt.shared {
+				shared := newSharedSourceReference(ref)
+				defer shared.Close()
+				ref = shared
+			}
+
+			before := reg.count("/token")
+			build(ref)
+			if got := reg.count("/token") - before; got != tt.wantTokens {
+				t.Errorf("got %d token requests, expected %d", got, tt.wantTokens)
+			}
+		})
+	}
+}
+
+// setAllowedRegistries sets the allowed registries of the current
+// configuration for the duration of the test.
+func setAllowedRegistries(t *testing.T, patterns []string) {
+	t.Helper()
+
+	prev := apptainerconf.GetCurrentConfig()
+	cfg, err := apptainerconf.Parse("")
+	if err != nil {
+		t.Fatalf("while parsing default configuration: %s", err)
+	}
+	cfg.AllowedRegistries = patterns
+	apptainerconf.SetCurrentConfig(cfg)
+	t.Cleanup(func() { apptainerconf.SetCurrentConfig(prev) })
+}
+
+func TestAllowedRegistriesSIFSources(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+		cp   interface {
+			Get(context.Context, *sytypes.Bundle) error
+		}
+		allowed    []string
+		configured []string
+		wantError  string
+	}{
+		{name: "oras", uri: "oras://ghcr.io/org/image:v1", cp: &OrasConveyorPacker{}, allowed: []string{"docker.io"}, wantError: "registry not allowed: ghcr.io of ghcr.io/org/image:v1"},
+		{name: "oras configured", uri: "oras://ghcr.io/org/image:v1", cp: &OrasConveyorPacker{}, configured: []string{"docker.io"}, wantError: "registry not allowed: ghcr.io"},
+		{name: "library", uri: "library://library.example.com/entity/collection/image:v1", cp: &LibraryConveyorPacker{}, allowed: []string{"docker.io"}, wantError: "registry not allowed: library.example.com"},
+		{name: "library configured", uri: "library://library.example.com/entity/collection/image:v1", cp: &LibraryConveyorPacker{}, configured: []string{"docker.io"}, wantError: "registry not allowed: library.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+			if err != nil {
+				t.Fatalf("while creating bundle: %s", err)
+			}
+			t.Cleanup(func() { b.Remove() })
+			b.Recipe, err = sytypes.NewDefinitionFromURI(tt.uri)
+			if err != nil {
+				t.Fatalf("while parsing URI: %s", err)
+			}
+			b.Opts.ImgCache = &cache.Handle{}
+			b.Opts.AllowedRegistries = tt.allowed
+			setAllowedRegistries(t, tt.configured)
+
+			// the source is rejected before any request, the registries
+			// being unreachable
+			err = tt.cp.Get(context.Background(), b)
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/util/fs"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	umocilayer "github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/opencontainers/umoci/pkg/mtreefilter"
+	"github.com/vbatts/go-mtree"
+)
+
+// RepackRootfs adds the changes made to rootfs, since its extraction from
+// the image manifest prevManifest of the OCI layout layoutDir, as a new
+// layer of the image. Deleted paths are recorded as whiteouts. The layer,
+// config and manifest blobs are written to the layout, and the descriptor
+// of the new manifest is returned; the layout index is left unchanged.
+func RepackRootfs(ctx context.Context, layoutDir, rootfs string, prevManifest imgspecv1.Descriptor) (imgspecv1.Descriptor, error) {
+	mapOptions, err := unpackMapOptions()
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+
+	engineExt, err := umoci.OpenLayout(layoutDir)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error opening layout: %s", err)
+	}
+	defer engineExt.Close()
+	engine := casext.NewEngine(engineExt)
+
+	blob, err := engine.FromDescriptor(ctx, prevManifest)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error obtaining manifest: %s", err)
+	}
+	defer blob.Close()
+	manifest, ok := blob.Data.(imgspecv1.Manifest)
+	if !ok {
+		return imgspecv1.Descriptor{}, fmt.Errorf("unsupported manifest media type: %s", prevManifest.MediaType)
+	}
+
+	fsEval := fseval.Default
+	if mapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+
+	// the base is extracted again to compare rootfs against it
+	tmpDir, err := os.MkdirTemp("", "repack-base-")
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		if err := fs.ForceRemoveAll(tmpDir); err != nil {
+			sylog.Warningf("Could not remove %s: %s", tmpDir, err)
+		}
+	}()
+	base, err := unpackBase(ctx, engine, manifest, filepath.Join(tmpDir, "rootfs"), mapOptions, fsEval)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+
+	diffs, err := mtree.Check(rootfs, base, umoci.MtreeKeywords, fsEval)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error computing rootfs changes: %s", err)
+	}
+	diffs = mtreefilter.FilterDeltas(diffs, mtreefilter.SimplifyFilter(diffs))
+	sylog.Debugf("Repacking %d changed paths of %s", len(diffs), rootfs)
+
+	layer, err := umocilayer.GenerateLayer(rootfs, diffs, &umocilayer.RepackOptions{MapOptions: mapOptions})
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error generating layer: %s", err)
+	}
+	defer layer.Close()
+
+	created := time.Now()
+	if epoch, ok, err := sytypes.SourceDateEpoch(); err != nil {
+		return imgspecv1.Descriptor{}, err
+	} else if ok {
+		created = epoch
+	}
+	history := &imgspecv1.History{
+		Created:   &created,
+		CreatedBy: "apptainer repack",
+	}
+
+	mutator, err := mutate.New(engine, casext.DescriptorPath{Walk: []imgspecv1.Descriptor{prevManifest}})
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error opening manifest: %s", err)
+	}
+	if _, err := mutator.Add(ctx, imgspecv1.MediaTypeImageLayer, layer, history, mutate.GzipCompressor); err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error adding layer: %s", err)
+	}
+	path, err := mutator.Commit(ctx)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error writing manifest: %s", err)
+	}
+	return path.Descriptor(), nil
+}
+
+// unpackBase extracts the layers of manifest into rootfs, as unpackRootfs
+// does, and returns the mtree hierarchy of the extracted content.
+func unpackBase(ctx context.Context, engine casext.Engine, manifest imgspecv1.Manifest, rootfs string, mapOptions umocilayer.MapOptions, fsEval fseval.FsEval) (*mtree.DirectoryHierarchy, error) {
+	u := &rootfsUnpacker{
+		engine: engine,
+		rootfs: rootfs,
+		opts:   umocilayer.UnpackOptions{MapOptions: mapOptions},
+	}
+	if err := u.unpack(ctx, manifest); err != nil {
+		return nil, fmt.Errorf("error unpacking base rootfs: %s", err)
+	}
+
+	// the modification times of the repacked rootfs were clamped the same way
+	if epoch, ok, err := sytypes.SourceDateEpoch(); err != nil {
+		return nil, err
+	} else if ok {
+		if err := sytypes.ClampMtimes(rootfs, epoch); err != nil {
+			return nil, err
+		}
+	}
+
+	dh, err := mtree.Walk(rootfs, nil, umoci.MtreeKeywords, fsEval)
+	if err != nil {
+		return nil, fmt.Errorf("error walking base rootfs: %s", err)
+	}
+	return dh, nil
+}
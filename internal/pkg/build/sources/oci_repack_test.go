@@ -0,0 +1,131 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRepackRootfs(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t,
+		dirEntry("etc/"),
+		tarEntry{name: "etc/config", body: "v1"},
+		tarEntry{name: "etc/obsolete", body: "obsolete"},
+		dirEntry("opt/"),
+		tarEntry{name: "opt/unchanged", body: "unchanged"},
+	))
+	b, err := unpackTestImage(t, img, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// edit the extracted rootfs
+	if err := os.WriteFile(filepath.Join(b.RootfsPath, "etc/config"), []byte("v2"), 0o644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(b.RootfsPath, "etc/added"), []byte("added"), 0o644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := os.Remove(filepath.Join(b.RootfsPath, "etc/obsolete")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	prev := imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Digest:    img.manifestDigest,
+		Size:      int64(len(img.manifestData)),
+	}
+	desc, err := RepackRootfs(context.Background(), b.TmpDir, b.RootfsPath, prev)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	readBlob := func(d imgspecv1.Descriptor) []byte {
+		data, err := os.ReadFile(filepath.Join(b.TmpDir, "blobs", "sha256", d.Digest.Encoded()))
+		if err != nil {
+			t.Fatalf("blob %s not written: %s", d.Digest, err)
+		}
+		return data
+	}
+
+	var manifest imgspecv1.Manifest
+	if err := json.Unmarshal(readBlob(desc), &manifest); err != nil {
+		t.Fatalf("while decoding manifest: %s", err)
+	}
+	if len(manifest.Layers) != 2 || manifest.Layers[0].Digest != img.manifest.Layers[0].Digest {
+		t.Fatalf("unexpected layers %v", manifest.Layers)
+	}
+	var config imgspecv1.Image
+	if err := json.Unmarshal(readBlob(manifest.Config), &config); err != nil {
+		t.Fatalf("while decoding config: %s", err)
+	}
+	if len(config.RootFS.DiffIDs) != 2 {
+		t.Errorf("unexpected diff IDs %v", config.RootFS.DiffIDs)
+	}
+
+	layer := manifest.Layers[1]
+	if layer.MediaType != imgspecv1.MediaTypeImageLayerGzip {
+		t.Errorf("unexpected layer media type %s", layer.MediaType)
+	}
+	f, err := os.Open(filepath.Join(b.TmpDir, "blobs", "sha256", layer.Digest.Encoded()))
+	if err != nil {
+		t.Fatalf("layer not written: %s", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	entries := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("while reading layer: %s", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("while reading %s: %s", hdr.Name, err)
+		}
+		entries[cleanEntryPath(hdr.Name)] = string(data)
+	}
+
+	want := map[string]string{
+		"etc/config":       "v2",
+		"etc/added":        "added",
+		"etc/.wh.obsolete": "",
+	}
+	for name, content := range want {
+		got, ok := entries[name]
+		if !ok {
+			t.Errorf("%s missing from the repacked layer, got %v", name, entries)
+		} else if got != content {
+			t.Errorf("unexpected content of %s: %q, want %q", name, got, content)
+		}
+	}
+	for _, name := range []string{"opt/unchanged", "opt"} {
+		if _, ok := entries[name]; ok {
+			t.Errorf("unchanged %s in the repacked layer", name)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apptainer/apptainer/internal/pkg/fakeroot"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// privilegedExamples is the number of paths given as examples of each kind
+// of privileged content.
+const privilegedExamples = 3
+
+// cISUID and cISGID are the setuid and setgid bits of the mode of a tar
+// entry.
+const (
+	cISUID = 0o4000
+	cISGID = 0o2000
+)
+
+// privilegedFeature counts the paths holding a kind of privileged content,
+// once each when they are written by several layers, or by the retries of
+// the extraction of a layer.
+type privilegedFeature struct {
+	paths    map[string]bool
+	examples []string
+}
+
+func (f *privilegedFeature) add(path string) {
+	if f.paths[path] {
+		return
+	} else if f.paths == nil {
+		f.paths = make(map[string]bool)
+	}
+	f.paths[path] = true
+	if len(f.examples) < privilegedExamples {
+		f.examples = append(f.examples, path)
+	}
+}
+
+func (f *privilegedFeature) String() string {
+	s := strings.Join(f.examples, ", ")
+	if len(f.paths) > len(f.examples) {
+		s += fmt.Sprintf(" and %d more", len(f.paths)-len(f.examples))
+	}
+	return s
+}
+
+// privilegedContent is a heuristic accounting for the content of an image
+// which isn't extracted as in the image by a rootless extraction, and may
+// leave the image non-functional: device nodes are replaced by empty files,
+// setuid/setgid files are owned by the building user, and file capabilities
+// are dropped.
+type privilegedContent struct {
+	devices      privilegedFeature
+	setids       privilegedFeature
+	capabilities privilegedFeature
+	// ports are the privileged ports exposed by the image config, which
+	// can't be bound unprivileged
+	ports []string
+}
+
+// check accounts for the tar entry hdr.
+func (p *privilegedContent) check(hdr *tar.Header) {
+	if strings.HasPrefix(filepath.Base(hdr.Name), whiteoutPrefix) {
+		return
+	}
+	path := "/" + cleanEntryPath(hdr.Name)
+	switch {
+	case hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock:
+		p.devices.add(path)
+	case hdr.Typeflag == tar.TypeReg && hdr.Mode&(cISUID|cISGID) != 0:
+		p.setids.add(path)
+	}
+	if _, ok := hdr.PAXRecords["SCHILY.xattr.security.capability"]; ok {
+		p.capabilities.add(path)
+	}
+}
+
+// checkConfig accounts for the ports exposed by the image config.
+func (p *privilegedContent) checkConfig(config imgspecv1.ImageConfig) {
+	for port := range config.ExposedPorts {
+		number, _, _ := strings.Cut(port, "/")
+		if n, err := strconv.Atoi(number); err == nil && n > 0 && n < 1024 {
+			p.ports = append(p.ports, port)
+		}
+	}
+	sort.Strings(p.ports)
+}
+
+// warn reports the privileged content found, if any, with a hint to build
+// with --fakeroot unless the build already uses it. The warnings are
+// informational, they are not recorded as warnings about the layer content.
+func (p *privilegedContent) warn() {
+	if len(p.devices.paths) == 0 && len(p.setids.paths) == 0 && len(p.capabilities.paths) == 0 && len(p.ports) == 0 {
+		return
+	}
+	sylog.Warningf("The image expects privileged features, the rootless build may produce a non-functional image:")
+	if len(p.devices.paths) > 0 {
+		sylog.Warningf("%d device nodes are extracted as empty files: %s", len(p.devices.paths), &p.devices)
+	}
+	if len(p.setids.paths) > 0 {
+		sylog.Warningf("%d setuid/setgid files are owned by the building user: %s", len(p.setids.paths), &p.setids)
+	}
+	if len(p.capabilities.paths) > 0 {
+		sylog.Warningf("%d files lose their file capabilities: %s", len(p.capabilities.paths), &p.capabilities)
+	}
+	if len(p.ports) > 0 {
+		sylog.Warningf("Privileged ports are exposed, which can't be bound unprivileged: %s", strings.Join(p.ports, ", "))
+	}
+	if os.Getenv(fakeroot.BuildEnv) == "" {
+		sylog.Warningf("Build with --fakeroot, or as root, to extract the image as intended.")
+	}
+}
+
+// reportPrivileged warns about the privileged content of the image
+// extracted by u, and of its config.
+func (u *rootfsUnpacker) reportPrivileged(ctx context.Context, manifest imgspecv1.Manifest) {
+	configBlob, err := u.engine.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		sylog.Debugf("Could not read the image config to check its exposed ports: %s", err)
+	} else {
+		defer configBlob.Close()
+		if config, ok := configBlob.Data.(imgspecv1.Image); ok {
+			u.privileged.checkConfig(config.Config)
+		}
+	}
+	u.privileged.warn()
+}
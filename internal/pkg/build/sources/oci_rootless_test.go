@@ -0,0 +1,153 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/fakeroot"
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	umocilayer "github.com/opencontainers/umoci/oci/layer"
+)
+
+func TestRootfsUnpackerReportPrivileged(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	devices := newTestImage(t, func(c *imgspecv1.Image) {
+		c.Config.ExposedPorts = map[string]struct{}{"8080/tcp": {}, "443/tcp": {}, "80/tcp": {}}
+	}, makeLayer(t,
+		dirEntry("dev/"),
+		tarEntry{name: "dev/null", typeflag: tar.TypeChar},
+		tarEntry{name: "dev/zero", typeflag: tar.TypeChar},
+		tarEntry{name: "dev/sda", typeflag: tar.TypeBlock},
+		tarEntry{name: "dev/loop0", typeflag: tar.TypeBlock},
+		dirEntry("usr/"),
+		tarEntry{name: "usr/ping", body: "ping", mode: 0o4755},
+	))
+	plain := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+
+	tests := []struct {
+		name     string
+		img      *testImage
+		fakeroot bool
+		want     []string
+		notWant  []string
+		quiet    bool
+	}{
+		{
+			name: "device nodes",
+			img:  devices,
+			want: []string{
+				"rootless build may produce a non-functional image",
+				"4 device nodes are extracted as empty files: /dev/null, /dev/zero, /dev/sda and 1 more",
+				"1 setuid/setgid files are owned by the building user: /usr/ping",
+				"Privileged ports are exposed, which can't be bound unprivileged: 443/tcp, 80/tcp",
+				"--fakeroot",
+			},
+		},
+		{
+			// a fakeroot build isn't told to use --fakeroot
+			name:     "fakeroot build",
+			img:      devices,
+			fakeroot: true,
+			want:     []string{"4 device nodes are extracted as empty files"},
+			notWant:  []string{"--fakeroot"},
+		},
+		{name: "unprivileged content", img: plain, quiet: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.fakeroot {
+				t.Setenv(fakeroot.BuildEnv, "1")
+			}
+			dir := t.TempDir()
+			tt.img.writeLayout(t, dir, "tmp")
+			engineExt, err := umoci.OpenLayout(dir)
+			if err != nil {
+				t.Fatalf("while opening layout: %s", err)
+			}
+			defer engineExt.Close()
+
+			rootfs := filepath.Join(t.TempDir(), "rootfs")
+			mapping := []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}}
+			u := &rootfsUnpacker{
+				engine: casext.NewEngine(engineExt),
+				rootfs: rootfs,
+				opts: umocilayer.UnpackOptions{MapOptions: umocilayer.MapOptions{
+					Rootless:    true,
+					UIDMappings: mapping,
+					GIDMappings: mapping,
+				}},
+				privileged: &privilegedContent{},
+			}
+
+			var buf bytes.Buffer
+			old := sylog.SetWriter(&buf)
+			defer sylog.SetWriter(old)
+
+			// the extraction is retried after a failure, the paths are
+			// only counted once
+			for i := 0; i < 2; i++ {
+				if err := u.unpack(context.Background(), tt.img.manifest); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			u.reportPrivileged(context.Background(), tt.img.manifest)
+
+			if tt.quiet && buf.Len() > 0 {
+				t.Errorf("unexpected warnings:\n%s", buf.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("%q not found in the warnings:\n%s", want, buf.String())
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(buf.String(), notWant) {
+					t.Errorf("unexpected %q in the warnings:\n%s", notWant, buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestPrivilegedContentCheck(t *testing.T) {
+	var p privilegedContent
+	p.check(&tar.Header{
+		Name:       "usr/bin/ping",
+		Typeflag:   tar.TypeReg,
+		Mode:       0o755,
+		PAXRecords: map[string]string{"SCHILY.xattr.security.capability": "\x01\x00\x00\x02"},
+	})
+	p.check(&tar.Header{Name: "usr/bin/newgrp", Typeflag: tar.TypeReg, Mode: 0o2755})
+	// whiteouts only remove paths
+	p.check(&tar.Header{Name: "dev/.wh.null", Typeflag: tar.TypeChar})
+
+	if got := p.capabilities.String(); got != "/usr/bin/ping" {
+		t.Errorf("unexpected files with capabilities: %s", got)
+	}
+	if got := p.setids.String(); got != "/usr/bin/newgrp" {
+		t.Errorf("unexpected setuid/setgid files: %s", got)
+	}
+	if len(p.devices.paths) != 0 {
+		t.Errorf("unexpected device nodes: %s", &p.devices)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/cache"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// sharedBlobReference is an image reference whose blobs are fetched from a
+// shared blob store, and stored in it once fetched.
+type sharedBlobReference struct {
+	types.ImageReference
+	store    *cache.SharedBlobStore
+	poisoned *poisonedBlobs
+}
+
+func newSharedBlobReference(ref types.ImageReference, store *cache.SharedBlobStore) *sharedBlobReference {
+	return &sharedBlobReference{ImageReference: ref, store: store, poisoned: &poisonedBlobs{}}
+}
+
+// poisonedBlobs are the digests of the poisoned entries of the shared blob
+// store found by the sources of a reference, fetched again from the
+// underlying source.
+type poisonedBlobs struct {
+	mu      sync.Mutex
+	digests map[digest.Digest]bool
+}
+
+func (p *poisonedBlobs) add(d digest.Digest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.digests == nil {
+		p.digests = make(map[digest.Digest]bool)
+	}
+	p.digests[d] = true
+}
+
+func (p *poisonedBlobs) has(d digest.Digest) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.digests[d]
+}
+
+// Unwrap returns the underlying image reference.
+func (r *sharedBlobReference) Unwrap() types.ImageReference {
+	return r.ImageReference
+}
+
+// NewImageSource returns an image source fetching its blobs from the
+// shared blob store.
+func (r *sharedBlobReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &sharedBlobSource{ImageSource: src, store: r.store, poisoned: r.poisoned}, nil
+}
+
+// NewImage returns the image of an image source fetching its blobs from
+// the shared blob store.
+func (r *sharedBlobReference) NewImage(ctx context.Context, sys *types.SystemContext) (types.ImageCloser, error) {
+	src, err := r.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return image.FromSource(ctx, sys, src)
+}
+
+// sharedBlobLockTimeout is how long GetBlob waits for the lock of a blob
+// fetched by another build, before fetching it too.
+var sharedBlobLockTimeout = 5 * time.Minute
+
+// sharedBlobSource is an image source fetching its blobs from store, the
+// blobs fetched from the underlying source being stored once read in full,
+// so that an interrupted build resumes from the blobs already stored.
+type sharedBlobSource struct {
+	types.ImageSource
+	store    *cache.SharedBlobStore
+	poisoned *poisonedBlobs
+}
+
+// cached returns the blob of the store, or nil when it isn't stored or is
+// known to be poisoned. A poisoned entry is only found once read, the read
+// failing with cache.ErrBlobDigestMismatch, the next GetBlob fetching the
+// blob from the source and replacing the entry.
+func (s *sharedBlobSource) cached(info types.BlobInfo) (io.ReadCloser, int64) {
+	if s.poisoned.has(info.Digest) {
+		return nil, 0
+	}
+	rc, size, err := s.store.Open(info.Digest)
+	if err == nil && info.Size > 0 && size != info.Size {
+		rc.Close()
+		err = fmt.Errorf("%w: size %d, expected %d", cache.ErrBlobDigestMismatch, size, info.Size)
+	}
+	if errors.Is(err, cache.ErrBlobDigestMismatch) {
+		sylog.Warningf("Ignoring the entry of %s in the shared blob cache: %s", info.Digest, err)
+		s.poisoned.add(info.Digest)
+		return nil, 0
+	} else if err != nil {
+		if !os.IsNotExist(err) {
+			sylog.Debugf("Not using the shared blob cache for %s: %s", info.Digest, err)
+		}
+		return nil, 0
+	}
+	sylog.Debugf("Using %s from the shared blob cache", info.Digest)
+	return &sharedBlobReader{ReadCloser: rc, digest: info.Digest, poisoned: s.poisoned}, size
+}
+
+func (s *sharedBlobSource) GetBlob(ctx context.Context, info types.BlobInfo, bic types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	if info.Digest == "" {
+		return s.ImageSource.GetBlob(ctx, info, bic)
+	}
+	if rc, size := s.cached(info); rc != nil {
+		return rc, size, nil
+	}
+
+	// the blob is fetched once by the concurrent builds, the others
+	// waiting for it to be stored, or fetching it too after a while
+	lockCtx, cancel := context.WithTimeout(ctx, sharedBlobLockTimeout)
+	unlock, err := s.store.Lock(lockCtx, info.Digest)
+	cancel()
+	if err != nil {
+		sylog.Debugf("Not storing %s in the shared blob cache: %s", info.Digest, err)
+		return s.ImageSource.GetBlob(ctx, info, bic)
+	}
+	// the blob may have been stored while waiting for the lock
+	if rc, size := s.cached(info); rc != nil {
+		unlock()
+		return rc, size, nil
+	}
+	rc, size, err := s.ImageSource.GetBlob(ctx, info, bic)
+	if err != nil {
+		unlock()
+		return nil, 0, err
+	}
+	w, err := s.store.Create(info.Digest)
+	if err != nil {
+		unlock()
+		sylog.Debugf("Not storing %s in the shared blob cache: %s", info.Digest, err)
+		return rc, size, nil
+	}
+	return &sharedBlobWriter{ReadCloser: rc, w: w, unlock: unlock}, size, nil
+}
+
+// sharedBlobReader is the content of a blob read from the shared blob
+// store, recording the blob as poisoned when the read fails to validate it.
+type sharedBlobReader struct {
+	io.ReadCloser
+	digest   digest.Digest
+	poisoned *poisonedBlobs
+}
+
+func (r *sharedBlobReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if errors.Is(err, cache.ErrBlobDigestMismatch) {
+		sylog.Warningf("Ignoring the entry of %s in the shared blob cache: %s", r.digest, err)
+		r.poisoned.add(r.digest)
+	}
+	return n, err
+}
+
+// sharedBlobWriter stores the blob read from the underlying source in the
+// shared blob store, once read in full.
+type sharedBlobWriter struct {
+	io.ReadCloser
+	w      *cache.SharedBlobWriter
+	unlock func()
+	failed bool
+	done   bool
+}
+
+func (r *sharedBlobWriter) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.failed {
+		if _, werr := r.w.Write(p[:n]); werr != nil {
+			sylog.Debugf("Not storing blob in the shared blob cache: %s", werr)
+			r.failed = true
+		}
+	}
+	if err == io.EOF && !r.failed && !r.done {
+		r.done = true
+		if cerr := r.w.Commit(); cerr != nil {
+			sylog.Warningf("Not storing blob in the shared blob cache: %s", cerr)
+		}
+	}
+	return n, err
+}
+
+func (r *sharedBlobWriter) Close() error {
+	if !r.done {
+		r.done = true
+		r.w.Abort()
+	}
+	if r.unlock != nil {
+		r.unlock()
+		r.unlock = nil
+	}
+	return r.ReadCloser.Close()
+}
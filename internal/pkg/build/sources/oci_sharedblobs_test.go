@@ -0,0 +1,111 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+)
+
+func TestSharedBlobCache(t *testing.T) {
+	reg := newStubRegistry(t)
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	reg.push("test/image", "latest", img)
+	layer := img.manifest.Layers[0].Digest
+
+	store := t.TempDir()
+	if err := os.Chmod(store, 0o777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(t *testing.T) {
+		cp, err := getDockerSource(t, reg.host()+"/test/image:latest", func(b *sytypes.Bundle) {
+			b.Opts.SharedBlobCache = store
+		})
+		if err != nil {
+			t.Fatalf("while getting image: %s", err)
+		}
+		cp.CleanUp()
+	}
+
+	// the first build stores the layer
+	get(t)
+	if n := reg.count(layer.Encoded()); n != 1 {
+		t.Fatalf("unexpected %d fetches of the layer, want 1", n)
+	}
+	entry := filepath.Join(store, "sha256-"+layer.Encoded())
+	if _, err := os.Stat(entry); err != nil {
+		t.Fatalf("layer not stored: %s", err)
+	}
+
+	// the next build reuses it
+	get(t)
+	if n := reg.count(layer.Encoded()); n != 1 {
+		t.Errorf("unexpected %d fetches of the layer, want 1", n)
+	}
+
+	// a poisoned entry is ignored, the layer being fetched again and
+	// replacing the entry
+	if err := os.WriteFile(entry, []byte("poisoned"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	get(t)
+	if n := reg.count(layer.Encoded()); n != 2 {
+		t.Errorf("unexpected %d fetches of the layer, want 2", n)
+	}
+	get(t)
+	if n := reg.count(layer.Encoded()); n != 2 {
+		t.Errorf("unexpected %d fetches of the layer, want 2", n)
+	}
+
+	// as is a poisoned entry of the expected size, only found once read
+	data, err := os.ReadFile(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(entry, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	get(t)
+	if n := reg.count(layer.Encoded()); n != 3 {
+		t.Errorf("unexpected %d fetches of the layer, want 3", n)
+	}
+	get(t)
+	if n := reg.count(layer.Encoded()); n != 3 {
+		t.Errorf("unexpected %d fetches of the layer, want 3", n)
+	}
+}
+
+func TestSharedBlobCacheInsecure(t *testing.T) {
+	store := t.TempDir()
+	if err := os.Chmod(store, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("while creating bundle: %s", err)
+	}
+	defer b.Remove()
+	b.Recipe, err = sytypes.NewDefinitionFromURI("docker://127.0.0.1:1/test/image:latest")
+	if err != nil {
+		t.Fatalf("while parsing URI: %s", err)
+	}
+	b.Opts.NoCache = true
+	b.Opts.SharedBlobCache = store
+
+	cp := &OCIConveyorPacker{}
+	if err := cp.Get(context.Background(), b); err == nil {
+		t.Fatalf("unexpected success with a shared blob cache without the sticky bit")
+	}
+}
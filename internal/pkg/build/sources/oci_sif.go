@@ -0,0 +1,279 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/image/unpacker"
+	"github.com/apptainer/apptainer/internal/pkg/util/fs"
+	utilmachine "github.com/apptainer/apptainer/internal/pkg/util/machine"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/image"
+	"github.com/apptainer/apptainer/pkg/inspect"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// sifLayoutTag is the tag of the image of the OCI layouts converted from SIF
+// images.
+const sifLayoutTag = "latest"
+
+// sifRunscript is the runscript of the Apptainer containers, used as the
+// command of the converted images which don't record any.
+const sifRunscript = "/.singularity.d/runscript"
+
+// SIFToOCILayout converts the SIF image sifPath into an image of the new OCI
+// layout outDir, tagged latest, and returns the descriptor of its manifest.
+// The root filesystem becomes the single layer of the image, added with
+// RepackRootfs. The image config and the manifest annotations preserved in
+// the SIF, if any, are kept, and the labels of the container are set as
+// image labels.
+func SIFToOCILayout(ctx context.Context, sifPath, outDir string) (imgspecv1.Descriptor, error) {
+	img, err := image.Init(sifPath, false)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("while opening %s: %s", sifPath, err)
+	}
+	defer img.File.Close()
+	if img.Type != image.SIF {
+		return imgspecv1.Descriptor{}, fmt.Errorf("%s is not a SIF image", sifPath)
+	}
+	part, err := img.GetRootFsPartition()
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("while getting root filesystem in %s: %s", sifPath, err)
+	}
+	if part.Type != image.SQUASHFS {
+		return imgspecv1.Descriptor{}, fmt.Errorf("unsupported root filesystem in %s, only squashfs is supported", sifPath)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "sif-oci-")
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		if err := fs.ForceRemoveAll(tmpDir); err != nil {
+			sylog.Warningf("Could not remove %s: %s", tmpDir, err)
+		}
+	}()
+	rootfs := filepath.Join(tmpDir, "rootfs")
+
+	reader, err := image.NewPartitionReader(img, "", 0)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("could not extract root filesystem: %s", err)
+	}
+	if err := unpacker.NewSquashfs().ExtractAll(reader, rootfs); err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("root filesystem extraction failed: %s", err)
+	}
+
+	config, annotations, err := sifImageConfig(img, rootfs)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	return rootfsToLayout(ctx, rootfs, outDir, config, annotations)
+}
+
+// rootfsToLayout creates the OCI layout outDir holding an image of config
+// and a manifest with annotations, tagged latest, whose single layer is the
+// content of rootfs, and returns the descriptor of its manifest.
+func rootfsToLayout(ctx context.Context, rootfs, outDir string, config imgspecv1.Image, annotations map[string]string) (imgspecv1.Descriptor, error) {
+	// the root filesystem is repacked on top of an image without layers
+	base, err := createBaseImage(ctx, outDir, config, annotations)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	desc, err := RepackRootfs(ctx, outDir, rootfs, base)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+
+	engineExt, err := umoci.OpenLayout(outDir)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error opening layout: %s", err)
+	}
+	defer engineExt.Close()
+	if err := engineExt.UpdateReference(ctx, sifLayoutTag, desc); err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error tagging image: %s", err)
+	}
+	// drop the blobs of the base image
+	if err := engineExt.GC(ctx); err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error cleaning layout: %s", err)
+	}
+	return desc, nil
+}
+
+// sifImageConfig returns the image config and the manifest annotations of
+// the image converted from the SIF image img, whose root filesystem is
+// extracted in rootfs.
+func sifImageConfig(img *image.Image, rootfs string) (imgspecv1.Image, map[string]string, error) {
+	return imageConfig(func(name string) ([]byte, error) {
+		return readSIFSection(img, name)
+	}, rootfs)
+}
+
+// imageConfig returns the image config and the manifest annotations of the
+// image converted from a container whose root filesystem is rootfs, and
+// whose SIF sections, if any, are returned by section, nil for a missing
+// section.
+func imageConfig(section func(name string) ([]byte, error), rootfs string) (imgspecv1.Image, map[string]string, error) {
+	var config imgspecv1.Image
+	var annotations map[string]string
+
+	// the image config and manifest of an oci/docker source, preserved
+	// with --preserve-manifest
+	if data, err := section(image.SIFDescOCIImageConfigJSON); err != nil {
+		return config, nil, err
+	} else if data != nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return config, nil, fmt.Errorf("while decoding %s: %s", image.SIFDescOCIImageConfigJSON, err)
+		}
+		config.RootFS = imgspecv1.RootFS{}
+		config.History = nil
+	} else if data, err := section(image.SIFDescOCIConfigJSON); err != nil {
+		return config, nil, err
+	} else if data != nil {
+		if err := json.Unmarshal(data, &config.Config); err != nil {
+			return config, nil, fmt.Errorf("while decoding %s: %s", image.SIFDescOCIConfigJSON, err)
+		}
+	}
+	if data, err := section(image.SIFDescOCIManifestJSON); err != nil {
+		return config, nil, err
+	} else if data != nil {
+		var m imgspecv1.Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return config, nil, fmt.Errorf("while decoding %s: %s", image.SIFDescOCIManifestJSON, err)
+		}
+		annotations = m.Annotations
+	}
+
+	labels, err := containerLabels(section, rootfs)
+	if err != nil {
+		return config, nil, err
+	}
+	for k, v := range labels {
+		if config.Config.Labels == nil {
+			config.Config.Labels = make(map[string]string)
+		}
+		config.Config.Labels[k] = v
+	}
+
+	if len(config.Config.Entrypoint) == 0 && len(config.Config.Cmd) == 0 {
+		if _, err := os.Lstat(filepath.Join(rootfs, sifRunscript)); err == nil {
+			config.Config.Cmd = []string{sifRunscript}
+		}
+	}
+	if len(config.Config.Env) == 0 {
+		config.Config.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+	}
+
+	config.OS = "linux"
+	config.Architecture = utilmachine.ArchFromContainer(rootfs)
+	if config.Architecture == "" {
+		config.Architecture = runtime.GOARCH
+	}
+	created := time.Now()
+	if epoch, ok, err := sytypes.SourceDateEpoch(); err != nil {
+		return config, nil, err
+	} else if ok {
+		created = epoch
+	}
+	config.Created = &created
+	config.RootFS.Type = "layers"
+	return config, annotations, nil
+}
+
+// containerLabels returns the labels of a container, from the inspect
+// metadata returned by section or from its root filesystem rootfs.
+func containerLabels(section func(name string) ([]byte, error), rootfs string) (map[string]string, error) {
+	data, err := section(image.SIFDescInspectMetadataJSON)
+	if err != nil {
+		return nil, err
+	} else if data != nil {
+		var metadata inspect.Metadata
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return nil, fmt.Errorf("while decoding %s: %s", image.SIFDescInspectMetadataJSON, err)
+		}
+		return metadata.Attributes.Labels, nil
+	}
+
+	data, err = os.ReadFile(filepath.Join(rootfs, ".singularity.d", "labels.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("while reading labels: %s", err)
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return nil, fmt.Errorf("while decoding labels: %s", err)
+	}
+	return labels, nil
+}
+
+// readSIFSection returns the content of the section name of the SIF image
+// img, or nil if there is none.
+func readSIFSection(img *image.Image, name string) ([]byte, error) {
+	r, err := image.NewSectionReader(img, name, -1)
+	if errors.Is(err, image.ErrNoSection) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not get %s section reader: %s", name, err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", name, err)
+	}
+	return data, nil
+}
+
+// createBaseImage creates the OCI layout dir holding an image without
+// layers, made of config and a manifest with annotations, and returns the
+// descriptor of the manifest.
+func createBaseImage(ctx context.Context, dir string, config imgspecv1.Image, annotations map[string]string) (imgspecv1.Descriptor, error) {
+	engineExt, err := umoci.CreateLayout(dir)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error creating layout: %s", err)
+	}
+	defer engineExt.Close()
+	engine := casext.NewEngine(engineExt)
+
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, config)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error writing config: %s", err)
+	}
+	manifest := imgspecv1.Manifest{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Config: imgspecv1.Descriptor{
+			MediaType: imgspecv1.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers:      []imgspecv1.Descriptor{},
+		Annotations: annotations,
+	}
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error writing manifest: %s", err)
+	}
+	return imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	"github.com/apptainer/apptainer/internal/pkg/test/tool/require"
+	"github.com/apptainer/apptainer/pkg/image"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// testSIF is a SIF image built from the busybox docker image.
+var testSIF = filepath.Join("..", "..", "..", "..", "e2e", "testdata", "busybox_amd64.sif")
+
+// testSIFLabel is one of the labels of testSIF.
+const testSIFLabel = "org.label-schema.usage.singularity.deffile.from"
+
+func TestSIFImageConfig(t *testing.T) {
+	img, err := image.Init(testSIF, false)
+	if err != nil {
+		t.Fatalf("while opening %s: %s", testSIF, err)
+	}
+	defer img.File.Close()
+
+	config, annotations, err := sifImageConfig(img, t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if annotations != nil {
+		t.Errorf("unexpected annotations %v", annotations)
+	}
+	if !reflect.DeepEqual(config.Config.Cmd, []string{"sh"}) {
+		t.Errorf("unexpected command %v", config.Config.Cmd)
+	}
+	if len(config.Config.Env) != 1 {
+		t.Errorf("unexpected environment %v", config.Config.Env)
+	}
+	if got := config.Config.Labels[testSIFLabel]; got != "busybox:1.33.1" {
+		t.Errorf("unexpected %s label %q", testSIFLabel, got)
+	}
+	if config.OS != "linux" || config.RootFS.Type != "layers" {
+		t.Errorf("unexpected config %+v", config)
+	}
+}
+
+func TestSIFToOCILayout(t *testing.T) {
+	test.EnsurePrivilege(t)
+	require.Command(t, "unsquashfs")
+
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "layout")
+	desc, err := SIFToOCILayout(ctx, testSIF, dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	engineExt, err := umoci.OpenLayout(dir)
+	if err != nil {
+		t.Fatalf("invalid layout: %s", err)
+	}
+	defer engineExt.Close()
+	engine := casext.NewEngine(engineExt)
+
+	paths, err := engine.ResolveReference(ctx, sifLayoutTag)
+	if err != nil {
+		t.Fatalf("while resolving %s: %s", sifLayoutTag, err)
+	}
+	if len(paths) != 1 || paths[0].Descriptor().Digest != desc.Digest {
+		t.Fatalf("unexpected images tagged %s: %v", sifLayoutTag, paths)
+	}
+
+	blob, err := engine.FromDescriptor(ctx, desc)
+	if err != nil {
+		t.Fatalf("while reading manifest: %s", err)
+	}
+	defer blob.Close()
+	manifest, ok := blob.Data.(imgspecv1.Manifest)
+	if !ok {
+		t.Fatalf("unexpected manifest %T", blob.Data)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Errorf("unexpected layers %v", manifest.Layers)
+	}
+
+	configBlob, err := engine.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatalf("while reading config: %s", err)
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(imgspecv1.Image)
+	if !ok {
+		t.Fatalf("unexpected config %T", configBlob.Data)
+	}
+	if config.Architecture != "amd64" {
+		t.Errorf("unexpected architecture %s", config.Architecture)
+	}
+	if len(config.RootFS.DiffIDs) != 1 || len(config.History) != 1 {
+		t.Errorf("unexpected rootfs %v and history %v", config.RootFS, config.History)
+	}
+	if got := config.Config.Labels[testSIFLabel]; got != "busybox:1.33.1" {
+		t.Errorf("unexpected %s label %q", testSIFLabel, got)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+)
+
+// maxSymlinkDepth is the number of symlinks a path of the rootfs may be
+// resolved through, as the limit of the kernel beyond which the path
+// fails with ELOOP.
+const maxSymlinkDepth = 40
+
+// badSymlink is a symlink of the rootfs which can't be resolved, looping
+// or going through more than maxSymlinkDepth symlinks.
+type badSymlink struct {
+	// path is the path of the symlink in the rootfs, starting with a
+	// slash
+	path string
+	// loop reports a cycle, a chain too deep otherwise
+	loop bool
+}
+
+func (l badSymlink) String() string {
+	if l.loop {
+		return l.path + " (symlink loop)"
+	}
+	return fmt.Sprintf("%s (more than %d nested symlinks)", l.path, maxSymlinkDepth)
+}
+
+// resolveSymlinkChain resolves the symlink link of rootfs, relative to
+// rootfs as in the container, and reports whether it loops or goes through
+// more than maxSymlinkDepth symlinks. The dangling symlinks are fine.
+func resolveSymlinkChain(rootfs, link string) (bad bool, loop bool) {
+	// a symlink resolved with the same remaining path again loops
+	seen := make(map[string]bool)
+	current := path.Dir(link)
+	rest := []string{path.Base(link)}
+	hops := 0
+
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			current = path.Dir(current)
+			continue
+		}
+		next := path.Join(current, c)
+		fi, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil {
+			return false, false
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			if !fi.IsDir() && len(rest) > 0 {
+				return false, false
+			}
+			current = next
+			continue
+		}
+
+		state := next + "\x00" + strings.Join(rest, "/")
+		if seen[state] {
+			return true, true
+		}
+		seen[state] = true
+		if hops++; hops > maxSymlinkDepth {
+			return true, false
+		}
+		target, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return false, false
+		}
+		if path.IsAbs(target) {
+			current = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return false, false
+}
+
+// findBadSymlinks returns the symlinks of rootfs which loop or go through
+// more than maxSymlinkDepth symlinks, which the later walks of the rootfs
+// following them, and the containers, fail to resolve.
+func findBadSymlinks(rootfs string) ([]badSymlink, error) {
+	var bad []badSymlink
+	err := filepath.WalkDir(rootfs, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// the directories with restrictive permissions are reported
+			// by checkPerms
+			if os.IsPermission(err) {
+				return nil
+			}
+			return err
+		} else if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(rootfs, p)
+		if err != nil {
+			return err
+		}
+		rel = "/" + filepath.ToSlash(rel)
+		if isBad, loop := resolveSymlinkChain(rootfs, rel); isBad {
+			bad = append(bad, badSymlink{path: rel, loop: loop})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("while scanning %s for symlink loops: %s", rootfs, err)
+	}
+	return bad, nil
+}
+
+// checkSymlinks applies the policy of Options.SymlinkLoops to the symlinks
+// of rootfs which loop or are nested too deeply.
+func checkSymlinks(rootfs, policy string, warnings *warningRecorder) error {
+	switch policy {
+	case sytypes.SymlinkLoopIgnore:
+		return nil
+	case "", sytypes.SymlinkLoopWarn, sytypes.SymlinkLoopRemove, sytypes.SymlinkLoopError:
+	default:
+		return fmt.Errorf("invalid policy %q for symlink loops, should be %s, %s, %s or %s", policy,
+			sytypes.SymlinkLoopWarn, sytypes.SymlinkLoopRemove, sytypes.SymlinkLoopError, sytypes.SymlinkLoopIgnore)
+	}
+
+	sylog.Debugf("Scanning for symlink loops")
+	bad, err := findBadSymlinks(rootfs)
+	if err != nil || len(bad) == 0 {
+		return err
+	}
+	paths := make([]string, 0, len(bad))
+	for _, l := range bad {
+		paths = append(paths, l.String())
+	}
+
+	switch policy {
+	case sytypes.SymlinkLoopError:
+		return fmt.Errorf("the rootfs holds unresolvable symlinks: %s", strings.Join(paths, ", "))
+	case sytypes.SymlinkLoopRemove:
+		for _, l := range bad {
+			if err := os.Remove(filepath.Join(rootfs, l.path)); err != nil {
+				return fmt.Errorf("while removing symlink %s: %s", l.path, err)
+			}
+		}
+		warnings.warnf("Removed the unresolvable symlinks of the rootfs: %s", strings.Join(paths, ", "))
+	default:
+		warnings.warnf("The rootfs holds unresolvable symlinks: %s", strings.Join(paths, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+)
+
+// symlinkLoopLayer returns a layer holding a symlink loop, a chain of
+// symlinks deeper than the kernel resolves, and valid symlinks.
+func symlinkLoopLayer(t *testing.T) []byte {
+	entries := []tarEntry{
+		dirEntry("etc/"),
+		{name: "etc/file", body: "content"},
+		{name: "etc/valid", typeflag: tar.TypeSymlink, linkname: "file"},
+		{name: "etc/parent", typeflag: tar.TypeSymlink, linkname: "../etc/./valid"},
+		{name: "etc/dangling", typeflag: tar.TypeSymlink, linkname: "/missing"},
+		{name: "etc/self", typeflag: tar.TypeSymlink, linkname: "."},
+		// a loop through a directory symlink
+		dirEntry("loop/"),
+		{name: "loop/a", typeflag: tar.TypeSymlink, linkname: "b"},
+		{name: "loop/b", typeflag: tar.TypeSymlink, linkname: "/loop/dir/c"},
+		{name: "loop/dir", typeflag: tar.TypeSymlink, linkname: "."},
+		{name: "loop/c", typeflag: tar.TypeSymlink, linkname: "a"},
+		dirEntry("deep/"),
+	}
+	for i := 0; i <= maxSymlinkDepth; i++ {
+		entries = append(entries, tarEntry{
+			name:     fmt.Sprintf("deep/link%d", i),
+			typeflag: tar.TypeSymlink,
+			linkname: fmt.Sprintf("link%d", i+1),
+		})
+	}
+	entries = append(entries, tarEntry{name: fmt.Sprintf("deep/link%d", maxSymlinkDepth+1), body: "content"})
+	return makeLayer(t, entries...)
+}
+
+func TestFindBadSymlinks(t *testing.T) {
+	img := newTestImage(t, nil, symlinkLoopLayer(t))
+	b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+		b.Opts.SymlinkLoops = sytypes.SymlinkLoopIgnore
+	})
+	if err != nil {
+		t.Fatalf("while unpacking image: %s", err)
+	}
+
+	bad, err := findBadSymlinks(b.RootfsPath)
+	if err != nil {
+		t.Fatalf("while scanning rootfs: %s", err)
+	}
+	want := map[string]bool{
+		"/deep/link0": false,
+		"/loop/a":     true,
+		"/loop/b":     true,
+		"/loop/c":     true,
+	}
+	got := make(map[string]bool)
+	for _, l := range bad {
+		got[l.path] = l.loop
+	}
+	if len(got) != len(want) {
+		t.Errorf("unexpected symlinks %v, want %v", bad, want)
+	}
+	for path, loop := range want {
+		if l, ok := got[path]; !ok || l != loop {
+			t.Errorf("unexpected report of %s: got %v (found %v), want loop %v", path, l, ok, loop)
+		}
+	}
+}
+
+func TestSymlinkLoopsPolicy(t *testing.T) {
+	img := newTestImage(t, nil, symlinkLoopLayer(t))
+
+	// the bad symlinks of the layer, as reported
+	reported := []string{
+		"/loop/a (symlink loop)",
+		"/loop/b (symlink loop)",
+		"/loop/c (symlink loop)",
+		fmt.Sprintf("/deep/link0 (more than %d nested symlinks)", maxSymlinkDepth),
+	}
+
+	tests := []struct {
+		policy    string
+		wantWarn  string
+		wantError string
+		removed   bool
+	}{
+		{policy: "", wantWarn: "The rootfs holds unresolvable symlinks"},
+		{policy: sytypes.SymlinkLoopWarn, wantWarn: "The rootfs holds unresolvable symlinks"},
+		{policy: sytypes.SymlinkLoopIgnore},
+		{policy: sytypes.SymlinkLoopRemove, wantWarn: "Removed the unresolvable symlinks", removed: true},
+		{policy: sytypes.SymlinkLoopError, wantError: "/loop/a (symlink loop)"},
+		{policy: "replace", wantError: "invalid policy \"replace\""},
+	}
+	for _, tt := range tests {
+		t.Run("policy "+tt.policy, func(t *testing.T) {
+			var output bytes.Buffer
+			oldWriter := sylog.SetWriter(&output)
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.SymlinkLoops = tt.policy
+				b.Opts.SandboxTarget = true
+			})
+			sylog.SetWriter(oldWriter)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			assertPaths(t, b.RootfsPath, map[string]bool{
+				"/etc/valid":    true,
+				"/etc/parent":   true,
+				"/etc/self":     true,
+				"/loop/a":       !tt.removed,
+				"/deep/link0":   !tt.removed,
+				"/deep/link1":   true,
+				"/loop/dir":     true,
+				"/etc/dangling": true,
+			})
+
+			// each bad symlink is reported with its kind, the loops of a
+			// cycle as well as the chain too deep
+			if tt.wantWarn == "" {
+				if strings.Contains(output.String(), "unresolvable symlinks") {
+					t.Errorf("unexpected warning: %s", output.String())
+				}
+			} else {
+				if !strings.Contains(output.String(), tt.wantWarn) {
+					t.Errorf("warning %q not found in: %s", tt.wantWarn, output.String())
+				}
+				for _, r := range reported {
+					if !strings.Contains(output.String(), r) {
+						t.Errorf("%s not reported in: %s", r, output.String())
+					}
+				}
+			}
+			bad, err := findBadSymlinks(b.RootfsPath)
+			if err != nil {
+				t.Fatalf("while scanning rootfs: %s", err)
+			}
+			if tt.removed && len(bad) != 0 {
+				t.Errorf("unexpected symlinks left: %v", bad)
+			} else if !tt.removed && len(bad) != len(reported) {
+				t.Errorf("unexpected symlinks %v, want %d", bad, len(reported))
+			}
+		})
+	}
+}
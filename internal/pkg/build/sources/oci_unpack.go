@@ -14,147 +14,1882 @@
 package sources
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	apexlog "github.com/apex/log"
+	"github.com/apptainer/apptainer/internal/pkg/build/sbom"
+	"github.com/apptainer/apptainer/internal/pkg/fakeroot"
 	"github.com/apptainer/apptainer/internal/pkg/util/fs"
 	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/image"
 	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/apptainer/apptainer/pkg/util/capabilities"
 	"github.com/apptainer/apptainer/pkg/util/namespaces"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
 	"github.com/containers/image/v5/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	digest "github.com/opencontainers/go-digest"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
 	umocilayer "github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
 	"github.com/opencontainers/umoci/pkg/idtools"
+	"github.com/opencontainers/umoci/pkg/system"
+	"golang.org/x/sys/unix"
 )
 
-// unpackRootfs extracts all of the layers of the given image reference into the rootfs of the provided bundle
-func unpackRootfs(ctx context.Context, b *sytypes.Bundle, tmpfsRef types.ImageReference, sysCtx *types.SystemContext) (err error) {
-	var mapOptions umocilayer.MapOptions
+// emptyLayerDiffID is the diff ID of an empty tar archive, the content of
+// the empty layers added by some image builders.
+const emptyLayerDiffID = digest.Digest("sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef")
 
+// unpackRootfs extracts all of the layers of the given image reference into the rootfs of the provided bundle.
+// It returns the subject of the image manifest, the manifest the image refers to, nil if the image has none.
+// The layers of the merged image references, in the same layout, are extracted in order atop them.
+// The rootfs is only replaced once the extraction succeeds, see stageRootfs.
+func unpackRootfs(ctx context.Context, b *sytypes.Bundle, tmpfsRef types.ImageReference, sysCtx *types.SystemContext, merged ...types.ImageReference) (*unpackResult, error) {
+	if b.Opts.RootfsFS != nil || b.Opts.UpperDir != "" || b.Opts.LowerDir != "" {
+		return extractRootfs(ctx, b, tmpfsRef, sysCtx, merged)
+	}
+	return stageRootfs(b, func() (*unpackResult, error) {
+		return extractRootfs(ctx, b, tmpfsRef, sysCtx, merged)
+	})
+}
+
+// stageRootfs runs extract with the rootfs of b replaced by a staging
+// directory next to it. The staging directory replaces the rootfs when
+// extract succeeds, and is removed otherwise, so that a failed or cancelled
+// extraction never leaves a partial rootfs behind.
+func stageRootfs(b *sytypes.Bundle, extract func() (*unpackResult, error)) (res *unpackResult, err error) {
+	rootfs := b.RootfsPath
+	staging, err := os.MkdirTemp(filepath.Dir(rootfs), ".rootfs-staging-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating rootfs staging directory: %s", err)
+	}
+	if err := os.Chmod(staging, 0o755); err != nil {
+		os.Remove(staging)
+		return nil, fmt.Errorf("error creating rootfs staging directory: %s", err)
+	}
+	sylog.Debugf("Extracting rootfs into staging directory %s", staging)
+
+	b.RootfsPath = staging
+	handler := b.Opts.RestrictivePermsHandler
+	if handler != nil {
+		// the paths are reported in the rootfs they end up in
+		b.Opts.RestrictivePermsHandler = func(paths []string) error {
+			moved := make([]string, 0, len(paths))
+			for _, path := range paths {
+				moved = append(moved, rootfs+strings.TrimPrefix(path, staging))
+			}
+			return handler(moved)
+		}
+	}
+	defer func() {
+		b.RootfsPath = rootfs
+		b.Opts.RestrictivePermsHandler = handler
+		if err != nil {
+			sylog.Debugf("Removing rootfs staging directory %s", staging)
+			if rerr := fs.ForceRemoveAll(staging); rerr != nil {
+				sylog.Errorf("Could not remove rootfs staging directory %s: %v", staging, rerr)
+			}
+			return
+		}
+		if rerr := removeRootfs(rootfs); rerr != nil {
+			err = fmt.Errorf("error replacing rootfs: %w", rerr)
+		} else if rerr := os.Rename(staging, rootfs); rerr != nil {
+			err = fmt.Errorf("error replacing rootfs: %s", rerr)
+		}
+		if err != nil {
+			fs.ForceRemoveAll(staging)
+		}
+	}()
+	return extract()
+}
+
+var (
+	// removeRootfsRetries is the number of times the removal of the rootfs
+	// replaced by the staging directory is retried after a transient error.
+	removeRootfsRetries = 4
+	// removeRootfsDelay is the delay before the first retry of the removal
+	// of the rootfs, doubled by each retry.
+	removeRootfsDelay = 100 * time.Millisecond
+	// forceRemoveAll removes the rootfs, replaced by the tests.
+	forceRemoveAll = fs.ForceRemoveAll
+)
+
+// transientRemoveErrors are the errors of the removal of a rootfs which may
+// succeed once retried, e.g. a file briefly in use, or created in a
+// directory being removed.
+var transientRemoveErrors = []error{unix.EBUSY, unix.ENOTEMPTY, unix.EAGAIN, unix.EINTR, unix.ESTALE}
+
+// removeRootfs removes the rootfs at path, retrying with a backoff after a
+// transient error. The error of a persistent failure names the path which
+// couldn't be removed.
+func removeRootfs(path string) error {
+	delay := removeRootfsDelay
+	for attempt := 1; ; attempt++ {
+		err := forceRemoveAll(path)
+		if err == nil {
+			return nil
+		}
+		transient := false
+		for _, e := range transientRemoveErrors {
+			transient = transient || errors.Is(err, e)
+		}
+		if !transient || attempt > removeRootfsRetries {
+			failed := path
+			var perr *os.PathError
+			if errors.As(err, &perr) {
+				failed = perr.Path
+			}
+			return fmt.Errorf("could not remove %s: %w: the path may be in use by a process or a mount, "+
+				"or have the immutable or append-only attribute (see lsattr)", failed, err)
+		}
+		sylog.Warningf("Removal of rootfs %s failed on attempt %d/%d, retrying in %s: %s", path, attempt, removeRootfsRetries+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// extractRootfs extracts the layers of tmpfsRef and of the merged image
+// references into the rootfs of b, see unpackRootfs.
+func extractRootfs(ctx context.Context, b *sytypes.Bundle, tmpfsRef types.ImageReference, sysCtx *types.SystemContext, merged []types.ImageReference) (res *unpackResult, err error) {
 	loggerLevel := sylog.GetLevel()
 
 	// set the apex log level, for umoci
 	if loggerLevel <= int(sylog.ErrorLevel) {
 		// silent option
-		apexlog.SetLevel(apexlog.ErrorLevel)
+		logHandlers.setLevel(apexlog.ErrorLevel)
 	} else if loggerLevel <= int(sylog.LogLevel) {
 		// quiet option
-		apexlog.SetLevel(apexlog.WarnLevel)
+		logHandlers.setLevel(apexlog.WarnLevel)
 	} else if loggerLevel < int(sylog.DebugLevel) {
 		// verbose option(s) or default
-		apexlog.SetLevel(apexlog.InfoLevel)
+		logHandlers.setLevel(apexlog.InfoLevel)
 	} else {
 		// debug option
-		apexlog.SetLevel(apexlog.DebugLevel)
+		logHandlers.setLevel(apexlog.DebugLevel)
 	}
 
-	// Allow unpacking as non-root
-	if namespaces.IsUnprivileged() {
-		sylog.Debugf("setting umoci rootless mode")
-		mapOptions.Rootless = true
-
-		uidMap, err := idtools.ParseMapping(fmt.Sprintf("0:%d:1", os.Geteuid()))
-		if err != nil {
-			return fmt.Errorf("error parsing uidmap: %s", err)
-		}
-		mapOptions.UIDMappings = append(mapOptions.UIDMappings, uidMap)
+	mapOptions, err := unpackMapOptions()
+	if err != nil {
+		return nil, err
+	}
+	if mapOptions, err = overrideMapOptions(mapOptions, b.Opts.ExtractUIDMap, b.Opts.ExtractGIDMap); err != nil {
+		return nil, err
+	}
 
-		gidMap, err := idtools.ParseMapping(fmt.Sprintf("0:%d:1", os.Getegid()))
-		if err != nil {
-			return fmt.Errorf("error parsing gidmap: %s", err)
-		}
-		mapOptions.GIDMappings = append(mapOptions.GIDMappings, gidMap)
+	var warnings *warningRecorder
+	if b.Opts.WarningsAsErrors {
+		warnings = &warningRecorder{}
+		defer warnings.captureUmoci()()
 	}
 
 	engineExt, err := umoci.OpenLayout(b.TmpDir)
 	if err != nil {
-		return fmt.Errorf("error opening layout: %s", err)
+		return nil, fmt.Errorf("error opening layout: %s", err)
 	}
 
 	// Obtain the manifest
 	imageSource, err := tmpfsRef.NewImageSource(ctx, sysCtx)
 	if err != nil {
-		return fmt.Errorf("error creating image source: %s", err)
+		return nil, fmt.Errorf("error creating image source: %s", err)
+	}
+	defer imageSource.Close()
+	manifestData, mediaType, err := fetchManifest(ctx, imageSource, b.Opts.ManifestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error obtaining manifest source: %s", err)
 	}
-	manifestData, mediaType, err := imageSource.GetManifest(ctx, nil)
+	manifest, err := parseManifest(manifestData, mediaType)
 	if err != nil {
-		return fmt.Errorf("error obtaining manifest source: %s", err)
+		return nil, err
+	}
+	if err := resolveConfigMediaType(ctx, imageSource, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Subject != nil {
+		sylog.Debugf("Manifest refers to the subject %s", manifest.Subject.Digest)
+	}
+	if b.Opts.PreserveManifest {
+		if err := preserveManifest(ctx, b, imageSource, manifestData, manifest.Config); err != nil {
+			return nil, err
+		}
+	}
+	if b.Opts.LayerHistory {
+		// the history of the source, before the layers of the merged ones
+		if err := recordLayerHistory(ctx, b, imageSource, manifest, warnings); err != nil {
+			return nil, err
+		}
+	}
+	if len(merged) > 0 {
+		manifest, err = mergeManifests(ctx, casext.NewEngine(engineExt), manifest, merged, sysCtx, b.Opts.ManifestTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error merging sources: %s", err)
+		}
+	}
+
+	if s := b.Opts.ExtractBufferSize; s != 0 && (s < sytypes.MinExtractBufferSize || s > sytypes.MaxExtractBufferSize) {
+		return nil, fmt.Errorf("extraction buffer size %d is not between %d and %d bytes", s, sytypes.MinExtractBufferSize, sytypes.MaxExtractBufferSize)
+	}
+
+	switch b.Opts.UnknownMediaTypes {
+	case "", sytypes.UnknownMediaTypeError, sytypes.UnknownMediaTypePassthrough, sytypes.UnknownMediaTypeSkip:
+	default:
+		return nil, fmt.Errorf("invalid policy %q for unknown media types, should be %s, %s or %s", b.Opts.UnknownMediaTypes,
+			sytypes.UnknownMediaTypeError, sytypes.UnknownMediaTypePassthrough, sytypes.UnknownMediaTypeSkip)
+	}
+
+	switch b.Opts.OversizedFiles {
+	case "", sytypes.OversizedFileError, sytypes.OversizedFileSkip:
+	default:
+		return nil, fmt.Errorf("invalid policy %q for oversized files, should be %s or %s", b.Opts.OversizedFiles,
+			sytypes.OversizedFileError, sytypes.OversizedFileSkip)
 	}
-	if mediaType != imgspecv1.MediaTypeImageManifest {
-		return fmt.Errorf("error verifying manifest media type: %s", mediaType)
+	if b.Opts.MaxFileSize < 0 {
+		return nil, fmt.Errorf("invalid maximum file size %d", b.Opts.MaxFileSize)
 	}
-	var manifest imgspecv1.Manifest
-	json.Unmarshal(manifestData, &manifest)
 
-	// UnpackRootfs from umoci v0.4.2 expects a path to a non-existing directory
-	os.RemoveAll(b.RootfsPath)
+	links, err := newHardlinkResolver(b.Opts.DanglingHardlinks, b.TmpDir, warnings)
+	if err != nil {
+		return nil, err
+	} else if links != nil {
+		defer links.close()
+	}
+
+	// the rootfs on disk is an empty staging directory
+	fsys, err := rootfsFS(b.Opts)
+	if err != nil {
+		return nil, err
+	} else if fsys != nil {
+		if err := checkRootfsFSOptions(b.Opts); err != nil {
+			return nil, err
+		}
+	}
 
 	// Unpack root filesystem
-	unpackOptions := umocilayer.UnpackOptions{MapOptions: mapOptions}
-	err = umocilayer.UnpackRootfs(ctx, engineExt, b.RootfsPath, manifest, &unpackOptions)
+	u := &rootfsUnpacker{
+		engine:         casext.NewEngine(engineExt),
+		rootfs:         b.RootfsPath,
+		fsys:           fsys,
+		opts:           umocilayer.UnpackOptions{MapOptions: mapOptions, KeepDirlinks: b.Opts.KeepDirlinks},
+		include:        newPathFilter(b.Opts.IncludePaths),
+		filter:         newTarFilter(b.Opts.TarFilters),
+		links:          links,
+		parallelGzip:   b.Opts.ParallelGzip,
+		verifyGzip:     b.Opts.VerifyGzip,
+		warnCollisions: b.Opts.CaseCollisionWarnings,
+		warnings:       warnings,
+		retries:        b.Opts.ExtractRetries,
+		maxFiles:       b.Opts.MaxFiles,
+		maxFileSize:    b.Opts.MaxFileSize,
+		skipOversized:  b.Opts.OversizedFiles == sytypes.OversizedFileSkip,
+		bufferSize:     b.Opts.ExtractBufferSize,
+		sparse:         b.Opts.SparseFiles,
+		keepGoing:      b.Opts.KeepGoing,
+		unknownPolicy:  b.Opts.UnknownMediaTypes,
+	}
+	if b.Opts.Provenance || b.Opts.MaxFiles > 0 || recordPermsState(b) {
+		u.provenance = make(map[string]int)
+	}
+	if mapOptions.Rootless {
+		u.privileged = &privilegedContent{}
+	}
+	if u.acls, err = newACLHandler(b.Opts.ACLs, mapOptions); err != nil {
+		return nil, err
+	}
+	if u.include != nil {
+		sylog.Warningf("Only extracting %s from the image, the resulting root filesystem is not complete", strings.Join(b.Opts.IncludePaths, ", "))
+	}
+	u.monitor, err = newResourceMonitor(b.Opts.MaxExtractMemory, b.Opts.MaxExtractCPUTime)
+	if err != nil {
+		return nil, err
+	} else if u.monitor != nil {
+		defer u.monitor.log()
+	}
+	if b.Opts.IDPreflight {
+		uidMap, gidMap := mapOptions.UIDMappings, mapOptions.GIDMappings
+		if !mapOptions.Rootless && uidMap == nil {
+			if uidMap, err = readIDMappings("/proc/self/uid_map"); err != nil {
+				return nil, fmt.Errorf("error reading uid mappings: %s", err)
+			}
+			if gidMap, err = readIDMappings("/proc/self/gid_map"); err != nil {
+				return nil, fmt.Errorf("error reading gid mappings: %s", err)
+			}
+		}
+		r, err := u.preflightIDs(ctx, manifest, uidMap, gidMap)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning image ownership: %s", err)
+		}
+		r.log(warnings)
+	}
+	if err := u.unpack(ctx, manifest); err != nil {
+		return nil, fmt.Errorf("error unpacking rootfs: %w", err)
+	}
+	if u.privileged != nil {
+		u.reportPrivileged(ctx, manifest)
+	}
+	u.acls.report()
+	if b.Opts.VerifyLayers {
+		diffIDs, err := u.diffIDs(ctx, manifest)
+		if err != nil {
+			return nil, fmt.Errorf("error verifying extracted layers: %s", err)
+		}
+		if err := u.checkApplied(manifest, diffIDs); err != nil {
+			return nil, fmt.Errorf("error verifying extracted layers: %s", err)
+		}
+	}
+	if b.Opts.VerifyRootfs {
+		if err := u.verifyRootfs(ctx, manifest); err != nil {
+			return nil, fmt.Errorf("error verifying rootfs: %s", err)
+		}
+	}
+
+	if b.Opts.Provenance {
+		if b.Opts.SandboxTarget {
+			sylog.Warningf("The provenance index is only recorded in SIF images")
+		}
+		data, err := json.Marshal(u.provenanceIndex(manifest))
+		if err != nil {
+			return nil, fmt.Errorf("error encoding provenance index: %s", err)
+		}
+		b.JSONObjects[image.SIFDescProvenanceJSON] = data
+	}
+
+	if b.Opts.SBOM {
+		if b.Opts.SandboxTarget {
+			sylog.Warningf("The SBOM is only recorded in SIF images")
+		}
+		s, err := sbom.Generate(b.RootfsPath)
+		if err != nil {
+			return nil, fmt.Errorf("error generating SBOM: %s", err)
+		}
+		sylog.Debugf("Recording %d packages in the SBOM", len(s.Packages))
+		data, err := json.Marshal(s)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding SBOM: %s", err)
+		}
+		b.JSONObjects[image.SIFDescSBOMJSON] = data
+	}
+
+	if fsys != nil {
+		if err := finalizeRootfsFS(fsys); err != nil {
+			return nil, err
+		}
+	} else {
+		var prov sytypes.Provenance
+		if recordPermsState(b) {
+			prov = u.provenanceIndex(manifest)
+		}
+		if err := finalizeRootfs(b, prov, warnings); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(u.failed) > 0 {
+		sylog.Warningf("The build is degraded, %d of the %d layers failed to extract: %s", len(u.failed), len(manifest.Layers), joinDigests(u.failed))
+	}
+
+	return &unpackResult{subject: manifest.Subject, failedLayers: u.failed}, warnings.err()
+}
+
+// unpackResult describes an image extracted by unpackRootfs.
+type unpackResult struct {
+	// subject is the subject of the image manifest, nil if none
+	subject *imgspecv1.Descriptor
+	// failedLayers are the layers which failed to extract with the
+	// KeepGoing option, the build is degraded when not empty
+	failedLayers []digest.Digest
+}
+
+// joinDigests returns the digests separated by commas.
+func joinDigests(digests []digest.Digest) string {
+	s := make([]string, 0, len(digests))
+	for _, d := range digests {
+		s = append(s, d.String())
+	}
+	return strings.Join(s, ",")
+}
+
+// rootfsFS returns the filesystem the layers are extracted into with opts,
+// the RootfsFS or the overlay of UpperDir atop LowerDir, nil for the rootfs
+// of the bundle.
+func rootfsFS(opts sytypes.Options) (sytypes.RootfsFS, error) {
+	if opts.UpperDir == "" && opts.LowerDir == "" {
+		return opts.RootfsFS, nil
+	} else if opts.UpperDir == "" || opts.LowerDir == "" {
+		return nil, fmt.Errorf("extracting into an overlay requires both an upper and a lower directory")
+	} else if opts.RootfsFS != nil {
+		return nil, fmt.Errorf("extracting into an overlay is not supported with a custom rootfs filesystem")
+	}
+	if fi, err := os.Stat(opts.LowerDir); err != nil {
+		return nil, fmt.Errorf("invalid overlay lower directory: %s", err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("invalid overlay lower directory %s: not a directory", opts.LowerDir)
+	}
+	sylog.Debugf("Extracting into the overlay upper directory %s atop %s", opts.UpperDir, opts.LowerDir)
+	return sytypes.NewOverlayFS(opts.LowerDir, opts.UpperDir), nil
+}
+
+// checkRootfsFSOptions returns an error if options reading the extracted
+// rootfs from disk are set along with opts.RootfsFS.
+func checkRootfsFSOptions(opts sytypes.Options) error {
+	var unsupported []string
+	if opts.SBOM {
+		unsupported = append(unsupported, "SBOM")
+	}
+	if opts.VerifyRootfs {
+		unsupported = append(unsupported, "VerifyRootfs")
+	}
+	if opts.NormalizeNetFiles != "" {
+		unsupported = append(unsupported, "NormalizeNetFiles")
+	}
+	if opts.FixPerms {
+		unsupported = append(unsupported, "FixPerms")
+	}
+	if opts.SELinuxLabels != "" {
+		unsupported = append(unsupported, "SELinuxLabels")
+	}
+	if len(opts.InjectFiles) > 0 {
+		unsupported = append(unsupported, "InjectFiles")
+	}
+	if len(opts.TemplateFiles) > 0 {
+		unsupported = append(unsupported, "TemplateFiles")
+	}
+	if opts.KeepDirlinks {
+		unsupported = append(unsupported, "KeepDirlinks")
+	}
+	if opts.ACLs == sytypes.ACLPreserve {
+		unsupported = append(unsupported, "ACLs")
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("%s not supported when extracting into a custom rootfs filesystem", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// recordPermsState returns true when the scan for restrictive permissions
+// of the rootfs of b is recorded in a perms state file.
+func recordPermsState(b *sytypes.Bundle) bool {
+	return b.Opts.PermsStateFile != "" && b.Opts.SandboxTarget && !b.Opts.FixPerms
+}
+
+// finalizeRootfsFS clamps the modification times of the rootfs extracted
+// into fsys, as finalizeRootfs does.
+func finalizeRootfsFS(fsys sytypes.RootfsFS) error {
+	epoch, ok, err := sytypes.SourceDateEpoch()
 	if err != nil {
-		return fmt.Errorf("error unpacking rootfs: %s", err)
+		return err
+	} else if ok {
+		sylog.Debugf("Clamping modification times to SOURCE_DATE_EPOCH %d", epoch.Unix())
+		if err := clampFSMtimes(fsys, "", epoch); err != nil {
+			return fmt.Errorf("error setting modification times: %s", err)
+		}
+	}
+	return nil
+}
+
+// finalizeRootfs applies the build options to the network files, injected
+// files, permissions, ownership, SELinux labels and modification times of
+// the unpacked rootfs of b.
+// The provenance index prov of the rootfs, if not nil, scopes the scan for
+// restrictive permissions to the paths written by the layers which changed
+// since the last build, see permsState.
+func finalizeRootfs(b *sytypes.Bundle, prov sytypes.Provenance, warnings *warningRecorder) error {
+	if b.Opts.NormalizeNetFiles != "" {
+		sylog.Debugf("Normalizing /etc/resolv.conf and /etc/hosts to %s files", b.Opts.NormalizeNetFiles)
+		if err := sytypes.NormalizeNetFiles(b.RootfsPath, b.Opts.NormalizeNetFiles); err != nil {
+			return err
+		}
+	}
+
+	if len(b.Opts.InjectFiles) > 0 {
+		sylog.Debugf("Injecting %d files into the rootfs", len(b.Opts.InjectFiles))
+		if err := sytypes.InjectFiles(b.RootfsPath, b.Opts.InjectFiles); err != nil {
+			return err
+		}
+		if prov != nil {
+			injected, err := injectedProvenance(prov, b.Opts.InjectFiles)
+			if err != nil {
+				return err
+			}
+			prov = injected
+		}
+	}
+
+	if len(b.Opts.TemplateFiles) > 0 {
+		r, err := sytypes.TemplateFiles(b.RootfsPath, b.Opts.TemplateFiles, b.Opts.TemplateVars)
+		if err != nil {
+			return err
+		}
+		sylog.Debugf("Templated %d files of the rootfs", len(r.Paths))
+		for _, path := range r.Paths {
+			if undefined := r.Undefined[path]; len(undefined) > 0 {
+				warnings.warnf("Undefined template variables in %s: %s", path, strings.Join(undefined, ", "))
+			}
+		}
+	}
+
+	if err := checkSymlinks(b.RootfsPath, b.Opts.SymlinkLoops, warnings); err != nil {
+		return err
 	}
 
 	// If the `--fix-perms` flag was used, then modify the permissions so that
-	// content has owner rwX and we're done
+	// content has owner rwX
 	if b.Opts.FixPerms {
 		sylog.Warningf("The --fix-perms option modifies the filesystem permissions on the resulting container.")
 		sylog.Debugf("Modifying permissions for file/directory owners")
-		return sytypes.FixPerms(b.RootfsPath)
+		if err := sytypes.FixPerms(b.RootfsPath); err != nil {
+			return err
+		}
+	} else if b.Opts.SandboxTarget {
+		// If `--fix-perms` was not used and this is a sandbox, scan for restrictive
+		// perms that would stop the user doing an `rm` without a chmod first,
+		// and warn if they exist
+		sylog.Debugf("Scanning for restrictive permissions")
+		if prov != nil {
+			if err := checkPermsIncremental(b.RootfsPath, prov, b.Opts.PermsStateFile, b.Opts.RestrictivePermsHandler, warnings); err != nil {
+				return err
+			}
+		} else if err := checkPerms(b.RootfsPath, b.Opts.RestrictivePermsHandler, warnings); err != nil {
+			return err
+		}
 	}
 
-	// If `--fix-perms` was not used and this is a sandbox, scan for restrictive
-	// perms that would stop the user doing an `rm` without a chmod first,
-	// and warn if they exist
-	if b.Opts.SandboxTarget {
-		sylog.Debugf("Scanning for restrictive permissions")
-		return checkPerms(b.RootfsPath)
+	if b.Opts.NormalizeOwnership {
+		if b.Opts.SandboxTarget {
+			sylog.Warningf("The ownership of the rootfs is only normalized in SIF images")
+		} else {
+			sylog.Debugf("Normalizing the ownership of the rootfs to root:root")
+			if err := sytypes.NormalizeOwnership(b.RootfsPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	if b.Opts.SELinuxLabels != "" {
+		p, err := readLabelPolicy(b.Opts.SELinuxLabels)
+		if err != nil {
+			return err
+		}
+		sylog.Debugf("Applying SELinux labels from %s", b.Opts.SELinuxLabels)
+		if err := applyLabels(b.RootfsPath, p); err != nil {
+			return err
+		}
 	}
 
-	// No `--fix-perms` and no sandbox... we are fine
-	return err
+	// For reproducible builds, don't let the extraction time leak into the
+	// modification times of the rootfs content
+	epoch, ok, err := sytypes.SourceDateEpoch()
+	if err != nil {
+		return err
+	} else if ok {
+		sylog.Debugf("Clamping modification times to SOURCE_DATE_EPOCH %d", epoch.Unix())
+		if err := sytypes.ClampMtimes(b.RootfsPath, epoch); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// checkPerms will work through the rootfs of this bundle, and find if any
-// directory does not have owner rwX - which may cause unexpected issues for a
-// user trying to look through, or delete a sandbox
-func checkPerms(rootfs string) (err error) {
-	// This is a locally defined error we can bubble up to cancel our recursive
-	// structure.
-	errRestrictivePerm := errors.New("restrictive file permission found")
+// manifestRetries is the number of attempts made to fetch the manifest of
+// an image when they time out.
+const manifestRetries = 3
 
-	err = fs.PermWalkRaiseError(rootfs, func(path string, f os.FileInfo, err error) error {
-		if err != nil {
-			// If the walk function cannot access a directory at all, that's an
-			// obvious restrictive permission we need to warn on
-			if os.IsPermission(err) {
-				sylog.Debugf("Path %q has restrictive permissions", path)
-				return errRestrictivePerm
+// errManifestTimeout is returned when the manifest fetch timed out on all
+// of the attempts.
+var errManifestTimeout = errors.New("manifest fetch timed out")
+
+// fetchManifest fetches the manifest of the image source src. When timeout
+// isn't zero, each attempt is abandoned after timeout, and retried up to
+// manifestRetries attempts.
+func fetchManifest(ctx context.Context, src types.ImageSource, timeout time.Duration) ([]byte, string, error) {
+	if timeout <= 0 {
+		return src.GetManifest(ctx, nil)
+	}
+
+	type result struct {
+		data      []byte
+		mediaType string
+		err       error
+	}
+	for attempt := 1; attempt <= manifestRetries; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		// the source might not abandon the fetch with its context
+		ch := make(chan result, 1)
+		go func() {
+			data, mediaType, err := src.GetManifest(attemptCtx, nil)
+			ch <- result{data, mediaType, err}
+		}()
+
+		select {
+		case r := <-ch:
+			cancel()
+			if r.err == nil || !errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+				return r.data, r.mediaType, r.err
+			}
+		case <-attemptCtx.Done():
+			cancel()
+			if ctx.Err() != nil {
+				return nil, "", ctx.Err()
 			}
-			return fmt.Errorf("unable to access rootfs path %s: %s", path, err)
 		}
-		// Warn on any directory not `rwX` - technically other combinations may
-		// be traversable / removable... but are confusing to the user vs
-		// the Singularity 3.4 behavior.
-		if f.Mode().IsDir() && f.Mode().Perm()&0o700 != 0o700 {
-			sylog.Debugf("Path %q has restrictive permissions", path)
-			return errRestrictivePerm
+		sylog.Debugf("Manifest fetch attempt %d timed out after %s", attempt, timeout)
+	}
+	return nil, "", fmt.Errorf("%w after %s on %d attempts", errManifestTimeout, timeout, manifestRetries)
+}
+
+// nestedMinIDs is the number of ids a nested user namespace must make
+// available for the ownership of the image content to be kept, covering the
+// ids usually found in images, up to nobody.
+const nestedMinIDs = 65536
+
+// isUnprivileged returns whether the build runs unprivileged, replaced in
+// tests.
+var isUnprivileged = namespaces.IsUnprivileged
+
+// readNestedMapOptions returns the mapping options of a nested user
+// namespace, replaced in tests.
+var readNestedMapOptions = nestedMapOptions
+
+// unpackMapOptions returns the umoci id mapping options for the current
+// user, in rootless mode when unprivileged. As root of a nested user
+// namespace with enough ids, the ownership is kept within the ids available
+// in the namespace instead. The fakeroot user namespace of a --fakeroot
+// build isn't considered nested, its builds stay in rootless mode.
+func unpackMapOptions() (umocilayer.MapOptions, error) {
+	// Allow unpacking as non-root
+	if isUnprivileged() {
+		if os.Geteuid() == 0 && os.Getenv(fakeroot.BuildEnv) == "" {
+			if nested, ok := readNestedMapOptions(); ok {
+				sylog.Debugf("setting umoci mapping to the ids of the nested user namespace")
+				return nested, nil
+			}
 		}
-		return nil
+
+		sylog.Debugf("setting umoci rootless mode")
+		return rootlessMapOptions(os.Geteuid(), os.Getegid())
+	}
+	return umocilayer.MapOptions{}, nil
+}
+
+// parseIDMapping parses an id mapping, replaced in tests.
+var parseIDMapping = idtools.ParseMapping
+
+// rootlessMapOptions returns the umoci mapping options of a rootless
+// extraction by the user euid, with the group egid, mapping image root to
+// them.
+func rootlessMapOptions(euid, egid int) (umocilayer.MapOptions, error) {
+	mapOptions := umocilayer.MapOptions{Rootless: true}
+
+	uidMap, err := parseIDMapping(fmt.Sprintf("0:%d:1", euid))
+	if err != nil {
+		return mapOptions, rootlessMappingError("uid", euid, egid, err)
+	}
+	mapOptions.UIDMappings = append(mapOptions.UIDMappings, uidMap)
+
+	gidMap, err := parseIDMapping(fmt.Sprintf("0:%d:1", egid))
+	if err != nil {
+		return mapOptions, rootlessMappingError("gid", euid, egid, err)
+	}
+	mapOptions.GIDMappings = append(mapOptions.GIDMappings, gidMap)
+	return mapOptions, nil
+}
+
+// overrideMapOptions returns the mapping options mapOptions of the
+// extraction with the uid and gid mappings uidMap and gidMap, in the
+// containerID:hostID[:size] form, if any. The mappings of a rootless
+// extraction, which doesn't change the ownership of the files, can't be
+// replaced.
+func overrideMapOptions(mapOptions umocilayer.MapOptions, uidMap, gidMap []string) (umocilayer.MapOptions, error) {
+	if len(uidMap) == 0 && len(gidMap) == 0 {
+		return mapOptions, nil
+	}
+	if mapOptions.Rootless {
+		return mapOptions, fmt.Errorf("extraction id mappings require a privileged extraction (consider building with --fakeroot, or as root)")
+	}
+
+	parse := func(kind string, specs []string, current []rspec.LinuxIDMapping) ([]rspec.LinuxIDMapping, error) {
+		if len(specs) == 0 {
+			return current, nil
+		}
+		var mappings []rspec.LinuxIDMapping
+		for _, spec := range specs {
+			m, err := parseIDMapping(spec)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s mapping %q: %s", kind, spec, err)
+			}
+			mappings = append(mappings, m)
+		}
+		return mappings, nil
+	}
+	var err error
+	if mapOptions.UIDMappings, err = parse("uid", uidMap, mapOptions.UIDMappings); err != nil {
+		return mapOptions, err
+	}
+	if mapOptions.GIDMappings, err = parse("gid", gidMap, mapOptions.GIDMappings); err != nil {
+		return mapOptions, err
+	}
+	return mapOptions, nil
+}
+
+// rootlessMappingError returns the error reported when the kind mapping of
+// a rootless extraction by euid and egid couldn't be set up.
+func rootlessMappingError(kind string, euid, egid int, err error) error {
+	return fmt.Errorf("unable to set up the id mappings of a rootless extraction, %s mapping for euid %d and egid %d: %s "+
+		"(consider building with --fakeroot, or as root)", kind, euid, egid, err)
+}
+
+// nestedMapOptions returns the mapping options of the extraction as root of
+// the current user namespace, and false if the rootless mode must be used:
+// when the ids available in the namespace or the capability to change the
+// ownership are missing.
+func nestedMapOptions() (umocilayer.MapOptions, bool) {
+	caps, err := capabilities.GetProcessEffective()
+	if err != nil {
+		sylog.Debugf("Could not get process capabilities: %s", err)
+		return umocilayer.MapOptions{}, false
+	}
+	if caps&(1<<capabilities.Map["CAP_CHOWN"].Value) == 0 {
+		return umocilayer.MapOptions{}, false
+	}
+
+	uidMap, err := readIDMappings("/proc/self/uid_map")
+	if err != nil {
+		sylog.Debugf("Could not read uid mappings: %s", err)
+		return umocilayer.MapOptions{}, false
+	}
+	gidMap, err := readIDMappings("/proc/self/gid_map")
+	if err != nil {
+		sylog.Debugf("Could not read gid mappings: %s", err)
+		return umocilayer.MapOptions{}, false
+	}
+	return nestedIDMapOptions(uidMap, gidMap)
+}
+
+// nestedIDMapOptions returns the mapping options of the extraction in the
+// user namespace with the uidMap and gidMap mappings to the outer namespace.
+// The image ids are mapped in order onto the ids the outer namespace makes
+// available, image root staying root of the namespace. It returns false if
+// the namespace doesn't provide root and at least nestedMinIDs ids.
+func nestedIDMapOptions(uidMap, gidMap []rspec.LinuxIDMapping) (umocilayer.MapOptions, bool) {
+	uids, ok := nestedIDMappings(uidMap)
+	if !ok {
+		return umocilayer.MapOptions{}, false
+	}
+	gids, ok := nestedIDMappings(gidMap)
+	if !ok {
+		return umocilayer.MapOptions{}, false
+	}
+	return umocilayer.MapOptions{UIDMappings: uids, GIDMappings: gids}, true
+}
+
+// nestedIDMappings returns the mappings of the image ids onto the ids of a
+// user namespace available through the mappings m, see nestedIDMapOptions.
+func nestedIDMappings(m []rspec.LinuxIDMapping) ([]rspec.LinuxIDMapping, bool) {
+	available := make([]rspec.LinuxIDMapping, len(m))
+	copy(available, m)
+	sort.Slice(available, func(i, j int) bool {
+		return available[i].ContainerID < available[j].ContainerID
 	})
+	if len(available) == 0 || available[0].ContainerID != 0 {
+		return nil, false
+	}
 
-	if errors.Is(err, errRestrictivePerm) {
-		sylog.Warningf("The sandbox contain files/dirs that cannot be removed with 'rm'.")
-		sylog.Warningf("Use 'chmod -R u+rwX' to set permissions that allow removal.")
-		sylog.Warningf("Use the '--fix-perms' option to 'apptainer build' to modify permissions at build time.")
-		// It's not an error any further up... the rootfs is still usable
-		return nil
+	var mappings []rspec.LinuxIDMapping
+	var next uint64
+	for _, a := range available {
+		if a.Size == 0 {
+			continue
+		}
+		mappings = append(mappings, rspec.LinuxIDMapping{
+			ContainerID: uint32(next),
+			HostID:      a.ContainerID,
+			Size:        a.Size,
+		})
+		next += uint64(a.Size)
+	}
+	if next < nestedMinIDs {
+		return nil, false
+	}
+	return mappings, true
+}
+
+const (
+	// whiteoutPrefix is the name prefix of an entry removing a path from
+	// lower layers.
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaqueDir is the name of an entry hiding the content of its
+	// directory in lower layers.
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// preserveManifest stores the manifest data and the config blob of the image,
+// as fetched, in the image metadata.
+func preserveManifest(ctx context.Context, b *sytypes.Bundle, src types.ImageSource, manifestData []byte, config imgspecv1.Descriptor) error {
+	configData, err := fetchConfigBlob(ctx, src, config)
+	if err != nil {
+		return err
+	}
+
+	if b.Opts.SandboxTarget {
+		sylog.Warningf("The source manifest and config are only recorded in SIF images")
+	}
+	b.JSONObjects[image.SIFDescOCIManifestJSON] = manifestData
+	b.JSONObjects[image.SIFDescOCIImageConfigJSON] = configData
+	return nil
+}
+
+// fetchConfigBlob returns the config blob described by config from the
+// image source src, checking its digest.
+func fetchConfigBlob(ctx context.Context, src types.ImageSource, config imgspecv1.Descriptor) ([]byte, error) {
+	rc, _, err := src.GetBlob(ctx, types.BlobInfo{Digest: config.Digest, Size: config.Size}, none.NoCache)
+	if err != nil {
+		return nil, fmt.Errorf("error obtaining config blob: %s", err)
+	}
+	defer rc.Close()
+
+	verifier := config.Digest.Verifier()
+	configData, err := io.ReadAll(io.TeeReader(rc, verifier))
+	if err != nil {
+		return nil, fmt.Errorf("error reading config blob: %s", err)
+	}
+	if !verifier.Verified() {
+		return nil, fmt.Errorf("config blob doesn't match digest %s", config.Digest)
+	}
+	return configData, nil
+}
+
+// dockerMediaTypes maps the media types of docker schema2 images to their
+// OCI equivalent.
+var dockerMediaTypes = map[string]string{
+	manifest.DockerV2Schema2MediaType:                 imgspecv1.MediaTypeImageManifest,
+	manifest.DockerV2Schema2ConfigMediaType:           imgspecv1.MediaTypeImageConfig,
+	manifest.DockerV2SchemaLayerMediaTypeUncompressed: imgspecv1.MediaTypeImageLayer,
+	manifest.DockerV2Schema2LayerMediaType:            imgspecv1.MediaTypeImageLayerGzip,
+	manifest.DockerV2Schema2ForeignLayerMediaType:     imgspecv1.MediaTypeImageLayerNonDistributable,     //nolint:staticcheck
+	manifest.DockerV2Schema2ForeignLayerMediaTypeGzip: imgspecv1.MediaTypeImageLayerNonDistributableGzip, //nolint:staticcheck
+}
+
+// parseManifest decodes an image manifest of mediaType. Docker schema2
+// manifests share the OCI manifest structure, their media types are
+// converted to the OCI ones. Deprecated docker schema1 manifests are
+// rejected with an explicit error, their layers are stored without the
+// diff IDs and config of the OCI images.
+func parseManifest(data []byte, mediaType string) (imgspecv1.Manifest, error) {
+	var m imgspecv1.Manifest
+
+	switch mediaType {
+	case manifest.DockerV2Schema1MediaType, manifest.DockerV2Schema1SignedMediaType:
+		return m, fmt.Errorf("the image uses the deprecated docker schema1 manifest format (%s), which is not supported: the image must be re-pushed to the registry with a recent version of docker or another container tool to convert it to the docker schema2 or OCI format", mediaType)
 	}
-	return err
+	if mediaType == manifest.DockerV2Schema2MediaType {
+		sylog.Debugf("Converting docker schema2 manifest to OCI")
+	} else if mediaType != imgspecv1.MediaTypeImageManifest {
+		return m, fmt.Errorf("error verifying manifest media type: %s", mediaType)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("error decoding manifest: %s", err)
+	}
+
+	normalize := func(mt string) string {
+		if oci, ok := dockerMediaTypes[mt]; ok {
+			return oci
+		}
+		return mt
+	}
+	m.MediaType = normalize(mediaType)
+	m.Config.MediaType = normalize(m.Config.MediaType)
+	for i := range m.Layers {
+		m.Layers[i].MediaType = normalize(m.Layers[i].MediaType)
+	}
+
+	// the manifests of artifacts, e.g. the attestations referring to an
+	// image through their subject, have no image config
+	if m.Config.MediaType == imgspecv1.MediaTypeEmptyJSON || (m.ArtifactType != "" && m.Config.MediaType != imgspecv1.MediaTypeImageConfig) {
+		artifactType := m.ArtifactType
+		if artifactType == "" {
+			artifactType = m.Config.MediaType
+		}
+		return m, fmt.Errorf("manifest describes an artifact of type %s, not an image", artifactType)
+	}
+	return m, nil
+}
+
+// isImageConfig reports whether the config blob data is an OCI or docker
+// image config, declaring the layers of its root filesystem.
+func isImageConfig(data []byte) bool {
+	var config struct {
+		RootFS *struct {
+			Type string `json:"type"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return false
+	}
+	return config.RootFS != nil && config.RootFS.Type == "layers"
+}
+
+// checkConfigMediaType sets the config media type of the manifest m, parsed
+// by parseManifest, from its config blob configData when it isn't the OCI
+// image config one, the docker one being converted by parseManifest. The
+// config of some sources, e.g. images imported into a docker daemon or
+// containerd by older tools, is declared with an empty or generic media
+// type, e.g. application/octet-stream, while being an image config, which
+// the extraction only reads with the OCI image config media type. The
+// manifests whose config is not an image config describe an artifact.
+func checkConfigMediaType(m *imgspecv1.Manifest, configData []byte) error {
+	if m.Config.MediaType == imgspecv1.MediaTypeImageConfig {
+		return nil
+	}
+	if !isImageConfig(configData) {
+		return fmt.Errorf("manifest describes an artifact of type %s, not an image", m.Config.MediaType)
+	}
+	sylog.Debugf("Config blob %s of media type %q is an image config", m.Config.Digest, m.Config.MediaType)
+	m.Config.MediaType = imgspecv1.MediaTypeImageConfig
+	return nil
+}
+
+// resolveConfigMediaType is checkConfigMediaType, fetching the config blob
+// of m from src only when its media type isn't known.
+func resolveConfigMediaType(ctx context.Context, src types.ImageSource, m *imgspecv1.Manifest) error {
+	if m.Config.MediaType == imgspecv1.MediaTypeImageConfig {
+		return nil
+	}
+	configData, err := fetchConfigBlob(ctx, src, m.Config)
+	if err != nil {
+		return err
+	}
+	return checkConfigMediaType(m, configData)
+}
+
+// rootfsUnpacker extracts the layers of an image manifest on top of each
+// other into a root filesystem, one layer at a time.
+type rootfsUnpacker struct {
+	engine casext.Engine
+	rootfs string
+	// fsys is the filesystem the layers are extracted into instead of
+	// rootfs, when not nil
+	fsys sytypes.RootfsFS
+	opts umocilayer.UnpackOptions
+	// include restricts the extraction to some paths when not nil
+	include *pathFilter
+	// filter transforms the tar entries after include when not nil
+	filter sytypes.TarFilter
+	// links handles the hard links whose target isn't extracted, when not
+	// nil, see filterLinkedEntry
+	links *hardlinkResolver
+	// parallelGzip uses a parallel gzip decompressor for gzip layers
+	parallelGzip bool
+	// verifyGzip checks the trailer of gzip layers, see gzipTrailerReader
+	verifyGzip bool
+	// provenance maps each extracted path to the index of the layer which
+	// last wrote it, when not nil
+	provenance map[string]int
+	// maxFiles is the number of paths of the provenance index above which
+	// the extraction is aborted, when not zero
+	maxFiles int
+	// maxFileSize is the size in bytes above which a regular file is
+	// skipped with skipOversized, or fails the extraction, when not zero
+	maxFileSize   int64
+	skipOversized bool
+	// collisions detects paths differing only by case, when extracting
+	// on a case-insensitive filesystem
+	collisions *caseCollisions
+	// warnCollisions reports case collisions as warnings instead of
+	// failing the extraction
+	warnCollisions bool
+	// warnings records the warnings about the layer content
+	warnings *warningRecorder
+	// warnedLayers records the layers warned about by warnLayer
+	warnedLayers map[digest.Digest]bool
+	// applied records the layers extracted by unpack, in order
+	applied []appliedLayer
+	// skipped maps the index of the layers intentionally not extracted by
+	// unpack to the reason why
+	skipped map[int]string
+	// retries is the number of times the extraction of a layer is retried
+	// after a transient filesystem error
+	retries int
+	// bufferSize is the size of the buffer copying the content of the
+	// entries, sytypes.DefaultExtractBufferSize when zero
+	bufferSize int
+	// sparse extracts the runs of zeros of the files as holes
+	sparse bool
+	// unpackEntry extracts a tar entry, umoci's UnpackEntry when nil
+	unpackEntry func(te *umocilayer.TarExtractor, hdr *tar.Header, r io.Reader) error
+	// keepGoing continues the extraction past a layer failing to extract
+	keepGoing bool
+	// failed records the layers which failed to extract with keepGoing
+	failed []digest.Digest
+	// unknownPolicy is the policy applied to the layers of unknown media
+	// type, see lookupMediaType
+	unknownPolicy string
+	// monitor aborts the reads of the layers once the build process
+	// exceeds its resource limits, when not nil
+	monitor *resourceMonitor
+	// privileged accounts for the content needing privileges to be
+	// extracted as in the image, when not nil
+	privileged *privilegedContent
+	// acls handles the ACLs of the entries apart from their other xattrs,
+	// when not nil
+	acls *aclHandler
+}
+
+// appliedLayer is a layer extracted by the unpacker.
+type appliedLayer struct {
+	// index is the index of the layer in the manifest
+	index  int
+	digest digest.Digest
+	// diffID is the digest of the uncompressed content extracted
+	diffID digest.Digest
+}
+
+// unpack extracts all layers of manifest into the root filesystem, as
+// umoci's UnpackRootfs does. As with UnpackRootfs, the root filesystem is
+// removed when the extraction fails, unless it's a custom filesystem.
+func (u *rootfsUnpacker) unpack(ctx context.Context, manifest imgspecv1.Manifest) (err error) {
+	if u.fsys != nil {
+		// the case sensitivity of a custom filesystem isn't checked
+		if err := u.fsys.Mkdir("", 0o755); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("error creating rootfs: %s", err)
+		}
+	} else {
+		if err := os.Mkdir(u.rootfs, 0o755); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("error creating rootfs: %s", err)
+		}
+		// a partially extracted rootfs isn't left behind, the rootless
+		// removal handles the directories without write permission
+		defer func() {
+			if err == nil {
+				return
+			}
+			fsEval := fseval.Default
+			if u.opts.MapOptions.Rootless {
+				fsEval = fseval.Rootless
+			}
+			if rerr := fsEval.RemoveAll(u.rootfs); rerr != nil {
+				sylog.Debugf("Could not remove the rootfs %s of the failed extraction: %s", u.rootfs, rerr)
+			}
+		}()
+
+		insensitive, err := isCaseInsensitive(u.rootfs)
+		if err != nil {
+			return fmt.Errorf("error checking rootfs case sensitivity: %s", err)
+		}
+		if insensitive {
+			sylog.Debugf("Rootfs %s is on a case-insensitive filesystem, checking for case collisions", u.rootfs)
+			u.collisions = newCaseCollisions()
+		}
+	}
+
+	rootUID, err := idtools.ToHost(0, u.opts.MapOptions.UIDMappings)
+	if err != nil {
+		return fmt.Errorf("error mapping root uid: %s", err)
+	}
+	rootGID, err := idtools.ToHost(0, u.opts.MapOptions.GIDMappings)
+	if err != nil {
+		return fmt.Errorf("error mapping root gid: %s", err)
+	}
+	epoch := time.Unix(0, 0)
+	if u.fsys != nil {
+		if err := u.fsys.Lchown("", rootUID, rootGID); err != nil {
+			return fmt.Errorf("error changing rootfs ownership: %s", err)
+		}
+		if err := u.fsys.Lchtimes("", epoch, epoch); err != nil {
+			return fmt.Errorf("error setting rootfs times: %s", err)
+		}
+	} else {
+		if err := os.Lchown(u.rootfs, rootUID, rootGID); err != nil {
+			return fmt.Errorf("error changing rootfs ownership: %s", err)
+		}
+		if err := system.Lutimes(u.rootfs, epoch, epoch); err != nil {
+			return fmt.Errorf("error setting rootfs times: %s", err)
+		}
+	}
+
+	diffIDs, err := u.diffIDs(ctx, manifest)
+	if err != nil {
+		return err
+	}
+
+	u.applied = nil
+	u.skipped = make(map[int]string)
+	for i, desc := range manifest.Layers {
+		sylog.Debugf("Extracting layer %s", desc.Digest)
+		d, err := u.unpackBlobRetries(ctx, i, desc, diffIDs[i])
+		if errors.Is(err, errSkippedLayer) {
+			u.skipped[i] = "unknown media type " + desc.MediaType
+			continue
+		} else if err != nil {
+			// a cancellation, too many files, an oversized file or a
+			// resource limit abort even with keepGoing
+			if !u.keepGoing || ctx.Err() != nil || errors.Is(err, errTooManyFiles) || errors.Is(err, errFileTooLarge) || errors.Is(err, errResourceLimit) {
+				se := &sytypes.SourceError{Type: sytypes.SourceErrorLayer, Layer: desc.Digest, Err: fmt.Errorf("layer %s: %w", desc.Digest, err)}
+				var ee *entryError
+				if errors.As(err, &ee) {
+					se.Path = "/" + cleanEntryPath(ee.name)
+				}
+				return se
+			}
+			sylog.Errorf("Extraction of layer %s failed, continuing with the next layers: %s", desc.Digest, err)
+			u.failed = append(u.failed, desc.Digest)
+			u.skipped[i] = "extraction failed"
+			continue
+		}
+		u.applied = append(u.applied, appliedLayer{index: i, digest: desc.Digest, diffID: d})
+	}
+
+	if u.collisions != nil && len(u.collisions.found) > 0 && !u.warnCollisions {
+		return fmt.Errorf("paths differing only by case collide on the case-insensitive filesystem of %s: %s", u.rootfs, strings.Join(u.collisions.found, ", "))
+	}
+	return nil
+}
+
+// checkApplied returns an error if the layers extracted by unpack don't
+// match the layers of manifest in number and order, or if the digests of
+// the content extracted don't match diffIDs. Only the layers skipped
+// intentionally, of unknown media type or failing with keepGoing, may be
+// missing from them.
+func (u *rootfsUnpacker) checkApplied(manifest imgspecv1.Manifest, diffIDs []digest.Digest) error {
+	if len(diffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("%d diff IDs for the %d layers of the manifest", len(diffIDs), len(manifest.Layers))
+	}
+	applied := u.applied
+	for i, desc := range manifest.Layers {
+		if reason, ok := u.skipped[i]; ok {
+			sylog.Debugf("Layer %s was not extracted: %s", desc.Digest, reason)
+			continue
+		}
+		if len(applied) == 0 || applied[0].index != i || applied[0].digest != desc.Digest {
+			return fmt.Errorf("layer %d (%s) of the manifest was not extracted", i, desc.Digest)
+		}
+		if applied[0].diffID != diffIDs[i] {
+			return fmt.Errorf("layer %d (%s) extracted with diff ID %s, expected %s", i, desc.Digest, applied[0].diffID, diffIDs[i])
+		}
+		applied = applied[1:]
+	}
+	if len(applied) != 0 {
+		return fmt.Errorf("%d layers extracted for the %d layers of the manifest", len(u.applied), len(manifest.Layers))
+	}
+	return nil
+}
+
+// diffIDs returns the diff IDs of the layers of manifest from the image
+// config.
+func (u *rootfsUnpacker) diffIDs(ctx context.Context, manifest imgspecv1.Manifest) ([]digest.Digest, error) {
+	configBlob, err := u.engine.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return nil, fmt.Errorf("error obtaining config blob: %s", err)
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(imgspecv1.Image)
+	if !ok {
+		return nil, fmt.Errorf("unexpected config media type: %s", configBlob.Descriptor.MediaType)
+	}
+	if config.RootFS.Type != "layers" {
+		return nil, fmt.Errorf("unsupported rootfs type: %s", config.RootFS.Type)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image config has %d diff IDs for %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	return config.RootFS.DiffIDs, nil
+}
+
+// errTooManyFiles is returned when the rootfs holds more files than the
+// maximum set for the build.
+var errTooManyFiles = errors.New("the image holds more than the maximum")
+
+// errFileTooLarge is returned when a file of a layer is larger than the
+// maximum file size set for the build.
+var errFileTooLarge = errors.New("the file is larger than the maximum")
+
+// extractRetryDelay is the delay before retrying the extraction of a layer.
+var extractRetryDelay = time.Second
+
+// transientFSErrors are the errors of a filesystem retried by
+// unpackBlobRetries, e.g. returned by an NFS server in the middle of a
+// failover.
+var transientFSErrors = []error{unix.EIO, unix.EAGAIN, unix.EINTR, unix.EBUSY, unix.ESTALE, unix.ETIMEDOUT}
+
+// isTransientFSError returns whether err is a transient filesystem error. An
+// integrity failure, e.g. a diff ID mismatch, is never transient.
+func isTransientFSError(err error) bool {
+	for _, e := range transientFSErrors {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// unpackBlobRetries extracts the layer blob described by desc as unpackBlob
+// does, retrying it up to u.retries times after a transient filesystem
+// error. The entries extracted by a failed attempt are overwritten by the
+// next one.
+func (u *rootfsUnpacker) unpackBlobRetries(ctx context.Context, idx int, desc imgspecv1.Descriptor, diffID digest.Digest) (digest.Digest, error) {
+	for attempt := 1; ; attempt++ {
+		d, err := u.unpackBlob(ctx, idx, desc, diffID)
+		if err == nil || attempt > u.retries || !isTransientFSError(err) {
+			return d, err
+		}
+		sylog.Warningf("Extraction of layer %s failed on attempt %d/%d, retrying: %s", desc.Digest, attempt, u.retries+1, err)
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(extractRetryDelay):
+		}
+	}
+}
+
+// unpackBlob extracts the blob of the layer at index idx described by desc,
+// checking that the uncompressed content matches diffID, and returns the
+// digest of the content extracted.
+func (u *rootfsUnpacker) unpackBlob(ctx context.Context, idx int, desc imgspecv1.Descriptor, diffID digest.Digest) (digest.Digest, error) {
+	return u.readBlob(ctx, desc, diffID, func(layer io.Reader) error {
+		return u.unpackLayer(idx, layer)
+	})
+}
+
+// layerCompression is the compression of the layer blobs of a media type.
+type layerCompression int
+
+const (
+	uncompressedLayer layerCompression = iota
+	gzipLayer
+	zstdLayer
+)
+
+// layerMediaType describes a layer media type handled by the extraction.
+type layerMediaType struct {
+	compression layerCompression
+	// foreign is set for the non-distributable layers
+	foreign bool
+}
+
+// layerMediaTypes are the layer media types handled by the extraction. The
+// docker media types are converted to the OCI ones by parseManifest.
+var layerMediaTypes = map[string]layerMediaType{
+	imgspecv1.MediaTypeImageLayer:                     {compression: uncompressedLayer},
+	imgspecv1.MediaTypeImageLayerGzip:                 {compression: gzipLayer},
+	imgspecv1.MediaTypeImageLayerZstd:                 {compression: zstdLayer},
+	imgspecv1.MediaTypeImageLayerNonDistributable:     {compression: uncompressedLayer, foreign: true}, //nolint:staticcheck
+	imgspecv1.MediaTypeImageLayerNonDistributableGzip: {compression: gzipLayer, foreign: true},         //nolint:staticcheck
+	imgspecv1.MediaTypeImageLayerNonDistributableZstd: {compression: zstdLayer, foreign: true},         //nolint:staticcheck
+}
+
+// errSkippedLayer is returned by readBlob for a layer of unknown media type
+// skipped by the UnknownMediaTypeSkip policy.
+var errSkippedLayer = errors.New("layer of unknown media type skipped")
+
+// warnLayer warns about the layer d once, its blob being read by each of
+// the steps of the extraction, and by the retries of its extraction.
+func (u *rootfsUnpacker) warnLayer(d digest.Digest, format string, a ...interface{}) {
+	if u.warnedLayers[d] {
+		return
+	}
+	if u.warnedLayers == nil {
+		u.warnedLayers = make(map[digest.Digest]bool)
+	}
+	u.warnedLayers[d] = true
+	u.warnings.warnf(format, a...)
+}
+
+// lookupMediaType returns how the layer blob described by desc is read. An
+// unknown media type is handled according to u.unknownPolicy: it is an
+// error by default, is read as an uncompressed tar stream with
+// UnknownMediaTypePassthrough, or errSkippedLayer is returned with
+// UnknownMediaTypeSkip.
+func (u *rootfsUnpacker) lookupMediaType(desc imgspecv1.Descriptor) (layerMediaType, error) {
+	if mt, ok := layerMediaTypes[desc.MediaType]; ok {
+		return mt, nil
+	}
+	switch u.unknownPolicy {
+	case sytypes.UnknownMediaTypePassthrough:
+		u.warnLayer(desc.Digest, "Layer %s has the unknown media type %s, extracting it as an uncompressed tar stream", desc.Digest, desc.MediaType)
+		return layerMediaType{compression: uncompressedLayer}, nil
+	case sytypes.UnknownMediaTypeSkip:
+		u.warnLayer(desc.Digest, "Skipping layer %s of unknown media type %s", desc.Digest, desc.MediaType)
+		return layerMediaType{}, errSkippedLayer
+	default:
+		return layerMediaType{}, fmt.Errorf("unsupported media type: %s", desc.MediaType)
+	}
+}
+
+// readBlob calls read with the uncompressed tar stream of the layer blob
+// described by desc, checking that its content matches diffID, and returns
+// the digest of the stream read. It returns errSkippedLayer without reading
+// a layer skipped by lookupMediaType.
+func (u *rootfsUnpacker) readBlob(ctx context.Context, desc imgspecv1.Descriptor, diffID digest.Digest, read func(io.Reader) error) (digest.Digest, error) {
+	mt, err := u.lookupMediaType(desc)
+	if err != nil {
+		return "", err
+	}
+
+	blob, err := u.engine.FromDescriptor(ctx, desc)
+	if err != nil {
+		return "", fmt.Errorf("error obtaining blob: %s", err)
+	}
+	defer blob.Close()
+
+	data, ok := blob.Data.(io.ReadCloser)
+	if !ok {
+		return "", fmt.Errorf("unsupported media type: %s", desc.MediaType)
+	}
+
+	if mt.foreign {
+		u.warnLayer(desc.Digest, "Layer %s is a foreign layer, its redistribution may be restricted", desc.Digest)
+	}
+
+	var raw io.Reader = data
+	switch mt.compression {
+	case uncompressedLayer:
+	case gzipLayer:
+		gz, err := newGzipReader(data, u.parallelGzip)
+		if err != nil {
+			return "", fmt.Errorf("error creating gzip reader: %s", err)
+		}
+		defer gz.Close()
+		raw = gz
+		if u.verifyGzip {
+			trailer := &gzipTrailerReader{r: gz}
+			defer func() {
+				if trailer.verified {
+					sylog.Debugf("Verified the gzip trailer of layer %s", desc.Digest)
+				}
+			}()
+			raw = trailer
+		}
+	case zstdLayer:
+		if isZstdChunked(desc) {
+			sylog.Debugf("Layer %s is zstd:chunked, partial pulls are not supported, using the whole layer", desc.Digest)
+		}
+		zr, err := zstd.NewReader(data)
+		if err != nil {
+			return "", fmt.Errorf("error creating zstd reader: %s", err)
+		}
+		defer zr.Close()
+		raw = zr
+	}
+
+	if u.monitor != nil {
+		raw = u.monitor.reader(raw)
+	}
+
+	digester := digest.SHA256.Digester()
+	layer := io.TeeReader(raw, digester.Hash())
+
+	if err := read(layer); err != nil {
+		return "", err
+	}
+
+	// consume any trailing data so the digest covers the whole stream
+	if n, err := io.Copy(io.Discard, layer); err != nil {
+		return "", fmt.Errorf("error reading trailing data: %s", err)
+	} else if n != 0 {
+		sylog.Debugf("Ignoring %d trailing bytes in layer %s", n, desc.Digest)
+	}
+
+	d := digester.Digest()
+	if d != diffID {
+		return "", fmt.Errorf("diff ID mismatch: got %s, expected %s", d, diffID)
+	}
+	return d, nil
+}
+
+// zstdChunkedManifestKey is the annotation of the zstd:chunked layers
+// giving the position of their table of contents, enabling partial pulls.
+const zstdChunkedManifestKey = "io.github.containers.zstd-chunked.manifest-position"
+
+// isZstdChunked returns whether the layer described by desc is a
+// zstd:chunked layer. Its table of contents and tar-split data are stored in
+// zstd skippable frames, ignored when decompressing the whole layer.
+func isZstdChunked(desc imgspecv1.Descriptor) bool {
+	_, ok := desc.Annotations[zstdChunkedManifestKey]
+	return ok
+}
+
+// errGzipTrailer is returned when reading a gzip layer whose stream is
+// truncated, or doesn't match the CRC-32 or size of its trailer, with the
+// VerifyGzip option.
+var errGzipTrailer = errors.New("gzip trailer verification failed")
+
+// gzipTrailerReader reads the gzip decompressor r, reporting the errors of a
+// truncated stream or of a trailer mismatch as errGzipTrailer errors. The
+// decompressor checks the trailer once the whole stream is read, which
+// readBlob always does after the extraction of the tar stream.
+type gzipTrailerReader struct {
+	r io.Reader
+	// verified is set once the end of the stream is reached, the trailer
+	// matching
+	verified bool
+}
+
+func (g *gzipTrailerReader) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	switch {
+	case err == io.EOF:
+		g.verified = true
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		err = fmt.Errorf("%w: truncated gzip stream", errGzipTrailer)
+	case errors.Is(err, gzip.ErrChecksum), errors.Is(err, pgzip.ErrChecksum):
+		err = fmt.Errorf("%w: CRC-32 or size mismatch", errGzipTrailer)
+	}
+	return n, err
+}
+
+// newGzipReader returns a gzip decompressor reading from r. With parallel,
+// the decompression is done by multiple goroutines and read ahead, which
+// speeds up the extraction of large layers on multi-core hosts.
+func newGzipReader(r io.Reader, parallel bool) (io.ReadCloser, error) {
+	if parallel {
+		return pgzip.NewReader(r)
+	}
+	return gzip.NewReader(r)
+}
+
+// entryError is a failure to extract the tar entry name of a layer.
+type entryError struct {
+	name string
+	err  error
+}
+
+func (e *entryError) Error() string {
+	return fmt.Sprintf("error extracting %s: %s", e.name, e.err)
+}
+
+func (e *entryError) Unwrap() error {
+	return e.err
+}
+
+// unpackLayer extracts the entries of the uncompressed tar stream layer of
+// the layer at index idx.
+func (u *rootfsUnpacker) unpackLayer(idx int, layer io.Reader) error {
+	te := umocilayer.NewTarExtractor(u.opts)
+	tr := tar.NewReader(layer)
+	content := newEntryReader(tr, u.bufferSize)
+	content.sparse = u.sparse
+	unpackEntry := u.unpackEntry
+	exists := func(path string) bool {
+		return rootfsExists(u.rootfs, path)
+	}
+	if unpackEntry == nil && u.fsys != nil {
+		e := newFSExtractor(u.fsys, u.opts.MapOptions, u.warnings)
+		unpackEntry = func(_ *umocilayer.TarExtractor, hdr *tar.Header, r io.Reader) error {
+			return e.unpackEntry(hdr, r)
+		}
+		exists = func(path string) bool {
+			dir, base := filepath.Split(path)
+			_, err := u.fsys.Lstat(joinEntryPath(e.resolve(dir), base))
+			return err == nil
+		}
+	} else if unpackEntry == nil {
+		unpackEntry = func(te *umocilayer.TarExtractor, hdr *tar.Header, r io.Reader) error {
+			return te.UnpackEntry(u.rootfs, hdr, r)
+		}
+	}
+	if u.links != nil {
+		u.links.reset()
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading tar entry: %w", err)
+		}
+
+		hdr, spooled, err := u.filterLinkedEntry(hdr, content, exists)
+		if err != nil {
+			return err
+		} else if hdr == nil {
+			continue
+		}
+		var r io.Reader = content
+		if spooled != nil {
+			r = spooled
+		}
+
+		if u.collisions != nil {
+			if collisions := u.collisions.check(hdr); len(collisions) > 0 {
+				if !u.warnCollisions {
+					// the extraction fails once all layers are checked
+					continue
+				}
+				for _, c := range collisions {
+					u.warnings.warnf("Case collision on a case-insensitive filesystem: %s", c)
+				}
+			}
+		}
+
+		if u.privileged != nil {
+			u.privileged.check(hdr)
+		}
+		var acls map[string][]byte
+		if u.acls != nil {
+			acls = u.acls.strip(hdr)
+		}
+		err = unpackEntry(te, hdr, r)
+		if spooled != nil {
+			spooled.Close()
+		}
+		if err == nil && acls != nil {
+			err = u.acls.apply(u.rootfs, hdr, acls)
+		}
+		if err != nil {
+			return &entryError{name: hdr.Name, err: err}
+		}
+
+		if u.provenance != nil {
+			u.recordEntry(idx, hdr)
+			if u.maxFiles > 0 && len(u.provenance) > u.maxFiles {
+				return fmt.Errorf("%w of %d files set for the build", errTooManyFiles, u.maxFiles)
+			}
+		}
+	}
+}
+
+// newTarFilter returns the pipeline of filters, nil if there is none.
+func newTarFilter(filters []sytypes.TarFilter) sytypes.TarFilter {
+	if len(filters) == 0 {
+		return nil
+	}
+	return sytypes.TarFilterPipeline(filters)
+}
+
+// filterEntry returns the tar entry hdr as transformed by the include and
+// the filter of u, or nil if it isn't extracted. The hard links whose
+// target isn't included are left to the resolver of u, when set.
+func (u *rootfsUnpacker) filterEntry(hdr *tar.Header) (*tar.Header, error) {
+	if u.include != nil && u.links != nil && !u.include.matchPath(hdr) {
+		return nil, nil
+	} else if u.include != nil && u.links == nil && !u.include.matchEntry(hdr) {
+		return nil, nil
+	}
+	if u.filter == nil {
+		return hdr, nil
+	}
+	name := hdr.Name
+	hdr, err := u.filter.Filter(hdr)
+	if err != nil {
+		return nil, fmt.Errorf("error filtering %s: %w", name, err)
+	}
+	return hdr, nil
+}
+
+// sparseBlockSize is the size of the blocks of zeros written as holes by
+// entryReader, the usual size of the blocks of the filesystems.
+const sparseBlockSize = 4 << 10
+
+// entryReader reads the content of the tar entries of a layer, copied to
+// the rootfs with its own buffer instead of the default one of io.Copy.
+type entryReader struct {
+	r   io.Reader
+	buf []byte
+	// sparse writes the blocks of zeros as holes to the files supporting it
+	sparse bool
+}
+
+// sparseFile is a file the blocks of zeros are written to as holes, by
+// seeking over them, e.g. an *os.File.
+type sparseFile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+}
+
+// newEntryReader returns a reader of the content of the entries read from
+// r, copied with a buffer of size bytes, sytypes.DefaultExtractBufferSize
+// when zero.
+func newEntryReader(r io.Reader, size int) *entryReader {
+	if size <= 0 {
+		size = sytypes.DefaultExtractBufferSize
+	}
+	return &entryReader{r: r, buf: make([]byte, size)}
+}
+
+func (e *entryReader) Read(p []byte) (int, error) {
+	return e.r.Read(p)
+}
+
+// WriteTo copies the content of the entry to w, used by io.Copy before the
+// ReadFrom method of w, e.g. of an *os.File. The buffer of e is filled
+// before each write, the decompressors returning smaller reads.
+func (e *entryReader) WriteTo(w io.Writer) (int64, error) {
+	if f, ok := w.(sparseFile); ok && e.sparse {
+		return e.writeSparse(f)
+	}
+	var written int64
+	for {
+		n := 0
+		var rerr error
+		for n < len(e.buf) && rerr == nil {
+			var m int
+			m, rerr = e.r.Read(e.buf[n:])
+			n += m
+		}
+		if n > 0 {
+			m, err := w.Write(e.buf[:n])
+			written += int64(m)
+			if err != nil {
+				return written, err
+			} else if m != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		} else if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// writeSparse copies the content of the entry to the new file f, seeking
+// over the blocks of zeros of the buffer of e instead of writing them, so
+// that they are left as holes by the filesystems supporting them. The file
+// is truncated to the size of the content when it ends with a hole.
+func (e *entryReader) writeSparse(f sparseFile) (int64, error) {
+	var written int64
+	hole := false
+	for {
+		n, rerr := io.ReadFull(e.r, e.buf)
+		for off := 0; off < n; {
+			end := off + sparseBlockSize
+			if end > n {
+				end = n
+			}
+			block := e.buf[off:end]
+			if isZeros(block) {
+				if _, err := f.Seek(int64(len(block)), io.SeekCurrent); err != nil {
+					return written, err
+				}
+				hole = true
+			} else {
+				// the following blocks of data are written at once
+				for end < n {
+					next := end + sparseBlockSize
+					if next > n {
+						next = n
+					}
+					if isZeros(e.buf[end:next]) {
+						break
+					}
+					end = next
+				}
+				block = e.buf[off:end]
+				m, err := f.Write(block)
+				if err != nil {
+					return written + int64(m), err
+				} else if m != len(block) {
+					return written + int64(m), io.ErrShortWrite
+				}
+				hole = false
+			}
+			written += int64(len(block))
+			off = end
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			return written, rerr
+		}
+	}
+	if hole {
+		if err := f.Truncate(written); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// isZeros reports whether b only holds zeros.
+func isZeros(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// recordEntry updates the provenance index after the extraction of the
+// entry hdr from the layer at index idx.
+func (u *rootfsUnpacker) recordEntry(idx int, hdr *tar.Header) {
+	path := "/" + cleanEntryPath(hdr.Name)
+	dir, base := filepath.Split(path)
+
+	switch {
+	case base == whiteoutOpaqueDir:
+		// content from lower layers is hidden, the directory itself is kept
+		u.forget(filepath.Clean(dir), false, idx)
+	case strings.HasPrefix(base, whiteoutPrefix):
+		u.forget(dir+strings.TrimPrefix(base, whiteoutPrefix), true, idx)
+	default:
+		if hdr.Typeflag != tar.TypeDir {
+			// a non directory entry replaces any directory from lower layers
+			u.forget(path, false, idx)
+		}
+		u.provenance[path] = idx
+	}
+}
+
+// forget removes the paths below path, and path itself when self is set,
+// written by the layers before the layer at index idx from the provenance
+// index.
+func (u *rootfsUnpacker) forget(path string, self bool, idx int) {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for p, l := range u.provenance {
+		if l < idx && (strings.HasPrefix(p, prefix) || (self && p == path)) {
+			delete(u.provenance, p)
+		}
+	}
+}
+
+// provenanceIndex returns the provenance index with the layers identified
+// by their digest in manifest.
+func (u *rootfsUnpacker) provenanceIndex(manifest imgspecv1.Manifest) sytypes.Provenance {
+	p := make(sytypes.Provenance, len(u.provenance))
+	for path, idx := range u.provenance {
+		p[path] = manifest.Layers[idx].Digest
+	}
+	return p
+}
+
+// pathFilter selects the layer entries to extract from a list of path
+// prefixes. The parent directories of the prefixes are also extracted, to
+// preserve their ownership and permissions, and whiteouts are honored for
+// any selected path.
+type pathFilter struct {
+	prefixes []string
+}
+
+// newPathFilter returns a filter for the given absolute or relative path
+// prefixes, or nil if no prefixes are given.
+func newPathFilter(paths []string) *pathFilter {
+	if len(paths) == 0 {
+		return nil
+	}
+	f := &pathFilter{}
+	for _, p := range paths {
+		f.prefixes = append(f.prefixes, cleanEntryPath(p))
+	}
+	return f
+}
+
+// cleanEntryPath returns the cleaned form of a path relative to the
+// root filesystem, "" being the root itself.
+func cleanEntryPath(p string) string {
+	return strings.TrimPrefix(filepath.Clean("/"+p), "/")
+}
+
+// match reports whether path is included, or is a parent directory of an
+// included path.
+func (f *pathFilter) match(path string) bool {
+	for _, prefix := range f.prefixes {
+		switch {
+		case prefix == "" || path == prefix || path == "":
+			return true
+		case strings.HasPrefix(path, prefix+"/"), strings.HasPrefix(prefix, path+"/"):
+			return true
+		}
+	}
+	return false
+}
+
+// matchEntry reports whether the tar entry hdr must be extracted, see
+// matchPath. A hard link whose target isn't included is skipped.
+func (f *pathFilter) matchEntry(hdr *tar.Header) bool {
+	if !f.matchPath(hdr) {
+		return false
+	}
+
+	// a hard link can't be created if its target isn't extracted
+	if hdr.Typeflag == tar.TypeLink && !f.match(cleanEntryPath(hdr.Linkname)) {
+		sylog.Warningf("Skipping hard link %s: target %s is not included", hdr.Name, hdr.Linkname)
+		return false
+	}
+	return true
+}
+
+// matchPath reports whether the path of the tar entry hdr is included. A
+// whiteout entry is matched against the path it removes, and an opaque
+// whiteout against its directory.
+func (f *pathFilter) matchPath(hdr *tar.Header) bool {
+	path := cleanEntryPath(hdr.Name)
+	dir, base := filepath.Split(path)
+	target := path
+	if base == whiteoutOpaqueDir {
+		target = cleanEntryPath(dir)
+	} else if strings.HasPrefix(base, whiteoutPrefix) {
+		target = cleanEntryPath(dir + strings.TrimPrefix(base, whiteoutPrefix))
+	}
+	return f.match(target)
+}
+
+// checkPerms will work through the rootfs of this bundle, and find if any
+// directory does not have owner rwX - which may cause unexpected issues for a
+// user trying to look through, or delete a sandbox. All of the restrictive
+// paths found are passed to handler, or reported as warnings when handler is
+// nil.
+func checkPerms(rootfs string, handler sytypes.RestrictivePermsHandler, warnings *warningRecorder) error {
+	paths, err := findRestrictivePerms(rootfs)
+	if err != nil {
+		return err
+	}
+	return reportRestrictivePerms(paths, handler, warnings)
+}
+
+// findRestrictivePerms returns the paths of rootfs with restrictive
+// permissions.
+func findRestrictivePerms(rootfs string) (paths []string, err error) {
+	err = fs.PermWalk(rootfs, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			// If the walk function cannot access a directory at all, that's an
+			// obvious restrictive permission we need to warn on
+			if os.IsPermission(err) {
+				sylog.Debugf("Path %q has restrictive permissions", path)
+				paths = append(paths, path)
+				return nil
+			}
+			return fmt.Errorf("unable to access rootfs path %s: %s", path, err)
+		}
+		if restrictivePerms(f) {
+			sylog.Debugf("Path %q has restrictive permissions", path)
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// reportRestrictivePerms passes the paths with restrictive permissions to
+// handler, or warns about them when handler is nil.
+func reportRestrictivePerms(paths []string, handler sytypes.RestrictivePermsHandler, warnings *warningRecorder) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	if handler != nil {
+		return handler(paths)
+	}
+
+	warnings.warnf("The sandbox contain files/dirs that cannot be removed with 'rm'.")
+	sylog.Warningf("Use 'chmod -R u+rwX' to set permissions that allow removal.")
+	sylog.Warningf("Use the '--fix-perms' option to 'apptainer build' to modify permissions at build time.")
+	// It's not an error any further up... the rootfs is still usable
+	return nil
 }
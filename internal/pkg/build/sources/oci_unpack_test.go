@@ -0,0 +1,2549 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/build/sbom"
+	"github.com/apptainer/apptainer/internal/pkg/fakeroot"
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/image"
+	"github.com/apptainer/apptainer/pkg/sylog"
+	dockerarchive "github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/manifest"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage/pkg/chunked/compressor"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	umocilayer "github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/idtools"
+	"golang.org/x/sys/unix"
+)
+
+// unpackTestImage writes img as the OCI layout of a new bundle configured
+// with configure, and extracts it into the bundle rootfs.
+func unpackTestImage(t *testing.T, img *testImage, configure func(*sytypes.Bundle)) (*sytypes.Bundle, error) {
+	t.Helper()
+
+	b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("while creating bundle: %s", err)
+	}
+	t.Cleanup(func() { b.Remove() })
+	if configure != nil {
+		configure(b)
+	}
+
+	img.writeLayout(t, b.TmpDir, "tmp")
+	ref, err := ocilayout.ParseReference(b.TmpDir + ":tmp")
+	if err != nil {
+		t.Fatalf("while parsing layout reference: %s", err)
+	}
+
+	_, err = unpackRootfs(context.Background(), b, ref, stubSysCtx())
+	return b, err
+}
+
+// assertPaths checks that each path exists under root, or doesn't exist
+// when mapped to false.
+func assertPaths(t *testing.T, root string, paths map[string]bool) {
+	t.Helper()
+
+	for p, exists := range paths {
+		_, err := os.Lstat(filepath.Join(root, p))
+		if exists && err != nil {
+			t.Errorf("%s: unexpected error: %s", p, err)
+		} else if !exists && !os.IsNotExist(err) {
+			t.Errorf("%s: unexpectedly present (err=%v)", p, err)
+		}
+	}
+}
+
+func TestUnpackRootfsIncludePaths(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	lower := makeLayer(t,
+		dirEntry("opt/"),
+		dirEntry("opt/myapp/"),
+		tarEntry{name: "opt/myapp/bin", body: "bin", mode: 0o755},
+		tarEntry{name: "opt/myapp/old", body: "old"},
+		dirEntry("opt/myapp/cache/"),
+		tarEntry{name: "opt/myapp/cache/entry", body: "entry"},
+		dirEntry("opt/other/"),
+		tarEntry{name: "opt/other/file", body: "other"},
+		dirEntry("usr/"),
+		tarEntry{name: "usr/tool", body: "tool"},
+	)
+	upper := makeLayer(t,
+		dirEntry("opt/myapp/"),
+		tarEntry{name: "opt/myapp/.wh.old"},
+		dirEntry("opt/myapp/cache/"),
+		tarEntry{name: "opt/myapp/cache/.wh..wh..opq"},
+		tarEntry{name: "opt/myapp/new", body: "new"},
+		tarEntry{name: "opt/myapp/link", typeflag: tar.TypeLink, linkname: "opt/myapp/bin"},
+		tarEntry{name: "opt/myapp/outside", typeflag: tar.TypeLink, linkname: "usr/tool"},
+		tarEntry{name: "opt/.wh.other"},
+		tarEntry{name: "usr/tool2", body: "tool2"},
+	)
+	img := newTestImage(t, nil, lower, upper)
+
+	b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+		b.Opts.IncludePaths = []string{"/opt/myapp"}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	assertPaths(t, b.RootfsPath, map[string]bool{
+		"opt/myapp/bin":         true,
+		"opt/myapp/new":         true,
+		"opt/myapp/link":        true,
+		"opt/myapp/old":         false,
+		"opt/myapp/cache":       true,
+		"opt/myapp/cache/entry": false,
+		"opt/myapp/outside":     false,
+		"opt/other":             false,
+		"usr":                   false,
+	})
+}
+
+func TestUnpackRootfsTarFilters(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t,
+		dirEntry("opt/"),
+		dirEntry("opt/myapp/"),
+		tarEntry{name: "opt/myapp/bin", body: "bin", mode: 0o4755},
+		tarEntry{name: "opt/myapp/link", typeflag: tar.TypeLink, linkname: "opt/myapp/bin"},
+		tarEntry{name: "opt/myapp/cache.tmp", body: "cache"},
+		dirEntry("usr/"),
+		tarEntry{name: "usr/tool", body: "tool", mode: 0o2755, uid: 10, gid: 10},
+	))
+
+	var errFiltered error
+	filters := []sytypes.TarFilter{
+		sytypes.NewDropTarFilter(func(name string) bool { return strings.HasSuffix(name, ".tmp") }),
+		sytypes.NewRenameTarFilter(func(name string) string { return strings.Replace(name, "opt/", "usr/local/", 1) }),
+		sytypes.NewOwnerTarFilter(1000, 1000),
+		sytypes.StripSetuidTarFilter,
+		sytypes.TarFilterFunc(func(hdr *tar.Header) (*tar.Header, error) {
+			return hdr, errFiltered
+		}),
+	}
+	b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+		b.Opts.TarFilters = filters
+		b.Opts.VerifyRootfs = true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	assertPaths(t, b.RootfsPath, map[string]bool{
+		"usr/local/myapp/bin":       true,
+		"usr/local/myapp/link":      true,
+		"usr/local/myapp/cache.tmp": false,
+		"usr/tool":                  true,
+		"opt":                       false,
+	})
+	for _, p := range []string{"usr/local/myapp/bin", "usr/tool"} {
+		fi, err := os.Lstat(filepath.Join(b.RootfsPath, p))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if fi.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 || st.Uid != 1000 || st.Gid != 1000 {
+			t.Errorf("%s: unexpected mode %s, owner %d:%d", p, fi.Mode(), st.Uid, st.Gid)
+		}
+		if p == "usr/local/myapp/bin" && st.Nlink != 2 {
+			t.Errorf("%s: unexpected number of links %d", p, st.Nlink)
+		}
+	}
+
+	errFiltered = errors.New("bad entry")
+	_, err = unpackTestImage(t, img, func(b *sytypes.Bundle) {
+		b.Opts.TarFilters = filters
+	})
+	if err == nil || !strings.Contains(err.Error(), "error filtering opt/: bad entry") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUnpackRootfsProvenance(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	base := makeLayer(t,
+		dirEntry("etc/"),
+		tarEntry{name: "etc/config", body: "base"},
+		tarEntry{name: "etc/hosts", body: "base"},
+		dirEntry("var/"),
+		dirEntry("var/lib/"),
+		tarEntry{name: "var/lib/db", body: "base"},
+		dirEntry("opt/"),
+		tarEntry{name: "opt/removed", body: "base"},
+	)
+	update := makeLayer(t,
+		dirEntry("etc/"),
+		tarEntry{name: "etc/config", body: "update"},
+		tarEntry{name: "var/lib/.wh..wh..opq"},
+		tarEntry{name: "var/lib/new", body: "update"},
+		tarEntry{name: "opt/.wh.removed"},
+	)
+	img := newTestImage(t, nil, base, update)
+	baseDigest := img.manifest.Layers[0].Digest
+	updateDigest := img.manifest.Layers[1].Digest
+
+	b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+		b.Opts.Provenance = true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	p, err := sytypes.ParseProvenance(b.JSONObjects[image.SIFDescProvenanceJSON])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		path   string
+		digest digest.Digest
+	}{
+		{"/etc/config", updateDigest},
+		{"etc/hosts", baseDigest},
+		{"/etc", updateDigest},
+		{"/var/lib", baseDigest},
+		{"/var/lib/new", updateDigest},
+		{"/var/lib/db", ""},
+		{"/opt/removed", ""},
+	}
+	for _, tt := range tests {
+		d, ok := p.Lookup(tt.path)
+		if tt.digest == "" && ok {
+			t.Errorf("%s: unexpectedly attributed to %s", tt.path, d)
+		} else if d != tt.digest {
+			t.Errorf("%s: got layer %q, want %q", tt.path, d, tt.digest)
+		}
+	}
+}
+
+func TestUnpackRootfsSBOM(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t,
+		dirEntry("etc/"),
+		tarEntry{name: "etc/os-release", body: "ID=debian\nVERSION_ID=\"12\"\n"},
+		dirEntry("var/"),
+		dirEntry("var/lib/"),
+		dirEntry("var/lib/dpkg/"),
+		tarEntry{name: "var/lib/dpkg/status", body: "Package: libc6\nStatus: install ok installed\nArchitecture: amd64\nVersion: 2.36-9\n"},
+	))
+
+	b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+		b.Opts.SBOM = true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var s sbom.SBOM
+	if err := json.Unmarshal(b.JSONObjects[image.SIFDescSBOMJSON], &s); err != nil {
+		t.Fatalf("while decoding SBOM: %s", err)
+	}
+	want := []sbom.Package{{Type: sbom.TypeDeb, Name: "libc6", Version: "2.36-9", Arch: "amd64"}}
+	if s.OS.ID != "debian" || !reflect.DeepEqual(s.Packages, want) {
+		t.Errorf("unexpected SBOM %+v", s)
+	}
+}
+
+func TestUnpackRootfsNormalizeNetFiles(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t,
+		dirEntry("etc/"),
+		tarEntry{name: "etc/resolv.conf", typeflag: tar.TypeSymlink, linkname: "../run/systemd/resolve/stub-resolv.conf"},
+		tarEntry{name: "etc/hosts", body: "10.0.0.1\tbuildhost\n"},
+	))
+
+	tests := []struct {
+		name        string
+		mode        string
+		wantHosts   string
+		wantSymlink bool
+	}{
+		{name: "not set", wantHosts: "10.0.0.1\tbuildhost\n", wantSymlink: true},
+		{name: "empty", mode: sytypes.NetFilesEmpty},
+		{name: "template", mode: sytypes.NetFilesTemplate, wantHosts: "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.NormalizeNetFiles = tt.mode
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			fi, err := os.Lstat(filepath.Join(b.RootfsPath, "etc", "resolv.conf"))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if isSymlink := fi.Mode()&os.ModeSymlink != 0; isSymlink != tt.wantSymlink {
+				t.Errorf("unexpected resolv.conf mode %s", fi.Mode())
+			}
+			data, err := os.ReadFile(filepath.Join(b.RootfsPath, "etc", "hosts"))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(data) != tt.wantHosts {
+				t.Errorf("unexpected hosts content %q, want %q", data, tt.wantHosts)
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsPreserveManifest(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+
+	tests := []struct {
+		name     string
+		preserve bool
+	}{
+		{name: "disabled", preserve: false},
+		{name: "enabled", preserve: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.PreserveManifest = tt.preserve
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			objects := map[string][]byte{
+				image.SIFDescOCIManifestJSON:    img.manifestData,
+				image.SIFDescOCIImageConfigJSON: img.configData,
+			}
+			for name, want := range objects {
+				got, ok := b.JSONObjects[name]
+				if ok != tt.preserve {
+					t.Fatalf("unexpected presence of %s: %v", name, ok)
+				}
+				if ok && !bytes.Equal(got, want) {
+					t.Errorf("%s doesn't match the fetched bytes:\n%s\nwant:\n%s", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsSubject(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	// an OCI 1.1 image referring to another image, e.g. a signed image
+	// pointing to the image it signs
+	target := newTestImage(t, nil, makeLayer(t, tarEntry{name: "target", body: "target"}))
+	subject := &imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Digest:    target.manifestDigest,
+		Size:      int64(len(target.manifestData)),
+	}
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	img.manifest.Subject = subject
+	img.update(t)
+
+	unpack := func(img *testImage) (*sytypes.Bundle, *imgspecv1.Descriptor, error) {
+		b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+		if err != nil {
+			t.Fatalf("while creating bundle: %s", err)
+		}
+		t.Cleanup(func() { b.Remove() })
+
+		img.writeLayout(t, b.TmpDir, "tmp")
+		ref, err := ocilayout.ParseReference(b.TmpDir + ":tmp")
+		if err != nil {
+			t.Fatalf("while parsing layout reference: %s", err)
+		}
+		res, err := unpackRootfs(context.Background(), b, ref, stubSysCtx())
+		if err != nil {
+			return b, nil, err
+		}
+		return b, res.subject, nil
+	}
+
+	b, got, err := unpack(img)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertPaths(t, b.RootfsPath, map[string]bool{"file": true, "target": false})
+	if !reflect.DeepEqual(got, subject) {
+		t.Fatalf("unexpected subject %+v, want %+v", got, subject)
+	}
+
+	cp := &OCIConveyorPacker{b: b, subject: got}
+	if err := os.MkdirAll(filepath.Join(b.RootfsPath, ".singularity.d"), 0o755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := cp.insertOCILabels(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data, err := os.ReadFile(filepath.Join(b.RootfsPath, ".singularity.d", "labels.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(data, &labels); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if labels[subjectLabel] != target.manifestDigest.String() {
+		t.Errorf("unexpected subject label %q, want %q", labels[subjectLabel], target.manifestDigest)
+	}
+
+	// an image without subject
+	if _, got, err := unpack(target); err != nil || got != nil {
+		t.Errorf("unexpected subject %+v (err=%v)", got, err)
+	}
+
+	// an artifact referring to the image isn't extracted as an image
+	artifact := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	artifact.manifest.ArtifactType = "application/vnd.example.signature"
+	artifact.manifest.Config.MediaType = imgspecv1.MediaTypeEmptyJSON
+	artifact.manifest.Subject = subject
+	artifact.update(t)
+	if _, _, err := unpack(artifact); err == nil || !strings.Contains(err.Error(), "artifact of type application/vnd.example.signature, not an image") {
+		t.Errorf("unexpected error for an artifact: %v", err)
+	}
+}
+
+func TestUnpackRootfsWarningsAsErrors(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	restrictive := newTestImage(t, nil, makeLayer(t,
+		tarEntry{name: "locked/", typeflag: tar.TypeDir, mode: 0o500},
+	))
+	foreign := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	foreign.manifest.Layers[0].MediaType = imgspecv1.MediaTypeImageLayerNonDistributableGzip //nolint:staticcheck
+	foreign.update(t)
+	clean := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+
+	tests := []struct {
+		name     string
+		img      *testImage
+		strict   bool
+		wantErr  string
+		sandbox  bool
+		fixPerms bool
+	}{
+		{name: "restrictive perms", img: restrictive, sandbox: true},
+		{name: "restrictive perms strict", img: restrictive, sandbox: true, strict: true, wantErr: "cannot be removed"},
+		{name: "restrictive perms fixed", img: restrictive, sandbox: true, fixPerms: true, strict: true},
+		{name: "foreign layer", img: foreign},
+		{name: "foreign layer strict", img: foreign, strict: true, wantErr: "foreign layer"},
+		{name: "no warnings strict", img: clean, sandbox: true, strict: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := unpackTestImage(t, tt.img, func(b *sytypes.Bundle) {
+				b.Opts.WarningsAsErrors = tt.strict
+				b.Opts.SandboxTarget = tt.sandbox
+				b.Opts.FixPerms = tt.fixPerms
+			})
+			t.Cleanup(func() { os.Chmod(filepath.Join(b.RootfsPath, "locked"), 0o755) })
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsVerifyLayers(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil,
+		makeLayer(t, tarEntry{name: "first", body: "1"}),
+		makeLayer(t),
+		makeLayer(t, tarEntry{name: "second", body: "2"}),
+	)
+	if got := img.config.RootFS.DiffIDs[1]; got != emptyLayerDiffID {
+		t.Fatalf("unexpected diff ID of the empty layer: %s", got)
+	}
+
+	b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+		b.Opts.VerifyLayers = true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertPaths(t, b.RootfsPath, map[string]bool{"first": true, "second": true})
+}
+
+func TestUnpackRootfsMaxFiles(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	// the first layer holds 51 paths, the second one hides 50 of them and
+	// adds 51 more, for 52 paths in the rootfs
+	lower := []tarEntry{dirEntry("a/")}
+	upper := []tarEntry{{name: "a/.wh..wh..opq"}, dirEntry("b/")}
+	for i := 0; i < 50; i++ {
+		lower = append(lower, tarEntry{name: fmt.Sprintf("a/%d", i), body: "a"})
+		upper = append(upper, tarEntry{name: fmt.Sprintf("b/%d", i), body: "b"})
+	}
+	img := newTestImage(t, nil, makeLayer(t, lower...), makeLayer(t, upper...))
+
+	tests := []struct {
+		name     string
+		maxFiles int
+		wantErr  string
+	}{
+		{name: "unlimited"},
+		{name: "at limit", maxFiles: 52},
+		{name: "above limit", maxFiles: 51, wantErr: "more than the maximum of 51 files"},
+		{name: "first layer above limit", maxFiles: 10, wantErr: "layer " + img.manifest.Layers[0].Digest.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.MaxFiles = tt.maxFiles
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if _, ok := b.JSONObjects[image.SIFDescProvenanceJSON]; ok {
+				t.Errorf("provenance index recorded without the Provenance option")
+			}
+			assertPaths(t, b.RootfsPath, map[string]bool{"a": true, "a/0": false, "b/49": true})
+		})
+	}
+}
+
+func TestUnpackRootfsMaxFileSize(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	// a 1 MiB file of zeroes, compressed to a few bytes in the layer
+	img := newTestImage(t, nil, makeLayer(t,
+		dirEntry("opt/"),
+		tarEntry{name: "opt/bomb", body: strings.Repeat("\x00", 1<<20)},
+		tarEntry{name: "opt/small", body: "small"},
+	))
+
+	tests := []struct {
+		name        string
+		maxFileSize int64
+		policy      string
+		keepGoing   bool
+		wantErr     string
+		wantBomb    bool
+	}{
+		{name: "unlimited", wantBomb: true},
+		{name: "at limit", maxFileSize: 1 << 20, wantBomb: true},
+		{name: "above limit", maxFileSize: 1 << 10, wantErr: "error extracting opt/bomb: the file is larger than the maximum of 1024 bytes set for the build: 1048576 bytes"},
+		{name: "above limit keep going", maxFileSize: 1 << 10, keepGoing: true, wantErr: "larger than the maximum"},
+		{name: "skip", maxFileSize: 1 << 10, policy: sytypes.OversizedFileSkip},
+		{name: "invalid policy", maxFileSize: 1 << 10, policy: "truncate", wantErr: `invalid policy "truncate" for oversized files`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.MaxFileSize = tt.maxFileSize
+				b.Opts.OversizedFiles = tt.policy
+				b.Opts.KeepGoing = tt.keepGoing
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+				}
+				var se *sytypes.SourceError
+				if errors.As(err, &se) && se.Path != "/opt/bomb" {
+					t.Errorf("unexpected error path %q", se.Path)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			assertPaths(t, b.RootfsPath, map[string]bool{"opt/bomb": tt.wantBomb, "opt/small": true})
+		})
+	}
+}
+
+func TestUnpackRootfsKeepGoing(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	// the second layer isn't a tar stream
+	img := newTestImage(t, nil,
+		makeLayer(t, tarEntry{name: "first", body: "1"}),
+		bytes.Repeat([]byte("x"), 1024),
+		makeLayer(t, tarEntry{name: "third", body: "3"}),
+	)
+	bad := img.manifest.Layers[1].Digest
+
+	unpack := func(configure func(*sytypes.Bundle)) (*sytypes.Bundle, *unpackResult, error) {
+		b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+		if err != nil {
+			t.Fatalf("while creating bundle: %s", err)
+		}
+		t.Cleanup(func() { b.Remove() })
+		configure(b)
+
+		img.writeLayout(t, b.TmpDir, "tmp")
+		ref, err := ocilayout.ParseReference(b.TmpDir + ":tmp")
+		if err != nil {
+			t.Fatalf("while parsing layout reference: %s", err)
+		}
+		res, err := unpackRootfs(context.Background(), b, ref, stubSysCtx())
+		return b, res, err
+	}
+
+	// fail-fast by default
+	if _, _, err := unpack(func(b *sytypes.Bundle) {}); err == nil || !strings.Contains(err.Error(), "layer "+bad.String()) {
+		t.Fatalf("unexpected error without KeepGoing: %v", err)
+	}
+
+	b, res, err := unpack(func(b *sytypes.Bundle) {
+		b.Opts.KeepGoing = true
+		b.Opts.VerifyLayers = true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertPaths(t, b.RootfsPath, map[string]bool{"first": true, "third": true})
+	if !reflect.DeepEqual(res.failedLayers, []digest.Digest{bad}) {
+		t.Fatalf("unexpected failed layers %v, want %s", res.failedLayers, bad)
+	}
+
+	cp := &OCIConveyorPacker{b: b, failedLayers: res.failedLayers}
+	if err := os.MkdirAll(filepath.Join(b.RootfsPath, ".singularity.d"), 0o755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := cp.insertOCILabels(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data, err := os.ReadFile(filepath.Join(b.RootfsPath, ".singularity.d", "labels.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(data, &labels); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if labels[degradedLabel] != bad.String() {
+		t.Errorf("unexpected degraded label %q, want %q", labels[degradedLabel], bad)
+	}
+
+	// the maximum number of files still aborts the extraction
+	_, _, err = unpack(func(b *sytypes.Bundle) {
+		b.Opts.KeepGoing = true
+		b.Opts.MaxFiles = 1
+	})
+	if err == nil || !strings.Contains(err.Error(), "more than the maximum of 1 files") {
+		t.Fatalf("unexpected error with MaxFiles: %v", err)
+	}
+}
+
+func TestUnpackRootfsUnknownMediaTypes(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	const unknown = "application/vnd.example.layer.v1.tar"
+
+	tests := []struct {
+		name      string
+		mediaType string
+		gzip      bool
+		policy    string
+		wantErr   string
+		extracted bool
+		// warning is displayed once, the blob being read by each of the
+		// verifications
+		warning string
+	}{
+		{name: "tar", mediaType: imgspecv1.MediaTypeImageLayer, policy: sytypes.UnknownMediaTypeSkip, extracted: true},
+		{name: "gzip", mediaType: imgspecv1.MediaTypeImageLayerGzip, gzip: true, policy: sytypes.UnknownMediaTypeSkip, extracted: true},
+		{name: "foreign gzip", mediaType: imgspecv1.MediaTypeImageLayerNonDistributableGzip, gzip: true, extracted: true, warning: "is a foreign layer"}, //nolint:staticcheck
+		{name: "docker gzip", mediaType: manifest.DockerV2Schema2LayerMediaType, gzip: true, extracted: true},
+		{name: "unknown default", mediaType: unknown, wantErr: "unsupported media type: " + unknown},
+		{name: "unknown error", mediaType: unknown, policy: sytypes.UnknownMediaTypeError, wantErr: "unsupported media type: " + unknown},
+		{name: "unknown passthrough", mediaType: unknown, policy: sytypes.UnknownMediaTypePassthrough, extracted: true, warning: "has the unknown media type"},
+		{name: "unknown passthrough compressed", mediaType: unknown, gzip: true, policy: sytypes.UnknownMediaTypePassthrough, wantErr: "error reading tar entry"},
+		{name: "unknown skip", mediaType: unknown, gzip: true, policy: sytypes.UnknownMediaTypeSkip, warning: "Skipping layer"},
+		{name: "invalid policy", mediaType: imgspecv1.MediaTypeImageLayer, policy: "ignore", wantErr: `invalid policy "ignore"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "first", body: "1"}))
+			blob := makeLayer(t, tarEntry{name: "second", body: "2"})
+			img.config.RootFS.DiffIDs = append(img.config.RootFS.DiffIDs, digest.FromBytes(blob))
+			if tt.gzip {
+				blob = gzipBytes(t, blob)
+			}
+			d := digest.FromBytes(blob)
+			img.blobs[d] = blob
+			img.manifest.Layers = append(img.manifest.Layers, imgspecv1.Descriptor{
+				MediaType: tt.mediaType,
+				Digest:    d,
+				Size:      int64(len(blob)),
+			})
+			img.update(t)
+
+			var output bytes.Buffer
+			oldWriter := sylog.SetWriter(&output)
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.UnknownMediaTypes = tt.policy
+				b.Opts.VerifyLayers = true
+				b.Opts.VerifyRootfs = true
+			})
+			sylog.SetWriter(oldWriter)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			assertPaths(t, b.RootfsPath, map[string]bool{"first": true, "second": tt.extracted})
+			if tt.warning != "" && strings.Count(output.String(), tt.warning) != 1 {
+				t.Errorf("warning %q not displayed once:\n%s", tt.warning, output.String())
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsVerifyGzip(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	layer := makeLayer(t,
+		tarEntry{name: "file", body: "content"},
+		tarEntry{name: "data", body: string(compressibleData(64 << 10))},
+	)
+	compressed := gzipBytes(t, layer)
+
+	tests := []struct {
+		name    string
+		corrupt func([]byte) []byte
+		wantErr string
+	}{
+		{name: "valid"},
+		{
+			name:    "truncated stream",
+			corrupt: func(b []byte) []byte { return b[:len(b)/2] },
+			wantErr: "truncated gzip stream",
+		},
+		{
+			name:    "truncated trailer",
+			corrupt: func(b []byte) []byte { return b[:len(b)-4] },
+			wantErr: "truncated gzip stream",
+		},
+		{
+			name: "CRC mismatch",
+			corrupt: func(b []byte) []byte {
+				b[len(b)-8] ^= 0xff
+				return b
+			},
+			wantErr: "CRC-32 or size mismatch",
+		},
+	}
+	for _, tt := range tests {
+		for _, parallel := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/parallel=%t", tt.name, parallel), func(t *testing.T) {
+				img := newTestImage(t, nil, layer)
+				blob := append([]byte(nil), compressed...)
+				if tt.corrupt != nil {
+					blob = tt.corrupt(blob)
+				}
+				// the corrupted blob is stored under its own digest, as a
+				// registry would serve a layer corrupted before its push
+				d := digest.FromBytes(blob)
+				img.blobs[d] = blob
+				img.manifest.Layers[0].Digest = d
+				img.manifest.Layers[0].Size = int64(len(blob))
+				img.update(t)
+
+				b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+					b.Opts.VerifyGzip = true
+					b.Opts.ParallelGzip = parallel
+				})
+				if tt.wantErr == "" {
+					if err != nil {
+						t.Fatalf("unexpected error: %s", err)
+					}
+					assertPaths(t, b.RootfsPath, map[string]bool{"file": true, "data": true})
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), "layer "+d.String()) ||
+					!strings.Contains(err.Error(), errGzipTrailer.Error()) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: got %v, want %q for layer %s", err, tt.wantErr, d)
+				}
+
+				// the layer still fails without the verification
+				if _, err := unpackTestImage(t, img, nil); err == nil {
+					t.Fatalf("corrupted layer extracted without the VerifyGzip option")
+				}
+			})
+		}
+	}
+}
+
+func TestRootfsUnpackerExtractRetries(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	defer func(d time.Duration) { extractRetryDelay = d }(extractRetryDelay)
+	extractRetryDelay = 0
+
+	img := newTestImage(t, nil, makeLayer(t,
+		dirEntry("etc/"),
+		tarEntry{name: "etc/file", body: "content"},
+	))
+	corrupted := newTestImage(t, nil, makeLayer(t, tarEntry{name: "etc/file", body: "content"}))
+	corrupted.config.RootFS.DiffIDs[0] = digest.FromString("other")
+	corrupted.update(t)
+
+	tests := []struct {
+		name    string
+		img     *testImage
+		retries int
+		// failures is the number of attempts whose write of etc/file fails
+		failures     int
+		wantAttempts int
+		wantErr      string
+	}{
+		{name: "transient error retried", img: img, retries: 2, failures: 1, wantAttempts: 2},
+		{name: "transient error without retries", img: img, failures: 1, wantAttempts: 1, wantErr: "input/output error"},
+		{name: "retries exhausted", img: img, retries: 2, failures: 5, wantAttempts: 3, wantErr: "input/output error"},
+		{name: "integrity failure not retried", img: corrupted, retries: 2, wantAttempts: 1, wantErr: "diff ID mismatch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.img.writeLayout(t, dir, "tmp")
+			engineExt, err := umoci.OpenLayout(dir)
+			if err != nil {
+				t.Fatalf("while opening layout: %s", err)
+			}
+			defer engineExt.Close()
+
+			attempts := 0
+			rootfs := filepath.Join(t.TempDir(), "rootfs")
+			u := &rootfsUnpacker{
+				engine:  casext.NewEngine(engineExt),
+				rootfs:  rootfs,
+				retries: tt.retries,
+				unpackEntry: func(te *umocilayer.TarExtractor, hdr *tar.Header, r io.Reader) error {
+					if hdr.Name == "etc/file" {
+						attempts++
+						if attempts <= tt.failures {
+							return &os.PathError{Op: "write", Path: hdr.Name, Err: unix.EIO}
+						}
+					}
+					return te.UnpackEntry(rootfs, hdr, r)
+				},
+			}
+
+			err = u.unpack(context.Background(), tt.img.manifest)
+			if attempts != tt.wantAttempts {
+				t.Errorf("unexpected attempts: got %d, want %d", attempts, tt.wantAttempts)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+				}
+				// the partial rootfs of the failed extraction is removed
+				if _, err := os.Lstat(rootfs); !os.IsNotExist(err) {
+					t.Errorf("rootfs of the failed extraction not removed: %v", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(rootfs, "etc", "file"))
+			if err != nil || string(data) != "content" {
+				t.Errorf("unexpected etc/file content %q (err=%v)", data, err)
+			}
+			if len(u.applied) != 1 {
+				t.Errorf("unexpected applied layers: %v", u.applied)
+			}
+		})
+	}
+}
+
+func TestIsTransientFSError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: fmt.Errorf("error extracting etc: %w", &os.PathError{Op: "mkdir", Path: "etc", Err: unix.ESTALE}), want: true},
+		{err: unix.EIO, want: true},
+		{err: unix.ENOSPC, want: false},
+		{err: errors.New("diff ID mismatch"), want: false},
+	}
+	for _, tt := range tests {
+		if got := isTransientFSError(tt.err); got != tt.want {
+			t.Errorf("isTransientFSError(%v): got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRootfsUnpackerCheckApplied(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil,
+		makeLayer(t, tarEntry{name: "first", body: "1"}),
+		makeLayer(t),
+		makeLayer(t, tarEntry{name: "third", body: "3"}),
+	)
+	dir := t.TempDir()
+	img.writeLayout(t, dir, "tmp")
+	engineExt, err := umoci.OpenLayout(dir)
+	if err != nil {
+		t.Fatalf("while opening layout: %s", err)
+	}
+	defer engineExt.Close()
+
+	// the layers recorded are the ones actually extracted, the empty one
+	// included
+	u := &rootfsUnpacker{
+		engine: casext.NewEngine(engineExt),
+		rootfs: filepath.Join(t.TempDir(), "rootfs"),
+	}
+	if err := u.unpack(context.Background(), img.manifest); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(u.applied) != 3 {
+		t.Fatalf("unexpected extracted layers: %v", u.applied)
+	}
+
+	diffIDs := img.config.RootFS.DiffIDs
+	layers := img.manifest.Layers
+	other := imgspecv1.Descriptor{Digest: digest.FromString("other")}
+	replace := func(l []digest.Digest, i int, d digest.Digest) []digest.Digest {
+		l = append([]digest.Digest(nil), l...)
+		l[i] = d
+		return l
+	}
+
+	tests := []struct {
+		name    string
+		layers  []imgspecv1.Descriptor
+		diffIDs []digest.Digest
+		// applied are the layers extracted, all of them when nil
+		applied []appliedLayer
+		skipped map[int]string
+		wantErr string
+	}{
+		{name: "all extracted", layers: layers, diffIDs: diffIDs},
+		{name: "diff ID mismatch", layers: layers, diffIDs: replace(diffIDs, 1, digest.FromString("other")), wantErr: "layer 1 (" + layers[1].Digest.String() + ") extracted with diff ID " + emptyLayerDiffID.String()},
+		{name: "layer not extracted", layers: append([]imgspecv1.Descriptor{layers[0], other}, layers[1:]...), diffIDs: append([]digest.Digest{diffIDs[0], other.Digest}, diffIDs[1:]...), wantErr: "layer 1 (" + other.Digest.String() + ") of the manifest was not extracted"},
+		{name: "reordered layers", layers: []imgspecv1.Descriptor{layers[0], layers[2], layers[1]}, diffIDs: []digest.Digest{diffIDs[0], diffIDs[2], diffIDs[1]}, wantErr: "layer 1 (" + layers[2].Digest.String() + ") of the manifest was not extracted"},
+		{name: "extra layer extracted", layers: layers[:2], diffIDs: diffIDs[:2], wantErr: "3 layers extracted for the 2 layers"},
+		{name: "intentional skip", layers: layers, diffIDs: diffIDs, applied: []appliedLayer{u.applied[0], u.applied[2]}, skipped: map[int]string{1: "extraction failed"}},
+		{name: "skipped layer", layers: layers, diffIDs: diffIDs, applied: []appliedLayer{u.applied[0], u.applied[2]}, wantErr: "layer 1 (" + layers[1].Digest.String() + ") of the manifest was not extracted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := &rootfsUnpacker{applied: tt.applied, skipped: tt.skipped}
+			if check.applied == nil {
+				check.applied = u.applied
+			}
+			err := check.checkApplied(imgspecv1.Manifest{Layers: tt.layers}, tt.diffIDs)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// delayedSource is an image source whose manifest fetches are delayed by
+// the successive delays, without abandoning them with their context.
+type delayedSource struct {
+	types.ImageSource
+
+	mu       sync.Mutex
+	delays   []time.Duration
+	attempts int
+}
+
+func (s *delayedSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	s.mu.Lock()
+	var delay time.Duration
+	if s.attempts < len(s.delays) {
+		delay = s.delays[s.attempts]
+	}
+	s.attempts++
+	s.mu.Unlock()
+
+	time.Sleep(delay)
+	return s.ImageSource.GetManifest(ctx, instanceDigest)
+}
+
+// delayedReference is an image reference of a delayedSource.
+type delayedReference struct {
+	types.ImageReference
+	src *delayedSource
+}
+
+func (r *delayedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	r.src.ImageSource = src
+	return r.src, nil
+}
+
+func TestFetchManifest(t *testing.T) {
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+	dir := t.TempDir()
+	img.writeLayout(t, dir, "v1")
+	ref, err := ocilayout.ParseReference(dir + ":v1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	base, err := ref.NewImageSource(context.Background(), stubSysCtx())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer base.Close()
+
+	const timeout = 50 * time.Millisecond
+	slow := time.Second
+
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		delays   []time.Duration
+		attempts int
+		wantErr  error
+	}{
+		{
+			name:     "no timeout",
+			delays:   []time.Duration{2 * timeout},
+			attempts: 1,
+		},
+		{
+			name:     "in time",
+			timeout:  timeout,
+			attempts: 1,
+		},
+		{
+			name:     "retried",
+			timeout:  timeout,
+			delays:   []time.Duration{slow},
+			attempts: 2,
+		},
+		{
+			name:     "timed out",
+			timeout:  timeout,
+			delays:   []time.Duration{slow, slow, slow},
+			attempts: manifestRetries,
+			wantErr:  errManifestTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &delayedSource{ImageSource: base, delays: tt.delays}
+			start := time.Now()
+			data, _, err := fetchManifest(context.Background(), src, tt.timeout)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("unexpected error: got %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && !bytes.Equal(data, img.manifestData) {
+				t.Errorf("unexpected manifest fetched")
+			}
+			if tt.wantErr != nil && time.Since(start) >= slow {
+				t.Errorf("timeout didn't abandon the fetch, took %s", time.Since(start))
+			}
+			src.mu.Lock()
+			defer src.mu.Unlock()
+			if src.attempts != tt.attempts {
+				t.Errorf("unexpected attempts: got %d, want %d", src.attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsManifestTimeout(t *testing.T) {
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "file", body: "content"}))
+
+	b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("while creating bundle: %s", err)
+	}
+	defer b.Remove()
+	b.Opts.ManifestTimeout = 50 * time.Millisecond
+
+	img.writeLayout(t, b.TmpDir, "tmp")
+	ref, err := ocilayout.ParseReference(b.TmpDir + ":tmp")
+	if err != nil {
+		t.Fatalf("while parsing layout reference: %s", err)
+	}
+	delays := []time.Duration{time.Second, time.Second, time.Second}
+	delayed := &delayedReference{ImageReference: ref, src: &delayedSource{delays: delays}}
+
+	_, err = unpackRootfs(context.Background(), b, delayed, stubSysCtx())
+	if err == nil || !strings.Contains(err.Error(), "manifest fetch timed out") {
+		t.Fatalf("unexpected error: got %v, want a manifest fetch timeout", err)
+	}
+}
+
+func TestRootlessMapOptions(t *testing.T) {
+	opts, err := rootlessMapOptions(1000, 1001)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	wantUIDs := []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}}
+	wantGIDs := []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 1001, Size: 1}}
+	if !opts.Rootless || !reflect.DeepEqual(opts.UIDMappings, wantUIDs) || !reflect.DeepEqual(opts.GIDMappings, wantGIDs) {
+		t.Errorf("unexpected mapping options %+v", opts)
+	}
+
+	tests := []struct {
+		name    string
+		failAt  int
+		wantErr string
+	}{
+		{name: "uid mapping", failAt: 1, wantErr: "rootless extraction, uid mapping for euid 1000 and egid 1001: bad mapping (consider building with --fakeroot, or as root)"},
+		{name: "gid mapping", failAt: 2, wantErr: "rootless extraction, gid mapping for euid 1000 and egid 1001: bad mapping"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			parseIDMapping = func(spec string) (rspec.LinuxIDMapping, error) {
+				calls++
+				if calls == tt.failAt {
+					return rspec.LinuxIDMapping{}, errors.New("bad mapping")
+				}
+				return idtools.ParseMapping(spec)
+			}
+			t.Cleanup(func() { parseIDMapping = idtools.ParseMapping })
+
+			_, err := rootlessMapOptions(1000, 1001)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("unexpected error: got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnpackMapOptionsNested(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	nested := umocilayer.MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 65536}},
+		GIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 65536}},
+	}
+	defer func(f func() bool) { isUnprivileged = f }(isUnprivileged)
+	defer func(f func() (umocilayer.MapOptions, bool)) { readNestedMapOptions = f }(readNestedMapOptions)
+	isUnprivileged = func() bool { return true }
+	readNestedMapOptions = func() (umocilayer.MapOptions, bool) { return nested, true }
+
+	tests := []struct {
+		name     string
+		fakeroot bool
+		rootless bool
+	}{
+		{name: "nested user namespace"},
+		// the fakeroot user namespace, even when providing enough ids,
+		// keeps the rootless mode
+		{name: "fakeroot", fakeroot: true, rootless: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.fakeroot {
+				t.Setenv(fakeroot.BuildEnv, "1")
+			}
+			got, err := unpackMapOptions()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got.Rootless != tt.rootless {
+				t.Fatalf("unexpected rootless mode %v, want %v", got.Rootless, tt.rootless)
+			}
+			if !tt.rootless && !reflect.DeepEqual(got, nested) {
+				t.Errorf("unexpected mapping: got %+v, want %+v", got, nested)
+			}
+		})
+	}
+}
+
+func TestNestedIDMapOptions(t *testing.T) {
+	// root of an unprivileged container, mapped to the user and its
+	// subordinate ids
+	container := []rspec.LinuxIDMapping{
+		{ContainerID: 0, HostID: 1000, Size: 1},
+		{ContainerID: 1, HostID: 100000, Size: 65536},
+	}
+
+	tests := []struct {
+		name   string
+		uidMap []rspec.LinuxIDMapping
+		gidMap []rspec.LinuxIDMapping
+		want   *umocilayer.MapOptions
+		// ids of the image and their expected id in the namespace
+		hostIDs map[int]int
+	}{
+		{
+			name:   "nested container",
+			uidMap: container,
+			gidMap: container,
+			want: &umocilayer.MapOptions{
+				UIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 1}, {ContainerID: 1, HostID: 1, Size: 65536}},
+				GIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 1}, {ContainerID: 1, HostID: 1, Size: 65536}},
+			},
+			hostIDs: map[int]int{0: 0, 1000: 1000, 65534: 65534},
+		},
+		{
+			name: "gap in namespace ids",
+			uidMap: []rspec.LinuxIDMapping{
+				{ContainerID: 1000, HostID: 200000, Size: 65536},
+				{ContainerID: 0, HostID: 1000, Size: 1},
+			},
+			gidMap: container,
+			want: &umocilayer.MapOptions{
+				UIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 1}, {ContainerID: 1, HostID: 1000, Size: 65536}},
+				GIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 1}, {ContainerID: 1, HostID: 1, Size: 65536}},
+			},
+			hostIDs: map[int]int{0: 0, 1: 1000, 65534: 66533},
+		},
+		{
+			name:   "single id",
+			uidMap: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}},
+			gidMap: container,
+		},
+		{
+			name:   "not enough ids",
+			uidMap: container,
+			gidMap: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}, {ContainerID: 1, HostID: 100000, Size: 1000}},
+		},
+		{
+			name:   "no root",
+			uidMap: []rspec.LinuxIDMapping{{ContainerID: 1, HostID: 100000, Size: 65536}},
+			gidMap: container,
+		},
+		{
+			name:   "no mapping",
+			gidMap: container,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := nestedIDMapOptions(tt.uidMap, tt.gidMap)
+			if tt.want == nil {
+				if ok {
+					t.Fatalf("unexpected nested mapping %+v, rootless mode expected", got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("unexpected rootless mode")
+			}
+			if !reflect.DeepEqual(got, *tt.want) {
+				t.Fatalf("unexpected mapping: got %+v, want %+v", got, *tt.want)
+			}
+			for id, want := range tt.hostIDs {
+				if h, err := idtools.ToHost(id, got.UIDMappings); err != nil || h != want {
+					t.Errorf("unexpected namespace uid for %d: got %d (%v), want %d", id, h, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsSourceDateEpoch(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	epoch := time.Unix(1500000000, 0)
+	t.Setenv("SOURCE_DATE_EPOCH", "1500000000")
+
+	// usr/share is not part of the layers and is created at extraction time
+	layer := makeLayer(t,
+		dirEntry("etc/"),
+		tarEntry{name: "etc/config", body: "config"},
+		tarEntry{name: "usr/share/doc", body: "doc"},
+		tarEntry{name: "usr/share/link", typeflag: tar.TypeSymlink, linkname: "doc"},
+	)
+	img := newTestImage(t, nil, layer)
+
+	mtimes := func() map[string]time.Time {
+		b, err := unpackTestImage(t, img, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		m := make(map[string]time.Time)
+		err = filepath.WalkDir(b.RootfsPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(b.RootfsPath, path)
+			m[rel] = fi.ModTime()
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("while walking rootfs: %s", err)
+		}
+		return m
+	}
+
+	first := mtimes()
+	// make sure a second extraction would get different times
+	time.Sleep(10 * time.Millisecond)
+	second := mtimes()
+
+	if len(first) != len(second) {
+		t.Fatalf("different rootfs content: %v != %v", first, second)
+	}
+	for path, mtime := range first {
+		if mtime.After(epoch) {
+			t.Errorf("%s: modification time %s after SOURCE_DATE_EPOCH", path, mtime)
+		}
+		if !second[path].Equal(mtime) {
+			t.Errorf("%s: modification time %s differs from %s", path, second[path], mtime)
+		}
+	}
+}
+
+// compressibleData returns size bytes of pseudo random text.
+func compressibleData(size int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, "line %d: %x\n", i, i*2654435761)
+	}
+	return buf.Bytes()[:size]
+}
+
+func TestUnpackRootfsNormalizeOwnership(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t,
+		tarEntry{name: "opt/", typeflag: tar.TypeDir, mode: 0o755, uid: 1000, gid: 1000},
+		tarEntry{name: "opt/data", body: "data", mode: 0o644, uid: 1000, gid: 100},
+		tarEntry{name: "opt/tool", body: "tool", mode: 0o6755, uid: 10, gid: 10},
+		tarEntry{name: "opt/link", typeflag: tar.TypeSymlink, linkname: "data", uid: 1000, gid: 1000},
+		tarEntry{name: "etc/hostname", body: "host"},
+	))
+	paths := []string{"opt", "opt/data", "opt/tool", "opt/link", "etc/hostname"}
+
+	tests := []struct {
+		name      string
+		normalize bool
+		sandbox   bool
+		wantRoot  bool
+	}{
+		{name: "disabled"},
+		{name: "SIF", normalize: true, wantRoot: true},
+		{name: "sandbox", normalize: true, sandbox: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.NormalizeOwnership = tt.normalize
+				b.Opts.SandboxTarget = tt.sandbox
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			root := true
+			for _, p := range paths {
+				fi, err := os.Lstat(filepath.Join(b.RootfsPath, p))
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				st := fi.Sys().(*syscall.Stat_t)
+				if st.Uid != 0 || st.Gid != 0 {
+					root = false
+					if tt.wantRoot {
+						t.Errorf("%s owned by %d:%d, want 0:0", p, st.Uid, st.Gid)
+					}
+				}
+			}
+			if !tt.wantRoot && root {
+				t.Errorf("ownership of the image not preserved")
+			}
+
+			// the setuid/setgid bits survive the ownership change
+			fi, err := os.Lstat(filepath.Join(b.RootfsPath, "opt/tool"))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if fi.Mode()&(os.ModeSetuid|os.ModeSetgid) != os.ModeSetuid|os.ModeSetgid {
+				t.Errorf("unexpected mode %s of opt/tool", fi.Mode())
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsDockerSchema2(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t,
+		dirEntry("etc/"),
+		tarEntry{name: "etc/hostname", body: "docker"},
+	))
+	img.dockerSchema2(t)
+
+	// a reference without an image name is needed, the lookup of named
+	// references only accepts OCI media types
+	unpack := func() (*sytypes.Bundle, error) {
+		b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+		if err != nil {
+			t.Fatalf("while creating bundle: %s", err)
+		}
+		t.Cleanup(func() { b.Remove() })
+
+		img.writeLayout(t, b.TmpDir, "tmp")
+		ref, err := ocilayout.ParseReference(b.TmpDir)
+		if err != nil {
+			t.Fatalf("while parsing layout reference: %s", err)
+		}
+		_, err = unpackRootfs(context.Background(), b, ref, stubSysCtx())
+		return b, err
+	}
+
+	b, err := unpack()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	content, err := os.ReadFile(filepath.Join(b.RootfsPath, "etc", "hostname"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(content) != "docker" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	// manifest lists must be resolved to a manifest before extraction
+	img.manifest.MediaType = manifest.DockerV2ListMediaType
+	img.update(t)
+	if _, err := unpack(); err == nil || !strings.Contains(err.Error(), "manifest media type") {
+		t.Errorf("unexpected error for a manifest list: %v", err)
+	}
+
+	// schema1 manifests are reported as deprecated
+	for _, mediaType := range []string{manifest.DockerV2Schema1MediaType, manifest.DockerV2Schema1SignedMediaType} {
+		img.manifest.MediaType = mediaType
+		img.update(t)
+		img.manifestData = []byte(`{
+	"schemaVersion": 1,
+	"name": "library/test",
+	"tag": "latest",
+	"architecture": "amd64",
+	"fsLayers": [{"blobSum": "` + img.manifest.Layers[0].Digest.String() + `"}],
+	"history": [{"v1Compatibility": "{\"id\":\"e45a5af57b00\"}"}]
+}`)
+		img.manifestDigest = digest.FromBytes(img.manifestData)
+		if _, err := unpack(); err == nil || !strings.Contains(err.Error(), "deprecated docker schema1 manifest format ("+mediaType+")") || !strings.Contains(err.Error(), "re-pushed") {
+			t.Errorf("unexpected error for a schema1 manifest: %v", err)
+		}
+	}
+}
+
+// writeDockerArchive writes the image made of the uncompressed tar layers
+// as a docker-archive, in the format of docker save, as exported by the
+// docker daemon, and returns its path.
+func writeDockerArchive(t *testing.T, img *testImage, layers ...[]byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "image.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("while creating archive: %s", err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	add := func(name string, data []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("while writing archive: %s", err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatalf("while writing archive: %s", err)
+		}
+	}
+
+	configName := img.manifest.Config.Digest.Encoded() + ".json"
+	add(configName, img.configData)
+	var layerNames []string
+	for _, l := range layers {
+		name := digest.FromBytes(l).Encoded() + "/layer.tar"
+		add(name, l)
+		layerNames = append(layerNames, name)
+	}
+	data, err := json.Marshal([]map[string]interface{}{{
+		"Config":   configName,
+		"RepoTags": []string{"test:latest"},
+		"Layers":   layerNames,
+	}})
+	if err != nil {
+		t.Fatalf("while encoding archive manifest: %s", err)
+	}
+	add("manifest.json", data)
+	if err := tw.Close(); err != nil {
+		t.Fatalf("while writing archive: %s", err)
+	}
+	return path
+}
+
+func TestConfigMediaType(t *testing.T) {
+	layer := makeLayer(t, dirEntry("etc/"), tarEntry{name: "etc/hostname", body: "config"})
+
+	// returns the manifest of ref as parsed for the extraction
+	resolve := func(t *testing.T, ref types.ImageReference) (imgspecv1.Manifest, error) {
+		src, err := ref.NewImageSource(context.Background(), stubSysCtx())
+		if err != nil {
+			t.Fatalf("while opening image source: %s", err)
+		}
+		defer src.Close()
+		data, mediaType, err := fetchManifest(context.Background(), src, 0)
+		if err != nil {
+			t.Fatalf("while fetching manifest: %s", err)
+		}
+		m, err := parseManifest(data, mediaType)
+		if err != nil {
+			return m, err
+		}
+		return m, resolveConfigMediaType(context.Background(), src, &m)
+	}
+	// encodes the manifest of img as is, update replacing an empty config
+	// media type
+	encode := func(t *testing.T, img *testImage) {
+		var err error
+		if img.manifestData, err = json.Marshal(img.manifest); err != nil {
+			t.Fatalf("while encoding manifest: %s", err)
+		}
+		img.manifestDigest = digest.FromBytes(img.manifestData)
+	}
+	layout := func(t *testing.T, img *testImage) types.ImageReference {
+		dir := t.TempDir()
+		img.writeLayout(t, dir, "tmp")
+		ref, err := ocilayout.ParseReference(dir)
+		if err != nil {
+			t.Fatalf("while parsing layout reference: %s", err)
+		}
+		return ref
+	}
+
+	tests := []struct {
+		name string
+		// ref returns the reference of an image made of layer
+		ref       func(t *testing.T) types.ImageReference
+		wantError string
+	}{
+		{
+			name: "oci",
+			ref: func(t *testing.T) types.ImageReference {
+				return layout(t, newTestImage(t, nil, layer))
+			},
+		},
+		{
+			name: "docker schema2",
+			ref: func(t *testing.T) types.ImageReference {
+				img := newTestImage(t, nil, layer)
+				img.dockerSchema2(t)
+				return layout(t, img)
+			},
+		},
+		{
+			name: "docker daemon",
+			ref: func(t *testing.T) types.ImageReference {
+				path := writeDockerArchive(t, newTestImage(t, nil, layer), layer)
+				ref, err := dockerarchive.ParseReference(path)
+				if err != nil {
+					t.Fatalf("while parsing archive reference: %s", err)
+				}
+				return ref
+			},
+		},
+		{
+			name: "generic media type",
+			ref: func(t *testing.T) types.ImageReference {
+				img := newTestImage(t, nil, layer)
+				img.manifest.Config.MediaType = "application/octet-stream"
+				img.update(t)
+				return layout(t, img)
+			},
+		},
+		{
+			name: "empty media type",
+			ref: func(t *testing.T) types.ImageReference {
+				img := newTestImage(t, nil, layer)
+				img.manifest.Config.MediaType = ""
+				encode(t, img)
+				return layout(t, img)
+			},
+		},
+		{
+			name: "artifact",
+			ref: func(t *testing.T) types.ImageReference {
+				img := newTestImage(t, nil, layer)
+				img.manifest.Config.MediaType = "application/vnd.cncf.helm.config.v1+json"
+				img.configData = []byte(`{"name":"chart","version":"1.0.0"}`)
+				img.blobs[digest.FromBytes(img.configData)] = img.configData
+				img.manifest.Config.Digest = digest.FromBytes(img.configData)
+				img.manifest.Config.Size = int64(len(img.configData))
+				encode(t, img)
+				return layout(t, img)
+			},
+			wantError: "artifact of type application/vnd.cncf.helm.config.v1+json, not an image",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := resolve(t, tt.ref(t))
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if m.Config.MediaType != imgspecv1.MediaTypeImageConfig {
+				t.Errorf("unexpected config media type %q, want %q", m.Config.MediaType, imgspecv1.MediaTypeImageConfig)
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsGenericConfigMediaType(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t, dirEntry("etc/"), tarEntry{name: "etc/hostname", body: "config"}))
+	img.manifest.Config.MediaType = "application/octet-stream"
+	img.update(t)
+	b, err := unpackTestImage(t, img, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertPaths(t, b.RootfsPath, map[string]bool{"etc/hostname": true})
+}
+
+func TestUnpackRootfsZstdChunked(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	layer := makeLayer(t,
+		dirEntry("usr/"),
+		tarEntry{name: "usr/data", body: string(compressibleData(256 << 10))},
+		tarEntry{name: "file", body: "content"},
+	)
+	img := newTestImage(t, nil, layer)
+
+	// replace the gzip layer with a zstd:chunked one, the annotations giving
+	// the position of its table of contents
+	var buf bytes.Buffer
+	annotations := make(map[string]string)
+	zw, err := compressor.ZstdCompressor(&buf, annotations, nil)
+	if err != nil {
+		t.Fatalf("while creating zstd:chunked compressor: %s", err)
+	}
+	if _, err := zw.Write(layer); err != nil {
+		t.Fatalf("while compressing layer: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("while compressing layer: %s", err)
+	}
+	if _, ok := annotations[zstdChunkedManifestKey]; !ok {
+		t.Fatalf("no zstd:chunked annotation in %v", annotations)
+	}
+	delete(img.blobs, img.manifest.Layers[0].Digest)
+	d := digest.FromBytes(buf.Bytes())
+	img.blobs[d] = buf.Bytes()
+	img.manifest.Layers[0] = imgspecv1.Descriptor{
+		MediaType:   imgspecv1.MediaTypeImageLayerZstd,
+		Digest:      d,
+		Size:        int64(buf.Len()),
+		Annotations: annotations,
+	}
+	img.update(t)
+
+	b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+		b.Opts.SandboxTarget = true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	files := map[string][]byte{
+		"usr/data": compressibleData(256 << 10),
+		"file":     []byte("content"),
+	}
+	for name, want := range files {
+		data, err := os.ReadFile(filepath.Join(b.RootfsPath, name))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s: unexpected content", name)
+		}
+	}
+}
+
+func TestNewGzipReader(t *testing.T) {
+	data := compressibleData(8 << 20)
+	compressed := gzipBytes(t, data)
+
+	for _, parallel := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallel=%v", parallel), func(t *testing.T) {
+			r, err := newGzipReader(bytes.NewReader(compressed), parallel)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer r.Close()
+			out, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Errorf("decompressed data differs from the original data")
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsParallelGzip(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	layer := makeLayer(t,
+		dirEntry("data/"),
+		tarEntry{name: "data/big", body: string(compressibleData(4 << 20))},
+		tarEntry{name: "data/small", body: "small", mode: 0o600},
+		tarEntry{name: "data/link", typeflag: tar.TypeSymlink, linkname: "big"},
+	)
+	img := newTestImage(t, nil, layer)
+
+	// snapshot returns the content of the extracted rootfs, both decompressors
+	// must produce the exact same tree
+	snapshot := func(parallel bool) map[string]string {
+		b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+			b.Opts.ParallelGzip = parallel
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		m := make(map[string]string)
+		err = filepath.WalkDir(b.RootfsPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(b.RootfsPath, path)
+			entry := fmt.Sprintf("%v %s", fi.Mode(), fi.ModTime())
+			if fi.Mode().IsRegular() {
+				content, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				entry += " " + digest.FromBytes(content).String()
+			}
+			m[rel] = entry
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("while walking rootfs: %s", err)
+		}
+		return m
+	}
+
+	standard := snapshot(false)
+	parallel := snapshot(true)
+	if len(standard) != len(parallel) {
+		t.Fatalf("different rootfs content: %v != %v", standard, parallel)
+	}
+	for path, entry := range standard {
+		if parallel[path] != entry {
+			t.Errorf("%s: got %q with parallel gzip, want %q", path, parallel[path], entry)
+		}
+	}
+}
+
+func BenchmarkNewGzipReader(b *testing.B) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(compressibleData(64 << 20))
+	gw.Close()
+	compressed := buf.Bytes()
+
+	for _, parallel := range []bool{false, true} {
+		b.Run(fmt.Sprintf("parallel=%v", parallel), func(b *testing.B) {
+			b.SetBytes(64 << 20)
+			for i := 0; i < b.N; i++ {
+				r, err := newGzipReader(bytes.NewReader(compressed), parallel)
+				if err != nil {
+					b.Fatalf("unexpected error: %s", err)
+				}
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					b.Fatalf("unexpected error: %s", err)
+				}
+				r.Close()
+			}
+		})
+	}
+}
+
+// writeSizes records the size of the largest write to a writer.
+type writeSizes struct {
+	mu  sync.Mutex
+	max int
+}
+
+func (s *writeSizes) record(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > s.max {
+		s.max = n
+	}
+}
+
+// sizeWriter is a writer recording the size of its writes.
+type sizeWriter struct {
+	io.WriteCloser
+	sizes *writeSizes
+}
+
+func (w sizeWriter) Write(p []byte) (int, error) {
+	w.sizes.record(len(p))
+	return w.WriteCloser.Write(p)
+}
+
+// sizeFS is a MemFS recording the size of the writes to its files.
+type sizeFS struct {
+	*sytypes.MemFS
+	sizes writeSizes
+}
+
+func (fsys *sizeFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	w, err := fsys.MemFS.Create(name, perm)
+	return sizeWriter{WriteCloser: w, sizes: &fsys.sizes}, err
+}
+
+func TestUnpackRootfsExtractBufferSize(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t, tarEntry{name: "large", body: string(compressibleData(1 << 20))}))
+
+	tests := []struct {
+		name       string
+		bufferSize int
+		wantMax    int
+		wantErr    string
+	}{
+		{name: "default", wantMax: sytypes.DefaultExtractBufferSize},
+		{name: "minimum", bufferSize: sytypes.MinExtractBufferSize, wantMax: sytypes.MinExtractBufferSize},
+		{name: "custom", bufferSize: 256 << 10, wantMax: 256 << 10},
+		{name: "too small", bufferSize: 512, wantErr: "extraction buffer size 512 is not between"},
+		{name: "too large", bufferSize: sytypes.MaxExtractBufferSize + 1, wantErr: "is not between"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := &sizeFS{MemFS: sytypes.NewMemFS()}
+			_, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.RootfsFS = fsys
+				b.Opts.ExtractBufferSize = tt.bufferSize
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if fsys.sizes.max != tt.wantMax {
+				t.Errorf("unexpected largest write of %d bytes, want %d", fsys.sizes.max, tt.wantMax)
+			}
+		})
+	}
+}
+
+func BenchmarkUnpackLayerBufferSize(b *testing.B) {
+	layer := makeLayer(&testing.T{}, tarEntry{name: "large", body: string(compressibleData(64 << 20))})
+	mapOptions, err := unpackMapOptions()
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, size := range []int{sytypes.MinExtractBufferSize, sytypes.DefaultExtractBufferSize, 1 << 20, 8 << 20} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(layer)))
+			for i := 0; i < b.N; i++ {
+				u := &rootfsUnpacker{
+					rootfs:     b.TempDir(),
+					opts:       umocilayer.UnpackOptions{MapOptions: mapOptions},
+					bufferSize: size,
+				}
+				if err := u.unpackLayer(0, bytes.NewReader(layer)); err != nil {
+					b.Fatalf("unexpected error: %s", err)
+				}
+			}
+		})
+	}
+}
+
+// diskUsage returns the bytes allocated to the file path.
+func diskUsage(t *testing.T, path string) int64 {
+	t.Helper()
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatalf("while getting %s info: %s", path, err)
+	}
+	return st.Blocks * 512
+}
+
+func TestUnpackRootfsSparseFiles(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	// data runs, and runs of zeros of 4MiB in the middle and 1MiB at the end
+	content := append([]byte("header"), make([]byte, 64<<10)...)
+	content = append(content, make([]byte, 4<<20)...)
+	content = append(content, bytes.Repeat([]byte("data"), 1<<10)...)
+	content = append(content, make([]byte, 1<<20)...)
+	img := newTestImage(t, nil, makeLayer(t,
+		tarEntry{name: "db", body: string(content)},
+		tarEntry{name: "small", body: "small"},
+	))
+
+	usage := make(map[bool]int64)
+	for _, sparse := range []bool{false, true} {
+		b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+			b.Opts.SparseFiles = sparse
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		path := filepath.Join(b.RootfsPath, "db")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("while reading %s: %s", path, err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("unexpected content of the sparse=%v file: %d bytes, want %d", sparse, len(data), len(content))
+		}
+		if data, err := os.ReadFile(filepath.Join(b.RootfsPath, "small")); err != nil || string(data) != "small" {
+			t.Errorf("unexpected content of the small file: %q (%v)", data, err)
+		}
+		usage[sparse] = diskUsage(t, path)
+	}
+
+	if usage[false] < 5<<20 {
+		t.Skipf("the filesystem of the rootfs compresses or deduplicates the files: %d bytes used", usage[false])
+	}
+	if usage[true] >= 1<<20 {
+		t.Errorf("unexpected disk usage of the sparse file: %d bytes, %d bytes without holes", usage[true], usage[false])
+	}
+}
+
+func TestCheckPermsHandler(t *testing.T) {
+	rootfs := t.TempDir()
+
+	dirs := map[string]os.FileMode{
+		"ok":           0o755,
+		"ok/nested":    0o700,
+		"readonly":     0o555,
+		"ok/noexec":    0o600,
+		"ok/nested/ro": 0o500,
+	}
+	// create parents first, and restrict permissions last so creation works
+	names := make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := os.Mkdir(filepath.Join(rootfs, name), 0o755); err != nil {
+			t.Fatalf("while creating %s: %s", name, err)
+		}
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := os.Chmod(filepath.Join(rootfs, names[i]), dirs[names[i]]); err != nil {
+			t.Fatalf("while changing %s permissions: %s", names[i], err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, name := range names {
+			os.Chmod(filepath.Join(rootfs, name), 0o755)
+		}
+	})
+
+	var got []string
+	err := checkPerms(rootfs, func(paths []string) error {
+		got = paths
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := []string{
+		filepath.Join(rootfs, "ok/nested/ro"),
+		filepath.Join(rootfs, "ok/noexec"),
+		filepath.Join(rootfs, "readonly"),
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected restrictive paths: got %v, want %v", got, want)
+	}
+
+	errPolicy := errors.New("policy violation")
+	err = checkPerms(rootfs, func([]string) error { return errPolicy }, nil)
+	if !errors.Is(err, errPolicy) {
+		t.Errorf("unexpected error: got %v, want %v", err, errPolicy)
+	}
+
+	// default behavior only warns
+	if err := checkPerms(rootfs, nil, nil); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestPathFilterMatchEntry(t *testing.T) {
+	f := newPathFilter([]string{"/opt/myapp/", "etc/app.conf"})
+
+	tests := []struct {
+		name  string
+		hdr   tar.Header
+		match bool
+	}{
+		{"included file", tar.Header{Name: "opt/myapp/bin"}, true},
+		{"included dir", tar.Header{Name: "./opt/myapp/"}, true},
+		{"parent dir", tar.Header{Name: "opt/"}, true},
+		{"root dir", tar.Header{Name: "./"}, true},
+		{"sibling prefix", tar.Header{Name: "opt/myapp2/bin"}, false},
+		{"excluded file", tar.Header{Name: "usr/bin/tool"}, false},
+		{"included single file", tar.Header{Name: "etc/app.conf"}, true},
+		{"whiteout included", tar.Header{Name: "opt/myapp/.wh.old"}, true},
+		{"whiteout of parent", tar.Header{Name: ".wh.opt"}, true},
+		{"whiteout excluded", tar.Header{Name: "usr/.wh.bin"}, false},
+		{"opaque included", tar.Header{Name: "opt/myapp/lib/.wh..wh..opq"}, true},
+		{"opaque excluded", tar.Header{Name: "usr/.wh..wh..opq"}, false},
+		{"hard link included", tar.Header{Name: "opt/myapp/a", Typeflag: tar.TypeLink, Linkname: "opt/myapp/b"}, true},
+		{"hard link to excluded", tar.Header{Name: "opt/myapp/a", Typeflag: tar.TypeLink, Linkname: "usr/b"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.matchEntry(&tt.hdr); got != tt.match {
+				t.Errorf("unexpected match for %s: got %v, want %v", tt.hdr.Name, got, tt.match)
+			}
+		})
+	}
+}
+
+func TestOCIConveyorPackerErrorDocument(t *testing.T) {
+	img := newTestImage(t, nil, makeLayer(t,
+		dirEntry("etc/"),
+		tarEntry{name: "etc/alias", typeflag: tar.TypeLink, linkname: "etc/missing"},
+	))
+	dir := t.TempDir()
+	img.writeLayout(t, dir, "test")
+
+	tests := []struct {
+		name string
+		uri  string
+		want sytypes.ErrorDocument
+	}{
+		{
+			name: "layer",
+			uri:  "oci:" + dir + ":test",
+			want: sytypes.ErrorDocument{
+				Type:   sytypes.SourceErrorLayer,
+				Source: "oci:" + dir + ":test",
+				Layer:  img.manifest.Layers[0].Digest.String(),
+				Path:   "/etc/alias",
+			},
+		},
+		{
+			name: "missing tag",
+			uri:  "oci:" + dir + ":missing",
+			want: sytypes.ErrorDocument{
+				Type:   sytypes.SourceErrorFetch,
+				Source: "oci:" + dir + ":missing",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := sytypes.NewBundle(t.TempDir(), t.TempDir())
+			if err != nil {
+				t.Fatalf("while creating bundle: %s", err)
+			}
+			t.Cleanup(func() { b.Remove() })
+			b.Recipe, err = sytypes.NewDefinitionFromURI(tt.uri)
+			if err != nil {
+				t.Fatalf("while parsing URI: %s", err)
+			}
+			b.Opts.NoCache = true
+
+			cp := &OCIConveyorPacker{}
+			err = cp.Get(context.Background(), b)
+			if err == nil {
+				_, err = cp.Pack(context.Background())
+			}
+			if err == nil {
+				t.Fatalf("unexpected success")
+			}
+
+			var buf bytes.Buffer
+			if err := sytypes.WriteErrorDocument(&buf, err); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var got sytypes.ErrorDocument
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("while decoding %s: %s", buf.String(), err)
+			}
+			if got.Message != err.Error() {
+				t.Errorf("unexpected message %q, want %q", got.Message, err.Error())
+			}
+			got.Message = ""
+			if got != tt.want {
+				t.Errorf("unexpected error document:\n\thave: %+v\n\twant: %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsStaging(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	lower := []tarEntry{dirEntry("a/"), {name: "ro/", typeflag: tar.TypeDir, mode: 0o500}}
+	upper := []tarEntry{dirEntry("b/")}
+	for i := 0; i < 10; i++ {
+		lower = append(lower, tarEntry{name: fmt.Sprintf("a/%d", i), body: "a"})
+		upper = append(upper, tarEntry{name: fmt.Sprintf("b/%d", i), body: "b"})
+	}
+	img := newTestImage(t, nil, makeLayer(t, lower...), makeLayer(t, upper...))
+
+	// assertStaged checks that the rootfs of b holds want paths, and that
+	// no staging directory is left next to it
+	assertStaged := func(t *testing.T, b *sytypes.Bundle, want int) {
+		t.Helper()
+		entries, err := os.ReadDir(b.RootfsPath)
+		if err != nil {
+			t.Fatalf("while reading rootfs: %s", err)
+		}
+		if len(entries) != want {
+			t.Errorf("unexpected rootfs content: %d entries, want %d", len(entries), want)
+		}
+		siblings, err := os.ReadDir(filepath.Dir(b.RootfsPath))
+		if err != nil {
+			t.Fatalf("while reading rootfs parent: %s", err)
+		}
+		for _, e := range siblings {
+			if strings.HasPrefix(e.Name(), ".rootfs-staging-") {
+				t.Errorf("staging directory %s left behind", e.Name())
+			}
+		}
+	}
+
+	t.Run("failed extraction", func(t *testing.T) {
+		// the second layer fails midway
+		b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+			b.Opts.MaxFiles = 17
+		})
+		if err == nil || !strings.Contains(err.Error(), "layer "+img.manifest.Layers[1].Digest.String()) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assertStaged(t, b, 0)
+	})
+
+	t.Run("successful extraction", func(t *testing.T) {
+		var restrictive []string
+		b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+			b.Opts.SandboxTarget = true
+			b.Opts.RestrictivePermsHandler = func(paths []string) error {
+				restrictive = paths
+				return nil
+			}
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		t.Cleanup(func() { os.Chmod(filepath.Join(b.RootfsPath, "ro"), 0o755) })
+		assertStaged(t, b, 3)
+		// the restrictive paths are reported in the final rootfs
+		if want := []string{filepath.Join(b.RootfsPath, "ro")}; !reflect.DeepEqual(restrictive, want) {
+			t.Errorf("unexpected restrictive paths:\n\thave: %v\n\twant: %v", restrictive, want)
+		}
+	})
+}
+
+func TestUnpackRootfsRemoveRetry(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t, dirEntry("a/"), tarEntry{name: "a/file", body: "a"}))
+	defer func(d time.Duration) { removeRootfsDelay = d }(removeRootfsDelay)
+	removeRootfsDelay = time.Millisecond
+	defer func(f func(string) error) { forceRemoveAll = f }(forceRemoveAll)
+	remove := forceRemoveAll
+
+	// stubRemoval fails the removal of the rootfs with errno for the
+	// first failures attempts, and counts the attempts
+	stubRemoval := func(errno syscall.Errno, failures int) *int {
+		attempts := 0
+		forceRemoveAll = func(path string) error {
+			attempts++
+			if attempts <= failures {
+				return &os.PathError{Op: "unlinkat", Path: filepath.Join(path, "busy"), Err: errno}
+			}
+			return remove(path)
+		}
+		return &attempts
+	}
+
+	t.Run("transient", func(t *testing.T) {
+		attempts := stubRemoval(unix.EBUSY, 2)
+		b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+			// a previous rootfs is replaced
+			if err := os.WriteFile(filepath.Join(b.RootfsPath, "old"), []byte("old"), 0o644); err != nil {
+				t.Fatalf("while writing old rootfs: %s", err)
+			}
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if *attempts != 3 {
+			t.Errorf("unexpected removal attempts %d, want 3", *attempts)
+		}
+		assertPaths(t, b.RootfsPath, map[string]bool{"a/file": true, "old": false})
+	})
+
+	for _, tt := range []struct {
+		name     string
+		errno    syscall.Errno
+		attempts int
+	}{
+		{name: "persistent", errno: unix.EBUSY, attempts: removeRootfsRetries + 1},
+		{name: "permanent", errno: unix.EPERM, attempts: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := stubRemoval(tt.errno, tt.attempts)
+			b, err := unpackTestImage(t, img, nil)
+			if err == nil {
+				t.Fatalf("unexpected success")
+			}
+			if !errors.Is(err, tt.errno) {
+				t.Errorf("unexpected error: %s, want %s", err, tt.errno)
+			}
+			for _, want := range []string{"could not remove " + filepath.Join(b.RootfsPath, "busy"), "in use"} {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("unexpected error: %s, want %q", err, want)
+				}
+			}
+			if *attempts != tt.attempts {
+				t.Errorf("unexpected removal attempts %d, want %d", *attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsInjectFiles(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t, dirEntry("etc/"), tarEntry{name: "etc/motd", body: "image"}))
+	files := []sytypes.InjectedFile{
+		{Path: "/etc/motd", Content: []byte("injected"), Mode: 0o640},
+		{Path: "/srv/private", Dir: true, Mode: 0o500},
+	}
+
+	t.Run("modes", func(t *testing.T) {
+		b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+			b.Opts.InjectFiles = files
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		t.Cleanup(func() { os.Chmod(filepath.Join(b.RootfsPath, "srv/private"), 0o755) })
+		want := map[string]os.FileMode{
+			"etc/motd":    0o640,
+			"srv":         os.ModeDir | 0o755,
+			"srv/private": os.ModeDir | 0o500,
+		}
+		for path, mode := range want {
+			fi, err := os.Lstat(filepath.Join(b.RootfsPath, path))
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			} else if fi.Mode() != mode {
+				t.Errorf("%s: unexpected mode %s, want %s", path, fi.Mode(), mode)
+			}
+		}
+		data, err := os.ReadFile(filepath.Join(b.RootfsPath, "etc/motd"))
+		if err != nil || string(data) != "injected" {
+			t.Errorf("unexpected etc/motd content %q: %v", data, err)
+		}
+	})
+
+	t.Run("fix perms", func(t *testing.T) {
+		b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+			b.Opts.InjectFiles = files
+			b.Opts.FixPerms = true
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		fi, err := os.Lstat(filepath.Join(b.RootfsPath, "srv/private"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if fi.Mode().Perm() != 0o700 {
+			t.Errorf("unexpected fixed mode %s", fi.Mode())
+		}
+	})
+
+	// the injected files are scanned for restrictive permissions, again
+	// when they change with a perms state file
+	statePath := filepath.Join(t.TempDir(), "perms.json")
+	for _, tt := range []struct {
+		name      string
+		stateFile string
+		files     []sytypes.InjectedFile
+		want      []string
+	}{
+		{name: "scan", files: files, want: []string{"srv/private"}},
+		{name: "incremental first", stateFile: statePath, files: files, want: []string{"srv/private"}},
+		{
+			name:      "incremental changed",
+			stateFile: statePath,
+			files:     append([]sytypes.InjectedFile{{Path: "/srv/other", Dir: true, Mode: 0o555}}, files...),
+			want:      []string{"srv/other", "srv/private"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var restrictive []string
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.InjectFiles = tt.files
+				b.Opts.SandboxTarget = true
+				b.Opts.PermsStateFile = tt.stateFile
+				b.Opts.RestrictivePermsHandler = func(paths []string) error {
+					restrictive = paths
+					return nil
+				}
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			t.Cleanup(func() {
+				for _, f := range tt.files {
+					os.Chmod(filepath.Join(b.RootfsPath, f.Path), 0o755)
+				}
+			})
+			var want []string
+			for _, path := range tt.want {
+				want = append(want, filepath.Join(b.RootfsPath, path))
+			}
+			sort.Strings(restrictive)
+			if !reflect.DeepEqual(restrictive, want) {
+				t.Errorf("unexpected restrictive paths:\n\thave: %v\n\twant: %v", restrictive, want)
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsKeepDirlinks(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	// a merged /usr base, and a layer adding to /lib as a directory
+	img := newTestImage(t, nil,
+		makeLayer(t,
+			tarEntry{name: "usr/", typeflag: tar.TypeDir, mode: 0o755},
+			tarEntry{name: "usr/lib/", typeflag: tar.TypeDir, mode: 0o755},
+			tarEntry{name: "usr/lib/libbase.so", body: "base"},
+			tarEntry{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+		),
+		makeLayer(t,
+			tarEntry{name: "lib/", typeflag: tar.TypeDir, mode: 0o755},
+			tarEntry{name: "lib/libextra.so", body: "extra"},
+		),
+	)
+
+	tests := []struct {
+		name         string
+		keepDirlinks bool
+		wantLink     bool
+		paths        map[string]bool
+	}{
+		{
+			name: "replaced",
+			paths: map[string]bool{
+				"lib/libextra.so":     true,
+				"lib/libbase.so":      false,
+				"usr/lib/libbase.so":  true,
+				"usr/lib/libextra.so": false,
+			},
+		},
+		{
+			name:         "kept",
+			keepDirlinks: true,
+			wantLink:     true,
+			paths: map[string]bool{
+				"usr/lib/libbase.so":  true,
+				"usr/lib/libextra.so": true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+				b.Opts.KeepDirlinks = tt.keepDirlinks
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			fi, err := os.Lstat(filepath.Join(b.RootfsPath, "lib"))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if link := fi.Mode()&os.ModeSymlink != 0; link != tt.wantLink {
+				t.Errorf("unexpected lib symlink %v, want %v (mode %s)", link, tt.wantLink, fi.Mode())
+			}
+			assertPaths(t, b.RootfsPath, tt.paths)
+		})
+	}
+}
+
+func TestOverrideMapOptions(t *testing.T) {
+	derived := umocilayer.MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 1}},
+	}
+
+	tests := []struct {
+		name     string
+		opts     umocilayer.MapOptions
+		uidMap   []string
+		gidMap   []string
+		wantUIDs []rspec.LinuxIDMapping
+		wantGIDs []rspec.LinuxIDMapping
+		wantErr  string
+	}{
+		{
+			name:     "derived",
+			opts:     derived,
+			wantUIDs: derived.UIDMappings,
+			wantGIDs: derived.GIDMappings,
+		},
+		{
+			name:     "uid map",
+			opts:     derived,
+			uidMap:   []string{"0:100000:1000", "1000:1000"},
+			wantUIDs: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 1000}, {ContainerID: 1000, HostID: 1000, Size: 1}},
+			wantGIDs: derived.GIDMappings,
+		},
+		{
+			name:     "gid map",
+			opts:     derived,
+			gidMap:   []string{"0:100000:65536"},
+			wantUIDs: derived.UIDMappings,
+			wantGIDs: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		},
+		{
+			name:    "invalid mapping",
+			opts:    derived,
+			gidMap:  []string{"0-100000"},
+			wantErr: `invalid gid mapping "0-100000"`,
+		},
+		{
+			name:    "rootless",
+			opts:    umocilayer.MapOptions{Rootless: true},
+			uidMap:  []string{"0:1000"},
+			wantErr: "require a privileged extraction",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := overrideMapOptions(tt.opts, tt.uidMap, tt.gidMap)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("unexpected error: got %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(opts.UIDMappings, tt.wantUIDs) || !reflect.DeepEqual(opts.GIDMappings, tt.wantGIDs) {
+				t.Errorf("unexpected mapping options %+v", opts)
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsExtractIDMap(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	img := newTestImage(t, nil, makeLayer(t,
+		tarEntry{name: "opt/", typeflag: tar.TypeDir, mode: 0o755},
+		tarEntry{name: "opt/data", body: "data", mode: 0o644, uid: 10, gid: 20},
+	))
+	b, err := unpackTestImage(t, img, func(b *sytypes.Bundle) {
+		b.Opts.ExtractUIDMap = []string{"0:100000:65536"}
+		b.Opts.ExtractGIDMap = []string{"0:200000:65536"}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fi, err := os.Lstat(filepath.Join(b.RootfsPath, "opt/data"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 100010 || st.Gid != 200020 {
+		t.Errorf("opt/data owned by %d:%d, want 100010:200020", st.Uid, st.Gid)
+	}
+}
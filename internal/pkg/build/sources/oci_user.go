@@ -0,0 +1,62 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/sylog"
+)
+
+// errRootUser is returned for an image running as root with the
+// sytypes.RootUserError policy.
+var errRootUser = errors.New("image runs as root")
+
+// isRootUser reports whether the user of an image config, a user name or
+// uid with an optional group, runs the image as root. The user names are
+// not resolved, only root is known to be uid 0.
+func isRootUser(user string) bool {
+	name, _, _ := strings.Cut(user, ":")
+	if name == "" || name == "root" {
+		return true
+	}
+	uid, err := strconv.ParseUint(name, 10, 32)
+	return err == nil && uid == 0
+}
+
+// checkImageUser applies the policy to the user of an image config, failing
+// with errRootUser or warning with the sytypes.RootUserError and
+// sytypes.RootUserWarn policies when it runs the image as root.
+func checkImageUser(user, policy string) error {
+	switch policy {
+	case "", sytypes.RootUserAllow:
+		return nil
+	case sytypes.RootUserWarn, sytypes.RootUserError:
+	default:
+		return fmt.Errorf("invalid policy %q for the images running as root, should be %s, %s or %s", policy,
+			sytypes.RootUserAllow, sytypes.RootUserWarn, sytypes.RootUserError)
+	}
+	if !isRootUser(user) {
+		return nil
+	}
+
+	reason := fmt.Sprintf("its config sets the user %s", user)
+	if user == "" {
+		reason = "its config doesn't set a user"
+	}
+	if policy == sytypes.RootUserWarn {
+		sylog.Warningf("The image runs as root: %s", reason)
+		return nil
+	}
+	return fmt.Errorf("%w: %s, set a non-root USER in the image or use --allow-root-user", errRootUser, reason)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/apptainer/apptainer/pkg/util/apptainerconf"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestIsRootUser(t *testing.T) {
+	tests := []struct {
+		user string
+		root bool
+	}{
+		{user: "", root: true},
+		{user: "root", root: true},
+		{user: "0", root: true},
+		{user: "0:1000", root: true},
+		{user: "root:wheel", root: true},
+		{user: ":1000", root: true},
+		{user: "1000", root: false},
+		{user: "1000:0", root: false},
+		{user: "app", root: false},
+		{user: "rootless", root: false},
+	}
+	for _, tt := range tests {
+		if root := isRootUser(tt.user); root != tt.root {
+			t.Errorf("unexpected root %v for user %q, want %v", root, tt.user, tt.root)
+		}
+	}
+}
+
+func TestRootUserPolicy(t *testing.T) {
+	reg := newStubRegistry(t)
+	layer := makeLayer(t, tarEntry{name: "file", body: "content"})
+	withUser := func(user string) func(*imgspecv1.Image) {
+		return func(img *imgspecv1.Image) {
+			img.Config.User = user
+		}
+	}
+	reg.push("test/image", "root", newTestImage(t, nil, layer))
+	reg.push("test/image", "uid0", newTestImage(t, withUser("0:0"), layer))
+	reg.push("test/image", "user", newTestImage(t, withUser("1000:1000"), layer))
+
+	tests := []struct {
+		name       string
+		tag        string
+		policy     string
+		configured string
+		wantError  string
+	}{
+		{name: "default policy", tag: "root"},
+		{name: "allow", tag: "root", policy: sytypes.RootUserAllow},
+		{name: "warn", tag: "uid0", policy: sytypes.RootUserWarn},
+		{name: "unset user rejected", tag: "root", policy: sytypes.RootUserError, wantError: "image runs as root: its config doesn't set a user"},
+		{name: "uid 0 rejected", tag: "uid0", policy: sytypes.RootUserError, wantError: "image runs as root: its config sets the user 0:0"},
+		{name: "non-root user accepted", tag: "user", policy: sytypes.RootUserError},
+		{name: "invalid policy", tag: "user", policy: "deny", wantError: "invalid policy \"deny\""},
+		// the configuration applies without the build option, as for pull
+		{name: "configured", tag: "root", configured: sytypes.RootUserError, wantError: "image runs as root"},
+		{name: "option over configuration", tag: "root", policy: sytypes.RootUserAllow, configured: sytypes.RootUserError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRootUserImages(t, tt.configured)
+			_, err := getDockerSource(t, reg.host()+"/test/image:"+tt.tag, func(b *sytypes.Bundle) {
+				b.Opts.RootUser = tt.policy
+			})
+			if tt.wantError == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("unexpected error: got %v, want %q", err, tt.wantError)
+			}
+			var serr *sytypes.SourceError
+			if !errors.As(err, &serr) || serr.Type != sytypes.SourceErrorManifest {
+				t.Errorf("unexpected error type: %#v", err)
+			}
+		})
+	}
+}
+
+// setRootUserImages sets the root user images policy of the current
+// configuration for the duration of the test.
+func setRootUserImages(t *testing.T, policy string) {
+	t.Helper()
+
+	prev := apptainerconf.GetCurrentConfig()
+	cfg, err := apptainerconf.Parse("")
+	if err != nil {
+		t.Fatalf("while parsing default configuration: %s", err)
+	}
+	if policy != "" {
+		cfg.RootUserImages = policy
+	}
+	apptainerconf.SetCurrentConfig(cfg)
+	t.Cleanup(func() { apptainerconf.SetCurrentConfig(prev) })
+}
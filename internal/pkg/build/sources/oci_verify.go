@@ -0,0 +1,458 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apptainer/apptainer/pkg/sylog"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// maxReportedMismatches is the number of mismatches listed in the error
+	// of verifyRootfs.
+	maxReportedMismatches = 10
+	// maxSymlinkHops is the number of symlinks followed when resolving a
+	// path of a rootfsModel, as securejoin does.
+	maxSymlinkHops = 255
+	// permBits are the bits of the mode of a path compared by verifyRootfs.
+	permBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+)
+
+// modelEntry is the state of a path of the root filesystem expected from
+// the layers of the image.
+type modelEntry struct {
+	// typ is the type bits of the mode of the path
+	typ os.FileMode
+	// perm is the permission bits of the path, unchecked for implied
+	// parent directories and symlinks
+	perm    os.FileMode
+	implied bool
+	size    int64
+	digest  digest.Digest
+	link    string
+}
+
+// rootfsModel is the root filesystem expected from the layers of an image.
+type rootfsModel struct {
+	// entries are keyed by the cleaned path relative to the root, "" being
+	// the root itself
+	entries map[string]*modelEntry
+	// children are the paths of the entries of each directory, so that a
+	// removal only visits the removed paths
+	children map[string]map[string]bool
+}
+
+// newRootfsModel returns a model holding the entries.
+func newRootfsModel(entries map[string]*modelEntry) *rootfsModel {
+	m := &rootfsModel{
+		entries:  make(map[string]*modelEntry, len(entries)),
+		children: make(map[string]map[string]bool),
+	}
+	for p, e := range entries {
+		m.set(p, e)
+	}
+	return m
+}
+
+// set sets the entry of path.
+func (m *rootfsModel) set(path string, e *modelEntry) {
+	m.entries[path] = e
+	if path == "" {
+		return
+	}
+	parent := parentEntryPath(path)
+	if m.children[parent] == nil {
+		m.children[parent] = make(map[string]bool)
+	}
+	m.children[parent][path] = true
+}
+
+// delete deletes the entry of path.
+func (m *rootfsModel) delete(path string) {
+	delete(m.entries, path)
+	parent := parentEntryPath(path)
+	delete(m.children[parent], path)
+	if len(m.children[parent]) == 0 {
+		delete(m.children, parent)
+	}
+}
+
+// verifyRootfs checks that the extracted root filesystem matches the layers
+// of manifest. The layers are read again, their content checked against the
+// diff IDs of the image config, and applied to a model of the filesystem as
+// umoci does, which is then compared to the paths, types, permissions,
+// content and symlink targets found on disk. The ownership, times and
+// xattrs are not checked.
+func (u *rootfsUnpacker) verifyRootfs(ctx context.Context, manifest imgspecv1.Manifest) error {
+	if u.collisions != nil {
+		return fmt.Errorf("not supported on the case-insensitive filesystem of %s", u.rootfs)
+	}
+
+	diffIDs, err := u.diffIDs(ctx, manifest)
+	if err != nil {
+		return err
+	}
+
+	m := newRootfsModel(map[string]*modelEntry{"": {typ: os.ModeDir, implied: true}})
+	for i, desc := range manifest.Layers {
+		if diffIDs[i] == emptyLayerDiffID {
+			continue
+		}
+		sylog.Debugf("Verifying rootfs against layer %s", desc.Digest)
+		_, err := u.readBlob(ctx, desc, diffIDs[i], func(layer io.Reader) error {
+			// upper records the paths, and their parents, written by the
+			// layer, which its whiteouts don't remove
+			upper := make(map[string]bool)
+			tr := tar.NewReader(layer)
+			if u.links != nil {
+				u.links.reset()
+			}
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				} else if err != nil {
+					return fmt.Errorf("error reading tar entry: %s", err)
+				}
+				hdr, spooled, err := u.filterLinkedEntry(hdr, tr, m.exists)
+				if err != nil {
+					return err
+				} else if hdr == nil {
+					continue
+				}
+				var r io.Reader = tr
+				if spooled != nil {
+					r = spooled
+				}
+				err = m.apply(hdr, r, upper)
+				if spooled != nil {
+					spooled.Close()
+				}
+				if err != nil {
+					return fmt.Errorf("%s: %s", hdr.Name, err)
+				}
+			}
+		})
+		if err != nil && !errors.Is(err, errSkippedLayer) {
+			return fmt.Errorf("layer %s: %s", desc.Digest, err)
+		}
+	}
+
+	fsEval := fseval.Default
+	if u.opts.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+	mismatches, err := m.compare(u.rootfs, fsEval)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		n := len(mismatches)
+		if n > maxReportedMismatches {
+			mismatches = append(mismatches[:maxReportedMismatches], fmt.Sprintf("and %d more", n-maxReportedMismatches))
+		}
+		return fmt.Errorf("%d paths don't match the image layers: %s", n, strings.Join(mismatches, "; "))
+	}
+	return nil
+}
+
+// apply updates the model with the tar entry hdr, whose content is read
+// from r. upper is the set of paths written by the layer of the entry.
+func (m *rootfsModel) apply(hdr *tar.Header, r io.Reader, upper map[string]bool) error {
+	unsafeDir, base := filepath.Split(cleanEntryPath(hdr.Name))
+	dir := m.resolve(unsafeDir)
+	path := joinEntryPath(dir, base)
+
+	// whiteouts don't remove the paths written by their own layer
+	switch {
+	case base == whiteoutOpaqueDir:
+		m.remove(dir, false, upper)
+		return nil
+	case strings.HasPrefix(base, whiteoutPrefix):
+		m.remove(joinEntryPath(dir, strings.TrimPrefix(base, whiteoutPrefix)), true, upper)
+		return nil
+	}
+
+	e := &modelEntry{perm: hdr.FileInfo().Mode() & permBits}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA: //nolint:staticcheck
+		digester := digest.SHA256.Digester()
+		n, err := io.Copy(digester.Hash(), r)
+		if err != nil {
+			return fmt.Errorf("error reading content: %s", err)
+		}
+		e.size, e.digest = n, digester.Digest()
+	case tar.TypeDir:
+		e.typ = os.ModeDir
+	case tar.TypeSymlink:
+		e.typ, e.perm, e.link = os.ModeSymlink, 0, hdr.Linkname
+	case tar.TypeLink:
+		linkDir, linkBase := filepath.Split(cleanEntryPath(hdr.Linkname))
+		target, ok := m.entries[joinEntryPath(m.resolve(linkDir), linkBase)]
+		if !ok {
+			return fmt.Errorf("hard link target %s not found", hdr.Linkname)
+		}
+		// a hard link shares the metadata of its target
+		linked := *target
+		e = &linked
+	case tar.TypeChar:
+		e.typ = os.ModeDevice | os.ModeCharDevice
+	case tar.TypeBlock:
+		e.typ = os.ModeDevice
+	case tar.TypeFifo:
+		e.typ = os.ModeNamedPipe
+	default:
+		return fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+
+	// a directory is kept when replaced by a directory, anything else is
+	// clobbered
+	if prev, ok := m.entries[path]; !ok || prev.typ != os.ModeDir || e.typ != os.ModeDir {
+		m.remove(path, true, nil)
+	}
+	m.set(path, e)
+
+	for p := path; ; p = parentEntryPath(p) {
+		upper[p] = true
+		if p == "" {
+			break
+		}
+		if parent := parentEntryPath(p); m.entries[parent] == nil {
+			m.set(parent, &modelEntry{typ: os.ModeDir, implied: true})
+		}
+	}
+	return nil
+}
+
+// remove deletes the paths below path, and path itself when self is set,
+// from the model, except those in keep.
+func (m *rootfsModel) remove(path string, self bool, keep map[string]bool) {
+	for child := range m.children[path] {
+		m.remove(child, true, keep)
+	}
+	if self && path != "" && !keep[path] {
+		m.delete(path)
+	}
+}
+
+// exists reports whether path is found in the model, its parents being
+// resolved within the model.
+func (m *rootfsModel) exists(path string) bool {
+	dir, base := filepath.Split(path)
+	_, ok := m.entries[joinEntryPath(m.resolve(dir), base)]
+	return ok
+}
+
+// resolve returns the model path of the directory dir, relative to the
+// root, with the symlinks of the model in its components followed within
+// the root filesystem.
+func (m *rootfsModel) resolve(dir string) string {
+	return resolveEntryPath(dir, func(path string) (string, bool) {
+		e, ok := m.entries[path]
+		if !ok || e.typ != os.ModeSymlink {
+			return "", false
+		}
+		return e.link, true
+	})
+}
+
+// resolveEntryPath returns the path of the directory dir relative to the
+// root, with the symlinks in its components, whose targets are returned by
+// readlink, followed within the root filesystem as securejoin does.
+func resolveEntryPath(dir string, readlink func(path string) (string, bool)) string {
+	resolved := ""
+	remaining := cleanEntryPath(dir)
+	for hops := 0; remaining != ""; {
+		var elem string
+		if i := strings.IndexByte(remaining, '/'); i >= 0 {
+			elem, remaining = remaining[:i], remaining[i+1:]
+		} else {
+			elem, remaining = remaining, ""
+		}
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = parentEntryPath(resolved)
+			continue
+		}
+
+		next := joinEntryPath(resolved, elem)
+		link, ok := "", false
+		if hops < maxSymlinkHops {
+			link, ok = readlink(next)
+		}
+		if !ok {
+			resolved = next
+			continue
+		}
+		hops++
+		if strings.HasPrefix(link, "/") {
+			resolved = ""
+		}
+		remaining = strings.TrimSuffix(link+"/"+remaining, "/")
+	}
+	return resolved
+}
+
+// compare returns the mismatches between the model and the root filesystem
+// rootfs, read with fsEval.
+func (m *rootfsModel) compare(rootfs string, fsEval fseval.FsEval) ([]string, error) {
+	var mismatches []string
+	seen := make(map[string]bool, len(m.entries))
+	// skipped are the directories whose content isn't compared, being
+	// reported themselves
+	skipped := make(map[string]bool)
+
+	err := fsEval.Walk(rootfs, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		rel = cleanEntryPath(rel)
+		seen[rel] = true
+
+		e, ok := m.entries[rel]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("/%s: not in the image", rel))
+			if fi.IsDir() {
+				skipped[rel] = true
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if mismatch, err := e.compare(path, fi, fsEval); err != nil {
+			return err
+		} else if mismatch != "" {
+			mismatches = append(mismatches, fmt.Sprintf("/%s: %s", rel, mismatch))
+			if fi.IsDir() != (e.typ == os.ModeDir) {
+				skipped[rel] = true
+			}
+			if fi.IsDir() && e.typ != os.ModeDir {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading rootfs: %s", err)
+	}
+
+	for p := range m.entries {
+		// the paths below a missing or skipped directory are not reported
+		if parent := parentEntryPath(p); !seen[p] && seen[parent] && !skipped[parent] {
+			mismatches = append(mismatches, fmt.Sprintf("/%s: missing", p))
+		}
+	}
+	sort.Strings(mismatches)
+	return mismatches, nil
+}
+
+// compare returns how the path of the root filesystem with the file info
+// fi doesn't match e, or "" if it does.
+func (e *modelEntry) compare(path string, fi os.FileInfo, fsEval fseval.FsEval) (string, error) {
+	typ := fi.Mode().Type()
+	// the devices of a rootless extraction are empty placeholder files
+	placeholder := e.typ&os.ModeDevice != 0 && typ.IsRegular() && fi.Size() == 0
+	if typ != e.typ && !placeholder {
+		return fmt.Sprintf("%s found, expected %s", typeName(typ), typeName(e.typ)), nil
+	}
+	if perm := fi.Mode() & permBits; !e.implied && e.typ != os.ModeSymlink && perm != e.perm {
+		return fmt.Sprintf("mode %s, expected %s", octalPerm(perm), octalPerm(e.perm)), nil
+	}
+
+	switch {
+	case e.typ == os.ModeSymlink:
+		link, err := fsEval.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if link != e.link {
+			return fmt.Sprintf("symlink to %s, expected %s", link, e.link), nil
+		}
+	case e.typ.IsRegular():
+		if fi.Size() != e.size {
+			return fmt.Sprintf("size %d, expected %d", fi.Size(), e.size), nil
+		}
+		f, err := fsEval.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		digester := digest.SHA256.Digester()
+		if _, err := io.Copy(digester.Hash(), f); err != nil {
+			return "", err
+		}
+		if d := digester.Digest(); d != e.digest {
+			return fmt.Sprintf("content digest %s, expected %s", d, e.digest), nil
+		}
+	}
+	return "", nil
+}
+
+// typeName returns a description of the file type typ.
+func typeName(typ os.FileMode) string {
+	switch {
+	case typ.IsRegular():
+		return "regular file"
+	case typ&os.ModeDir != 0:
+		return "directory"
+	case typ&os.ModeSymlink != 0:
+		return "symlink"
+	case typ&os.ModeCharDevice != 0:
+		return "character device"
+	case typ&os.ModeDevice != 0:
+		return "block device"
+	case typ&os.ModeNamedPipe != 0:
+		return "fifo"
+	default:
+		return "special file"
+	}
+}
+
+// octalPerm returns the permission bits of mode in octal.
+func octalPerm(mode os.FileMode) string {
+	perm := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= unix.S_ISVTX
+	}
+	return fmt.Sprintf("%#o", perm)
+}
+
+// joinEntryPath joins the model path dir and the name base.
+func joinEntryPath(dir, base string) string {
+	return cleanEntryPath(dir + "/" + base)
+}
+
+// parentEntryPath returns the model path of the parent directory of path.
+func parentEntryPath(path string) string {
+	return cleanEntryPath(filepath.Dir("/" + path))
+}
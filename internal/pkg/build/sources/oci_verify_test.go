@@ -0,0 +1,224 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+	sytypes "github.com/apptainer/apptainer/pkg/build/types"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// newVerifyTestImage returns an image whose layers override, remove and
+// link content of the lower layers.
+func newVerifyTestImage(t *testing.T) *testImage {
+	return newTestImage(t, nil, verifyTestLayers(t)...)
+}
+
+// verifyTestLayers returns the layers of newVerifyTestImage.
+func verifyTestLayers(t *testing.T) [][]byte {
+	return [][]byte{
+		makeLayer(t,
+			dirEntry("etc/"),
+			tarEntry{name: "etc/passwd", body: "root"},
+			tarEntry{name: "etc/shadow", body: "secret", mode: 0o600},
+			dirEntry("usr/"),
+			dirEntry("usr/bin/"),
+			tarEntry{name: "usr/bin/sh", body: "shell", mode: 0o755},
+			tarEntry{name: "bin", typeflag: tar.TypeSymlink, linkname: "usr/bin"},
+			dirEntry("opt/"),
+			dirEntry("opt/app/"),
+			tarEntry{name: "opt/app/old", body: "old"},
+		),
+		makeLayer(t,
+			tarEntry{name: "etc/passwd", body: "root\nuser"},
+			tarEntry{name: "etc/.wh.shadow"},
+			// written through the bin symlink
+			tarEntry{name: "bin/ls", body: "ls", mode: 0o755},
+			tarEntry{name: "bin/dir", typeflag: tar.TypeLink, linkname: "usr/bin/ls"},
+			dirEntry("opt/app/"),
+			tarEntry{name: "opt/app/new", body: "new"},
+			tarEntry{name: "opt/app/.wh..wh..opq"},
+			// files created without their parent directories
+			tarEntry{name: "var/lib/db", body: "db"},
+		),
+	}
+}
+
+func TestUnpackRootfsVerifyRootfs(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	b, err := unpackTestImage(t, newVerifyTestImage(t), func(b *sytypes.Bundle) {
+		b.Opts.VerifyRootfs = true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertPaths(t, b.RootfsPath, map[string]bool{
+		"etc/passwd":  true,
+		"etc/shadow":  false,
+		"usr/bin/ls":  true,
+		"usr/bin/dir": true,
+		"opt/app/new": true,
+		"opt/app/old": false,
+		"var/lib/db":  true,
+	})
+}
+
+func TestRootfsUnpackerVerifyRootfs(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	tests := []struct {
+		name    string
+		tamper  func(rootfs string) error
+		wantErr string
+	}{
+		{
+			name:   "untouched",
+			tamper: func(string) error { return nil },
+		},
+		{
+			name: "modified content",
+			tamper: func(rootfs string) error {
+				return os.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("root\nevil"), 0o644)
+			},
+			wantErr: "/etc/passwd: content digest",
+		},
+		{
+			name: "modified size",
+			tamper: func(rootfs string) error {
+				return os.WriteFile(filepath.Join(rootfs, "usr", "bin", "ls"), []byte("evil"), 0o755)
+			},
+			wantErr: "/usr/bin/ls: size 4, expected 2",
+		},
+		{
+			name: "added file",
+			tamper: func(rootfs string) error {
+				return os.WriteFile(filepath.Join(rootfs, "etc", "shadow"), []byte("secret"), 0o600)
+			},
+			wantErr: "/etc/shadow: not in the image",
+		},
+		{
+			name: "removed file",
+			tamper: func(rootfs string) error {
+				return os.Remove(filepath.Join(rootfs, "var", "lib", "db"))
+			},
+			wantErr: "/var/lib/db: missing",
+		},
+		{
+			name: "changed mode",
+			tamper: func(rootfs string) error {
+				return os.Chmod(filepath.Join(rootfs, "usr", "bin", "sh"), 0o755|os.ModeSetuid)
+			},
+			wantErr: "/usr/bin/sh: mode 04755, expected 0755",
+		},
+		{
+			name: "changed permissions",
+			tamper: func(rootfs string) error {
+				return os.Chmod(filepath.Join(rootfs, "etc", "passwd"), 0o666)
+			},
+			wantErr: "/etc/passwd: mode 0666, expected 0644",
+		},
+		{
+			name: "retargeted symlink",
+			tamper: func(rootfs string) error {
+				bin := filepath.Join(rootfs, "bin")
+				if err := os.Remove(bin); err != nil {
+					return err
+				}
+				return os.Symlink("/tmp", bin)
+			},
+			wantErr: "/bin: symlink to /tmp, expected usr/bin",
+		},
+		{
+			name: "replaced type",
+			tamper: func(rootfs string) error {
+				app := filepath.Join(rootfs, "opt", "app")
+				if err := os.RemoveAll(app); err != nil {
+					return err
+				}
+				return os.WriteFile(app, nil, 0o755)
+			},
+			wantErr: "/opt/app: regular file found, expected directory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := newVerifyTestImage(t)
+			dir := t.TempDir()
+			img.writeLayout(t, dir, "tmp")
+			engineExt, err := umoci.OpenLayout(dir)
+			if err != nil {
+				t.Fatalf("while opening layout: %s", err)
+			}
+			defer engineExt.Close()
+
+			u := &rootfsUnpacker{
+				engine: casext.NewEngine(engineExt),
+				rootfs: filepath.Join(t.TempDir(), "rootfs"),
+			}
+			ctx := context.Background()
+			if err := u.unpack(ctx, img.manifest); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err := tt.tamper(u.rootfs); err != nil {
+				t.Fatalf("while tampering with the rootfs: %s", err)
+			}
+
+			err = u.verifyRootfs(ctx, img.manifest)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("unexpected error: got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRootfsModelResolve(t *testing.T) {
+	m := newRootfsModel(map[string]*modelEntry{
+		"":          {typ: os.ModeDir},
+		"usr":       {typ: os.ModeDir},
+		"usr/bin":   {typ: os.ModeDir},
+		"bin":       {typ: os.ModeSymlink, link: "usr/bin"},
+		"abs":       {typ: os.ModeSymlink, link: "/usr/../usr/bin"},
+		"escape":    {typ: os.ModeSymlink, link: "../../.."},
+		"usr/lib64": {typ: os.ModeSymlink, link: "../lib"},
+		"loop":      {typ: os.ModeSymlink, link: "loop"},
+	})
+
+	tests := []struct {
+		dir  string
+		want string
+	}{
+		{dir: "", want: ""},
+		{dir: "etc/", want: "etc"},
+		{dir: "bin/", want: "usr/bin"},
+		{dir: "abs/x/", want: "usr/bin/x"},
+		{dir: "escape/etc", want: "etc"},
+		{dir: "usr/lib64/", want: "lib"},
+		{dir: "../bin", want: "usr/bin"},
+		{dir: "loop/x", want: "loop/x"},
+	}
+	for _, tt := range tests {
+		if got := m.resolve(tt.dir); got != tt.want {
+			t.Errorf("resolve(%q): got %q, want %q", tt.dir, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	apexlog "github.com/apex/log"
+	"github.com/apptainer/apptainer/pkg/sylog"
+)
+
+// warningRecorder records the warnings about the image content emitted
+// while extracting a source, to fail the build once the extraction is
+// done. A nil recorder only logs the warnings.
+type warningRecorder struct {
+	mu       sync.Mutex
+	warnings []string
+}
+
+// record records the warning msg.
+func (w *warningRecorder) record(msg string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warnings = append(w.warnings, msg)
+}
+
+// warnf logs a warning, and records it.
+func (w *warningRecorder) warnf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	sylog.Warningf("%s", msg)
+	if w != nil {
+		w.record(msg)
+	}
+}
+
+// captureUmoci records the warnings logged by umoci, e.g. about dropped
+// xattrs, until the returned function is called. The warnings are recorded
+// even when the log level hides them.
+func (w *warningRecorder) captureUmoci() (restore func()) {
+	if w == nil {
+		return func() {}
+	}
+	return logHandlers.add(&logHandler{
+		entry: func(e *apexlog.Entry) {
+			if e.Level == apexlog.WarnLevel {
+				w.record(e.Message)
+			}
+		},
+		warnings: true,
+	})
+}
+
+// err returns an error aggregating the recorded warnings, if any.
+func (w *warningRecorder) err() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.warnings) == 0 {
+		return nil
+	}
+	return fmt.Errorf("warnings treated as errors: %s", strings.Join(w.warnings, "; "))
+}
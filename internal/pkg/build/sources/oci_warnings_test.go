@@ -0,0 +1,58 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"strings"
+	"testing"
+
+	apexlog "github.com/apex/log"
+)
+
+func TestWarningRecorderCaptureUmoci(t *testing.T) {
+	logger := apexlog.Log.(*apexlog.Logger)
+	level := logger.Level
+	logHandlers.setLevel(apexlog.ErrorLevel)
+	t.Cleanup(func() { logHandlers.setLevel(level) })
+
+	// the recorders of concurrent extractions are restored in any order
+	w := &warningRecorder{}
+	other := &warningRecorder{}
+	restoreOther := other.captureUmoci()
+	restore := w.captureUmoci()
+	restoreOther()
+	apexlog.Infof("unpack rootfs: %s", "/rootfs")
+	apexlog.Warnf("xattr{%s} ignoring forbidden xattr: %q", "file", "security.evm")
+	restore()
+	apexlog.Warnf("after restore")
+
+	if logger.Handler != logHandlers {
+		t.Errorf("unexpected apex/log handler: %T", logger.Handler)
+	}
+	if err := other.err(); err != nil {
+		t.Errorf("unexpected warnings recorded after restore: %s", err)
+	}
+
+	if logger.Level != apexlog.ErrorLevel {
+		t.Errorf("log level not restored: %s", logger.Level)
+	}
+	err := w.err()
+	if err == nil {
+		t.Fatalf("warnings not recorded")
+	}
+	if !strings.Contains(err.Error(), "ignoring forbidden xattr") || strings.Contains(err.Error(), "after restore") {
+		t.Errorf("unexpected recorded warnings: %s", err)
+	}
+
+	var nilRecorder *warningRecorder
+	nilRecorder.warnf("only logged")
+	if err := nilRecorder.err(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
@@ -34,6 +34,8 @@ type stage struct {
 	a Assembler
 	// b is an intermediate structure that encapsulates all information for the container, e.g., metadata, filesystems.
 	b *types.Bundle
+	// lock is held on the scratch directory holding the rootfs of b.
+	lock *os.File
 }
 
 const (
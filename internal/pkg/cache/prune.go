@@ -0,0 +1,307 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apptainer/apptainer/pkg/sylog"
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// EntryInfo describes an entry of the cache, as listed by Entries.
+type EntryInfo struct {
+	// Type is the cache type of the entry, e.g. OciBlobCacheType.
+	Type string
+	// Name is the file name of the entry in its cache type directory.
+	Name string
+	// Digest is the digest of the content of the entries of the
+	// OciBlobCacheType, empty for the file cache types whose entries are
+	// named after the hash of their source.
+	Digest digest.Digest
+	// Path is the path of the entry.
+	Path string
+	// Size is the size of the entry, in bytes.
+	Size int64
+	// LastUsed is the time the entry was last used, its access time when the
+	// filesystem records it, updated by GetEntry, or its modification time.
+	LastUsed time.Time
+}
+
+// PruneOptions select the entries removed by Prune. An entry is removed
+// when it's older than MaxAge, or when it's one of the least recently used
+// ones to remove for the remaining entries to fit in MaxSize.
+type PruneOptions struct {
+	// Types are the cache types pruned, all of them when empty.
+	Types []string
+	// MaxAge, if not zero, removes the entries not used for longer.
+	MaxAge time.Duration
+	// MaxSize, if not zero, removes the least recently used entries until
+	// the size of the entries of Types is at most MaxSize bytes.
+	MaxSize int64
+	// DryRun only reports the entries which would be removed.
+	DryRun bool
+}
+
+// PruneResult reports the entries removed by Prune.
+type PruneResult struct {
+	// Removed are the entries removed, or which would be with DryRun.
+	Removed []EntryInfo
+	// Locked are the entries selected but kept, as locked by a build.
+	Locked []EntryInfo
+	// Bytes is the size of the entries removed.
+	Bytes int64
+}
+
+// allCacheTypes returns the cache types types, or all of the cache types
+// when empty, after checking them.
+func allCacheTypes(types []string) ([]string, error) {
+	if len(types) == 0 {
+		return append(append([]string{}, OciCacheTypes...), FileCacheTypes...), nil
+	}
+	for _, t := range types {
+		if !stringInSlice(t, OciCacheTypes) && !stringInSlice(t, FileCacheTypes) {
+			return nil, fmt.Errorf("%w: %s", errInvalidCacheType, t)
+		}
+	}
+	return types, nil
+}
+
+// entriesDir returns the directory holding the entries of cacheType.
+func (h *Handle) entriesDir(cacheType string) string {
+	if cacheType == OciBlobCacheType {
+		return filepath.Join(h.getCacheTypeDir(cacheType), "blobs", "sha256")
+	}
+	return h.getCacheTypeDir(cacheType)
+}
+
+// Entries returns the entries of the cache types, or of all of the cache
+// types when empty, from the least recently used.
+func (h *Handle) Entries(types []string) ([]EntryInfo, error) {
+	if h.disabled {
+		return nil, nil
+	}
+	types, err := allCacheTypes(types)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []EntryInfo
+	for _, t := range types {
+		dir := h.entriesDir(t)
+		files, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to open cache %s at directory %s: %v", t, dir, err)
+		}
+		for _, f := range files {
+			// the temporary files of the entries being created
+			if strings.HasPrefix(f.Name(), "tmp_") || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			fi, err := f.Info()
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("unable to get info for cache entry %s: %v", f.Name(), err)
+			}
+			e := EntryInfo{
+				Type:     t,
+				Name:     f.Name(),
+				Path:     filepath.Join(dir, f.Name()),
+				Size:     fi.Size(),
+				LastUsed: lastUsed(fi),
+			}
+			if t == OciBlobCacheType {
+				e.Digest = digest.NewDigestFromEncoded(digest.SHA256, f.Name())
+			}
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// lastUsed returns the latest of the access and modification times of fi.
+func lastUsed(fi os.FileInfo) time.Time {
+	t := fi.ModTime()
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if atime := time.Unix(st.Atim.Sec, st.Atim.Nsec); atime.After(t) {
+			t = atime
+		}
+	}
+	return t
+}
+
+// touch records the use of the entry at path, for Entries, without
+// changing its modification time, the creation time of the entries listed
+// and cleaned by age.
+func touch(path string) {
+	fi, err := os.Stat(path)
+	if err == nil {
+		err = os.Chtimes(path, time.Now(), fi.ModTime())
+	}
+	if err != nil {
+		sylog.Debugf("Could not record the use of cache entry %s: %v", path, err)
+	}
+}
+
+// Lock holds a shared lock on the entry name of the file cache type
+// cacheType, or on all of the entries of cacheType when name is empty,
+// until the returned function is called, so that Prune doesn't remove it,
+// e.g. for the duration of a build using it. It waits for Prune to
+// complete.
+func (h *Handle) Lock(cacheType, name string) (func(), error) {
+	if h.disabled {
+		return func() {}, nil
+	}
+	if _, err := allCacheTypes([]string{cacheType}); err != nil {
+		return nil, err
+	}
+
+	path := h.getCacheTypeDir(cacheType)
+	if name == "" {
+		// the blob cache is only created by the first fetch
+		if err := initCacheDir(path); err != nil {
+			return nil, err
+		}
+	} else if cacheType == OciBlobCacheType {
+		return nil, fmt.Errorf("the entries of the %s cache are only locked together", cacheType)
+	} else {
+		path = filepath.Join(path, name)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("while locking cache entry: %w", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_SH); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("while locking %s: %w", path, err)
+	}
+	// the entry may have been removed while waiting for the lock
+	if name != "" {
+		fi, err := f.Stat()
+		if err == nil {
+			var cur os.FileInfo
+			if cur, err = os.Lstat(path); err == nil && !os.SameFile(fi, cur) {
+				err = os.ErrNotExist
+			}
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("while locking cache entry %s: %w", path, err)
+		}
+	}
+	return func() { f.Close() }, nil
+}
+
+// tryLock takes an exclusive lock on path, held until the returned file is
+// closed, or returns nil if it's locked.
+func tryLock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		f.Close()
+		return nil, nil
+	} else if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Prune removes the entries of the cache selected by opts, from the least
+// recently used, and reports the space reclaimed. The entries locked by
+// builds, see Lock, are kept.
+func (h *Handle) Prune(opts PruneOptions) (PruneResult, error) {
+	var r PruneResult
+	if h.disabled {
+		return r, nil
+	}
+	types, err := allCacheTypes(opts.Types)
+	if err != nil {
+		return r, err
+	}
+
+	// the cache types locked as a whole are locked for the duration of the
+	// prune, for a build not to use their entries in the meantime
+	lockedTypes := make(map[string]bool)
+	for _, t := range types {
+		f, err := tryLock(h.getCacheTypeDir(t))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return r, fmt.Errorf("while locking cache %s: %w", t, err)
+		}
+		if f == nil {
+			lockedTypes[t] = true
+			continue
+		}
+		defer f.Close()
+	}
+
+	entries, err := h.Entries(types)
+	if err != nil {
+		return r, err
+	}
+	var size int64
+	for _, e := range entries {
+		size += e.Size
+	}
+
+	now := time.Now()
+	for _, e := range entries {
+		expired := opts.MaxAge > 0 && now.Sub(e.LastUsed) > opts.MaxAge
+		oversized := opts.MaxSize > 0 && size > opts.MaxSize
+		if !expired && !oversized {
+			continue
+		}
+
+		if lockedTypes[e.Type] {
+			r.Locked = append(r.Locked, e)
+			continue
+		}
+		f, err := tryLock(e.Path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return r, fmt.Errorf("while locking cache entry %s: %w", e.Path, err)
+		}
+		if f == nil {
+			r.Locked = append(r.Locked, e)
+			continue
+		}
+		if !opts.DryRun {
+			err = os.Remove(e.Path)
+		}
+		f.Close()
+		if err != nil {
+			return r, fmt.Errorf("could not remove cache entry %s: %v", e.Path, err)
+		}
+		r.Removed = append(r.Removed, e)
+		r.Bytes += e.Size
+		size -= e.Size
+	}
+	return r, nil
+}
@@ -0,0 +1,262 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// testEntry is an entry of the cache created by makeTestCache, last used
+// age ago.
+type testEntry struct {
+	cacheType string
+	content   string
+	age       time.Duration
+}
+
+// makeTestCache returns a cache holding the entries, and their names.
+func makeTestCache(t *testing.T, entries []testEntry) (*Handle, []string) {
+	t.Helper()
+
+	t.Setenv(DisableEnv, "")
+	h, err := New(Config{ParentDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("while creating cache: %s", err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := digest.FromString(e.content).Encoded()
+		dir := h.getCacheTypeDir(e.cacheType)
+		if e.cacheType == OciBlobCacheType {
+			dir = filepath.Join(dir, "blobs", "sha256")
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(e.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		used := time.Now().Add(-e.age)
+		if err := os.Chtimes(path, used, used); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	return h, names
+}
+
+// entryNames returns the names of entries.
+func entryNames(entries []EntryInfo) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func TestEntries(t *testing.T) {
+	h, names := makeTestCache(t, []testEntry{
+		{cacheType: OciBlobCacheType, content: "layer", age: time.Hour},
+		{cacheType: LibraryCacheType, content: "library image", age: 3 * time.Hour},
+		{cacheType: OciTempCacheType, content: "oci image", age: 2 * time.Hour},
+	})
+
+	entries, err := h.Entries(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := entryNames(entries), []string{names[1], names[2], names[0]}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected entries %v, want %v", got, want)
+	}
+	blob := entries[2]
+	if blob.Type != OciBlobCacheType || blob.Digest != digest.FromString("layer") || blob.Size != int64(len("layer")) {
+		t.Errorf("unexpected blob entry %+v", blob)
+	}
+	if entries[0].Type != LibraryCacheType || entries[0].Digest != "" {
+		t.Errorf("unexpected library entry %+v", entries[0])
+	}
+	if d := time.Since(entries[0].LastUsed); d < 3*time.Hour-time.Minute || d > 3*time.Hour+time.Minute {
+		t.Errorf("unexpected last use %s", entries[0].LastUsed)
+	}
+
+	entries, err = h.Entries([]string{OciTempCacheType})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := entryNames(entries); !reflect.DeepEqual(got, []string{names[2]}) {
+		t.Errorf("unexpected entries %v", got)
+	}
+	if _, err := h.Entries([]string{"unknown"}); err == nil {
+		t.Errorf("unexpected success with an unknown cache type")
+	}
+
+	// using an entry makes it the most recently used one
+	e, err := h.GetEntry(LibraryCacheType, names[1])
+	if err != nil || !e.Exists {
+		t.Fatalf("unexpected entry %+v (err=%v)", e, err)
+	}
+	entries, err = h.Entries(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := entryNames(entries), []string{names[2], names[0], names[1]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected entries %v, want %v", got, want)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	entries := []testEntry{
+		{cacheType: LibraryCacheType, content: strings.Repeat("a", 100), age: 5 * time.Hour},
+		{cacheType: OciTempCacheType, content: strings.Repeat("b", 200), age: 4 * time.Hour},
+		{cacheType: OciBlobCacheType, content: strings.Repeat("c", 300), age: 3 * time.Hour},
+		{cacheType: NetCacheType, content: strings.Repeat("d", 400), age: time.Hour},
+	}
+
+	tests := []struct {
+		name    string
+		opts    PruneOptions
+		lock    func(t *testing.T, h *Handle, names []string) func()
+		removed []int
+		locked  []int
+		bytes   int64
+	}{
+		{
+			name:    "max age",
+			opts:    PruneOptions{MaxAge: 3*time.Hour + 30*time.Minute},
+			removed: []int{0, 1},
+			bytes:   300,
+		},
+		{
+			name:    "max size lru",
+			opts:    PruneOptions{MaxSize: 700},
+			removed: []int{0, 1},
+			bytes:   300,
+		},
+		{
+			name:    "max size of types",
+			opts:    PruneOptions{Types: []string{OciBlobCacheType, NetCacheType}, MaxSize: 500},
+			removed: []int{2},
+			bytes:   300,
+		},
+		{
+			name:    "dry run",
+			opts:    PruneOptions{MaxSize: 400, DryRun: true},
+			removed: []int{0, 1, 2},
+			bytes:   600,
+		},
+		{
+			name: "locked entry",
+			opts: PruneOptions{MaxSize: 700},
+			lock: func(t *testing.T, h *Handle, names []string) func() {
+				unlock, err := h.Lock(OciTempCacheType, names[1])
+				if err != nil {
+					t.Fatalf("while locking entry: %s", err)
+				}
+				return unlock
+			},
+			removed: []int{0, 2},
+			locked:  []int{1},
+			bytes:   400,
+		},
+		{
+			name: "locked blobs",
+			opts: PruneOptions{MaxAge: time.Minute},
+			lock: func(t *testing.T, h *Handle, _ []string) func() {
+				unlock, err := h.Lock(OciBlobCacheType, "")
+				if err != nil {
+					t.Fatalf("while locking blobs: %s", err)
+				}
+				return unlock
+			},
+			removed: []int{0, 1, 3},
+			locked:  []int{2},
+			bytes:   700,
+		},
+		{
+			name: "released lock",
+			opts: PruneOptions{MaxAge: time.Minute},
+			lock: func(t *testing.T, h *Handle, names []string) func() {
+				unlock, err := h.Lock(OciTempCacheType, names[1])
+				if err != nil {
+					t.Fatalf("while locking entry: %s", err)
+				}
+				unlock()
+				return func() {}
+			},
+			removed: []int{0, 1, 2, 3},
+			bytes:   1000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, names := makeTestCache(t, entries)
+			if tt.lock != nil {
+				defer tt.lock(t, h, names)()
+			}
+
+			r, err := h.Prune(tt.opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			var removed, locked []string
+			for _, i := range tt.removed {
+				removed = append(removed, names[i])
+			}
+			for _, i := range tt.locked {
+				locked = append(locked, names[i])
+			}
+			if got := entryNames(r.Removed); !reflect.DeepEqual(got, removed) {
+				t.Errorf("unexpected removed entries %v, want %v", got, removed)
+			}
+			if got := entryNames(r.Locked); !reflect.DeepEqual(got, locked) {
+				t.Errorf("unexpected locked entries %v, want %v", got, locked)
+			}
+			if r.Bytes != tt.bytes {
+				t.Errorf("unexpected reclaimed size %d, want %d", r.Bytes, tt.bytes)
+			}
+
+			left, err := h.Entries(nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if want := len(entries) - len(removed); tt.opts.DryRun {
+				if len(left) != len(entries) {
+					t.Errorf("entries removed by dry run: %v", entryNames(left))
+				}
+			} else if len(left) != want {
+				t.Errorf("unexpected %d entries left, want %d", len(left), want)
+			}
+		})
+	}
+}
+
+func TestLockRemovedEntry(t *testing.T) {
+	h, names := makeTestCache(t, []testEntry{{cacheType: LibraryCacheType, content: "image", age: time.Hour}})
+
+	if _, err := h.Prune(PruneOptions{MaxAge: time.Minute}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := h.Lock(LibraryCacheType, names[0]); err == nil {
+		t.Errorf("unexpected lock of a removed entry")
+	}
+	if _, err := h.Lock(OciBlobCacheType, names[0]); err == nil {
+		t.Errorf("unexpected lock of a single blob")
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// ErrBlobDigestMismatch is returned for an entry of a shared blob store
+// whose content doesn't match its digest, e.g. a poisoned entry.
+var ErrBlobDigestMismatch = errors.New("blob content doesn't match its digest")
+
+// SharedBlobStore is a directory of OCI blobs, named by their digest,
+// which the builds of several users populate and reuse, e.g. a
+// group-writable directory of a multi-user node. The directory must have
+// the sticky bit when writable by other users, so that the entries are
+// only removed or renamed by their owner, and the entries are only
+// replaced when poisoned, by their owner or root. The entries are
+// validated against their digest while read, a poisoned entry failing the
+// read. The poisoned entries of other users are evicted by removing them
+// as root.
+type SharedBlobStore struct {
+	dir string
+}
+
+// OpenSharedBlobStore returns the shared blob store of the directory dir,
+// which must be owned by root or the current user, and have the sticky bit
+// when it is writable by the group or the other users.
+func OpenSharedBlobStore(dir string) (*SharedBlobStore, error) {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("while opening shared blob cache: %w", err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("shared blob cache %s is not a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Uid != 0 && int(st.Uid) != os.Getuid() {
+		return nil, fmt.Errorf("shared blob cache %s must be owned by root or the current user, not uid %d", dir, st.Uid)
+	}
+	if fi.Mode().Perm()&0o022 != 0 && fi.Mode()&os.ModeSticky == 0 {
+		return nil, fmt.Errorf("shared blob cache %s is writable by other users and must have the sticky bit (chmod +t)", dir)
+	}
+	return &SharedBlobStore{dir: dir}, nil
+}
+
+// path returns the path of the entry of the blob d.
+func (s *SharedBlobStore) path(d digest.Digest) (string, error) {
+	if err := d.Validate(); err != nil {
+		return "", fmt.Errorf("invalid blob digest %q: %w", d, err)
+	}
+	return filepath.Join(s.dir, d.Algorithm().String()+"-"+d.Encoded()), nil
+}
+
+// Open returns the content of the blob d and its size, failing with an
+// error wrapping os.ErrNotExist when it isn't stored, or
+// ErrBlobDigestMismatch when the entry isn't a regular file only writable
+// by its owner. The content is validated against d while it is read, the
+// read failing with ErrBlobDigestMismatch at the end of a poisoned entry.
+func (s *SharedBlobStore) Open(d digest.Digest) (io.ReadCloser, int64, error) {
+	path, err := s.path(d)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	} else if !fi.Mode().IsRegular() || fi.Mode().Perm()&0o022 != 0 {
+		f.Close()
+		return nil, 0, fmt.Errorf("%w: %s is not a regular file only writable by its owner", ErrBlobDigestMismatch, path)
+	}
+	return &verifiedBlob{File: f, verifier: d.Verifier(), path: path}, fi.Size(), nil
+}
+
+// verifiedBlob is the content of an entry validated while it is read.
+type verifiedBlob struct {
+	*os.File
+	verifier digest.Verifier
+	path     string
+}
+
+func (b *verifiedBlob) Read(p []byte) (int, error) {
+	n, err := b.File.Read(p)
+	b.verifier.Write(p[:n])
+	if err == io.EOF && !b.verifier.Verified() {
+		return n, fmt.Errorf("%w: %s", ErrBlobDigestMismatch, b.path)
+	}
+	return n, err
+}
+
+// lockPollInterval is the interval Lock retries a lock held by another
+// build at.
+var lockPollInterval = 100 * time.Millisecond
+
+// Lock locks the entry of the blob d, e.g. while it is fetched to store
+// it, until the returned function is called. It waits for the lock held by
+// another build until ctx is done, returning the error of ctx.
+func (s *SharedBlobStore) Lock(ctx context.Context, d digest.Digest) (func(), error) {
+	path, err := s.path(d)
+	if err != nil {
+		return nil, err
+	}
+	path += ".lock"
+	// the lock file of another user isn't opened with O_CREAT, refused in
+	// the sticky directories protecting the regular files
+	var f *os.File
+	for f == nil {
+		f, err = os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		if os.IsNotExist(err) {
+			f, err = os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0o644)
+			if os.IsExist(err) {
+				continue
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("while creating lock file of %s: %w", d, err)
+		}
+	}
+
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			return func() {
+				unix.Flock(int(f.Fd()), unix.LOCK_UN)
+				f.Close()
+			}, nil
+		} else if err != unix.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("while locking %s: %w", d, err)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("while waiting for the lock of %s: %w", d, ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// Create returns a writer of the content of the blob d, stored once
+// committed.
+func (s *SharedBlobStore) Create(d digest.Digest) (*SharedBlobWriter, error) {
+	path, err := s.path(d)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(s.dir, ".tmp-")
+	if err != nil {
+		return nil, fmt.Errorf("while creating shared cache entry of %s: %w", d, err)
+	}
+	// the entries are readable by the other users, and only writable by
+	// their owner
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &SharedBlobWriter{f: f, path: path, digest: d, verifier: d.Verifier()}, nil
+}
+
+// SharedBlobWriter writes the content of a blob to a shared blob store.
+type SharedBlobWriter struct {
+	f        *os.File
+	path     string
+	digest   digest.Digest
+	verifier digest.Verifier
+}
+
+func (w *SharedBlobWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.verifier.Write(p[:n])
+	return n, err
+}
+
+// Commit stores the content written, once validated against the digest of
+// the blob. An entry already stored, e.g. by another user, is only
+// replaced when poisoned, and owned by the current user, or by root.
+func (w *SharedBlobWriter) Commit() error {
+	defer os.Remove(w.f.Name())
+	if err := w.f.Close(); err != nil {
+		return err
+	} else if !w.verifier.Verified() {
+		return fmt.Errorf("%w: content written for %s", ErrBlobDigestMismatch, filepath.Base(w.path))
+	}
+	// a link fails instead of replacing an existing entry
+	err := os.Link(w.f.Name(), w.path)
+	if err == nil {
+		return nil
+	} else if !os.IsExist(err) {
+		return fmt.Errorf("while storing %s: %w", filepath.Base(w.path), err)
+	}
+
+	fi, err := os.Lstat(w.path)
+	if err != nil {
+		return fmt.Errorf("while storing %s: %w", filepath.Base(w.path), err)
+	}
+	if validEntry(w.path, w.digest) {
+		return nil
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && os.Getuid() != 0 && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%w: %s of uid %d, only replaced by its owner or root", ErrBlobDigestMismatch, w.path, st.Uid)
+	}
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		return fmt.Errorf("while replacing poisoned %s: %w", filepath.Base(w.path), err)
+	}
+	return nil
+}
+
+// validEntry reports whether the entry path is a regular file only
+// writable by its owner whose content matches d.
+func validEntry(path string, d digest.Digest) bool {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() || fi.Mode().Perm()&0o022 != 0 {
+		return false
+	}
+	verifier := d.Verifier()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return false
+	}
+	return verifier.Verified()
+}
+
+// Abort discards the content written.
+func (w *SharedBlobWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
@@ -0,0 +1,256 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func writeSharedBlob(s *SharedBlobStore, d digest.Digest, content string) error {
+	w, err := s.Create(d)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+func TestOpenSharedBlobStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    os.FileMode
+		symlink bool
+		wantErr bool
+	}{
+		{name: "private", mode: 0o700},
+		{name: "group writable with sticky bit", mode: 0o775 | os.ModeSticky},
+		{name: "world writable with sticky bit", mode: 0o777 | os.ModeSticky},
+		{name: "group writable without sticky bit", mode: 0o775, wantErr: true},
+		{name: "world writable without sticky bit", mode: 0o777, wantErr: true},
+		{name: "symlink", mode: 0o700, symlink: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "blobs")
+			if err := os.Mkdir(dir, 0o700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(dir, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			if tt.symlink {
+				link := dir + ".link"
+				if err := os.Symlink(dir, link); err != nil {
+					t.Fatal(err)
+				}
+				dir = link
+			}
+			_, err := OpenSharedBlobStore(dir)
+			if tt.wantErr && err == nil {
+				t.Errorf("unexpected success for mode %s", tt.mode)
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestSharedBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSharedBlobStore(dir)
+	if err != nil {
+		t.Fatalf("while opening store: %s", err)
+	}
+	content := "blob content"
+	d := digest.FromString(content)
+
+	if _, _, err := s.Open(d); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error for a missing blob: %v", err)
+	}
+	if err := writeSharedBlob(s, d, "other content"); !errors.Is(err, ErrBlobDigestMismatch) {
+		t.Fatalf("unexpected error for a mismatching blob: %v", err)
+	}
+	if _, _, err := s.Open(d); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("mismatching blob stored: %v", err)
+	}
+
+	// the concurrent writers of a blob all succeed, the first commit
+	// being kept
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			unlock, err := s.Lock(context.Background(), d)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer unlock()
+			errs[i] = writeSharedBlob(s, d, content)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("while writing blob: %s", err)
+		}
+	}
+
+	rc, size, err := s.Open(d)
+	if err != nil {
+		t.Fatalf("while opening blob: %s", err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("while reading blob: %s", err)
+	} else if string(data) != content || size != int64(len(content)) {
+		t.Errorf("unexpected blob %q of size %d", data, size)
+	}
+
+	path := filepath.Join(dir, "sha256-"+d.Encoded())
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0o644 {
+		t.Errorf("unexpected mode %s of blob", fi.Mode())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ".lock" && e.Name() != filepath.Base(path) {
+			t.Errorf("unexpected entry %s left in store", e.Name())
+		}
+	}
+}
+
+func TestSharedBlobStorePoisoned(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSharedBlobStore(dir)
+	if err != nil {
+		t.Fatalf("while opening store: %s", err)
+	}
+	d := digest.FromString("blob content")
+	path := filepath.Join(dir, "sha256-"+d.Encoded())
+
+	if err := os.WriteFile(path, []byte("poisoned content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// a poisoned entry fails the read
+	read := func() error {
+		rc, _, err := s.Open(d)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.ReadAll(rc)
+		return err
+	}
+	if err := read(); !errors.Is(err, ErrBlobDigestMismatch) {
+		t.Fatalf("unexpected error for a poisoned blob: %v", err)
+	}
+	// a poisoned entry of the current user is replaced, a valid one isn't
+	if err := writeSharedBlob(s, d, "blob content"); err != nil {
+		t.Fatalf("while writing blob: %s", err)
+	}
+	if err := read(); err != nil {
+		t.Fatalf("poisoned blob not replaced: %s", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSharedBlob(s, d, "blob content"); err != nil {
+		t.Fatalf("while writing blob: %s", err)
+	}
+	if other, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if !os.SameFile(fi, other) {
+		t.Errorf("valid blob replaced")
+	}
+
+	// an entry writable by other users is rejected even if valid
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSharedBlob(s, d, "blob content"); err != nil {
+		t.Fatalf("while writing blob: %s", err)
+	}
+	if err := os.Chmod(path, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Open(d); !errors.Is(err, ErrBlobDigestMismatch) {
+		t.Fatalf("unexpected error for a writable blob: %v", err)
+	}
+
+	// an entry modified once opened fails the read
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rc, _, err := s.Open(d)
+	if err != nil {
+		t.Fatalf("while opening blob: %s", err)
+	}
+	defer rc.Close()
+	if err := os.WriteFile(path, []byte("blob CONTENT"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(rc); !errors.Is(err, ErrBlobDigestMismatch) {
+		t.Errorf("unexpected error reading a modified blob: %v", err)
+	}
+
+	if _, _, err := s.Open("sha256:../../etc/passwd"); err == nil {
+		t.Errorf("unexpected success opening an invalid digest")
+	}
+}
+
+func TestSharedBlobStoreLockTimeout(t *testing.T) {
+	s, err := OpenSharedBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("while opening store: %s", err)
+	}
+	d := digest.FromString("blob content")
+
+	unlock, err := s.Lock(context.Background(), d)
+	if err != nil {
+		t.Fatalf("while locking blob: %s", err)
+	}
+	// the lock held by another build is waited for until ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := s.Lock(ctx, d); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error for a held lock: %v", err)
+	}
+
+	unlock()
+	other, err := s.Lock(context.Background(), d)
+	if err != nil {
+		t.Fatalf("while locking released blob: %s", err)
+	}
+	other()
+}
@@ -14,6 +14,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"time"
 
@@ -21,6 +22,7 @@ import (
 	"github.com/apptainer/apptainer/internal/pkg/client"
 	"github.com/apptainer/apptainer/internal/pkg/signature"
 	"github.com/apptainer/apptainer/internal/pkg/util/fs"
+	buildtypes "github.com/apptainer/apptainer/pkg/build/types"
 	"github.com/apptainer/apptainer/pkg/sylog"
 	keyClient "github.com/apptainer/container-key-client/client"
 	libClient "github.com/apptainer/container-library-client/client"
@@ -30,11 +32,30 @@ import (
 // ErrLibraryPullUnsigned indicates that the interactive portion of the pull was aborted.
 var ErrLibraryPullUnsigned = errors.New("failed to verify container")
 
+// CheckAllowedRegistry checks that the host of the library baseURL, which
+// imageRef is pulled from, matches one of the allowed registry patterns,
+// before any request is sent to it.
+func CheckAllowedRegistry(baseURL string, imageRef *libClient.Ref, patterns []string) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid library URL %q: %s", baseURL, err)
+	}
+	return buildtypes.CheckRegistryAllowed(patterns, u.Host, imageRef.String())
+}
+
 // pull will pull a library image into the cache if directTo="", or a specific file if directTo is set.
-func pull(ctx context.Context, imgCache *cache.Handle, directTo string, imageRef *libClient.Ref, arch string, libraryConfig *libClient.Config) (string, error) {
+// The cache entry is locked against Prune until the returned function is called.
+func pull(ctx context.Context, imgCache *cache.Handle, directTo string, imageRef *libClient.Ref, arch string, libraryConfig *libClient.Config) (string, func(), error) {
+	if err := CheckAllowedRegistry(libraryConfig.BaseURL, imageRef, buildtypes.AllowedRegistries(nil)); err != nil {
+		return "", nil, err
+	}
+
 	c, err := libClient.NewClient(libraryConfig)
 	if err != nil {
-		return "", fmt.Errorf("unable to initialize client library: %v", err)
+		return "", nil, fmt.Errorf("unable to initialize client library: %v", err)
 	}
 
 	ref := fmt.Sprintf("%s:%s", imageRef.Path, imageRef.Tags[0])
@@ -42,9 +63,9 @@ func pull(ctx context.Context, imgCache *cache.Handle, directTo string, imageRef
 	libraryImage, err := c.GetImage(ctx, arch, ref)
 	if err != nil {
 		if errors.Is(err, libClient.ErrNotFound) {
-			return "", fmt.Errorf("image does not exist in the library: %s (%s)", ref, arch)
+			return "", nil, fmt.Errorf("image does not exist in the library: %s (%s)", ref, arch)
 		}
-		return "", err
+		return "", nil, err
 	}
 
 	var progressBar libClient.ProgressBar
@@ -55,36 +76,40 @@ func pull(ctx context.Context, imgCache *cache.Handle, directTo string, imageRef
 	if directTo != "" {
 		// Download direct to file
 		if err := downloadWrapper(ctx, c, directTo, arch, imageRef, progressBar); err != nil {
-			return "", fmt.Errorf("unable to download image: %v", err)
+			return "", nil, fmt.Errorf("unable to download image: %v", err)
 		}
-		return directTo, nil
+		return directTo, func() {}, nil
 	}
 
 	cacheEntry, err := imgCache.GetEntry(cache.LibraryCacheType, libraryImage.Hash)
 	if err != nil {
-		return "", fmt.Errorf("unable to check if %v exists in cache: %v", libraryImage.Hash, err)
+		return "", nil, fmt.Errorf("unable to check if %v exists in cache: %v", libraryImage.Hash, err)
 	}
 	defer cacheEntry.CleanTmp()
 
 	if !cacheEntry.Exists {
 		if err := downloadWrapper(ctx, c, cacheEntry.TmpPath, arch, imageRef, progressBar); err != nil {
-			return "", fmt.Errorf("unable to download image: %v", err)
+			return "", nil, fmt.Errorf("unable to download image: %v", err)
 		}
 
 		if cacheFileHash, err := libClient.ImageHash(cacheEntry.TmpPath); err != nil {
-			return "", fmt.Errorf("error getting image hash: %v", err)
+			return "", nil, fmt.Errorf("error getting image hash: %v", err)
 		} else if cacheFileHash != libraryImage.Hash {
-			return "", fmt.Errorf("cached file hash(%s) and expected hash(%s) does not match", cacheFileHash, libraryImage.Hash)
+			return "", nil, fmt.Errorf("cached file hash(%s) and expected hash(%s) does not match", cacheFileHash, libraryImage.Hash)
 		}
 
 		if err := cacheEntry.Finalize(); err != nil {
-			return "", err
+			return "", nil, err
 		}
 	} else {
 		sylog.Infof("Using cached image")
 	}
 
-	return cacheEntry.Path, nil
+	unlock, err := imgCache.Lock(cache.LibraryCacheType, libraryImage.Hash)
+	if err != nil {
+		return "", nil, err
+	}
+	return cacheEntry.Path, unlock, nil
 }
 
 // downloadWrapper calls DownloadImage() and outputs download summary if progressBar not specified.
@@ -119,7 +144,12 @@ func Pull(ctx context.Context, imgCache *cache.Handle, pullFrom *libClient.Ref,
 		sylog.Infof("Downloading library image to tmp cache: %s", directTo)
 	}
 
-	return pull(ctx, imgCache, directTo, pullFrom, arch, libraryConfig)
+	imagePath, unlock, err := pull(ctx, imgCache, directTo, pullFrom, arch, libraryConfig)
+	if err != nil {
+		return "", err
+	}
+	unlock()
+	return imagePath, nil
 }
 
 // PullToFile will pull a library image to the specified location, through the cache, or directly if cache is disabled
@@ -130,7 +160,7 @@ func PullToFile(ctx context.Context, imgCache *cache.Handle, pullTo string, pull
 		sylog.Debugf("Cache disabled, pulling directly to: %s", directTo)
 	}
 
-	src, err := pull(ctx, imgCache, directTo, pullFrom, arch, libraryConfig)
+	src, unlock, err := pull(ctx, imgCache, directTo, pullFrom, arch, libraryConfig)
 	if err != nil {
 		return "", fmt.Errorf("error fetching image: %v", err)
 	}
@@ -138,6 +168,7 @@ func PullToFile(ctx context.Context, imgCache *cache.Handle, pullTo string, pull
 	if directTo == "" {
 		// mode is before umask if pullTo doesn't exist
 		err = fs.CopyFileAtomic(src, pullTo, 0o777)
+		unlock()
 		if err != nil {
 			return "", fmt.Errorf("error copying image out of cache: %v", err)
 		}
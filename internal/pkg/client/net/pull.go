@@ -113,7 +113,8 @@ func DownloadImage(ctx context.Context, filePath string, netURL string) error {
 }
 
 // pull will pull a http(s) image into the cache if directTo="", or a specific file if directTo is set.
-func pull(ctx context.Context, imgCache *cache.Handle, directTo, pullFrom string) (imagePath string, err error) {
+// The cache entry is locked against Prune until the returned function is called.
+func pull(ctx context.Context, imgCache *cache.Handle, directTo, pullFrom string) (imagePath string, unlock func(), err error) {
 	// We will cache using a sha256 over the URL and the date of the file that
 	// is to be fetched, as returned by an HTTP HEAD call and the Last-Modified
 	// header. If no date is available, use the current date-time, which will
@@ -143,14 +144,15 @@ func pull(ctx context.Context, imgCache *cache.Handle, directTo, pullFrom string
 	if directTo != "" {
 		sylog.Infof("Downloading network image")
 		if err := DownloadImage(ctx, directTo, pullFrom); err != nil {
-			return "", fmt.Errorf("unable to Download Image: %v", err)
+			return "", nil, fmt.Errorf("unable to Download Image: %v", err)
 		}
 		imagePath = directTo
+		unlock = func() {}
 
 	} else {
 		cacheEntry, err := imgCache.GetEntry(cache.NetCacheType, hash)
 		if err != nil {
-			return "", fmt.Errorf("unable to check if %v exists in cache: %v", hash, err)
+			return "", nil, fmt.Errorf("unable to check if %v exists in cache: %v", hash, err)
 		}
 		defer cacheEntry.CleanTmp()
 
@@ -163,7 +165,7 @@ func pull(ctx context.Context, imgCache *cache.Handle, directTo, pullFrom string
 
 			err = cacheEntry.Finalize()
 			if err != nil {
-				return "", err
+				return "", nil, err
 			}
 
 		} else {
@@ -171,9 +173,12 @@ func pull(ctx context.Context, imgCache *cache.Handle, directTo, pullFrom string
 		}
 
 		imagePath = cacheEntry.Path
+		if unlock, err = imgCache.Lock(cache.NetCacheType, hash); err != nil {
+			return "", nil, err
+		}
 	}
 
-	return imagePath, nil
+	return imagePath, unlock, nil
 }
 
 // Pull will pull a http(s) image to the cache or direct to a temporary file if cache is disabled
@@ -189,7 +194,12 @@ func Pull(ctx context.Context, imgCache *cache.Handle, pullFrom string, tmpDir s
 		sylog.Infof("Downloading library image to tmp cache: %s", directTo)
 	}
 
-	return pull(ctx, imgCache, directTo, pullFrom)
+	imagePath, unlock, err := pull(ctx, imgCache, directTo, pullFrom)
+	if err != nil {
+		return "", err
+	}
+	unlock()
+	return imagePath, nil
 }
 
 // PullToFile will pull an http(s) image to the specified location, through the cache, or directly if cache is disabled
@@ -200,7 +210,7 @@ func PullToFile(ctx context.Context, imgCache *cache.Handle, pullTo, pullFrom, t
 		sylog.Debugf("Cache disabled, pulling directly to: %s", directTo)
 	}
 
-	src, err := pull(ctx, imgCache, directTo, pullFrom)
+	src, unlock, err := pull(ctx, imgCache, directTo, pullFrom)
 	if err != nil {
 		return "", fmt.Errorf("error fetching image to cache: %v", err)
 	}
@@ -208,6 +218,7 @@ func PullToFile(ctx context.Context, imgCache *cache.Handle, pullTo, pullFrom, t
 	if directTo == "" {
 		// mode is before umask if pullTo doesn't exist
 		err = fs.CopyFileAtomic(src, pullTo, 0o777)
+		unlock()
 		if err != nil {
 			return "", fmt.Errorf("error copying image out of cache: %v", err)
 		}
@@ -0,0 +1,529 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package notary implements the verification of Docker Content Trust
+// signatures, by resolving image tags through the TUF trust data served by a
+// notary server. The root of trust of each image is pinned in a trust store
+// on first use, and follows the root rotations signed by the pinned root.
+// The versions of the metadata verified are recorded in the trust store, so
+// that older metadata is rejected afterwards. Only the top level targets
+// role and its targets/releases delegation, used by docker to sign tags, are
+// supported.
+package notary
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DockerHubServer is the notary server holding the trust data of Docker Hub
+// images.
+const DockerHubServer = "https://notary.docker.io"
+
+// releasesRole is the delegated role used by docker to sign tags.
+const releasesRole = "targets/releases"
+
+// maxMetadataSize limits the size of the trust metadata files.
+const maxMetadataSize = 10 << 20
+
+// maxRootRotations limits the number of root versions walked in a single
+// update of the pinned root.
+const maxRootRotations = 1024
+
+// ErrNoTrustData is returned when no signed trust data exists for an image
+// or one of its tags.
+var ErrNoTrustData = errors.New("no signed trust data")
+
+// ErrRollback is returned when the server returns metadata older than the
+// version previously verified.
+var ErrRollback = errors.New("trust data rollback")
+
+// Config holds the configuration used to verify content trust signatures.
+type Config struct {
+	// Server is the base URL of the notary server.
+	Server string
+	// TrustDir is the local trust store, holding the pinned root metadata
+	// of each image under tuf/<gun>/metadata/root.json, and the other
+	// metadata last verified next to it. Without a trust store, the trust
+	// data is verified against the root served by the server, and the
+	// rollbacks to older metadata aren't detected.
+	TrustDir string
+	// Username and Password are used to obtain a token from the server
+	// authentication service, anonymous tokens are requested when empty.
+	Username string
+	Password string
+	// HTTPClient is the client used to reach the server, the default
+	// client is used when nil.
+	HTTPClient *http.Client
+}
+
+// DefaultServer returns the notary server holding the trust data of the
+// images of the registry hosting named, as docker does.
+func DefaultServer(named reference.Named) string {
+	if reference.Domain(named) == "docker.io" {
+		return DockerHubServer
+	}
+	return "https://" + reference.Domain(named)
+}
+
+// DefaultTrustDir returns the docker trust store location.
+func DefaultTrustDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "trust")
+}
+
+// ResolveTag returns the digest of the manifest signed for tag in the trust
+// data of the image gun (e.g. docker.io/library/alpine). The root metadata
+// is pinned in the trust store on first use, and must sign the trust data,
+// or the next root version, on subsequent uses. The metadata older than the
+// one verified on previous uses is rejected with ErrRollback.
+func ResolveTag(ctx context.Context, cfg Config, gun, tag string) (digest.Digest, error) {
+	c := &client{cfg: cfg, gun: gun}
+	if c.cfg.HTTPClient == nil {
+		c.cfg.HTTPClient = http.DefaultClient
+	}
+
+	root, err := c.loadRoot(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var ts timestampMeta
+	if err := c.fetchRole(ctx, "timestamp", root.Keys, root.Roles["timestamp"], nil, &ts); err != nil {
+		return "", err
+	}
+	var snap snapshotMeta
+	if err := c.fetchRole(ctx, "snapshot", root.Keys, root.Roles["snapshot"], ts.Meta, &snap); err != nil {
+		return "", err
+	}
+	var targets targetsMeta
+	if err := c.fetchRole(ctx, "targets", root.Keys, root.Roles["targets"], snap.Meta, &targets); err != nil {
+		return "", err
+	}
+
+	// docker signs tags in the releases delegation, which takes precedence
+	// over the top level targets
+	for _, r := range targets.Delegations.Roles {
+		if r.Name != releasesRole {
+			continue
+		}
+		var releases targetsMeta
+		if err := c.fetchRole(ctx, releasesRole, targets.Delegations.Keys, r.role, snap.Meta, &releases); err != nil {
+			return "", err
+		}
+		if t, ok := releases.Targets[tag]; ok {
+			return t.digest()
+		}
+	}
+	if t, ok := targets.Targets[tag]; ok {
+		return t.digest()
+	}
+
+	return "", fmt.Errorf("%w for %s:%s", ErrNoTrustData, gun, tag)
+}
+
+type client struct {
+	cfg   Config
+	gun   string
+	token string
+}
+
+// metadataPath returns the path of the metadata of the role name in the
+// trust store, or an empty path without a trust store.
+func (c *client) metadataPath(name string) string {
+	if c.cfg.TrustDir == "" {
+		return ""
+	}
+	return filepath.Join(c.cfg.TrustDir, "tuf", filepath.FromSlash(c.gun), "metadata", filepath.FromSlash(name)+".json")
+}
+
+// store records the verified metadata data of the role name in the trust
+// store.
+func (c *client) store(name string, data []byte) error {
+	path := c.metadataPath(name)
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("while creating trust store: %w", err)
+	}
+	// the metadata is written to a temporary file renamed over the stored
+	// one, so that a concurrent read, or an interrupted write, never sees
+	// truncated metadata
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("while storing %s metadata: %w", name, err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("while storing %s metadata: %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("while storing %s metadata: %w", name, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("while storing %s metadata: %w", name, err)
+	}
+	return nil
+}
+
+// storedVersion returns the version of the metadata of the role name last
+// verified, or 0 if there is none. The metadata was verified when stored.
+func (c *client) storedVersion(name string) (int, error) {
+	path := c.metadataPath(name)
+	if path == "" {
+		return 0, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("while reading stored %s metadata: %w", name, err)
+	}
+	var s signedMeta
+	var common commonMeta
+	if err := json.Unmarshal(data, &s); err != nil {
+		return 0, fmt.Errorf("while decoding stored %s metadata: %w", name, err)
+	}
+	if err := json.Unmarshal(s.Signed, &common); err != nil {
+		return 0, fmt.Errorf("while decoding stored %s metadata: %w", name, err)
+	}
+	return common.Version, nil
+}
+
+// loadRoot returns the root metadata of the image. The root metadata served
+// by the server is pinned on first use, and must afterwards be signed by
+// the pinned root or be reached from it by a chain of root versions each
+// signed by the previous one, as the root keys are rotated.
+func (c *client) loadRoot(ctx context.Context) (*rootMeta, error) {
+	var pinned *rootMeta
+	if path := c.metadataPath("root"); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			// the pinned root may have expired since, only the current
+			// root has to be valid
+			if pinned, _, err = decodeRoot(data); err != nil {
+				return nil, fmt.Errorf("pinned %w", err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("while reading pinned root metadata: %w", err)
+		}
+	}
+
+	data, err := c.fetch(ctx, "root")
+	if err != nil {
+		return nil, err
+	}
+	root, s, err := decodeRoot(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if pinned != nil {
+		if root.Version < pinned.Version {
+			return nil, fmt.Errorf("%w: root metadata version %d is older than the pinned version %d", ErrRollback, root.Version, pinned.Version)
+		}
+		if root.Version-pinned.Version > maxRootRotations {
+			return nil, fmt.Errorf("root metadata version %d is too far from the pinned version %d", root.Version, pinned.Version)
+		}
+		// each root version is signed by the previous one
+		prev := pinned
+		for v := pinned.Version + 1; v < root.Version; v++ {
+			name := fmt.Sprintf("%d.root", v)
+			d, err := c.fetch(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			next, ns, err := decodeRoot(d)
+			if err != nil {
+				return nil, err
+			}
+			if next.Version != v {
+				return nil, fmt.Errorf("%s metadata has version %d", name, next.Version)
+			}
+			if err := ns.verifySignatures(name, prev.Keys, prev.Roles["root"]); err != nil {
+				return nil, err
+			}
+			prev = next
+		}
+		if err := s.verifySignatures("root", prev.Keys, prev.Roles["root"]); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.verify("root", root.Type, root.Expires, root.Keys, root.Roles["root"]); err != nil {
+		return nil, err
+	}
+
+	if pinned == nil || root.Version != pinned.Version {
+		if err := c.store("root", data); err != nil {
+			return nil, err
+		}
+	}
+	return root, nil
+}
+
+// decodeRoot decodes the root metadata data, and checks it is signed by its
+// own root role keys, whether it expired or not.
+func decodeRoot(data []byte) (*rootMeta, *signedMeta, error) {
+	var s signedMeta
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, nil, fmt.Errorf("while decoding root metadata: %w", err)
+	}
+	var root rootMeta
+	if err := json.Unmarshal(s.Signed, &root); err != nil {
+		return nil, nil, fmt.Errorf("while decoding root metadata: %w", err)
+	}
+	if !strings.EqualFold(root.Type, "root") {
+		return nil, nil, fmt.Errorf("root metadata has unexpected type %q", root.Type)
+	}
+	if err := s.verifySignatures("root", root.Keys, root.Roles["root"]); err != nil {
+		return nil, nil, err
+	}
+	return &root, &s, nil
+}
+
+// fetchRole fetches the metadata of the role name, checks it against its
+// hashes recorded in the signed meta of the parent role (none for the
+// timestamp role), and verifies it is signed by the role keys, and not older
+// than the version last verified, before decoding it into v. The metadata
+// verified is stored in the trust store.
+func (c *client) fetchRole(ctx context.Context, name string, keys map[string]publicKey, r role, meta map[string]*fileMeta, v interface{}) error {
+	data, err := c.fetch(ctx, name)
+	if err != nil {
+		return err
+	}
+	if name != "timestamp" {
+		m, ok := meta[name]
+		if !ok || m == nil {
+			return fmt.Errorf("%s metadata is not listed in the signed metadata", name)
+		}
+		if err := m.check(data); err != nil {
+			return fmt.Errorf("%s metadata: %w", name, err)
+		}
+	}
+
+	var s signedMeta
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("while decoding %s metadata: %w", name, err)
+	}
+	var common commonMeta
+	if err := json.Unmarshal(s.Signed, &common); err != nil {
+		return fmt.Errorf("while decoding %s metadata: %w", name, err)
+	}
+	if err := s.verify(name, common.Type, common.Expires, keys, r); err != nil {
+		return err
+	}
+	stored, err := c.storedVersion(name)
+	if err != nil {
+		return err
+	}
+	if common.Version < stored {
+		return fmt.Errorf("%w: %s metadata version %d is older than the verified version %d", ErrRollback, name, common.Version, stored)
+	}
+	if err := json.Unmarshal(s.Signed, v); err != nil {
+		return fmt.Errorf("while decoding %s metadata: %w", name, err)
+	}
+	return c.store(name, data)
+}
+
+// fetch returns the metadata of the role name from the server.
+func (c *client) fetch(ctx context.Context, name string) ([]byte, error) {
+	url := strings.TrimSuffix(c.cfg.Server, "/") + "/v2/" + c.gun + "/_trust/tuf/" + name + ".json"
+
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("while fetching %s metadata: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized && c.token == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if c.token, err = c.authenticate(ctx, challenge); err != nil {
+			return nil, fmt.Errorf("while authenticating to %s: %w", c.cfg.Server, err)
+		}
+		if resp, err = c.get(ctx, url); err != nil {
+			return nil, fmt.Errorf("while fetching %s metadata: %w", name, err)
+		}
+		defer resp.Body.Close()
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%w for %s (%s metadata not found)", ErrNoTrustData, c.gun, name)
+	default:
+		return nil, fmt.Errorf("while fetching %s metadata: unexpected status %s", name, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxMetadataSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s metadata: %w", name, err)
+	}
+	if len(data) > maxMetadataSize {
+		return nil, fmt.Errorf("%s metadata exceeds %d bytes", name, maxMetadataSize)
+	}
+	return data, nil
+}
+
+func (c *client) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.cfg.HTTPClient.Do(req)
+}
+
+// authenticate obtains a token from the authentication service described
+// by the bearer challenge.
+func (c *client) authenticate(ctx context.Context, challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "bearer") {
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	p := make(map[string]string)
+	for _, kv := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		p[k] = strings.Trim(v, `"`)
+	}
+	if p["realm"] == "" {
+		return "", fmt.Errorf("no realm in authentication challenge %q", challenge)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p["realm"], nil)
+	if err != nil {
+		return "", err
+	}
+	q := req.URL.Query()
+	for _, k := range []string{"service", "scope"} {
+		if p[k] != "" {
+			q.Set(k, p[k])
+		}
+	}
+	req.URL.RawQuery = q.Encode()
+	if c.cfg.Username != "" {
+		req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+	}
+
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxMetadataSize)).Decode(&tok); err != nil {
+		return "", fmt.Errorf("while decoding token: %w", err)
+	}
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+	if tok.Token == "" {
+		return "", errors.New("no token returned")
+	}
+	return tok.Token, nil
+}
+
+// role lists the keys allowed to sign a role metadata, and how many of them
+// must sign it.
+type role struct {
+	KeyIDs    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+// commonMeta holds the fields common to the metadata of all the roles.
+type commonMeta struct {
+	Type    string    `json:"_type"`
+	Expires time.Time `json:"expires"`
+	Version int       `json:"version"`
+}
+
+type rootMeta struct {
+	Type    string               `json:"_type"`
+	Expires time.Time            `json:"expires"`
+	Version int                  `json:"version"`
+	Keys    map[string]publicKey `json:"keys"`
+	Roles   map[string]role      `json:"roles"`
+}
+
+// fileMeta describes the expected length and hashes of a metadata file or
+// of a target.
+type fileMeta struct {
+	Length int64             `json:"length"`
+	Hashes map[string][]byte `json:"hashes"`
+}
+
+// check verifies that data matches the length and sha256 hash of m.
+func (m *fileMeta) check(data []byte) error {
+	if m.Length != 0 && int64(len(data)) != m.Length {
+		return fmt.Errorf("length %d doesn't match the signed length %d", len(data), m.Length)
+	}
+	h, ok := m.Hashes["sha256"]
+	if !ok {
+		return errors.New("no signed sha256 hash")
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], h) {
+		return errors.New("sha256 hash doesn't match the signed hash")
+	}
+	return nil
+}
+
+// digest returns the digest of the manifest of a target.
+func (m fileMeta) digest() (digest.Digest, error) {
+	h, ok := m.Hashes["sha256"]
+	if !ok || len(h) != sha256.Size {
+		return "", errors.New("no signed sha256 hash for the target")
+	}
+	return digest.NewDigestFromEncoded(digest.SHA256, hex.EncodeToString(h)), nil
+}
+
+type timestampMeta struct {
+	Meta map[string]*fileMeta `json:"meta"`
+}
+
+type snapshotMeta struct {
+	Meta map[string]*fileMeta `json:"meta"`
+}
+
+type targetsMeta struct {
+	Targets     map[string]fileMeta `json:"targets"`
+	Delegations struct {
+		Keys  map[string]publicKey `json:"keys"`
+		Roles []struct {
+			Name string `json:"name"`
+			role
+		} `json:"roles"`
+	} `json:"delegations"`
+}
@@ -0,0 +1,217 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package notary
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	testNotary "github.com/apptainer/apptainer/internal/pkg/test/tool/notary"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const testGUN = "registry.example.com/test/image"
+
+var testManifest = []byte(`{"schemaVersion":2}`)
+
+func TestResolveTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		delegate bool
+		gun      string
+		tag      string
+		tamper   string
+		wantErr  bool
+		noTrust  bool
+	}{
+		{name: "Signed", gun: testGUN, tag: "v1"},
+		{name: "SignedReleases", delegate: true, gun: testGUN, tag: "v1"},
+		{name: "UnsignedTag", gun: testGUN, tag: "v2", wantErr: true, noTrust: true},
+		{name: "UnsignedReleasesTag", delegate: true, gun: testGUN, tag: "v2", wantErr: true, noTrust: true},
+		{name: "UnknownImage", gun: "registry.example.com/other", tag: "v1", wantErr: true, noTrust: true},
+		{name: "TamperedTargets", gun: testGUN, tag: "v1", tamper: "targets", wantErr: true},
+		{name: "TamperedTimestamp", gun: testGUN, tag: "v1", tamper: "timestamp", wantErr: true},
+		{name: "TamperedReleases", delegate: true, gun: testGUN, tag: "v1", tamper: "targets/releases", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := testNotary.NewServer(t)
+			srv.Delegate = tt.delegate
+			srv.Sign(testGUN, "v1", testManifest)
+			if tt.tamper != "" {
+				data := bytes.Replace(srv.Metadata(testGUN, tt.tamper), []byte(`"version":1`), []byte(`"version":2`), 1)
+				srv.SetMetadata(testGUN, tt.tamper, data)
+			}
+
+			cfg := Config{Server: srv.URL, TrustDir: t.TempDir()}
+			d, err := ResolveTag(context.Background(), cfg, tt.gun, tt.tag)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("unexpected success, resolved %s", d)
+				}
+				if got := errors.Is(err, ErrNoTrustData); got != tt.noTrust {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if want := digest.FromBytes(testManifest); d != want {
+				t.Errorf("resolved %s, expected %s", d, want)
+			}
+		})
+	}
+}
+
+func TestResolveTagPinnedRoot(t *testing.T) {
+	trustDir := t.TempDir()
+
+	srv := testNotary.NewServer(t)
+	srv.Sign(testGUN, "v1", testManifest)
+	cfg := Config{Server: srv.URL, TrustDir: trustDir}
+	if _, err := ResolveTag(context.Background(), cfg, testGUN, "v1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pinned, err := os.ReadFile(filepath.Join(trustDir, "tuf", testGUN, "metadata", "root.json"))
+	if err != nil {
+		t.Fatalf("root metadata not pinned: %s", err)
+	}
+	if !bytes.Equal(pinned, srv.Metadata(testGUN, "root")) {
+		t.Errorf("pinned root metadata differs from the served one")
+	}
+	// the metadata is renamed from temporary files, none is left
+	entries, err := os.ReadDir(filepath.Join(trustDir, "tuf", testGUN, "metadata"))
+	if err != nil {
+		t.Fatalf("while reading the trust store: %s", err)
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			t.Errorf("unexpected file %s left in the trust store", e.Name())
+		}
+	}
+
+	// trust data signed with other keys must be rejected once the root is
+	// pinned
+	other := testNotary.NewServer(t)
+	other.Sign(testGUN, "v1", testManifest)
+	cfg.Server = other.URL
+	if d, err := ResolveTag(context.Background(), cfg, testGUN, "v1"); err == nil {
+		t.Errorf("unexpected success with another root, resolved %s", d)
+	}
+}
+
+func TestResolveTagRootRotation(t *testing.T) {
+	trustDir := t.TempDir()
+	rootPath := filepath.Join(trustDir, "tuf", testGUN, "metadata", "root.json")
+
+	srv := testNotary.NewServer(t)
+	srv.Sign(testGUN, "v1", testManifest)
+	cfg := Config{Server: srv.URL, TrustDir: trustDir}
+	if _, err := ResolveTag(context.Background(), cfg, testGUN, "v1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the pinned root follows the root versions each signed by the
+	// previous one
+	srv.RotateRoot()
+	srv.RotateRoot()
+	if _, err := ResolveTag(context.Background(), cfg, testGUN, "v1"); err != nil {
+		t.Fatalf("unexpected error after root rotations: %s", err)
+	}
+	pinned, err := os.ReadFile(rootPath)
+	if err != nil {
+		t.Fatalf("root metadata not pinned: %s", err)
+	}
+	if !bytes.Equal(pinned, srv.Metadata(testGUN, "root")) {
+		t.Errorf("pinned root metadata is not the rotated one")
+	}
+
+	// a rotation not signed by the pinned root is rejected
+	other := testNotary.NewServer(t)
+	other.Sign(testGUN, "v1", testManifest)
+	for i := 0; i < 3; i++ {
+		other.RotateRoot()
+	}
+	cfg.Server = other.URL
+	if d, err := ResolveTag(context.Background(), cfg, testGUN, "v1"); err == nil {
+		t.Errorf("unexpected success with a rotation of another root, resolved %s", d)
+	}
+
+	// as is an older root once pinned
+	restore := srv.Metadata(testGUN, "1.root")
+	srv.SetMetadata(testGUN, "root", restore)
+	cfg.Server = srv.URL
+	if _, err := ResolveTag(context.Background(), cfg, testGUN, "v1"); !errors.Is(err, ErrRollback) {
+		t.Errorf("unexpected error with an older root: %v", err)
+	}
+}
+
+func TestResolveTagRollback(t *testing.T) {
+	// replaying a role replays the older metadata it lists too, so that the
+	// served trust data stays consistent
+	replays := []struct {
+		role  string
+		roles []string
+	}{
+		{"timestamp", []string{"timestamp", "snapshot", "targets", "targets/releases"}},
+		{"snapshot", []string{"snapshot", "targets", "targets/releases"}},
+		{"targets", []string{"targets"}},
+		{"targets/releases", []string{"targets/releases"}},
+	}
+	for _, tt := range replays {
+		role := tt.role
+		roles := tt.roles
+		t.Run(role, func(t *testing.T) {
+			srv := testNotary.NewServer(t)
+			srv.Delegate = true
+			srv.Sign(testGUN, "v1", testManifest)
+			old := make(map[string][]byte)
+			for _, r := range roles {
+				old[r] = srv.Metadata(testGUN, r)
+			}
+
+			cfg := Config{Server: srv.URL, TrustDir: t.TempDir()}
+			srv.Sign(testGUN, "v2", testManifest)
+			if _, err := ResolveTag(context.Background(), cfg, testGUN, "v2"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			stored, err := os.ReadFile(filepath.Join(cfg.TrustDir, "tuf", testGUN, "metadata", filepath.FromSlash(role)+".json"))
+			if err != nil {
+				t.Fatalf("%s metadata not stored: %s", role, err)
+			}
+			if !bytes.Equal(stored, srv.Metadata(testGUN, role)) {
+				t.Errorf("stored %s metadata differs from the served one", role)
+			}
+
+			// the older metadata, signed and listed by the parent role, is
+			// rejected once a newer version was verified
+			for r, data := range old {
+				srv.SetMetadata(testGUN, r, data)
+			}
+			srv.Republish(testGUN, role)
+			if d, err := ResolveTag(context.Background(), cfg, testGUN, "v1"); !errors.Is(err, ErrRollback) {
+				t.Errorf("unexpected result %s with older %s metadata: %v", d, role, err)
+			}
+
+			// without a trust store the rollback isn't detected
+			cfg.TrustDir = ""
+			if _, err := ResolveTag(context.Background(), cfg, testGUN, "v1"); err != nil {
+				t.Errorf("unexpected error without a trust store: %s", err)
+			}
+		})
+	}
+}
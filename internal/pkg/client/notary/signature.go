@@ -0,0 +1,182 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package notary
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// signedMeta is a TUF metadata file, its signed content and the signatures
+// of its canonical JSON form.
+type signedMeta struct {
+	Signed     json.RawMessage `json:"signed"`
+	Signatures []struct {
+		KeyID  string `json:"keyid"`
+		Method string `json:"method"`
+		Sig    []byte `json:"sig"`
+	} `json:"signatures"`
+}
+
+// publicKey is a TUF public key.
+type publicKey struct {
+	Type  string `json:"keytype"`
+	Value struct {
+		Public []byte `json:"public"`
+	} `json:"keyval"`
+}
+
+// verify checks that the metadata of the role name, declaring typ and
+// expires, is current and signed by at least the threshold of keys of r.
+func (s *signedMeta) verify(name, typ string, expires time.Time, keys map[string]publicKey, r role) error {
+	// delegated roles are targets roles
+	wantType := name
+	if i := strings.Index(name, "/"); i > 0 {
+		wantType = name[:i]
+	}
+	if !strings.EqualFold(typ, wantType) {
+		return fmt.Errorf("%s metadata has unexpected type %q", name, typ)
+	}
+	if time.Now().After(expires) {
+		return fmt.Errorf("%s metadata expired on %s", name, expires.Format(time.RFC3339))
+	}
+	return s.verifySignatures(name, keys, r)
+}
+
+// verifySignatures checks that the metadata of the role name is signed by
+// at least the threshold of keys of r.
+func (s *signedMeta) verifySignatures(name string, keys map[string]publicKey, r role) error {
+	if r.Threshold < 1 {
+		return fmt.Errorf("invalid signature threshold %d for %s metadata", r.Threshold, name)
+	}
+
+	msg, err := canonicalJSON(s.Signed)
+	if err != nil {
+		return fmt.Errorf("while encoding %s metadata: %w", name, err)
+	}
+
+	allowed := make(map[string]bool, len(r.KeyIDs))
+	for _, id := range r.KeyIDs {
+		allowed[id] = true
+	}
+
+	valid := make(map[string]bool)
+	for _, sig := range s.Signatures {
+		k, ok := keys[sig.KeyID]
+		if !ok || !allowed[sig.KeyID] || valid[sig.KeyID] {
+			continue
+		}
+		if err := k.verify(sig.Method, msg, sig.Sig); err != nil {
+			continue
+		}
+		valid[sig.KeyID] = true
+	}
+	if len(valid) < r.Threshold {
+		return fmt.Errorf("%s metadata has %d valid signatures, %d required", name, len(valid), r.Threshold)
+	}
+	return nil
+}
+
+// verify checks the signature sig of msg made with method.
+func (k publicKey) verify(method string, msg, sig []byte) error {
+	pub, err := k.parse()
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(msg)
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if method != "ecdsa" {
+			break
+		}
+		// signatures are the concatenation of r and s
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid ecdsa signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return errors.New("invalid ecdsa signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		switch method {
+		case "rsapss":
+			return rsa.VerifyPSS(pub, crypto.SHA256, hash[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		case "rsapkcs1v15":
+			return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig)
+		}
+	case ed25519.PublicKey:
+		if method != "ed25519" {
+			break
+		}
+		if !ed25519.Verify(pub, msg, sig) {
+			return errors.New("invalid ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported signature method %s for %s key", method, k.Type)
+}
+
+// parse returns the crypto public key of k.
+func (k publicKey) parse() (crypto.PublicKey, error) {
+	switch k.Type {
+	case "ecdsa", "rsa":
+		return x509.ParsePKIXPublicKey(k.Value.Public)
+	case "ecdsa-x509", "rsa-x509":
+		block, _ := pem.Decode(k.Value.Public)
+		if block == nil {
+			return nil, errors.New("invalid certificate")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "ed25519":
+		if len(k.Value.Public) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(k.Value.Public), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Type)
+}
+
+// canonicalJSON returns the canonical form of a JSON document, with sorted
+// keys and no insignificant whitespace, as signed by notary.
+func canonicalJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -19,12 +19,14 @@ import (
 
 	"github.com/apptainer/apptainer/internal/pkg/build"
 	"github.com/apptainer/apptainer/internal/pkg/build/oci"
+	"github.com/apptainer/apptainer/internal/pkg/build/sources"
 	"github.com/apptainer/apptainer/internal/pkg/cache"
 	"github.com/apptainer/apptainer/internal/pkg/util/fs"
 	buildtypes "github.com/apptainer/apptainer/pkg/build/types"
 	"github.com/apptainer/apptainer/pkg/syfs"
 	"github.com/apptainer/apptainer/pkg/sylog"
 	useragent "github.com/apptainer/apptainer/pkg/util/user-agent"
+	"github.com/containers/image/v5/docker/reference"
 	ocitypes "github.com/containers/image/v5/types"
 )
 
@@ -35,10 +37,51 @@ type PullOptions struct {
 	NoHTTPS    bool
 	NoCleanUp  bool
 	Pullarch   string
+	// DefaultRegistry resolves the docker:// images not naming their
+	// registry, e.g. quay.io resolves docker://ubuntu to quay.io/ubuntu.
+	DefaultRegistry string
+}
+
+// defaultRegistryReference returns pullFrom resolved from the default
+// registry, if any, when it is a docker:// image not naming its registry.
+func defaultRegistryReference(pullFrom, registry string) (string, error) {
+	if registry == "" || !strings.HasPrefix(pullFrom, "docker:") {
+		return pullFrom, nil
+	}
+	ref, err := sources.DefaultRegistryReference(strings.TrimPrefix(pullFrom, "docker:"), registry)
+	if err != nil {
+		return "", err
+	}
+	return "docker:" + ref, nil
+}
+
+// checkAllowedRegistry checks that the registry of a docker:// image
+// pullFrom is allowed by the configuration, before any request is sent to
+// it. The images of the other transports aren't pulled from a registry.
+func checkAllowedRegistry(pullFrom string) error {
+	patterns := buildtypes.AllowedRegistries(nil)
+	if len(patterns) == 0 || !strings.HasPrefix(pullFrom, "docker://") {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(pullFrom, "docker://"))
+	if err != nil {
+		return err
+	}
+	return buildtypes.CheckRegistryAllowed(patterns, reference.Domain(named), reference.FamiliarString(named))
 }
 
 // pull will build a SIF image into the cache if directTo="", or a specific file if directTo is set.
 func pull(ctx context.Context, imgCache *cache.Handle, directTo, pullFrom string, opts PullOptions) (imagePath string, err error) {
+	// the image is resolved before any check or request, the cached and
+	// built image being the resolved one
+	pullFrom, err = defaultRegistryReference(pullFrom, opts.DefaultRegistry)
+	if err != nil {
+		return "", err
+	}
+	if err := checkAllowedRegistry(pullFrom); err != nil {
+		return "", err
+	}
+
 	// DockerInsecureSkipTLSVerify is set only if --no-https is specified to honor
 	// configuration from /etc/containers/registries.conf because DockerInsecureSkipTLSVerify
 	// can have three possible values true/false and undefined, so we left it as undefined instead
@@ -125,6 +168,9 @@ func convertOciToSIF(ctx context.Context, imgCache *cache.Handle, image, cachedI
 				DockerDaemonHost: opts.DockerHost,
 				ImgCache:         imgCache,
 				Arch:             opts.Pullarch,
+				// the floating latest tag is a reproducibility concern
+				// of the builds, not of the pulled images
+				LatestTag: buildtypes.LatestTagIgnore,
 			},
 		},
 	)
@@ -0,0 +1,65 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package oci
+
+import (
+	"testing"
+)
+
+func TestDefaultRegistryReference(t *testing.T) {
+	tests := []struct {
+		name     string
+		pullFrom string
+		registry string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "no default registry",
+			pullFrom: "docker://ubuntu",
+			want:     "docker://ubuntu",
+		},
+		{
+			name:     "short name",
+			pullFrom: "docker://ubuntu:22.04",
+			registry: "registry.site.example.com:5000/hub",
+			want:     "docker://registry.site.example.com:5000/hub/ubuntu:22.04",
+		},
+		{
+			name:     "named registry",
+			pullFrom: "docker://quay.io/centos/centos:stream9",
+			registry: "registry.site.example.com",
+			want:     "docker://quay.io/centos/centos:stream9",
+		},
+		{
+			name:     "other transport",
+			pullFrom: "oci-archive:ubuntu.tar",
+			registry: "registry.site.example.com",
+			want:     "oci-archive:ubuntu.tar",
+		},
+		{
+			name:     "invalid registry",
+			pullFrom: "docker://ubuntu",
+			registry: "hub",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := defaultRegistryReference(tt.pullFrom, tt.registry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("unexpected reference: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
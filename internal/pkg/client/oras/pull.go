@@ -13,57 +13,77 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/apptainer/apptainer/internal/pkg/cache"
 	"github.com/apptainer/apptainer/internal/pkg/util/fs"
+	buildtypes "github.com/apptainer/apptainer/pkg/build/types"
 	"github.com/apptainer/apptainer/pkg/sylog"
 	ocitypes "github.com/containers/image/v5/types"
 )
 
+// CheckAllowedRegistry checks that the registry of the oras image ref, e.g.
+// oras://ghcr.io/org/image:tag, matches one of the allowed registry
+// patterns, before any request is sent to it.
+func CheckAllowedRegistry(ref string, patterns []string) error {
+	name := strings.TrimPrefix(strings.TrimPrefix(ref, "oras:"), "//")
+	host := strings.SplitN(name, "/", 2)[0]
+	return buildtypes.CheckRegistryAllowed(patterns, host, name)
+}
+
 // pull will pull an oras image into the cache if directTo="", or a specific file if directTo is set.
-func pull(ctx context.Context, imgCache *cache.Handle, directTo, pullFrom string, ociAuth *ocitypes.DockerAuthConfig, noHTTPS bool) (imagePath string, err error) {
+// The cache entry is locked against Prune until the returned function is called.
+func pull(ctx context.Context, imgCache *cache.Handle, directTo, pullFrom string, ociAuth *ocitypes.DockerAuthConfig, noHTTPS bool) (imagePath string, unlock func(), err error) {
+	if err := CheckAllowedRegistry(pullFrom, buildtypes.AllowedRegistries(nil)); err != nil {
+		return "", nil, err
+	}
+
 	hash, err := ImageSHA(ctx, pullFrom, ociAuth, noHTTPS)
 	if err != nil {
-		return "", fmt.Errorf("failed to get checksum for %s: %s", pullFrom, err)
+		return "", nil, fmt.Errorf("failed to get checksum for %s: %s", pullFrom, err)
 	}
 
 	if directTo != "" {
 		sylog.Infof("Downloading oras image")
 		if err := DownloadImage(ctx, directTo, pullFrom, ociAuth, noHTTPS); err != nil {
-			return "", fmt.Errorf("unable to Download Image: %v", err)
+			return "", nil, fmt.Errorf("unable to Download Image: %v", err)
 		}
 		imagePath = directTo
+		unlock = func() {}
 
 	} else {
 		cacheEntry, err := imgCache.GetEntry(cache.OrasCacheType, hash)
 		if err != nil {
-			return "", fmt.Errorf("unable to check if %v exists in cache: %v", hash, err)
+			return "", nil, fmt.Errorf("unable to check if %v exists in cache: %v", hash, err)
 		}
 		defer cacheEntry.CleanTmp()
 		if !cacheEntry.Exists {
 			sylog.Infof("Downloading oras image")
 
 			if err := DownloadImage(ctx, cacheEntry.TmpPath, pullFrom, ociAuth, noHTTPS); err != nil {
-				return "", fmt.Errorf("unable to Download Image: %v", err)
+				return "", nil, fmt.Errorf("unable to Download Image: %v", err)
 			}
 			if cacheFileHash, err := ImageHash(cacheEntry.TmpPath); err != nil {
-				return "", fmt.Errorf("error getting ImageHash: %v", err)
+				return "", nil, fmt.Errorf("error getting ImageHash: %v", err)
 			} else if cacheFileHash != hash {
-				return "", fmt.Errorf("cached file hash(%s) and expected hash(%s) does not match", cacheFileHash, hash)
+				return "", nil, fmt.Errorf("cached file hash(%s) and expected hash(%s) does not match", cacheFileHash, hash)
 			}
 
 			err = cacheEntry.Finalize()
 			if err != nil {
-				return "", err
+				return "", nil, err
 			}
 
 		} else {
 			sylog.Infof("Using cached SIF image")
 		}
 		imagePath = cacheEntry.Path
+		if unlock, err = imgCache.Lock(cache.OrasCacheType, hash); err != nil {
+			return "", nil, err
+		}
 	}
 
-	return imagePath, nil
+	return imagePath, unlock, nil
 }
 
 // Pull will pull an oras image to the cache or direct to a temporary file if cache is disabled
@@ -79,7 +99,12 @@ func Pull(ctx context.Context, imgCache *cache.Handle, pullFrom, tmpDir string,
 		sylog.Infof("Downloading oras image to tmp cache: %s", directTo)
 	}
 
-	return pull(ctx, imgCache, directTo, pullFrom, ociAuth, noHTTPS)
+	imagePath, unlock, err := pull(ctx, imgCache, directTo, pullFrom, ociAuth, noHTTPS)
+	if err != nil {
+		return "", err
+	}
+	unlock()
+	return imagePath, nil
 }
 
 // PullToFile will pull an oras image to the specified location, through the cache, or directly if cache is disabled
@@ -90,7 +115,7 @@ func PullToFile(ctx context.Context, imgCache *cache.Handle, pullTo, pullFrom, t
 		sylog.Debugf("Cache disabled, pulling directly to: %s", directTo)
 	}
 
-	src, err := pull(ctx, imgCache, directTo, pullFrom, ociAuth, noHTTPS)
+	src, unlock, err := pull(ctx, imgCache, directTo, pullFrom, ociAuth, noHTTPS)
 	if err != nil {
 		return "", fmt.Errorf("error fetching image to cache: %v", err)
 	}
@@ -98,6 +123,7 @@ func PullToFile(ctx context.Context, imgCache *cache.Handle, pullTo, pullFrom, t
 	if directTo == "" {
 		// mode is before umask if pullTo doesn't exist
 		err = fs.CopyFileAtomic(src, pullTo, 0o777)
+		unlock()
 		if err != nil {
 			return "", fmt.Errorf("error copying image out of cache: %v", err)
 		}
@@ -31,6 +31,9 @@ const (
 	SubUIDFile = "/etc/subuid"
 	// SubGIDFile is the default path to the subgid file.
 	SubGIDFile = "/etc/subgid"
+	// BuildEnv is set in the environment of the builds run with --fakeroot,
+	// in a fakeroot user namespace or with the fakeroot command.
+	BuildEnv = "_APPTAINER_FAKEROOT_BUILD"
 	// validRangeCount is the valid fakeroot range count.
 	validRangeCount = uint32(65536)
 	// StartMax is the maximum possible range start.
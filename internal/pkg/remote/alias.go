@@ -0,0 +1,82 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/apptainer/apptainer/pkg/sylog"
+)
+
+// ErrAliasCollision indicates a remote alias which is the name of a remote,
+// or an alias of another one.
+var ErrAliasCollision = errors.New("remote alias collision")
+
+// ResolveName returns the name of the remote named, or aliased, name, and
+// whether there is one.
+func (c *Config) ResolveName(name string) (string, bool) {
+	if _, ok := c.Remotes[name]; ok {
+		return name, true
+	}
+	return c.ResolveAlias(name)
+}
+
+// ResolveAlias returns the name of the remote aliased alias, and whether
+// there is one. The names of the remotes aren't resolved.
+func (c *Config) ResolveAlias(alias string) (string, bool) {
+	for n, r := range c.Remotes {
+		for _, a := range r.Aliases {
+			if a == alias {
+				return n, true
+			}
+		}
+	}
+	return "", false
+}
+
+// CheckAliases returns an error, wrapping ErrAliasCollision for the
+// collisions, if an alias of a remote is empty, is the name of a remote, or
+// is set more than once.
+func (c *Config) CheckAliases() error {
+	owners := make(map[string]string)
+	for _, n := range sortedRemoteNames(c.Remotes) {
+		for _, a := range c.Remotes[n].Aliases {
+			if strings.TrimSpace(a) == "" {
+				return fmt.Errorf("remote %s has an empty alias", n)
+			}
+			if _, ok := c.Remotes[a]; ok {
+				return fmt.Errorf("%w: alias %s of remote %s is a remote", ErrAliasCollision, a, n)
+			}
+			if owner, ok := owners[a]; ok && owner == n {
+				return fmt.Errorf("%w: alias %s is set twice for remote %s", ErrAliasCollision, a, n)
+			} else if ok {
+				return fmt.Errorf("%w: alias %s is set for remotes %s and %s", ErrAliasCollision, a, owner, n)
+			}
+			owners[a] = n
+		}
+	}
+	return nil
+}
+
+// syncAliases returns the aliases of the global remote name which don't
+// name another remote of c, or alias it. The user remotes take precedence
+// over the aliases of the global ones.
+func (c *Config) syncAliases(name string, aliases []string) []string {
+	var synced []string
+	for _, a := range aliases {
+		if owner, ok := c.ResolveName(a); ok && owner != name {
+			sylog.Infof("%s defined both as an alias of global remote %s and individually, using individual", a, name)
+			continue
+		}
+		synced = append(synced, a)
+	}
+	return synced
+}
@@ -0,0 +1,266 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package remote
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/remote/endpoint"
+)
+
+func newAliasConfig() *Config {
+	return &Config{
+		Remotes: map[string]*endpoint.Config{
+			"cloud": {URI: "cloud.apptainer.org", Aliases: []string{"c", "main"}},
+			"lab":   {URI: "lab.example.com"},
+		},
+	}
+}
+
+func TestResolveName(t *testing.T) {
+	c := newAliasConfig()
+
+	for name, want := range map[string]string{"cloud": "cloud", "c": "cloud", "main": "cloud", "lab": "lab"} {
+		if got, ok := c.ResolveName(name); !ok || got != want {
+			t.Errorf("ResolveName(%q) = %q, %v, want %q", name, got, ok, want)
+		}
+	}
+	if got, ok := c.ResolveName("other"); ok {
+		t.Errorf("unexpected resolution of an unknown name to %q", got)
+	}
+
+	// the names of the remotes aren't aliases
+	for alias, want := range map[string]string{"c": "cloud", "main": "cloud"} {
+		if got, ok := c.ResolveAlias(alias); !ok || got != want {
+			t.Errorf("ResolveAlias(%q) = %q, %v, want %q", alias, got, ok, want)
+		}
+	}
+	for _, name := range []string{"cloud", "lab", "other"} {
+		if got, ok := c.ResolveAlias(name); ok {
+			t.Errorf("unexpected resolution of %s as an alias of %q", name, got)
+		}
+	}
+
+	e, err := c.GetRemote("main")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if e != c.Remotes["cloud"] {
+		t.Errorf("unexpected remote %v for alias main", e)
+	}
+
+	// the name of the remote is stored, not the alias
+	if err := c.SetDefault("c", false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c.DefaultRemote != "cloud" {
+		t.Errorf("unexpected default remote %q", c.DefaultRemote)
+	}
+
+	if err := c.Rename("c", "sylabs"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, ok := c.ResolveName("main"); !ok || got != "sylabs" || c.DefaultRemote != "sylabs" {
+		t.Errorf("unexpected resolution %q, %v of the alias of a renamed remote", got, ok)
+	}
+
+	if err := c.Remove("main"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := c.Remotes["sylabs"]; ok {
+		t.Errorf("remote not removed through its alias")
+	}
+}
+
+func TestCheckAliases(t *testing.T) {
+	tests := []struct {
+		name      string
+		remotes   map[string]*endpoint.Config
+		collision bool
+		wantErr   bool
+	}{
+		{
+			name: "no collision",
+			remotes: map[string]*endpoint.Config{
+				"cloud": {Aliases: []string{"c"}},
+				"lab":   {Aliases: []string{"l"}},
+			},
+		},
+		{
+			name: "alias of a remote name",
+			remotes: map[string]*endpoint.Config{
+				"cloud": {Aliases: []string{"lab"}},
+				"lab":   {},
+			},
+			collision: true,
+			wantErr:   true,
+		},
+		{
+			name: "alias of its own name",
+			remotes: map[string]*endpoint.Config{
+				"cloud": {Aliases: []string{"cloud"}},
+			},
+			collision: true,
+			wantErr:   true,
+		},
+		{
+			name: "alias of two remotes",
+			remotes: map[string]*endpoint.Config{
+				"cloud": {Aliases: []string{"main"}},
+				"lab":   {Aliases: []string{"main"}},
+			},
+			collision: true,
+			wantErr:   true,
+		},
+		{
+			name: "alias set twice",
+			remotes: map[string]*endpoint.Config{
+				"cloud": {Aliases: []string{"c", "c"}},
+			},
+			collision: true,
+			wantErr:   true,
+		},
+		{
+			name: "empty alias",
+			remotes: map[string]*endpoint.Config{
+				"cloud": {Aliases: []string{" "}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&Config{Remotes: tt.remotes}).CheckAliases()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if errors.Is(err, ErrAliasCollision) != tt.collision {
+				t.Errorf("unexpected collision error: %v", err)
+			}
+		})
+	}
+}
+
+func TestAliasCollisions(t *testing.T) {
+	c := newAliasConfig()
+
+	if err := c.Add("main", &endpoint.Config{URI: "other.example.com"}); !errors.Is(err, ErrAliasCollision) {
+		t.Errorf("unexpected error adding a remote named as an alias: %v", err)
+	}
+	if err := c.Add("other", &endpoint.Config{URI: "other.example.com", Aliases: []string{"c"}}); !errors.Is(err, ErrAliasCollision) {
+		t.Errorf("unexpected error adding a remote with a colliding alias: %v", err)
+	}
+	if err := c.Add("other", &endpoint.Config{URI: "other.example.com", Aliases: []string{"lab"}}); !errors.Is(err, ErrAliasCollision) {
+		t.Errorf("unexpected error adding a remote aliased as a remote: %v", err)
+	}
+	if _, ok := c.Remotes["other"]; ok {
+		t.Errorf("remote with colliding aliases added")
+	}
+	if err := c.Rename("lab", "c"); !errors.Is(err, ErrAliasCollision) {
+		t.Errorf("unexpected error renaming a remote as an alias: %v", err)
+	}
+
+	yaml := `Remotes:
+  cloud:
+    URI: cloud.apptainer.org
+    Aliases: [lab]
+  lab:
+    URI: lab.example.com
+`
+	if _, err := ReadFrom(strings.NewReader(yaml)); !errors.Is(err, ErrAliasCollision) {
+		t.Errorf("unexpected error reading colliding aliases: %v", err)
+	}
+
+	base := &Config{Remotes: map[string]*endpoint.Config{"cloud": {URI: "cloud.apptainer.org", Aliases: []string{"main"}}}}
+	overlay := &Config{Remotes: map[string]*endpoint.Config{"lab": {URI: "lab.example.com", Aliases: []string{"main"}}}}
+	if _, _, err := MergeRemoteConfigs(base, overlay, MergePreferOverlay); !errors.Is(err, ErrAliasCollision) {
+		t.Errorf("unexpected error merging colliding aliases: %v", err)
+	}
+}
+
+func TestSyncFromAliases(t *testing.T) {
+	sys := &Config{
+		Remotes: map[string]*endpoint.Config{
+			"cloud": {URI: "cloud.apptainer.org", System: true, Aliases: []string{"c", "lab"}},
+			"main":  {URI: "main.example.com", System: true},
+		},
+	}
+	usr := &Config{
+		Remotes: map[string]*endpoint.Config{
+			"lab":  {URI: "lab.example.com"},
+			"site": {URI: "site.example.com", Aliases: []string{"main"}},
+		},
+	}
+
+	if err := usr.SyncFrom(sys); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the user remotes and their aliases take precedence over the global
+	// remotes and theirs
+	if _, ok := usr.Remotes["main"]; ok {
+		t.Errorf("global remote named as a user alias synced")
+	}
+	if got := usr.Remotes["cloud"].Aliases; !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("unexpected aliases %v of the global remote", got)
+	}
+	if err := usr.CheckAliases(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// the aliases of the global remotes follow the system configuration
+	sys.Remotes["cloud"].Aliases = []string{"cl"}
+	if err := usr.SyncFrom(sys); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := usr.Remotes["cloud"].Aliases; !reflect.DeepEqual(got, []string{"cl"}) {
+		t.Errorf("unexpected aliases %v of the global remote", got)
+	}
+}
+
+func TestSyncFromCachedAliases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "remote.yaml")
+	data := `Remotes:
+  cloud:
+    URI: cloud.apptainer.org
+    System: true
+    Aliases: [c, lab]
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("while writing config: %s", err)
+	}
+	cc := NewConfigCache(time.Minute)
+
+	sync := func() *Config {
+		t.Helper()
+		sys, err := cc.Read(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		usr := &Config{Remotes: map[string]*endpoint.Config{"lab": {URI: "lab.example.com"}}}
+		if err := usr.SyncFrom(sys); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// the aliases synced are modified, not the ones of the cached config
+		usr.Remotes["cloud"].Aliases = append(usr.Remotes["cloud"].Aliases, "main")
+		sys.Remotes["cloud"].Aliases[0] = "modified"
+		return usr
+	}
+
+	for i := 0; i < 2; i++ {
+		if got := sync().Remotes["cloud"].Aliases; !reflect.DeepEqual(got, []string{"c", "main"}) {
+			t.Errorf("sync %d: unexpected aliases %v of the global remote", i, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package remote
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/remote/credential"
+	"github.com/apptainer/apptainer/internal/pkg/remote/endpoint"
+)
+
+// DefaultConfigCacheTTL is the time a ConfigCache keeps the configs read
+// when created with a zero TTL.
+const DefaultConfigCacheTTL = 5 * time.Second
+
+// ConfigCache caches the remote configs read from files, for the long-lived
+// processes reading them repeatedly, e.g. to list the remotes. A config is
+// read again once its TTL has elapsed, or as soon as the modification time
+// or size of its file changes. It is safe for concurrent use.
+type ConfigCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cachedConfig
+	// now returns the current time, time.Now when nil
+	now func() time.Time
+}
+
+// cachedConfig is a config read by a ConfigCache.
+type cachedConfig struct {
+	config  *Config
+	readAt  time.Time
+	modTime time.Time
+	size    int64
+}
+
+// NewConfigCache returns a cache keeping the configs read for ttl,
+// DefaultConfigCacheTTL when zero.
+func NewConfigCache(ttl time.Duration) *ConfigCache {
+	if ttl == 0 {
+		ttl = DefaultConfigCacheTTL
+	}
+	return &ConfigCache{
+		ttl:     ttl,
+		entries: make(map[string]*cachedConfig),
+	}
+}
+
+// Read returns the config of the file at path, as ReadFrom, from the cache
+// if the file didn't change since it was read. The config returned is a
+// copy the caller may modify. The errors of a missing file match
+// os.ErrNotExist.
+func (cc *ConfigCache) Read(path string) (*Config, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	now := time.Now
+	if cc.now != nil {
+		now = cc.now
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		delete(cc.entries, path)
+		return nil, fmt.Errorf("while reading remote config file: %w", err)
+	}
+	e, ok := cc.entries[path]
+	if ok && now().Sub(e.readAt) < cc.ttl && e.modTime.Equal(fi.ModTime()) && e.size == fi.Size() {
+		return e.config.clone(), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		delete(cc.entries, path)
+		return nil, fmt.Errorf("while opening remote config file: %w", err)
+	}
+	defer f.Close()
+	// the file info of the content read, in case it changed since
+	if fi, err = f.Stat(); err != nil {
+		return nil, fmt.Errorf("while reading remote config file: %w", err)
+	}
+	c, err := ReadFrom(f)
+	if err != nil {
+		delete(cc.entries, path)
+		return nil, fmt.Errorf("while parsing remote config data: %w", err)
+	}
+	cc.entries[path] = &cachedConfig{
+		config:  c,
+		readAt:  now(),
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+	}
+	return c.clone(), nil
+}
+
+// clone returns a deep copy of c, for the configs as read by ReadFrom.
+func (c *Config) clone() *Config {
+	n := &Config{
+		DefaultRemote: c.DefaultRemote,
+		Remotes:       make(map[string]*endpoint.Config, len(c.Remotes)),
+		system:        c.system,
+	}
+	for name, r := range c.Remotes {
+		n.Remotes[name] = r.Copy()
+	}
+	if c.Credentials != nil {
+		n.Credentials = make([]*credential.Config, len(c.Credentials))
+		for i, cred := range c.Credentials {
+			cr := *cred
+			n.Credentials[i] = &cr
+		}
+	}
+	return n
+}
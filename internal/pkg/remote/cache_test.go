@@ -0,0 +1,181 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/remote/endpoint"
+)
+
+// writeCacheConfig writes a config whose active remote is active to path,
+// with the modification time mtime.
+func writeCacheConfig(t *testing.T, path, active string, mtime time.Time) {
+	t.Helper()
+
+	data := fmt.Sprintf("Active: %s\nRemotes:\n  %s:\n    URI: %s.example.com\n", active, active, active)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("while writing config: %s", err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("while setting config times: %s", err)
+	}
+}
+
+func TestConfigCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "remote.yaml")
+	mtime := time.Now().Add(-time.Hour)
+	writeCacheConfig(t, path, "first", mtime)
+
+	now := time.Now()
+	cc := NewConfigCache(time.Minute)
+	cc.now = func() time.Time { return now }
+
+	read := func(want string) *Config {
+		t.Helper()
+		c, err := cc.Read(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if c.DefaultRemote != want {
+			t.Errorf("unexpected active remote %q, want %q", c.DefaultRemote, want)
+		}
+		return c
+	}
+
+	c := read("first")
+	// the config returned is a copy
+	c.DefaultRemote = "modified"
+	c.Remotes["first"].URI = "modified.example.com"
+
+	// the cached config is returned while the file info is unchanged
+	writeCacheConfig(t, path, "other", mtime)
+	c = read("first")
+	if uri := c.Remotes["first"].URI; uri != "first.example.com" {
+		t.Errorf("unexpected cached URI %q", uri)
+	}
+
+	// a new modification time invalidates the cache
+	mtime = mtime.Add(time.Second)
+	writeCacheConfig(t, path, "second", mtime)
+	read("second")
+
+	// the cache expires after its TTL, the file size being unchanged
+	writeCacheConfig(t, path, "latest", mtime)
+	read("second")
+	now = now.Add(time.Minute)
+	read("latest")
+
+	// a missing file isn't cached
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("while removing config: %s", err)
+	}
+	if _, err := cc.Read(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	writeCacheConfig(t, path, "fourth", mtime)
+	read("fourth")
+}
+
+func TestConfigCacheCopy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "remote.yaml")
+	data := `Active: cloud
+Remotes:
+  cloud:
+    URI: cloud.example.com
+    Keyservers:
+    - URI: https://keys.example.com
+Credentials:
+- URI: docker://registry.example.com
+  Auth: Basic secret
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("while writing config: %s", err)
+	}
+
+	cc := NewConfigCache(time.Minute)
+	read := func() *Config {
+		t.Helper()
+		c, err := cc.Read(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return c
+	}
+
+	c := read()
+	want := read()
+	r, err := c.GetRemote("cloud")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	r.Keyservers[0].URI = "https://modified.example.com"
+	r.Keyservers = append(r.Keyservers, &endpoint.ServiceConfig{URI: "https://other.example.com"})
+	c.Credentials[0].Auth = "Basic modified"
+	if err := c.Remove("cloud"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := c.Add("other", &endpoint.Config{URI: "other.example.com"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the next read is unchanged by the modifications of the copy
+	if got := read(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected cached config after modifying a copy:\n\thave: %+v\n\twant: %+v", got, want)
+	}
+}
+
+func TestConfigCacheConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "remote.yaml")
+	mtime := time.Now().Add(-time.Hour)
+	writeCacheConfig(t, path, "initial", mtime)
+
+	cc := NewConfigCache(time.Millisecond)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c, err := cc.Read(path)
+				if err != nil {
+					errs <- err
+					return
+				}
+				// the copies returned are modified independently
+				c.DefaultRemote = ""
+				for _, r := range c.Remotes {
+					r.URI = ""
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	c, err := cc.Read(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c.DefaultRemote != "initial" || c.Remotes["initial"].URI != "initial.example.com" {
+		t.Errorf("unexpected config after concurrent reads: %+v", c)
+	}
+}
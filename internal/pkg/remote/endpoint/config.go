@@ -41,12 +41,48 @@ type Config struct {
 	Exclusive  bool             `yaml:"Exclusive"`          // true if the endpoint must be used exclusively
 	Insecure   bool             `yaml:"Insecure,omitempty"` // Allow use of http for service discovery
 	Keyservers []*ServiceConfig `yaml:"Keyservers,omitempty"`
+	// DefaultPullRegistry is the registry, with an optional port and
+	// repository prefix, the docker sources not naming their registry
+	// (e.g. docker://ubuntu) are resolved from while the remote is active.
+	DefaultPullRegistry string `yaml:"DefaultPullRegistry,omitempty"`
+	// Aliases are other names of the remote, resolved as its name, e.g. by
+	// remote use or in the library://alias/... URIs. They can't be the name,
+	// or an alias, of another remote.
+	Aliases []string `yaml:"Aliases,omitempty"`
 
 	// for internal purpose
 	credentials []*credential.Config
 	services    map[string][]Service
 }
 
+// Copy returns a deep copy of the settings of config. The credentials and
+// services of config, which aren't read from the configuration file, aren't
+// copied: they are set again by the remote configuration and retrieved again
+// by the copy when used.
+func (config *Config) Copy() *Config {
+	n := &Config{
+		URI:                 config.URI,
+		Token:               config.Token,
+		System:              config.System,
+		Exclusive:           config.Exclusive,
+		Insecure:            config.Insecure,
+		DefaultPullRegistry: config.DefaultPullRegistry,
+		Aliases:             append([]string(nil), config.Aliases...),
+	}
+	if config.Keyservers != nil {
+		n.Keyservers = make([]*ServiceConfig, len(config.Keyservers))
+		for i, k := range config.Keyservers {
+			n.Keyservers[i] = &ServiceConfig{
+				URI:      k.URI,
+				Skip:     k.Skip,
+				External: k.External,
+				Insecure: k.Insecure,
+			}
+		}
+	}
+	return n
+}
+
 func (config *Config) SetCredentials(creds []*credential.Config) {
 	config.credentials = creds
 }
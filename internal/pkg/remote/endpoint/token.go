@@ -11,8 +11,13 @@
 package endpoint
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/apptainer/apptainer/internal/pkg/remote/credential"
 	"github.com/apptainer/apptainer/pkg/sylog"
@@ -74,3 +79,37 @@ func (config *Config) VerifyToken(token string) (err error) {
 
 	return nil
 }
+
+// ErrOpaqueToken indicates that a token does not carry any expiry
+// information that can be decoded locally.
+var ErrOpaqueToken = errors.New("token has no decodable expiry")
+
+// TokenExpiry returns the expiry time carried by the "exp" claim of a JWT
+// token. The signature is not verified, this is only meant to give a hint
+// to the user about stored credentials. ErrOpaqueToken is returned for
+// tokens which are not JWTs or which don't have an "exp" claim.
+func TokenExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, ErrOpaqueToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, ErrOpaqueToken
+	}
+
+	claims := struct {
+		Exp *json.Number `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == nil {
+		return time.Time{}, ErrOpaqueToken
+	}
+
+	exp, err := claims.Exp.Float64()
+	if err != nil {
+		return time.Time{}, ErrOpaqueToken
+	}
+
+	return time.Unix(int64(exp), 0), nil
+}
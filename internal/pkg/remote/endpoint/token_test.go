@@ -0,0 +1,73 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package endpoint
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func makeTestToken(claims string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+	return header + "." + payload + ".c2lnbmF0dXJl"
+}
+
+func TestTokenExpiry(t *testing.T) {
+	future := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	past := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name    string
+		token   string
+		want    time.Time
+		wantErr error
+	}{
+		{
+			name:  "future expiry",
+			token: makeTestToken(fmt.Sprintf(`{"sub":"1234","exp":%d}`, future.Unix())),
+			want:  future,
+		},
+		{
+			name:  "past expiry",
+			token: makeTestToken(fmt.Sprintf(`{"sub":"1234","exp":%d}`, past.Unix())),
+			want:  past,
+		},
+		{
+			name:    "no exp claim",
+			token:   makeTestToken(`{"sub":"1234"}`),
+			wantErr: ErrOpaqueToken,
+		},
+		{
+			name:    "opaque token",
+			token:   "0123456789abcdef",
+			wantErr: ErrOpaqueToken,
+		},
+		{
+			name:    "invalid payload",
+			token:   "a.!!!.c",
+			wantErr: ErrOpaqueToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exp, err := TokenExpiry(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("unexpected error: got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !exp.Equal(tt.want) {
+				t.Errorf("unexpected expiry: got %s, want %s", exp, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package remote
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/apptainer/apptainer/internal/pkg/remote/credential"
+	"github.com/apptainer/apptainer/internal/pkg/remote/endpoint"
+)
+
+// MergeStrategy selects the setting kept by MergeRemoteConfigs when the two
+// remote configurations it merges conflict.
+type MergeStrategy int
+
+const (
+	// MergePreferBase keeps the setting of the base configuration.
+	MergePreferBase MergeStrategy = iota
+	// MergePreferOverlay keeps the setting of the overlay configuration.
+	MergePreferOverlay
+	// MergeError fails the merge on the first conflict.
+	MergeError
+)
+
+// Kinds of the settings of a MergeConflict.
+const (
+	// MergeConflictRemote is a remote defined differently by both configurations.
+	MergeConflictRemote = "remote"
+	// MergeConflictCredential is a credential stored differently by both
+	// configurations.
+	MergeConflictCredential = "credential"
+	// MergeConflictActive is an active remote set differently by both
+	// configurations.
+	MergeConflictActive = "active"
+)
+
+// MergeConflict is a conflict between the settings of two remote
+// configurations resolved by MergeRemoteConfigs.
+type MergeConflict struct {
+	// Kind is the kind of the conflicting setting, MergeConflictRemote,
+	// MergeConflictCredential or MergeConflictActive.
+	Kind string
+	// Name is the name of the remote, the URI of the credential, or the
+	// name of the active remote kept.
+	Name string
+	// Overlay is true when the setting of the overlay configuration was
+	// kept, false for the base one.
+	Overlay bool
+}
+
+// String returns a description of c.
+func (c MergeConflict) String() string {
+	kept := "base"
+	if c.Overlay {
+		kept = "overlay"
+	}
+	if c.Kind == MergeConflictActive {
+		return fmt.Sprintf("active remote: using %s from the %s configuration", c.Name, kept)
+	}
+	return fmt.Sprintf("%s %s: using the %s configuration", c.Kind, c.Name, kept)
+}
+
+// MergeRemoteConfigs returns the configuration holding the remotes and
+// credentials of base and overlay, e.g. to layer a site configuration over
+// a user one. A remote or credential defined differently by both, or an
+// active remote set by both to different remotes, is resolved by strategy
+// and returned as a conflict, unless strategy is MergeError which fails the
+// merge. An active remote set by only one of them is kept. An exclusive
+// remote is always the active remote of the merged configuration, and the
+// remote aliases colliding in it fail the merge. The
+// returned configuration doesn't share its remotes and credentials with base
+// and overlay, which are not modified.
+func MergeRemoteConfigs(base, overlay *Config, strategy MergeStrategy) (*Config, []MergeConflict, error) {
+	switch strategy {
+	case MergePreferBase, MergePreferOverlay, MergeError:
+	default:
+		return nil, nil, fmt.Errorf("unknown merge strategy %d", strategy)
+	}
+
+	var conflicts []MergeConflict
+	// resolve returns whether the overlay setting is kept for a conflict
+	resolve := func(kind, name string) (bool, error) {
+		if strategy == MergeError {
+			return false, fmt.Errorf("%s %s conflicts between the configurations", kind, name)
+		}
+		conflicts = append(conflicts, MergeConflict{Kind: kind, Name: name, Overlay: strategy == MergePreferOverlay})
+		return strategy == MergePreferOverlay, nil
+	}
+
+	merged := &Config{
+		DefaultRemote: base.DefaultRemote,
+		Remotes:       make(map[string]*endpoint.Config, len(base.Remotes)+len(overlay.Remotes)),
+		system:        base.system,
+	}
+	for name, e := range base.Remotes {
+		merged.Remotes[name] = e.Copy()
+	}
+	for _, name := range sortedRemoteNames(overlay.Remotes) {
+		e := overlay.Remotes[name]
+		if b, ok := merged.Remotes[name]; ok && !sameEndpoint(b, e) {
+			keep, err := resolve(MergeConflictRemote, name)
+			if err != nil {
+				return nil, nil, err
+			} else if !keep {
+				continue
+			}
+		}
+		merged.Remotes[name] = e.Copy()
+	}
+
+	for _, c := range base.Credentials {
+		cc := *c
+		merged.Credentials = append(merged.Credentials, &cc)
+	}
+	for _, c := range overlay.Credentials {
+		cc := *c
+		i := credentialIndex(merged.Credentials, c.URI)
+		if i < 0 {
+			merged.Credentials = append(merged.Credentials, &cc)
+			continue
+		} else if *merged.Credentials[i] == cc {
+			continue
+		}
+		keep, err := resolve(MergeConflictCredential, c.URI)
+		if err != nil {
+			return nil, nil, err
+		} else if keep {
+			merged.Credentials[i] = &cc
+		}
+	}
+
+	switch {
+	case overlay.DefaultRemote == "" || overlay.DefaultRemote == base.DefaultRemote:
+	case base.DefaultRemote == "":
+		merged.DefaultRemote = overlay.DefaultRemote
+	default:
+		if strategy == MergePreferOverlay {
+			merged.DefaultRemote = overlay.DefaultRemote
+		}
+		if _, err := resolve(MergeConflictActive, merged.DefaultRemote); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var exclusive []string
+	for _, name := range sortedRemoteNames(merged.Remotes) {
+		if merged.Remotes[name].Exclusive {
+			exclusive = append(exclusive, name)
+		}
+	}
+	if len(exclusive) > 1 {
+		return nil, nil, fmt.Errorf("remotes %s are all exclusive", strings.Join(exclusive, ", "))
+	} else if len(exclusive) == 1 {
+		merged.DefaultRemote = exclusive[0]
+	}
+	if merged.DefaultRemote != "" {
+		if _, ok := merged.Remotes[merged.DefaultRemote]; !ok {
+			return nil, nil, fmt.Errorf("active remote %s is not a remote", merged.DefaultRemote)
+		}
+	}
+	if err := merged.CheckAliases(); err != nil {
+		return nil, nil, err
+	}
+
+	return merged, conflicts, nil
+}
+
+// sameEndpoint returns whether a and b have the same settings.
+func sameEndpoint(a, b *endpoint.Config) bool {
+	return reflect.DeepEqual(a.Copy(), b.Copy())
+}
+
+// sortedRemoteNames returns the names of remotes in order.
+func sortedRemoteNames(remotes map[string]*endpoint.Config) []string {
+	names := make([]string, 0, len(remotes))
+	for name := range remotes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// credentialIndex returns the index of the credential of uri in creds, -1
+// if there is none.
+func credentialIndex(creds []*credential.Config, uri string) int {
+	for i, c := range creds {
+		if c.URI == uri {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,216 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package remote
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/remote/credential"
+	"github.com/apptainer/apptainer/internal/pkg/remote/endpoint"
+)
+
+func TestMergeRemoteConfigs(t *testing.T) {
+	site := Config{
+		DefaultRemote: "site",
+		Remotes: map[string]*endpoint.Config{
+			"site":   {URI: "cloud.site.example", System: true},
+			"shared": {URI: "cloud.shared.example", System: true},
+		},
+		Credentials: []*credential.Config{
+			{URI: "docker://registry.site.example", Auth: "Basic site"},
+			{URI: "docker://registry.shared.example", Auth: "Basic site"},
+		},
+	}
+	user := Config{
+		DefaultRemote: "user",
+		Remotes: map[string]*endpoint.Config{
+			"user":   {URI: "cloud.user.example", Token: "token"},
+			"shared": {URI: "cloud.shared.example", Token: "token"},
+		},
+		Credentials: []*credential.Config{
+			{URI: "docker://registry.shared.example", Auth: "Basic user"},
+			{URI: "docker://registry.user.example", Auth: "Basic user"},
+		},
+	}
+	bothRemotes := func(shared *endpoint.Config) map[string]*endpoint.Config {
+		return map[string]*endpoint.Config{
+			"site":   {URI: "cloud.site.example", System: true},
+			"user":   {URI: "cloud.user.example", Token: "token"},
+			"shared": shared,
+		}
+	}
+	bothCredentials := func(shared string) []*credential.Config {
+		return []*credential.Config{
+			{URI: "docker://registry.site.example", Auth: "Basic site"},
+			{URI: "docker://registry.shared.example", Auth: shared},
+			{URI: "docker://registry.user.example", Auth: "Basic user"},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		base          Config
+		overlay       Config
+		strategy      MergeStrategy
+		want          *Config
+		wantConflicts []MergeConflict
+		wantErr       string
+	}{
+		{
+			name:     "prefer base",
+			base:     site,
+			overlay:  user,
+			strategy: MergePreferBase,
+			want: &Config{
+				DefaultRemote: "site",
+				Remotes:       bothRemotes(&endpoint.Config{URI: "cloud.shared.example", System: true}),
+				Credentials:   bothCredentials("Basic site"),
+			},
+			wantConflicts: []MergeConflict{
+				{Kind: MergeConflictRemote, Name: "shared"},
+				{Kind: MergeConflictCredential, Name: "docker://registry.shared.example"},
+				{Kind: MergeConflictActive, Name: "site"},
+			},
+		},
+		{
+			name:     "prefer overlay",
+			base:     site,
+			overlay:  user,
+			strategy: MergePreferOverlay,
+			want: &Config{
+				DefaultRemote: "user",
+				Remotes:       bothRemotes(&endpoint.Config{URI: "cloud.shared.example", Token: "token"}),
+				Credentials:   bothCredentials("Basic user"),
+			},
+			wantConflicts: []MergeConflict{
+				{Kind: MergeConflictRemote, Name: "shared", Overlay: true},
+				{Kind: MergeConflictCredential, Name: "docker://registry.shared.example", Overlay: true},
+				{Kind: MergeConflictActive, Name: "user", Overlay: true},
+			},
+		},
+		{
+			name:     "error",
+			base:     site,
+			overlay:  user,
+			strategy: MergeError,
+			wantErr:  "remote shared conflicts",
+		},
+		{
+			name: "error without conflict",
+			base: site,
+			overlay: Config{
+				Remotes: map[string]*endpoint.Config{
+					"user":   {URI: "cloud.user.example", Token: "token"},
+					"shared": {URI: "cloud.shared.example", System: true},
+				},
+				Credentials: []*credential.Config{
+					{URI: "docker://registry.site.example", Auth: "Basic site"},
+				},
+			},
+			strategy: MergeError,
+			want: &Config{
+				DefaultRemote: "site",
+				Remotes:       bothRemotes(&endpoint.Config{URI: "cloud.shared.example", System: true}),
+				Credentials: []*credential.Config{
+					{URI: "docker://registry.site.example", Auth: "Basic site"},
+					{URI: "docker://registry.shared.example", Auth: "Basic site"},
+				},
+			},
+		},
+		{
+			name: "active remote of overlay only",
+			base: Config{
+				Remotes: map[string]*endpoint.Config{"site": {URI: "cloud.site.example"}},
+			},
+			overlay:  Config{DefaultRemote: "site"},
+			strategy: MergePreferBase,
+			want: &Config{
+				DefaultRemote: "site",
+				Remotes:       map[string]*endpoint.Config{"site": {URI: "cloud.site.example"}},
+			},
+		},
+		{
+			name: "exclusive remote stays active",
+			base: Config{
+				DefaultRemote: "site",
+				Remotes:       map[string]*endpoint.Config{"site": {URI: "cloud.site.example", System: true, Exclusive: true}},
+			},
+			overlay:  user,
+			strategy: MergePreferOverlay,
+			want: &Config{
+				DefaultRemote: "site",
+				Remotes: map[string]*endpoint.Config{
+					"site":   {URI: "cloud.site.example", System: true, Exclusive: true},
+					"user":   {URI: "cloud.user.example", Token: "token"},
+					"shared": {URI: "cloud.shared.example", Token: "token"},
+				},
+				Credentials: user.Credentials,
+			},
+			wantConflicts: []MergeConflict{
+				{Kind: MergeConflictActive, Name: "user", Overlay: true},
+			},
+		},
+		{
+			name: "several exclusive remotes",
+			base: Config{
+				Remotes: map[string]*endpoint.Config{"site": {URI: "cloud.site.example", Exclusive: true}},
+			},
+			overlay: Config{
+				Remotes: map[string]*endpoint.Config{"user": {URI: "cloud.user.example", Exclusive: true}},
+			},
+			strategy: MergePreferBase,
+			wantErr:  "remotes site, user are all exclusive",
+		},
+		{
+			name:     "missing active remote",
+			base:     Config{DefaultRemote: "site"},
+			strategy: MergePreferBase,
+			wantErr:  "active remote site is not a remote",
+		},
+		{
+			name:     "unknown strategy",
+			strategy: MergeStrategy(42),
+			wantErr:  "unknown merge strategy 42",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conflicts, err := MergeRemoteConfigs(&tt.base, &tt.overlay, tt.strategy)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bad merge:\n\thave: %+v\n\twant: %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(conflicts, tt.wantConflicts) {
+				t.Errorf("unexpected conflicts %v, want %v", conflicts, tt.wantConflicts)
+			}
+		})
+	}
+
+	// the merged configuration doesn't share the remotes of base
+	site.Remotes["site"].Keyservers = []*endpoint.ServiceConfig{{URI: "https://keys.site.example"}}
+	got, _, err := MergeRemoteConfigs(&site, &Config{}, MergePreferBase)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got.Remotes["site"].URI = "cloud.other.example"
+	got.Remotes["site"].Keyservers[0].URI = "https://keys.other.example"
+	got.Credentials[0].Auth = ""
+	if site.Remotes["site"].URI != "cloud.site.example" || site.Remotes["site"].Keyservers[0].URI != "https://keys.site.example" || site.Credentials[0].Auth != "Basic site" {
+		t.Errorf("base configuration modified by a change of the merged one")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package remote
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Kinds of the rules of a RemotePolicy broken by a PolicyViolation.
+const (
+	// PolicyViolationInsecure is a remote, or a keyserver of a remote,
+	// allowing the use of http.
+	PolicyViolationInsecure = "insecure"
+	// PolicyViolationActive is an active remote which isn't a system remote.
+	PolicyViolationActive = "active"
+	// PolicyViolationURI is a remote whose URI isn't approved.
+	PolicyViolationURI = "uri"
+)
+
+// RemotePolicy is the baseline the remote configurations are audited
+// against by ValidateRemoteConfigAgainstPolicy.
+type RemotePolicy struct {
+	// DenyInsecure rejects the remotes and the keyservers allowing the use
+	// of http.
+	DenyInsecure bool
+	// RequireSystemActive requires the active remote, when set, to be a
+	// remote of the system configuration.
+	RequireSystemActive bool
+	// ApprovedURIs, when set, are the patterns of the only URIs allowed for
+	// the remotes, compared case-insensitively with the wildcards of
+	// path.Match, e.g. *.example.com. The system remotes are checked too.
+	ApprovedURIs []string
+}
+
+// PolicyViolation is a rule of a RemotePolicy broken by a remote
+// configuration.
+type PolicyViolation struct {
+	// Kind is the kind of the rule, PolicyViolationInsecure,
+	// PolicyViolationActive or PolicyViolationURI.
+	Kind string
+	// Remote is the name of the remote breaking the rule.
+	Remote string
+	// Detail describes the setting breaking the rule.
+	Detail string
+}
+
+// String returns a description of v.
+func (v PolicyViolation) String() string {
+	return fmt.Sprintf("%s remote %s: %s", v.Kind, v.Remote, v.Detail)
+}
+
+// ValidateRemoteConfigAgainstPolicy returns the violations of the policy by
+// the remote configuration c, sorted by remote name, none when c complies
+// with it. It fails when the policy itself is invalid.
+func ValidateRemoteConfigAgainstPolicy(c *Config, policy RemotePolicy) ([]PolicyViolation, error) {
+	for _, p := range policy.ApprovedURIs {
+		if p == "" {
+			return nil, fmt.Errorf("invalid approved URI: empty pattern")
+		} else if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid approved URI %q: %s", p, err)
+		}
+	}
+
+	var violations []PolicyViolation
+	for _, name := range sortedRemoteNames(c.Remotes) {
+		e := c.Remotes[name]
+		if policy.DenyInsecure {
+			if e.Insecure {
+				violations = append(violations, PolicyViolation{Kind: PolicyViolationInsecure, Remote: name, Detail: "allows http for " + e.URI})
+			}
+			for _, ks := range e.Keyservers {
+				if ks.Insecure {
+					violations = append(violations, PolicyViolation{Kind: PolicyViolationInsecure, Remote: name, Detail: "allows http for keyserver " + ks.URI})
+				}
+			}
+		}
+		if len(policy.ApprovedURIs) > 0 && !approvedURI(policy.ApprovedURIs, e.URI) {
+			violations = append(violations, PolicyViolation{Kind: PolicyViolationURI, Remote: name, Detail: e.URI + " is not approved"})
+		}
+		if policy.RequireSystemActive && name == c.DefaultRemote && !e.System {
+			violations = append(violations, PolicyViolation{Kind: PolicyViolationActive, Remote: name, Detail: "the active remote is not a system remote"})
+		}
+	}
+	if _, ok := c.Remotes[c.DefaultRemote]; policy.RequireSystemActive && c.DefaultRemote != "" && !ok {
+		violations = append(violations, PolicyViolation{Kind: PolicyViolationActive, Remote: c.DefaultRemote, Detail: "the active remote is not defined"})
+	}
+	return violations, nil
+}
+
+// approvedURI reports whether uri matches one of patterns.
+func approvedURI(patterns []string, uri string) bool {
+	uri = strings.ToLower(strings.TrimSuffix(uri, "/"))
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), uri); ok {
+			return true
+		}
+	}
+	return false
+}
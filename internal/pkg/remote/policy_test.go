@@ -0,0 +1,115 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package remote
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/remote/endpoint"
+)
+
+func TestValidateRemoteConfigAgainstPolicy(t *testing.T) {
+	policy := RemotePolicy{
+		DenyInsecure:        true,
+		RequireSystemActive: true,
+		ApprovedURIs:        []string{"cloud.apptainer.org", "*.site.example"},
+	}
+
+	tests := []struct {
+		name    string
+		config  Config
+		policy  RemotePolicy
+		want    []PolicyViolation
+		wantErr bool
+	}{
+		{
+			name: "compliant",
+			config: Config{
+				DefaultRemote: "site",
+				Remotes: map[string]*endpoint.Config{
+					"site":    {URI: "cloud.site.example", System: true},
+					"default": {URI: "Cloud.Apptainer.org/", Keyservers: []*endpoint.ServiceConfig{{URI: "https://keys.site.example"}}},
+				},
+			},
+			policy: policy,
+		},
+		{
+			name: "no active remote",
+			config: Config{
+				Remotes: map[string]*endpoint.Config{
+					"user": {URI: "cloud.user.site.example"},
+				},
+			},
+			policy: policy,
+		},
+		{
+			name: "multiple violations",
+			config: Config{
+				DefaultRemote: "user",
+				Remotes: map[string]*endpoint.Config{
+					"site": {URI: "cloud.site.example", System: true, Keyservers: []*endpoint.ServiceConfig{{URI: "http://keys.site.example", Insecure: true}}},
+					"user": {URI: "cloud.user.example", Insecure: true},
+				},
+			},
+			policy: policy,
+			want: []PolicyViolation{
+				{Kind: PolicyViolationInsecure, Remote: "site", Detail: "allows http for keyserver http://keys.site.example"},
+				{Kind: PolicyViolationInsecure, Remote: "user", Detail: "allows http for cloud.user.example"},
+				{Kind: PolicyViolationURI, Remote: "user", Detail: "cloud.user.example is not approved"},
+				{Kind: PolicyViolationActive, Remote: "user", Detail: "the active remote is not a system remote"},
+			},
+		},
+		{
+			name: "undefined active remote",
+			config: Config{
+				DefaultRemote: "missing",
+				Remotes: map[string]*endpoint.Config{
+					"site": {URI: "cloud.site.example", System: true},
+				},
+			},
+			policy: policy,
+			want: []PolicyViolation{
+				{Kind: PolicyViolationActive, Remote: "missing", Detail: "the active remote is not defined"},
+			},
+		},
+		{
+			name: "empty policy",
+			config: Config{
+				DefaultRemote: "user",
+				Remotes: map[string]*endpoint.Config{
+					"user": {URI: "cloud.user.example", Insecure: true},
+				},
+			},
+		},
+		{
+			name:    "invalid pattern",
+			config:  Config{Remotes: map[string]*endpoint.Config{}},
+			policy:  RemotePolicy{ApprovedURIs: []string{"[cloud"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations, err := ValidateRemoteConfigAgainstPolicy(&tt.config, tt.policy)
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			} else if tt.wantErr {
+				t.Fatalf("unexpected success")
+			}
+			if !reflect.DeepEqual(violations, tt.want) {
+				t.Errorf("unexpected violations:\n%v\nwant:\n%v", violations, tt.want)
+			}
+		})
+	}
+}
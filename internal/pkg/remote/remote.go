@@ -86,6 +86,9 @@ func ReadFrom(r io.Reader) (*Config, error) {
 			return nil, fmt.Errorf("failed to decode YAML data from io.Reader: %s", err)
 		}
 	}
+	if err := c.CheckAliases(); err != nil {
+		return nil, fmt.Errorf("invalid remote aliases: %w", err)
+	}
 	return c, nil
 }
 
@@ -108,18 +111,34 @@ func (c *Config) WriteTo(w io.Writer) (int64, error) {
 // SyncFrom updates c with the remotes specified in sys. Typically, this is used
 // to sync a globally-configured remote.Config into a user-specific remote.Config.
 func (c *Config) SyncFrom(sys *Config) error {
+	// the aliases of the global remotes are synced once all of them are,
+	// the previous ones are not to collide with the new global remotes
+	for _, e := range c.Remotes {
+		if e.System {
+			e.Aliases = nil
+		}
+	}
+
 	for name, eSys := range sys.Remotes {
-		eUsr, err := c.GetRemote(name)
-		if err == nil && !eUsr.System { // usr & sys name collision
+		// the aliases aren't resolved, only the remotes synced from sys
+		// are updated
+		eUsr, ok := c.Remotes[name]
+		if ok && !eUsr.System { // usr & sys name collision
 			sylog.Infof("%s defined both globally and individually, using individual", name)
 			continue
-		} else if err == nil {
+		} else if ok {
 			eUsr.URI = eSys.URI // update URI just in case
 			eUsr.Exclusive = eSys.Exclusive
 			if eSys.Exclusive {
 				c.DefaultRemote = name
 			}
 			eUsr.Keyservers = eSys.Keyservers
+			eUsr.DefaultPullRegistry = eSys.DefaultPullRegistry
+			continue
+		}
+
+		if owner, ok := c.ResolveName(name); ok {
+			sylog.Infof("%s defined both globally and as an alias of remote %s, using the alias", name, owner)
 			continue
 		}
 
@@ -127,10 +146,11 @@ func (c *Config) SyncFrom(sys *Config) error {
 			c.DefaultRemote = name
 		}
 		e := &endpoint.Config{
-			URI:        eSys.URI,
-			System:     true,
-			Exclusive:  eSys.Exclusive,
-			Keyservers: eSys.Keyservers,
+			URI:                 eSys.URI,
+			System:              true,
+			Exclusive:           eSys.Exclusive,
+			Keyservers:          eSys.Keyservers,
+			DefaultPullRegistry: eSys.DefaultPullRegistry,
 		}
 
 		if err := c.Add(name, e); err != nil {
@@ -138,6 +158,12 @@ func (c *Config) SyncFrom(sys *Config) error {
 		}
 	}
 
+	for _, name := range sortedRemoteNames(sys.Remotes) {
+		if e, ok := c.Remotes[name]; ok && e.System {
+			e.Aliases = c.syncAliases(name, sys.Remotes[name].Aliases)
+		}
+	}
+
 	// set system default to user default if no user default specified
 	if c.DefaultRemote == "" && sys.DefaultRemote != "" {
 		c.DefaultRemote = sys.DefaultRemote
@@ -146,9 +172,13 @@ func (c *Config) SyncFrom(sys *Config) error {
 	return nil
 }
 
-// SetDefault sets default remote endpoint or returns an error if it does not exist.
-// A remote endpoint can also be set as exclusive.
+// SetDefault sets default remote endpoint, named or aliased name, or returns
+// an error if it does not exist. A remote endpoint can also be set as
+// exclusive.
 func (c *Config) SetDefault(name string, exclusive bool) error {
+	if n, ok := c.ResolveName(name); ok {
+		name = n
+	}
 	r, ok := c.Remotes[name]
 	if !ok {
 		return fmt.Errorf("%s is not a remote", name)
@@ -185,20 +215,30 @@ func (c *Config) GetDefault() (*endpoint.Config, error) {
 }
 
 // Add a new remote endpoint
-// returns an error if it already exists
+// returns an error if it already exists, or if its name or aliases collide
+// with the names or aliases of the other remotes
 func (c *Config) Add(name string, e *endpoint.Config) error {
 	if _, ok := c.Remotes[name]; ok {
 		return fmt.Errorf("%s is already a remote", name)
+	} else if owner, ok := c.ResolveName(name); ok {
+		return fmt.Errorf("%w: %s is already an alias of remote %s", ErrAliasCollision, name, owner)
 	}
 
 	c.Remotes[name] = e
+	if err := c.CheckAliases(); err != nil {
+		delete(c.Remotes, name)
+		return err
+	}
 	return nil
 }
 
-// Remove a remote endpoint
+// Remove a remote endpoint, named or aliased name
 // if endpoint is the default, the default is cleared
 // returns an error if it does not exist
 func (c *Config) Remove(name string) error {
+	if n, ok := c.ResolveName(name); ok {
+		name = n
+	}
 	if r, ok := c.Remotes[name]; !ok {
 		return fmt.Errorf("%s is not a remote", name)
 	} else if r.System && !c.system {
@@ -213,9 +253,13 @@ func (c *Config) Remove(name string) error {
 	return nil
 }
 
-// GetRemote returns a reference to an existing endpoint
+// GetRemote returns a reference to an existing endpoint, named or aliased
+// name
 // returns error if remote does not exist
 func (c *Config) GetRemote(name string) (*endpoint.Config, error) {
+	if n, ok := c.ResolveName(name); ok {
+		name = n
+	}
 	r, ok := c.Remotes[name]
 	if !ok {
 		return nil, fmt.Errorf("%s is not a remote", name)
@@ -293,15 +337,21 @@ func (c *Config) Logout(uri string) error {
 	return nil
 }
 
-// Rename an existing remote
-// returns an error if it does not exist
+// Rename an existing remote, named or aliased name
+// returns an error if it does not exist, or if newName is already a remote
+// or an alias
 func (c *Config) Rename(name, newName string) error {
+	if n, ok := c.ResolveName(name); ok {
+		name = n
+	}
 	if _, ok := c.Remotes[name]; !ok {
 		return fmt.Errorf("%s is not a remote", name)
 	}
 
 	if _, ok := c.Remotes[newName]; ok {
 		return fmt.Errorf("%s is already a remote", newName)
+	} else if owner, ok := c.ResolveName(newName); ok {
+		return fmt.Errorf("%w: %s is already an alias of remote %s", ErrAliasCollision, newName, owner)
 	}
 
 	if c.DefaultRemote == name {
@@ -332,6 +332,28 @@ func TestSyncFrom(t *testing.T) {
 					},
 				},
 			},
+		}, {
+			name: "sys config default pull registry",
+			sys: Config{
+				DefaultRemote: "site",
+				Remotes: map[string]*endpoint.Config{
+					"site":   {URI: "site.example.com", DefaultPullRegistry: "registry.site.example.com"},
+					"mirror": {URI: "mirror.example.com", DefaultPullRegistry: "mirror.example.com:5000/hub"},
+				},
+			},
+			usr: Config{
+				Remotes: map[string]*endpoint.Config{
+					// the registry of a global remote is updated
+					"site": {URI: "site.example.com", System: true, DefaultPullRegistry: "old.example.com"},
+				},
+			},
+			res: Config{
+				DefaultRemote: "site",
+				Remotes: map[string]*endpoint.Config{
+					"site":   {URI: "site.example.com", System: true, DefaultPullRegistry: "registry.site.example.com"},
+					"mirror": {URI: "mirror.example.com", System: true, DefaultPullRegistry: "mirror.example.com:5000/hub"},
+				},
+			},
 		},
 	}
 
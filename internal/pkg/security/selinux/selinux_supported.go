@@ -22,3 +22,8 @@ func Enabled() bool {
 func SetExecLabel(label string) error {
 	return selinux.SetExecLabel(label)
 }
+
+// LsetFileLabel sets the SELinux label of path, not following symlinks.
+func LsetFileLabel(path, label string) error {
+	return selinux.LsetFileLabel(path, label)
+}
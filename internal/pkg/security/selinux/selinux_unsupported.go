@@ -11,7 +11,11 @@
 
 package selinux
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
 
 // Enabled returns whether SELinux is enabled.
 func Enabled() bool {
@@ -22,3 +26,8 @@ func Enabled() bool {
 func SetExecLabel(label string) error {
 	return errors.New("can't set SELinux label: not enabled at compilation time")
 }
+
+// LsetFileLabel sets the SELinux label of path, not following symlinks.
+func LsetFileLabel(path, label string) error {
+	return fmt.Errorf("can't set SELinux label of %s: not enabled at compilation time: %w", path, syscall.ENOTSUP)
+}
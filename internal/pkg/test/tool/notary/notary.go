@@ -0,0 +1,363 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package notary provides a stub notary server serving Docker Content Trust
+// data signed on the fly, for tests.
+package notary
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const releasesRole = "targets/releases"
+
+// Server is a stub notary server. Each server has its own set of signing
+// keys, shared by all the images it holds trust data for.
+type Server struct {
+	*httptest.Server
+
+	t  *testing.T
+	mu sync.Mutex
+	// keys maps role names to their signing key
+	keys map[string]*ecdsa.PrivateKey
+	// public maps role names to their TUF public key
+	public map[string]map[string]interface{}
+	// targets maps gun -> tag -> target
+	targets map[string]map[string]interface{}
+	// files maps gun -> role -> metadata, the root metadata of each root
+	// version being also held as <version>.root
+	files map[string]map[string][]byte
+	// versions maps gun to the version of its metadata, increased each
+	// time it is regenerated
+	versions map[string]int
+	// rootVersion is the version of the root metadata, increased by each
+	// rotation of the root key, and prevRoot the previous root key, which
+	// signs the root metadata along with the current one
+	rootVersion    int
+	prevRoot       *ecdsa.PrivateKey
+	prevRootPublic map[string]interface{}
+
+	// Delegate signs the tags in the targets/releases delegated role, as
+	// docker does, instead of the top level targets role.
+	Delegate bool
+}
+
+// NewServer starts a stub notary server, closed at the end of the test.
+func NewServer(t *testing.T) *Server {
+	t.Helper()
+
+	s := &Server{
+		t:           t,
+		keys:        make(map[string]*ecdsa.PrivateKey),
+		public:      make(map[string]map[string]interface{}),
+		targets:     make(map[string]map[string]interface{}),
+		files:       make(map[string]map[string][]byte),
+		versions:    make(map[string]int),
+		rootVersion: 1,
+	}
+	for _, role := range []string{"root", "targets", "snapshot", "timestamp", releasesRole} {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("while generating %s key: %s", role, err)
+		}
+		s.keys[role] = k
+		s.public[role] = s.publicKey(role, k)
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Sign adds the manifest as the signed target of tag in the trust data of
+// the image gun, and regenerates its metadata.
+func (s *Server) Sign(gun, tag string, manifest []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sum := sha256.Sum256(manifest)
+	if s.targets[gun] == nil {
+		s.targets[gun] = make(map[string]interface{})
+	}
+	s.targets[gun][tag] = map[string]interface{}{
+		"length": len(manifest),
+		"hashes": map[string]interface{}{"sha256": sum[:]},
+	}
+	s.generate(gun)
+}
+
+// RotateRoot replaces the root key, and regenerates the metadata of all the
+// images with a new root version signed by both the previous and the new
+// root keys, the previous root versions being still served.
+func (s *Server) RotateRoot() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		s.t.Fatalf("while generating root key: %s", err)
+	}
+	s.prevRoot, s.prevRootPublic = s.keys["root"], s.public["root"]
+	s.keys["root"] = k
+	s.public["root"] = s.publicKey("root", k)
+	s.rootVersion++
+	for gun := range s.files {
+		s.generate(gun)
+	}
+}
+
+// Metadata returns the metadata of role in the trust data of gun.
+func (s *Server) Metadata(gun, role string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files[gun][role]
+}
+
+// SetMetadata replaces the metadata of role in the trust data of gun, e.g.
+// to serve tampered data.
+func (s *Server) SetMetadata(gun, role string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[gun][role] = data
+}
+
+// generate signs all of the metadata of gun.
+func (s *Server) generate(gun string) {
+	expires := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	files := make(map[string][]byte)
+	s.versions[gun]++
+	version := s.versions[gun]
+
+	roles := make(map[string]interface{})
+	rootKeys := make(map[string]interface{})
+	for _, role := range []string{"root", "targets", "snapshot", "timestamp"} {
+		id := s.keyID(role)
+		rootKeys[id] = s.public[role]
+		roles[role] = map[string]interface{}{"keyids": []string{id}, "threshold": 1}
+	}
+	rootSigners := []*ecdsa.PrivateKey{s.keys["root"]}
+	if s.prevRoot != nil {
+		rootSigners = append(rootSigners, s.prevRoot)
+	}
+	files["root"] = s.sign("root", map[string]interface{}{
+		"_type":               "Root",
+		"consistent_snapshot": false,
+		"expires":             expires,
+		"version":             s.rootVersion,
+		"keys":                rootKeys,
+		"roles":               roles,
+	}, rootSigners...)
+
+	targets := map[string]interface{}{
+		"_type":   "Targets",
+		"expires": expires,
+		"version": version,
+		"targets": s.targets[gun],
+	}
+	if s.Delegate {
+		id := s.keyID(releasesRole)
+		targets["targets"] = map[string]interface{}{}
+		targets["delegations"] = map[string]interface{}{
+			"keys": map[string]interface{}{id: s.public[releasesRole]},
+			"roles": []interface{}{
+				map[string]interface{}{"name": releasesRole, "keyids": []string{id}, "threshold": 1, "paths": []string{""}},
+			},
+		}
+		files[releasesRole] = s.sign(releasesRole, map[string]interface{}{
+			"_type":   "Targets",
+			"expires": expires,
+			"version": version,
+			"targets": s.targets[gun],
+		})
+	}
+	files["targets"] = s.sign("targets", targets)
+
+	s.signSnapshot(files, expires, version)
+	s.signTimestamp(files, expires, version)
+
+	// the previous root versions are still served
+	for name, data := range s.files[gun] {
+		if strings.HasSuffix(name, ".root") {
+			files[name] = data
+		}
+	}
+	files[fmt.Sprintf("%d.root", s.rootVersion)] = files["root"]
+
+	s.files[gun] = files
+}
+
+// signSnapshot signs the snapshot metadata listing the root and targets
+// metadata of files.
+func (s *Server) signSnapshot(files map[string][]byte, expires string, version int) {
+	snapMeta := map[string]interface{}{}
+	for _, role := range []string{"root", "targets", releasesRole} {
+		if data, ok := files[role]; ok {
+			snapMeta[role] = fileMeta(data)
+		}
+	}
+	files["snapshot"] = s.sign("snapshot", map[string]interface{}{
+		"_type":   "Snapshot",
+		"expires": expires,
+		"version": version,
+		"meta":    snapMeta,
+	})
+}
+
+// signTimestamp signs the timestamp metadata listing the snapshot metadata
+// of files.
+func (s *Server) signTimestamp(files map[string][]byte, expires string, version int) {
+	files["timestamp"] = s.sign("timestamp", map[string]interface{}{
+		"_type":   "Timestamp",
+		"expires": expires,
+		"version": version,
+		"meta":    map[string]interface{}{"snapshot": fileMeta(files["snapshot"])},
+	})
+}
+
+// Republish signs new versions of the snapshot and timestamp metadata that
+// list the metadata of role in the trust data of gun, e.g. once replaced by
+// SetMetadata.
+func (s *Server) Republish(gun, role string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	s.versions[gun]++
+	files := s.files[gun]
+	if role != "snapshot" && role != "timestamp" {
+		s.signSnapshot(files, expires, s.versions[gun])
+	}
+	if role != "timestamp" {
+		s.signTimestamp(files, expires, s.versions[gun])
+	}
+}
+
+// sign returns the metadata signed with the key of role, or with keys when
+// set.
+func (s *Server) sign(role string, signed map[string]interface{}, keys ...*ecdsa.PrivateKey) []byte {
+	// json.Marshal sorts map keys and doesn't add any whitespace, which is
+	// the canonical form for this content
+	msg, err := json.Marshal(signed)
+	if err != nil {
+		s.t.Fatalf("while encoding %s metadata: %s", role, err)
+	}
+	hash := sha256.Sum256(msg)
+	if len(keys) == 0 {
+		keys = []*ecdsa.PrivateKey{s.keys[role]}
+	}
+	var sigs []interface{}
+	for _, k := range keys {
+		r, ss, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			s.t.Fatalf("while signing %s metadata: %s", role, err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		ss.FillBytes(sig[32:])
+		sigs = append(sigs, map[string]interface{}{"keyid": s.keyIDOf(role, k), "method": "ecdsa", "sig": sig})
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"signed":     signed,
+		"signatures": sigs,
+	})
+	if err != nil {
+		s.t.Fatalf("while encoding %s metadata: %s", role, err)
+	}
+	return data
+}
+
+// publicKey returns the TUF public key of role, the root key being
+// provided as a self-signed certificate as done by notary.
+func (s *Server) publicKey(role string, k *ecdsa.PrivateKey) map[string]interface{} {
+	if role != "root" {
+		der, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+		if err != nil {
+			s.t.Fatalf("while encoding %s key: %s", role, err)
+		}
+		return map[string]interface{}{"keytype": "ecdsa", "keyval": map[string]interface{}{"public": der, "private": nil}}
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "root"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		s.t.Fatalf("while creating root certificate: %s", err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return map[string]interface{}{"keytype": "ecdsa-x509", "keyval": map[string]interface{}{"public": cert, "private": nil}}
+}
+
+// keyID returns the ID of the key of role, the hash of its canonical form.
+func (s *Server) keyID(role string) string {
+	return s.publicKeyID(role, s.public[role])
+}
+
+// keyIDOf returns the ID of the key k signing role, the current key of role
+// or the previous root key.
+func (s *Server) keyIDOf(role string, k *ecdsa.PrivateKey) string {
+	if k == s.prevRoot {
+		return s.publicKeyID(role, s.prevRootPublic)
+	}
+	return s.keyID(role)
+}
+
+// publicKeyID returns the ID of the TUF public key public of role.
+func (s *Server) publicKeyID(role string, public map[string]interface{}) string {
+	data, err := json.Marshal(public)
+	if err != nil {
+		s.t.Fatalf("while encoding %s key: %s", role, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func fileMeta(data []byte) map[string]interface{} {
+	sum := sha256.Sum256(data)
+	return map[string]interface{}{"length": len(data), "hashes": map[string]interface{}{"sha256": sum[:]}}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	gun, file, ok := strings.Cut(path, "/_trust/tuf/")
+	if !ok || !strings.HasSuffix(file, ".json") {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	data, ok := s.files[gun][strings.TrimSuffix(file, ".json")]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
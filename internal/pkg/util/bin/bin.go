@@ -46,6 +46,7 @@ func FindBin(name string) (path string, err error) {
 		"fakeroot-sysv",
 		"fuse-overlayfs",
 		"fuse2fs",
+		"git",
 		"go",
 		"ldconfig",
 		"mksquashfs",
@@ -34,11 +34,14 @@ var validURIs = map[string]bool{
 	"docker":         true,
 	"docker-archive": true,
 	"docker-daemon":  true,
+	"containerd":     true,
 	"oci":            true,
 	"oci-archive":    true,
+	"oci-http":       true,
 	"http":           true,
 	"https":          true,
 	"oras":           true,
+	"cpio":           true,
 }
 
 // IsValid returns whether or not the given source is valid
@@ -0,0 +1,57 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// The build modes recorded in the build provenance.
+const (
+	// BuildModeRoot is a build run by the host root user.
+	BuildModeRoot = "root"
+	// BuildModeFakeroot is a build run as root in an unprivileged user
+	// namespace, or with the fakeroot command.
+	BuildModeFakeroot = "fakeroot"
+	// BuildModeRootless is a build run by an unprivileged user.
+	BuildModeRootless = "rootless"
+)
+
+// BuildProvenance records how an image was built, as stored in the SIF
+// image build provenance metadata.
+type BuildProvenance struct {
+	// Version is the apptainer version which built the image.
+	Version string `json:"version"`
+	// OS and Arch are the platform of the build host.
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	// Mode is the build mode, one of the BuildMode constants.
+	Mode string `json:"mode"`
+	// Source is the reference of the source the image was built from, as
+	// bootstrap://from.
+	Source string `json:"source"`
+	// SourceDigest is the manifest digest of the source image, when known.
+	SourceDigest digest.Digest `json:"sourceDigest,omitempty"`
+	// Timestamp is the time of the build, SOURCE_DATE_EPOCH when set.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ParseBuildProvenance decodes a build provenance, as stored in the SIF
+// image build provenance metadata.
+func ParseBuildProvenance(data []byte) (*BuildProvenance, error) {
+	p := new(BuildProvenance)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("while decoding build provenance: %w", err)
+	}
+	return p, nil
+}
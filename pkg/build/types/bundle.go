@@ -13,11 +13,15 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/apptainer/apptainer/internal/pkg/cache"
 	"github.com/apptainer/apptainer/internal/pkg/util/fs"
 	"github.com/apptainer/apptainer/pkg/sylog"
+	"github.com/apptainer/apptainer/pkg/util/apptainerconf"
 	"github.com/apptainer/apptainer/pkg/util/cryptkey"
 	keyClient "github.com/apptainer/container-key-client/client"
 	ocitypes "github.com/containers/image/v5/types"
@@ -26,6 +30,12 @@ import (
 
 const OCIConfigJSON = "oci-config"
 
+// ScratchLockSuffix is the suffix appended to the path of a scratch
+// directory of a build for the lock file held next to it by the build
+// process, for the lifetime of the bundle. The lock files are kept out of
+// the scratch directories, whose content is packed into the images.
+const ScratchLockSuffix = ".lock"
+
 // Bundle is the temporary environment used during the image building process.
 type Bundle struct {
 	JSONObjects map[string][]byte `json:"jsonObjects"`
@@ -35,7 +45,142 @@ type Bundle struct {
 	RootfsPath string `json:"rootfsPath"` // where actual fs to chroot will appear
 	TmpDir     string `json:"tmpPath"`    // where temp files required during build will appear
 
-	parentPath string // parent directory for RootfsPath
+	parentPath string     // parent directory for RootfsPath
+	locks      []*os.File // locks held on the scratch directories
+}
+
+// RestrictivePermsHandler is called with the list of paths found with
+// restrictive permissions in a root filesystem.
+type RestrictivePermsHandler func(paths []string) error
+
+// Bounds of Options.ExtractBufferSize, and its default value when zero, the
+// buffer size of io.Copy.
+const (
+	MinExtractBufferSize     = 4 << 10
+	MaxExtractBufferSize     = 64 << 20
+	DefaultExtractBufferSize = 32 << 10
+)
+
+// PlatformAll is the Options.Platform building an image for each platform
+// of the image index of an oci/docker source.
+const PlatformAll = "all"
+
+// Policies of Options.RootUser for the oci/docker sources whose image
+// config runs them as root.
+const (
+	// RootUserAllow builds the image, the default.
+	RootUserAllow = "allow"
+	// RootUserWarn builds the image with a warning.
+	RootUserWarn = "warn"
+	// RootUserError fails the build.
+	RootUserError = "error"
+)
+
+// RootUserPolicy returns the policy applied to the oci/docker sources whose
+// image config runs them as root: policy, e.g. RootUserAllow from the
+// --allow-root-user build option, or else the root user images directive of
+// the current apptainer.conf configuration, RootUserAllow without one.
+func RootUserPolicy(policy string) string {
+	if policy != "" {
+		return policy
+	}
+	if conf := apptainerconf.GetCurrentConfig(); conf != nil && conf.RootUserImages != "" {
+		return conf.RootUserImages
+	}
+	return RootUserAllow
+}
+
+// Policies of Options.UnknownMediaTypes for the layers of oci/docker sources
+// whose media type isn't handled by the extraction.
+const (
+	// UnknownMediaTypeError fails the extraction, the default.
+	UnknownMediaTypeError = "error"
+	// UnknownMediaTypePassthrough extracts the layer as an uncompressed tar
+	// stream.
+	UnknownMediaTypePassthrough = "passthrough"
+	// UnknownMediaTypeSkip doesn't extract the layer, with a warning.
+	UnknownMediaTypeSkip = "skip"
+)
+
+// Policies of Options.OversizedFiles for the files of the layers of
+// oci/docker sources larger than Options.MaxFileSize.
+const (
+	// OversizedFileError fails the extraction, the default.
+	OversizedFileError = "error"
+	// OversizedFileSkip doesn't extract the file, with a warning.
+	OversizedFileSkip = "skip"
+)
+
+// Policies of Options.ACLs for the POSIX ACLs of the files of the layers of
+// oci/docker sources, held by their system.posix_acl_access and
+// system.posix_acl_default xattrs.
+const (
+	// ACLDrop doesn't extract the ACLs, the default.
+	ACLDrop = "drop"
+	// ACLPreserve sets the ACLs, with the users and groups they name mapped
+	// as the owners of the files. They are dropped with a warning when the
+	// rootfs doesn't support them.
+	ACLPreserve = "preserve"
+)
+
+// Policies of Options.DanglingHardlinks for the hard links of the layers of
+// oci/docker sources whose target isn't extracted.
+const (
+	// DanglingHardlinkCopy extracts the hard link as a copy of its target,
+	// when the target was dropped from the same layer.
+	DanglingHardlinkCopy = "copy"
+	// DanglingHardlinkSkip doesn't extract the hard link, with a warning.
+	DanglingHardlinkSkip = "skip"
+	// DanglingHardlinkError fails the extraction.
+	DanglingHardlinkError = "error"
+)
+
+// Policies of Options.SymlinkLoops for the symlinks of the rootfs which
+// loop or are nested too deeply to be resolved.
+const (
+	// SymlinkLoopWarn reports the symlinks with a warning, the default.
+	SymlinkLoopWarn = "warn"
+	// SymlinkLoopRemove removes the symlinks, with a warning.
+	SymlinkLoopRemove = "remove"
+	// SymlinkLoopError fails the build.
+	SymlinkLoopError = "error"
+	// SymlinkLoopIgnore doesn't scan the rootfs for them.
+	SymlinkLoopIgnore = "ignore"
+)
+
+// Policies of Options.LatestTag for the docker sources using the floating
+// latest tag, explicitly or without any tag, and not pinned to a digest.
+const (
+	// LatestTagWarn builds the image with a warning, the default.
+	LatestTagWarn = "warn"
+	// LatestTagError fails the build.
+	LatestTagError = "error"
+	// LatestTagIgnore builds the image silently.
+	LatestTagIgnore = "ignore"
+)
+
+// Policies of Options.RunnableCheck for the built containers without an
+// executable entrypoint or shell.
+const (
+	// RunnableCheckIgnore doesn't check the container, the default.
+	RunnableCheckIgnore = "ignore"
+	// RunnableCheckWarn builds the container with a warning.
+	RunnableCheckWarn = "warn"
+	// RunnableCheckError fails the build.
+	RunnableCheckError = "error"
+)
+
+// DefaultLockFile is the name of the lock file used by the build command,
+// in the current directory, when --update-lock is given without --lock-file.
+const DefaultLockFile = "apptainer-build.lock"
+
+// ContainerdOptions are the socket and the namespace of the image store of
+// containerd sources. They default to the CONTAINERD_ADDRESS and
+// CONTAINERD_NAMESPACE environment variables, as for ctr, or to
+// /run/containerd/containerd.sock and default.
+type ContainerdOptions struct {
+	Address   string `json:"address"`
+	Namespace string `json:"namespace"`
 }
 
 // Options defines build time behavior to be executed on the bundle.
@@ -50,12 +195,47 @@ type Options struct {
 	LibraryAuthToken string `json:"libraryAuthToken"`
 	// Path to fakeroot command will be empty if not needed or not available
 	FakerootPath string `json:"fakerootPath"`
+	// Fakeroot is whether the build runs with --fakeroot, in a user
+	// namespace mapping the user to root.
+	Fakeroot bool `json:"fakeroot"`
 	// KeyServerOpts contains options for keyserver used for SIF fingerprint verification in builds.
 	KeyServerOpts []keyClient.Option
 	// contains docker credentials if specified.
 	DockerAuthConfig *ocitypes.DockerAuthConfig
 	// Custom docker Daemon host
 	DockerDaemonHost string
+	// Containerd selects the image store of containerd sources.
+	Containerd ContainerdOptions `json:"containerd"`
+	// MergeSources are the URIs of oci/docker sources, e.g. docker://alpine,
+	// whose layers are extracted in order atop the layers of the oci/docker
+	// source of the definition, into the same rootfs. The layers of a source
+	// overwrite the paths of the sources before it, and its whiteouts remove
+	// them. The image config, e.g. the env and the runscript, is the one of
+	// the source of the definition.
+	MergeSources []string `json:"mergeSources"`
+	// DockerClientCert and DockerClientKey are the paths of the PEM encoded
+	// client certificate and key presented to the registries and servers of
+	// docker and oci-http sources requiring mutual TLS.
+	DockerClientCert string `json:"dockerClientCert"`
+	DockerClientKey  string `json:"dockerClientKey"`
+	// PullThroughCache, if set, is the pull-through cache of Docker Hub the
+	// docker sources not naming their registry are resolved through, a
+	// registry host with an optional port and repository prefix.
+	PullThroughCache string `json:"pullThroughCache"`
+	// SharedBlobCache, if set, is the directory of a blob cache shared
+	// across users, e.g. group-writable with the sticky bit, the blobs of
+	// docker sources are fetched from and stored in, validated by digest.
+	SharedBlobCache string `json:"sharedBlobCache,omitempty"`
+	// DefaultRegistry, if set, is the registry the docker sources not
+	// naming their registry are resolved from instead of Docker Hub, a
+	// registry host with an optional port and repository prefix, e.g. from
+	// the active remote.
+	DefaultRegistry string `json:"defaultRegistry,omitempty"`
+	// AllowedRegistries, if set, restricts the docker, oras and library
+	// sources to the registries matching one of these host patterns, see
+	// RegistryAllowed, instead of the allowed registries of the
+	// configuration.
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
 	// EncryptionKeyInfo specifies the key used for filesystem
 	// encryption if applicable.
 	// A nil value indicates encryption should not occur.
@@ -82,12 +262,286 @@ type Options struct {
 	// To warn when the above is needed, we need to know if the target of this
 	// bundle will be a sandbox
 	SandboxTarget bool
+	// NormalizeOwnership sets the ownership of all the content of the
+	// rootfs extracted from the build source to root:root, for SIF images
+	// where the ownership is advisory. It is ignored for sandboxes.
+	NormalizeOwnership bool `json:"normalizeOwnership"`
+	// IncludePaths restricts the extraction of oci/docker sources to the given
+	// paths and their parent directories, producing a non-complete root
+	// filesystem. All paths are extracted when empty.
+	IncludePaths []string `json:"includePaths"`
+	// Provenance records, for oci/docker sources, the digest of the layer
+	// which last wrote each path of the root filesystem in the image metadata.
+	Provenance bool `json:"provenance"`
+	// LayerHistory records the history of the config of oci/docker sources,
+	// correlated to their layers, in the image metadata.
+	LayerHistory bool `json:"layerHistory"`
+	// BuildProvenance records how the image was built, the apptainer
+	// version, host platform, build mode and source, in the image metadata.
+	BuildProvenance bool `json:"buildProvenance"`
+	// SBOM stores the list of the packages installed in the root filesystem
+	// extracted from oci/docker sources, read from their dpkg and rpm
+	// databases, in the image metadata.
+	SBOM bool `json:"sbom"`
+	// Healthcheck writes the healthcheck of the image config of oci/docker
+	// sources, set by the HEALTHCHECK instruction of a Dockerfile, as the
+	// test script of the container run by apptainer test, unless the
+	// definition has a %test section.
+	Healthcheck bool `json:"healthcheck"`
+	// TestScript, if set, is the path of the script written as the test
+	// script of the container, instead of the %test section of the
+	// definition or the healthcheck of the image. A script without
+	// shebang is run by /bin/sh.
+	TestScript string `json:"testScript"`
+	// PreserveManifest stores the manifest and config of oci/docker sources,
+	// as fetched, in the image metadata.
+	PreserveManifest bool `json:"preserveManifest"`
+	// ParallelGzip uses a parallel decompressor for the gzip compressed
+	// layers of oci/docker sources, instead of the standard one.
+	ParallelGzip bool `json:"parallelGzip"`
+	// IgnorePlatform allows building from oci/docker sources whose OS or
+	// architecture doesn't match the host, e.g. for cross-builds.
+	IgnorePlatform bool `json:"ignorePlatform"`
+	// DownloadRateLimit limits the rate of the downloads of docker and
+	// oci-http sources, in bytes per second. Downloads are not limited when 0.
+	DownloadRateLimit int64 `json:"downloadRateLimit"`
+	// ManifestTimeout, when not zero, abandons the fetch of the manifest of
+	// oci/docker sources after that duration, and retries it a few times
+	// before failing the build.
+	ManifestTimeout time.Duration `json:"manifestTimeout"`
+	// VerifyLayers checks that all of the layers of oci/docker sources were
+	// applied in the order of their manifest after the extraction.
+	VerifyLayers bool `json:"verifyLayers"`
+	// VerifyRootfs reads the layers of oci/docker sources again after their
+	// extraction, and checks that the extracted rootfs matches their content.
+	VerifyRootfs bool `json:"verifyRootfs"`
+	// VerifyGzip checks the CRC-32 and size trailer of the gzip layers of
+	// oci/docker sources during their extraction, failing with the digest
+	// of a truncated or corrupted layer.
+	VerifyGzip bool `json:"verifyGzip"`
+	// IDPreflight reports the uids and gids owning the content of oci/docker
+	// sources before their extraction, and warns about those outside of the
+	// available id mappings.
+	IDPreflight bool `json:"idPreflight"`
+	// WarningsAsErrors fails the extraction of oci/docker sources, once done,
+	// when warnings about the image content were emitted, e.g. about
+	// restrictive permissions, foreign layers or dropped xattrs.
+	WarningsAsErrors bool `json:"warningsAsErrors"`
+	// CaseCollisionWarnings reports the paths of oci/docker sources which
+	// only differ by case, and collide when extracted on a case-insensitive
+	// filesystem, as warnings instead of failing the build.
+	CaseCollisionWarnings bool `json:"caseCollisionWarnings"`
+	// ChunkSize, when not zero, fetches the layers of docker sources larger
+	// than ChunkSize bytes with range requests. The part of a layer fetched
+	// so far is kept in the blob cache, so an interrupted download resumes
+	// instead of restarting.
+	ChunkSize int64 `json:"chunkSize"`
+	// ContentTrust requires docker sources to be signed with Docker Content
+	// Trust, and builds from the signed manifest digest of their tag.
+	ContentTrust bool `json:"contentTrust"`
+	// ContentTrustServer is the notary server holding the trust data of
+	// docker sources, derived from the registry when empty.
+	ContentTrustServer string `json:"contentTrustServer"`
+	// ContentTrustDir is the trust store holding the last verified metadata of
+	// docker sources, the docker one (~/.docker/trust) when empty.
+	ContentTrustDir string `json:"contentTrustDir"`
+	// PrunePatterns removes the files and directories of the root filesystem
+	// matching the patterns once built, before the image is assembled, see
+	// PruneRootfs.
+	PrunePatterns []string `json:"prunePatterns"`
+	// PruneProfile, if set, is the name of a prune profile, e.g.
+	// PruneProfileMinimal, whose patterns are pruned along with
+	// PrunePatterns, see GetPruneProfile.
+	PruneProfile string `json:"pruneProfile"`
+	// PruneDryRun only reports what PrunePatterns and PruneProfile would
+	// remove.
+	PruneDryRun bool `json:"pruneDryRun"`
+	// NormalizeNetFiles replaces the /etc/resolv.conf and /etc/hosts files
+	// of the extracted rootfs by regular files, so that the host ones can be
+	// bound over at runtime, either NetFilesEmpty or NetFilesTemplate, see
+	// NormalizeNetFiles. The files are kept as is when empty.
+	NormalizeNetFiles string `json:"normalizeNetFiles"`
+	// NormalizeEnv drops the malformed entries of the env of the image
+	// config of oci/docker sources, keeps the last value of the variables
+	// set several times, and sets PATH to the default path if missing, with
+	// warnings, before the env is recorded in the image.
+	NormalizeEnv bool `json:"normalizeEnv"`
+	// ExtractRetries is the number of times the extraction of a layer of
+	// oci/docker sources is retried after a transient filesystem error,
+	// e.g. EIO or ESTALE from an NFS server.
+	ExtractRetries int `json:"extractRetries"`
+	// MaxFiles, when not zero, aborts the extraction of oci/docker sources
+	// once their root filesystem holds more than MaxFiles files, e.g. to
+	// fail early on a filesystem with a limited number of inodes.
+	MaxFiles int `json:"maxFiles"`
+	// MaxFileSize, when not zero, is the maximum size in bytes of a single
+	// file of the layers of oci/docker sources, guarding against the
+	// decompression bombs. A larger file is handled with OversizedFiles.
+	MaxFileSize int64 `json:"maxFileSize"`
+	// OversizedFiles is the policy applied to the files larger than
+	// MaxFileSize, OversizedFileError or OversizedFileSkip.
+	// OversizedFileError when empty.
+	OversizedFiles string `json:"oversizedFiles"`
+	// ACLs is the policy applied to the POSIX ACLs of the files of
+	// oci/docker sources, ACLDrop or ACLPreserve, handled apart from their
+	// other xattrs as they name users and groups. ACLDrop when empty.
+	ACLs string `json:"acls,omitempty"`
+	// MaxExtractMemory, when not zero, aborts the extraction of oci/docker
+	// sources once the resident memory of the build process exceeds
+	// MaxExtractMemory bytes. As MaxExtractCPUTime, it is a best-effort
+	// limit, checked periodically during the extraction and so overshot
+	// until the next check.
+	MaxExtractMemory int64 `json:"maxExtractMemory"`
+	// MaxExtractCPUTime, when not zero, aborts the extraction of oci/docker
+	// sources once the build process used more than MaxExtractCPUTime of
+	// CPU time since its start, e.g. decompressing a pathological image.
+	MaxExtractCPUTime time.Duration `json:"maxExtractCPUTime"`
+	// ExtractBufferSize is the size of the buffer copying the content of the
+	// files of oci/docker sources to the rootfs during their extraction,
+	// between MinExtractBufferSize and MaxExtractBufferSize, or
+	// DefaultExtractBufferSize when zero.
+	ExtractBufferSize int `json:"extractBufferSize"`
+	// SparseFiles extracts the runs of zeros of the files of oci/docker
+	// sources as holes, where the filesystem of the rootfs supports them,
+	// e.g. for preallocated database files.
+	SparseFiles bool `json:"sparseFiles,omitempty"`
+	// KeepDirlinks extracts the directories of the layers of oci/docker
+	// sources whose path in the rootfs is a symlink to a directory, e.g. the
+	// /lib symlink of a merged /usr base image, through the symlink as rsync
+	// --keep-dirlinks does, instead of replacing the symlink by a directory.
+	KeepDirlinks bool `json:"keepDirlinks,omitempty"`
+	// ExtractUIDMap and ExtractGIDMap, if set, map the uids and gids owning
+	// the content of oci/docker sources onto those of the rootfs, instead of
+	// the mappings derived from the privileges of the build. The mappings
+	// are in the containerID:hostID[:size] form, e.g. 0:100000:65536, and
+	// require a privileged extraction, as root of the host or of a user
+	// namespace.
+	ExtractUIDMap []string `json:"extractUIDMap,omitempty"`
+	ExtractGIDMap []string `json:"extractGIDMap,omitempty"`
+	// LockFile, if set, is the path of the lock file pinning the tags of
+	// docker sources to the digests recorded in it, see DefaultLockFile.
+	// The tags missing from it are resolved and recorded.
+	LockFile string `json:"lockFile"`
+	// UpdateLock resolves the tags of docker sources again, recording their
+	// current digest in LockFile.
+	UpdateLock bool `json:"updateLock"`
+	// KeepGoing continues the extraction of oci/docker sources past a layer
+	// failing to extract, logging the error instead of aborting the build.
+	// The build is degraded: the root filesystem may miss the content of
+	// the failed layers, or hold part of it.
+	KeepGoing bool `json:"keepGoing"`
+	// UnknownMediaTypes is the policy applied to the layers of oci/docker
+	// sources of an unknown media type, UnknownMediaTypeError,
+	// UnknownMediaTypePassthrough or UnknownMediaTypeSkip.
+	// UnknownMediaTypeError when empty.
+	UnknownMediaTypes string `json:"unknownMediaTypes"`
+	// RootUser is the policy applied to the oci/docker sources whose image
+	// config doesn't set a user, or sets root or uid 0, RootUserAllow,
+	// RootUserWarn or RootUserError. The policy of the configuration when
+	// empty, see RootUserPolicy, so that the sources of the pulled images
+	// are checked as the ones of the builds.
+	RootUser string `json:"rootUser,omitempty"`
+	// LatestTag is the policy applied to the docker sources using the latest
+	// tag, LatestTagWarn, LatestTagError or LatestTagIgnore. LatestTagWarn
+	// when empty. The digest the tag resolves to is reported unless ignored.
+	// The images pulled to the cache set LatestTagIgnore, the check is for
+	// the builds.
+	LatestTag string `json:"latestTag,omitempty"`
+	// DanglingHardlinks is the policy applied to the hard links of the
+	// layers of oci/docker sources whose target isn't extracted, e.g.
+	// dropped by IncludePaths or TarFilters, DanglingHardlinkCopy,
+	// DanglingHardlinkSkip or DanglingHardlinkError. When empty, the hard
+	// links to a path not included by IncludePaths are skipped with a
+	// warning, and the others fail the extraction.
+	DanglingHardlinks string `json:"danglingHardlinks"`
+	// SymlinkLoops is the policy applied to the symlinks of the rootfs
+	// which loop, or go through more symlinks than the kernel resolves,
+	// SymlinkLoopWarn, SymlinkLoopRemove, SymlinkLoopError or
+	// SymlinkLoopIgnore. SymlinkLoopWarn when empty.
+	SymlinkLoops string `json:"symlinkLoops,omitempty"`
+	// RunnableCheck is the policy applied to the built containers which
+	// don't hold the interpreter of their %runscript, its shebang or
+	// /bin/sh, or else the executable of the entrypoint, or cmd, of the
+	// config of their oci/docker source, or a shell when they don't have
+	// one, RunnableCheckIgnore, RunnableCheckWarn or RunnableCheckError.
+	// Only the last stage of a multi-stage build is checked.
+	// RunnableCheckIgnore when empty, as for the intentionally minimal
+	// containers, e.g. of data built from scratch.
+	RunnableCheck string `json:"runnableCheck,omitempty"`
+	// LogFile, if set, is the path of the file the log lines of the source
+	// phase of the build are copied to, including those of umoci during the
+	// extraction of oci/docker sources. The file is replaced by each build.
+	LogFile string `json:"logFile"`
+	// RootfsFS, if set, is the filesystem the layers of oci/docker sources
+	// are extracted into, e.g. a MemFS, instead of RootfsPath. Only the
+	// extraction writes to it, the files added by the build afterwards are
+	// still written to RootfsPath, and the options reading the extracted
+	// rootfs from disk, e.g. SBOM or FixPerms, aren't supported with it.
+	RootfsFS RootfsFS `json:"-"`
+	// ManifestCache, if set, caches the manifests of oci/docker sources
+	// across the stages of a build, and the resolution of their digests
+	// beforehand, e.g. a MemoryManifestCache, so that the manifests aren't
+	// fetched again. Each source of a build caches its manifests for the
+	// duration of its fetch when nil.
+	ManifestCache ManifestCache `json:"-"`
+	// LowerDir and UpperDir, if set, extract the layers of oci/docker
+	// sources into the overlay upper directory UpperDir atop the existing
+	// root filesystem LowerDir, which isn't modified, see OverlayFS. As with
+	// RootfsFS, the extraction doesn't write to RootfsPath.
+	LowerDir string `json:"lowerDir,omitempty"`
+	UpperDir string `json:"upperDir,omitempty"`
+	// TarFilters transform the tar entries of the layers of oci/docker
+	// sources before their extraction, run in order as a TarFilterPipeline,
+	// after IncludePaths is applied.
+	TarFilters []TarFilter `json:"-"`
+	// RestrictivePermsHandler, if set, is called with the paths of a sandbox
+	// rootfs extracted from oci/docker sources that cannot be removed by the
+	// owner, instead of reporting them as warnings. An error returned by the
+	// handler aborts the build.
+	RestrictivePermsHandler RestrictivePermsHandler `json:"-"`
+	// PermsStateFile, if set, is the path of the file recording the scan
+	// for restrictive permissions of a sandbox rootfs extracted from
+	// oci/docker sources, so that a rebuild only scans the paths written by
+	// the layers which changed since. The whole rootfs is scanned when the
+	// file doesn't exist yet.
+	PermsStateFile string `json:"permsStateFile"`
+	// SELinuxLabels, if set, is the path of the policy setting the SELinux
+	// labels of the rootfs extracted from oci/docker sources, in the format
+	// of the file_contexts files of SELinux, so that the image runs without
+	// relabeling on SELinux enforcing hosts. The labels are skipped when the
+	// filesystem of the rootfs can't hold them. AppArmor confines by path
+	// and has no labels to apply.
+	SELinuxLabels string `json:"selinuxLabels"`
+	// InjectFiles are written into the rootfs extracted from oci/docker
+	// sources before FixPerms, and the scan for restrictive permissions of
+	// a sandbox rootfs, so that they are handled as the files of the image.
+	InjectFiles []InjectedFile `json:"injectFiles"`
+	// TemplateFiles, if set, are the patterns of the files of the rootfs
+	// extracted from oci/docker sources whose TemplateVars are substituted,
+	// after InjectFiles and before FixPerms, see the TemplateFiles function.
+	TemplateFiles []string          `json:"templateFiles,omitempty"`
+	TemplateVars  map[string]string `json:"-"`
 	// Binds stores bind mounts used for the post scripts
 	Binds []string
 	// whether using gocryptfs to build and run encrypted containers
 	Unprivilege bool
 	// Arch info
 	Arch string
+	// Platform selects the image of the image index of oci/docker sources
+	// for the os/architecture[/variant] platform, e.g. linux/arm64/v8,
+	// instead of the platform of the host. With PlatformAll, an image is
+	// built for each platform of the index, next to the destination, along
+	// with a manifest listing them.
+	Platform string `json:"platform"`
+	// ArchVariant overrides the architecture variant, e.g. v7, of the image
+	// selected from the image index of an oci/docker source.
+	ArchVariant string
+	// Compression is the compression algorithm of the squashfs of a SIF
+	// image, gzip, lz4, lzo, xz or zstd, gzip when empty.
+	Compression string `json:"compression"`
+	// CompressionLevel is the level of Compression, the default level of
+	// the algorithm when zero.
+	CompressionLevel int `json:"compressionLevel"`
 }
 
 // NewEncryptedBundle creates an Encrypted Bundle environment.
@@ -123,6 +577,11 @@ func (b *Bundle) Remove() error {
 			errors = append(errors, fmt.Sprintf("could not remove %q: %v", dir, err))
 		}
 	}
+	// the directories are unlocked once removed
+	for _, l := range b.locks {
+		ReleaseScratchLock(l)
+	}
+	b.locks = nil
 
 	if len(errors) > 0 {
 		return fmt.Errorf(strings.Join(errors, " "))
@@ -153,6 +612,48 @@ func canChown(rootfs string) (bool, error) {
 	return true, nil
 }
 
+// MkdirScratch creates a new scratch directory in dir, named as by
+// os.MkdirTemp with pattern, and returns it with the lock file held next to
+// it until ReleaseScratchLock. The lock file is created and locked before
+// the directory, which is thus never found unlocked by a concurrent scratch
+// cleanup. The PID of the build process is recorded in the lock file for
+// information.
+func MkdirScratch(dir, pattern string) (string, *os.File, error) {
+	for try := 0; try < 100; try++ {
+		l, err := os.CreateTemp(dir, pattern+"*"+ScratchLockSuffix)
+		if err != nil {
+			// a missing dir is reported as by os.MkdirTemp
+			if _, serr := os.Stat(dir); serr != nil {
+				return "", nil, serr
+			}
+			return "", nil, err
+		}
+		if err := unix.Flock(int(l.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+			ReleaseScratchLock(l)
+			return "", nil, fmt.Errorf("while locking %s: %v", l.Name(), err)
+		}
+		path := strings.TrimSuffix(l.Name(), ScratchLockSuffix)
+		if err := os.Mkdir(path, 0o700); os.IsExist(err) {
+			// a directory left without its lock file
+			ReleaseScratchLock(l)
+			continue
+		} else if err != nil {
+			ReleaseScratchLock(l)
+			return "", nil, err
+		}
+		fmt.Fprintf(l, "%d\n", os.Getpid())
+		return path, l, nil
+	}
+	return "", nil, fmt.Errorf("could not create a scratch directory in %s", dir)
+}
+
+// ReleaseScratchLock removes the lock file l of a scratch directory, and
+// releases the lock.
+func ReleaseScratchLock(l *os.File) {
+	os.Remove(l.Name())
+	l.Close()
+}
+
 func cleanupDir(path string) {
 	if err := os.Remove(path); err != nil {
 		sylog.Errorf("Could not cleanup dir %q: %v", path, err)
@@ -172,10 +673,23 @@ func cleanupDir(path string) {
 func newBundle(parentPath, tempDir string, keyInfo *cryptkey.KeyInfo) (*Bundle, error) {
 	rootfsPath := filepath.Join(parentPath, "rootfs")
 
-	tmpPath, err := os.MkdirTemp(tempDir, "bundle-temp-")
+	// the scratch directories created are locked, so they are not
+	// considered as orphaned by a concurrent scratch cleanup
+	var locks []*os.File
+	created := false
+	defer func() {
+		if !created {
+			for _, l := range locks {
+				ReleaseScratchLock(l)
+			}
+		}
+	}()
+
+	tmpPath, l, err := MkdirScratch(tempDir, "bundle-temp-")
 	if err != nil {
 		return nil, fmt.Errorf("could not create temp dir in %q: %v", tempDir, err)
 	}
+	locks = append(locks, l)
 	sylog.Debugf("Created temporary directory %q for the bundle", tmpPath)
 
 	if err := os.MkdirAll(rootfsPath, 0o755); err != nil {
@@ -199,11 +713,12 @@ func newBundle(parentPath, tempDir string, keyInfo *cryptkey.KeyInfo) (*Bundle,
 		// If the supplied rootfs was not inside tempDir (as is the case during a sandbox build),
 		// try tempDir as a fallback.
 		if !strings.HasPrefix(parentPath, tempDir) {
-			parentPath, err = os.MkdirTemp(tempDir, "build-temp-")
+			parentPath, l, err = MkdirScratch(tempDir, "build-temp-")
 			if err != nil {
 				cleanupDir(tmpPath)
 				return nil, fmt.Errorf("failed to create rootfs directory: %v", err)
 			}
+			locks = append(locks, l)
 			// Create an inner dir, so we don't clobber the secure permissions on the surrounding dir.
 			rootfsNewPath := filepath.Join(parentPath, "rootfs")
 			if err := os.Mkdir(rootfsNewPath, 0o755); err != nil {
@@ -233,8 +748,10 @@ func newBundle(parentPath, tempDir string, keyInfo *cryptkey.KeyInfo) (*Bundle,
 
 	sylog.Debugf("Created directory %q for the bundle", rootfsPath)
 
+	created = true
 	return &Bundle{
 		parentPath:  parentPath,
+		locks:       locks,
 		RootfsPath:  rootfsPath,
 		TmpDir:      tmpPath,
 		JSONObjects: make(map[string][]byte),
@@ -281,3 +798,106 @@ func FixPerms(rootfs string) (err error) {
 	}
 	return err
 }
+
+// NormalizeOwnership will work through the rootfs of this bundle, setting
+// the owner and group of any file or directory to root. The setuid/setgid
+// bits and file capabilities, cleared by the kernel when the ownership of a
+// file changes, are restored. Unprivileged, the ownership can't be changed
+// and nothing is done, the SIF assembler builds the squashfs image of the
+// rootfs with -all-root instead.
+func NormalizeOwnership(rootfs string) (err error) {
+	if syscall.Getuid() != 0 {
+		sylog.Debugf("Running unprivileged, the ownership of %s is normalized when assembled", rootfs)
+		return nil
+	}
+
+	errors := 0
+	err = fs.PermWalk(rootfs, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			sylog.Errorf("Unable to access rootfs path %s: %s", path, err)
+			errors++
+			return nil
+		}
+
+		st, ok := f.Sys().(*syscall.Stat_t)
+		if !ok || (st.Uid == 0 && st.Gid == 0) {
+			return nil
+		}
+		var capability []byte
+		if f.Mode().IsRegular() {
+			if size, err := unix.Lgetxattr(path, "security.capability", nil); err == nil && size > 0 {
+				capability = make([]byte, size)
+				if size, err = unix.Lgetxattr(path, "security.capability", capability); err == nil {
+					capability = capability[:size]
+				} else {
+					capability = nil
+				}
+			}
+		}
+		if err := os.Lchown(path, 0, 0); err != nil {
+			sylog.Errorf("Error setting ownership for %s: %s", path, err)
+			errors++
+			return nil
+		}
+		if f.Mode()&os.ModeSymlink == 0 && f.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			if err := os.Chmod(path, f.Mode()); err != nil {
+				sylog.Errorf("Error setting permission for %s: %s", path, err)
+				errors++
+			}
+		}
+		if capability != nil {
+			if err := unix.Lsetxattr(path, "security.capability", capability, 0); err != nil {
+				sylog.Errorf("Error setting capabilities for %s: %s", path, err)
+				errors++
+			}
+		}
+		return nil
+	})
+
+	if errors > 0 {
+		err = fmt.Errorf("%d errors were encountered when setting ownership", errors)
+	}
+	return err
+}
+
+// SourceDateEpoch returns the time set by the SOURCE_DATE_EPOCH environment
+// variable for reproducible builds, ok is false when the variable is not set.
+func SourceDateEpoch() (epoch time.Time, ok bool, err error) {
+	v, ok := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if !ok || v == "" {
+		return time.Time{}, false, nil
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || sec < 0 {
+		return time.Time{}, false, fmt.Errorf("invalid SOURCE_DATE_EPOCH value %q", v)
+	}
+	return time.Unix(sec, 0), true, nil
+}
+
+// ClampMtimes will work through the rootfs of this bundle, setting the
+// modification time of any file or directory newer than epoch to epoch, so
+// that the extraction time doesn't leak into the container content.
+func ClampMtimes(rootfs string, epoch time.Time) (err error) {
+	ts := []unix.Timespec{unix.NsecToTimespec(epoch.UnixNano()), unix.NsecToTimespec(epoch.UnixNano())}
+	errors := 0
+	err = fs.PermWalk(rootfs, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			sylog.Errorf("Unable to access rootfs path %s: %s", path, err)
+			errors++
+			return nil
+		}
+
+		if f.ModTime().After(epoch) {
+			if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				sylog.Errorf("Error setting modification time for %s: %s", path, err)
+				errors++
+			}
+		}
+		return nil
+	})
+
+	if errors > 0 {
+		err = fmt.Errorf("%d errors were encountered when setting modification times", errors)
+	}
+	return err
+}
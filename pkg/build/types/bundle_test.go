@@ -13,7 +13,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
 )
 
 func TestNewBundle(t *testing.T) {
@@ -65,6 +68,15 @@ func TestNewBundle(t *testing.T) {
 				if err != nil {
 					t.Errorf("TmpDir stat failed: %v", err)
 				}
+				// the scratch dir is locked, with its lock file kept out of it
+				_, err = os.Stat(b.TmpDir + ScratchLockSuffix)
+				if err != nil {
+					t.Errorf("TmpDir lock file stat failed: %v", err)
+				}
+				entries, err := os.ReadDir(b.TmpDir)
+				if err != nil || len(entries) != 0 {
+					t.Errorf("unexpected TmpDir content %v: %v", entries, err)
+				}
 
 				if err := b.Remove(); err != nil {
 					t.Errorf("Could not remove bundle: %v", err)
@@ -79,6 +91,10 @@ func TestNewBundle(t *testing.T) {
 				if !os.IsNotExist(err) {
 					t.Errorf("TmpDir was not removed: %v", err)
 				}
+				_, err = os.Stat(b.TmpDir + ScratchLockSuffix)
+				if !os.IsNotExist(err) {
+					t.Errorf("TmpDir lock file was not removed: %v", err)
+				}
 			}
 		})
 	}
@@ -132,3 +148,28 @@ func TestBundle_RunSections(t *testing.T) {
 		})
 	}
 }
+
+func TestNormalizeOwnershipUnprivileged(t *testing.T) {
+	test.DropPrivilege(t)
+	defer test.ResetPrivilege(t)
+
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "opt"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "opt", "data"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ownership is left to the assembler
+	if err := NormalizeOwnership(rootfs); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fi, err := os.Lstat(filepath.Join(rootfs, "opt", "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid := fi.Sys().(*syscall.Stat_t).Uid; int(uid) != os.Getuid() {
+		t.Errorf("opt/data owned by %d, want %d", uid, os.Getuid())
+	}
+}
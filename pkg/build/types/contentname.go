@@ -0,0 +1,192 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// contentKeyVersion is the version of the content key of the images, to
+// change along with contentKey so that the names of the images built by
+// a previous version don't match.
+const contentKeyVersion = 1
+
+// ContentSource is a stage of a build for ContentAddressedName, its
+// definition and the resolved digest of its source, e.g. the manifest
+// digest of an oci/docker source, empty for a scratch source.
+type ContentSource struct {
+	Definition Definition
+	Digest     string
+}
+
+// contentStage is a stage of contentKey.
+type contentStage struct {
+	Header map[string]string `json:"header"`
+	Raw    []byte            `json:"raw"`
+	Digest string            `json:"digest"`
+}
+
+// contentOptions are the options of contentKey, those affecting the
+// content of the built image.
+type contentOptions struct {
+	Sections           []string          `json:"sections"`
+	MergeSources       []string          `json:"mergeSources"`
+	FixPerms           bool              `json:"fixPerms"`
+	NormalizeOwnership bool              `json:"normalizeOwnership"`
+	IncludePaths       []string          `json:"includePaths"`
+	Provenance         bool              `json:"provenance"`
+	LayerHistory       bool              `json:"layerHistory"`
+	BuildProvenance    bool              `json:"buildProvenance"`
+	SBOM               bool              `json:"sbom"`
+	PreserveManifest   bool              `json:"preserveManifest"`
+	Healthcheck        bool              `json:"healthcheck"`
+	TestScript         string            `json:"testScriptDigest"`
+	PrunePatterns      []string          `json:"prunePatterns"`
+	PruneProfile       string            `json:"pruneProfile"`
+	PruneDryRun        bool              `json:"pruneDryRun"`
+	NormalizeNetFiles  string            `json:"normalizeNetFiles"`
+	NormalizeEnv       bool              `json:"normalizeEnv"`
+	MaxFileSize        int64             `json:"maxFileSize"`
+	OversizedFiles     string            `json:"oversizedFiles"`
+	UnknownMediaTypes  string            `json:"unknownMediaTypes"`
+	DanglingHardlinks  string            `json:"danglingHardlinks"`
+	SymlinkLoops       string            `json:"symlinkLoops"`
+	SELinuxLabels      string            `json:"selinuxLabels"`
+	InjectFiles        []InjectedFile    `json:"injectFiles"`
+	TemplateFiles      []string          `json:"templateFiles"`
+	TemplateVars       map[string]string `json:"templateVars"`
+	NoTest             bool              `json:"noTest"`
+	Encrypted          bool              `json:"encrypted"`
+	Arch               string            `json:"arch"`
+	Platform           string            `json:"platform"`
+	ArchVariant        string            `json:"archVariant"`
+	Compression        string            `json:"compression"`
+	CompressionLevel   int               `json:"compressionLevel"`
+	Fakeroot           bool              `json:"fakeroot"`
+	Unprivilege        bool              `json:"unprivilege"`
+	ACLs               string            `json:"acls"`
+	KeepDirlinks       bool              `json:"keepDirlinks"`
+	ExtractUIDMap      []string          `json:"extractUIDMap"`
+	ExtractGIDMap      []string          `json:"extractGIDMap"`
+}
+
+// contentKey is what the content-addressed name of an image is derived
+// from, encoded in JSON.
+type contentKey struct {
+	Version int            `json:"version"`
+	Format  string         `json:"format"`
+	Stages  []contentStage `json:"stages"`
+	Options contentOptions `json:"options"`
+}
+
+// ContentAddressedName returns the file name of the image built in the
+// format, e.g. sif or sandbox, from the stages, with opts. The name is
+// derived from the definitions of the stages, the resolved digests of
+// their sources and the options affecting the content of the image, not
+// from the paths of the build, e.g. TmpDir, so that identical builds get
+// the same name, e.g. sha256-<hex>.sif. The content of the TestScript
+// option is part of the name, the files copied from the host by the
+// definitions aren't.
+func ContentAddressedName(stages []ContentSource, format string, opts Options) (string, error) {
+	if len(stages) == 0 {
+		return "", fmt.Errorf("no stage to derive a content-addressed name from")
+	}
+	if len(opts.TarFilters) > 0 || opts.RootfsFS != nil {
+		return "", fmt.Errorf("content-addressed names are not supported with tar filters or a rootfs filesystem")
+	}
+	if opts.Platform == PlatformAll {
+		return "", fmt.Errorf("content-addressed names are not supported with the %s platform", PlatformAll)
+	}
+
+	var ext string
+	switch format {
+	case "sif":
+		ext = ".sif"
+	case "oci-archive":
+		ext = ".tar"
+	case "sandbox", "oci-layout":
+	default:
+		return "", fmt.Errorf("unrecognized output format %q", format)
+	}
+
+	var testScript string
+	if opts.TestScript != "" {
+		data, err := os.ReadFile(opts.TestScript)
+		if err != nil {
+			return "", fmt.Errorf("while reading test script: %s", err)
+		}
+		sum := sha256.Sum256(data)
+		testScript = hex.EncodeToString(sum[:])
+	}
+
+	key := contentKey{
+		Version: contentKeyVersion,
+		Format:  format,
+		Options: contentOptions{
+			Sections:           opts.Sections,
+			MergeSources:       opts.MergeSources,
+			FixPerms:           opts.FixPerms,
+			NormalizeOwnership: opts.NormalizeOwnership,
+			IncludePaths:       opts.IncludePaths,
+			Provenance:         opts.Provenance,
+			LayerHistory:       opts.LayerHistory,
+			BuildProvenance:    opts.BuildProvenance,
+			SBOM:               opts.SBOM,
+			PreserveManifest:   opts.PreserveManifest,
+			Healthcheck:        opts.Healthcheck,
+			TestScript:         testScript,
+			PrunePatterns:      opts.PrunePatterns,
+			PruneProfile:       opts.PruneProfile,
+			PruneDryRun:        opts.PruneDryRun,
+			NormalizeNetFiles:  opts.NormalizeNetFiles,
+			NormalizeEnv:       opts.NormalizeEnv,
+			MaxFileSize:        opts.MaxFileSize,
+			OversizedFiles:     opts.OversizedFiles,
+			UnknownMediaTypes:  opts.UnknownMediaTypes,
+			DanglingHardlinks:  opts.DanglingHardlinks,
+			SymlinkLoops:       opts.SymlinkLoops,
+			SELinuxLabels:      opts.SELinuxLabels,
+			InjectFiles:        opts.InjectFiles,
+			TemplateFiles:      opts.TemplateFiles,
+			TemplateVars:       opts.TemplateVars,
+			NoTest:             opts.NoTest,
+			Encrypted:          opts.EncryptionKeyInfo != nil,
+			Arch:               opts.Arch,
+			Platform:           opts.Platform,
+			ArchVariant:        opts.ArchVariant,
+			Compression:        opts.Compression,
+			CompressionLevel:   opts.CompressionLevel,
+			Fakeroot:           opts.Fakeroot,
+			Unprivilege:        opts.Unprivilege,
+			ACLs:               opts.ACLs,
+			KeepDirlinks:       opts.KeepDirlinks,
+			ExtractUIDMap:      opts.ExtractUIDMap,
+			ExtractGIDMap:      opts.ExtractGIDMap,
+		},
+	}
+	for _, s := range stages {
+		key.Stages = append(key.Stages, contentStage{
+			Header: s.Definition.Header,
+			Raw:    s.Definition.Raw,
+			Digest: s.Digest,
+		})
+	}
+
+	// the keys of the maps are sorted by the encoding
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", fmt.Errorf("while encoding content key: %s", err)
+	}
+	sum := sha256.Sum256(data)
+	return "sha256-" + hex.EncodeToString(sum[:]) + ext, nil
+}
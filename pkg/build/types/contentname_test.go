@@ -0,0 +1,154 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/apptainer/apptainer/pkg/util/cryptkey"
+)
+
+func TestContentAddressedName(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	stages := func(digest string) []ContentSource {
+		return []ContentSource{{
+			Definition: Definition{
+				Header: map[string]string{"bootstrap": "docker", "from": "alpine:3.18"},
+				Raw:    []byte("bootstrap: docker\nfrom: alpine:3.18\n"),
+			},
+			Digest: digest,
+		}}
+	}
+	opts := func() Options {
+		return Options{
+			Sections:         []string{"all"},
+			TemplateVars:     map[string]string{"b": "2", "a": "1"},
+			CompressionLevel: 3,
+		}
+	}
+
+	name, err := ContentAddressedName(stages(digest), "sif", opts())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !regexp.MustCompile(`^sha256-[0-9a-f]{64}\.sif$`).MatchString(name) {
+		t.Errorf("unexpected name %q", name)
+	}
+
+	// the paths of the build aren't part of the name
+	same := opts()
+	same.TmpDir = "/var/tmp"
+	same.LogFile = "/tmp/build.log"
+	same.NoCleanUp = true
+	same.TemplateVars = map[string]string{"a": "1", "b": "2"}
+	if other, err := ContentAddressedName(stages(digest), "sif", same); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if other != name {
+		t.Errorf("equivalent builds have different names %q and %q", name, other)
+	}
+
+	tests := []struct {
+		name   string
+		stages []ContentSource
+		format string
+		opts   func(*Options)
+	}{
+		{name: "digest", stages: stages("sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"), format: "sif"},
+		{name: "format", stages: stages(digest), format: "oci-archive"},
+		{name: "fix perms", stages: stages(digest), format: "sif", opts: func(o *Options) { o.FixPerms = true }},
+		{name: "compression", stages: stages(digest), format: "sif", opts: func(o *Options) { o.CompressionLevel = 9 }},
+		{name: "template vars", stages: stages(digest), format: "sif", opts: func(o *Options) { o.TemplateVars["a"] = "3" }},
+		{name: "platform", stages: stages(digest), format: "sif", opts: func(o *Options) { o.Platform = "linux/arm64" }},
+		{name: "encryption", stages: stages(digest), format: "sif", opts: func(o *Options) { o.EncryptionKeyInfo = &cryptkey.KeyInfo{} }},
+		{name: "fakeroot", stages: stages(digest), format: "sif", opts: func(o *Options) { o.Fakeroot = true }},
+		{name: "unprivilege", stages: stages(digest), format: "sif", opts: func(o *Options) { o.Unprivilege = true }},
+		{name: "acls", stages: stages(digest), format: "sif", opts: func(o *Options) { o.ACLs = ACLPreserve }},
+		{name: "keep dirlinks", stages: stages(digest), format: "sif", opts: func(o *Options) { o.KeepDirlinks = true }},
+		{name: "extract uid map", stages: stages(digest), format: "sif", opts: func(o *Options) { o.ExtractUIDMap = []string{"0:1000:1"} }},
+		{name: "extract gid map", stages: stages(digest), format: "sif", opts: func(o *Options) { o.ExtractGIDMap = []string{"0:1000:1"} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := opts()
+			if tt.opts != nil {
+				tt.opts(&o)
+			}
+			other, err := ContentAddressedName(tt.stages, tt.format, o)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if other == name {
+				t.Errorf("different builds have the same name %q", name)
+			}
+		})
+	}
+
+	for _, format := range []string{"sandbox", "oci-layout"} {
+		if name, err := ContentAddressedName(stages(digest), format, opts()); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if !regexp.MustCompile(`^sha256-[0-9a-f]{64}$`).MatchString(name) {
+			t.Errorf("unexpected %s name %q", format, name)
+		}
+	}
+
+	if _, err := ContentAddressedName(stages(digest), "squashfs", opts()); err == nil {
+		t.Errorf("unexpected success with an unknown format")
+	}
+	if _, err := ContentAddressedName(nil, "sif", opts()); err == nil {
+		t.Errorf("unexpected success without stages")
+	}
+	all := opts()
+	all.Platform = PlatformAll
+	if _, err := ContentAddressedName(stages(digest), "sif", all); err == nil {
+		t.Errorf("unexpected success with the %s platform", PlatformAll)
+	}
+}
+
+func TestContentAddressedNameTestScript(t *testing.T) {
+	stages := []ContentSource{{Definition: Definition{Header: map[string]string{"bootstrap": "scratch"}}}}
+	name := func(path string) string {
+		t.Helper()
+		name, err := ContentAddressedName(stages, "sif", Options{TestScript: path})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return name
+	}
+	write := func(content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "test.sh")
+		if err := os.WriteFile(path, []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// the name is derived from the content of the test script, not its path
+	first := name(write("#!/bin/sh\ntrue\n"))
+	if other := name(write("#!/bin/sh\ntrue\n")); other != first {
+		t.Errorf("identical test scripts have different names %q and %q", first, other)
+	}
+	path := write("#!/bin/sh\nfalse\n")
+	if other := name(path); other == first {
+		t.Errorf("different test scripts have the same name %q", first)
+	}
+	if err := os.WriteFile(path, []byte("#!/bin/sh\ntrue\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if other := name(path); other != first {
+		t.Errorf("the name %q doesn't follow the content of the test script, want %q", other, first)
+	}
+
+	if _, err := ContentAddressedName(stages, "sif", Options{TestScript: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Errorf("unexpected success with a missing test script")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// The types of the failures of a build source.
+const (
+	// SourceErrorReference is an invalid source reference.
+	SourceErrorReference = "reference"
+	// SourceErrorFetch is a failure to fetch the image of the source.
+	SourceErrorFetch = "fetch"
+	// SourceErrorManifest is an invalid or unsupported manifest or config.
+	SourceErrorManifest = "manifest"
+	// SourceErrorLayer is a failure to extract a layer of the image.
+	SourceErrorLayer = "layer"
+	// SourceErrorRootfs is a failure to finalize the extracted rootfs.
+	SourceErrorRootfs = "rootfs"
+	// SourceErrorOther is any other failure of the build source.
+	SourceErrorOther = "source"
+	// BuildError is a build failure which isn't a failure of the source.
+	BuildError = "build"
+)
+
+// SourceError is a failure of a build source, with its context.
+type SourceError struct {
+	// Type is one of the SourceError* types.
+	Type string
+	// Source is the reference of the build source, e.g. docker://alpine.
+	Source string
+	// Layer is the digest of the layer extracted, if any.
+	Layer digest.Digest
+	// Path is the path of the layer entry extracted, if any.
+	Path string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *SourceError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorDocument is the JSON document describing a build failure, written
+// with the --json-errors build option.
+type ErrorDocument struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	Source  string `json:"source,omitempty"`
+	Layer   string `json:"layer,omitempty"`
+	Path    string `json:"path,omitempty"`
+}
+
+// NewErrorDocument returns the document describing the build failure err,
+// with the context of the SourceError it wraps, if any.
+func NewErrorDocument(err error) ErrorDocument {
+	doc := ErrorDocument{Type: BuildError, Message: err.Error()}
+	var se *SourceError
+	if errors.As(err, &se) {
+		doc.Type = se.Type
+		doc.Source = se.Source
+		doc.Layer = se.Layer.String()
+		doc.Path = se.Path
+	}
+	return doc
+}
+
+// WriteErrorDocument writes the document describing the build failure err
+// to w, as a single line of JSON.
+func WriteErrorDocument(w io.Writer, buildErr error) error {
+	data, err := json.Marshal(NewErrorDocument(buildErr))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,56 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestWriteErrorDocument(t *testing.T) {
+	layer := digest.FromString("layer")
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "source error",
+			err: fmt.Errorf("conveyor failed to get: %w", &SourceError{
+				Type:   SourceErrorLayer,
+				Source: "docker://alpine",
+				Layer:  layer,
+				Path:   "/etc/passwd",
+				Err:    errors.New("no space left on device"),
+			}),
+			want: `{"type":"layer","message":"conveyor failed to get: no space left on device","source":"docker://alpine","layer":"` + layer.String() + `","path":"/etc/passwd"}` + "\n",
+		},
+		{
+			name: "build error",
+			err:  errors.New("failed to execute %test script"),
+			want: `{"type":"build","message":"failed to execute %test script"}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteErrorDocument(&buf, tt.err); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("unexpected document:\n\thave: %s\twant: %s", buf.String(), tt.want)
+			}
+		})
+	}
+}
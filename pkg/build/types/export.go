@@ -0,0 +1,132 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/apptainer/apptainer/internal/pkg/util/fs"
+	"github.com/apptainer/apptainer/pkg/sylog"
+)
+
+// ExportTarOptions are the options of ExportRootfsTar.
+type ExportTarOptions struct {
+	// ModTime is the modification time of all the entries of the tarball.
+	// When zero, the time set by SOURCE_DATE_EPOCH is used, or the Unix
+	// epoch if the variable is not set.
+	ModTime time.Time
+	// KeepOwnership keeps the uid/gid of the files of the rootfs, instead
+	// of setting them to root.
+	KeepOwnership bool
+}
+
+// ExportRootfsTar writes the content of rootfs to w as a reproducible tar
+// stream: the entries are sorted by path, their modification times and
+// ownership are normalized according to opts, and they don't hold user or
+// group names, access or change times. The hard links of the rootfs are
+// kept, pointing at the first of their paths. Sockets are skipped, and the
+// extended attributes of the files are not exported.
+func ExportRootfsTar(rootfs string, w io.Writer, opts ExportTarOptions) error {
+	modTime := opts.ModTime
+	if modTime.IsZero() {
+		epoch, ok, err := SourceDateEpoch()
+		if err != nil {
+			return err
+		}
+		modTime = time.Unix(0, 0)
+		if ok {
+			modTime = epoch
+		}
+	}
+	modTime = modTime.Truncate(time.Second)
+
+	type inode struct {
+		dev, ino uint64
+	}
+	links := make(map[inode]string)
+
+	tw := tar.NewWriter(w)
+	err := fs.PermWalkRaiseError(rootfs, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		} else if name == "." {
+			return nil
+		}
+		if f.Mode()&os.ModeSocket != 0 {
+			sylog.Debugf("Skipping socket %s", name)
+			return nil
+		}
+
+		var target string
+		if f.Mode()&os.ModeSymlink != 0 {
+			if target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(f, target)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if f.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Format = tar.FormatPAX
+		hdr.ModTime = modTime
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+		hdr.Uname = ""
+		hdr.Gname = ""
+		if !opts.KeepOwnership {
+			hdr.Uid = 0
+			hdr.Gid = 0
+		}
+
+		if st, ok := f.Sys().(*syscall.Stat_t); ok && f.Mode().IsRegular() && st.Nlink > 1 {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if first, ok := links[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[key] = hdr.Name
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := io.Copy(tw, file); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("while exporting rootfs %s: %s", rootfs, err)
+	}
+	return tw.Close()
+}
@@ -0,0 +1,115 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportRootfsTar(t *testing.T) {
+	rootfs := t.TempDir()
+	for _, dir := range []string{"usr/bin", "etc"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0o755); err != nil {
+			t.Fatalf("while creating %s: %s", dir, err)
+		}
+	}
+	for name, content := range map[string]string{"etc/hostname": "host", "usr/bin/tool": "tool"} {
+		if err := os.WriteFile(filepath.Join(rootfs, name), []byte(content), 0o755); err != nil {
+			t.Fatalf("while writing %s: %s", name, err)
+		}
+	}
+	if err := os.Link(filepath.Join(rootfs, "usr/bin/tool"), filepath.Join(rootfs, "usr/bin/alias")); err != nil {
+		t.Fatalf("while creating hard link: %s", err)
+	}
+	if err := os.Symlink("usr/bin", filepath.Join(rootfs, "bin")); err != nil {
+		t.Fatalf("while creating symlink: %s", err)
+	}
+
+	export := func(opts ExportTarOptions) []byte {
+		var buf bytes.Buffer
+		if err := ExportRootfsTar(rootfs, &buf, opts); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return buf.Bytes()
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	first := export(ExportTarOptions{})
+	// the modification and access times of the rootfs don't change the
+	// tarball
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(rootfs, "etc/hostname"), now, now); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if second := export(ExportTarOptions{}); !bytes.Equal(first, second) {
+		t.Fatalf("exports of the same rootfs differ")
+	}
+
+	type entry struct {
+		name     string
+		typeflag byte
+		linkname string
+	}
+	var entries []entry
+	tr := tar.NewReader(bytes.NewReader(first))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		entries = append(entries, entry{hdr.Name, hdr.Typeflag, hdr.Linkname})
+		if !hdr.ModTime.Equal(time.Unix(0, 0)) || hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("%s: unexpected metadata %+v", hdr.Name, hdr)
+		}
+	}
+	want := []entry{
+		{"bin", tar.TypeSymlink, "usr/bin"},
+		{"etc/", tar.TypeDir, ""},
+		{"etc/hostname", tar.TypeReg, ""},
+		{"usr/", tar.TypeDir, ""},
+		{"usr/bin/", tar.TypeDir, ""},
+		{"usr/bin/alias", tar.TypeReg, ""},
+		{"usr/bin/tool", tar.TypeLink, "usr/bin/alias"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("unexpected entries:\n\thave: %v\n\twant: %v", entries, want)
+	}
+
+	// SOURCE_DATE_EPOCH sets the modification times when ModTime isn't set
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	tr = tar.NewReader(bytes.NewReader(export(ExportTarOptions{})))
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !hdr.ModTime.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("unexpected modification time %s", hdr.ModTime)
+	}
+	tr = tar.NewReader(bytes.NewReader(export(ExportTarOptions{ModTime: time.Unix(1000, 0)})))
+	if hdr, err = tr.Next(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !hdr.ModTime.Equal(time.Unix(1000, 0)) {
+		t.Errorf("unexpected modification time %s", hdr.ModTime)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "invalid")
+	if err := ExportRootfsTar(rootfs, io.Discard, ExportTarOptions{}); err == nil {
+		t.Errorf("unexpected success with an invalid SOURCE_DATE_EPOCH")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerHistoryEntry is an entry of the history of an OCI image config,
+// along with the layer it created.
+type LayerHistoryEntry struct {
+	// Layer is the digest of the layer created, empty for the entries
+	// which didn't create a layer, e.g. setting the environment.
+	Layer digest.Digest `json:"layer,omitempty"`
+	// Created is the creation time of the layer, if known.
+	Created *time.Time `json:"created,omitempty"`
+	// CreatedBy is the command which created the layer.
+	CreatedBy string `json:"createdBy,omitempty"`
+	// Author is the author of the layer.
+	Author string `json:"author,omitempty"`
+	// Comment is the comment recorded with the layer.
+	Comment string `json:"comment,omitempty"`
+	// EmptyLayer is set when the entry didn't create a layer.
+	EmptyLayer bool `json:"emptyLayer,omitempty"`
+}
+
+// LayerHistory is the history of the layers of an OCI image, from its base
+// layer, as stored in the SIF image layer history metadata.
+type LayerHistory []LayerHistoryEntry
+
+// NewLayerHistory correlates the entries of the history of an image config
+// to the layers of its manifest, the entries marked as empty layers not
+// creating any. It fails when the history doesn't create as many layers as
+// the manifest holds.
+func NewLayerHistory(history []imgspecv1.History, layers []digest.Digest) (LayerHistory, error) {
+	h := make(LayerHistory, 0, len(history))
+	next := 0
+	for _, e := range history {
+		entry := LayerHistoryEntry{
+			Created:    e.Created,
+			CreatedBy:  e.CreatedBy,
+			Author:     e.Author,
+			Comment:    e.Comment,
+			EmptyLayer: e.EmptyLayer,
+		}
+		if !e.EmptyLayer {
+			if next == len(layers) {
+				return nil, fmt.Errorf("the image history creates more than the %d layers of the image", len(layers))
+			}
+			entry.Layer = layers[next]
+			next++
+		}
+		h = append(h, entry)
+	}
+	if next != len(layers) {
+		return nil, fmt.Errorf("the image history creates %d of the %d layers of the image", next, len(layers))
+	}
+	return h, nil
+}
+
+// ParseLayerHistory decodes a layer history, as stored in the SIF image
+// layer history metadata.
+func ParseLayerHistory(data []byte) (LayerHistory, error) {
+	var h LayerHistory
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("while decoding layer history: %w", err)
+	}
+	return h, nil
+}
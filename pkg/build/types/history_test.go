@@ -0,0 +1,75 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestNewLayerHistory(t *testing.T) {
+	l1 := digest.FromString("layer1")
+	l2 := digest.FromString("layer2")
+
+	tests := []struct {
+		name       string
+		history    []imgspecv1.History
+		layers     []digest.Digest
+		wantLayers []digest.Digest
+		wantError  string
+	}{
+		{
+			name: "empty layers",
+			history: []imgspecv1.History{
+				{CreatedBy: "ADD rootfs.tar /"},
+				{CreatedBy: "ENV PATH=/bin", EmptyLayer: true},
+				{CreatedBy: "RUN make install"},
+				{CreatedBy: "CMD [\"sh\"]", EmptyLayer: true},
+			},
+			layers:     []digest.Digest{l1, l2},
+			wantLayers: []digest.Digest{l1, "", l2, ""},
+		},
+		{
+			name:      "missing history",
+			history:   []imgspecv1.History{{CreatedBy: "ADD rootfs.tar /"}},
+			layers:    []digest.Digest{l1, l2},
+			wantError: "the image history creates 1 of the 2 layers of the image",
+		},
+		{
+			name:      "extra history",
+			history:   []imgspecv1.History{{CreatedBy: "ADD rootfs.tar /"}, {CreatedBy: "RUN true"}},
+			layers:    []digest.Digest{l1},
+			wantError: "the image history creates more than the 1 layers of the image",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewLayerHistory(tt.history, tt.layers)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("unexpected error: %v, want %q", err, tt.wantError)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(h) != len(tt.wantLayers) {
+				t.Fatalf("unexpected history %+v", h)
+			}
+			for i, e := range h {
+				if e.Layer != tt.wantLayers[i] || e.CreatedBy != tt.history[i].CreatedBy || e.EmptyLayer != tt.history[i].EmptyLayer {
+					t.Errorf("unexpected entry %d: %+v", i, e)
+				}
+			}
+		})
+	}
+}
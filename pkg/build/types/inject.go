@@ -0,0 +1,99 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/apptainer/apptainer/pkg/sylog"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"golang.org/x/sys/unix"
+)
+
+// InjectedFile is a file or directory injected into a root filesystem, see
+// Options.InjectFiles.
+type InjectedFile struct {
+	// Path is the path of the file in the root filesystem, e.g.
+	// /etc/site.conf. Its missing parent directories are created with the
+	// 0755 mode, owned by root.
+	Path string `json:"path"`
+	// Dir injects a directory instead of a regular file.
+	Dir bool `json:"dir,omitempty"`
+	// Content is the content of the regular file.
+	Content []byte `json:"content,omitempty"`
+	// Mode holds the permission bits of the file, and its setuid, setgid
+	// and sticky bits, as for chmod, e.g. 0o4755.
+	Mode uint32 `json:"mode"`
+	// UID and GID are the owner of the file. An unprivileged build, which
+	// can't give its files to another user, keeps the file owned by its
+	// user with a warning.
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// InjectFiles writes the files into the root filesystem rootfs, in order,
+// replacing the files already at their paths. A directory already at the
+// path of an injected directory is kept, with the mode and owner of the
+// injected one.
+func InjectFiles(rootfs string, files []InjectedFile) error {
+	for _, f := range files {
+		if err := injectFile(rootfs, f); err != nil {
+			return fmt.Errorf("while injecting %s: %s", f.Path, err)
+		}
+	}
+	return nil
+}
+
+func injectFile(rootfs string, f InjectedFile) error {
+	if f.Mode&^uint32(unix.S_ISUID|unix.S_ISGID|unix.S_ISVTX|0o777) != 0 {
+		return fmt.Errorf("invalid mode %#o", f.Mode)
+	}
+	rel := filepath.Clean("/" + f.Path)
+	path := rootfs
+	if rel != "/" {
+		// the symlinks of the parents are resolved within the root filesystem
+		parent, err := securejoin.SecureJoin(rootfs, filepath.Dir(rel))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0o755); err != nil {
+			return err
+		}
+		path = filepath.Join(parent, filepath.Base(rel))
+	} else if !f.Dir {
+		return fmt.Errorf("the root directory can't be replaced by a file")
+	}
+
+	fi, err := os.Lstat(path)
+	if err == nil && (!f.Dir || !fi.IsDir()) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if f.Dir {
+		if err := os.Mkdir(path, 0o700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	} else if err := os.WriteFile(path, f.Content, 0o600); err != nil {
+		return err
+	}
+	// chown clears the setuid and setgid bits, the mode is set last
+	if err := os.Lchown(path, f.UID, f.GID); errors.Is(err, unix.EPERM) && os.Geteuid() != 0 {
+		sylog.Warningf("Can't set the owner of %s to %d:%d in an unprivileged build, keeping the owner of the build user", rel, f.UID, f.GID)
+	} else if err != nil {
+		return err
+	}
+	return unix.Chmod(path, f.Mode)
+}
@@ -0,0 +1,132 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+)
+
+func TestInjectFiles(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "usr/bin"), 0o755); err != nil {
+		t.Fatalf("while creating usr/bin: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "usr/bin/tool"), []byte("old"), 0o755); err != nil {
+		t.Fatalf("while writing usr/bin/tool: %s", err)
+	}
+	// a parent symlink pointing out of the rootfs is resolved within it
+	if err := os.Symlink("/usr/bin", filepath.Join(rootfs, "bin")); err != nil {
+		t.Fatalf("while creating bin: %s", err)
+	}
+
+	files := []InjectedFile{
+		{Path: "/usr/bin/tool", Content: []byte("new"), Mode: 0o4755},
+		{Path: "bin/helper", Content: []byte("helper"), Mode: 0o700, UID: 1000, GID: 1000},
+		{Path: "/opt/site/data", Dir: true, Mode: 0o1770, GID: 100},
+	}
+	if err := InjectFiles(rootfs, files); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		path    string
+		mode    os.FileMode
+		uid     uint32
+		gid     uint32
+		content string
+	}{
+		{path: "usr/bin/tool", mode: os.ModeSetuid | 0o755, content: "new"},
+		{path: "usr/bin/helper", mode: 0o700, uid: 1000, gid: 1000, content: "helper"},
+		{path: "opt", mode: os.ModeDir | 0o755},
+		{path: "opt/site/data", mode: os.ModeDir | os.ModeSticky | 0o770, gid: 100},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(rootfs, tt.path)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		if fi.Mode() != tt.mode {
+			t.Errorf("%s: unexpected mode %s, want %s", tt.path, fi.Mode(), tt.mode)
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Uid != tt.uid || st.Gid != tt.gid {
+			t.Errorf("%s: unexpected owner %d:%d, want %d:%d", tt.path, st.Uid, st.Gid, tt.uid, tt.gid)
+		}
+		if tt.content == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if string(data) != tt.content {
+			t.Errorf("%s: unexpected content %q, want %q", tt.path, data, tt.content)
+		}
+	}
+
+	for _, f := range []InjectedFile{
+		{Path: "/etc/file", Mode: 0o10644},
+		{Path: "/", Mode: 0o644},
+	} {
+		if err := InjectFiles(rootfs, []InjectedFile{f}); err == nil {
+			t.Errorf("unexpected success injecting %s with mode %#o", f.Path, f.Mode)
+		}
+	}
+}
+
+func TestInjectFilesUnprivileged(t *testing.T) {
+	// the parents of t.TempDir aren't accessible to the unprivileged user
+	rootfs, err := os.MkdirTemp("", "inject-")
+	if err != nil {
+		t.Fatalf("while creating the rootfs: %s", err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	test.DropPrivilege(t)
+	uid, gid := os.Geteuid(), os.Getegid()
+	test.ResetPrivilege(t)
+	if err := os.Chown(rootfs, uid, gid); err != nil {
+		t.Fatalf("while changing the owner of the rootfs: %s", err)
+	}
+
+	test.DropPrivilege(t)
+	defer test.ResetPrivilege(t)
+
+	// the files are kept owned by the user instead of failing the build
+	files := []InjectedFile{
+		{Path: "/etc/site.conf", Content: []byte("site"), Mode: 0o644},
+		{Path: "/opt/data", Dir: true, Mode: 0o750, UID: 1000, GID: 1000},
+	}
+	if err := InjectFiles(rootfs, files); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, f := range files {
+		path := filepath.Join(rootfs, f.Path)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		if fi.Mode().Perm() != os.FileMode(f.Mode) {
+			t.Errorf("%s: unexpected mode %s, want %#o", f.Path, fi.Mode(), f.Mode)
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if int(st.Uid) != uid {
+			t.Errorf("%s: unexpected owner %d, want %d", f.Path, st.Uid, uid)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import "sync"
+
+// ManifestCache caches the manifests of oci/docker sources fetched during a
+// build, see Options.ManifestCache, so that the operations of a build
+// reading the manifest of its source, e.g. the resolution of the platform,
+// the fetch of the image and the read of its config, fetch it only once.
+// The keys are the references of the images, followed by @ and the digest
+// of the instance for the manifests of the images of an index. As the
+// reference of a tag maps to a manifest which changes, a cache is scoped to
+// a build. A cache is used concurrently.
+type ManifestCache interface {
+	// GetManifest returns the manifest of key and its media type, when
+	// cached.
+	GetManifest(key string) (data []byte, mediaType string, ok bool)
+	// PutManifest caches the manifest of key and its media type.
+	PutManifest(key string, data []byte, mediaType string)
+}
+
+// cachedManifest is a manifest of a MemoryManifestCache.
+type cachedManifest struct {
+	data      []byte
+	mediaType string
+}
+
+// MemoryManifestCache is a ManifestCache holding the manifests in memory.
+type MemoryManifestCache struct {
+	mu        sync.Mutex
+	manifests map[string]cachedManifest
+}
+
+// NewMemoryManifestCache returns an empty MemoryManifestCache.
+func NewMemoryManifestCache() *MemoryManifestCache {
+	return &MemoryManifestCache{manifests: make(map[string]cachedManifest)}
+}
+
+// GetManifest returns the manifest of key and its media type, when cached.
+func (c *MemoryManifestCache) GetManifest(key string) ([]byte, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m, ok := c.manifests[key]
+	return m.data, m.mediaType, ok
+}
+
+// PutManifest caches the manifest of key and its media type.
+func (c *MemoryManifestCache) PutManifest(key string, data []byte, mediaType string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.manifests[key] = cachedManifest{data: data, mediaType: mediaType}
+}
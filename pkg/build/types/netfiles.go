@@ -0,0 +1,71 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+)
+
+const (
+	// NetFilesEmpty normalizes the network files of a root filesystem to
+	// empty files.
+	NetFilesEmpty = "empty"
+	// NetFilesTemplate normalizes the network files of a root filesystem to
+	// a minimal content, resolving localhost without any bind mount.
+	NetFilesTemplate = "template"
+)
+
+// netFiles are the network files of the root filesystem bound from the host
+// at runtime, with their template content.
+var netFiles = []struct {
+	name     string
+	template string
+}{
+	{name: "resolv.conf", template: "# Replaced by the resolv.conf of the host at runtime\n"},
+	{name: "hosts", template: "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"},
+}
+
+// NormalizeNetFiles replaces the /etc/resolv.conf and /etc/hosts files of
+// the root filesystem rootfs by regular files, empty or holding a minimal
+// template according to mode, NetFilesEmpty or NetFilesTemplate. The files
+// of an image can't always be bound over at runtime, e.g. a resolv.conf
+// symlink to the stub of systemd-resolved dangles in the container.
+func NormalizeNetFiles(rootfs, mode string) error {
+	if mode != NetFilesEmpty && mode != NetFilesTemplate {
+		return fmt.Errorf("invalid network files normalization %q", mode)
+	}
+
+	// an etc symlink is resolved within the root filesystem
+	etc, err := securejoin.SecureJoin(rootfs, "etc")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(etc, 0o755); err != nil {
+		return err
+	}
+
+	for _, f := range netFiles {
+		path := filepath.Join(etc, f.name)
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("while removing /etc/%s: %s", f.name, err)
+		}
+		var content string
+		if mode == NetFilesTemplate {
+			content = f.template
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			return fmt.Errorf("while writing /etc/%s: %s", f.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeNetFilesRootfs creates a root filesystem whose resolv.conf is a
+// dangling symlink and hosts a directory, and returns its path.
+func makeNetFilesRootfs(t *testing.T) string {
+	t.Helper()
+
+	rootfs := t.TempDir()
+	etc := filepath.Join(rootfs, "etc")
+	if err := os.MkdirAll(filepath.Join(etc, "hosts"), 0o755); err != nil {
+		t.Fatalf("while creating %s: %s", etc, err)
+	}
+	if err := os.Symlink("../run/systemd/resolve/stub-resolv.conf", filepath.Join(etc, "resolv.conf")); err != nil {
+		t.Fatalf("while creating symlink: %s", err)
+	}
+	return rootfs
+}
+
+func TestNormalizeNetFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		wantHosts string
+	}{
+		{name: "empty", mode: NetFilesEmpty},
+		{name: "template", mode: NetFilesTemplate, wantHosts: "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := makeNetFilesRootfs(t)
+			if err := NormalizeNetFiles(rootfs, tt.mode); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			for _, name := range []string{"resolv.conf", "hosts"} {
+				fi, err := os.Lstat(filepath.Join(rootfs, "etc", name))
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if !fi.Mode().IsRegular() || fi.Mode().Perm() != 0o644 {
+					t.Errorf("%s: unexpected mode %s", name, fi.Mode())
+				}
+			}
+			data, err := os.ReadFile(filepath.Join(rootfs, "etc", "hosts"))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(data) != tt.wantHosts {
+				t.Errorf("unexpected hosts content %q, want %q", data, tt.wantHosts)
+			}
+		})
+	}
+}
+
+func TestNormalizeNetFilesEtcSymlink(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "private", "etc"), 0o755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// an absolute symlink, resolved within the root filesystem
+	if err := os.Symlink("/private/etc", filepath.Join(rootfs, "etc")); err != nil {
+		t.Fatalf("while creating symlink: %s", err)
+	}
+
+	if err := NormalizeNetFiles(rootfs, NetFilesEmpty); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, "private", "etc", "hosts")); err != nil {
+		t.Errorf("hosts not written in the etc symlink target: %s", err)
+	}
+}
+
+func TestNormalizeNetFilesInvalidMode(t *testing.T) {
+	if err := NormalizeNetFiles(t.TempDir(), "keep"); err == nil {
+		t.Errorf("unexpected success with an invalid mode")
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// OverlayOpaqueXattr is the extended attribute marking a directory of an
+// overlay upper directory as opaque, hiding the content of the lower one.
+const OverlayOpaqueXattr = "trusted.overlay.opaque"
+
+// OverlayFS is a RootfsFS presenting the directory lower, which is never
+// modified, merged with the directory upper the changes are written to, as
+// the upper directory of an overlay filesystem mounted atop lower. A path of
+// lower is copied up before its metadata is changed, a removed path of
+// lower is represented by a whiteout, a character device with the 0/0
+// device number, and a directory replacing a removed one of lower is made
+// opaque with OverlayOpaqueXattr. Creating whiteouts and opaque directories
+// requires privileges.
+type OverlayFS struct {
+	lower *DirFS
+	upper *DirFS
+}
+
+// NewOverlayFS returns a RootfsFS writing the changes to the root
+// filesystem lower into upper.
+func NewOverlayFS(lower, upper string) *OverlayFS {
+	return &OverlayFS{lower: NewDirFS(lower), upper: NewDirFS(upper)}
+}
+
+// IsOverlayWhiteout returns whether fi is the file info of an overlay
+// whiteout.
+func IsOverlayWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// opaque returns whether the directory name of upper is opaque.
+func (o *OverlayFS) opaque(name string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(o.upper.path(name), OverlayOpaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// lowerVisible returns whether the path name of lower is part of the
+// merged root filesystem, not being hidden by a whiteout, a file or an
+// opaque directory of upper. The directories of both are merged.
+func (o *OverlayFS) lowerVisible(name string) bool {
+	name = cleanFSPath(name)
+	if name == "" {
+		return true
+	}
+	elems := strings.Split(name, "/")
+	for i := range elems {
+		p := strings.Join(elems[:i+1], "/")
+		fi, err := o.upper.Lstat(p)
+		if err != nil {
+			// upper holds nothing below a missing path
+			return true
+		}
+		if IsOverlayWhiteout(fi) || !fi.IsDir() || o.opaque(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// layer returns the filesystem holding the path name of the merged root
+// filesystem, and its file info.
+func (o *OverlayFS) layer(op, name string) (*DirFS, os.FileInfo, error) {
+	fi, err := o.upper.Lstat(name)
+	if err == nil {
+		if IsOverlayWhiteout(fi) {
+			return nil, nil, &os.PathError{Op: op, Path: cleanFSPath(name), Err: syscall.ENOENT}
+		}
+		return o.upper, fi, nil
+	} else if !isNotExistPath(err) {
+		return nil, nil, err
+	}
+	if !o.lowerVisible(parentFSPath(name)) {
+		return nil, nil, &os.PathError{Op: op, Path: cleanFSPath(name), Err: syscall.ENOENT}
+	}
+	fi, err = o.lower.Lstat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return o.lower, fi, nil
+}
+
+// parentFSPath returns the parent directory of the RootfsFS path name.
+func parentFSPath(name string) string {
+	name = cleanFSPath(name)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// copyUp copies the path name of lower to upper, with its parents, unless
+// upper already holds it. Regular files are copied with their content,
+// directories without.
+func (o *OverlayFS) copyUp(name string) error {
+	l, fi, err := o.layer("copyup", name)
+	if err != nil {
+		return err
+	} else if l == o.upper {
+		return nil
+	}
+	if err := o.copyUp(parentFSPath(name)); err != nil {
+		return err
+	}
+
+	switch {
+	case fi.IsDir():
+		err = o.upper.Mkdir(name, 0o700)
+	case fi.Mode().IsRegular():
+		err = o.copyFile(name)
+	case fi.Mode()&os.ModeSymlink != 0:
+		var target string
+		if target, err = o.lower.Readlink(name); err == nil {
+			err = o.upper.Symlink(target, name)
+		}
+	default:
+		st, _ := fi.Sys().(*syscall.Stat_t)
+		var dev uint64
+		if st != nil {
+			dev = st.Rdev
+		}
+		err = o.upper.Mknod(name, fi.Mode(), dev)
+	}
+	if err != nil {
+		return err
+	}
+	return o.copyMetadata(name, fi)
+}
+
+// copyFile copies the content of the regular file name of lower to upper.
+func (o *OverlayFS) copyFile(name string) error {
+	r, err := o.lower.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := o.upper.Create(name, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// copyMetadata applies the ownership, permissions and times of the file
+// info fi of lower to the path name copied up.
+func (o *OverlayFS) copyMetadata(name string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("unsupported file info")
+	}
+	if err := o.upper.Lchown(name, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		if err := o.upper.Chmod(name, fi.Mode()); err != nil {
+			return err
+		}
+	}
+	return o.upper.Lchtimes(name, time.Unix(st.Atim.Unix()), fi.ModTime())
+}
+
+// prepare copies up the parent directory of the path name created in
+// upper, and removes its whiteout, if any. It returns whether the
+// directory name of lower must be hidden by an opaque directory.
+func (o *OverlayFS) prepare(name string) (bool, error) {
+	if err := o.copyUp(parentFSPath(name)); err != nil {
+		return false, err
+	}
+	fi, err := o.upper.Lstat(name)
+	if err != nil || !IsOverlayWhiteout(fi) {
+		return false, nil
+	}
+	if err := o.upper.RemoveAll(name); err != nil {
+		return false, err
+	}
+	lfi, err := o.lower.Lstat(name)
+	return err == nil && lfi.IsDir(), nil
+}
+
+func (o *OverlayFS) Lstat(name string) (os.FileInfo, error) {
+	_, fi, err := o.layer("lstat", name)
+	return fi, err
+}
+
+func (o *OverlayFS) Readlink(name string) (string, error) {
+	l, _, err := o.layer("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return l.Readlink(name)
+}
+
+func (o *OverlayFS) ReadDir(name string) ([]os.DirEntry, error) {
+	l, fi, err := o.layer("readdir", name)
+	if err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: cleanFSPath(name), Err: syscall.ENOTDIR}
+	}
+
+	entries := make(map[string]os.DirEntry)
+	hidden := make(map[string]bool)
+	if l == o.upper {
+		upper, err := o.upper.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range upper {
+			if e.Type()&fs.ModeCharDevice != 0 {
+				if info, err := e.Info(); err == nil && IsOverlayWhiteout(info) {
+					hidden[e.Name()] = true
+					continue
+				}
+			}
+			entries[e.Name()] = e
+		}
+	}
+	if o.lowerVisible(name) {
+		lower, err := o.lower.ReadDir(name)
+		if err != nil && !isNotExistPath(err) {
+			return nil, err
+		}
+		for _, e := range lower {
+			if _, ok := entries[e.Name()]; !ok && !hidden[e.Name()] {
+				entries[e.Name()] = e
+			}
+		}
+	}
+
+	merged := make([]os.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		merged = append(merged, e)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Name() < merged[j].Name()
+	})
+	return merged, nil
+}
+
+func (o *OverlayFS) Open(name string) (io.ReadCloser, error) {
+	l, _, err := o.layer("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return l.Open(name)
+}
+
+func (o *OverlayFS) Mkdir(name string, perm os.FileMode) error {
+	if cleanFSPath(name) == "" {
+		// the upper directory is the root of the merged root filesystem
+		return o.upper.Mkdir(name, perm)
+	}
+	if _, _, err := o.layer("mkdir", name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: cleanFSPath(name), Err: syscall.EEXIST}
+	}
+	opaque, err := o.prepare(name)
+	if err != nil {
+		return err
+	}
+	if err := o.upper.Mkdir(name, perm); err != nil {
+		return err
+	}
+	if opaque {
+		p := o.upper.path(name)
+		if err := unix.Lsetxattr(p, OverlayOpaqueXattr, []byte("y"), 0); err != nil {
+			return &os.PathError{Op: "setxattr", Path: p, Err: err}
+		}
+	}
+	return nil
+}
+
+func (o *OverlayFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	if _, err := o.prepare(name); err != nil {
+		return nil, err
+	}
+	return o.upper.Create(name, perm)
+}
+
+func (o *OverlayFS) Symlink(target, name string) error {
+	if _, _, err := o.layer("symlink", name); err == nil {
+		return &os.PathError{Op: "symlink", Path: cleanFSPath(name), Err: syscall.EEXIST}
+	}
+	if _, err := o.prepare(name); err != nil {
+		return err
+	}
+	return o.upper.Symlink(target, name)
+}
+
+func (o *OverlayFS) Link(oldname, name string) error {
+	if _, _, err := o.layer("link", name); err == nil {
+		return &os.PathError{Op: "link", Path: cleanFSPath(name), Err: syscall.EEXIST}
+	}
+	// the target is copied up, a hard link can't cross the directories
+	if err := o.copyUp(oldname); err != nil {
+		return err
+	}
+	if _, err := o.prepare(name); err != nil {
+		return err
+	}
+	return o.upper.Link(oldname, name)
+}
+
+func (o *OverlayFS) Mknod(name string, mode os.FileMode, dev uint64) error {
+	if _, _, err := o.layer("mknod", name); err == nil {
+		return &os.PathError{Op: "mknod", Path: cleanFSPath(name), Err: syscall.EEXIST}
+	}
+	if _, err := o.prepare(name); err != nil {
+		return err
+	}
+	return o.upper.Mknod(name, mode, dev)
+}
+
+// RemoveAll removes name and its content from upper, and hides the path of
+// lower with a whiteout.
+func (o *OverlayFS) RemoveAll(name string) error {
+	if cleanFSPath(name) == "" {
+		return &os.PathError{Op: "removeall", Path: "", Err: syscall.EINVAL}
+	}
+	l, _, err := o.layer("removeall", name)
+	if isNotExistPath(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	inLower := l == o.lower
+	if !inLower {
+		if err := o.upper.RemoveAll(name); err != nil {
+			return err
+		}
+		_, err := o.lower.Lstat(name)
+		inLower = err == nil && o.lowerVisible(parentFSPath(name))
+	}
+	if !inLower {
+		return nil
+	}
+	if err := o.copyUp(parentFSPath(name)); err != nil {
+		return err
+	}
+	return o.upper.Mknod(name, os.ModeDevice|os.ModeCharDevice, 0)
+}
+
+// isNotExistPath returns whether err reports a missing path, or a parent
+// of the path which isn't a directory.
+func isNotExistPath(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)
+}
+
+func (o *OverlayFS) Chmod(name string, mode os.FileMode) error {
+	if err := o.copyUp(name); err != nil {
+		return err
+	}
+	return o.upper.Chmod(name, mode)
+}
+
+func (o *OverlayFS) Lchown(name string, uid, gid int) error {
+	if err := o.copyUp(name); err != nil {
+		return err
+	}
+	return o.upper.Lchown(name, uid, gid)
+}
+
+// Lchtimes changes the times of name, without copying up a path of lower
+// whose times are unchanged.
+func (o *OverlayFS) Lchtimes(name string, atime, mtime time.Time) error {
+	l, fi, err := o.layer("lchtimes", name)
+	if err != nil {
+		return err
+	}
+	if l == o.lower && fi.ModTime().Equal(mtime) {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && time.Unix(st.Atim.Unix()).Equal(atime) {
+			return nil
+		}
+	}
+	if err := o.copyUp(name); err != nil {
+		return err
+	}
+	return o.upper.Lchtimes(name, atime, mtime)
+}
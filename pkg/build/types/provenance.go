@@ -0,0 +1,38 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Provenance maps the absolute paths of a root filesystem extracted from
+// an OCI image to the digest of the layer which last wrote them.
+type Provenance map[string]digest.Digest
+
+// ParseProvenance decodes a provenance index, as stored in the SIF image
+// provenance metadata.
+func ParseProvenance(data []byte) (Provenance, error) {
+	p := make(Provenance)
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("while decoding provenance index: %w", err)
+	}
+	return p, nil
+}
+
+// Lookup returns the digest of the layer which provided path, path being
+// relative to the root filesystem or absolute.
+func (p Provenance) Lookup(path string) (digest.Digest, bool) {
+	d, ok := p[filepath.Clean("/"+path)]
+	return d, ok
+}
@@ -0,0 +1,177 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PruneReport lists the paths pruned from a root filesystem, and the bytes
+// reclaimed by their removal.
+type PruneReport struct {
+	// Paths are the pruned paths, relative to the root filesystem and
+	// starting with a slash. The content of a pruned directory isn't listed.
+	Paths []string
+	// Bytes is the size of the regular files pruned, including the content
+	// of the pruned directories.
+	Bytes int64
+}
+
+// PruneProfileMinimal is the prune profile removing the documentation, the
+// manual and info pages, and the translations other than the English ones.
+const PruneProfileMinimal = "minimal"
+
+// PruneProfile is a named set of prune patterns, see PruneRootfsProfile.
+type PruneProfile struct {
+	// Patterns are the patterns of the paths pruned, as for PruneRootfs.
+	Patterns []string
+	// Keep are the patterns of the paths matching Patterns which are kept.
+	Keep []string
+}
+
+// pruneProfiles are the prune profiles, by name.
+var pruneProfiles = map[string]PruneProfile{
+	PruneProfileMinimal: {
+		Patterns: []string{
+			"/usr/share/doc",
+			"/usr/share/gtk-doc",
+			"/usr/share/info",
+			"/usr/share/man",
+			"/usr/local/share/doc",
+			"/usr/local/share/man",
+			"/usr/share/locale/*",
+		},
+		Keep: []string{
+			"/usr/share/locale/en",
+			"/usr/share/locale/en_*",
+			"/usr/share/locale/locale.alias",
+		},
+	},
+}
+
+// GetPruneProfile returns the prune profile name, e.g. PruneProfileMinimal.
+func GetPruneProfile(name string) (PruneProfile, error) {
+	p, ok := pruneProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(pruneProfiles))
+		for n := range pruneProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return PruneProfile{}, fmt.Errorf("unknown prune profile %q, should be one of %s", name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
+
+// PruneRootfs removes the files and directories of the root filesystem
+// rootfs matching one of patterns, and reports what was removed. A pattern
+// without any slash matches the base name of the paths, e.g. *.a, otherwise
+// it matches their full path in the root filesystem, e.g.
+// /usr/share/man/*. When dryRun is true, nothing is removed and the report
+// lists what would be.
+func PruneRootfs(rootfs string, patterns []string, dryRun bool) (PruneReport, error) {
+	return PruneRootfsProfile(rootfs, PruneProfile{}, patterns, dryRun)
+}
+
+// PruneRootfsProfile removes the files and directories of the root
+// filesystem rootfs matching the patterns of profile, unless they match
+// the patterns it keeps, or one of patterns, as PruneRootfs does.
+func PruneRootfsProfile(rootfs string, profile PruneProfile, patterns []string, dryRun bool) (PruneReport, error) {
+	var r PruneReport
+
+	for _, list := range [][]string{patterns, profile.Patterns, profile.Keep} {
+		for _, p := range list {
+			if _, err := filepath.Match(p, ""); err != nil {
+				return r, fmt.Errorf("invalid prune pattern %q: %s", p, err)
+			}
+		}
+	}
+
+	var matched []string
+	err := filepath.WalkDir(rootfs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = "/" + filepath.ToSlash(rel)
+		if !pruneMatch(patterns, rel) && (!pruneMatch(profile.Patterns, rel) || pruneMatch(profile.Keep, rel)) {
+			return nil
+		}
+
+		size, err := prunedSize(path)
+		if err != nil {
+			return err
+		}
+		r.Paths = append(r.Paths, rel)
+		r.Bytes += size
+		matched = append(matched, path)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return r, fmt.Errorf("while scanning %s: %s", rootfs, err)
+	}
+
+	if dryRun {
+		return r, nil
+	}
+	for _, path := range matched {
+		if err := os.RemoveAll(path); err != nil {
+			return r, fmt.Errorf("while pruning %s: %s", path, err)
+		}
+	}
+	return r, nil
+}
+
+// pruneMatch reports whether the path rel of the root filesystem matches
+// one of patterns.
+func pruneMatch(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		name := rel
+		if !strings.Contains(p, "/") {
+			name = filepath.Base(rel)
+		} else if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// prunedSize returns the size of the regular files removed with path.
+func prunedSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+		return nil
+	})
+	return size, err
+}
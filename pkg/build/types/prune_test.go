@@ -0,0 +1,218 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// makePruneRootfs creates a root filesystem holding the files with the
+// given sizes, and returns its path.
+func makePruneRootfs(t *testing.T, files map[string]int) string {
+	t.Helper()
+
+	rootfs := t.TempDir()
+	for name, size := range files {
+		path := filepath.Join(rootfs, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("while creating %s: %s", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", size)), 0o644); err != nil {
+			t.Fatalf("while writing %s: %s", path, err)
+		}
+	}
+	if err := os.Symlink("libfoo.a", filepath.Join(rootfs, "usr", "lib", "libbar.a")); err != nil {
+		t.Fatalf("while creating symlink: %s", err)
+	}
+	return rootfs
+}
+
+func TestPruneRootfs(t *testing.T) {
+	files := map[string]int{
+		"usr/lib/libfoo.a":              1000,
+		"usr/lib/libfoo.so":             300,
+		"usr/share/man/man1/ls.1":       200,
+		"usr/share/man/man8/mount.8":    50,
+		"usr/share/doc/README":          20,
+		"etc/apt/apt.conf.d/docker.man": 5,
+	}
+
+	tests := []struct {
+		name      string
+		patterns  []string
+		dryRun    bool
+		paths     []string
+		bytes     int64
+		remaining []string
+		wantErr   bool
+	}{
+		{
+			name:      "base name and directory",
+			patterns:  []string{"*.a", "/usr/share/man"},
+			paths:     []string{"/usr/lib/libbar.a", "/usr/lib/libfoo.a", "/usr/share/man"},
+			bytes:     1250,
+			remaining: []string{"usr/lib/libfoo.so", "usr/share/doc/README", "etc/apt/apt.conf.d/docker.man"},
+		},
+		{
+			name:      "path glob",
+			patterns:  []string{"usr/share/*/man1"},
+			paths:     []string{"/usr/share/man/man1"},
+			bytes:     200,
+			remaining: []string{"usr/share/man/man8/mount.8", "usr/lib/libfoo.a"},
+		},
+		{
+			name:      "dry run",
+			patterns:  []string{"*.a", "/usr/share/man"},
+			dryRun:    true,
+			paths:     []string{"/usr/lib/libbar.a", "/usr/lib/libfoo.a", "/usr/share/man"},
+			bytes:     1250,
+			remaining: []string{"usr/lib/libfoo.a", "usr/lib/libbar.a", "usr/share/man/man1/ls.1"},
+		},
+		{
+			name:      "no match",
+			patterns:  []string{"*.la"},
+			remaining: []string{"usr/lib/libfoo.a"},
+		},
+		{
+			name:     "invalid pattern",
+			patterns: []string{"*.[a"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := makePruneRootfs(t, files)
+
+			r, err := PruneRootfs(rootfs, tt.patterns, tt.dryRun)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("unexpected success")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !reflect.DeepEqual(r.Paths, tt.paths) {
+				t.Errorf("unexpected pruned paths: got %v, want %v", r.Paths, tt.paths)
+			}
+			if r.Bytes != tt.bytes {
+				t.Errorf("unexpected reclaimed size: got %d, want %d", r.Bytes, tt.bytes)
+			}
+			for _, p := range r.Paths {
+				_, err := os.Lstat(filepath.Join(rootfs, p))
+				if tt.dryRun && err != nil {
+					t.Errorf("%s removed by dry run: %s", p, err)
+				} else if !tt.dryRun && !os.IsNotExist(err) {
+					t.Errorf("%s not removed", p)
+				}
+			}
+			for _, p := range tt.remaining {
+				if _, err := os.Lstat(filepath.Join(rootfs, p)); err != nil {
+					t.Errorf("%s unexpectedly removed: %s", p, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPruneRootfsProfile(t *testing.T) {
+	files := map[string]int{
+		"usr/lib/libfoo.a":                                 1000,
+		"usr/share/man/man1/ls.1":                          200,
+		"usr/share/doc/bash/README":                        20,
+		"usr/share/info/bash.info":                         30,
+		"usr/share/locale/de/LC_MESSAGES/bash.mo":          40,
+		"usr/share/locale/fr/LC_MESSAGES/bash.mo":          50,
+		"usr/share/locale/en_GB/LC_MESSAGES/bash.mo":       60,
+		"usr/share/locale/en/LC_MESSAGES/bash.mo":          70,
+		"usr/share/locale/locale.alias":                    5,
+		"usr/share/zoneinfo/Europe/Paris":                  10,
+		"usr/local/share/man/man1/tool.1":                  15,
+		"usr/lib/x86_64-linux-gnu/gconv/gconv-modules.doc": 1,
+	}
+
+	profile, err := GetPruneProfile(PruneProfileMinimal)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := GetPruneProfile("huge"); err == nil {
+		t.Errorf("unexpected success with an unknown profile")
+	}
+
+	pruned := []string{
+		"/usr/local/share/man",
+		"/usr/share/doc",
+		"/usr/share/info",
+		"/usr/share/locale/de",
+		"/usr/share/locale/fr",
+		"/usr/share/man",
+	}
+	remaining := []string{
+		"usr/lib/libfoo.a",
+		"usr/share/locale/en_GB/LC_MESSAGES/bash.mo",
+		"usr/share/locale/en/LC_MESSAGES/bash.mo",
+		"usr/share/locale/locale.alias",
+		"usr/share/zoneinfo/Europe/Paris",
+		"usr/lib/x86_64-linux-gnu/gconv/gconv-modules.doc",
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		rootfs := makePruneRootfs(t, files)
+		r, err := PruneRootfsProfile(rootfs, profile, nil, dryRun)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(r.Paths, pruned) {
+			t.Errorf("unexpected pruned paths: got %v, want %v", r.Paths, pruned)
+		}
+		if want := int64(200 + 20 + 30 + 40 + 50 + 15); r.Bytes != want {
+			t.Errorf("unexpected reclaimed size: got %d, want %d", r.Bytes, want)
+		}
+		for _, p := range r.Paths {
+			_, err := os.Lstat(filepath.Join(rootfs, p))
+			if dryRun && err != nil {
+				t.Errorf("%s removed by dry run: %s", p, err)
+			} else if !dryRun && !os.IsNotExist(err) {
+				t.Errorf("%s not removed", p)
+			}
+		}
+		for _, p := range remaining {
+			if _, err := os.Lstat(filepath.Join(rootfs, p)); err != nil {
+				t.Errorf("%s unexpectedly removed: %s", p, err)
+			}
+		}
+	}
+
+	// the patterns are pruned along with the profile, even those it keeps
+	rootfs := makePruneRootfs(t, files)
+	r, err := PruneRootfsProfile(rootfs, profile, []string{"*.a", "/usr/share/locale/en"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []string{
+		"/usr/lib/libbar.a",
+		"/usr/lib/libfoo.a",
+		"/usr/local/share/man",
+		"/usr/share/doc",
+		"/usr/share/info",
+		"/usr/share/locale/de",
+		"/usr/share/locale/en",
+		"/usr/share/locale/fr",
+		"/usr/share/man",
+	}
+	if !reflect.DeepEqual(r.Paths, want) {
+		t.Errorf("unexpected pruned paths: got %v, want %v", r.Paths, want)
+	}
+}
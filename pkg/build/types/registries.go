@@ -0,0 +1,90 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/apptainer/apptainer/pkg/util/apptainerconf"
+)
+
+// ErrRegistryNotAllowed is the error of a source whose registry isn't
+// allowed, see CheckRegistryAllowed.
+var ErrRegistryNotAllowed = errors.New("registry not allowed")
+
+// AllowedRegistries returns the patterns of the registries the sources may
+// be pulled from: patterns, e.g. from the --allowed-registries build option,
+// or else the allowed registries of the current apptainer.conf
+// configuration. Empty, any registry is allowed.
+func AllowedRegistries(patterns []string) []string {
+	if len(patterns) > 0 {
+		return patterns
+	}
+	if conf := apptainerconf.GetCurrentConfig(); conf != nil {
+		return conf.AllowedRegistries
+	}
+	return nil
+}
+
+// CheckRegistryAllowed returns an error wrapping ErrRegistryNotAllowed if
+// the registry host of the source name doesn't match one of the patterns,
+// see RegistryAllowed. Any registry is allowed without patterns.
+func CheckRegistryAllowed(patterns []string, host, name string) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	if err := CheckRegistryPatterns(patterns); err != nil {
+		return err
+	}
+	if !RegistryAllowed(patterns, host) {
+		return fmt.Errorf("%w: %s of %s, the allowed registries are %s", ErrRegistryNotAllowed, host, name, strings.Join(patterns, ", "))
+	}
+	return nil
+}
+
+// CheckRegistryPatterns checks the syntax of the allowed registry patterns.
+func CheckRegistryPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if p == "" || strings.Contains(p, "/") {
+			return fmt.Errorf("invalid allowed registry %q, should be a registry host with an optional port", p)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid allowed registry %q: %s", p, err)
+		}
+	}
+	return nil
+}
+
+// RegistryAllowed reports whether the registry host, with an optional port,
+// matches one of the patterns, compared case-insensitively. A pattern may
+// hold the wildcards of path.Match, e.g. *.example.com, and matches the
+// host on any port when it doesn't set one. Docker Hub is the docker.io
+// registry.
+func RegistryAllowed(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		name := host
+		if _, _, err := net.SplitHostPort(p); err != nil {
+			name = hostname
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"testing"
+)
+
+func TestRegistryAllowed(t *testing.T) {
+	patterns := []string{"docker.io", "*.example.com", "localhost:5000", "Quay.IO"}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "docker.io", want: true},
+		{host: "registry.example.com", want: true},
+		{host: "registry.example.com:5000", want: true},
+		{host: "a.b.example.com", want: true},
+		{host: "example.com", want: false},
+		{host: "example.com.evil.org", want: false},
+		{host: "localhost:5000", want: true},
+		{host: "localhost", want: false},
+		{host: "localhost:5001", want: false},
+		{host: "quay.io", want: true},
+		{host: "ghcr.io", want: false},
+	}
+	for _, tt := range tests {
+		if got := RegistryAllowed(patterns, tt.host); got != tt.want {
+			t.Errorf("%s: unexpected result %v, want %v", tt.host, got, tt.want)
+		}
+	}
+	if RegistryAllowed(nil, "docker.io") {
+		t.Errorf("unexpected registry allowed by an empty list")
+	}
+
+	if err := CheckRegistryPatterns(patterns); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, p := range []string{"", "docker.io/library", "[registry"} {
+		if err := CheckRegistryPatterns([]string{p}); err == nil {
+			t.Errorf("unexpected success checking pattern %q", p)
+		}
+	}
+}
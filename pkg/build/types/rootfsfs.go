@@ -0,0 +1,517 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// RootfsFS is a filesystem a root filesystem is extracted into, see
+// Options.RootfsFS. Its paths are slash separated and relative to the root
+// filesystem, "" being the root itself. The paths passed by the extraction
+// never contain a symlink as a parent directory, the symlinks of the root
+// filesystem being resolved within it, and none of the methods follow a
+// symlink as the last element of a path.
+type RootfsFS interface {
+	// Lstat returns the file info of name.
+	Lstat(name string) (os.FileInfo, error)
+	// Readlink returns the target of the symlink name.
+	Readlink(name string) (string, error)
+	// ReadDir returns the entries of the directory name, sorted by name.
+	ReadDir(name string) ([]os.DirEntry, error)
+	// Open opens the regular file name for reading.
+	Open(name string) (io.ReadCloser, error)
+	// Mkdir creates the directory name.
+	Mkdir(name string, perm os.FileMode) error
+	// Create creates the regular file name, or truncates it if it exists.
+	Create(name string, perm os.FileMode) (io.WriteCloser, error)
+	// Symlink creates name as a symlink to target.
+	Symlink(target, name string) error
+	// Link creates name as a hard link to the file oldname.
+	Link(oldname, name string) error
+	// Mknod creates name as the device or named pipe of mode, with the
+	// device number dev.
+	Mknod(name string, mode os.FileMode, dev uint64) error
+	// RemoveAll removes name and its content, if it exists.
+	RemoveAll(name string) error
+	// Chmod changes the permissions, and the setuid, setgid and sticky
+	// bits, of name.
+	Chmod(name string, mode os.FileMode) error
+	// Lchown changes the ownership of name.
+	Lchown(name string, uid, gid int) error
+	// Lchtimes changes the access and modification times of name.
+	Lchtimes(name string, atime, mtime time.Time) error
+}
+
+// cleanFSPath returns the cleaned form of the RootfsFS path name.
+func cleanFSPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// unixMode returns the mode bits of the stat and mknod system calls for
+// mode.
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= unix.S_ISVTX
+	}
+	switch {
+	case mode&os.ModeDir != 0:
+		m |= unix.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		m |= unix.S_IFLNK
+	case mode&os.ModeNamedPipe != 0:
+		m |= unix.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		m |= unix.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		m |= unix.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		m |= unix.S_IFBLK
+	default:
+		m |= unix.S_IFREG
+	}
+	return m
+}
+
+// DirFS is a RootfsFS writing to a directory of the host filesystem.
+type DirFS struct {
+	root string
+}
+
+// NewDirFS returns a RootfsFS writing to the directory root.
+func NewDirFS(root string) *DirFS {
+	return &DirFS{root: root}
+}
+
+func (d *DirFS) path(name string) string {
+	return filepath.Join(d.root, filepath.FromSlash(cleanFSPath(name)))
+}
+
+func (d *DirFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(d.path(name))
+}
+
+func (d *DirFS) Readlink(name string) (string, error) {
+	return os.Readlink(d.path(name))
+}
+
+func (d *DirFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(d.path(name))
+}
+
+func (d *DirFS) Open(name string) (io.ReadCloser, error) {
+	return os.OpenFile(d.path(name), os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+}
+
+func (d *DirFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(d.path(name), perm)
+}
+
+func (d *DirFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(d.path(name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, perm)
+}
+
+func (d *DirFS) Symlink(target, name string) error {
+	return os.Symlink(target, d.path(name))
+}
+
+func (d *DirFS) Link(oldname, name string) error {
+	return os.Link(d.path(oldname), d.path(name))
+}
+
+func (d *DirFS) Mknod(name string, mode os.FileMode, dev uint64) error {
+	p := d.path(name)
+	if err := unix.Mknod(p, unixMode(mode), int(dev)); err != nil {
+		return &os.PathError{Op: "mknod", Path: p, Err: err}
+	}
+	return nil
+}
+
+func (d *DirFS) RemoveAll(name string) error {
+	return os.RemoveAll(d.path(name))
+}
+
+func (d *DirFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(d.path(name), mode)
+}
+
+func (d *DirFS) Lchown(name string, uid, gid int) error {
+	return os.Lchown(d.path(name), uid, gid)
+}
+
+func (d *DirFS) Lchtimes(name string, atime, mtime time.Time) error {
+	p := d.path(name)
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "lchtimes", Path: p, Err: err}
+	}
+	return nil
+}
+
+// memNode is a file of a MemFS, shared by its hard links.
+type memNode struct {
+	ino      uint64
+	mode     os.FileMode
+	uid, gid int
+	atime    time.Time
+	mtime    time.Time
+	nlink    uint64
+	rdev     uint64
+	data     []byte
+	link     string
+	children map[string]*memNode
+}
+
+// MemFS is a RootfsFS keeping the root filesystem in memory, e.g. to
+// inspect the extracted content without writing it to disk. The Sys method
+// of its file info returns a *syscall.Stat_t, as for the host filesystem.
+type MemFS struct {
+	mu      sync.Mutex
+	root    *memNode
+	lastIno uint64
+}
+
+// NewMemFS returns an empty MemFS, holding the root directory only.
+func NewMemFS() *MemFS {
+	m := &MemFS{}
+	m.root = m.newNode(os.ModeDir | 0o755)
+	return m
+}
+
+func (m *MemFS) newNode(mode os.FileMode) *memNode {
+	m.lastIno++
+	now := time.Now()
+	n := &memNode{ino: m.lastIno, mode: mode, atime: now, mtime: now, nlink: 1}
+	if mode.IsDir() {
+		n.children = make(map[string]*memNode)
+	}
+	return n
+}
+
+// lookup returns the parent directory of name and the base name of name,
+// the parent being nil for the root.
+func (m *MemFS) lookup(op, name string) (*memNode, string, error) {
+	name = cleanFSPath(name)
+	if name == "" {
+		return nil, "", nil
+	}
+	dir := m.root
+	elems := strings.Split(name, "/")
+	for _, elem := range elems[:len(elems)-1] {
+		n, ok := dir.children[elem]
+		if !ok {
+			return nil, "", &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+		} else if !n.mode.IsDir() {
+			return nil, "", &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		dir = n
+	}
+	return dir, elems[len(elems)-1], nil
+}
+
+// node returns the file name.
+func (m *MemFS) node(op, name string) (*memNode, error) {
+	dir, base, err := m.lookup(op, name)
+	if err != nil {
+		return nil, err
+	} else if dir == nil {
+		return m.root, nil
+	}
+	n, ok := dir.children[base]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: cleanFSPath(name), Err: syscall.ENOENT}
+	}
+	return n, nil
+}
+
+// add adds the file n as name, which must not exist.
+func (m *MemFS) add(op, name string, n *memNode) error {
+	dir, base, err := m.lookup(op, name)
+	if err != nil {
+		return err
+	}
+	if dir == nil {
+		return &os.PathError{Op: op, Path: cleanFSPath(name), Err: syscall.EEXIST}
+	}
+	if _, ok := dir.children[base]; ok {
+		return &os.PathError{Op: op, Path: cleanFSPath(name), Err: syscall.EEXIST}
+	}
+	dir.children[base] = n
+	dir.mtime = time.Now()
+	return nil
+}
+
+func (m *MemFS) Lstat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.node("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(path.Base("/" + cleanFSPath(name))), nil
+}
+
+func (m *MemFS) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.node("readlink", name)
+	if err != nil {
+		return "", err
+	} else if n.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: cleanFSPath(name), Err: syscall.EINVAL}
+	}
+	return n.link, nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.node("readdir", name)
+	if err != nil {
+		return nil, err
+	} else if !n.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: cleanFSPath(name), Err: syscall.ENOTDIR}
+	}
+	entries := make([]os.DirEntry, 0, len(n.children))
+	for base, c := range n.children {
+		entries = append(entries, fs.FileInfoToDirEntry(c.info(base)))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *MemFS) Open(name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.node("open", name)
+	if err != nil {
+		return nil, err
+	} else if !n.mode.IsRegular() {
+		return nil, &os.PathError{Op: "open", Path: cleanFSPath(name), Err: syscall.EINVAL}
+	}
+	return io.NopCloser(bytes.NewReader(n.data)), nil
+}
+
+func (m *MemFS) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.add("mkdir", name, m.newNode(os.ModeDir|perm.Perm()))
+}
+
+func (m *MemFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.node("create", name)
+	if os.IsNotExist(err) {
+		n = m.newNode(perm.Perm())
+		err = m.add("create", name, n)
+	} else if err == nil && !n.mode.IsRegular() {
+		err = &os.PathError{Op: "create", Path: cleanFSPath(name), Err: syscall.EEXIST}
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.data = nil
+	n.mtime = time.Now()
+	return &memWriter{fs: m, node: n}, nil
+}
+
+func (m *MemFS) Symlink(target, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := m.newNode(os.ModeSymlink | 0o777)
+	n.link = target
+	return m.add("symlink", name, n)
+}
+
+func (m *MemFS) Link(oldname, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.node("link", oldname)
+	if err != nil {
+		return err
+	} else if n.mode.IsDir() {
+		return &os.PathError{Op: "link", Path: cleanFSPath(oldname), Err: syscall.EPERM}
+	}
+	if err := m.add("link", name, n); err != nil {
+		return err
+	}
+	n.nlink++
+	return nil
+}
+
+func (m *MemFS) Mknod(name string, mode os.FileMode, dev uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if mode&(os.ModeDevice|os.ModeNamedPipe) == 0 {
+		return &os.PathError{Op: "mknod", Path: cleanFSPath(name), Err: syscall.EINVAL}
+	}
+	n := m.newNode(mode & (os.ModeType | os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky))
+	n.rdev = dev
+	return m.add("mknod", name, n)
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, err := m.lookup("removeall", name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if dir == nil {
+		return &os.PathError{Op: "removeall", Path: "", Err: syscall.EINVAL}
+	}
+	n, ok := dir.children[base]
+	if !ok {
+		return nil
+	}
+	delete(dir.children, base)
+	dir.mtime = time.Now()
+	n.unlink()
+	return nil
+}
+
+func (m *MemFS) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.node("chmod", name)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode&os.ModeType | mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	return nil
+}
+
+func (m *MemFS) Lchown(name string, uid, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.node("lchown", name)
+	if err != nil {
+		return err
+	}
+	if uid >= 0 {
+		n.uid = uid
+	}
+	if gid >= 0 {
+		n.gid = gid
+	}
+	return nil
+}
+
+func (m *MemFS) Lchtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.node("lchtimes", name)
+	if err != nil {
+		return err
+	}
+	n.atime, n.mtime = atime, mtime
+	return nil
+}
+
+// unlink drops a link to n, and the links of its content when a directory.
+func (n *memNode) unlink() {
+	n.nlink--
+	for _, c := range n.children {
+		c.unlink()
+	}
+}
+
+// info returns the file info of n, named name.
+func (n *memNode) info(name string) os.FileInfo {
+	size := int64(len(n.data))
+	if n.mode&os.ModeSymlink != 0 {
+		size = int64(len(n.link))
+	}
+	return &memFileInfo{
+		name: name,
+		mode: n.mode,
+		stat: syscall.Stat_t{
+			Ino:   n.ino,
+			Nlink: n.nlink,
+			Mode:  unixMode(n.mode),
+			Uid:   uint32(n.uid),
+			Gid:   uint32(n.gid),
+			Rdev:  n.rdev,
+			Size:  size,
+			Atim:  syscall.NsecToTimespec(n.atime.UnixNano()),
+			Mtim:  syscall.NsecToTimespec(n.mtime.UnixNano()),
+		},
+		mtime: n.mtime,
+	}
+}
+
+// memFileInfo is the file info of a MemFS file.
+type memFileInfo struct {
+	name  string
+	mode  os.FileMode
+	mtime time.Time
+	stat  syscall.Stat_t
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.stat.Size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return &fi.stat }
+
+// memWriter writes the content of a MemFS regular file.
+type memWriter struct {
+	fs   *MemFS
+	node *memNode
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+
+	w.node.data = append(w.node.data, p...)
+	w.node.mtime = time.Now()
+	return len(p), nil
+}
+
+func (w *memWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeFSFile creates the regular file name of fsys with content.
+func writeFSFile(t *testing.T, fsys RootfsFS, name, content string) {
+	t.Helper()
+
+	w, err := fsys.Create(name, 0o644)
+	if err != nil {
+		t.Fatalf("while creating %s: %s", name, err)
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		t.Fatalf("while writing %s: %s", name, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("while closing %s: %s", name, err)
+	}
+}
+
+// readFSFile returns the content of the regular file name of fsys.
+func readFSFile(t *testing.T, fsys RootfsFS, name string) string {
+	t.Helper()
+
+	r, err := fsys.Open(name)
+	if err != nil {
+		t.Fatalf("while opening %s: %s", name, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("while reading %s: %s", name, err)
+	}
+	return string(data)
+}
+
+func TestRootfsFS(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys RootfsFS
+	}{
+		{name: "memory", fsys: NewMemFS()},
+		{name: "directory", fsys: NewDirFS(t.TempDir())},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := tt.fsys
+			if err := fsys.Mkdir("etc", 0o755); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err := fsys.Mkdir("/etc/", 0o755); !os.IsExist(err) {
+				t.Errorf("unexpected error creating an existing directory: %v", err)
+			}
+			writeFSFile(t, fsys, "etc/passwd", "root")
+			writeFSFile(t, fsys, "etc/passwd", "user")
+			if got := readFSFile(t, fsys, "etc/passwd"); got != "user" {
+				t.Errorf("unexpected content after truncation: %q", got)
+			}
+			if _, err := fsys.Lstat("etc/passwd/x"); !errors.Is(err, syscall.ENOTDIR) {
+				t.Errorf("unexpected error below a file: %v", err)
+			}
+
+			if err := fsys.Link("etc/passwd", "etc/group"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err := fsys.Chmod("etc/group", 0o600|os.ModeSetuid); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			fi, err := fsys.Lstat("etc/passwd")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if fi.Mode() != 0o600|os.ModeSetuid || fi.Sys().(*syscall.Stat_t).Nlink != 2 {
+				t.Errorf("unexpected hard link target mode %s", fi.Mode())
+			}
+
+			if err := fsys.Symlink("passwd", "etc/link"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			mtime := time.Unix(1600000000, 0)
+			if err := fsys.Lchtimes("etc/link", mtime, mtime); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			fi, err = fsys.Lstat("etc/link")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if fi.Mode()&os.ModeSymlink == 0 || !fi.ModTime().Equal(mtime) {
+				t.Errorf("unexpected symlink mode %s, mtime %s", fi.Mode(), fi.ModTime())
+			}
+			if link, err := fsys.Readlink("etc/link"); err != nil || link != "passwd" {
+				t.Errorf("unexpected symlink target %q (err=%v)", link, err)
+			}
+
+			if err := fsys.Mknod("etc/fifo", os.ModeNamedPipe|0o600, 0); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			entries, err := fsys.ReadDir("etc")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			if want := []string{"fifo", "group", "link", "passwd"}; len(names) != len(want) || names[0] != want[0] || names[3] != want[3] {
+				t.Errorf("unexpected entries %v, want %v", names, want)
+			}
+
+			if err := fsys.RemoveAll("etc"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err := fsys.RemoveAll("etc"); err != nil {
+				t.Errorf("unexpected error removing a missing path: %s", err)
+			}
+			if _, err := fsys.Lstat("etc"); !os.IsNotExist(err) {
+				t.Errorf("unexpected error after removal: %v", err)
+			}
+		})
+	}
+}
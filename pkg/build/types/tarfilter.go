@@ -0,0 +1,91 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"archive/tar"
+)
+
+// TarFilter transforms the tar entries of the layers of oci/docker sources
+// before their extraction, see Options.TarFilters. The layers are read again
+// by the ownership preflight and the rootfs verification, a filter must
+// return the same result each time it is passed an entry.
+type TarFilter interface {
+	// Filter returns the entry extracted in place of hdr, which it may
+	// modify, or nil to drop the entry. The content of a regular file is
+	// extracted as is, its size must be kept.
+	Filter(hdr *tar.Header) (*tar.Header, error)
+}
+
+// TarFilterFunc is a TarFilter calling the function.
+type TarFilterFunc func(hdr *tar.Header) (*tar.Header, error)
+
+// Filter returns f(hdr).
+func (f TarFilterFunc) Filter(hdr *tar.Header) (*tar.Header, error) {
+	return f(hdr)
+}
+
+// TarFilterPipeline is a TarFilter running its filters in order, each one
+// on the entry returned by the previous one, until one of them drops it.
+type TarFilterPipeline []TarFilter
+
+// Filter returns the entry returned by the last filter of p, or nil if one
+// of them dropped hdr.
+func (p TarFilterPipeline) Filter(hdr *tar.Header) (*tar.Header, error) {
+	for _, f := range p {
+		var err error
+		hdr, err = f.Filter(hdr)
+		if err != nil || hdr == nil {
+			return nil, err
+		}
+	}
+	return hdr, nil
+}
+
+// NewRenameTarFilter returns a filter renaming the entries with rename,
+// which is passed the entry names as found in the layers, e.g. "./etc/" or
+// "usr/bin/sh". The targets of the hard links are renamed as well.
+func NewRenameTarFilter(rename func(name string) string) TarFilter {
+	return TarFilterFunc(func(hdr *tar.Header) (*tar.Header, error) {
+		hdr.Name = rename(hdr.Name)
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = rename(hdr.Linkname)
+		}
+		return hdr, nil
+	})
+}
+
+// NewDropTarFilter returns a filter dropping the entries whose name, as
+// found in the layers, drop returns true for. Dropping a directory doesn't
+// drop the entries below it.
+func NewDropTarFilter(drop func(name string) bool) TarFilter {
+	return TarFilterFunc(func(hdr *tar.Header) (*tar.Header, error) {
+		if drop(hdr.Name) {
+			return nil, nil
+		}
+		return hdr, nil
+	})
+}
+
+// NewOwnerTarFilter returns a filter setting the owner of all entries to
+// uid and gid.
+func NewOwnerTarFilter(uid, gid int) TarFilter {
+	return TarFilterFunc(func(hdr *tar.Header) (*tar.Header, error) {
+		hdr.Uid, hdr.Gid = uid, gid
+		hdr.Uname, hdr.Gname = "", ""
+		return hdr, nil
+	})
+}
+
+// StripSetuidTarFilter is a filter clearing the setuid and setgid bits of
+// all entries.
+var StripSetuidTarFilter TarFilter = TarFilterFunc(func(hdr *tar.Header) (*tar.Header, error) {
+	hdr.Mode &^= 0o6000
+	return hdr, nil
+})
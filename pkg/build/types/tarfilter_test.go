@@ -0,0 +1,83 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"archive/tar"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTarFilterPipeline(t *testing.T) {
+	var seen []string
+	record := TarFilterFunc(func(hdr *tar.Header) (*tar.Header, error) {
+		seen = append(seen, hdr.Name)
+		return hdr, nil
+	})
+	p := TarFilterPipeline{
+		NewDropTarFilter(func(name string) bool { return strings.HasSuffix(name, ".pyc") }),
+		NewRenameTarFilter(func(name string) string { return strings.Replace(name, "opt/", "usr/local/", 1) }),
+		NewOwnerTarFilter(1000, 1001),
+		StripSetuidTarFilter,
+		record,
+	}
+
+	tests := []struct {
+		name string
+		hdr  *tar.Header
+		want *tar.Header
+	}{
+		{
+			name: "file",
+			hdr:  &tar.Header{Name: "opt/bin/tool", Typeflag: tar.TypeReg, Mode: 0o6755, Uid: 0, Gid: 0, Uname: "root", Gname: "root"},
+			want: &tar.Header{Name: "usr/local/bin/tool", Typeflag: tar.TypeReg, Mode: 0o755, Uid: 1000, Gid: 1001},
+		},
+		{
+			name: "hard link",
+			hdr:  &tar.Header{Name: "opt/bin/link", Linkname: "opt/bin/tool", Typeflag: tar.TypeLink, Mode: 0o755},
+			want: &tar.Header{Name: "usr/local/bin/link", Linkname: "usr/local/bin/tool", Typeflag: tar.TypeLink, Mode: 0o755, Uid: 1000, Gid: 1001},
+		},
+		{
+			name: "symlink target kept",
+			hdr:  &tar.Header{Name: "opt/current", Linkname: "opt/bin", Typeflag: tar.TypeSymlink, Mode: 0o777},
+			want: &tar.Header{Name: "usr/local/current", Linkname: "opt/bin", Typeflag: tar.TypeSymlink, Mode: 0o777, Uid: 1000, Gid: 1001},
+		},
+		{
+			name: "dropped",
+			hdr:  &tar.Header{Name: "opt/lib/module.pyc", Typeflag: tar.TypeReg, Mode: 0o644},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen = nil
+			got, err := p.Filter(tt.hdr)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected entry %+v, want %+v", got, tt.want)
+			}
+			// the filters after a drop aren't run
+			if wantSeen := tt.want != nil; (len(seen) == 1) != wantSeen {
+				t.Errorf("unexpected entries reaching the last filter: %v", seen)
+			}
+		})
+	}
+
+	failing := TarFilterPipeline{
+		TarFilterFunc(func(hdr *tar.Header) (*tar.Header, error) { return nil, errors.New("bad entry") }),
+		record,
+	}
+	seen = nil
+	if got, err := failing.Filter(&tar.Header{Name: "file"}); err == nil || got != nil || len(seen) != 0 {
+		t.Errorf("unexpected result %+v (err=%v) after an error, %v filtered", got, err, seen)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// templateVarRegexp matches the variables of the templated files, with the
+// syntax of the build args of the definition files, e.g. {{ VERSION }}.
+var templateVarRegexp = regexp.MustCompile(`{{\s*(\w+)\s*}}`)
+
+// TemplateReport lists the files of a root filesystem templated by
+// TemplateFiles.
+type TemplateReport struct {
+	// Paths are the templated files, relative to the root filesystem and
+	// starting with a slash.
+	Paths []string
+	// Undefined maps the templated files to the variables they reference
+	// without a value, which are left as is.
+	Undefined map[string][]string
+}
+
+// TemplateFiles substitutes the variables vars in the regular files of the
+// root filesystem rootfs matching one of patterns, as PruneRootfs matches
+// them: a pattern without any slash matches the base name of the paths,
+// e.g. *.conf.tmpl, otherwise it matches their full path in the root
+// filesystem, e.g. /etc/app/*.conf. The symlinks are never followed, so
+// that only the files of the root filesystem are templated, and the
+// patterns can't hold a .. element.
+func TemplateFiles(rootfs string, patterns []string, vars map[string]string) (TemplateReport, error) {
+	r := TemplateReport{Undefined: make(map[string][]string)}
+
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return r, fmt.Errorf("invalid template pattern %q: %s", p, err)
+		}
+		for _, elem := range strings.Split(p, "/") {
+			if elem == ".." {
+				return r, fmt.Errorf("invalid template pattern %q: it can't hold a .. element", p)
+			}
+		}
+	}
+
+	err := filepath.WalkDir(rootfs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		rel = "/" + filepath.ToSlash(rel)
+		if !pruneMatch(patterns, rel) {
+			return nil
+		}
+
+		undefined, err := templateFile(path, vars)
+		if err != nil {
+			return fmt.Errorf("while templating %s: %s", rel, err)
+		}
+		r.Paths = append(r.Paths, rel)
+		if len(undefined) > 0 {
+			r.Undefined[rel] = undefined
+		}
+		return nil
+	})
+	if err != nil {
+		return r, fmt.Errorf("while scanning %s: %s", rootfs, err)
+	}
+	return r, nil
+}
+
+// templateFile substitutes vars in the regular file path and returns the
+// variables it references without a value. The templated content is written
+// to a new file with the mode and owner of path, renamed over path, so that
+// the file is never seen partially written. The other hard links of path
+// keep the previous content.
+func templateFile(path string, vars map[string]string) ([]string, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var undefined []string
+	templated := templateVarRegexp.ReplaceAllStringFunc(string(data), func(m string) string {
+		name := templateVarRegexp.FindStringSubmatch(m)[1]
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		if !seen[name] {
+			seen[name] = true
+			undefined = append(undefined, name)
+		}
+		return m
+	})
+	sort.Strings(undefined)
+	if templated == string(data) {
+		return undefined, nil
+	}
+
+	st := fi.Sys().(*syscall.Stat_t)
+	return undefined, replaceFile(path, []byte(templated), fi.Mode(), int(st.Uid), int(st.Gid))
+}
+
+// replaceFile replaces the file path by a file holding data, with the mode
+// and owner, written in the directory of path and renamed over it.
+func replaceFile(path string, data []byte, mode os.FileMode, uid, gid int) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	// chown clears the setuid and setgid bits, the mode is set last
+	if err = f.Chown(uid, gid); err != nil {
+		return err
+	}
+	if err = f.Chmod(mode); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
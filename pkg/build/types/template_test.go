@@ -0,0 +1,174 @@
+// Copyright (c) Contributors to the Apptainer project, established as
+//   Apptainer a Series of LF Projects LLC.
+//   For website terms of use, trademark policy, privacy policy and other
+//   project policies see https://lfprojects.org/policies
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/apptainer/apptainer/internal/pkg/test"
+)
+
+func TestTemplateFiles(t *testing.T) {
+	const content = "version={{ VERSION }} name={{NAME}} other={{ OTHER }}\n"
+	templated := "version=1.2 name=app other={{ OTHER }}\n"
+
+	files := []string{
+		"etc/app/app.conf",
+		"etc/app/app.conf.tmpl",
+		"etc/other.conf",
+		"usr/share/app/app.conf.tmpl",
+	}
+	vars := map[string]string{"VERSION": "1.2", "NAME": "app"}
+
+	tests := []struct {
+		name      string
+		patterns  []string
+		templated []string
+		wantErr   bool
+	}{
+		{
+			name:      "base name",
+			patterns:  []string{"*.tmpl"},
+			templated: []string{"/etc/app/app.conf.tmpl", "/usr/share/app/app.conf.tmpl"},
+		},
+		{
+			name:      "full path",
+			patterns:  []string{"/etc/app/*.conf"},
+			templated: []string{"/etc/app/app.conf"},
+		},
+		{
+			name:      "symlink",
+			patterns:  []string{"/etc/link.conf"},
+			templated: nil,
+		},
+		{
+			name:     "traversal",
+			patterns: []string{"/etc/../../*.conf"},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid pattern",
+			patterns: []string{"[.conf"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := t.TempDir()
+			for _, name := range files {
+				path := filepath.Join(rootfs, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatalf("while creating %s: %s", filepath.Dir(path), err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+					t.Fatalf("while writing %s: %s", path, err)
+				}
+			}
+			// a symlink to a file out of the rootfs is never followed
+			outside := filepath.Join(t.TempDir(), "outside.conf")
+			if err := os.WriteFile(outside, []byte(content), 0o644); err != nil {
+				t.Fatalf("while writing %s: %s", outside, err)
+			}
+			if err := os.Symlink(outside, filepath.Join(rootfs, "etc", "link.conf")); err != nil {
+				t.Fatalf("while creating symlink: %s", err)
+			}
+
+			r, err := TemplateFiles(rootfs, tt.patterns, vars)
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			} else if tt.wantErr {
+				t.Fatalf("unexpected success")
+			}
+
+			if !reflect.DeepEqual(r.Paths, tt.templated) {
+				t.Errorf("unexpected templated files %v, want %v", r.Paths, tt.templated)
+			}
+			want := make(map[string]bool)
+			for _, path := range tt.templated {
+				want[path] = true
+				if undefined := r.Undefined[path]; !reflect.DeepEqual(undefined, []string{"OTHER"}) {
+					t.Errorf("unexpected undefined variables of %s: %v", path, undefined)
+				}
+			}
+			for _, name := range files {
+				data, err := os.ReadFile(filepath.Join(rootfs, name))
+				if err != nil {
+					t.Fatalf("while reading %s: %s", name, err)
+				}
+				expected := content
+				if want["/"+name] {
+					expected = templated
+				}
+				if string(data) != expected {
+					t.Errorf("unexpected content of %s: %q, want %q", name, data, expected)
+				}
+				fi, err := os.Stat(filepath.Join(rootfs, name))
+				if err != nil {
+					t.Fatalf("while getting %s info: %s", name, err)
+				}
+				if fi.Mode().Perm() != 0o640 {
+					t.Errorf("unexpected permissions of %s: %o", name, fi.Mode().Perm())
+				}
+			}
+			if data, err := os.ReadFile(outside); err != nil || string(data) != content {
+				t.Errorf("unexpected content of the symlink target: %q (%v)", data, err)
+			}
+		})
+	}
+}
+
+func TestTemplateFilesReplace(t *testing.T) {
+	test.EnsurePrivilege(t)
+
+	rootfs := t.TempDir()
+	path := filepath.Join(rootfs, "app.conf")
+	if err := os.WriteFile(path, []byte("version={{ VERSION }}\n"), 0o600); err != nil {
+		t.Fatalf("while writing %s: %s", path, err)
+	}
+	if err := os.Chown(path, 1000, 100); err != nil {
+		t.Fatalf("while changing the owner of %s: %s", path, err)
+	}
+	if err := os.Chmod(path, os.ModeSetgid|0o750); err != nil {
+		t.Fatalf("while changing the mode of %s: %s", path, err)
+	}
+
+	if _, err := TemplateFiles(rootfs, []string{"*.conf"}, map[string]string{"VERSION": "1.2"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the templated file replaces the original one, with its mode and owner
+	if data, err := os.ReadFile(path); err != nil || string(data) != "version=1.2\n" {
+		t.Errorf("unexpected content of %s: %q (%v)", path, data, err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatalf("while getting %s info: %s", path, err)
+	}
+	if fi.Mode() != os.ModeSetgid|0o750 {
+		t.Errorf("unexpected mode %s, want %s", fi.Mode(), os.ModeSetgid|0o750)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 100 {
+		t.Errorf("unexpected owner %d:%d, want 1000:100", st.Uid, st.Gid)
+	}
+	entries, err := os.ReadDir(rootfs)
+	if err != nil {
+		t.Fatalf("while reading %s: %s", rootfs, err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("unexpected files left in %s: %v", rootfs, entries)
+	}
+}
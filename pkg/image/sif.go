@@ -24,6 +24,24 @@ const (
 	SIFDescOCIConfigJSON = "oci-config.json"
 	// SIFDescInspectMetadataJSON is the name of the SIF descriptor holding the container metadata.
 	SIFDescInspectMetadataJSON = "inspect-metadata.json"
+	// SIFDescProvenanceJSON is the name of the SIF descriptor holding the index of
+	// the OCI layers which provided each path of the root filesystem.
+	SIFDescProvenanceJSON = "provenance.json"
+	// SIFDescSBOMJSON is the name of the SIF descriptor holding the list of
+	// the packages installed in the root filesystem.
+	SIFDescSBOMJSON = "sbom.json"
+	// SIFDescOCIManifestJSON is the name of the SIF descriptor holding the
+	// manifest of the OCI image the container was built from, verbatim.
+	SIFDescOCIManifestJSON = "oci-manifest.json"
+	// SIFDescOCIImageConfigJSON is the name of the SIF descriptor holding the
+	// config of the OCI image the container was built from, verbatim.
+	SIFDescOCIImageConfigJSON = "oci-image-config.json"
+	// SIFDescBuildProvenanceJSON is the name of the SIF descriptor holding the
+	// provenance of the build of the container.
+	SIFDescBuildProvenanceJSON = "build-provenance.json"
+	// SIFDescLayerHistoryJSON is the name of the SIF descriptor holding the
+	// history of the layers of the OCI image the container was built from.
+	SIFDescLayerHistoryJSON = "layer-history.json"
 )
 
 type sifFormat struct{}
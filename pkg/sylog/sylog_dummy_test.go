@@ -13,6 +13,7 @@ package sylog
 
 import (
 	"io"
+	"os"
 	"testing"
 
 	"github.com/apptainer/apptainer/internal/pkg/test"
@@ -48,6 +49,9 @@ func TestWriter(t *testing.T) {
 	if w != io.Discard {
 		t.Fatalf("Writer() did not return io.Discard as expected")
 	}
+	if w := SetWriter(os.Stderr); w != io.Discard {
+		t.Fatalf("SetWriter() did not return io.Discard as expected")
+	}
 }
 
 func TestNoOps(t *testing.T) {
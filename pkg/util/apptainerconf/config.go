@@ -120,14 +120,18 @@ type File struct {
 	CniPluginPath             string   `directive:"cni plugin path"`
 	BinaryPath                string   `default:"$PATH:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin" directive:"binary path"`
 	// SuidBinaryPath is hidden; it is not referenced below, and overwritten
-	SuidBinaryPath      string `directive:"suidbinary path"`
-	MksquashfsProcs     uint   `default:"0" directive:"mksquashfs procs"`
-	MksquashfsMem       string `directive:"mksquashfs mem"`
-	ImageDriver         string `directive:"image driver"`
-	DownloadConcurrency uint   `default:"3" directive:"download concurrency"`
-	DownloadPartSize    uint   `default:"5242880" directive:"download part size"`
-	DownloadBufferSize  uint   `default:"32768" directive:"download buffer size"`
-	SystemdCgroups      bool   `default:"yes" authorized:"yes,no" directive:"systemd cgroups"`
+	SuidBinaryPath      string   `directive:"suidbinary path"`
+	MksquashfsProcs     uint     `default:"0" directive:"mksquashfs procs"`
+	MksquashfsMem       string   `directive:"mksquashfs mem"`
+	ImageDriver         string   `directive:"image driver"`
+	DownloadConcurrency uint     `default:"3" directive:"download concurrency"`
+	DownloadPartSize    uint     `default:"5242880" directive:"download part size"`
+	DownloadBufferSize  uint     `default:"32768" directive:"download buffer size"`
+	PullThroughCache    string   `directive:"docker pull-through cache"`
+	SharedBlobCache     string   `directive:"shared blob cache"`
+	AllowedRegistries   []string `directive:"allowed registries"`
+	RootUserImages      string   `default:"allow" authorized:"allow,warn,error" directive:"root user images"`
+	SystemdCgroups      bool     `default:"yes" authorized:"yes,no" directive:"systemd cgroups"`
 }
 
 // NOTE: if you think that we may want to change the default for any
@@ -525,6 +529,50 @@ download part size = {{ .DownloadPartSize }}
 # are enabled.
 download buffer size = {{ .DownloadBufferSize }}
 
+# DOCKER PULL-THROUGH CACHE: [STRING]
+# DEFAULT: Undefined
+# This option sets a pull-through cache of Docker Hub, a registry host with
+# an optional port and repository prefix, that the docker:// build sources
+# not naming their registry (e.g. docker://library/ubuntu) are resolved
+# through. It is overridden by the --pull-through-cache build option.
+# docker pull-through cache = cache.example.com:5000/dockerhub
+{{ if ne .PullThroughCache "" }}docker pull-through cache = {{ .PullThroughCache }}{{ end }}
+
+# SHARED BLOB CACHE: [STRING]
+# DEFAULT: Undefined
+# This option sets a directory of blobs shared by the builds of all of the
+# users, that the layers of the docker:// build sources are stored in once
+# downloaded and reused from. The directory must be owned by root, and have
+# the sticky bit when writable by a group or all of the users (e.g. mode
+# 1775), the blobs being validated against their digest when read. It is
+# overridden by the --shared-blob-cache build option.
+# shared blob cache = /var/cache/apptainer/blobs
+{{ if ne .SharedBlobCache "" }}shared blob cache = {{ .SharedBlobCache }}{{ end }}
+
+# ALLOWED REGISTRIES: [STRING]
+# DEFAULT: NULL
+# This option restricts the registries the docker://, oras:// and library://
+# images may be pulled from, by builds as well as pull, run and the other
+# commands, to the hosts listed, with an optional port. The hosts may hold
+# wildcards, e.g. *.example.com, and Docker Hub is docker.io. An image from
+# another registry is rejected before any request is sent. The
+# --allowed-registries build option may only restrict this list further.
+#allowed registries = docker.io, *.example.com
+{{ range $index, $registry := .AllowedRegistries }}
+{{- if eq $index 0 }}allowed registries = {{ else }}, {{ end }}{{$registry}}
+{{- end }}
+
+# ROOT USER IMAGES: [allow/warn/error]
+# DEFAULT: allow
+# This option selects how the builds handle the docker:// and oci build
+# sources whose image config runs them as root, not setting a USER or
+# setting root or uid 0, to enforce explicit non-root images:
+# - allow: build the image
+# - warn: build the image with a warning
+# - error: fail the build
+# The --allow-root-user build option builds the image anyway.
+root user images = {{ .RootUserImages }}
+
 # SYSTEMD CGROUPS: [BOOL]
 # DEFAULT: yes
 # Whether to use systemd to manage container cgroups. Required for rootless cgroups